@@ -0,0 +1,60 @@
+package juggler
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultAcceptQueueTimeout is the maximum time a handshake waits in
+// the accept queue if the server's AcceptQueueTimeout is 0.
+const DefaultAcceptQueueTimeout = time.Second
+
+// acquireSlot reserves a connection slot for a handshake served by
+// Upgrade, if the server has a MaxConns limit. If all slots are taken
+// and the accept queue is enabled, it waits for a slot to be released
+// for at most the AcceptQueueTimeout. It returns false if no slot
+// could be reserved, in which case the handshake must be refused,
+// otherwise releaseSlot must be called once the connection is closed.
+func (srv *Server) acquireSlot() bool {
+	if srv.slots == nil {
+		return true
+	}
+
+	select {
+	case srv.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	// all slots are taken, wait in the accept queue if there is room
+	if srv.AcceptQueueSize <= 0 {
+		return false
+	}
+	if n := atomic.AddInt32(&srv.queued, 1); n > int32(srv.AcceptQueueSize) {
+		atomic.AddInt32(&srv.queued, -1)
+		return false
+	}
+	defer atomic.AddInt32(&srv.queued, -1)
+	srv.vars.Add("QueuedConns", 1)
+
+	to := srv.AcceptQueueTimeout
+	if to <= 0 {
+		to = DefaultAcceptQueueTimeout
+	}
+	t := time.NewTimer(to)
+	defer t.Stop()
+
+	select {
+	case srv.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// releaseSlot releases a connection slot reserved by acquireSlot.
+func (srv *Server) releaseSlot() {
+	if srv.slots != nil {
+		<-srv.slots
+	}
+}
@@ -0,0 +1,123 @@
+package juggler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// AffinityHeader is the name of the HTTP response header that holds
+// the affinity token of the connection, if Server.Affinity is set.
+const AffinityHeader = "Juggler-Affinity"
+
+var (
+	// ErrInvalidAffinityToken is returned by Affinity.Validate when
+	// the token is malformed or its signature is invalid.
+	ErrInvalidAffinityToken = errors.New("juggler: invalid affinity token")
+
+	// ErrExpiredAffinityToken is returned by Affinity.Validate when
+	// the token is expired.
+	ErrExpiredAffinityToken = errors.New("juggler: expired affinity token")
+
+	// ErrMissingAffinityKey is returned by Affinity.Validate when its
+	// Key is empty, so that a misconfigured Affinity rejects all tokens
+	// instead of accepting the ones signed with an empty key, which
+	// anyone can forge.
+	ErrMissingAffinityKey = errors.New("juggler: missing affinity key")
+)
+
+// AffinityClaims is the information encoded in an affinity token.
+type AffinityClaims struct {
+	Instance string    `json:"instance"`
+	ConnUUID uuid.UUID `json:"conn_uuid"`
+	Expires  time.Time `json:"expires,omitempty"`
+}
+
+// Affinity generates and validates signed affinity tokens that
+// identify the server instance that served a connection. A load
+// balancer or a session-resumption mechanism can validate the token
+// presented by a reconnecting client to route it back to the same
+// instance.
+type Affinity struct {
+	// Instance is the identifier of this server instance, e.g. its
+	// address or host name. It is encoded in the tokens.
+	Instance string
+
+	// Key is the key used to sign the tokens with HMAC-SHA256. All
+	// instances that validate tokens must use the same key. It must
+	// not be empty, no token is generated or validated otherwise.
+	Key []byte
+
+	// TTL is the validity duration of the tokens. The default of 0
+	// means that tokens never expire.
+	TTL time.Duration
+}
+
+// Token returns a signed affinity token for the connection identified
+// by connUUID, served by this instance. It returns an empty string if
+// the Key of the Affinity is empty.
+func (a *Affinity) Token(connUUID uuid.UUID) string {
+	if len(a.Key) == 0 {
+		return ""
+	}
+
+	claims := AffinityClaims{Instance: a.Instance, ConnUUID: connUUID}
+	if a.TTL > 0 {
+		claims.Expires = time.Now().Add(a.TTL).UTC()
+	}
+
+	// marshaling the claims cannot fail
+	b, _ := json.Marshal(claims)
+	pld := base64.RawURLEncoding.EncodeToString(b)
+	return pld + "." + base64.RawURLEncoding.EncodeToString(a.sign(pld))
+}
+
+// Validate checks the signature and expiration of the token and
+// returns its claims if it is valid. It returns ErrMissingAffinityKey
+// if the Key of the Affinity is empty.
+func (a *Affinity) Validate(token string) (*AffinityClaims, error) {
+	if len(a.Key) == 0 {
+		return nil, ErrMissingAffinityKey
+	}
+
+	ix := strings.IndexByte(token, '.')
+	if ix < 0 {
+		return nil, ErrInvalidAffinityToken
+	}
+	pld, sig := token[:ix], token[ix+1:]
+
+	b, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(b, a.sign(pld)) {
+		return nil, ErrInvalidAffinityToken
+	}
+	if b, err = base64.RawURLEncoding.DecodeString(pld); err != nil {
+		return nil, ErrInvalidAffinityToken
+	}
+
+	var claims AffinityClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, ErrInvalidAffinityToken
+	}
+	if !claims.Expires.IsZero() && time.Now().After(claims.Expires) {
+		return nil, ErrExpiredAffinityToken
+	}
+	return &claims, nil
+}
+
+func (a *Affinity) sign(pld string) []byte {
+	mac := hmac.New(sha256.New, a.Key)
+	mac.Write([]byte(pld))
+	return mac.Sum(nil)
+}
+
+// AffinityToken returns the signed affinity token of the connection,
+// or an empty string if Server.Affinity is not set.
+func (c *Conn) AffinityToken() string {
+	return c.affinity
+}
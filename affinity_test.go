@@ -0,0 +1,73 @@
+package juggler
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mna/juggler/jugglertest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAffinity(t *testing.T) {
+	a := &Affinity{Instance: "srv1", Key: []byte("secret")}
+	connUUID := uuid.NewRandom()
+
+	tok := a.Token(connUUID)
+	claims, err := a.Validate(tok)
+	require.NoError(t, err, "Validate")
+	assert.Equal(t, "srv1", claims.Instance, "instance")
+	assert.Equal(t, connUUID, claims.ConnUUID, "conn UUID")
+	assert.True(t, claims.Expires.IsZero(), "no expiration")
+
+	// invalid tokens
+	other := &Affinity{Instance: "srv1", Key: []byte("other")}
+	for i, tok := range []string{"", "abc", "abc.def", tok + "x", other.Token(connUUID)} {
+		_, err := a.Validate(tok)
+		assert.Equal(t, ErrInvalidAffinityToken, err, "%d: invalid token", i)
+	}
+
+	// expired token
+	a.TTL = time.Millisecond
+	tok = a.Token(connUUID)
+	time.Sleep(2 * time.Millisecond)
+	_, err = a.Validate(tok)
+	assert.Equal(t, ErrExpiredAffinityToken, err, "expired token")
+
+	// no key, no token is generated and the tokens signed with an
+	// empty key are rejected
+	a = &Affinity{Instance: "srv1"}
+	assert.Equal(t, "", a.Token(connUUID), "no token without key")
+	pld := base64.RawURLEncoding.EncodeToString([]byte(`{"instance":"srv1"}`))
+	_, err = a.Validate(pld + "." + base64.RawURLEncoding.EncodeToString(a.sign(pld)))
+	assert.Equal(t, ErrMissingAffinityKey, err, "empty key")
+	a.Key = []byte{}
+	_, err = a.Validate(pld + "." + base64.RawURLEncoding.EncodeToString(a.sign(pld)))
+	assert.Equal(t, ErrMissingAffinityKey, err, "empty key slice")
+}
+
+func TestUpgradeAffinity(t *testing.T) {
+	a := &Affinity{Instance: "srv1", Key: []byte("secret")}
+	server := &Server{Affinity: a}
+	nextConn := connected(t, server)
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	l := jugglertest.StartPipeServer(Upgrade(upg, server))
+	defer l.Close()
+
+	wsc, res, err := l.Dialer(Subprotocols...).Dial(jugglertest.PipeURL, http.Header{"Juggler-Allowed-Messages": {"pub"}})
+	require.NoError(t, err, "Dial")
+	defer wsc.Close()
+
+	tok := res.Header.Get(AffinityHeader)
+	claims, err := a.Validate(tok)
+	require.NoError(t, err, "Validate")
+	assert.Equal(t, "srv1", claims.Instance, "instance")
+
+	c := nextConn()
+	assert.Equal(t, tok, c.AffinityToken(), "conn token")
+	assert.Equal(t, c.UUID, claims.ConnUUID, "conn UUID")
+}
@@ -0,0 +1,232 @@
+package juggler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrMissingToken is returned by JWTAuth.Authenticate when the
+	// request has no token.
+	ErrMissingToken = errors.New("juggler: missing authentication token")
+
+	// ErrInvalidToken is returned by JWTAuth.Validate when the token is
+	// malformed, its signature is invalid or its claims don't match the
+	// expected ones.
+	ErrInvalidToken = errors.New("juggler: invalid authentication token")
+
+	// ErrExpiredToken is returned by JWTAuth.Validate when the token is
+	// expired.
+	ErrExpiredToken = errors.New("juggler: expired authentication token")
+
+	// ErrMissingKey is returned by JWTAuth.Validate when its Key is
+	// empty, so that a misconfigured JWTAuth rejects all tokens instead
+	// of accepting the ones signed with an empty key.
+	ErrMissingKey = errors.New("juggler: missing JWT key")
+)
+
+// Identity is the authenticated identity of a connection.
+type Identity struct {
+	// Subject identifies the authenticated principal, e.g. the "sub"
+	// claim of a JWT.
+	Subject string
+
+	// Claims holds all the claims of the authentication token, as
+	// decoded from JSON.
+	Claims map[string]interface{}
+}
+
+// Authenticator defines the method required to authenticate the HTTP
+// request of a connection before it is upgraded to the websocket
+// protocol. Authenticate returns the identity of the client, or an
+// error if the request cannot be authenticated.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// JWTAuth is an Authenticator that validates JSON Web Tokens signed
+// with HMAC-SHA256, HMAC-SHA384 or HMAC-SHA512 (the HS256, HS384 and
+// HS512 algorithms). The token is read from the Authorization header
+// with the Bearer scheme, or from the QueryParam query string
+// parameter if it is set.
+type JWTAuth struct {
+	// Key is the key used to verify the signature of the tokens. It
+	// must be set, all tokens are rejected if it is empty.
+	Key []byte
+
+	// QueryParam is the name of the query string parameter that holds
+	// the token, for clients that cannot set the Authorization header
+	// (e.g. browsers). If it is empty, the token is only read from the
+	// header.
+	QueryParam string
+
+	// Issuer, if set, is the required value of the "iss" claim.
+	Issuer string
+
+	// Audience, if set, must be in the "aud" claim.
+	Audience string
+
+	// Leeway is the clock skew tolerated when validating the "exp" and
+	// "nbf" claims.
+	Leeway time.Duration
+}
+
+// Authenticate implements Authenticator for the JWTAuth. It returns
+// ErrMissingToken if the request has no token, otherwise it returns
+// the result of Validate.
+func (a *JWTAuth) Authenticate(r *http.Request) (*Identity, error) {
+	var token string
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		token = strings.TrimSpace(h[7:])
+	} else if a.QueryParam != "" {
+		token = r.URL.Query().Get(a.QueryParam)
+	}
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+	return a.Validate(token)
+}
+
+// Validate checks the signature and the registered claims of the
+// token and returns the identity it holds if it is valid. It returns
+// ErrMissingKey if the Key of the JWTAuth is empty.
+func (a *JWTAuth) Validate(token string) (*Identity, error) {
+	if len(a.Key) == 0 {
+		return nil, ErrMissingKey
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var hdr struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &hdr); err != nil {
+		return nil, ErrInvalidToken
+	}
+	var fn func() hash.Hash
+	switch hdr.Alg {
+	case "HS256":
+		fn = sha256.New
+	case "HS384":
+		fn = sha512.New384
+	case "HS512":
+		fn = sha512.New
+	default:
+		return nil, ErrInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	mac := hmac.New(fn, a.Key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil || claims == nil {
+		return nil, ErrInvalidToken
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	sub, _ := claims["sub"].(string)
+	return &Identity{Subject: sub, Claims: claims}, nil
+}
+
+// checkClaims validates the registered claims of a token.
+func (a *JWTAuth) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	if v, ok := claims["exp"]; ok {
+		exp, ok := v.(float64)
+		if !ok {
+			return ErrInvalidToken
+		}
+		if now.Add(-a.Leeway).After(unixTime(exp)) {
+			return ErrExpiredToken
+		}
+	}
+	if v, ok := claims["nbf"]; ok {
+		nbf, ok := v.(float64)
+		if !ok || now.Add(a.Leeway).Before(unixTime(nbf)) {
+			return ErrInvalidToken
+		}
+	}
+
+	if a.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.Issuer {
+			return ErrInvalidToken
+		}
+	}
+	if a.Audience != "" {
+		switch aud := claims["aud"].(type) {
+		case string:
+			if aud != a.Audience {
+				return ErrInvalidToken
+			}
+		case []interface{}:
+			var found bool
+			for _, v := range aud {
+				if s, _ := v.(string); s == a.Audience {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return ErrInvalidToken
+			}
+		default:
+			return ErrInvalidToken
+		}
+	}
+	return nil
+}
+
+// decodeJWTPart decodes the base64url-encoded JSON part of a token
+// into v.
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// unixTime returns the time corresponding to the NumericDate secs.
+func unixTime(secs float64) time.Time {
+	return time.Unix(0, int64(secs*float64(time.Second)))
+}
+
+// Identity returns the authenticated identity of the connection, or
+// nil if the Server has no Authenticator.
+func (c *Conn) Identity() *Identity {
+	return c.identity
+}
+
+// key of the identity in the context of the connection.
+type identityKey struct{}
+
+// IdentityFromContext returns the authenticated identity stored in
+// ctx, which is the identity of the connection in the context passed
+// to the Handler (see Conn.Context). It returns nil if there is no
+// identity.
+func IdentityFromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
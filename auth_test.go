@@ -0,0 +1,116 @@
+package juggler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mna/juggler/jugglertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signJWT returns a JWT with the alg header and the claims, always
+// signed with HMAC-SHA256 using key.
+func signJWT(t *testing.T, key []byte, alg string, claims map[string]interface{}) string {
+	hdr, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	require.NoError(t, err, "marshal header")
+	pld, err := json.Marshal(claims)
+	require.NoError(t, err, "marshal claims")
+
+	tok := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(pld)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(tok))
+	return tok + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthValidate(t *testing.T) {
+	key := []byte("secret")
+	a := &JWTAuth{Key: key, Issuer: "iss", Audience: "aud"}
+	now := time.Now().Unix()
+
+	valid := map[string]interface{}{"sub": "u1", "iss": "iss", "aud": "aud", "exp": now + 60, "role": "admin"}
+	id, err := a.Validate(signJWT(t, key, "HS256", valid))
+	require.NoError(t, err, "Validate")
+	assert.Equal(t, "u1", id.Subject, "subject")
+	assert.Equal(t, "admin", id.Claims["role"], "claim")
+
+	// audience in a list
+	_, err = a.Validate(signJWT(t, key, "HS256", map[string]interface{}{"iss": "iss", "aud": []string{"x", "aud"}}))
+	assert.NoError(t, err, "audience list")
+
+	cases := []struct {
+		tok string
+		err error
+	}{
+		{"", ErrInvalidToken},
+		{"a.b", ErrInvalidToken},
+		{"a.b.c", ErrInvalidToken},
+		{signJWT(t, []byte("other"), "HS256", valid), ErrInvalidToken},
+		{signJWT(t, key, "none", valid), ErrInvalidToken},
+		{signJWT(t, key, "HS256", map[string]interface{}{"iss": "x", "aud": "aud"}), ErrInvalidToken},
+		{signJWT(t, key, "HS256", map[string]interface{}{"iss": "iss", "aud": "x"}), ErrInvalidToken},
+		{signJWT(t, key, "HS256", map[string]interface{}{"iss": "iss", "aud": "aud", "exp": now - 60}), ErrExpiredToken},
+		{signJWT(t, key, "HS256", map[string]interface{}{"iss": "iss", "aud": "aud", "exp": "never"}), ErrInvalidToken},
+		{signJWT(t, key, "HS256", map[string]interface{}{"iss": "iss", "aud": "aud", "nbf": now + 60}), ErrInvalidToken},
+	}
+	for i, c := range cases {
+		_, err := a.Validate(c.tok)
+		assert.Equal(t, c.err, err, "%d", i)
+	}
+
+	// leeway
+	a.Leeway = 2 * time.Minute
+	_, err = a.Validate(signJWT(t, key, "HS256", map[string]interface{}{"iss": "iss", "aud": "aud", "exp": now - 60}))
+	assert.NoError(t, err, "expired within leeway")
+
+	// no key, the tokens signed with an empty key are rejected
+	a = &JWTAuth{}
+	_, err = a.Validate(signJWT(t, nil, "HS256", valid))
+	assert.Equal(t, ErrMissingKey, err, "empty key")
+	a.Key = []byte{}
+	_, err = a.Validate(signJWT(t, []byte{}, "HS256", valid))
+	assert.Equal(t, ErrMissingKey, err, "empty key slice")
+}
+
+func TestUpgradeAuthenticator(t *testing.T) {
+	key := []byte("secret")
+	server := &Server{
+		Authenticator: &JWTAuth{Key: key, QueryParam: "access_token"},
+	}
+	nextConn := connected(t, server)
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	l := jugglertest.StartPipeServer(Upgrade(upg, server))
+	defer l.Close()
+
+	hdr := http.Header{"Juggler-Allowed-Messages": {"pub"}}
+	_, res, err := l.Dialer(Subprotocols...).Dial(jugglertest.PipeURL, hdr)
+	require.Error(t, err, "Dial without token")
+	if assert.NotNil(t, res, "response") {
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "status code")
+	}
+
+	hdr.Set("Authorization", "Bearer "+signJWT(t, []byte("other"), "HS256", map[string]interface{}{"sub": "u1"}))
+	_, res, err = l.Dialer(Subprotocols...).Dial(jugglertest.PipeURL, hdr)
+	require.Error(t, err, "Dial with invalid token")
+	if assert.NotNil(t, res, "response") {
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "status code")
+	}
+
+	hdr.Del("Authorization")
+	tok := signJWT(t, key, "HS256", map[string]interface{}{"sub": "u1"})
+	wsc, _, err := l.Dialer(Subprotocols...).Dial(jugglertest.PipeURL+"?access_token="+tok, hdr)
+	require.NoError(t, err, "Dial with token")
+	defer wsc.Close()
+
+	c := nextConn()
+	if assert.NotNil(t, c.Identity(), "identity") {
+		assert.Equal(t, "u1", c.Identity().Subject, "subject")
+	}
+	assert.Equal(t, c.Identity(), IdentityFromContext(c.Context()), "identity in context")
+}
@@ -0,0 +1,77 @@
+package juggler
+
+import (
+	"errors"
+
+	"github.com/mna/juggler/message"
+)
+
+// errNotAuthorized is the error sent in the NACK of a request denied
+// by the Server's Authorizer when the Authorizer returned no error.
+var errNotAuthorized = errors.New("juggler: not authorized")
+
+// Authorizer defines the method required to authorize the requests of
+// a connection. Authorize is called with the connection, the type of
+// the request (CALL, PUB, SUB or UNSB) and the target of the request,
+// that is the URI of a CALL or the channel (or pattern) of a PUB, SUB
+// or UNSB. It returns true if the request is allowed, otherwise the
+// request is rejected with a NACK with code and err. If code is 0,
+// 403 is used, and if err is nil, a generic error is used.
+//
+// It is called concurrently for all connections, so it must be safe
+// for concurrent use.
+type Authorizer interface {
+	Authorize(c *Conn, t message.Type, target string) (ok bool, code int, err error)
+}
+
+// AuthorizerFunc is a function signature that implements the Authorizer
+// interface.
+type AuthorizerFunc func(*Conn, message.Type, string) (bool, int, error)
+
+// Authorize implements Authorizer for the AuthorizerFunc by calling the
+// function itself.
+func (f AuthorizerFunc) Authorize(c *Conn, t message.Type, target string) (bool, int, error) {
+	return f(c, t, target)
+}
+
+// authorize returns nil if the request m is allowed by the server's
+// Authorizer, or the NACK to send otherwise. A fan-out CALL is allowed
+// only if all its fan-out URIs are allowed.
+func (c *Conn) authorize(m message.Msg) *message.Nack {
+	az := c.srv.Authorizer
+	if az == nil {
+		return nil
+	}
+
+	var targets []string
+	switch m := m.(type) {
+	case *message.Call:
+		targets = []string{m.Payload.URI}
+		if len(m.Payload.FanOut) > 0 {
+			targets = m.Payload.FanOut
+		}
+	case *message.Pub:
+		targets = []string{m.Payload.Channel}
+	case *message.Sub:
+		targets = []string{m.Payload.Channel}
+	case *message.Unsb:
+		targets = []string{m.Payload.Channel}
+	default:
+		return nil
+	}
+
+	for _, target := range targets {
+		ok, code, err := az.Authorize(c, m.Type(), target)
+		if ok {
+			continue
+		}
+		if code == 0 {
+			code = 403
+		}
+		if err == nil {
+			err = errNotAuthorized
+		}
+		return message.NewNack(m, code, err)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package juggler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// BlobHandler returns an HTTP handler that serves the blobs stored in
+// store, identified by the ref query string parameter. It responds
+// with the blob as JSON, or with a 404 status code if the blob doesn't
+// exist or has expired. It can be used to resolve the references of
+// the arguments offloaded by the server (see Server.OffloadThreshold).
+// Anyone who knows the reference of a blob can read it, so it should
+// only be exposed to trusted clients, e.g. behind an authenticating
+// proxy.
+func BlobHandler(store broker.BlobStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ref := r.URL.Query().Get("ref")
+		if ref == "" {
+			http.Error(w, "missing ref", http.StatusBadRequest)
+			return
+		}
+
+		b, err := store.GetBlob(ref)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if err == broker.ErrBlobNotFound {
+				code = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
+
+// OffloadHeader is the name of the HTTP header used to negotiate the
+// offloading of the message arguments on a connection (see
+// Server.OffloadThreshold). The client sends the comma-separated list
+// of the offloading modes it supports, and Upgrade responds with the
+// mode selected for the connection, if any. OffloadBlob is the only
+// mode supported, for clients that resolve the blob references (see
+// client.SetBlobResolver).
+const OffloadHeader = "Juggler-Offload"
+
+// OffloadBlob is the offloading mode where the arguments are replaced
+// by the reference of a blob in the server's BlobStore.
+const OffloadBlob = "blob"
+
+var errNoBlobStore = errors.New("juggler: no blob store to resolve the arguments")
+
+// negotiateOffload returns true if the server offloads the arguments of
+// the messages and OffloadBlob is listed in the OffloadHeader of h.
+func (srv *Server) negotiateOffload(h http.Header) bool {
+	if srv.BlobStore == nil || srv.OffloadThreshold <= 0 {
+		return false
+	}
+	for _, v := range h[OffloadHeader] {
+		for _, mode := range strings.Split(v, ",") {
+			if strings.TrimSpace(strings.ToLower(mode)) == OffloadBlob {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// callTTL is the timeout of a pending call, and the time at which it
+// expires.
+type callTTL struct {
+	ttl      time.Duration
+	deadline time.Time
+}
+
+// trackCall records the timeout of the call id if offloading was
+// negotiated for the connection, so that the blob of its result
+// expires with the call (see offloadResult). As the result of a call
+// may never be received, the expired calls are removed periodically.
+func (c *Conn) trackCall(id uuid.UUID, timeout time.Duration) {
+	if !c.offloading {
+		return
+	}
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+
+	now := time.Now()
+	c.omu.Lock()
+	defer c.omu.Unlock()
+	if c.callTTLs == nil {
+		c.callTTLs = make(map[string]callTTL)
+	}
+	if now.After(c.nextSweep) {
+		for k, v := range c.callTTLs {
+			if now.After(v.deadline) {
+				delete(c.callTTLs, k)
+			}
+		}
+		c.nextSweep = now.Add(broker.DefaultCallTimeout)
+	}
+	c.callTTLs[id.String()] = callTTL{ttl: timeout, deadline: now.Add(timeout)}
+}
+
+// resultTTL returns the timeout of the call id, or
+// broker.DefaultCallTimeout if it is unknown. If done is true, the call
+// is no longer tracked.
+func (c *Conn) resultTTL(id uuid.UUID, done bool) time.Duration {
+	key := id.String()
+	c.omu.Lock()
+	defer c.omu.Unlock()
+	ct, ok := c.callTTLs[key]
+	if !ok {
+		return broker.DefaultCallTimeout
+	}
+	if done {
+		delete(c.callTTLs, key)
+	}
+	return ct.ttl
+}
+
+// offloadResult returns the RES or RCHK message m with its arguments
+// offloaded if offloading was negotiated for the connection, in a blob
+// that expires after the timeout of the call.
+func (c *Conn) offloadResult(m message.Msg) message.Msg {
+	if !c.offloading {
+		return m
+	}
+
+	var ttl time.Duration
+	switch m := m.(type) {
+	case *message.Res:
+		// the partial results of a fan-out call are followed by the
+		// combined result.
+		ttl = c.resultTTL(m.Payload.For, !m.Payload.Partial)
+	case *message.ResChunk:
+		ttl = c.resultTTL(m.Payload.For, false)
+	default:
+		return m
+	}
+	return c.offload(m, ttl)
+}
+
+// offload returns m with its arguments offloaded to the server's
+// BlobStore, in a blob that expires after ttl, if they are larger than
+// the server's OffloadThreshold. It returns m as-is if offloading
+// fails.
+func (c *Conn) offload(m message.Msg, ttl time.Duration) message.Msg {
+	store := c.srv.BlobStore
+	om, err := message.Offload(m, c.srv.OffloadThreshold, func(b []byte) (string, error) {
+		return store.PutBlob(b, ttl)
+	})
+	if err != nil {
+		c.srv.vars.Add("FailedOffloads", 1)
+		return m
+	}
+	if om != m {
+		c.srv.vars.Add("MsgsOffloaded", 1)
+	}
+	return om
+}
+
+// offloadPub offloads the arguments of the event pp to the server's
+// BlobStore if they are larger than the server's OffloadThreshold, so
+// that they are stored once for all the subscribers of the channel,
+// in a blob that expires after broker.DefaultCallTimeout. It leaves pp
+// as-is if offloading fails.
+func (c *Conn) offloadPub(pp *message.PubPayload) {
+	store := c.srv.BlobStore
+	if store == nil || c.srv.OffloadThreshold <= 0 || len(pp.Args) <= c.srv.OffloadThreshold {
+		return
+	}
+
+	ref, err := store.PutBlob(pp.Args, broker.DefaultCallTimeout)
+	if err != nil {
+		c.srv.vars.Add("FailedOffloads", 1)
+		return
+	}
+	c.srv.vars.Add("MsgsOffloaded", 1)
+	pp.Args = json.RawMessage("null")
+	pp.OffloadRef = ref
+}
+
+// resolveEvent resolves in-place the offloaded arguments of the event
+// m if offloading was not negotiated for the connection, or if the
+// connection has an event filter or transform, that may need the
+// arguments.
+func (c *Conn) resolveEvent(m *message.Evnt) error {
+	if m.Meta.R == "" {
+		return nil
+	}
+
+	c.emu.Lock()
+	hooks := c.evFilter != nil || c.evTransform != nil
+	c.emu.Unlock()
+	if c.offloading && !hooks {
+		return nil
+	}
+
+	store := c.srv.BlobStore
+	if store == nil {
+		return errNoBlobStore
+	}
+	return message.Resolve(m, store.GetBlob)
+}
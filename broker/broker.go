@@ -1,9 +1,13 @@
 // Package broker defines the generic interfaces that a broker must
 // implement in order to act as a juggler broker. The redisbroker
-// package implements those interfaces against a redis backend.
+// package implements those interfaces against a redis backend, the
+// natsbroker package against a NATS backend, and the inmembroker
+// package in memory, for single-process deployments and tests.
 package broker
 
 import (
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/mna/juggler/message"
@@ -17,6 +21,30 @@ import (
 // on the message. It should not be set to less than 1ms.
 var DefaultCallTimeout = time.Minute
 
+// PrefixURIs returns the prefix URIs that match uri, from the most
+// specific to the least specific. A prefix URI is a URI that ends
+// with ".*" and that matches all URIs that start with the part before
+// the "*", or "*" that matches all URIs. For example, the prefix URIs
+// of "billing.invoice.create" are "billing.invoice.*", "billing.*"
+// and "*".
+func PrefixURIs(uri string) []string {
+	parts := strings.Split(uri, ".")
+	res := make([]string, 0, len(parts))
+	for i := len(parts) - 1; i > 0; i-- {
+		res = append(res, strings.Join(parts[:i], ".")+".*")
+	}
+	return append(res, "*")
+}
+
+// ErrBlobNotFound is returned by BlobStore.GetBlob when the blob does
+// not exist or has expired.
+var ErrBlobNotFound = errors.New("juggler/broker: blob not found")
+
+// ErrDuplicate is returned by CallerBroker.Call and CalleeBroker.Result
+// when the call request or result was already registered, by a broker
+// that deduplicates them on their message UUID.
+var ErrDuplicate = errors.New("juggler/broker: duplicate call or result")
+
 // CallerBroker defines the methods for a broker in the caller role.
 type CallerBroker interface {
 	// NewResultsConn returns a new ResultsConn that can be used
@@ -32,10 +60,15 @@ type CalleeBroker interface {
 	// NewCallsConn returns a new CallsConn that can be used to
 	// process call requests for the specified URIs. For use in
 	// a redis cluster, all URIs must belong to the same
-	// cluster slot.
+	// cluster slot. Brokers that support prefix routing accept
+	// prefix URIs (see PrefixURIs) to process the call requests
+	// for all matching URIs.
 	NewCallsConn(uris ...string) (CallsConn, error)
 
-	// Result registers a call result in the broker.
+	// Result registers a call result in the broker. It is also used
+	// to register the chunks of a streamed result (see
+	// message.ResPayload.Chunk), that must be delivered to the
+	// ResultsConn of the caller in the same way as the result.
 	Result(rp *message.ResPayload, timeout time.Duration) error
 }
 
@@ -46,8 +79,142 @@ type PubSubBroker interface {
 	// events sent on subscribed channels.
 	NewPubSubConn() (PubSubConn, error)
 
-	// Publish publishes an event on the specified channel.
-	Publish(channel string, pp *message.PubPayload) error
+	// Publish publishes an event on the specified channel. It returns
+	// the number of subscribers the event was delivered to.
+	Publish(channel string, pp *message.PubPayload) (int, error)
+}
+
+// PubSubInfoBroker defines the optional methods for a broker in the
+// pub-sub role that can report information about the active channels.
+type PubSubInfoBroker interface {
+	// NumSub returns the number of subscribers for each of the
+	// specified channels. Pattern-based subscriptions are not counted.
+	NumSub(channels ...string) (map[string]int, error)
+
+	// Channels returns the list of active channels (channels with
+	// at least one subscriber) matching the glob-style pattern. If
+	// pattern is empty, all active channels are returned. Pattern-based
+	// subscriptions are not listed.
+	Channels(pattern string) ([]string, error)
+}
+
+// ReplayBroker defines the optional method for a broker in the pub-sub
+// role that stores the events published on durable channels, so that
+// a subscriber that was disconnected can receive the events it missed.
+// The events of a durable channel have an ID (see
+// message.EvntPayload.EventID) that identifies their position in the
+// channel.
+type ReplayBroker interface {
+	// Replay returns the events published on channel after the event
+	// identified by lastID, oldest first. If lastID is no longer
+	// retained by the broker, the retained events are returned. It
+	// returns nil if channel is not a durable channel.
+	Replay(channel, lastID string) ([]*message.EvntPayload, error)
+}
+
+// BlobStore defines the methods for a store of large payloads, so that
+// they can be passed by reference instead of by value in the calls,
+// results and events.
+type BlobStore interface {
+	// PutBlob stores b and returns the reference of the blob. The
+	// blob expires after ttl.
+	PutBlob(b []byte, ttl time.Duration) (string, error)
+
+	// GetBlob returns the blob identified by ref. It returns
+	// ErrBlobNotFound if the blob doesn't exist or has expired.
+	GetBlob(ref string) ([]byte, error)
+}
+
+// Pinger defines the optional method for a broker that can check
+// that its backend is reachable, e.g. for readiness probes.
+type Pinger interface {
+	// Ping checks that the broker's backend is reachable and returns
+	// an error if it isn't.
+	Ping() error
+}
+
+// Locker defines the optional method for a broker that provides
+// distributed locks, e.g. so that a single instance of a scheduler
+// fires each tick of a scheduled job.
+type Locker interface {
+	// TryLock acquires the lock identified by key for ttl. It returns
+	// false if the lock is already held.
+	TryLock(key string, ttl time.Duration) (bool, error)
+}
+
+// RoomsBroker defines the methods for a broker that stores the
+// membership of rooms. A room is a group of connections that receive
+// the events published on the room's channel, and whose members can
+// be listed.
+type RoomsBroker interface {
+	// Join adds the connection identified by connUUID to the room.
+	Join(room string, connUUID uuid.UUID) error
+
+	// Leave removes the connection identified by connUUID from the
+	// room.
+	Leave(room string, connUUID uuid.UUID) error
+
+	// Members returns the UUIDs of the connections that are members
+	// of the room.
+	Members(room string) ([]uuid.UUID, error)
+}
+
+// PresenceBroker defines the methods for a broker that maintains
+// presence sets shared by all servers. A presence set lists the
+// connections present on a channel. Each entry expires after a
+// time-to-live unless it is refreshed, so that the connections of
+// a server that crashed are eventually removed.
+type PresenceBroker interface {
+	// SetPresence adds or refreshes the connection identified by
+	// connUUID in the presence set of channel. The entry expires
+	// after ttl.
+	SetPresence(channel string, connUUID uuid.UUID, ttl time.Duration) error
+
+	// RemovePresence removes the connection identified by connUUID
+	// from the presence set of channel.
+	RemovePresence(channel string, connUUID uuid.UUID) error
+
+	// Presence returns the UUIDs of the connections present on
+	// channel, excluding expired entries.
+	Presence(channel string) ([]uuid.UUID, error)
+}
+
+// CalleeInfo describes a callee instance registered with a
+// HealthBroker.
+type CalleeInfo struct {
+	// ID uniquely identifies the callee instance.
+	ID string `json:"id"`
+
+	// URIs is the list of URIs served by the callee, which may include
+	// prefix URIs (see PrefixURIs).
+	URIs []string `json:"uris"`
+
+	// Workers is the number of concurrent workers of the callee.
+	Workers int `json:"workers"`
+
+	// LastSeen is the time of the last heartbeat of the callee, set by
+	// RegisterCallee.
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// HealthBroker defines the methods for a broker that maintains the
+// registry of live callees. Each callee instance refreshes its entry
+// with a heartbeat, and the entry expires after a time-to-live unless
+// it is refreshed, so that the callees that crashed are eventually
+// removed.
+type HealthBroker interface {
+	// RegisterCallee adds or refreshes the entry of the callee
+	// instance described by info, with its LastSeen set to the current
+	// time. The entry expires after ttl.
+	RegisterCallee(info *CalleeInfo, ttl time.Duration) error
+
+	// UnregisterCallee removes the entry of the callee instance
+	// identified by id.
+	UnregisterCallee(id string) error
+
+	// Callees returns the live callee instances, excluding expired
+	// entries.
+	Callees() ([]*CalleeInfo, error)
 }
 
 // ResultsConn defines the methods to list the results from calls
@@ -92,6 +259,18 @@ type CallsConn interface {
 	Close() error
 }
 
+// AckCallsConn is implemented by a CallsConn that processes the call
+// requests at least once: a call request that is not acknowledged
+// within some time after it was received, e.g. because the callee
+// crashed, is sent again to a callee.
+type AckCallsConn interface {
+	CallsConn
+
+	// Ack acknowledges that the call request cp, received from Calls,
+	// was processed.
+	Ack(cp *message.CallPayload) error
+}
+
 // PubSubConn defines the methods to manage subscriptions to events
 // for a connection.
 type PubSubConn interface {
@@ -0,0 +1,271 @@
+// Package inmembroker implements a juggler broker in memory, using Go
+// channels and timers, so that the server, the callees and the pub-sub
+// can run in a single process without redis, e.g. for single-process
+// deployments and for tests. As the state is not shared between
+// processes, all the components that use the broker must run in the
+// same process and use the same Broker value.
+//
+// It mirrors the behaviour of the redisbroker package: the call
+// requests are stored in a queue per URI and the results in a queue
+// per connection UUID, and each one expires after its timeout, when
+// it is removed from its queue. The calls and results with a priority
+// > 0 (see message.Meta) are processed before the others. The pub-sub
+// channels support glob-style patterns (see path.Match), or topic
+// filters if Topics is set.
+package inmembroker
+
+import (
+	"errors"
+	"log"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/pborman/uuid"
+)
+
+var (
+	// static check that *Broker implements the broker interfaces
+	_ broker.CallerBroker     = (*Broker)(nil)
+	_ broker.CalleeBroker     = (*Broker)(nil)
+	_ broker.PubSubBroker     = (*Broker)(nil)
+	_ broker.PubSubInfoBroker = (*Broker)(nil)
+	_ broker.HealthBroker     = (*Broker)(nil)
+	_ metrics.Setter          = (*Broker)(nil)
+)
+
+// DiscardLog is a no-op logging function that can be used as Broker.LogFunc
+// to disable logging.
+var DiscardLog = func(_ string, _ ...interface{}) {}
+
+// DefaultEventsBufferSize is the default number of events buffered for
+// each pub-sub connection.
+const DefaultEventsBufferSize = 1024
+
+var (
+	// errCapExceeded is returned when a call or result is registered
+	// in a queue that is full.
+	errCapExceeded = errors.New("juggler/inmembroker: queue capacity exceeded")
+
+	// errClosed is the error that caused the stream of a closed
+	// connection to close.
+	errClosed = errors.New("juggler/inmembroker: closed connection")
+)
+
+// Broker is a broker that keeps the calls, results and subscriptions
+// in memory. The zero value is ready to use. It must not be copied
+// after first use.
+type Broker struct {
+	// prevent unkeyed literals
+	_ struct{}
+
+	// LogFunc is the logging function to use. If nil, log.Printf
+	// is used. It can be set to DiscardLog to disable logging.
+	LogFunc func(string, ...interface{})
+
+	// CallCap is the capacity of the CALL queue per URI. If it is
+	// exceeded for a given URI, subsequent Broker.Call calls for that
+	// URI will fail with an error. The default of 0 means no limit.
+	CallCap int
+
+	// ResultCap is the capacity of the RES queue per connection UUID.
+	// If it is exceeded for a given connection, Broker.Result calls
+	// for that connection will fail with an error. The default of 0
+	// means no limit.
+	ResultCap int
+
+	// EventsBufferSize is the number of events buffered for each
+	// pub-sub connection. If the buffer of a connection is full, the
+	// events published for it are dropped. If it is 0,
+	// DefaultEventsBufferSize is used.
+	EventsBufferSize int
+
+	// Topics, if true, requires the channels to be topics and the
+	// patterns of the pattern-based subscriptions to be topic filters
+	// (see broker.ValidTopic and broker.ValidTopicFilter), and matches
+	// the patterns as topic filters instead of glob-style patterns, so
+	// that they behave the same as with the other brokers that support
+	// topics. Invalid channels and patterns are rejected with
+	// broker.ErrInvalidTopic.
+	Topics bool
+
+	// Vars can be set to a metrics.Sink (e.g. an *expvar.Map) to
+	// collect metrics about the broker. It should be set before
+	// starting to make calls with the broker. If it is not set, the
+	// broker uses the sink set by SetMetrics, if any.
+	Vars metrics.Sink
+
+	// mu protects the inherited sink set by SetMetrics.
+	mu        sync.Mutex
+	inherited metrics.Sink
+
+	// qmu protects the queues of calls and results.
+	qmu     sync.Mutex
+	calls   map[string]*queue // by URI
+	results map[string]*queue // by connection UUID
+
+	// psmu protects the pub-sub connections.
+	psmu sync.Mutex
+	pscs map[*pubSubConn]struct{}
+
+	// hmu protects the registry of live callees.
+	hmu     sync.Mutex
+	callees map[string]calleeEntry // by ID
+}
+
+// SetMetrics sets the metrics sink used by the broker if Vars is not
+// set. It is called by the juggler.Server with its own sink, so that
+// the broker metrics are collected along with the server's.
+func (b *Broker) SetMetrics(s metrics.Sink) {
+	b.mu.Lock()
+	if b.inherited == nil {
+		b.inherited = s
+	}
+	b.mu.Unlock()
+}
+
+// metrics returns the metrics sink of the broker, never nil.
+func (b *Broker) metrics() metrics.Sink {
+	if !metrics.IsNil(b.Vars) {
+		return b.Vars
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return metrics.Or(b.inherited)
+}
+
+// Call registers a call request in the broker.
+func (b *Broker) Call(cp *message.CallPayload, timeout time.Duration) error {
+	return b.push(&b.calls, cp.URI, cp, cp.Priority, timeout, b.CallCap, "ExpiredCalls")
+}
+
+// Result registers a call result in the broker.
+func (b *Broker) Result(rp *message.ResPayload, timeout time.Duration) error {
+	return b.push(&b.results, rp.ConnUUID.String(), rp, rp.Priority, timeout, b.ResultCap, "ExpiredResults")
+}
+
+// Publish publishes an event to a channel. It returns the number of
+// subscriptions that received the event, counting each matching
+// pattern-based subscription.
+func (b *Broker) Publish(channel string, pp *message.PubPayload) (int, error) {
+	if b.Topics {
+		if err := broker.ValidTopic(channel); err != nil {
+			return 0, err
+		}
+	}
+
+	b.psmu.Lock()
+	defer b.psmu.Unlock()
+
+	var n int
+	for psc := range b.pscs {
+		n += psc.publish(channel, pp)
+	}
+	return n, nil
+}
+
+// NumSub returns the number of subscribers for each of the channels.
+// Pattern-based subscriptions are not counted.
+func (b *Broker) NumSub(channels ...string) (map[string]int, error) {
+	res := make(map[string]int, len(channels))
+	for _, ch := range channels {
+		res[ch] = 0
+	}
+
+	b.psmu.Lock()
+	defer b.psmu.Unlock()
+	for psc := range b.pscs {
+		psc.smu.Lock()
+		for _, ch := range channels {
+			if psc.channels[ch] {
+				res[ch]++
+			}
+		}
+		psc.smu.Unlock()
+	}
+	return res, nil
+}
+
+// Channels returns the active channels matching the glob-style pattern
+// (see path.Match), or all active channels if pattern is empty.
+// Pattern-based subscriptions are not listed.
+func (b *Broker) Channels(pattern string) ([]string, error) {
+	seen := make(map[string]bool)
+	var res []string
+
+	b.psmu.Lock()
+	defer b.psmu.Unlock()
+	for psc := range b.pscs {
+		psc.smu.Lock()
+		for ch := range psc.channels {
+			if seen[ch] {
+				continue
+			}
+			if pattern != "" {
+				if ok, err := path.Match(pattern, ch); !ok || err != nil {
+					continue
+				}
+			}
+			seen[ch] = true
+			res = append(res, ch)
+		}
+		psc.smu.Unlock()
+	}
+	return res, nil
+}
+
+// NewPubSubConn returns a new pub-sub connection that can be used
+// to subscribe to and unsubscribe from channels, and to process
+// incoming events.
+func (b *Broker) NewPubSubConn() (broker.PubSubConn, error) {
+	size := b.EventsBufferSize
+	if size <= 0 {
+		size = DefaultEventsBufferSize
+	}
+	psc := &pubSubConn{
+		b:        b,
+		logFn:    b.LogFunc,
+		vars:     b.metrics(),
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+		in:       make(chan *message.EvntPayload, size),
+		done:     make(chan struct{}),
+	}
+
+	b.psmu.Lock()
+	if b.pscs == nil {
+		b.pscs = make(map[*pubSubConn]struct{})
+	}
+	b.pscs[psc] = struct{}{}
+	b.psmu.Unlock()
+	return psc, nil
+}
+
+// NewCallsConn returns a new calls connection that can be used
+// to process the call requests for the specified URIs.
+func (b *Broker) NewCallsConn(uris ...string) (broker.CallsConn, error) {
+	c := &callsConn{
+		pollConn: newPollConn(b, &b.calls, uris),
+	}
+	return c, nil
+}
+
+// NewResultsConn returns a new results connection that can be used
+// to process the call results for the specified connection UUID.
+func (b *Broker) NewResultsConn(connUUID uuid.UUID) (broker.ResultsConn, error) {
+	c := &resultsConn{
+		pollConn: newPollConn(b, &b.results, []string{connUUID.String()}),
+	}
+	return c, nil
+}
+
+func logf(fn func(string, ...interface{}), f string, args ...interface{}) {
+	if fn != nil {
+		fn(f, args...)
+	} else {
+		log.Printf(f, args...)
+	}
+}
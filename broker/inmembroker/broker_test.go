@@ -0,0 +1,272 @@
+package inmembroker
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/jugglertest"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalls(t *testing.T) {
+	snap := jugglertest.SnapshotGoroutines()
+	brk := &Broker{}
+
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection")
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		uuids []uuid.UUID
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for cp := range cc.Calls() {
+			assert.True(t, cp.TTLAfterRead > 0, "TTLAfterRead is set")
+			assert.False(t, cp.ReadTimestamp.IsZero(), "ReadTimestamp is set")
+			mu.Lock()
+			uuids = append(uuids, cp.MsgUUID)
+			mu.Unlock()
+		}
+	}()
+
+	cases := []struct {
+		cp  *message.CallPayload
+		exp bool
+	}{
+		{&message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}, true},
+		{&message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "b"}, false},
+		{&message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}, true},
+	}
+	var expected []uuid.UUID
+	for i, c := range cases {
+		if c.exp {
+			expected = append(expected, c.cp.MsgUUID)
+		}
+		require.NoError(t, brk.Call(c.cp, time.Second), "Call %d", i)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, cc.Close(), "close calls connection")
+	wg.Wait()
+	assert.Equal(t, errClosed, cc.CallsErr(), "CallsErr returns the error")
+	mu.Lock()
+	assert.Equal(t, expected, uuids, "got expected UUIDs")
+	mu.Unlock()
+
+	snap.AssertNoLeak(t, time.Second)
+}
+
+func TestCallsPriority(t *testing.T) {
+	brk := &Broker{}
+
+	var expected []uuid.UUID
+	low := &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "a"}
+	high := &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "a", Priority: 1}
+	require.NoError(t, brk.Call(low, time.Second), "Call low")
+	require.NoError(t, brk.Call(high, time.Second), "Call high")
+	expected = append(expected, high.MsgUUID, low.MsgUUID)
+
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection")
+	defer cc.Close()
+
+	var got []uuid.UUID
+	for len(got) < len(expected) {
+		select {
+		case cp := <-cc.Calls():
+			got = append(got, cp.MsgUUID)
+		case <-time.After(time.Second):
+			require.FailNow(t, "no call received")
+		}
+	}
+	assert.Equal(t, expected, got, "high priority call is received first")
+}
+
+func TestCallsExpiration(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	brk := &Broker{Vars: vars, CallCap: 1}
+
+	cp := &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Call(cp, 10*time.Millisecond), "Call")
+	assert.Equal(t, errCapExceeded, brk.Call(cp, time.Second), "Call over capacity")
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "1", vars.Get("ExpiredCalls").String(), "ExpiredCalls")
+
+	// the queue is removed once empty
+	brk.qmu.Lock()
+	assert.Equal(t, 0, len(brk.calls), "no more queues")
+	brk.qmu.Unlock()
+
+	// the capacity is available again
+	assert.NoError(t, brk.Call(cp, time.Second), "Call after expiration")
+}
+
+func TestResults(t *testing.T) {
+	snap := jugglertest.SnapshotGoroutines()
+	brk := &Broker{}
+
+	connUUID := uuid.NewRandom()
+	rc, err := brk.NewResultsConn(connUUID)
+	require.NoError(t, err, "get Results connection")
+
+	rp := &message.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Result(rp, time.Second), "Result")
+	require.NoError(t, brk.Result(&message.ResPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom()}, time.Second), "Result other conn")
+
+	select {
+	case got := <-rc.Results():
+		assert.Equal(t, rp.MsgUUID, got.MsgUUID, "received result")
+	case <-time.After(time.Second):
+		assert.Fail(t, "no result received")
+	}
+
+	require.NoError(t, rc.Close(), "close results connection")
+	_, ok := <-rc.Results()
+	assert.False(t, ok, "Results channel is closed")
+	assert.Equal(t, errClosed, rc.ResultsErr(), "ResultsErr returns the error")
+
+	snap.AssertNoLeak(t, time.Second)
+}
+
+func TestPubSub(t *testing.T) {
+	snap := jugglertest.SnapshotGoroutines()
+	brk := &Broker{}
+
+	psc1, err := brk.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn 1")
+	psc2, err := brk.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn 2")
+
+	require.NoError(t, psc1.Subscribe("a", false), "Subscribe a")
+	require.NoError(t, psc1.Subscribe("a*", true), "Subscribe a*")
+	require.NoError(t, psc2.Subscribe("b", false), "Subscribe b")
+	require.NoError(t, psc2.Subscribe("a", false), "Subscribe a")
+	assert.Error(t, psc2.Subscribe("[", true), "invalid pattern")
+
+	n, err := brk.Publish("a", &message.PubPayload{MsgUUID: uuid.NewRandom(), Args: []byte(`1`)})
+	require.NoError(t, err, "Publish a")
+	assert.Equal(t, 3, n, "Publish a subscriptions")
+	n, err = brk.Publish("ab", &message.PubPayload{MsgUUID: uuid.NewRandom()})
+	require.NoError(t, err, "Publish ab")
+	assert.Equal(t, 1, n, "Publish ab subscriptions")
+
+	nums, err := brk.NumSub("a", "b", "c")
+	require.NoError(t, err, "NumSub")
+	assert.Equal(t, map[string]int{"a": 2, "b": 1, "c": 0}, nums, "NumSub")
+	chans, err := brk.Channels("")
+	require.NoError(t, err, "Channels")
+	sort.Strings(chans)
+	assert.Equal(t, []string{"a", "b"}, chans, "Channels")
+	chans, err = brk.Channels("b*")
+	require.NoError(t, err, "Channels b*")
+	assert.Equal(t, []string{"b"}, chans, "Channels b*")
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		select {
+		case ep := <-psc1.Events():
+			got = append(got, ep.Channel+":"+ep.Pattern)
+		case <-time.After(time.Second):
+			require.FailNow(t, "no event received")
+		}
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{"a:", "a:a*", "ab:a*"}, got, "events received by psc1")
+
+	select {
+	case ep := <-psc2.Events():
+		assert.Equal(t, "a", ep.Channel, "event received by psc2")
+	case <-time.After(time.Second):
+		assert.Fail(t, "no event received by psc2")
+	}
+
+	require.NoError(t, psc2.Unsubscribe("a", false), "Unsubscribe a")
+	n, err = brk.Publish("a", &message.PubPayload{MsgUUID: uuid.NewRandom()})
+	require.NoError(t, err, "Publish a after Unsubscribe")
+	assert.Equal(t, 2, n, "Publish a after Unsubscribe")
+
+	require.NoError(t, psc1.Close(), "Close psc1")
+	require.NoError(t, psc2.Close(), "Close psc2")
+	for range psc1.Events() {
+	}
+	assert.Equal(t, errClosed, psc1.EventsErr(), "EventsErr")
+	assert.Equal(t, errClosed, psc1.Subscribe("a", false), "Subscribe after Close")
+
+	n, err = brk.Publish("a", &message.PubPayload{MsgUUID: uuid.NewRandom()})
+	require.NoError(t, err, "Publish a after Close")
+	assert.Equal(t, 0, n, "Publish a after Close")
+
+	snap.AssertNoLeak(t, time.Second)
+}
+
+func TestPubSubTopics(t *testing.T) {
+	brk := &Broker{Topics: true}
+	psc, err := brk.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn")
+	defer psc.Close()
+
+	require.NoError(t, psc.Subscribe("a.+", true), "Subscribe a.+")
+	require.NoError(t, psc.Subscribe("a.#", true), "Subscribe a.#")
+	require.NoError(t, psc.Subscribe("a", false), "Subscribe a")
+	assert.Equal(t, broker.ErrInvalidTopic, psc.Subscribe("a*", true), "glob pattern")
+	assert.Equal(t, broker.ErrInvalidTopic, psc.Subscribe("a.+", false), "wildcard channel")
+
+	_, err = brk.Publish("a.+", &message.PubPayload{MsgUUID: uuid.NewRandom()})
+	assert.Equal(t, broker.ErrInvalidTopic, err, "Publish to wildcard channel")
+
+	cases := []struct {
+		channel string
+		exp     int
+	}{
+		{"a", 2},     // a, a.#
+		{"a.b", 2},   // a.+, a.#
+		{"a.b.c", 1}, // a.#
+		{"ab", 0},
+	}
+	var total int
+	for _, c := range cases {
+		n, err := brk.Publish(c.channel, &message.PubPayload{MsgUUID: uuid.NewRandom()})
+		require.NoError(t, err, "Publish %s", c.channel)
+		assert.Equal(t, c.exp, n, "Publish %s subscriptions", c.channel)
+		total += n
+	}
+
+	var got []string
+	for i := 0; i < total; i++ {
+		select {
+		case ep := <-psc.Events():
+			got = append(got, ep.Channel+":"+ep.Pattern)
+		case <-time.After(time.Second):
+			require.FailNow(t, "no event received")
+		}
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{"a.b.c:a.#", "a.b:a.#", "a.b:a.+", "a:", "a:a.#"}, got, "events")
+}
+
+func TestPubSubDroppedEvents(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	brk := &Broker{Vars: vars, EventsBufferSize: 1, LogFunc: DiscardLog}
+
+	psc, err := brk.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn")
+	defer psc.Close()
+	require.NoError(t, psc.Subscribe("a", false), "Subscribe")
+
+	for i := 0; i < 3; i++ {
+		_, err := brk.Publish("a", &message.PubPayload{MsgUUID: uuid.NewRandom()})
+		require.NoError(t, err, "Publish %d", i)
+	}
+	assert.Equal(t, "2", vars.Get("DroppedEvents").String(), "DroppedEvents")
+}
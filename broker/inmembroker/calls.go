@@ -0,0 +1,60 @@
+package inmembroker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+)
+
+var _ broker.CallsConn = (*callsConn)(nil)
+
+type callsConn struct {
+	*pollConn
+
+	// once makes sure only the first call to Calls starts the goroutine.
+	once sync.Once
+	ch   chan *message.CallPayload
+}
+
+// CallsErr returns the error that caused the Calls channel to close.
+func (c *callsConn) CallsErr() error {
+	return c.getErr()
+}
+
+// Calls returns a stream of call requests for the URIs specified when
+// creating the callsConn.
+func (c *callsConn) Calls() <-chan *message.CallPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *message.CallPayload)
+		go c.pollCalls()
+	})
+
+	return c.ch
+}
+
+func (c *callsConn) pollCalls() {
+	defer close(c.ch)
+
+	vars := c.b.metrics()
+	for offset := 0; ; offset++ {
+		pld, ttl, ok := c.next(offset)
+		if !ok {
+			return
+		}
+
+		// copy the payload, it is owned by the callee once received
+		cp := *pld.(*message.CallPayload)
+		cp.ReadTimestamp = time.Now().UTC()
+		cp.TTLAfterRead = ttl
+		select {
+		case c.ch <- &cp:
+			metrics.AddExemplar(vars, "Calls", 1, cp.CorrelationID)
+		case <-c.done:
+			c.setErr(errClosed)
+			return
+		}
+	}
+}
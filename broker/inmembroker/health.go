@@ -0,0 +1,60 @@
+package inmembroker
+
+import (
+	"time"
+
+	"github.com/mna/juggler/broker"
+)
+
+// calleeEntry is the entry of a live callee in the registry.
+type calleeEntry struct {
+	info    broker.CalleeInfo
+	expires time.Time
+}
+
+// RegisterCallee adds or refreshes the entry of the callee instance
+// described by info. The entry expires after ttl.
+func (b *Broker) RegisterCallee(info *broker.CalleeInfo, ttl time.Duration) error {
+	now := time.Now()
+	ci := *info
+	ci.URIs = append([]string(nil), info.URIs...)
+	ci.LastSeen = now
+
+	b.hmu.Lock()
+	defer b.hmu.Unlock()
+
+	if b.callees == nil {
+		b.callees = make(map[string]calleeEntry)
+	}
+	b.callees[ci.ID] = calleeEntry{info: ci, expires: now.Add(ttl)}
+	return nil
+}
+
+// UnregisterCallee removes the entry of the callee instance identified
+// by id.
+func (b *Broker) UnregisterCallee(id string) error {
+	b.hmu.Lock()
+	delete(b.callees, id)
+	b.hmu.Unlock()
+	return nil
+}
+
+// Callees returns the live callee instances, in no particular order.
+// Expired entries are removed from the registry.
+func (b *Broker) Callees() ([]*broker.CalleeInfo, error) {
+	now := time.Now()
+
+	b.hmu.Lock()
+	defer b.hmu.Unlock()
+
+	infos := make([]*broker.CalleeInfo, 0, len(b.callees))
+	for id, e := range b.callees {
+		if !now.Before(e.expires) {
+			delete(b.callees, id)
+			continue
+		}
+		ci := e.info
+		infos = append(infos, &ci)
+	}
+	return infos, nil
+}
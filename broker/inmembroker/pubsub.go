@@ -0,0 +1,185 @@
+package inmembroker
+
+import (
+	"path"
+	"sync"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+)
+
+var _ broker.PubSubConn = (*pubSubConn)(nil)
+
+type pubSubConn struct {
+	b     *Broker
+	logFn func(string, ...interface{})
+	vars  metrics.Sink
+
+	// smu protects the subscriptions.
+	smu      sync.Mutex
+	channels map[string]bool
+	patterns map[string]bool
+
+	// events published for the connection, buffered.
+	in chan *message.EvntPayload
+
+	closeOnce sync.Once
+	done      chan struct{}
+
+	// once makes sure only the first call to Events starts the goroutine.
+	once sync.Once
+	evch chan *message.EvntPayload
+
+	// errmu protects access to err.
+	errmu sync.Mutex
+	err   error
+}
+
+// Close closes the connection.
+func (c *pubSubConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.b.psmu.Lock()
+		delete(c.b.pscs, c)
+		c.b.psmu.Unlock()
+		close(c.done)
+	})
+	return nil
+}
+
+// Subscribe subscribes the connection to the channel, which may be a
+// glob-style pattern (see path.Match), or a topic filter if the broker
+// has Topics set.
+func (c *pubSubConn) Subscribe(channel string, pattern bool) error {
+	select {
+	case <-c.done:
+		return errClosed
+	default:
+	}
+
+	if c.b.Topics {
+		if err := broker.ValidateTopicSub(channel, pattern); err != nil {
+			return err
+		}
+	} else if pattern {
+		if _, err := path.Match(channel, ""); err != nil {
+			return err
+		}
+	}
+
+	c.smu.Lock()
+	if pattern {
+		c.patterns[channel] = true
+	} else {
+		c.channels[channel] = true
+	}
+	c.smu.Unlock()
+	return nil
+}
+
+// Unsubscribe unsubscribes the connection from the channel, which may
+// be a pattern.
+func (c *pubSubConn) Unsubscribe(channel string, pattern bool) error {
+	c.smu.Lock()
+	if pattern {
+		delete(c.patterns, channel)
+	} else {
+		delete(c.channels, channel)
+	}
+	c.smu.Unlock()
+	return nil
+}
+
+// publish sends the event to the connection for each of its matching
+// subscriptions, and returns the number of matching subscriptions.
+func (c *pubSubConn) publish(channel string, pp *message.PubPayload) int {
+	c.smu.Lock()
+	var pats []string
+	sub := c.channels[channel]
+	for pat := range c.patterns {
+		if c.match(pat, channel) {
+			pats = append(pats, pat)
+		}
+	}
+	c.smu.Unlock()
+
+	var n int
+	if sub {
+		c.send(channel, "", pp)
+		n++
+	}
+	for _, pat := range pats {
+		c.send(channel, pat, pp)
+		n++
+	}
+	return n
+}
+
+// match returns true if the pattern pat matches channel.
+func (c *pubSubConn) match(pat, channel string) bool {
+	if c.b.Topics {
+		return broker.MatchTopic(pat, channel)
+	}
+	ok, _ := path.Match(pat, channel)
+	return ok
+}
+
+func (c *pubSubConn) send(channel, pattern string, pp *message.PubPayload) {
+	ep := &message.EvntPayload{
+		MsgUUID:       pp.MsgUUID,
+		Channel:       channel,
+		Pattern:       pattern,
+		Args:          pp.Args,
+		CorrelationID: pp.CorrelationID,
+		Priority:      pp.Priority,
+		Binary:        pp.Binary,
+		OffloadRef:    pp.OffloadRef,
+	}
+	select {
+	case c.in <- ep:
+	default:
+		c.vars.Add("DroppedEvents", 1)
+		logf(c.logFn, "Events: buffer full, dropping event %v on %s [%s]", ep.MsgUUID, channel, ep.CorrelationID)
+	}
+}
+
+// Events returns the stream of events from channels that the
+// connection is subscribed to.
+func (c *pubSubConn) Events() <-chan *message.EvntPayload {
+	c.once.Do(func() {
+		c.evch = make(chan *message.EvntPayload)
+		go c.listen()
+	})
+
+	return c.evch
+}
+
+func (c *pubSubConn) listen() {
+	defer close(c.evch)
+
+	for {
+		select {
+		case ep := <-c.in:
+			select {
+			case c.evch <- ep:
+				metrics.AddExemplar(c.vars, "Events", 1, ep.CorrelationID)
+				continue
+			case <-c.done:
+			}
+		case <-c.done:
+		}
+
+		c.errmu.Lock()
+		c.err = errClosed
+		c.errmu.Unlock()
+		return
+	}
+}
+
+// EventsErr returns the error that caused the events channel to close.
+func (c *pubSubConn) EventsErr() error {
+	c.errmu.Lock()
+	err := c.err
+	c.errmu.Unlock()
+	return err
+}
@@ -0,0 +1,215 @@
+package inmembroker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+)
+
+// queue is a queue of call requests or results.
+type queue struct {
+	items   []*item
+	waiters map[chan struct{}]struct{} // signaled when an item is pushed
+}
+
+// item is a call request or result in a queue, removed when it expires.
+type item struct {
+	pld      interface{}
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// push adds pld to the queue identified by key in qs. It expires after
+// timeout, in which case the expired metric is incremented.
+func (b *Broker) push(qs *map[string]*queue, key string, pld interface{}, priority int, timeout time.Duration, cap int, expired string) error {
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+
+	b.qmu.Lock()
+	defer b.qmu.Unlock()
+
+	q := b.queue(qs, key)
+	if cap > 0 && len(q.items) >= cap {
+		return errCapExceeded
+	}
+
+	it := &item{pld: pld, deadline: time.Now().Add(timeout)}
+	if priority > 0 {
+		q.items = append([]*item{it}, q.items...)
+	} else {
+		q.items = append(q.items, it)
+	}
+	it.timer = time.AfterFunc(timeout, func() {
+		if b.remove(qs, key, it) {
+			b.metrics().Add(expired, 1)
+		}
+	})
+
+	for w := range q.waiters {
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// pop removes and returns the first item of the first non-empty queue
+// identified by keys in qs, starting at offset, along with its
+// remaining time-to-live. It returns false if all queues are empty.
+func (b *Broker) pop(qs *map[string]*queue, keys []string, offset int) (interface{}, time.Duration, bool) {
+	b.qmu.Lock()
+	defer b.qmu.Unlock()
+
+	for i := range keys {
+		key := keys[(i+offset)%len(keys)]
+		q := (*qs)[key]
+		if q == nil || len(q.items) == 0 {
+			continue
+		}
+
+		it := q.items[0]
+		q.items[0] = nil
+		q.items = q.items[1:]
+		it.timer.Stop()
+		b.release(qs, key, q)
+
+		// the timer may not have fired yet for an expired item
+		ttl := it.deadline.Sub(time.Now())
+		if ttl <= 0 {
+			ttl = time.Nanosecond
+		}
+		return it.pld, ttl, true
+	}
+	return nil, 0, false
+}
+
+// remove removes it from the queue identified by key in qs. It returns
+// true if it was in the queue.
+func (b *Broker) remove(qs *map[string]*queue, key string, it *item) bool {
+	b.qmu.Lock()
+	defer b.qmu.Unlock()
+
+	q := (*qs)[key]
+	if q == nil {
+		return false
+	}
+	for i, qit := range q.items {
+		if qit == it {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			b.release(qs, key, q)
+			return true
+		}
+	}
+	return false
+}
+
+// queue returns the queue identified by key in qs, creating it if
+// needed. The qmu lock must be held.
+func (b *Broker) queue(qs *map[string]*queue, key string) *queue {
+	if *qs == nil {
+		*qs = make(map[string]*queue)
+	}
+	q := (*qs)[key]
+	if q == nil {
+		q = &queue{waiters: make(map[chan struct{}]struct{})}
+		(*qs)[key] = q
+	}
+	return q
+}
+
+// release deletes the queue identified by key in qs if it is not used
+// anymore. The qmu lock must be held.
+func (b *Broker) release(qs *map[string]*queue, key string, q *queue) {
+	if len(q.items) == 0 && len(q.waiters) == 0 {
+		delete(*qs, key)
+	}
+}
+
+// pollConn is the common implementation of the calls and results
+// connections, that wait for the items pushed to their queues.
+type pollConn struct {
+	b    *Broker
+	qs   *map[string]*queue
+	keys []string
+	wake chan struct{}
+
+	closeOnce sync.Once
+	done      chan struct{}
+
+	// errmu protects access to err.
+	errmu sync.Mutex
+	err   error
+}
+
+func newPollConn(b *Broker, qs *map[string]*queue, keys []string) *pollConn {
+	c := &pollConn{
+		b:    b,
+		qs:   qs,
+		keys: keys,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+
+	b.qmu.Lock()
+	for _, key := range keys {
+		b.queue(qs, key).waiters[c.wake] = struct{}{}
+	}
+	b.qmu.Unlock()
+	return c
+}
+
+// Close closes the connection.
+func (c *pollConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.b.qmu.Lock()
+		for _, key := range c.keys {
+			if q := (*c.qs)[key]; q != nil {
+				delete(q.waiters, c.wake)
+				c.b.release(c.qs, key, q)
+			}
+		}
+		c.b.qmu.Unlock()
+	})
+	return nil
+}
+
+// next waits for the next item of the queues of the connection, and
+// returns it along with its remaining time-to-live. It returns false
+// if the connection is closed.
+func (c *pollConn) next(offset int) (interface{}, time.Duration, bool) {
+	for {
+		select {
+		case <-c.done:
+			c.setErr(errClosed)
+			return nil, 0, false
+		default:
+		}
+
+		if pld, ttl, ok := c.b.pop(c.qs, c.keys, offset); ok {
+			return pld, ttl, true
+		}
+
+		select {
+		case <-c.wake:
+		case <-c.done:
+		}
+	}
+}
+
+func (c *pollConn) setErr(err error) {
+	c.errmu.Lock()
+	c.err = err
+	c.errmu.Unlock()
+}
+
+func (c *pollConn) getErr() error {
+	c.errmu.Lock()
+	err := c.err
+	c.errmu.Unlock()
+	return err
+}
@@ -0,0 +1,56 @@
+package inmembroker
+
+import (
+	"sync"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+)
+
+var _ broker.ResultsConn = (*resultsConn)(nil)
+
+type resultsConn struct {
+	*pollConn
+
+	// once makes sure only the first call to Results starts the goroutine.
+	once sync.Once
+	ch   chan *message.ResPayload
+}
+
+// ResultsErr returns the error that caused the Results channel to close.
+func (c *resultsConn) ResultsErr() error {
+	return c.getErr()
+}
+
+// Results returns a stream of call results for the connUUID specified when
+// creating the resultsConn.
+func (c *resultsConn) Results() <-chan *message.ResPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *message.ResPayload)
+		go c.pollResults()
+	})
+
+	return c.ch
+}
+
+func (c *resultsConn) pollResults() {
+	defer close(c.ch)
+
+	vars := c.b.metrics()
+	for {
+		pld, _, ok := c.next(0)
+		if !ok {
+			return
+		}
+
+		rp := *pld.(*message.ResPayload)
+		select {
+		case c.ch <- &rp:
+			metrics.AddExemplar(vars, "Results", 1, rp.CorrelationID)
+		case <-c.done:
+			c.setErr(errClosed)
+			return
+		}
+	}
+}
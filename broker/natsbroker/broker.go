@@ -0,0 +1,409 @@
+// Package natsbroker implements a juggler broker using NATS as
+// backend. RPC calls are stored in a JetStream stream and consumed by
+// the callees with a durable pull consumer per URI, so that the calls
+// for a given URI are load-balanced between the callees that listen
+// for it. Call results and pub-sub events use core NATS subjects.
+//
+// Call timeouts mirror the semantics of the redisbroker package: each
+// call request is published with a JetStream per-message TTL, so that
+// the requests that are not processed in time are removed from the
+// stream, and with a header holding its deadline, so that a callee
+// drops a request that has expired and knows how much time is left
+// to process it. As the per-message TTL has a granularity of one
+// second, the deadline is what makes the timeout precise. The call
+// results are published with the same deadline header, and dropped if
+// they are received after it. The per-message TTL requires NATS server
+// 2.11 or later, and a stream that allows it, which is the case of the
+// stream created by the broker.
+//
+// Results and events are not persisted: a result published when the
+// connection that made the call is not listening anymore is dropped,
+// as is an event published on a channel without subscriber.
+//
+// The URIs and channels are mapped to NATS subjects, so they must be
+// valid subject tokens, and the pattern-based subscriptions use the
+// NATS wildcards ("*" matches a single dot-separated token, ">"
+// matches one or more trailing tokens) instead of the glob-style
+// patterns of the redisbroker, unless Topics is set.
+//
+// The priority of calls and results, the compression and offloading
+// of arguments and the prefix routing of calls are not supported.
+//
+package natsbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/nats-io/nats.go"
+	"github.com/pborman/uuid"
+)
+
+var (
+	// static check that *Broker implements the broker interfaces
+	_ broker.CallerBroker = (*Broker)(nil)
+	_ broker.CalleeBroker = (*Broker)(nil)
+	_ broker.PubSubBroker = (*Broker)(nil)
+	_ broker.Pinger       = (*Broker)(nil)
+	_ metrics.Setter      = (*Broker)(nil)
+)
+
+// DiscardLog is a no-op logging function that can be used as Broker.LogFunc
+// to disable logging.
+var DiscardLog = func(_ string, _ ...interface{}) {}
+
+// DefaultStream is the default name of the JetStream stream that
+// stores the call requests.
+const DefaultStream = "JUGGLER_CALLS"
+
+// DefaultBlockingTimeout is the default time to wait for call requests
+// and results before trying again.
+var DefaultBlockingTimeout = 5 * time.Second
+
+// DefaultAckWait is the time after which a call request that was
+// received but not acknowledged is delivered again, if
+// VisibilityTimeout is not set. As the call requests are acknowledged
+// as soon as they are received in that case, it only matters if the
+// callee crashed before acknowledging it.
+var DefaultAckWait = 30 * time.Second
+
+const (
+	callSubject = "juggler.calls.%s"   // 1: URI
+	resSubject  = "juggler.results.%s" // 1: cUUID
+	evntSubject = "juggler.events.%s"  // 1: channel
+
+	// header holding the deadline of a call request or result, in
+	// milliseconds since the epoch.
+	deadlineHeader = "Juggler-Deadline"
+
+	// JetStream header holding the per-message TTL, in seconds.
+	ttlHeader = "Nats-TTL"
+)
+
+// Broker is a broker that provides the methods to interact with NATS
+// using the juggler protocol.
+type Broker struct {
+	// prevent unkeyed literals
+	_ struct{}
+
+	// Conn is the NATS connection to use. It is shared by all the
+	// connections returned by the broker. The NATS server must have
+	// JetStream enabled to make and process calls.
+	Conn *nats.Conn
+
+	// Stream is the name of the JetStream stream that stores the call
+	// requests. If it is empty, DefaultStream is used. The stream is
+	// created if it doesn't exist, with a work-queue retention policy
+	// and per-message TTLs allowed. An existing stream must capture
+	// the "juggler.calls.>" subjects and allow per-message TTLs.
+	Stream string
+
+	// BlockingTimeout is the time to wait for call requests and
+	// results before trying again. If it is 0, DefaultBlockingTimeout
+	// is used.
+	BlockingTimeout time.Duration
+
+	// LogFunc is the logging function to use. If nil, log.Printf
+	// is used. It can be set to DiscardLog to disable logging.
+	LogFunc func(string, ...interface{})
+
+	// CallCap is the capacity of the CALL queue per URI. If it is
+	// exceeded for a given URI, subsequent Broker.Call calls for that
+	// URI will fail with an error. The default of 0 means no limit.
+	// It is only applied when the broker creates the stream.
+	CallCap int
+
+	// VisibilityTimeout enables the at-least-once processing of the
+	// call requests if it is greater than 0. The calls connections
+	// returned by NewCallsConn then implement broker.AckCallsConn, and
+	// a call request that is not acknowledged within VisibilityTimeout
+	// after it was received, e.g. because the callee crashed, is
+	// delivered again by JetStream to a callee. It is used as the
+	// acknowledgement wait of the consumers, which are shared by all
+	// the callees of a URI, so it must be the same for all callees.
+	VisibilityTimeout time.Duration
+
+	// Topics, if true, requires the channels to be topics and the
+	// patterns of the pattern-based subscriptions to be topic filters
+	// (see broker.ValidTopic and broker.ValidTopicFilter), that are
+	// translated to NATS wildcards, so that they behave the same as
+	// with the other brokers that support topics. Invalid channels and
+	// patterns are rejected with broker.ErrInvalidTopic.
+	Topics bool
+
+	// Vars can be set to a metrics.Sink (e.g. an *expvar.Map) to
+	// collect metrics about the broker. It should be set before
+	// starting to make calls with the broker. If it is not set, the
+	// broker uses the sink set by SetMetrics, if any.
+	Vars metrics.Sink
+
+	// mu protects the inherited sink set by SetMetrics.
+	mu        sync.Mutex
+	inherited metrics.Sink
+
+	// jsmu protects the JetStream context, initialized on first use.
+	jsmu sync.Mutex
+	js   nats.JetStreamContext
+}
+
+// SetMetrics sets the metrics sink used by the broker if Vars is not
+// set. It is called by the juggler.Server with its own sink, so that
+// the broker metrics are collected along with the server's.
+func (b *Broker) SetMetrics(s metrics.Sink) {
+	b.mu.Lock()
+	if b.inherited == nil {
+		b.inherited = s
+	}
+	b.mu.Unlock()
+}
+
+// metrics returns the metrics sink of the broker, never nil.
+func (b *Broker) metrics() metrics.Sink {
+	if !metrics.IsNil(b.Vars) {
+		return b.Vars
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return metrics.Or(b.inherited)
+}
+
+func (b *Broker) stream() string {
+	if b.Stream != "" {
+		return b.Stream
+	}
+	return DefaultStream
+}
+
+func (b *Broker) blockingTimeout() time.Duration {
+	if b.BlockingTimeout > 0 {
+		return b.BlockingTimeout
+	}
+	return DefaultBlockingTimeout
+}
+
+// jetStream returns the JetStream context of the broker, creating the
+// calls stream if it doesn't exist.
+func (b *Broker) jetStream() (nats.JetStreamContext, error) {
+	b.jsmu.Lock()
+	defer b.jsmu.Unlock()
+
+	if b.js != nil {
+		return b.js, nil
+	}
+
+	js, err := b.Conn.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	_, err = js.StreamInfo(b.stream())
+	if err == nats.ErrStreamNotFound {
+		cfg := &nats.StreamConfig{
+			Name:              b.stream(),
+			Subjects:          []string{fmt.Sprintf(callSubject, ">")},
+			Retention:         nats.WorkQueuePolicy,
+			MaxMsgsPerSubject: -1,
+			AllowMsgTTL:       true,
+		}
+		if b.CallCap > 0 {
+			cfg.MaxMsgsPerSubject = int64(b.CallCap)
+			cfg.Discard = nats.DiscardNew
+			cfg.DiscardNewPerSubject = true
+		}
+		_, err = js.AddStream(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.js = js
+	return js, nil
+}
+
+// Call registers a call request in the broker, by publishing it on the
+// JetStream subject of its URI.
+func (b *Broker) Call(cp *message.CallPayload, timeout time.Duration) error {
+	js, err := b.jetStream()
+	if err != nil {
+		return err
+	}
+
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	m, err := newMsg(fmt.Sprintf(callSubject, cp.URI), cp, timeout)
+	if err != nil {
+		return err
+	}
+	m.Header.Set(ttlHeader, strconv.FormatInt(ttlSeconds(timeout), 10))
+	_, err = js.PublishMsg(m)
+	return err
+}
+
+// Result registers a call result in the broker, by publishing it on
+// the subject of the calling connection's UUID.
+func (b *Broker) Result(rp *message.ResPayload, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	m, err := newMsg(fmt.Sprintf(resSubject, rp.ConnUUID), rp, timeout)
+	if err != nil {
+		return err
+	}
+	return b.Conn.PublishMsg(m)
+}
+
+// Publish publishes an event to a channel. As NATS doesn't report the
+// number of subscribers that received a message, it always returns 0
+// on success.
+func (b *Broker) Publish(channel string, pp *message.PubPayload) (int, error) {
+	if b.Topics {
+		if err := broker.ValidTopic(channel); err != nil {
+			return 0, err
+		}
+	}
+
+	p, err := json.Marshal(pp)
+	if err != nil {
+		return 0, err
+	}
+	return 0, b.Conn.Publish(fmt.Sprintf(evntSubject, channel), p)
+}
+
+// Ping checks that the NATS server is reachable, by measuring the
+// round-trip time of the connection.
+func (b *Broker) Ping() error {
+	_, err := b.Conn.RTT()
+	return err
+}
+
+// NewPubSubConn returns a new pub-sub connection that can be used
+// to subscribe to and unsubscribe from channels, and to process
+// incoming events.
+func (b *Broker) NewPubSubConn() (broker.PubSubConn, error) {
+	return &pubSubConn{
+		nc:       b.Conn,
+		logFn:    b.LogFunc,
+		vars:     b.metrics(),
+		topics:   b.Topics,
+		subs:     make(map[subscription][]*nats.Subscription),
+		patterns: make(map[*nats.Subscription]string),
+		msgs:     make(chan *nats.Msg, eventsBufferSize),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// NewCallsConn returns a new calls connection that can be used to
+// process the call requests for the specified URIs. A durable
+// consumer is created for each URI if it doesn't exist, and shared
+// by all the callees of the URI. If VisibilityTimeout is set, the
+// returned connection implements broker.AckCallsConn.
+func (b *Broker) NewCallsConn(uris ...string) (broker.CallsConn, error) {
+	js, err := b.jetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	ackWait := b.VisibilityTimeout
+	if ackWait <= 0 {
+		ackWait = DefaultAckWait
+	}
+
+	cc := &callsConn{
+		uris:    uris,
+		timeout: b.blockingTimeout(),
+		logFn:   b.LogFunc,
+		vars:    b.metrics(),
+	}
+	for _, uri := range uris {
+		sub, err := pullSubscribe(js, b.stream(), uri, ackWait)
+		if err != nil {
+			cc.Close()
+			return nil, err
+		}
+		cc.subs = append(cc.subs, sub)
+	}
+
+	if b.VisibilityTimeout <= 0 {
+		return cc, nil
+	}
+	cc.inflight = make(map[string]*nats.Msg)
+	return &ackCallsConn{callsConn: cc}, nil
+}
+
+// NewResultsConn returns a new results connection that can be used
+// to process the call results for the specified connection UUID.
+func (b *Broker) NewResultsConn(connUUID uuid.UUID) (broker.ResultsConn, error) {
+	sub, err := b.Conn.SubscribeSync(fmt.Sprintf(resSubject, connUUID))
+	if err != nil {
+		return nil, err
+	}
+	return &resultsConn{
+		sub:     sub,
+		timeout: b.blockingTimeout(),
+		logFn:   b.LogFunc,
+		vars:    b.metrics(),
+	}, nil
+}
+
+// newMsg returns the NATS message with the JSON-encoded payload pld,
+// with the deadline header set to expire after timeout.
+func newMsg(subject string, pld interface{}, timeout time.Duration) (*nats.Msg, error) {
+	p, err := json.Marshal(pld)
+	if err != nil {
+		return nil, err
+	}
+	m := nats.NewMsg(subject)
+	m.Data = p
+	deadline := time.Now().Add(timeout).UnixNano() / int64(time.Millisecond)
+	m.Header.Set(deadlineHeader, strconv.FormatInt(deadline, 10))
+	return m, nil
+}
+
+// remainingTTL returns the time left before the deadline of m, or 0
+// if it has expired or if it doesn't have a valid deadline header.
+func remainingTTL(m *nats.Msg, now time.Time) time.Duration {
+	if m.Header == nil {
+		return 0
+	}
+	ms, err := strconv.ParseInt(m.Header.Get(deadlineHeader), 10, 64)
+	if err != nil {
+		return 0
+	}
+	ttl := time.Unix(0, ms*int64(time.Millisecond)).Sub(now)
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// ttlSeconds returns the per-message TTL for timeout, rounded up to
+// the second.
+func ttlSeconds(timeout time.Duration) int64 {
+	s := int64((timeout + time.Second - 1) / time.Second)
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
+
+// durableName returns the name of the durable consumer of uri. The
+// dots, which are not allowed in consumer names, are replaced.
+func durableName(uri string) string {
+	r := strings.NewReplacer(".", "_", "*", "_", ">", "_")
+	return "juggler_calls_" + r.Replace(uri)
+}
+
+func logf(fn func(string, ...interface{}), f string, args ...interface{}) {
+	if fn != nil {
+		fn(f, args...)
+	} else {
+		log.Printf(f, args...)
+	}
+}
@@ -0,0 +1,83 @@
+package natsbroker
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/nats-io/nats.go"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMsg(t *testing.T) {
+	cp := &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "a.b"}
+	m, err := newMsg("juggler.calls.a.b", cp, time.Second)
+	require.NoError(t, err, "newMsg")
+	assert.Equal(t, "juggler.calls.a.b", m.Subject, "subject")
+
+	var got message.CallPayload
+	require.NoError(t, json.Unmarshal(m.Data, &got), "Unmarshal")
+	assert.Equal(t, cp.MsgUUID, got.MsgUUID, "payload")
+
+	ttl := remainingTTL(m, time.Now())
+	assert.True(t, ttl > 900*time.Millisecond && ttl <= time.Second, "remaining TTL %s", ttl)
+	assert.Equal(t, time.Duration(0), remainingTTL(m, time.Now().Add(2*time.Second)), "expired")
+}
+
+func TestRemainingTTL(t *testing.T) {
+	now := time.Now()
+	ms := now.Add(time.Minute).UnixNano() / int64(time.Millisecond)
+
+	cases := []struct {
+		hdr nats.Header
+		out time.Duration
+	}{
+		{nil, 0},
+		{nats.Header{}, 0},
+		{nats.Header{deadlineHeader: {"x"}}, 0},
+		{nats.Header{deadlineHeader: {strconv.FormatInt(ms, 10)}}, time.Unix(0, ms*int64(time.Millisecond)).Sub(now)},
+	}
+	for i, c := range cases {
+		got := remainingTTL(&nats.Msg{Header: c.hdr}, now)
+		assert.Equal(t, c.out, got, "%d", i)
+	}
+}
+
+func TestTTLSeconds(t *testing.T) {
+	cases := []struct {
+		in  time.Duration
+		out int64
+	}{
+		{0, 1},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1001 * time.Millisecond, 2},
+		{time.Minute, 60},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.out, ttlSeconds(c.in), "%s", c.in)
+	}
+}
+
+func TestDurableName(t *testing.T) {
+	assert.Equal(t, "juggler_calls_a", durableName("a"))
+	assert.Equal(t, "juggler_calls_a_b_c", durableName("a.b.c"))
+}
+
+func TestTopicSubjects(t *testing.T) {
+	cases := map[string][]string{
+		"a":     {"a"},
+		"a.+.c": {"a.*.c"},
+		"+":     {"*"},
+		"#":     {">"},
+		"a.#":   {"a.>", "a"},
+		"+.b.#": {"*.b.>", "*.b"},
+	}
+	for in, exp := range cases {
+		assert.Equal(t, exp, topicSubjects(in), in)
+	}
+}
@@ -0,0 +1,198 @@
+package natsbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	_ broker.CallsConn    = (*callsConn)(nil)
+	_ broker.AckCallsConn = (*ackCallsConn)(nil)
+)
+
+// pullSubscribe returns a pull subscription bound to the durable
+// consumer of uri, creating the consumer if it doesn't exist. The
+// subscription is bound so that unsubscribing doesn't delete the
+// consumer, which is shared by all the callees of uri.
+func pullSubscribe(js nats.JetStreamContext, stream, uri string, ackWait time.Duration) (*nats.Subscription, error) {
+	subject := fmt.Sprintf(callSubject, uri)
+	name := durableName(uri)
+	_, err := js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:       name,
+		FilterSubject: subject,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       ackWait,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return js.PullSubscribe(subject, name, nats.Bind(stream, name))
+}
+
+type callsConn struct {
+	subs    []*nats.Subscription
+	uris    []string
+	timeout time.Duration
+	logFn   func(string, ...interface{})
+	vars    metrics.Sink
+
+	// in-flight call requests by message UUID, nil if the calls are not
+	// processed at least once (see Broker.VisibilityTimeout).
+	imu      sync.Mutex
+	inflight map[string]*nats.Msg
+
+	// once makes sure only the first call to Calls starts the goroutines.
+	once sync.Once
+	ch   chan *message.CallPayload
+
+	closeOnce sync.Once
+
+	// errmu protects access to err.
+	errmu sync.Mutex
+	err   error
+}
+
+// Close closes the connection. The durable consumers are not deleted.
+func (c *callsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		for _, sub := range c.subs {
+			if e := sub.Unsubscribe(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// CallsErr returns the error that caused the Calls channel to close.
+func (c *callsConn) CallsErr() error {
+	c.errmu.Lock()
+	err := c.err
+	c.errmu.Unlock()
+	return err
+}
+
+// Calls returns a stream of call requests for the URIs specified when
+// creating the callsConn.
+func (c *callsConn) Calls() <-chan *message.CallPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *message.CallPayload)
+
+		wg := sync.WaitGroup{}
+		for _, sub := range c.subs {
+			wg.Add(1)
+			go c.pollCalls(sub, &wg)
+		}
+		go func() {
+			wg.Wait()
+			close(c.ch)
+		}()
+	})
+
+	return c.ch
+}
+
+func (c *callsConn) pollCalls(sub *nats.Subscription, done *sync.WaitGroup) {
+	defer done.Done()
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		msgs, err := sub.Fetch(1, nats.MaxWait(c.timeout))
+		if err != nil {
+			if err == nats.ErrTimeout {
+				// no available value
+				continue
+			}
+
+			// possibly a closed connection, in any case stop all the
+			// loops.
+			c.errmu.Lock()
+			if c.err == nil {
+				c.err = err
+			}
+			c.errmu.Unlock()
+			c.Close()
+			return
+		}
+
+		for _, m := range msgs {
+			wg.Add(1)
+			go c.sendCall(m, &wg)
+		}
+	}
+}
+
+func (c *callsConn) sendCall(m *nats.Msg, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var cp message.CallPayload
+	if err := json.Unmarshal(m.Data, &cp); err != nil {
+		c.vars.Add("FailedCallPayloadUnmarshals", 1)
+		logf(c.logFn, "Calls: failed to unmarshal call payload: %v", err)
+		// will never succeed, do not deliver it again
+		m.Term()
+		return
+	}
+
+	// check if call is expired
+	ttl := remainingTTL(m, time.Now())
+	if ttl <= 0 {
+		metrics.AddExemplar(c.vars, "ExpiredCalls", 1, cp.CorrelationID)
+		logf(c.logFn, "Calls: message %v expired, dropping call [%s]", cp.MsgUUID, cp.CorrelationID)
+		c.ackMsg(m, &cp)
+		return
+	}
+
+	if c.inflight == nil {
+		// processed at most once, acknowledge it as soon as it is received
+		c.ackMsg(m, &cp)
+	} else {
+		if md, err := m.Metadata(); err == nil && md.NumDelivered > 1 {
+			c.vars.Add("RequeuedCalls", 1)
+		}
+		c.imu.Lock()
+		c.inflight[cp.MsgUUID.String()] = m
+		c.imu.Unlock()
+	}
+
+	cp.ReadTimestamp = time.Now().UTC()
+	cp.TTLAfterRead = ttl
+	c.ch <- &cp
+	metrics.AddExemplar(c.vars, "Calls", 1, cp.CorrelationID)
+}
+
+func (c *callsConn) ackMsg(m *nats.Msg, cp *message.CallPayload) {
+	if err := m.Ack(); err != nil {
+		logf(c.logFn, "Calls: failed to acknowledge message %v: %v [%s]", cp.MsgUUID, err, cp.CorrelationID)
+	}
+}
+
+// ackCallsConn is a callsConn that processes the call requests at
+// least once.
+type ackCallsConn struct {
+	*callsConn
+}
+
+// Ack acknowledges that the call request cp was processed, so that it
+// is not delivered again.
+func (c *ackCallsConn) Ack(cp *message.CallPayload) error {
+	id := cp.MsgUUID.String()
+	c.imu.Lock()
+	m := c.inflight[id]
+	delete(c.inflight, id)
+	c.imu.Unlock()
+
+	if m == nil {
+		return nil
+	}
+	return m.Ack()
+}
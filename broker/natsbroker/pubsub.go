@@ -0,0 +1,237 @@
+package natsbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/nats-io/nats.go"
+)
+
+var _ broker.PubSubConn = (*pubSubConn)(nil)
+
+// eventsBufferSize is the number of NATS messages buffered for a
+// pub-sub connection. If the buffer is full, NATS drops the messages
+// of the slow consumer.
+const eventsBufferSize = 1024
+
+// errClosed is the error returned by EventsErr once the pub-sub
+// connection is closed.
+var errClosed = errors.New("juggler/natsbroker: closed connection")
+
+// subscription identifies a subscription of a pub-sub connection.
+type subscription struct {
+	channel string
+	pattern bool
+}
+
+type pubSubConn struct {
+	nc     *nats.Conn
+	logFn  func(string, ...interface{})
+	vars   metrics.Sink
+	topics bool // patterns are topic filters
+
+	// smu protects the subscriptions. A topic filter may require many
+	// NATS subscriptions (see topicSubjects).
+	smu      sync.Mutex
+	subs     map[subscription][]*nats.Subscription
+	patterns map[*nats.Subscription]string // pattern of each pattern-based subscription
+
+	// all subscriptions deliver their messages on msgs.
+	msgs chan *nats.Msg
+
+	// done is closed when the connection is closed.
+	closeOnce sync.Once
+	done      chan struct{}
+
+	// once makes sure only the first call to Events starts the goroutine.
+	once sync.Once
+	evch chan *message.EvntPayload
+
+	// errmu protects access to err.
+	errmu sync.Mutex
+	err   error
+}
+
+// Close closes the connection, unsubscribing from all channels.
+func (c *pubSubConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.smu.Lock()
+		defer c.smu.Unlock()
+		for k, subs := range c.subs {
+			for _, sub := range subs {
+				if e := sub.Unsubscribe(); e != nil && err == nil {
+					err = e
+				}
+			}
+			delete(c.subs, k)
+		}
+	})
+	return err
+}
+
+// Subscribe subscribes the connection to the channel, which may be a
+// pattern using the NATS wildcards, or a topic filter if the broker has
+// Topics set.
+func (c *pubSubConn) Subscribe(channel string, pattern bool) error {
+	subjects := []string{channel}
+	if c.topics {
+		if err := broker.ValidateTopicSub(channel, pattern); err != nil {
+			return err
+		}
+		if pattern {
+			subjects = topicSubjects(channel)
+		}
+	}
+
+	c.smu.Lock()
+	defer c.smu.Unlock()
+
+	select {
+	case <-c.done:
+		return errClosed
+	default:
+	}
+
+	k := subscription{channel, pattern}
+	if _, ok := c.subs[k]; ok {
+		return nil
+	}
+	subs := make([]*nats.Subscription, 0, len(subjects))
+	for _, subject := range subjects {
+		sub, err := c.nc.ChanSubscribe(fmt.Sprintf(evntSubject, subject), c.msgs)
+		if err != nil {
+			for _, sub := range subs {
+				sub.Unsubscribe()
+			}
+			return err
+		}
+		subs = append(subs, sub)
+	}
+	c.subs[k] = subs
+	if pattern {
+		for _, sub := range subs {
+			c.patterns[sub] = channel
+		}
+	}
+	return nil
+}
+
+// Unsubscribe unsubscribes the connection from the channel, which may
+// be a pattern.
+func (c *pubSubConn) Unsubscribe(channel string, pattern bool) error {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+
+	k := subscription{channel, pattern}
+	subs, ok := c.subs[k]
+	if !ok {
+		return nil
+	}
+	delete(c.subs, k)
+
+	var err error
+	for _, sub := range subs {
+		delete(c.patterns, sub)
+		if e := sub.Unsubscribe(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// topicSubjects returns the NATS subjects that match the topics matched
+// by the topic filter pattern. The NATS ">" wildcard matches one or
+// more tokens, so a trailing TopicMultiWildcard requires a subject for
+// the parent topic too.
+func topicSubjects(pattern string) []string {
+	segs := strings.Split(pattern, ".")
+	for i, seg := range segs {
+		if seg == broker.TopicWildcard {
+			segs[i] = "*"
+		}
+	}
+
+	last := len(segs) - 1
+	if segs[last] != broker.TopicMultiWildcard {
+		return []string{strings.Join(segs, ".")}
+	}
+	segs[last] = ">"
+	if last == 0 {
+		return []string{">"}
+	}
+	return []string{strings.Join(segs, "."), strings.Join(segs[:last], ".")}
+}
+
+// Events returns the stream of events from channels that the
+// connection is subscribed to.
+func (c *pubSubConn) Events() <-chan *message.EvntPayload {
+	c.once.Do(func() {
+		c.evch = make(chan *message.EvntPayload)
+		go c.listen()
+	})
+
+	return c.evch
+}
+
+func (c *pubSubConn) listen() {
+	defer close(c.evch)
+
+	for {
+		select {
+		case m := <-c.msgs:
+			c.sendEvent(m)
+
+		case <-c.done:
+			c.errmu.Lock()
+			c.err = errClosed
+			c.errmu.Unlock()
+			return
+		}
+	}
+}
+
+func (c *pubSubConn) sendEvent(m *nats.Msg) {
+	var pp message.PubPayload
+	if err := json.Unmarshal(m.Data, &pp); err != nil {
+		c.vars.Add("FailedEvntPayloadUnmarshals", 1)
+		logf(c.logFn, "Events: failed to unmarshal event payload: %v", err)
+		return
+	}
+
+	prefix := fmt.Sprintf(evntSubject, "")
+	ep := &message.EvntPayload{
+		MsgUUID:       pp.MsgUUID,
+		Channel:       strings.TrimPrefix(m.Subject, prefix),
+		Args:          pp.Args,
+		CorrelationID: pp.CorrelationID,
+		Priority:      pp.Priority,
+		Binary:        pp.Binary,
+		OffloadRef:    pp.OffloadRef,
+	}
+	c.smu.Lock()
+	ep.Pattern = c.patterns[m.Sub]
+	c.smu.Unlock()
+
+	select {
+	case c.evch <- ep:
+		metrics.AddExemplar(c.vars, "Events", 1, ep.CorrelationID)
+	case <-c.done:
+	}
+}
+
+// EventsErr returns the error that caused the events channel to close.
+func (c *pubSubConn) EventsErr() error {
+	c.errmu.Lock()
+	err := c.err
+	c.errmu.Unlock()
+	return err
+}
@@ -0,0 +1,100 @@
+package natsbroker
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/nats-io/nats.go"
+)
+
+var _ broker.ResultsConn = (*resultsConn)(nil)
+
+type resultsConn struct {
+	sub     *nats.Subscription
+	timeout time.Duration
+	logFn   func(string, ...interface{})
+	vars    metrics.Sink
+
+	// once makes sure only the first call to Results starts the goroutine.
+	once sync.Once
+	ch   chan *message.ResPayload
+
+	// errmu protects access to err.
+	errmu sync.Mutex
+	err   error
+}
+
+// Close closes the connection.
+func (c *resultsConn) Close() error {
+	return c.sub.Unsubscribe()
+}
+
+// ResultsErr returns the error that caused the Results channel to close.
+func (c *resultsConn) ResultsErr() error {
+	c.errmu.Lock()
+	err := c.err
+	c.errmu.Unlock()
+	return err
+}
+
+// Results returns a stream of call results for the connUUID specified when
+// creating the resultsConn.
+func (c *resultsConn) Results() <-chan *message.ResPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *message.ResPayload)
+		go c.pollResults()
+	})
+
+	return c.ch
+}
+
+func (c *resultsConn) pollResults() {
+	defer close(c.ch)
+
+	wg := sync.WaitGroup{}
+	for {
+		m, err := c.sub.NextMsg(c.timeout)
+		if err != nil {
+			if err == nats.ErrTimeout {
+				// no available value
+				continue
+			}
+
+			// possibly a closed connection, in any case stop
+			// the loop.
+			c.errmu.Lock()
+			c.err = err
+			c.errmu.Unlock()
+			wg.Wait()
+			return
+		}
+
+		wg.Add(1)
+		go c.sendResult(m, &wg)
+	}
+}
+
+func (c *resultsConn) sendResult(m *nats.Msg, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var rp message.ResPayload
+	if err := json.Unmarshal(m.Data, &rp); err != nil {
+		c.vars.Add("FailedResPayloadUnmarshals", 1)
+		logf(c.logFn, "Results: failed to unmarshal result payload: %v", err)
+		return
+	}
+
+	// check if call is expired
+	if remainingTTL(m, time.Now()) <= 0 {
+		metrics.AddExemplar(c.vars, "ExpiredResults", 1, rp.CorrelationID)
+		logf(c.logFn, "Results: message %v expired, dropping call [%s]", rp.MsgUUID, rp.CorrelationID)
+		return
+	}
+
+	c.ch <- &rp
+	metrics.AddExemplar(c.vars, "Results", 1, rp.CorrelationID)
+}
@@ -12,25 +12,86 @@
 // requests are hashed on the call URI, and the results
 // are hashed on the calling connection's UUID.
 //
-// If an RPC URI is much more sollicitated than others,
-// it can be spread over multiple URIs using
-// "RPC_URI_%d" where %d is e.g. a number from 1 to 100.
-// Clients that need to call this function can use a random
-// over that range to spread the load over different cluster
-// nodes, or a server handler can alter the URI to achieve
-// that result without impacting clients.
+// Calls and results with a priority > 0 (see message.Meta) are pushed
+// at the consuming end of their list, so that they are processed
+// before the other pending calls and results. If PriorityQueues is
+// set, the high-priority call requests are instead stored in a
+// separate list of their URI, that the callees poll before the
+// normal lists of all their URIs, so that interactive calls are not
+// stuck behind batch work.
+//
+// If PrefixRouting is set, callees can listen for prefix URIs
+// (e.g. "billing.*", see broker.PrefixURIs), and the call requests
+// are stored in the queue of the most specific registered URI that
+// matches the call URI. The URIs that callees listen to are
+// registered in a redis SET, so that adding a method under a service
+// prefix only requires the callee to handle it.
+//
+// If VisibilityTimeout is set, the call requests are processed at
+// least once: a call request is moved atomically to a processing set
+// of its URI when it is received, and it is requeued if the callee
+// does not acknowledge it before the visibility timeout, e.g. because
+// it crashed.
+//
+// If Mode is StreamMode, the call requests and results are stored in
+// redis streams instead of lists. The call requests are consumed by a
+// consumer group shared by all callees listening for a URI, so they
+// are processed at least once without polling: the entries that are
+// not acknowledged within the visibility timeout, e.g. because the
+// callee crashed, are claimed by another callee. The results are read
+// with XREAD and deleted once received. Priorities are ignored in that
+// mode, the streams are processed in order.
+//
+// If FlushInterval is set, the call requests and results are
+// registered in batches, pipelined on a single connection per cluster
+// slot, to reduce the number of round trips to redis under load. The
+// Lua scripts can be preloaded with LoadScripts so that they are
+// always executed by their SHA1 digest.
+//
+// If Dispatchers is set, the results of all the connections of a
+// server are stored in a single results queue, consumed by a few
+// dispatcher goroutines that route them to the connections in-process,
+// instead of using a redis connection per client.
+//
+// If a channel matches DurableChannels, its events are also stored in
+// a redis stream for the retention window, and the events published
+// after a given event can be replayed, so that a subscriber that was
+// briefly disconnected does not lose events.
+//
+// The callees can register themselves in a registry of live callees
+// (see broker.HealthBroker), stored in a redis hash along with a
+// sorted set of the expiration time of each entry.
+//
+// If Namespace is set, all the redis keys and pub-sub channels used by
+// the broker are prefixed with it, so that many independent
+// deployments can share a redis server or cluster. The hash tags of
+// the keys are not affected, so the cluster support is unchanged.
+//
+// A callee can register a result with ResultTx to execute its own Lua
+// script atomically with the registration, e.g. to update the state it
+// changed to produce that result. In a cluster, the keys of the script
+// must be in the hash slot of the result (see ResultHashTag).
+//
+// If an RPC URI is much more sollicitated than others, it can be
+// sharded with ShardedCalls: its call requests are spread over a
+// number of queues, on different cluster nodes, based on the
+// consistent hash of a shard key, without impacting the clients. The
+// callees listen to a range of shards (see ShardURIs and
+// AssignShards).
 //
 package redisbroker
 
 import (
 	"encoding/json"
-	"expvar"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/mna/juggler/broker"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 	"github.com/mna/redisc"
 	"github.com/garyburd/redigo/redis"
 	"github.com/pborman/uuid"
@@ -38,9 +99,14 @@ import (
 
 var (
 	// static check that *Broker implements all the broker interfaces
-	_ broker.CallerBroker = (*Broker)(nil)
-	_ broker.CalleeBroker = (*Broker)(nil)
-	_ broker.PubSubBroker = (*Broker)(nil)
+	_ broker.CallerBroker     = (*Broker)(nil)
+	_ broker.CalleeBroker     = (*Broker)(nil)
+	_ broker.PubSubBroker     = (*Broker)(nil)
+	_ broker.PubSubInfoBroker = (*Broker)(nil)
+	_ broker.RoomsBroker      = (*Broker)(nil)
+	_ broker.PresenceBroker   = (*Broker)(nil)
+	_ broker.HealthBroker     = (*Broker)(nil)
+	_ broker.Locker           = (*Broker)(nil)
 )
 
 // DiscardLog is a no-op logging function that can be used as Broker.LogFunc
@@ -72,8 +138,17 @@ type Broker struct {
 	// or redisc.Cluster.Dial.
 	Dial func() (redis.Conn, error)
 
+	// Namespace, if set, is the prefix of all the redis keys and pub-sub
+	// channels used by the broker, followed by a colon, e.g. the call
+	// requests of URI "a" are stored in "<Namespace>:juggler:calls:{a}",
+	// so that many independent juggler deployments can share the same
+	// redis server or cluster. The channels of the events received and
+	// returned by the broker are not prefixed. It must be the same on
+	// all the brokers of a deployment.
+	Namespace string
+
 	// BlockingTimeout is the time to wait for a value on calls to
-	// BRPOP before trying again. The default of 0 means no timeout.
+	// BRPOP (or XREADGROUP and XREAD in StreamMode) before trying again. The default of 0 means no timeout.
 	BlockingTimeout time.Duration
 
 	// LogFunc is the logging function to use. If nil, log.Printf
@@ -85,89 +160,580 @@ type Broker struct {
 	// URI will fail with an error. The default of 0 means no limit.
 	CallCap int
 
+	// PrefixRouting enables routing the calls to the callees that
+	// listen for a prefix URI matching the call URI (see
+	// broker.PrefixURIs). The callee broker registers the URIs it
+	// listens to, and the caller broker routes each call request to
+	// the queue of the URI itself if it is registered, or of the most
+	// specific registered prefix URI, at the cost of an additional
+	// redis command per call. It must be set on both the caller and
+	// callee brokers.
+	PrefixRouting bool
+
+	// ShardedCalls maps the URIs of the sharded queues to their number
+	// of shards. The call requests for such a URI (after PrefixRouting,
+	// if set) are stored in the queue of the shard of their shard key,
+	// as returned by ShardOf. The key is returned by ShardKey, or is
+	// the UUID of the calling connection if ShardKey is nil, so that
+	// the calls of a connection are processed in order by the same
+	// callee. Callees listen to the shards with the URIs returned by
+	// ShardURIs. Only the caller brokers need to set ShardedCalls, and
+	// the number of shards of a URI should not change while callees
+	// listen to it.
+	ShardedCalls map[string]int
+	ShardKey     func(*message.CallPayload) string
+
+	// PriorityQueues stores the call requests with a priority > 0 in a
+	// separate high-priority list of their URI, in the order they are
+	// made, instead of at the consuming end of the URI's list. The
+	// calls connections always poll the high-priority lists of all
+	// their URIs before the normal lists, so only the caller brokers
+	// need to set it, once the callees are upgraded. CallCap applies
+	// to each list. It is not used in StreamMode.
+	PriorityQueues bool
+
+	// VisibilityTimeout enables the at-least-once processing of the
+	// call requests if it is greater than 0. The calls connections
+	// returned by NewCallsConn then implement broker.AckCallsConn, and
+	// a call request that is not acknowledged within VisibilityTimeout
+	// after it was received, e.g. because the callee crashed, is
+	// requeued to be processed by another callee. As the call requests
+	// are moved atomically to a processing set when they are received,
+	// they are polled every PollInterval (or DefaultPollInterval if it
+	// is 0) instead of with BRPOP.
+	VisibilityTimeout time.Duration
+	PollInterval      time.Duration
+
+	// Mode is the redis data structure used to store the call requests
+	// and results, ListMode (the default) or StreamMode. In StreamMode,
+	// the calls connections returned by NewCallsConn always implement
+	// broker.AckCallsConn, the unacknowledged call requests being
+	// claimed by another callee after VisibilityTimeout (or
+	// DefaultStreamVisibilityTimeout if it is 0), and PollInterval is
+	// not used. The CallCap and ResultCap capacities include the call
+	// requests being processed. It must be the same on the caller and
+	// callee brokers.
+	Mode Mode
+
+	// ConsumerGroup is the name of the consumer group of the calls
+	// streams in StreamMode. If it is empty, DefaultConsumerGroup is
+	// used.
+	ConsumerGroup string
+
 	// ResultCap is the capacity of the RES queue per connection UUID.
 	// If it is exceeded for a given connection, Broker.Result calls
 	// for that connection will fail with an error. The default of 0
 	// means no limit.
 	ResultCap int
 
-	// Vars can be set to an *expvar.Map to collect metrics about the
-	// broker. It should be set before starting to make calls with the
-	// broker.
-	Vars *expvar.Map
+	// Compression is the compression encoding (see message.Gzip and
+	// message.Deflate) used to compress the arguments of the calls,
+	// results and events stored in redis, if they are larger than
+	// CompressThreshold bytes. Compressed arguments are always
+	// decompressed when read from redis, so brokers with and without
+	// compression can be mixed. The default empty value disables
+	// compression.
+	Compression       string
+	CompressThreshold int
+
+	// OffloadThreshold is the size, in bytes, above which the arguments
+	// of the calls, results and events are stored in BlobStore instead
+	// of in the payload, which only holds the reference of the blob, so
+	// that the redis lists and pub-sub messages stay small. The blobs
+	// of calls and results expire with the call timeout, those of
+	// events after broker.DefaultCallTimeout. Blob references are
+	// always resolved when read from redis. The default of 0 disables
+	// offloading.
+	OffloadThreshold int
+
+	// BlobStore is the store to use for offloaded arguments. If it is
+	// nil, the Broker itself is used, storing the blobs as redis keys.
+	BlobStore broker.BlobStore
+
+	// DurableChannels is the list of glob-style patterns (see
+	// path.Match) of the durable channels. The events published on a
+	// durable channel are also appended to a redis stream (requires
+	// redis 6.2 or later), where they are kept for DurableRetention
+	// (DefaultDurableRetention if it is 0), so that subscribers can
+	// replay the events they missed (see Replay). The events are
+	// published with the ID of their stream entry.
+	DurableChannels  []string
+	DurableRetention time.Duration
+
+	// Topics, if true, requires the channels to be topics and the
+	// patterns of the pattern-based subscriptions to be topic filters
+	// (see broker.ValidTopic and broker.ValidTopicFilter), instead of
+	// redis glob-style patterns, so that they behave the same as with
+	// the other brokers that support topics. Each topic filter is
+	// subscribed to with a redis pattern that matches a superset of its
+	// topics, and the events are matched against the filter before
+	// they are sent. Invalid channels and patterns are rejected with
+	// broker.ErrInvalidTopic.
+	Topics bool
+
+	// DedupWindow enables the deduplication of the call requests and
+	// results if it is greater than 0. The message UUID of each call
+	// request and result registered is kept for DedupWindow, and Call
+	// and Result return broker.ErrDuplicate instead of registering it
+	// again during that window, e.g. when a client retries a call with
+	// the same CALL message. This prevents executing non-idempotent
+	// calls twice, as long as DedupWindow is longer than the time
+	// between the retries of a call. It costs an additional redis
+	// command per call request and result. A registration that fails
+	// is not marked, so it can be retried.
+	DedupWindow time.Duration
+
+	// NodePools can be set to one pool per node of a redis cluster, so
+	// that NumSub and Channels report the subscribers across all nodes
+	// instead of only those connected to the node that executes the
+	// command. If it is empty, Pool is used.
+	NodePools []Pool
+
+	// FlushInterval enables the pipelining of the registrations of call
+	// requests and results in ListMode if it is greater than 0. Calls to
+	// Call and Result are batched and sent on a single connection per
+	// cluster slot every FlushInterval, or as soon as MaxPipeline (or
+	// DefaultMaxPipeline if it is 0) registrations are pending, to
+	// reduce the number of redis round trips under load. Call and
+	// Result still wait for their registration to be flushed, so that
+	// its error is returned, at the cost of up to FlushInterval of
+	// added latency.
+	FlushInterval time.Duration
+	MaxPipeline   int
+
+	// Dispatchers enables the shared results dispatcher in ListMode if
+	// it is greater than 0. Instead of using a redis connection blocked
+	// on BRPOP for each results connection, the results of the calls
+	// made with the broker are stored in a single results queue, named
+	// ResultsQueue (a random UUID if it is empty), that is consumed by
+	// Dispatchers goroutines that route the results to the results
+	// connection of their connection UUID in-process. The name of the
+	// queue is stored in the call requests, so the callee brokers need
+	// no configuration. ResultsQueue must be unique to each broker, and
+	// ResultCap applies to the whole queue.
+	Dispatchers  int
+	ResultsQueue string
+
+	// Vars can be set to a metrics.Sink (e.g. an *expvar.Map) to
+	// collect metrics about the broker. It should be set before
+	// starting to make calls with the broker. If it is not set, the
+	// broker uses the sink set by SetMetrics, if any.
+	Vars metrics.Sink
+
+	// mu protects the inherited sink set by SetMetrics.
+	mu        sync.Mutex
+	inherited metrics.Sink
+
+	pipeOnce sync.Once
+	pipe     *pipeline
+
+	dispOnce sync.Once
+	disp     *dispatcher
+}
+
+var (
+	_ metrics.Setter   = (*Broker)(nil)
+	_ broker.BlobStore = (*Broker)(nil)
+)
+
+// SetMetrics sets the metrics sink used by the broker if Vars is not
+// set. It is called by the juggler.Server with its own sink, so that
+// the broker metrics are collected along with the server's.
+func (b *Broker) SetMetrics(s metrics.Sink) {
+	b.mu.Lock()
+	if b.inherited == nil {
+		b.inherited = s
+	}
+	b.mu.Unlock()
+}
+
+// metrics returns the metrics sink of the broker, never nil.
+func (b *Broker) metrics() metrics.Sink {
+	if !metrics.IsNil(b.Vars) {
+		return b.Vars
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return metrics.Or(b.inherited)
 }
 
 // script to store the call request or call result along with
-// its expiration information.
-var callOrResScript = redis.NewScript(2, `
+// its expiration information. The LIST is consumed with BRPOP, so
+// high-priority payloads are pushed with RPUSH to be consumed before
+// the others, which are pushed with LPUSH.
+var callOrResScript = redis.NewScript(2, callOrResLua)
+
+// Lua source of callOrResScript, also used by the ResultScripts.
+const callOrResLua = `
 	redis.call("SET", KEYS[1], ARGV[1], "PX", tonumber(ARGV[1]))
-	local res = redis.call("LPUSH", KEYS[2], ARGV[2])
+	local push = ARGV[4]
+	local res = redis.call(push, KEYS[2], ARGV[2])
 	local limit = tonumber(ARGV[3])
 	if res > limit and limit > 0 then
 		local diff = res - limit
-		redis.call("LTRIM", KEYS[2], diff, limit + diff)
+		if push == "RPUSH" then
+			redis.call("LTRIM", KEYS[2], 0, limit - 1)
+		else
+			redis.call("LTRIM", KEYS[2], diff, limit + diff)
+		end
 		return redis.error_reply("list capacity exceeded")
 	end
 	return res
-`)
+`
 
 const (
 	// redis cluster-compliant keys, so that both keys are in the same slot
-	callKey        = "juggler:calls:{%s}"            // 1: URI
-	callTimeoutKey = "juggler:calls:timeout:{%s}:%s" // 1: URI, 2: mUUID
+	callKey         = "juggler:calls:{%s}"            // 1: URI
+	callPriorityKey = "juggler:calls:{%s}:priority"   // 1: URI
+	callTimeoutKey  = "juggler:calls:timeout:{%s}:%s" // 1: URI, 2: mUUID
 
 	// redis cluster-compliant keys, so that both keys are in the same slot
 	resKey        = "juggler:results:{%s}"            // 1: cUUID
 	resTimeoutKey = "juggler:results:timeout:{%s}:%s" // 1: cUUID, 2: mUUID
 )
 
+// key returns the redis key built with the format f and args, in the
+// Namespace of the broker.
+func (b *Broker) key(f string, args ...interface{}) string {
+	return nsKey(b.Namespace, f, args...)
+}
+
+// channel returns the pub-sub channel ch in the Namespace of the
+// broker.
+func (b *Broker) channel(ch string) string {
+	return nsName(b.Namespace, ch)
+}
+
+// nsKey returns the redis key built with the constant format f and
+// args, in the namespace ns.
+func nsKey(ns, f string, args ...interface{}) string {
+	return nsName(ns, fmt.Sprintf(f, args...))
+}
+
+// nsName returns the key or channel s in the namespace ns.
+func nsName(ns, s string) string {
+	if ns == "" {
+		return s
+	}
+	return ns + ":" + s
+}
+
+// nsPattern returns the redis glob-style pattern pat in the namespace
+// ns, the special characters of ns being escaped.
+func nsPattern(ns, pat string) string {
+	if ns == "" {
+		return pat
+	}
+	return nsName(globEscaper.Replace(ns), pat)
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// trimNS returns the key or channel s without the namespace ns.
+func trimNS(ns, s string) string {
+	if ns == "" {
+		return s
+	}
+	return strings.TrimPrefix(s, ns+":")
+}
+
+// trimPatternNS returns the pattern pat without the namespace ns, as
+// added by nsPattern.
+func trimPatternNS(ns, pat string) string {
+	if ns == "" {
+		return pat
+	}
+	return strings.TrimPrefix(pat, globEscaper.Replace(ns)+":")
+}
+
 // Call registers a call request in the broker.
 func (b *Broker) Call(cp *message.CallPayload, timeout time.Duration) error {
-	k1 := fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)
-	k2 := fmt.Sprintf(callKey, cp.URI)
-	return registerCallOrRes(b.Pool, cp, timeout, b.CallCap, k1, k2)
+	if b.Dispatchers > 0 && b.Mode != StreamMode {
+		ccp := *cp
+		ccp.ResultsQueue = b.dispatcher().queue
+		cp = &ccp
+	}
+
+	uri := cp.URI
+	if b.PrefixRouting {
+		var err error
+		if uri, err = b.route(cp.URI); err != nil {
+			return err
+		}
+	}
+	uri = b.shard(uri, cp)
+
+	k1 := b.key(callTimeoutKey, uri, cp.MsgUUID)
+	k2 := b.key(callKey, uri)
+	priority := cp.Priority
+	if b.PriorityQueues && priority > 0 {
+		// pushed with LPUSH, so the high-priority calls are FIFO
+		k2, priority = b.key(callPriorityKey, uri), 0
+	}
+	args, enc, ref, err := b.packArgs(cp.Args, timeout)
+	if err != nil {
+		return err
+	}
+	if enc != "" || ref != "" {
+		ccp := *cp
+		ccp.Args, ccp.Compression, ccp.BlobRef = args, enc, ref
+		cp = &ccp
+	}
+	return b.withDedup(b.dedupCallKeyFor(cp.MsgUUID), "DedupedCalls", func() error {
+		if b.Mode == StreamMode {
+			return addCallOrRes(b.Pool, cp, timeout, b.CallCap, k1, b.key(callStreamKey, uri))
+		}
+		return b.registerCallOrRes(cp, priority, timeout, b.CallCap, k1, k2)
+	})
 }
 
 // Result registers a call result in the broker.
 func (b *Broker) Result(rp *message.ResPayload, timeout time.Duration) error {
-	k1 := fmt.Sprintf(resTimeoutKey, rp.ConnUUID, rp.MsgUUID)
-	k2 := fmt.Sprintf(resKey, rp.ConnUUID)
-	return registerCallOrRes(b.Pool, rp, timeout, b.ResultCap, k1, k2)
+	k1, k2 := b.resultKeys(rp)
+	rp, err := b.packResult(rp, timeout)
+	if err != nil {
+		return err
+	}
+	return b.withDedup(b.dedupResKeyFor(rp.MsgUUID, rp.Chunk, rp.Seq), "DedupedResults", func() error {
+		if b.Mode == StreamMode && rp.ResultsQueue == "" {
+			return addCallOrRes(b.Pool, rp, timeout, b.ResultCap, k1, b.key(resStreamKey, rp.ConnUUID))
+		}
+		return b.registerCallOrRes(rp, rp.Priority, timeout, b.ResultCap, k1, k2)
+	})
 }
 
-func registerCallOrRes(pool Pool, pld interface{}, timeout time.Duration, cap int, k1, k2 string) error {
-	p, err := json.Marshal(pld)
+// resultKeys returns the keys of the expiring key and of the LIST of
+// the result rp.
+func (b *Broker) resultKeys(rp *message.ResPayload) (string, string) {
+	if rp.ResultsQueue != "" {
+		// dispatched from the shared results queue of the caller
+		return b.key(resQueueTimeoutKey, rp.ResultsQueue, rp.MsgUUID),
+			b.key(resQueueKey, rp.ResultsQueue)
+	}
+	return b.key(resTimeoutKey, rp.ConnUUID, rp.MsgUUID),
+		b.key(resKey, rp.ConnUUID)
+}
+
+// packResult returns the result rp with its arguments compressed or
+// offloaded (see packArgs), if needed.
+func (b *Broker) packResult(rp *message.ResPayload, timeout time.Duration) (*message.ResPayload, error) {
+	args, enc, ref, err := b.packArgs(rp.Args, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if enc != "" || ref != "" {
+		crp := *rp
+		crp.Args, crp.Compression, crp.BlobRef = args, enc, ref
+		rp = &crp
+	}
+	return rp, nil
+}
+
+func (b *Broker) registerCallOrRes(pld interface{}, priority int, timeout time.Duration, cap int, k1, k2 string) error {
+	argv, err := callOrResArgs(pld, priority, timeout, cap)
 	if err != nil {
 		return err
 	}
 
-	rc := pool.Get()
+	args := append([]interface{}{
+		k1, // key[1] : the SET key with expiration
+		k2, // key[2] : the LIST key
+	}, argv...)
+	if b.FlushInterval > 0 {
+		return b.pipeline().do(k1, args)
+	}
+
+	rc := b.Pool.Get()
 	defer rc.Close()
 
 	// turn it into a cluster-aware RetryConn if running in a cluster
 	rc = clusterifyConn(rc, k1, k2)
 
+	_, err = callOrResScript.Do(rc, args...)
+	return err
+}
+
+// callOrResArgs returns the ARGV of callOrResScript to register the
+// payload pld.
+func callOrResArgs(pld interface{}, priority int, timeout time.Duration, cap int) ([]interface{}, error) {
+	p, err := json.Marshal(pld)
+	if err != nil {
+		return nil, err
+	}
+
 	to := int(timeout / time.Millisecond)
 	if to == 0 {
 		to = int(broker.DefaultCallTimeout / time.Millisecond)
 	}
 
-	_, err = callOrResScript.Do(rc,
-		k1,  // key[1] : the SET key with expiration
-		k2,  // key[2] : the LIST key
-		to,  // argv[1] : the timeout in milliseconds
-		p,   // argv[2] : the call payload
-		cap, // argv[3] : the LIST capacity
-	)
-	return err
+	push := "LPUSH"
+	if priority > 0 {
+		push = "RPUSH"
+	}
+
+	return []interface{}{
+		to,   // argv[1] : the timeout in milliseconds
+		p,    // argv[2] : the call payload
+		cap,  // argv[3] : the LIST capacity
+		push, // argv[4] : the push command, depending on the priority
+	}, nil
 }
 
-// Publish publishes an event to a channel.
-func (b *Broker) Publish(channel string, pp *message.PubPayload) error {
-	p, err := json.Marshal(pp)
+// packArgs returns the arguments to store in the payload for args,
+// along with the compression encoding and the blob reference, if the
+// broker is configured to compress or offload args of that size. If
+// the arguments are offloaded, the blob expires after ttl. If the
+// compression fails, args are stored uncompressed.
+func (b *Broker) packArgs(args json.RawMessage, ttl time.Duration) (json.RawMessage, string, string, error) {
+	if b.OffloadThreshold > 0 && len(args) > b.OffloadThreshold {
+		if ttl <= 0 {
+			ttl = broker.DefaultCallTimeout
+		}
+		ref, err := b.blobStore().PutBlob(args, ttl)
+		if err != nil {
+			return nil, "", "", err
+		}
+		return nil, "", ref, nil
+	}
+
+	if b.Compression == "" || len(args) <= b.CompressThreshold {
+		return args, "", "", nil
+	}
+	cargs, err := message.CompressArgs(b.Compression, args)
+	if err != nil || len(cargs) >= len(args) {
+		return args, "", "", nil
+	}
+	return cargs, b.Compression, "", nil
+}
+
+// unpackArgs reverses packArgs, resolving the blob reference ref using
+// blobs, or decompressing args if enc is not empty.
+func unpackArgs(blobs broker.BlobStore, args *json.RawMessage, enc, ref *string) error {
+	if *ref != "" {
+		b, err := blobs.GetBlob(*ref)
+		if err != nil {
+			return err
+		}
+		*args, *ref = b, ""
+		return nil
+	}
+
+	if *enc == "" {
+		return nil
+	}
+	b, err := message.DecompressArgs(*enc, *args, 0)
 	if err != nil {
 		return err
 	}
+	*args, *enc = b, ""
+	return nil
+}
+
+// blobStore returns the BlobStore to use, the broker itself if none is
+// set.
+func (b *Broker) blobStore() broker.BlobStore {
+	if b.BlobStore != nil {
+		return b.BlobStore
+	}
+	return b
+}
+
+const blobKey = "juggler:blobs:{%s}" // 1: blob reference
+
+// PutBlob stores b as a redis key that expires after ttl, and returns
+// its reference.
+func (b *Broker) PutBlob(blob []byte, ttl time.Duration) (string, error) {
+	ref := uuid.NewRandom().String()
+	k := b.key(blobKey, ref)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	ms := int64(ttl / time.Millisecond)
+	if ms <= 0 {
+		ms = 1
+	}
+	if _, err := rc.Do("SET", k, blob, "PX", ms); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+// GetBlob returns the blob stored with PutBlob, identified by ref.
+func (b *Broker) GetBlob(ref string) ([]byte, error) {
+	k := b.key(blobKey, ref)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	blob, err := redis.Bytes(rc.Do("GET", k))
+	if err == redis.ErrNil {
+		return nil, broker.ErrBlobNotFound
+	}
+	return blob, err
+}
+
+const lockKey = "juggler:locks:{%s}" // 1: lock key
+
+// TryLock acquires the lock identified by key for ttl, using a redis
+// key set with the NX option. It returns false if the lock is already
+// held. The lock is released when it expires.
+func (b *Broker) TryLock(key string, ttl time.Duration) (bool, error) {
+	k := b.key(lockKey, key)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	ms := int64(ttl / time.Millisecond)
+	if ms <= 0 {
+		ms = 1
+	}
+	_, err := redis.String(rc.Do("SET", k, 1, "PX", ms, "NX"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Publish publishes an event to a channel. It returns the number of
+// subscribers that received the event, as returned by the redis
+// PUBLISH command. In a redis cluster, only the subscribers connected
+// to the node that executed the command are counted.
+//
+// If the channel matches DurableChannels, the event is also appended
+// to the stream of the channel, and it is published with its ID.
+func (b *Broker) Publish(channel string, pp *message.PubPayload) (int, error) {
+	if b.Topics {
+		if err := broker.ValidTopic(channel); err != nil {
+			return 0, err
+		}
+	}
+
+	durable := b.isDurable(channel)
+	ttl := broker.DefaultCallTimeout
+	if durable {
+		// offloaded arguments must be available for replay
+		ttl = b.durableRetention()
+	}
+	args, enc, ref, err := b.packArgs(pp.Args, ttl)
+	if err != nil {
+		return 0, err
+	}
+	if enc != "" || ref != "" {
+		cpp := *pp
+		cpp.Args, cpp.Compression, cpp.BlobRef = args, enc, ref
+		pp = &cpp
+	}
+	p, err := json.Marshal(pp)
+	if err != nil {
+		return 0, err
+	}
+	if durable {
+		return b.publishDurable(channel, p)
+	}
 
 	rc := b.Pool.Get()
 	defer rc.Close()
@@ -180,10 +746,119 @@ func (b *Broker) Publish(channel string, pp *message.PubPayload) error {
 		// Bind without a key selects a random node.
 		bc.Bind()
 	}
-	_, err = rc.Do("PUBLISH", channel, p)
+	return redis.Int(rc.Do("PUBLISH", b.channel(channel), p))
+}
+
+// Ping checks that the redis backend is reachable, using the redis
+// PING command on a connection from the pool.
+func (b *Broker) Ping() error {
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	_, err := rc.Do("PING")
 	return err
 }
 
+// NumSub returns the number of subscribers for each of the channels,
+// using the redis PUBSUB NUMSUB command. In a redis cluster, only
+// the subscribers connected to the node that executed the command
+// are counted, unless NodePools is set, in which case the counts of
+// all nodes are added.
+func (b *Broker) NumSub(channels ...string) (map[string]int, error) {
+	res := make(map[string]int, len(channels))
+	if len(channels) == 0 {
+		return res, nil
+	}
+
+	args := redis.Args{"NUMSUB"}
+	for _, ch := range channels {
+		args = args.Add(b.channel(ch))
+	}
+	for _, p := range b.infoPools() {
+		if err := numSub(p, args, b.Namespace, res); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func numSub(pool Pool, args redis.Args, ns string, res map[string]int) error {
+	rc := pool.Get()
+	defer rc.Close()
+
+	vals, err := redis.Values(rc.Do("PUBSUB", args...))
+	if err != nil {
+		return err
+	}
+	for len(vals) > 0 {
+		var ch string
+		var n int
+		if vals, err = redis.Scan(vals, &ch, &n); err != nil {
+			return err
+		}
+		res[trimNS(ns, ch)] += n
+	}
+	return nil
+}
+
+// Channels returns the active channels matching pattern, using the
+// redis PUBSUB CHANNELS command. In a redis cluster, only the channels
+// with subscribers connected to the node that executed the command are
+// returned, unless NodePools is set, in which case the channels of all
+// nodes are returned.
+func (b *Broker) Channels(pattern string) ([]string, error) {
+	args := redis.Args{"CHANNELS"}
+	if pattern != "" {
+		args = args.Add(nsPattern(b.Namespace, pattern))
+	} else if b.Namespace != "" {
+		// only the channels of the namespace
+		args = args.Add(nsPattern(b.Namespace, "*"))
+	}
+
+	pools := b.infoPools()
+	if len(pools) == 1 {
+		return channels(pools[0], args, b.Namespace)
+	}
+
+	var res []string
+	seen := make(map[string]bool)
+	for _, p := range pools {
+		chans, err := channels(p, args, b.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, ch := range chans {
+			if !seen[ch] {
+				seen[ch] = true
+				res = append(res, ch)
+			}
+		}
+	}
+	return res, nil
+}
+
+func channels(pool Pool, args redis.Args, ns string) ([]string, error) {
+	rc := pool.Get()
+	defer rc.Close()
+
+	chans, err := redis.Strings(rc.Do("PUBSUB", args...))
+	if err != nil {
+		return nil, err
+	}
+	for i, ch := range chans {
+		chans[i] = trimNS(ns, ch)
+	}
+	return chans, nil
+}
+
+// infoPools returns the pools to query for pub-sub information.
+func (b *Broker) infoPools() []Pool {
+	if len(b.NodePools) > 0 {
+		return b.NodePools
+	}
+	return []Pool{b.Pool}
+}
+
 // NewPubSubConn returns a new pub-sub connection that can be used
 // to subscribe to and unsubscribe from channels, and to process
 // incoming events.
@@ -193,44 +868,108 @@ func (b *Broker) NewPubSubConn() (broker.PubSubConn, error) {
 		return nil, err
 	}
 	return &pubSubConn{
-		psc:   redis.PubSubConn{Conn: rc},
-		logFn: b.LogFunc,
-		vars:  b.Vars,
+		psc:    redis.PubSubConn{Conn: rc},
+		ns:     b.Namespace,
+		logFn:  b.LogFunc,
+		vars:   b.metrics(),
+		blobs:  b.blobStore(),
+		topics: b.Topics,
 	}, nil
 }
 
 // NewCallsConn returns a new calls connection that can be used
-// to process the call requests for the specified URIs.
+// to process the call requests for the specified URIs. If
+// PrefixRouting is set, the URIs are registered so that the calls
+// are routed to them, and they can be prefix URIs. If
+// VisibilityTimeout is set or Mode is StreamMode, the returned
+// connection implements broker.AckCallsConn.
 func (b *Broker) NewCallsConn(uris ...string) (broker.CallsConn, error) {
+	if b.PrefixRouting {
+		if err := b.registerRoutes(uris); err != nil {
+			return nil, err
+		}
+	}
+	if b.Mode == StreamMode {
+		for _, uri := range uris {
+			if err := b.createGroup(b.key(callStreamKey, uri)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	rc, err := b.Dial()
 	if err != nil {
 		return nil, err
 	}
-	return &callsConn{
+	cc := &callsConn{
 		c:       rc,
 		pool:    b.Pool,
 		uris:    uris,
-		vars:    b.Vars,
+		ns:      b.Namespace,
+		vars:    b.metrics(),
 		timeout: b.BlockingTimeout,
 		logFn:   b.LogFunc,
-	}, nil
+		blobs:   b.blobStore(),
+	}
+	if b.Mode == StreamMode {
+		vis := b.VisibilityTimeout
+		if vis <= 0 {
+			vis = DefaultStreamVisibilityTimeout
+		}
+		return &streamCallsConn{
+			callsConn:  cc,
+			group:      b.consumerGroup(),
+			consumer:   uuid.NewRandom().String(),
+			visibility: vis,
+			entries:    make(map[string]streamEntry),
+		}, nil
+	}
+	if b.VisibilityTimeout <= 0 {
+		return cc, nil
+	}
+
+	poll := b.PollInterval
+	if poll <= 0 {
+		poll = DefaultPollInterval
+	}
+	cc.reliable = &reliableCallsConn{
+		callsConn:  cc,
+		visibility: b.VisibilityTimeout,
+		poll:       poll,
+		stop:       make(chan struct{}),
+		queues:     make(map[string]string),
+	}
+	return cc.reliable, nil
 }
 
 // NewResultsConn returns a new results connection that can be used
-// to process the call results for the specified connection UUID.
+// to process the call results for the specified connection UUID. If
+// Dispatchers is set, the results are received from the shared
+// results dispatcher, and the connection replaces any other results
+// connection for that UUID.
 func (b *Broker) NewResultsConn(connUUID uuid.UUID) (broker.ResultsConn, error) {
+	if b.Dispatchers > 0 && b.Mode != StreamMode {
+		return b.dispatcher().register(connUUID)
+	}
+
 	rc, err := b.Dial()
 	if err != nil {
 		return nil, err
 	}
-	return &resultsConn{
+	resc := &resultsConn{
 		c:        rc,
 		pool:     b.Pool,
 		connUUID: connUUID,
-		vars:     b.Vars,
+		ns:       b.Namespace,
+		vars:     b.metrics(),
 		timeout:  b.BlockingTimeout,
 		logFn:    b.LogFunc,
-	}, nil
+		blobs:    b.blobStore(),
+	}
+	if b.Mode == StreamMode {
+		return &streamResultsConn{resultsConn: resc}, nil
+	}
+	return resc, nil
 }
 
 const (
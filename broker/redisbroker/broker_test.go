@@ -2,14 +2,19 @@ package redisbroker
 
 import (
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/jugglertest"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 	"github.com/mna/redisc/redistest"
 	"github.com/garyburd/redigo/redis"
 	"github.com/pborman/uuid"
@@ -134,17 +139,20 @@ func TestPublish(t *testing.T) {
 	cases := []struct {
 		v  interface{}
 		ch string
+		n  int
 	}{
-		{"abc", "a"},
-		{"def", "b"},
-		{map[string]interface{}{"v": 3}, "a"},
-		{5, "c"},
+		{"abc", "a", 1},
+		{"def", "b", 0},
+		{map[string]interface{}{"v": 3}, "a", 1},
+		{5, "c", 0},
 	}
 	for i, c := range cases {
 		b, err := json.Marshal(c.v)
 		require.NoError(t, err, "marshal case %d", i)
 		pp := &message.PubPayload{MsgUUID: uuid.NewRandom(), Args: b}
-		require.NoError(t, brk.Publish(c.ch, pp), "Publish event %d", i)
+		n, err := brk.Publish(c.ch, pp)
+		require.NoError(t, err, "Publish event %d", i)
+		assert.Equal(t, c.n, n, "delivered count %d", i)
 	}
 
 	require.NoError(t, psc.Close(), "close subscribed connection")
@@ -152,6 +160,43 @@ func TestPublish(t *testing.T) {
 	assert.Equal(t, 2, cnt, "number of events received")
 }
 
+func TestPubSubInfo(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	psc1, err := brk.NewPubSubConn()
+	require.NoError(t, err, "get PubSubConn 1")
+	defer psc1.Close()
+	psc2, err := brk.NewPubSubConn()
+	require.NoError(t, err, "get PubSubConn 2")
+	defer psc2.Close()
+
+	require.NoError(t, psc1.Subscribe("a", false), "Subscribe 1 a")
+	require.NoError(t, psc1.Subscribe("b", false), "Subscribe 1 b")
+	require.NoError(t, psc2.Subscribe("a", false), "Subscribe 2 a")
+	require.NoError(t, psc2.Subscribe("c*", true), "Subscribe 2 c*")
+
+	n, err := brk.NumSub("a", "b", "c", "d")
+	require.NoError(t, err, "NumSub")
+	assert.Equal(t, map[string]int{"a": 2, "b": 1, "c": 0, "d": 0}, n, "NumSub")
+
+	chans, err := brk.Channels("")
+	require.NoError(t, err, "Channels")
+	sort.Strings(chans)
+	assert.Equal(t, []string{"a", "b"}, chans, "all channels")
+
+	chans, err = brk.Channels("b*")
+	require.NoError(t, err, "Channels b*")
+	assert.Equal(t, []string{"b"}, chans, "b* channels")
+}
+
 func expectUUIDs(t *testing.T, rc redis.Conn, key string, uuids ...uuid.UUID) {
 	defer rc.Close()
 	vals, err := redis.ByteSlices(rc.Do("LRANGE", key, 0, -1))
@@ -171,3 +216,200 @@ func logIfVerbose(s string, args ...interface{}) {
 		log.Printf(s, args...)
 	}
 }
+
+// assertNoLeak closes the pool and checks that no goroutine started
+// after snap is still running, and that only one client (the one
+// used to check) is connected to the redis server on port.
+func assertNoLeak(t *testing.T, snap *jugglertest.GoroutineSnapshot, pool *redis.Pool, port string) {
+	require.NoError(t, pool.Close(), "close pool")
+	snap.AssertNoLeak(t, time.Second)
+
+	rc, err := redis.Dial("tcp", ":"+port)
+	require.NoError(t, err, "Dial")
+	defer rc.Close()
+	jugglertest.AssertRedisClients(t, rc, 1, time.Second)
+}
+
+func TestCompression(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:              pool,
+		Dial:              pool.Dial,
+		LogFunc:           logIfVerbose,
+		Compression:       message.Gzip,
+		CompressThreshold: 10,
+	}
+
+	args, err := json.Marshal(strings.Repeat("abcd", 100))
+	require.NoError(t, err, "Marshal")
+
+	// call is stored compressed and decompressed when read
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "NewCallsConn")
+	defer cc.Close()
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Args: args}
+	require.NoError(t, brk.Call(cp, time.Second), "Call")
+	assert.Equal(t, "", cp.Compression, "source payload unchanged")
+	select {
+	case got := <-cc.Calls():
+		assert.Equal(t, string(args), string(got.Args), "call args")
+		assert.Equal(t, "", got.Compression, "call compression cleared")
+	case <-time.After(time.Second):
+		t.Error("no call received")
+	}
+
+	// same for events
+	psc, err := brk.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn")
+	defer psc.Close()
+	require.NoError(t, psc.Subscribe("c", false), "Subscribe")
+
+	_, err = brk.Publish("c", &message.PubPayload{MsgUUID: uuid.NewRandom(), Args: args})
+	require.NoError(t, err, "Publish")
+	select {
+	case ev := <-psc.Events():
+		assert.Equal(t, string(args), string(ev.Args), "event args")
+	case <-time.After(time.Second):
+		t.Error("no event received")
+	}
+}
+
+func TestOffload(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:             pool,
+		Dial:             pool.Dial,
+		LogFunc:          logIfVerbose,
+		OffloadThreshold: 10,
+	}
+
+	_, err := brk.GetBlob("nope")
+	assert.Equal(t, broker.ErrBlobNotFound, err, "GetBlob unknown ref")
+
+	args, err := json.Marshal(strings.Repeat("abcd", 10))
+	require.NoError(t, err, "Marshal")
+
+	// result is stored as a blob and resolved when read
+	rc, err := brk.NewResultsConn(uuid.NewRandom())
+	require.NoError(t, err, "NewResultsConn")
+	defer rc.Close()
+
+	connUUID := rc.(*resultsConn).connUUID
+	rp := &message.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a", Args: args}
+	require.NoError(t, brk.Result(rp, time.Second), "Result")
+	assert.Equal(t, "", rp.BlobRef, "source payload unchanged")
+
+	c := pool.Get()
+	defer c.Close()
+	keys, err := redis.Strings(c.Do("KEYS", "juggler:blobs:*"))
+	require.NoError(t, err, "KEYS")
+	assert.Equal(t, 1, len(keys), "blob stored")
+
+	select {
+	case got := <-rc.Results():
+		assert.Equal(t, string(args), string(got.Args), "result args")
+		assert.Equal(t, "", got.BlobRef, "blob reference cleared")
+	case <-time.After(time.Second):
+		t.Error("no result received")
+	}
+}
+
+func TestPing(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	var brk broker.Pinger = &Broker{Pool: pool, Dial: pool.Dial}
+	assert.NoError(t, brk.Ping(), "Ping")
+
+	cmd.Process.Kill()
+	cmd.Wait()
+	assert.Error(t, brk.Ping(), "Ping after server stopped")
+}
+
+func TestBrokerMetrics(t *testing.T) {
+	var b Broker
+	assert.Equal(t, metrics.Discard, b.metrics(), "no sink")
+
+	parent := new(expvar.Map).Init()
+	b.SetMetrics(parent)
+	assert.Equal(t, parent, b.metrics(), "inherited sink")
+
+	b.SetMetrics(new(expvar.Map).Init())
+	assert.Equal(t, parent, b.metrics(), "inherited sink is set only once")
+
+	own := new(expvar.Map).Init()
+	b.Vars = own
+	assert.Equal(t, own, b.metrics(), "own sink has priority")
+}
+
+func TestNamespace(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	b1 := &Broker{Pool: pool, Dial: pool.Dial, Namespace: "t1", BlockingTimeout: time.Second, LogFunc: logIfVerbose}
+	b2 := &Broker{Pool: pool, Dial: pool.Dial, Namespace: "t2", BlockingTimeout: time.Second, LogFunc: logIfVerbose}
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, b1.Call(cp, time.Second), "Call")
+
+	rc := pool.Get()
+	defer rc.Close()
+	n, err := redis.Int(rc.Do("LLEN", "t1:"+fmt.Sprintf(callKey, "a")))
+	require.NoError(t, err, "LLEN t1")
+	assert.Equal(t, 1, n, "call in namespace t1")
+	n, err = redis.Int(rc.Do("LLEN", fmt.Sprintf(callKey, "a")))
+	require.NoError(t, err, "LLEN")
+	assert.Equal(t, 0, n, "no call without namespace")
+
+	cc, err := b1.NewCallsConn("a")
+	require.NoError(t, err, "NewCallsConn")
+	defer cc.Close()
+	select {
+	case got := <-cc.Calls():
+		assert.Equal(t, cp.MsgUUID, got.MsgUUID, "received call")
+	case <-time.After(time.Second):
+		t.Fatal("call not received")
+	}
+
+	// events are isolated by namespace, and their channels are not
+	// prefixed.
+	psc1, err := b1.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn t1")
+	defer psc1.Close()
+	require.NoError(t, psc1.Subscribe("c*", true), "PSubscribe t1")
+	psc2, err := b2.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn t2")
+	defer psc2.Close()
+	require.NoError(t, psc2.Subscribe("ch", false), "Subscribe t2")
+	time.Sleep(10 * time.Millisecond)
+
+	n, err = b1.Publish("ch", &message.PubPayload{MsgUUID: uuid.NewRandom()})
+	require.NoError(t, err, "Publish t1")
+	assert.Equal(t, 1, n, "only the subscriber in t1 received the event")
+	select {
+	case ep := <-psc1.Events():
+		assert.Equal(t, "ch", ep.Channel, "channel")
+		assert.Equal(t, "c*", ep.Pattern, "pattern")
+	case <-time.After(time.Second):
+		t.Fatal("event not received")
+	}
+
+	subs, err := b2.NumSub("ch")
+	require.NoError(t, err, "NumSub")
+	assert.Equal(t, map[string]int{"ch": 1}, subs, "NumSub t2")
+	chans, err := b2.Channels("")
+	require.NoError(t, err, "Channels")
+	assert.Equal(t, []string{"ch"}, chans, "Channels t2")
+	chans, err = b1.Channels("")
+	require.NoError(t, err, "Channels")
+	assert.Empty(t, chans, "Channels t1")
+}
@@ -2,13 +2,12 @@ package redisbroker
 
 import (
 	"encoding/json"
-	"expvar"
-	"fmt"
 	"sync"
 	"time"
 
 	"github.com/mna/juggler/broker"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 	"github.com/garyburd/redigo/redis"
 )
 
@@ -25,9 +24,15 @@ type callsConn struct {
 	c       redis.Conn
 	pool    Pool
 	uris    []string
+	ns      string
 	timeout time.Duration
 	logFn   func(string, ...interface{})
-	vars    *expvar.Map
+	vars    metrics.Sink
+	blobs   broker.BlobStore
+
+	// set if the calls are processed at least once (see
+	// Broker.VisibilityTimeout)
+	reliable *reliableCallsConn
 
 	// once makes sure only the first call to Calls starts the goroutine.
 	once sync.Once
@@ -52,16 +57,19 @@ func (c *callsConn) CallsErr() error {
 }
 
 // Calls returns a stream of call requests for the URIs specified when
-// creating the callsConn. For use in a redis cluster, all URIs must
-// belong to the same cluster slot.
+// creating the callsConn. The high-priority lists of all URIs are
+// polled before the normal lists (see Broker.PriorityQueues). For use
+// in a redis cluster, all URIs must belong to the same cluster slot.
 func (c *callsConn) Calls() <-chan *message.CallPayload {
 	c.once.Do(func() {
 		c.ch = make(chan *message.CallPayload)
 
-		// compute all keys and timeout
-		keys := make([]string, len(c.uris))
+		// compute all keys and timeout, BRPOP pops from the first
+		// non-empty list in the order of the keys.
+		keys := make([]string, 2*len(c.uris))
 		for i, uri := range c.uris {
-			keys[i] = fmt.Sprintf(callKey, uri)
+			keys[i] = nsKey(c.ns, callPriorityKey, uri)
+			keys[len(c.uris)+i] = nsKey(c.ns, callKey, uri)
 		}
 		to := int(c.timeout / time.Second)
 		args := redis.Args{}.AddFlat(keys).Add(to)
@@ -108,43 +116,59 @@ func (c *callsConn) sendCall(v []interface{}, wg *sync.WaitGroup) {
 
 	// unmarshal the payload
 	var cp message.CallPayload
-	if err := unmarshalBRPOPValue(&cp, v); err != nil {
-		if c.vars != nil {
-			c.vars.Add("FailedCallPayloadUnmarshals", 1)
-		}
+	err := unmarshalBRPOPValue(&cp, v)
+	if err == nil {
+		err = unpackArgs(c.blobs, &cp.Args, &cp.Compression, &cp.BlobRef)
+	}
+	if err != nil {
+		c.vars.Add("FailedCallPayloadUnmarshals", 1)
 		logf(c.logFn, "Calls: BRPOP failed to unmarshal call payload: %v", err)
 		return
 	}
 
-	// check if call is expired
-	k := fmt.Sprintf(callTimeoutKey, cp.URI, cp.MsgUUID)
+	// check if call is expired, the timeout key is in the slot of the
+	// queue, which may be a prefix URI if the call was routed.
+	var key string
+	if _, err := redis.Scan(v, &key); err != nil {
+		key = nsKey(c.ns, callKey, cp.URI)
+	}
+	queue := callKeyURI(key)
+	k := nsKey(c.ns, callTimeoutKey, queue, cp.MsgUUID)
 
 	rc := c.pool.Get()
 	defer rc.Close()
 	rc = clusterifyConn(rc, k)
 
-	pttl, err := redis.Int(delAndPTTLScript.Do(rc, k))
+	var pttl int
+	if c.reliable != nil {
+		// the timeout key is deleted when the call is acknowledged, so
+		// that it is still valid if the call is requeued.
+		pttl, err = redis.Int(rc.Do("PTTL", k))
+	} else {
+		pttl, err = redis.Int(delAndPTTLScript.Do(rc, k))
+	}
 	if err != nil {
-		if c.vars != nil {
-			c.vars.Add("FailedPTTLCalls", 1)
-		}
-		logf(c.logFn, "Calls: DEL/PTTL failed: %v", err)
+		metrics.AddExemplar(c.vars, "FailedPTTLCalls", 1, cp.CorrelationID)
+		logf(c.logFn, "Calls: DEL/PTTL failed: %v [%s]", err, cp.CorrelationID)
 		return
 	}
 	if pttl <= 0 {
-		if c.vars != nil {
-			c.vars.Add("ExpiredCalls", 1)
+		metrics.AddExemplar(c.vars, "ExpiredCalls", 1, cp.CorrelationID)
+		logf(c.logFn, "Calls: message %v expired, dropping call [%s]", cp.MsgUUID, cp.CorrelationID)
+		if c.reliable != nil {
+			c.reliable.track(&cp, queue)
+			c.reliable.Ack(&cp)
 		}
-		logf(c.logFn, "Calls: message %v expired, dropping call", cp.MsgUUID)
 		return
 	}
+	if c.reliable != nil {
+		c.reliable.track(&cp, queue)
+	}
 
 	cp.ReadTimestamp = time.Now().UTC()
 	cp.TTLAfterRead = time.Duration(pttl) * time.Millisecond
 	c.ch <- &cp
-	if c.vars != nil {
-		c.vars.Add("Calls", 1)
-	}
+	metrics.AddExemplar(c.vars, "Calls", 1, cp.CorrelationID)
 }
 
 func unmarshalBRPOPValue(dst interface{}, src []interface{}) error {
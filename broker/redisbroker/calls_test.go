@@ -1,10 +1,13 @@
 package redisbroker
 
 import (
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/jugglertest"
 	"github.com/mna/juggler/message"
 	"github.com/mna/redisc/redistest"
 	"github.com/pborman/uuid"
@@ -16,6 +19,7 @@ func TestCalls(t *testing.T) {
 	cmd, port := redistest.StartServer(t, nil, "")
 	defer cmd.Process.Kill()
 
+	snap := jugglertest.SnapshotGoroutines()
 	pool := redistest.NewPool(t, ":"+port)
 	brk := &Broker{
 		Pool:            pool,
@@ -66,4 +70,228 @@ func TestCalls(t *testing.T) {
 		assert.Contains(t, cc.CallsErr().Error(), "use of closed", "CallsErr is the expected error")
 	}
 	assert.Equal(t, expected, uuids, "got expected UUIDs")
+
+	assertNoLeak(t, snap, pool, port)
+}
+
+func TestCallsPriority(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	defer pool.Close()
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		LogFunc:         logIfVerbose,
+	}
+
+	// register the calls before listening, so that they are all pending
+	normal := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	high := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Priority: 1}
+	require.NoError(t, brk.Call(normal, time.Minute), "Call normal")
+	require.NoError(t, brk.Call(high, time.Minute), "Call high")
+
+	cc, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection")
+	defer cc.Close()
+
+	var got []uuid.UUID
+	for cp := range cc.Calls() {
+		got = append(got, cp.MsgUUID)
+		if len(got) == 2 {
+			break
+		}
+	}
+	assert.Equal(t, []uuid.UUID{high.MsgUUID, normal.MsgUUID}, got, "high priority call first")
+}
+
+func TestCallsPriorityQueues(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	defer pool.Close()
+
+	for _, vis := range []time.Duration{0, time.Minute} {
+		brk := &Broker{
+			Pool:              pool,
+			Dial:              pool.Dial,
+			BlockingTimeout:   time.Second,
+			PriorityQueues:    true,
+			VisibilityTimeout: vis,
+			PollInterval:      10 * time.Millisecond,
+			LogFunc:           logIfVerbose,
+		}
+
+		// register the calls before listening, so that they are all
+		// pending. The high-priority calls of all URIs are received
+		// first, in the order they were made.
+		calls := []*message.CallPayload{
+			{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"},
+			{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "b", Priority: 1},
+			{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Priority: 2},
+		}
+		for i, cp := range calls {
+			require.NoError(t, brk.Call(cp, time.Minute), "%v: Call %d", vis, i)
+		}
+
+		cc, err := brk.NewCallsConn("a", "b")
+		require.NoError(t, err, "%v: get Calls connection", vis)
+
+		var got []uuid.UUID
+		for cp := range cc.Calls() {
+			got = append(got, cp.MsgUUID)
+			if ac, ok := cc.(broker.AckCallsConn); ok {
+				require.NoError(t, ac.Ack(cp), "%v: Ack", vis)
+			}
+			if len(got) == len(calls) {
+				break
+			}
+		}
+		require.NoError(t, cc.Close(), "%v: close calls connection", vis)
+		assert.Equal(t, []uuid.UUID{calls[1].MsgUUID, calls[2].MsgUUID, calls[0].MsgUUID}, got, "%v: high priority calls first", vis)
+	}
+}
+
+func TestCallsPrefixRouting(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	defer pool.Close()
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		LogFunc:         logIfVerbose,
+		PrefixRouting:   true,
+	}
+
+	service, err := brk.NewCallsConn("billing.*")
+	require.NoError(t, err, "get prefix Calls connection")
+	defer service.Close()
+	exact, err := brk.NewCallsConn("billing.invoice.create")
+	require.NoError(t, err, "get exact Calls connection")
+	defer exact.Close()
+
+	create := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "billing.invoice.create"}
+	del := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "billing.invoice.delete"}
+	require.NoError(t, brk.Call(create, time.Minute), "Call create")
+	require.NoError(t, brk.Call(del, time.Minute), "Call delete")
+
+	select {
+	case cp := <-exact.Calls():
+		assert.Equal(t, create.MsgUUID, cp.MsgUUID, "exact URI")
+	case <-time.After(time.Second):
+		assert.Fail(t, "no call on exact URI")
+	}
+	select {
+	case cp := <-service.Calls():
+		assert.Equal(t, del.MsgUUID, cp.MsgUUID, "prefix URI")
+		assert.Equal(t, "billing.invoice.delete", cp.URI, "call URI")
+	case <-time.After(time.Second):
+		assert.Fail(t, "no call on prefix URI")
+	}
+}
+
+func TestCallsSharded(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	defer pool.Close()
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		LogFunc:         logIfVerbose,
+		ShardedCalls:    map[string]int{"a": 4},
+		ShardKey: func(cp *message.CallPayload) string {
+			return string(cp.Args)
+		},
+	}
+
+	var conns []broker.CallsConn
+	for i := 0; i < 2; i++ {
+		cc, err := brk.NewCallsConn(ShardURIs("a", AssignShards(4, 2, i))...)
+		require.NoError(t, err, "get Calls connection %d", i)
+		defer cc.Close()
+		conns = append(conns, cc)
+	}
+
+	// find a key for each callee
+	keys := make([]string, 2)
+	for i := 0; keys[0] == "" || keys[1] == ""; i++ {
+		k := strconv.Itoa(i)
+		if ShardOf(k, 4) < 2 {
+			keys[0] = k
+		} else {
+			keys[1] = k
+		}
+	}
+
+	for i, k := range keys {
+		cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", Args: []byte(k)}
+		require.NoError(t, brk.Call(cp, time.Minute), "Call %d", i)
+
+		select {
+		case got := <-conns[i].Calls():
+			assert.Equal(t, cp.MsgUUID, got.MsgUUID, "%d: call UUID", i)
+			assert.Equal(t, "a", got.URI, "%d: call URI", i)
+		case <-time.After(time.Second):
+			assert.Fail(t, "no call", "%d", i)
+		}
+	}
+}
+
+func TestCallsReliable(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	defer pool.Close()
+	brk := &Broker{
+		Pool:              pool,
+		Dial:              pool.Dial,
+		LogFunc:           logIfVerbose,
+		VisibilityTimeout: 100 * time.Millisecond,
+		PollInterval:      10 * time.Millisecond,
+	}
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Call(cp, time.Minute), "Call")
+
+	// the first callee receives the call but doesn't acknowledge it
+	cc1, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection 1")
+	select {
+	case got := <-cc1.Calls():
+		assert.Equal(t, cp.MsgUUID, got.MsgUUID, "first receive")
+	case <-time.After(time.Second):
+		require.FailNow(t, "no call received")
+	}
+	require.NoError(t, cc1.Close(), "close Calls connection 1")
+
+	// the call is requeued and received by the second callee
+	cc2, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection 2")
+	defer cc2.Close()
+	ac, ok := cc2.(broker.AckCallsConn)
+	require.True(t, ok, "AckCallsConn")
+	select {
+	case got := <-ac.Calls():
+		assert.Equal(t, cp.MsgUUID, got.MsgUUID, "requeued receive")
+		require.NoError(t, ac.Ack(got), "Ack")
+	case <-time.After(time.Second):
+		require.FailNow(t, "no requeued call received")
+	}
+
+	// once acknowledged, the call is not requeued
+	select {
+	case got := <-ac.Calls():
+		assert.Fail(t, "unexpected call", "%v", got.MsgUUID)
+	case <-time.After(300 * time.Millisecond):
+	}
 }
@@ -0,0 +1,157 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/internal/localcluster"
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startCluster starts a local redis cluster with its nodes listening
+// from basePort, and returns the cluster and a refreshed cluster client.
+func startCluster(t *testing.T, basePort int) (*localcluster.Cluster, *redisc.Cluster) {
+	if _, err := exec.LookPath("redis-server"); err != nil {
+		t.Skip("redis-server not found")
+	}
+
+	lc, err := localcluster.Start(localcluster.Config{Nodes: 3, BasePort: basePort})
+	require.NoError(t, err, "start cluster")
+
+	rc := &redisc.Cluster{
+		StartupNodes: []string{":" + lc.Ports[0]},
+		CreatePool: func(addr string, opts ...redis.DialOption) (*redis.Pool, error) {
+			return &redis.Pool{
+				MaxIdle: 2,
+				Dial: func() (redis.Conn, error) {
+					return redis.Dial("tcp", addr, opts...)
+				},
+			}, nil
+		},
+	}
+	if err := rc.Refresh(); err != nil {
+		lc.Close()
+		require.NoError(t, err, "refresh cluster")
+	}
+	return lc, rc
+}
+
+func TestClusterCallsAndPubSub(t *testing.T) {
+	lc, cluster := startCluster(t, 17100)
+	defer lc.Close()
+	defer cluster.Close()
+
+	brk := &Broker{
+		Pool:            cluster,
+		Dial:            cluster.Dial,
+		BlockingTimeout: 100 * time.Millisecond,
+		LogFunc:         logIfVerbose,
+	}
+
+	// calls on different URIs are spread across the slots
+	uris := []string{"a", "b", "c", "d"}
+	cc, err := brk.NewCallsConn(uris...)
+	require.NoError(t, err, "NewCallsConn")
+	defer cc.Close()
+
+	want := make(map[string]bool)
+	for _, uri := range uris {
+		cp := &message.CallPayload{
+			ConnUUID: uuid.NewRandom(),
+			MsgUUID:  uuid.NewRandom(),
+			URI:      uri,
+		}
+		require.NoError(t, brk.Call(cp, time.Second), "Call %s", uri)
+		want[cp.MsgUUID.String()] = true
+	}
+
+	got := make(map[string]bool)
+	timeout := time.After(2 * time.Second)
+loop:
+	for len(got) < len(want) {
+		select {
+		case cp, ok := <-cc.Calls():
+			if !ok {
+				break loop
+			}
+			got[cp.MsgUUID.String()] = true
+		case <-timeout:
+			break loop
+		}
+	}
+	assert.Equal(t, want, got, "received calls")
+
+	// pub-sub works on a cluster connection
+	psc, err := brk.NewPubSubConn()
+	require.NoError(t, err, "NewPubSubConn")
+	defer psc.Close()
+	require.NoError(t, psc.Subscribe("a", false), "Subscribe")
+
+	b, _ := json.Marshal("x")
+	_, err = brk.Publish("a", &message.PubPayload{MsgUUID: uuid.NewRandom(), Args: b})
+	require.NoError(t, err, "Publish")
+
+	select {
+	case ev := <-psc.Events():
+		assert.Equal(t, "a", ev.Channel, "event channel")
+		assert.Equal(t, `"x"`, string(ev.Args), "event args")
+	case <-time.After(2 * time.Second):
+		t.Error("no event received")
+	}
+}
+
+func TestClusterPubSubInfo(t *testing.T) {
+	lc, cluster := startCluster(t, 17200)
+	defer lc.Close()
+	defer cluster.Close()
+
+	// one pool per node, and one subscriber on channel "a" connected
+	// to each node.
+	var pools []Pool
+	for _, port := range lc.Ports {
+		pool := &redis.Pool{
+			MaxIdle: 2,
+			Dial: func(addr string) func() (redis.Conn, error) {
+				return func() (redis.Conn, error) {
+					return redis.Dial("tcp", addr)
+				}
+			}(":" + port),
+		}
+		defer pool.Close()
+		pools = append(pools, pool)
+
+		psc := redis.PubSubConn{Conn: pool.Get()}
+		defer psc.Close()
+		require.NoError(t, psc.Subscribe("a", "node:"+port), "Subscribe on %s", port)
+		for i := 0; i < 2; i++ {
+			_, ok := psc.Receive().(redis.Subscription)
+			require.True(t, ok, "subscription confirmed on %s", port)
+		}
+	}
+
+	brk := &Broker{
+		Pool:      cluster,
+		Dial:      cluster.Dial,
+		LogFunc:   logIfVerbose,
+		NodePools: pools,
+	}
+
+	got, err := brk.NumSub("a", "b")
+	require.NoError(t, err, "NumSub")
+	assert.Equal(t, map[string]int{"a": len(lc.Ports), "b": 0}, got, "NumSub")
+
+	chans, err := brk.Channels("node:*")
+	require.NoError(t, err, "Channels")
+	assert.Equal(t, len(lc.Ports), len(chans), "Channels")
+
+	chans, err = brk.Channels("a")
+	require.NoError(t, err, "Channels")
+	assert.Equal(t, []string{"a"}, chans, "Channels")
+}
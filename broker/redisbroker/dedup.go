@@ -0,0 +1,72 @@
+package redisbroker
+
+import (
+	"github.com/mna/juggler/broker"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+const (
+	dedupCallKey  = "juggler:dedup:calls:{%s}"     // 1: mUUID
+	dedupResKey   = "juggler:dedup:results:{%s}"   // 1: mUUID
+	dedupChunkKey = "juggler:dedup:chunks:{%s}:%d" // 1: mUUID, 2: seq
+)
+
+// dedup marks key as registered for the DedupWindow. It returns
+// broker.ErrDuplicate if it already was.
+func (b *Broker) dedup(key string) error {
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, key)
+
+	ms := int64(b.DedupWindow / 1e6)
+	if ms <= 0 {
+		ms = 1
+	}
+	_, err := redis.String(rc.Do("SET", key, 1, "NX", "PX", ms))
+	if err == redis.ErrNil {
+		return broker.ErrDuplicate
+	}
+	return err
+}
+
+// undedup removes the mark of key, so that a registration that failed
+// can be retried.
+func (b *Broker) undedup(key string) {
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, key)
+	rc.Do("DEL", key)
+}
+
+// withDedup calls register if key is not marked as registered, and
+// removes the mark if register fails. Otherwise it increments the
+// metric name and returns broker.ErrDuplicate. It calls register
+// directly if DedupWindow is not set.
+func (b *Broker) withDedup(key, name string, register func() error) error {
+	if b.DedupWindow <= 0 {
+		return register()
+	}
+	if err := b.dedup(key); err != nil {
+		if err == broker.ErrDuplicate {
+			b.metrics().Add(name, 1)
+		}
+		return err
+	}
+	if err := register(); err != nil {
+		b.undedup(key)
+		return err
+	}
+	return nil
+}
+
+func (b *Broker) dedupCallKeyFor(mUUID uuid.UUID) string {
+	return b.key(dedupCallKey, mUUID)
+}
+
+func (b *Broker) dedupResKeyFor(mUUID uuid.UUID, chunk bool, seq int) string {
+	if chunk {
+		return b.key(dedupChunkKey, mUUID, seq)
+	}
+	return b.key(dedupResKey, mUUID)
+}
@@ -0,0 +1,66 @@
+package redisbroker
+
+import (
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc/redistest"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedup(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	vars := new(expvar.Map).Init()
+	brk := &Broker{
+		Pool:        pool,
+		LogFunc:     logIfVerbose,
+		DedupWindow: 100 * time.Millisecond,
+		Vars:        vars,
+	}
+
+	cp := &message.CallPayload{
+		ConnUUID: uuid.NewRandom(),
+		MsgUUID:  uuid.NewRandom(),
+		URI:      "a",
+	}
+	require.NoError(t, brk.Call(cp, time.Second), "Call")
+	assert.Equal(t, broker.ErrDuplicate, brk.Call(cp, time.Second), "duplicate Call")
+
+	rp := &message.ResPayload{
+		ConnUUID: cp.ConnUUID,
+		MsgUUID:  cp.MsgUUID,
+		URI:      "a",
+	}
+	chunk := *rp
+	chunk.Chunk = true
+	require.NoError(t, brk.Result(&chunk, time.Second), "Result chunk")
+	require.NoError(t, brk.Result(rp, time.Second), "Result")
+	assert.Equal(t, broker.ErrDuplicate, brk.Result(&chunk, time.Second), "duplicate Result chunk")
+	assert.Equal(t, broker.ErrDuplicate, brk.Result(rp, time.Second), "duplicate Result")
+
+	rc := pool.Get()
+	defer rc.Close()
+	n, err := redis.Int(rc.Do("LLEN", fmt.Sprintf(callKey, "a")))
+	require.NoError(t, err, "LLEN calls")
+	assert.Equal(t, 1, n, "registered calls")
+	n, err = redis.Int(rc.Do("LLEN", fmt.Sprintf(resKey, cp.ConnUUID)))
+	require.NoError(t, err, "LLEN results")
+	assert.Equal(t, 2, n, "registered results")
+
+	assert.Equal(t, "1", vars.Get("DedupedCalls").String(), "DedupedCalls")
+	assert.Equal(t, "2", vars.Get("DedupedResults").String(), "DedupedResults")
+
+	// the call can be registered again after the window
+	time.Sleep(150 * time.Millisecond)
+	assert.NoError(t, brk.Call(cp, time.Second), "Call after window")
+}
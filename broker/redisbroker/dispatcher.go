@@ -0,0 +1,330 @@
+package redisbroker
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+// delay before a dispatcher tries to reconnect to redis after a
+// failed BRPOP.
+const dispatcherRetryDelay = time.Second
+
+const (
+	// redis cluster-compliant keys, so that both keys are in the same slot
+	resQueueKey        = "juggler:results:queue:{%s}"            // 1: queue
+	resQueueTimeoutKey = "juggler:results:queue:timeout:{%s}:%s" // 1: queue, 2: mUUID
+)
+
+var _ broker.ResultsConn = (*sharedResultsConn)(nil)
+
+// errDispatcherStopped is returned when a dispatcher connection is
+// redialed after the dispatcher was stopped.
+var errDispatcherStopped = errors.New("juggler/redisbroker: dispatcher stopped")
+
+// dispatcher consumes the shared results queue of a broker and routes
+// the results to the results connections of their connection UUID. Its
+// goroutines run only while at least one results connection is
+// registered.
+type dispatcher struct {
+	b     *Broker
+	queue string
+	key   string
+	vars  metrics.Sink
+
+	mu    sync.Mutex
+	conns map[string]*sharedResultsConn // by connection UUID
+	group *dispatchGroup                // nil if not running
+}
+
+// dispatchGroup holds the redis connections of the running dispatcher
+// goroutines, so that they can be stopped by closing their connection.
+type dispatchGroup struct {
+	stop chan struct{}
+
+	mu      sync.Mutex
+	stopped bool
+	rcs     []redis.Conn
+}
+
+// dispatcher returns the results dispatcher of the broker, creating it
+// on first use.
+func (b *Broker) dispatcher() *dispatcher {
+	b.dispOnce.Do(func() {
+		queue := b.ResultsQueue
+		if queue == "" {
+			queue = uuid.NewRandom().String()
+		}
+		b.disp = &dispatcher{
+			b:     b,
+			queue: queue,
+			key:   b.key(resQueueKey, queue),
+			vars:  b.metrics(),
+			conns: make(map[string]*sharedResultsConn),
+		}
+	})
+	return b.disp
+}
+
+// register returns a new results connection for connUUID, starting
+// the dispatcher goroutines if it is the first one. It replaces any
+// results connection already registered for connUUID.
+func (d *dispatcher) register(connUUID uuid.UUID) (*sharedResultsConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.group == nil {
+		g, err := d.start()
+		if err != nil {
+			return nil, err
+		}
+		d.group = g
+	}
+
+	c := &sharedResultsConn{
+		d:        d,
+		connUUID: connUUID,
+		ch:       make(chan *message.ResPayload),
+		done:     make(chan struct{}),
+	}
+	d.conns[connUUID.String()] = c
+	return c, nil
+}
+
+// unregister removes the results connection c, stopping the dispatcher
+// goroutines if it was the last one.
+func (d *dispatcher) unregister(c *sharedResultsConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	k := c.connUUID.String()
+	if d.conns[k] != c {
+		// already replaced by a newer results connection
+		return
+	}
+	delete(d.conns, k)
+	if len(d.conns) == 0 && d.group != nil {
+		d.group.close()
+		d.group = nil
+	}
+}
+
+// lookup returns the results connection registered for connUUID, or
+// nil.
+func (d *dispatcher) lookup(connUUID uuid.UUID) *sharedResultsConn {
+	d.mu.Lock()
+	c := d.conns[connUUID.String()]
+	d.mu.Unlock()
+	return c
+}
+
+// start dials the redis connections and starts the dispatcher
+// goroutines.
+func (d *dispatcher) start() (*dispatchGroup, error) {
+	g := &dispatchGroup{
+		stop: make(chan struct{}),
+		rcs:  make([]redis.Conn, d.b.Dispatchers),
+	}
+	for i := range g.rcs {
+		rc, err := d.b.Dial()
+		if err != nil {
+			g.close()
+			return nil, err
+		}
+		g.rcs[i] = rc
+	}
+	for i, rc := range g.rcs {
+		go d.run(g, i, rc)
+	}
+	return g, nil
+}
+
+// close stops the dispatcher goroutines of g.
+func (g *dispatchGroup) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.stopped = true
+	close(g.stop)
+	for _, rc := range g.rcs {
+		if rc != nil {
+			rc.Close()
+		}
+	}
+}
+
+// redial replaces the failed connection i of g, unless g is stopped.
+func (g *dispatchGroup) redial(i int, dial func() (redis.Conn, error)) (redis.Conn, error) {
+	rc, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stopped {
+		rc.Close()
+		return nil, errDispatcherStopped
+	}
+	g.rcs[i] = rc
+	return rc, nil
+}
+
+// run is the loop of a dispatcher goroutine, that pops the results
+// from the shared queue with the connection rc until g is stopped. If
+// the connection fails, it is replaced by a new one.
+func (d *dispatcher) run(g *dispatchGroup, i int, rc redis.Conn) {
+	to := int(d.b.BlockingTimeout / time.Second)
+
+	// make connection cluster-aware if running in a cluster
+	pollConn := clusterifyConn(rc, d.key)
+	for {
+		// BRPOP returns array with [0]: key name, [1]: payload.
+		v, err := redis.Values(pollConn.Do("BRPOP", d.key, to))
+		if err == nil {
+			go d.dispatch(v)
+			continue
+		}
+		if err == redis.ErrNil {
+			// no available value
+			continue
+		}
+
+		select {
+		case <-g.stop:
+			return
+		default:
+		}
+		d.vars.Add("FailedResultsDispatches", 1)
+		logf(d.b.LogFunc, "Results: dispatcher BRPOP failed: %v", err)
+
+		for {
+			select {
+			case <-g.stop:
+				return
+			case <-time.After(dispatcherRetryDelay):
+			}
+			rc, err = g.redial(i, d.b.Dial)
+			if err == errDispatcherStopped {
+				return
+			}
+			if err == nil {
+				pollConn = clusterifyConn(rc, d.key)
+				break
+			}
+			logf(d.b.LogFunc, "Results: dispatcher failed to reconnect: %v", err)
+		}
+	}
+}
+
+// dispatch routes the raw value v returned from BRPOP to the results
+// connection of its connection UUID.
+func (d *dispatcher) dispatch(v []interface{}) {
+	var rp message.ResPayload
+	err := unmarshalBRPOPValue(&rp, v)
+	if err == nil {
+		err = unpackArgs(d.b.blobStore(), &rp.Args, &rp.Compression, &rp.BlobRef)
+	}
+	if err != nil {
+		d.vars.Add("FailedResPayloadUnmarshals", 1)
+		logf(d.b.LogFunc, "Results: BRPOP failed to unmarshal result payload: %v", err)
+		return
+	}
+
+	// check if call is expired
+	k := d.b.key(resQueueTimeoutKey, d.queue, rp.MsgUUID)
+
+	rc := d.b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	pttl, err := redis.Int(delAndPTTLScript.Do(rc, k))
+	if err != nil {
+		metrics.AddExemplar(d.vars, "FailedPTTLResults", 1, rp.CorrelationID)
+		logf(d.b.LogFunc, "Results: DEL/PTTL failed: %v [%s]", err, rp.CorrelationID)
+		return
+	}
+	if pttl <= 0 {
+		metrics.AddExemplar(d.vars, "ExpiredResults", 1, rp.CorrelationID)
+		logf(d.b.LogFunc, "Results: message %v expired, dropping call [%s]", rp.MsgUUID, rp.CorrelationID)
+		return
+	}
+
+	c := d.lookup(rp.ConnUUID)
+	if c == nil || !c.send(&rp) {
+		metrics.AddExemplar(d.vars, "UnroutedResults", 1, rp.CorrelationID)
+		logf(d.b.LogFunc, "Results: no results connection for %v, dropping call [%s]", rp.ConnUUID, rp.CorrelationID)
+		return
+	}
+	metrics.AddExemplar(d.vars, "Results", 1, rp.CorrelationID)
+}
+
+// sharedResultsConn is a results connection that receives its results
+// from the dispatcher of the broker.
+type sharedResultsConn struct {
+	d        *dispatcher
+	connUUID uuid.UUID
+	ch       chan *message.ResPayload
+	done     chan struct{}
+
+	// mu protects closed, and makes sure no send is started once it
+	// is closed.
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Close unregisters the connection from the dispatcher and closes its
+// results channel.
+func (c *sharedResultsConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	c.mu.Unlock()
+
+	c.d.unregister(c)
+	c.wg.Wait()
+	close(c.ch)
+	return nil
+}
+
+// ResultsErr always returns nil, as the dispatcher reconnects to
+// redis on failure.
+func (c *sharedResultsConn) ResultsErr() error {
+	return nil
+}
+
+// Results returns the stream of call results for the connection UUID.
+func (c *sharedResultsConn) Results() <-chan *message.ResPayload {
+	return c.ch
+}
+
+// send sends rp on the results channel, and returns true if it was
+// received. It returns false if the connection is closed.
+func (c *sharedResultsConn) send(rp *message.ResPayload) bool {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return false
+	}
+	c.wg.Add(1)
+	c.mu.Unlock()
+	defer c.wg.Done()
+
+	select {
+	case c.ch <- rp:
+		return true
+	case <-c.done:
+		return false
+	}
+}
@@ -0,0 +1,148 @@
+package redisbroker
+
+import (
+	"expvar"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/callee"
+	"github.com/mna/juggler/jugglertest"
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatcher(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	snap := jugglertest.SnapshotGoroutines()
+	pool := redistest.NewPool(t, ":"+port)
+	vars := new(expvar.Map).Init()
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		Dispatchers:     2,
+		ResultsQueue:    "srv1",
+		LogFunc:         logIfVerbose,
+		Vars:            vars,
+	}
+	// the callee broker needs no configuration
+	cle := &Broker{Pool: pool, Dial: pool.Dial, BlockingTimeout: time.Second, LogFunc: logIfVerbose}
+
+	// register results connections for 3 connections
+	conns := make([]uuid.UUID, 3)
+	got := make([][]uuid.UUID, 3)
+	var rcs []broker.ResultsConn
+	var wg sync.WaitGroup
+	for i := range conns {
+		conns[i] = uuid.NewRandom()
+		rc, err := brk.NewResultsConn(conns[i])
+		require.NoError(t, err, "NewResultsConn %d", i)
+		rcs = append(rcs, rc)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for rp := range rc.Results() {
+				got[i] = append(got[i], rp.MsgUUID)
+				if len(got[i]) == 2 {
+					return
+				}
+			}
+		}(i)
+	}
+
+	// make 2 calls per connection, and store their results via the callee
+	want := make([][]uuid.UUID, 3)
+	for i, connUUID := range conns {
+		for j := 0; j < 2; j++ {
+			cp := &message.CallPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a"}
+			want[i] = append(want[i], cp.MsgUUID)
+			require.NoError(t, brk.Call(cp, time.Second), "Call %d-%d", i, j)
+		}
+	}
+	cc, err := cle.NewCallsConn("a")
+	require.NoError(t, err, "NewCallsConn")
+	for i := 0; i < 6; i++ {
+		cp := <-cc.Calls()
+		assert.Equal(t, "srv1", cp.ResultsQueue, "results queue")
+		rp, err := callee.ResultPayload(cp, "ok", nil)
+		require.NoError(t, err, "ResultPayload")
+		require.NoError(t, cle.Result(rp, time.Second), "Result")
+	}
+	require.NoError(t, cc.Close(), "close calls connection")
+	wg.Wait()
+
+	for i := range want {
+		assert.ElementsMatch(t, want[i], got[i], "results of %d", i)
+	}
+	assert.Equal(t, "6", vars.Get("Results").String(), "Results")
+
+	// a result for an unknown connection is dropped
+	rp := &message.ResPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), ResultsQueue: "srv1"}
+	require.NoError(t, cle.Result(rp, time.Second), "Result")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "1", vars.Get("UnroutedResults").String(), "UnroutedResults")
+
+	// a new results connection for the same UUID replaces the old one
+	rc, err := brk.NewResultsConn(conns[0])
+	require.NoError(t, err, "NewResultsConn")
+	rp = &message.ResPayload{ConnUUID: conns[0], MsgUUID: uuid.NewRandom(), ResultsQueue: "srv1"}
+	require.NoError(t, cle.Result(rp, time.Second), "Result")
+	select {
+	case res := <-rc.Results():
+		assert.Equal(t, rp.MsgUUID, res.MsgUUID, "result on new connection")
+	case <-time.After(time.Second):
+		assert.Fail(t, "no result on new connection")
+	}
+	require.NoError(t, rc.Close(), "close results connection")
+	_, ok := <-rc.Results()
+	assert.False(t, ok, "results channel closed")
+	assert.NoError(t, rc.ResultsErr(), "ResultsErr")
+
+	for _, rc := range rcs {
+		require.NoError(t, rc.Close(), "close results connection")
+	}
+	assertNoLeak(t, snap, pool, port)
+}
+
+func TestSharedResultsConn(t *testing.T) {
+	// no dispatcher goroutine is started, the results are sent directly
+	brk := &Broker{}
+	d := brk.dispatcher()
+
+	connUUID := uuid.NewRandom()
+	c1, err := d.register(connUUID)
+	require.NoError(t, err, "register")
+	assert.Equal(t, c1, d.lookup(connUUID), "lookup")
+
+	rp := &message.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom()}
+	go func() { assert.True(t, c1.send(rp), "send") }()
+	assert.Equal(t, rp, <-c1.Results(), "received")
+
+	// replace the connection, the old one can still be closed
+	c2, err := d.register(connUUID)
+	require.NoError(t, err, "register")
+	assert.Equal(t, c2, d.lookup(connUUID), "lookup")
+	require.NoError(t, c1.Close(), "Close")
+	assert.Equal(t, c2, d.lookup(connUUID), "lookup after close of replaced")
+	assert.False(t, c1.send(rp), "send on closed")
+
+	// closing unblocks a pending send
+	done := make(chan bool)
+	go func() { done <- c2.send(rp) }()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, c2.Close(), "Close")
+	assert.False(t, <-done, "pending send")
+	assert.Nil(t, d.lookup(connUUID), "lookup after close")
+	assert.Nil(t, d.group, "dispatcher stopped")
+	_, ok := <-c2.Results()
+	assert.False(t, ok, "results channel closed")
+	assert.NoError(t, c2.Close(), "Close twice")
+}
@@ -0,0 +1,135 @@
+package redisbroker
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// DefaultDurableRetention is the default retention window of the
+	// events of durable channels.
+	DefaultDurableRetention = time.Hour
+
+	// MaxReplayEvents is the maximum number of events returned by a
+	// call to Broker.Replay.
+	MaxReplayEvents = 1000
+)
+
+// redis cluster-compliant key, hashed on the channel
+const eventStreamKey = "juggler:events:stream:{%s}" // 1: channel
+
+var _ broker.ReplayBroker = (*Broker)(nil)
+
+// valid stream entry ID, as generated by XADD.
+var rxEventID = regexp.MustCompile(`^\d+-\d+$`)
+
+// script to append the event to the stream of a durable channel,
+// trimming the events older than the retention window, and to publish
+// it with the ID of its stream entry. The ID is added as the first
+// field of the JSON-encoded payload, which is always an object with
+// at least the msg_uuid field.
+var publishDurableScript = redis.NewScript(1, `
+	local id = redis.call("XADD", KEYS[1], "MINID", "~", ARGV[2], "*", "p", ARGV[1])
+	redis.call("PEXPIRE", KEYS[1], tonumber(ARGV[3]))
+	local pld = '{"event_id":"' .. id .. '",' .. string.sub(ARGV[1], 2)
+	return redis.call("PUBLISH", ARGV[4], pld)
+`)
+
+// isDurable returns true if channel matches one of the DurableChannels
+// patterns.
+func (b *Broker) isDurable(channel string) bool {
+	for _, pat := range b.DurableChannels {
+		if ok, err := path.Match(pat, channel); ok && err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// durableRetention returns the retention window of the events of
+// durable channels.
+func (b *Broker) durableRetention() time.Duration {
+	if b.DurableRetention > 0 {
+		return b.DurableRetention
+	}
+	return DefaultDurableRetention
+}
+
+// publishDurable appends the JSON-encoded payload p to the stream of
+// the durable channel and publishes it. It returns the number of
+// subscribers the event was delivered to.
+func (b *Broker) publishDurable(channel string, p []byte) (int, error) {
+	key := b.key(eventStreamKey, channel)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, key)
+
+	ret := b.durableRetention()
+	minID := time.Now().Add(-ret).UnixNano() / int64(time.Millisecond)
+	n, err := redis.Int(publishDurableScript.Do(rc,
+		key,                       // key[1] : the stream key
+		p,                         // argv[1] : the payload
+		minID,                     // argv[2] : the minimum ID to keep
+		int(ret/time.Millisecond), // argv[3] : the retention window in milliseconds
+		b.channel(channel),        // argv[4] : the channel
+	))
+	if err == nil {
+		b.metrics().Add("DurableEvents", 1)
+	}
+	return n, err
+}
+
+// Replay returns the events published on the durable channel after the
+// event identified by lastID, oldest first, up to MaxReplayEvents. If
+// lastID is empty, all retained events are returned. It returns nil if
+// channel does not match DurableChannels.
+func (b *Broker) Replay(channel, lastID string) ([]*message.EvntPayload, error) {
+	if !b.isDurable(channel) {
+		return nil, nil
+	}
+
+	start := "-"
+	if lastID != "" {
+		if !rxEventID.MatchString(lastID) {
+			return nil, fmt.Errorf("juggler/redisbroker: invalid event ID %q", lastID)
+		}
+		start = "(" + lastID
+	}
+	key := b.key(eventStreamKey, channel)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, key)
+
+	vals, err := redis.Values(rc.Do("XRANGE", key, start, "+", "COUNT", MaxReplayEvents))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseEntries(nil, key, vals)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := b.metrics()
+	blobs := b.blobStore()
+	eps := make([]*message.EvntPayload, 0, len(entries))
+	for _, e := range entries {
+		ep, err := newEvntPayload(blobs, channel, "", e.payload)
+		if err != nil {
+			vars.Add("FailedEvntPayloadUnmarshals", 1)
+			logf(b.LogFunc, "Replay: failed to unmarshal event payload: %v", err)
+			continue
+		}
+		ep.EventID = e.id
+		eps = append(eps, ep)
+	}
+	vars.Add("ReplayedEvents", int64(len(eps)))
+	return eps, nil
+}
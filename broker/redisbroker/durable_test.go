@@ -0,0 +1,86 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurableChannels(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	defer pool.Close()
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		LogFunc:         logIfVerbose,
+		DurableChannels: []string{"d.*"},
+	}
+
+	psc, err := brk.NewPubSubConn()
+	require.NoError(t, err, "get PubSub connection")
+	defer psc.Close()
+	require.NoError(t, psc.Subscribe("d.a", false), "Subscribe")
+
+	// wait for the subscription to be active
+	deadline := time.Now().Add(time.Second)
+	for {
+		n, err := brk.NumSub("d.a")
+		require.NoError(t, err, "NumSub")
+		if n["d.a"] > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pps := make([]*message.PubPayload, 3)
+	for i := range pps {
+		pps[i] = &message.PubPayload{MsgUUID: uuid.NewRandom(), Args: json.RawMessage(`{"i":` + string(rune('0'+i)) + `}`)}
+		n, err := brk.Publish("d.a", pps[i])
+		require.NoError(t, err, "Publish %d", i)
+		assert.Equal(t, 1, n, "delivered %d", i)
+	}
+
+	// the events are published with their ID
+	var ids []string
+	for i := range pps {
+		select {
+		case ep := <-psc.Events():
+			assert.Equal(t, pps[i].MsgUUID, ep.MsgUUID, "event %d", i)
+			assert.NotEmpty(t, ep.EventID, "event ID %d", i)
+			ids = append(ids, ep.EventID)
+		case <-time.After(time.Second):
+			require.FailNow(t, "no event received")
+		}
+	}
+
+	eps, err := brk.Replay("d.a", ids[0])
+	require.NoError(t, err, "Replay")
+	if assert.Len(t, eps, 2, "replayed events") {
+		for i, ep := range eps {
+			assert.Equal(t, pps[i+1].MsgUUID, ep.MsgUUID, "replayed event %d", i)
+			assert.Equal(t, ids[i+1], ep.EventID, "replayed event ID %d", i)
+			assert.Equal(t, string(pps[i+1].Args), string(ep.Args), "replayed args %d", i)
+			assert.Equal(t, "d.a", ep.Channel, "replayed channel %d", i)
+		}
+	}
+
+	eps, err = brk.Replay("d.a", "")
+	require.NoError(t, err, "Replay all")
+	assert.Len(t, eps, 3, "all retained events")
+
+	eps, err = brk.Replay("x", ids[0])
+	require.NoError(t, err, "Replay non-durable")
+	assert.Nil(t, eps, "non-durable channel")
+
+	_, err = brk.Replay("d.a", "nope")
+	assert.Error(t, err, "invalid ID")
+}
@@ -0,0 +1,98 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/broker"
+)
+
+// redis cluster-compliant keys, the live callees are stored in a hash
+// of their JSON-encoded CalleeInfo by ID, and their expiration time
+// (in milliseconds) in a sorted set. Both keys are in the same hash
+// slot so that they can be updated atomically.
+const (
+	calleesKey        = "juggler:callees:{health}"
+	calleesExpiresKey = "juggler:callees:{health}:expires"
+)
+
+// script to add or refresh the entry of a callee.
+var registerCalleeScript = redis.NewScript(2, `
+	redis.call("ZADD", KEYS[2], tonumber(ARGV[1]) + tonumber(ARGV[2]), ARGV[3])
+	redis.call("HSET", KEYS[1], ARGV[3], ARGV[4])
+	return 1
+`)
+
+// script to remove the entry of a callee.
+var unregisterCalleeScript = redis.NewScript(2, `
+	redis.call("HDEL", KEYS[1], ARGV[1])
+	redis.call("ZREM", KEYS[2], ARGV[1])
+	return 1
+`)
+
+// script to remove the expired callees and return the remaining ones.
+var calleesScript = redis.NewScript(2, `
+	local expired = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", ARGV[1])
+	if #expired > 0 then
+		redis.call("HDEL", KEYS[1], unpack(expired))
+		redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[1])
+	end
+	return redis.call("HVALS", KEYS[1])
+`)
+
+// RegisterCallee adds or refreshes the entry of the callee instance
+// described by info. The expiration is based on the callee's clock,
+// so the clocks of the callees and servers that share the registry
+// should be synchronized.
+func (b *Broker) RegisterCallee(info *broker.CalleeInfo, ttl time.Duration) error {
+	ci := *info
+	ci.LastSeen = time.Now()
+	p, err := json.Marshal(ci)
+	if err != nil {
+		return err
+	}
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	_, err = registerCalleeScript.Do(rc,
+		b.key(calleesKey),           // KEYS[1]
+		b.key(calleesExpiresKey),    // KEYS[2]
+		nowMillis(),                 // ARGV[1] : the current time in milliseconds
+		int64(ttl/time.Millisecond), // ARGV[2] : the TTL in milliseconds
+		ci.ID,                       // ARGV[3] : the callee ID
+		p,                           // ARGV[4] : the callee info
+	)
+	return err
+}
+
+// UnregisterCallee removes the entry of the callee instance identified
+// by id.
+func (b *Broker) UnregisterCallee(id string) error {
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	_, err := unregisterCalleeScript.Do(rc, b.key(calleesKey), b.key(calleesExpiresKey), id)
+	return err
+}
+
+// Callees returns the live callee instances, in no particular order.
+// Expired entries are removed from the registry.
+func (b *Broker) Callees() ([]*broker.CalleeInfo, error) {
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	vals, err := redis.Strings(calleesScript.Do(rc, b.key(calleesKey), b.key(calleesExpiresKey), nowMillis()))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*broker.CalleeInfo, 0, len(vals))
+	for _, v := range vals {
+		var ci broker.CalleeInfo
+		if err := json.Unmarshal([]byte(v), &ci); err == nil {
+			infos = append(infos, &ci)
+		}
+	}
+	return infos, nil
+}
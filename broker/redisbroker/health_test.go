@@ -0,0 +1,48 @@
+package redisbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/redisc/redistest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallees(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	c1 := &broker.CalleeInfo{ID: "c1", URIs: []string{"a", "b.*"}, Workers: 4}
+	c2 := &broker.CalleeInfo{ID: "c2", URIs: []string{"a"}, Workers: 1}
+	require.NoError(t, brk.RegisterCallee(c1, time.Second), "RegisterCallee c1")
+	require.NoError(t, brk.RegisterCallee(c2, 10*time.Millisecond), "RegisterCallee c2")
+
+	infos, err := brk.Callees()
+	require.NoError(t, err, "Callees")
+	assert.Equal(t, 2, len(infos), "2 live callees")
+
+	// c2 expires
+	time.Sleep(20 * time.Millisecond)
+	infos, err = brk.Callees()
+	require.NoError(t, err, "Callees after expiration")
+	if assert.Equal(t, 1, len(infos), "c2 expired") {
+		assert.Equal(t, "c1", infos[0].ID, "ID")
+		assert.Equal(t, c1.URIs, infos[0].URIs, "URIs")
+		assert.Equal(t, 4, infos[0].Workers, "Workers")
+		assert.False(t, infos[0].LastSeen.IsZero(), "LastSeen")
+	}
+
+	require.NoError(t, brk.UnregisterCallee("c1"), "UnregisterCallee c1")
+	infos, err = brk.Callees()
+	require.NoError(t, err, "Callees after unregister")
+	assert.Empty(t, infos, "no live callee")
+}
@@ -0,0 +1,214 @@
+package redisbroker
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mna/redisc"
+	"github.com/garyburd/redigo/redis"
+)
+
+// DefaultMaxPipeline is the default maximum number of call requests
+// and results registered in a single pipeline when FlushInterval is
+// set.
+var DefaultMaxPipeline = 100
+
+// scripts is the list of all scripts used by the broker, loaded by
+// LoadScripts.
+var scripts = []*redis.Script{
+	callOrResScript,
+	delAndPTTLScript,
+	publishDurableScript,
+	setPresenceScript,
+	presenceScript,
+	popCallScript,
+	ackCallScript,
+	requeueCallsScript,
+	routeScript,
+	addCallOrResScript,
+	ackStreamCallScript,
+	registerCalleeScript,
+	unregisterCalleeScript,
+	calleesScript,
+}
+
+// LoadScripts loads the Lua scripts used by the broker in the script
+// cache of redis with SCRIPT LOAD, so that they are always executed
+// with EVALSHA without having to send their body first. It should be
+// called once the redis servers are started, e.g. when the broker is
+// initialized. In a redis cluster, it loads the scripts on each of
+// the NodePools, or on the node returned by Pool if there is none.
+//
+// Loading the scripts is an optimization, the scripts that are not
+// loaded are sent on their first use.
+func (b *Broker) LoadScripts() error {
+	for _, p := range b.infoPools() {
+		if err := loadScripts(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadScripts(pool Pool) error {
+	rc := pool.Get()
+	defer rc.Close()
+
+	for _, s := range scripts {
+		if err := s.Load(rc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pipelineReq is a call request or result waiting to be registered in
+// a pipeline.
+type pipelineReq struct {
+	key  string        // the key used to select the cluster node
+	args []interface{} // the arguments of callOrResScript
+	done chan error
+}
+
+// pipeline batches the registrations of call requests and results,
+// and sends them on a single connection per cluster slot every flush
+// interval, or as soon as max requests are pending.
+type pipeline struct {
+	pool     Pool
+	interval time.Duration
+	max      int
+	vars     func(string, int64)
+
+	mu      sync.Mutex
+	pending []*pipelineReq
+	timer   *time.Timer
+}
+
+// pipeline returns the pipeline of the broker, creating it on first
+// use.
+func (b *Broker) pipeline() *pipeline {
+	b.pipeOnce.Do(func() {
+		max := b.MaxPipeline
+		if max <= 0 {
+			max = DefaultMaxPipeline
+		}
+		b.pipe = &pipeline{
+			pool:     b.Pool,
+			interval: b.FlushInterval,
+			max:      max,
+			vars:     func(k string, n int64) { b.metrics().Add(k, n) },
+		}
+	})
+	return b.pipe
+}
+
+// do adds the registration to the pipeline and waits for it to be
+// flushed. It returns the error of the registration.
+func (p *pipeline) do(key string, args []interface{}) error {
+	req := &pipelineReq{key: key, args: args, done: make(chan error, 1)}
+
+	p.mu.Lock()
+	p.pending = append(p.pending, req)
+	var batch []*pipelineReq
+	switch {
+	case len(p.pending) >= p.max:
+		if p.timer != nil {
+			p.timer.Stop()
+			p.timer = nil
+		}
+		batch, p.pending = p.pending, nil
+	case p.timer == nil:
+		p.timer = time.AfterFunc(p.interval, p.flushPending)
+	}
+	p.mu.Unlock()
+
+	if batch != nil {
+		p.flush(batch)
+	}
+	return <-req.done
+}
+
+// flushPending flushes the pending registrations once the flush
+// interval has elapsed.
+func (p *pipeline) flushPending() {
+	p.mu.Lock()
+	batch := p.pending
+	p.pending, p.timer = nil, nil
+	p.mu.Unlock()
+
+	if len(batch) > 0 {
+		p.flush(batch)
+	}
+}
+
+// flush sends the batch of registrations, pipelined on a single
+// connection per cluster slot.
+func (p *pipeline) flush(batch []*pipelineReq) {
+	p.vars("PipelineFlushes", 1)
+	p.vars("PipelinedRegistrations", int64(len(batch)))
+
+	var order []int
+	bySlot := make(map[int][]*pipelineReq)
+	for _, req := range batch {
+		slot := redisc.Slot(req.key)
+		if _, ok := bySlot[slot]; !ok {
+			order = append(order, slot)
+		}
+		bySlot[slot] = append(bySlot[slot], req)
+	}
+
+	var wg sync.WaitGroup
+	for _, slot := range order {
+		wg.Add(1)
+		go func(reqs []*pipelineReq) {
+			defer wg.Done()
+			p.send(reqs)
+		}(bySlot[slot])
+	}
+	wg.Wait()
+}
+
+// send sends the registrations reqs, that are all in the same cluster
+// slot, on a single connection.
+func (p *pipeline) send(reqs []*pipelineReq) {
+	rc := p.pool.Get()
+	defer rc.Close()
+	if bc, ok := rc.(binder); ok {
+		bc.Bind(reqs[0].key)
+	}
+
+	for _, req := range reqs {
+		if err := callOrResScript.SendHash(rc, req.args...); err != nil {
+			failAll(reqs, err)
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		failAll(reqs, err)
+		return
+	}
+
+	var noScript []*pipelineReq
+	for _, req := range reqs {
+		_, err := rc.Receive()
+		if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "NOSCRIPT ") {
+			noScript = append(noScript, req)
+			continue
+		}
+		req.done <- err
+	}
+
+	// the script was not loaded, send it with its body once all the
+	// pipelined replies are received.
+	for _, req := range noScript {
+		_, err := callOrResScript.Do(rc, req.args...)
+		req.done <- err
+	}
+}
+
+func failAll(reqs []*pipelineReq, err error) {
+	for _, req := range reqs {
+		req.done <- err
+	}
+}
@@ -0,0 +1,74 @@
+package redisbroker
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc/redistest"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	vars := new(expvar.Map).Init()
+	brk := &Broker{
+		Pool:          pool,
+		LogFunc:       logIfVerbose,
+		CallCap:       4,
+		FlushInterval: 10 * time.Millisecond,
+		MaxPipeline:   3,
+		Vars:          vars,
+	}
+
+	// the scripts are not loaded yet, they are sent on first use
+	call := func(uri string) error {
+		cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: uri}
+		return brk.Call(cp, time.Second)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 5; i++ {
+		uri := "a"
+		if i%2 == 1 {
+			uri = "b"
+		}
+		wg.Add(1)
+		go func(uri string) {
+			defer wg.Done()
+			errs <- call(uri)
+		}(uri)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err, "Call")
+	}
+
+	rc := pool.Get()
+	defer rc.Close()
+	n, err := redis.Int(rc.Do("LLEN", fmt.Sprintf(callKey, "a")))
+	require.NoError(t, err, "LLEN a")
+	assert.Equal(t, 3, n, "calls a")
+	n, err = redis.Int(rc.Do("LLEN", fmt.Sprintf(callKey, "b")))
+	require.NoError(t, err, "LLEN b")
+	assert.Equal(t, 2, n, "calls b")
+	assert.Equal(t, "5", vars.Get("PipelinedRegistrations").String(), "PipelinedRegistrations")
+	assert.True(t, vars.Get("PipelineFlushes").(*expvar.Int).Value() >= 2, "PipelineFlushes")
+
+	// the errors are returned to each caller
+	require.NoError(t, brk.LoadScripts(), "LoadScripts")
+	require.NoError(t, call("a"), "Call a")
+	if err := call("a"); assert.Error(t, err, "Call a over capacity") {
+		assert.Contains(t, err.Error(), "list capacity exceeded", "error message")
+	}
+}
@@ -0,0 +1,81 @@
+package redisbroker
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+// redis cluster-compliant key, the presence set of a channel is stored
+// in a sorted set with the expiration time (in milliseconds) as score.
+const presenceKey = "juggler:presence:{%s}" // 1: channel
+
+// script to add or refresh an entry in a presence set. The key itself
+// expires after the TTL so that the sets of inactive channels are
+// eventually removed.
+var setPresenceScript = redis.NewScript(1, `
+	redis.call("ZADD", KEYS[1], tonumber(ARGV[1]) + tonumber(ARGV[2]), ARGV[3])
+	local ttl = redis.call("PTTL", KEYS[1])
+	if ttl < tonumber(ARGV[2]) then
+		redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	end
+	return 1
+`)
+
+// script to remove the expired entries of a presence set and return
+// the remaining ones.
+var presenceScript = redis.NewScript(1, `
+	redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+	return redis.call("ZRANGE", KEYS[1], 0, -1)
+`)
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// SetPresence adds or refreshes the connection identified by connUUID
+// in the presence set of channel, stored in a redis sorted set. The
+// expiration is based on the server's clock, so the clocks of the
+// servers that share the presence sets should be synchronized.
+func (b *Broker) SetPresence(channel string, connUUID uuid.UUID, ttl time.Duration) error {
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	_, err := setPresenceScript.Do(rc,
+		b.key(presenceKey, channel), // KEYS[1]
+		nowMillis(),                 // ARGV[1] : the current time in milliseconds
+		int64(ttl/time.Millisecond), // ARGV[2] : the TTL in milliseconds
+		connUUID.String(),           // ARGV[3] : the connection UUID
+	)
+	return err
+}
+
+// RemovePresence removes the connection identified by connUUID from
+// the presence set of channel.
+func (b *Broker) RemovePresence(channel string, connUUID uuid.UUID) error {
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	_, err := rc.Do("ZREM", b.key(presenceKey, channel), connUUID.String())
+	return err
+}
+
+// Presence returns the UUIDs of the connections present on channel,
+// in no particular order. Expired entries are removed from the set.
+func (b *Broker) Presence(channel string) ([]uuid.UUID, error) {
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	vals, err := redis.Strings(presenceScript.Do(rc, b.key(presenceKey, channel), nowMillis()))
+	if err != nil {
+		return nil, err
+	}
+	uuids := make([]uuid.UUID, 0, len(vals))
+	for _, v := range vals {
+		if u := uuid.Parse(v); u != nil {
+			uuids = append(uuids, u)
+		}
+	}
+	return uuids, nil
+}
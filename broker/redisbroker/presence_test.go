@@ -0,0 +1,42 @@
+package redisbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresence(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	c1, c2 := uuid.NewRandom(), uuid.NewRandom()
+	require.NoError(t, brk.SetPresence("a", c1, time.Second), "SetPresence c1")
+	require.NoError(t, brk.SetPresence("a", c2, 10*time.Millisecond), "SetPresence c2")
+
+	uuids, err := brk.Presence("a")
+	require.NoError(t, err, "Presence")
+	assert.Equal(t, 2, len(uuids), "2 present")
+
+	// c2 expires
+	time.Sleep(20 * time.Millisecond)
+	uuids, err = brk.Presence("a")
+	require.NoError(t, err, "Presence after expiration")
+	assert.Equal(t, []uuid.UUID{c1}, uuids, "c2 expired")
+
+	require.NoError(t, brk.RemovePresence("a", c1), "RemovePresence c1")
+	uuids, err = brk.Presence("a")
+	require.NoError(t, err, "Presence after remove")
+	assert.Empty(t, uuids, "none present")
+}
@@ -2,11 +2,11 @@ package redisbroker
 
 import (
 	"encoding/json"
-	"expvar"
 	"sync"
 
 	"github.com/mna/juggler/broker"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 	"github.com/garyburd/redigo/redis"
 )
 
@@ -14,12 +14,21 @@ var _ broker.PubSubConn = (*pubSubConn)(nil)
 
 type pubSubConn struct {
 	psc   redis.PubSubConn
+	ns    string
 	logFn func(string, ...interface{})
-	vars  *expvar.Map
+	vars  metrics.Sink
+	blobs broker.BlobStore
 
 	// wmu controls writes (sub/unsub calls) to the connection.
 	wmu sync.Mutex
 
+	// topics is true if the patterns are topic filters, in which case
+	// filters holds the filters subscribed with each redis glob, and is
+	// protected by tmu.
+	topics  bool
+	tmu     sync.Mutex
+	filters map[string]map[string]bool
+
 	// once makes sure only the first call to Events starts the goroutine.
 	once sync.Once
 	evch chan *message.EvntPayload
@@ -35,14 +44,25 @@ func (c *pubSubConn) Close() error {
 }
 
 // Subscribe subscribes the redis connection to the channel, which may
-// be a pattern.
+// be a pattern, or a topic filter if the broker has Topics set.
 func (c *pubSubConn) Subscribe(channel string, pattern bool) error {
+	if c.topics {
+		if err := broker.ValidateTopicSub(channel, pattern); err != nil {
+			return err
+		}
+		if pattern {
+			return c.subTopicFilter(channel)
+		}
+	}
 	return c.subUnsub(channel, pattern, true)
 }
 
 // Unsubscribe unsubscribes the redis connection from the channel, which
 // may be a pattern.
 func (c *pubSubConn) Unsubscribe(channel string, pattern bool) error {
+	if c.topics && pattern {
+		return c.unsubTopicFilter(channel)
+	}
 	return c.subUnsub(channel, pattern, false)
 }
 
@@ -59,6 +79,13 @@ func (c *pubSubConn) subUnsub(ch string, pat bool, sub bool) error {
 		fn = c.psc.Unsubscribe
 	}
 
+	// the channels and patterns are in the namespace of the broker
+	if pat {
+		ch = nsPattern(c.ns, ch)
+	} else {
+		ch = nsName(c.ns, ch)
+	}
+
 	c.wmu.Lock()
 	err := fn(ch)
 	c.wmu.Unlock()
@@ -84,11 +111,21 @@ func (c *pubSubConn) listen() {
 		switch v := c.psc.Receive().(type) {
 		case redis.Message:
 			wg.Add(1)
-			go c.sendEvent(v.Channel, "", v.Data, &wg)
+			go c.sendEvent(trimNS(c.ns, v.Channel), "", v.Data, &wg)
 
 		case redis.PMessage:
-			wg.Add(1)
-			go c.sendEvent(v.Channel, v.Pattern, v.Data, &wg)
+			v.Channel, v.Pattern = trimNS(c.ns, v.Channel), trimPatternNS(c.ns, v.Pattern)
+			if !c.topics {
+				wg.Add(1)
+				go c.sendEvent(v.Channel, v.Pattern, v.Data, &wg)
+				break
+			}
+			// send the event for each topic filter of the glob that
+			// matches the channel
+			for _, f := range c.filtersFor(v.Pattern, v.Channel) {
+				wg.Add(1)
+				go c.sendEvent(v.Channel, f, v.Data, &wg)
+			}
 
 		case error:
 			// possibly because the pub-sub connection was closed, but
@@ -106,30 +143,34 @@ func (c *pubSubConn) listen() {
 func (c *pubSubConn) sendEvent(channel, pattern string, pld []byte, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	ep, err := newEvntPayload(channel, pattern, pld)
+	ep, err := newEvntPayload(c.blobs, channel, pattern, pld)
 	if err != nil {
-		if c.vars != nil {
-			c.vars.Add("FailedEvntPayloadUnmarshals", 1)
-		}
+		c.vars.Add("FailedEvntPayloadUnmarshals", 1)
 		logf(c.logFn, "Events: failed to unmarshal event payload: %v", err)
 		return
 	}
 	c.evch <- ep
-	if c.vars != nil {
-		c.vars.Add("Events", 1)
-	}
+	metrics.AddExemplar(c.vars, "Events", 1, ep.CorrelationID)
 }
 
-func newEvntPayload(channel, pattern string, pld []byte) (*message.EvntPayload, error) {
+func newEvntPayload(blobs broker.BlobStore, channel, pattern string, pld []byte) (*message.EvntPayload, error) {
 	var pp message.PubPayload
 	if err := json.Unmarshal(pld, &pp); err != nil {
 		return nil, err
 	}
+	if err := unpackArgs(blobs, &pp.Args, &pp.Compression, &pp.BlobRef); err != nil {
+		return nil, err
+	}
 	ep := &message.EvntPayload{
-		MsgUUID: pp.MsgUUID,
-		Channel: channel,
-		Pattern: pattern,
-		Args:    pp.Args,
+		MsgUUID:       pp.MsgUUID,
+		Channel:       channel,
+		Pattern:       pattern,
+		EventID:       pp.EventID,
+		Args:          pp.Args,
+		CorrelationID: pp.CorrelationID,
+		Priority:      pp.Priority,
+		Binary:        pp.Binary,
+		OffloadRef:    pp.OffloadRef,
 	}
 	return ep, nil
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mna/juggler/jugglertest"
 	"github.com/mna/juggler/message"
 	"github.com/mna/redisc/redistest"
 	"github.com/pborman/uuid"
@@ -16,6 +17,7 @@ func TestPubSub(t *testing.T) {
 	cmd, port := redistest.StartServer(t, nil, "")
 	defer cmd.Process.Kill()
 
+	snap := jugglertest.SnapshotGoroutines()
 	pool := redistest.NewPool(t, ":"+port)
 	brk := &Broker{
 		Pool:    pool,
@@ -60,7 +62,8 @@ func TestPubSub(t *testing.T) {
 		if c.exp {
 			expected = append(expected, c.pp.MsgUUID)
 		}
-		require.NoError(t, brk.Publish(c.ch, c.pp), "Publish %d", i)
+		_, err := brk.Publish(c.ch, c.pp)
+		require.NoError(t, err, "Publish %d", i)
 		if c.unsb != "" {
 			require.NoError(t, psc.Unsubscribe(c.unsb, false), "Unsubscribe %d", i)
 		}
@@ -73,4 +76,6 @@ func TestPubSub(t *testing.T) {
 		assert.Contains(t, psc.EventsErr().Error(), "use of closed", "EventsErr is the expected error")
 	}
 	assert.Equal(t, expected, uuids, "got expected UUIDs")
+
+	assertNoLeak(t, snap, pool, port)
 }
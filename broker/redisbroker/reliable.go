@@ -0,0 +1,227 @@
+package redisbroker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/garyburd/redigo/redis"
+)
+
+// DefaultPollInterval is the default interval at which the call
+// requests are polled when VisibilityTimeout is set.
+var DefaultPollInterval = 100 * time.Millisecond
+
+const (
+	// redis cluster-compliant keys, in the same slot as the calls LIST
+	callProcessingKey = "juggler:calls:processing:{%s}" // 1: URI
+	callInflightKey   = "juggler:calls:inflight:{%s}"   // 1: URI
+)
+
+// script to pop a call request from the first non-empty LIST and
+// to record it as being processed, along with its visibility deadline.
+// The keys are, for each URI, the high-priority calls LIST, the calls
+// LIST, the processing ZSET and the inflight HASH. The high-priority
+// LISTs of all URIs are checked before the calls LISTs, starting at
+// the offset ARGV[2] so that all URIs are eventually processed. It
+// returns the LIST key and the payload, like BRPOP.
+var popCallScript = redis.NewScript(-1, `
+	local n = #KEYS / 4
+	for list = 0, 1 do
+		for i = 0, n - 1 do
+			local j = ((i + tonumber(ARGV[2])) % n) * 4 + 1
+			local p = redis.call("RPOP", KEYS[j+list])
+			if p then
+				local id = cjson.decode(p)["msg_uuid"]
+				redis.call("ZADD", KEYS[j+2], ARGV[1], id)
+				redis.call("HSET", KEYS[j+3], id, p)
+				return {KEYS[j+list], p}
+			end
+		end
+	end
+	return false
+`)
+
+// script to acknowledge a processed call request, deleting its timeout
+// key and its processing entries.
+var ackCallScript = redis.NewScript(3, `
+	redis.call("DEL", KEYS[1])
+	redis.call("ZREM", KEYS[2], ARGV[1])
+	redis.call("HDEL", KEYS[3], ARGV[1])
+`)
+
+// script to requeue the call requests whose visibility deadline
+// expired. They are pushed at the consuming end of the calls LIST, or
+// of the high-priority calls LIST if they have a priority > 0, so that
+// they are processed first. It returns the number of requeued calls.
+var requeueCallsScript = redis.NewScript(4, `
+	local ids = redis.call("ZRANGEBYSCORE", KEYS[3], "-inf", ARGV[1])
+	local n = 0
+	for _, id in ipairs(ids) do
+		local p = redis.call("HGET", KEYS[4], id)
+		if p then
+			local k = KEYS[2]
+			if (tonumber(cjson.decode(p)["priority"]) or 0) > 0 then
+				k = KEYS[1]
+			end
+			redis.call("RPUSH", k, p)
+			redis.call("HDEL", KEYS[4], id)
+			n = n + 1
+		end
+		redis.call("ZREM", KEYS[3], id)
+	end
+	return n
+`)
+
+var _ broker.AckCallsConn = (*reliableCallsConn)(nil)
+
+// reliableCallsConn is a calls connection that processes the call
+// requests at least once.
+type reliableCallsConn struct {
+	*callsConn
+	visibility time.Duration
+	poll       time.Duration
+
+	stopOnce sync.Once
+	stop     chan struct{}
+
+	// mu protects queues, the URI of the queue of each call being
+	// processed, by call UUID.
+	mu     sync.Mutex
+	queues map[string]string
+}
+
+// Calls returns a stream of call requests for the URIs specified when
+// creating the connection, and starts the loop that requeues the calls
+// that are not acknowledged within the visibility timeout.
+func (c *reliableCallsConn) Calls() <-chan *message.CallPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *message.CallPayload)
+
+		keys := make([]string, 0, len(c.uris)*4)
+		for _, uri := range c.uris {
+			keys = append(keys,
+				nsKey(c.ns, callPriorityKey, uri),
+				nsKey(c.ns, callKey, uri),
+				nsKey(c.ns, callProcessingKey, uri),
+				nsKey(c.ns, callInflightKey, uri))
+		}
+		rc := clusterifyConn(c.c, keys...)
+
+		go c.pollCalls(rc, keys)
+		go c.requeueCalls()
+	})
+	return c.ch
+}
+
+// Close stops the loops and closes the connection.
+func (c *reliableCallsConn) Close() error {
+	c.stopOnce.Do(func() { close(c.stop) })
+	return c.callsConn.Close()
+}
+
+// Ack acknowledges that the call request cp was processed, so that it
+// is not requeued.
+func (c *reliableCallsConn) Ack(cp *message.CallPayload) error {
+	id := cp.MsgUUID.String()
+	c.mu.Lock()
+	uri, ok := c.queues[id]
+	delete(c.queues, id)
+	c.mu.Unlock()
+	if !ok {
+		uri = cp.URI
+	}
+
+	keys := []string{
+		nsKey(c.ns, callTimeoutKey, uri, cp.MsgUUID),
+		nsKey(c.ns, callProcessingKey, uri),
+		nsKey(c.ns, callInflightKey, uri),
+	}
+	rc := c.pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, keys...)
+
+	_, err := ackCallScript.Do(rc, keys[0], keys[1], keys[2], id)
+	return err
+}
+
+// track records the URI of the queue of the call request cp, so that
+// it can be acknowledged.
+func (c *reliableCallsConn) track(cp *message.CallPayload, uri string) {
+	c.mu.Lock()
+	c.queues[cp.MsgUUID.String()] = uri
+	c.mu.Unlock()
+}
+
+func (c *reliableCallsConn) pollCalls(pollConn redis.Conn, keys []string) {
+	defer close(c.ch)
+
+	wg := sync.WaitGroup{}
+	for offset := 0; ; offset++ {
+		deadline := time.Now().Add(c.visibility).UnixNano() / int64(time.Millisecond)
+		args := redis.Args{len(keys)}.AddFlat(keys).Add(deadline, offset%len(c.uris))
+		v, err := redis.Values(popCallScript.Do(pollConn, args...))
+		if err != nil {
+			if err == redis.ErrNil {
+				// no available value
+				select {
+				case <-c.stop:
+				case <-time.After(c.poll):
+				}
+				continue
+			}
+
+			// possibly a closed connection, in any case stop
+			// the loop.
+			c.errmu.Lock()
+			c.err = err
+			c.errmu.Unlock()
+			wg.Wait()
+			return
+		}
+
+		wg.Add(1)
+		go c.sendCall(v, &wg)
+	}
+}
+
+// requeueCalls is the loop that requeues the calls whose visibility
+// deadline expired, until the connection is closed.
+func (c *reliableCallsConn) requeueCalls() {
+	t := time.NewTicker(c.visibility / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+		}
+
+		for _, uri := range c.uris {
+			n, err := c.requeue(uri)
+			if err != nil {
+				c.vars.Add("FailedCallRequeues", 1)
+				logf(c.logFn, "Calls: failed to requeue calls for %s: %v", uri, err)
+				continue
+			}
+			c.vars.Add("RequeuedCalls", int64(n))
+		}
+	}
+}
+
+func (c *reliableCallsConn) requeue(uri string) (int, error) {
+	keys := []string{
+		nsKey(c.ns, callPriorityKey, uri),
+		nsKey(c.ns, callKey, uri),
+		nsKey(c.ns, callProcessingKey, uri),
+		nsKey(c.ns, callInflightKey, uri),
+	}
+	rc := c.pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, keys...)
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	return redis.Int(requeueCallsScript.Do(rc, keys[0], keys[1], keys[2], keys[3], now))
+}
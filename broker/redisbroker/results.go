@@ -1,13 +1,12 @@
 package redisbroker
 
 import (
-	"expvar"
-	"fmt"
 	"sync"
 	"time"
 
 	"github.com/mna/juggler/broker"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 	"github.com/garyburd/redigo/redis"
 	"github.com/pborman/uuid"
 )
@@ -18,9 +17,11 @@ type resultsConn struct {
 	c        redis.Conn
 	pool     Pool
 	connUUID uuid.UUID
+	ns       string
 	timeout  time.Duration
 	logFn    func(string, ...interface{})
-	vars     *expvar.Map
+	vars     metrics.Sink
+	blobs    broker.BlobStore
 
 	// once makes sure only the first call to Results starts the goroutine.
 	once sync.Once
@@ -51,7 +52,7 @@ func (c *resultsConn) Results() <-chan *message.ResPayload {
 		c.ch = make(chan *message.ResPayload)
 
 		// compute key and timeout
-		key := fmt.Sprintf(resKey, c.connUUID)
+		key := nsKey(c.ns, resKey, c.connUUID)
 		to := int(c.timeout / time.Second)
 
 		// make connection cluster-aware if running in a cluster
@@ -96,16 +97,18 @@ func (c *resultsConn) sendResult(v []interface{}, wg *sync.WaitGroup) {
 
 	// unmarshal the payload
 	var rp message.ResPayload
-	if err := unmarshalBRPOPValue(&rp, v); err != nil {
-		if c.vars != nil {
-			c.vars.Add("FailedResPayloadUnmarshals", 1)
-		}
+	err := unmarshalBRPOPValue(&rp, v)
+	if err == nil {
+		err = unpackArgs(c.blobs, &rp.Args, &rp.Compression, &rp.BlobRef)
+	}
+	if err != nil {
+		c.vars.Add("FailedResPayloadUnmarshals", 1)
 		logf(c.logFn, "Results: BRPOP failed to unmarshal result payload: %v", err)
 		return
 	}
 
 	// check if call is expired
-	k := fmt.Sprintf(resTimeoutKey, rp.ConnUUID, rp.MsgUUID)
+	k := nsKey(c.ns, resTimeoutKey, rp.ConnUUID, rp.MsgUUID)
 
 	rc := c.pool.Get()
 	defer rc.Close()
@@ -113,22 +116,16 @@ func (c *resultsConn) sendResult(v []interface{}, wg *sync.WaitGroup) {
 
 	pttl, err := redis.Int(delAndPTTLScript.Do(rc, k))
 	if err != nil {
-		if c.vars != nil {
-			c.vars.Add("FailedPTTLResults", 1)
-		}
-		logf(c.logFn, "Results: DEL/PTTL failed: %v", err)
+		metrics.AddExemplar(c.vars, "FailedPTTLResults", 1, rp.CorrelationID)
+		logf(c.logFn, "Results: DEL/PTTL failed: %v [%s]", err, rp.CorrelationID)
 		return
 	}
 	if pttl <= 0 {
-		if c.vars != nil {
-			c.vars.Add("ExpiredResults", 1)
-		}
-		logf(c.logFn, "Results: message %v expired, dropping call", rp.MsgUUID)
+		metrics.AddExemplar(c.vars, "ExpiredResults", 1, rp.CorrelationID)
+		logf(c.logFn, "Results: message %v expired, dropping call [%s]", rp.MsgUUID, rp.CorrelationID)
 		return
 	}
 
 	c.ch <- &rp
-	if c.vars != nil {
-		c.vars.Add("Results", 1)
-	}
+	metrics.AddExemplar(c.vars, "Results", 1, rp.CorrelationID)
 }
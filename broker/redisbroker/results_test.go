@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mna/juggler/jugglertest"
 	"github.com/mna/juggler/message"
 	"github.com/mna/redisc/redistest"
 	"github.com/pborman/uuid"
@@ -16,6 +17,7 @@ func TestResults(t *testing.T) {
 	cmd, port := redistest.StartServer(t, nil, "")
 	defer cmd.Process.Kill()
 
+	snap := jugglertest.SnapshotGoroutines()
 	pool := redistest.NewPool(t, ":"+port)
 	brk := &Broker{
 		Pool:            pool,
@@ -67,4 +69,6 @@ func TestResults(t *testing.T) {
 		assert.Contains(t, rc.ResultsErr().Error(), "use of closed", "ResultsErr is the expected error")
 	}
 	assert.Equal(t, expected, uuids, "got expected UUIDs")
+
+	assertNoLeak(t, snap, pool, port)
 }
@@ -0,0 +1,134 @@
+package redisbroker
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc"
+)
+
+// ErrResultTxStreamMode is returned by ResultTx when the broker is in
+// StreamMode, where the results are not registered by a Lua script.
+var ErrResultTxStreamMode = errors.New("redisbroker: ResultTx is not supported in stream mode")
+
+// ResultScript is a Lua script executed by ResultTx atomically with
+// the registration of a call result. It must be created with
+// NewResultScript.
+type ResultScript struct {
+	s *redis.Script
+}
+
+// resultTxLua wraps the user script (1) and the script that registers
+// the result (2). ARGV[1] and ARGV[2] are the number of keys and
+// arguments of the user script, the keys and arguments of the result
+// registration follow those of the user script. The result is not
+// registered if the user script returns an error reply.
+const resultTxLua = `
+	local function tx(KEYS, ARGV)
+		%s
+	end
+	local function register(KEYS, ARGV)
+		%s
+	end
+
+	local n, m = tonumber(ARGV[1]), tonumber(ARGV[2])
+	local ret = tx({unpack(KEYS, 1, n)}, {unpack(ARGV, 3, m + 2)})
+	if type(ret) == "table" and ret.err then
+		return ret
+	end
+	local res = register({KEYS[n + 1], KEYS[n + 2]}, {unpack(ARGV, m + 3)})
+	if type(res) == "table" and res.err then
+		return res
+	end
+	return ret
+`
+
+// NewResultScript creates a ResultScript for the Lua source src. The
+// script accesses its keys and arguments via KEYS and ARGV as usual,
+// and its return value is returned by ResultTx. If it returns an error
+// reply (redis.error_reply), the result is not registered.
+//
+// Redis does not roll back the writes of a script that fails: the
+// writes made by src before it returns an error or raises one are
+// kept, and so are its writes if the result cannot be registered
+// because the results list is full (see ResultCap).
+func NewResultScript(src string) *ResultScript {
+	return &ResultScript{s: redis.NewScript(-1, fmt.Sprintf(resultTxLua, src, callOrResLua))}
+}
+
+// ResultHashTag returns the hash tag of the keys where the result rp
+// is registered, e.g. "{<conn UUID>}". In a redis cluster, the keys
+// of the ResultScript executed with that result must contain that hash
+// tag, so that all keys are in the same hash slot.
+func ResultHashTag(rp *message.ResPayload) string {
+	if rp.ResultsQueue != "" {
+		return "{" + rp.ResultsQueue + "}"
+	}
+	return "{" + rp.ConnUUID.String() + "}"
+}
+
+// ResultTx registers a call result in the broker like Result, and
+// atomically executes the script s with the keys and args, e.g. to
+// update the state that the callee changed to produce that result.
+// It returns the value returned by the script. Neither the result nor
+// the script's writes are visible to other redis clients until both
+// are done.
+//
+// The result is not registered if the script returns an error. The
+// result is always sent directly to redis, even if FlushInterval is
+// set, and it is not supported if Mode is StreamMode. In a redis
+// cluster, all keys must be in the hash slot of the result (see
+// ResultHashTag), otherwise it returns an error without executing the
+// script.
+func (b *Broker) ResultTx(rp *message.ResPayload, timeout time.Duration, s *ResultScript, keys []string, args ...interface{}) (interface{}, error) {
+	if b.Mode == StreamMode && rp.ResultsQueue == "" {
+		return nil, ErrResultTxStreamMode
+	}
+
+	k1, k2 := b.resultKeys(rp)
+	rp, err := b.packResult(rp, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret interface{}
+	err = b.withDedup(b.dedupResKeyFor(rp.MsgUUID, rp.Chunk, rp.Seq), "DedupedResults", func() error {
+		argv, err := callOrResArgs(rp, rp.Priority, timeout, b.ResultCap)
+		if err != nil {
+			return err
+		}
+
+		allKeys := append(append([]string(nil), keys...), k1, k2)
+		scriptArgs := make([]interface{}, 0, 3+len(allKeys)+len(args)+len(argv))
+		scriptArgs = append(scriptArgs, len(allKeys))
+		for _, k := range allKeys {
+			scriptArgs = append(scriptArgs, k)
+		}
+		scriptArgs = append(scriptArgs, len(keys), len(args))
+		scriptArgs = append(scriptArgs, args...)
+		scriptArgs = append(scriptArgs, argv...)
+
+		rc := b.Pool.Get()
+		defer rc.Close()
+
+		// unlike clusterifyConn, fail if the keys are not in the same
+		// slot, the script could not be executed atomically.
+		if bc, ok := rc.(binder); ok {
+			if err := bc.Bind(allKeys...); err != nil {
+				return err
+			}
+			retry, err := redisc.RetryConn(rc, clusterConnMaxAttempts, clusterConnTryAgainDelay)
+			if err != nil {
+				return err
+			}
+			rc = retry
+		}
+
+		ret, err = s.s.Do(rc, scriptArgs...)
+		return err
+	})
+	return ret, err
+}
@@ -0,0 +1,52 @@
+package redisbroker
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultTx(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	incr := NewResultScript(`return redis.call("INCRBY", KEYS[1], ARGV[1])`)
+	fail := NewResultScript(`return redis.error_reply("rejected")`)
+
+	connUUID := uuid.NewRandom()
+	rp := &message.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a"}
+	stateKey := "state:" + ResultHashTag(rp)
+
+	ret, err := brk.ResultTx(rp, 0, incr, []string{stateKey}, 3)
+	require.NoError(t, err, "ResultTx")
+	assert.Equal(t, int64(3), ret, "script returned value")
+
+	rp2 := &message.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a"}
+	_, err = brk.ResultTx(rp2, 0, fail, nil)
+	if assert.Error(t, err, "ResultTx with failing script") {
+		assert.Contains(t, err.Error(), "rejected", "script error")
+	}
+
+	rc := pool.Get()
+	defer rc.Close()
+
+	n, err := redis.Int(rc.Do("GET", stateKey))
+	require.NoError(t, err, "GET state")
+	assert.Equal(t, 3, n, "state updated")
+	n, err = redis.Int(rc.Do("LLEN", fmt.Sprintf(resKey, connUUID)))
+	require.NoError(t, err, "LLEN results")
+	assert.Equal(t, 1, n, "only the first result is registered")
+}
@@ -0,0 +1,47 @@
+package redisbroker
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"github.com/pborman/uuid"
+)
+
+// redis cluster-compliant key, the members of a room are stored in a set
+const roomKey = "juggler:rooms:{%s}" // 1: room
+
+// Join adds the connection identified by connUUID to the room. Room
+// members are stored in a redis set.
+func (b *Broker) Join(room string, connUUID uuid.UUID) error {
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	_, err := rc.Do("SADD", b.key(roomKey, room), connUUID.String())
+	return err
+}
+
+// Leave removes the connection identified by connUUID from the room.
+func (b *Broker) Leave(room string, connUUID uuid.UUID) error {
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	_, err := rc.Do("SREM", b.key(roomKey, room), connUUID.String())
+	return err
+}
+
+// Members returns the UUIDs of the connections that are members of
+// the room, in no particular order.
+func (b *Broker) Members(room string) ([]uuid.UUID, error) {
+	rc := b.Pool.Get()
+	defer rc.Close()
+
+	vals, err := redis.Strings(rc.Do("SMEMBERS", b.key(roomKey, room)))
+	if err != nil {
+		return nil, err
+	}
+	uuids := make([]uuid.UUID, 0, len(vals))
+	for _, v := range vals {
+		if u := uuid.Parse(v); u != nil {
+			uuids = append(uuids, u)
+		}
+	}
+	return uuids, nil
+}
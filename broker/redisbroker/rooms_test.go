@@ -0,0 +1,47 @@
+package redisbroker
+
+import (
+	"testing"
+
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRooms(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	brk := &Broker{
+		Pool:    pool,
+		Dial:    pool.Dial,
+		LogFunc: logIfVerbose,
+	}
+
+	members, err := brk.Members("a")
+	require.NoError(t, err, "Members empty")
+	assert.Empty(t, members, "no members")
+
+	c1, c2 := uuid.NewRandom(), uuid.NewRandom()
+	require.NoError(t, brk.Join("a", c1), "Join c1")
+	require.NoError(t, brk.Join("a", c2), "Join c2")
+	require.NoError(t, brk.Join("a", c1), "Join c1 again")
+	require.NoError(t, brk.Join("b", c2), "Join b c2")
+
+	members, err = brk.Members("a")
+	require.NoError(t, err, "Members a")
+	assert.Equal(t, 2, len(members), "a members")
+	assert.Contains(t, members, c1, "c1 in a")
+	assert.Contains(t, members, c2, "c2 in a")
+
+	require.NoError(t, brk.Leave("a", c2), "Leave c2")
+	members, err = brk.Members("a")
+	require.NoError(t, err, "Members a after leave")
+	assert.Equal(t, []uuid.UUID{c1}, members, "a members after leave")
+
+	members, err = brk.Members("b")
+	require.NoError(t, err, "Members b")
+	assert.Equal(t, []uuid.UUID{c2}, members, "b members")
+}
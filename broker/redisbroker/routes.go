@@ -0,0 +1,67 @@
+package redisbroker
+
+import (
+	"strings"
+
+	"github.com/mna/juggler/broker"
+	"github.com/garyburd/redigo/redis"
+)
+
+// redis SET of the URIs for which callees listen for call requests,
+// used when PrefixRouting is set.
+const routesKey = "juggler:routes"
+
+// script to return the first of the candidate URIs that is registered
+// in the routes SET, or nil.
+var routeScript = redis.NewScript(1, `
+	for _, uri in ipairs(ARGV) do
+		if redis.call("SISMEMBER", KEYS[1], uri) == 1 then
+			return uri
+		end
+	end
+	return false
+`)
+
+// registerRoutes registers the uris in the routes SET.
+func (b *Broker) registerRoutes(uris []string) error {
+	key := b.key(routesKey)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, key)
+
+	_, err := rc.Do("SADD", redis.Args{key}.AddFlat(uris)...)
+	return err
+}
+
+// route returns the URI of the queue that holds the call requests for
+// uri. This is uri itself if a callee registered it, or if no callee
+// registered a matching prefix URI, otherwise it is the most specific
+// registered prefix URI.
+func (b *Broker) route(uri string) (string, error) {
+	key := b.key(routesKey)
+
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, key)
+
+	args := redis.Args{key, uri}.AddFlat(broker.PrefixURIs(uri))
+	route, err := redis.String(routeScript.Do(rc, args...))
+	if err == redis.ErrNil {
+		return uri, nil
+	}
+	return route, err
+}
+
+// callKeyURI returns the URI of the call requests queue identified by
+// key, which may be the high-priority list of the queue, that is the
+// hash tag of the key, in any Namespace.
+func callKeyURI(key string) string {
+	if i := strings.Index(key, "{"); i >= 0 {
+		key = key[i+1:]
+	}
+	if i := strings.LastIndex(key, "}"); i >= 0 {
+		key = key[:i]
+	}
+	return key
+}
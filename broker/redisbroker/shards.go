@@ -0,0 +1,109 @@
+package redisbroker
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/mna/juggler/message"
+)
+
+// shardURI is the format of the URI of the queue of a shard of a
+// sharded URI, see ShardedCalls.
+const shardURI = "%s#%d" // 1: URI, 2: shard
+
+// ShardRange is a range of shards of a sharded URI, from First to
+// Last inclusive, as returned by AssignShards.
+type ShardRange struct {
+	First int
+	Last  int
+}
+
+// Len returns the number of shards in the range.
+func (r ShardRange) Len() int {
+	if r.Last < r.First {
+		return 0
+	}
+	return r.Last - r.First + 1
+}
+
+// ShardURIs returns the URIs of the queues of the shards of uri in
+// the range r, to pass to NewCallsConn so that a callee processes the
+// call requests of those shards. The call requests keep the original
+// uri as URI, so the callee handles them as calls to uri.
+//
+// In a redis cluster, the shards are spread over the cluster slots,
+// so a calls connection can only listen to a single shard.
+func ShardURIs(uri string, r ShardRange) []string {
+	uris := make([]string, 0, r.Len())
+	for i := r.First; i <= r.Last; i++ {
+		uris = append(uris, fmt.Sprintf(shardURI, uri, i))
+	}
+	return uris
+}
+
+// AssignShards returns the range of the n shards of a sharded URI
+// assigned to the callee at index among callees. The shards are split
+// in contiguous ranges of (almost) the same size, so that all shards
+// are assigned when each callee listens to its range. When callees
+// are added or removed, each callee calls it again with the new count
+// and its new index, and reopens its calls connection if its range
+// changed. If there are more callees than shards, the range of the
+// extra callees is empty.
+func AssignShards(n, callees, index int) ShardRange {
+	if n <= 0 || callees <= 0 || index < 0 || index >= callees || index >= n {
+		return ShardRange{First: 0, Last: -1}
+	}
+	if callees > n {
+		callees = n
+	}
+	size, extra := n/callees, n%callees
+
+	// the first extra callees get one more shard
+	if index < extra {
+		first := index * (size + 1)
+		return ShardRange{First: first, Last: first + size}
+	}
+	first := index*size + extra
+	return ShardRange{First: first, Last: first + size - 1}
+}
+
+// ShardOf returns the shard in [0, n) of the shard key, using a jump
+// consistent hash, so that only 1/n of the keys move to another shard
+// when the number of shards grows from n-1 to n.
+func ShardOf(key string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	k := h.Sum64()
+
+	// Lamping and Veach, "A Fast, Minimal Memory, Consistent Hash
+	// Algorithm".
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		k = k*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((k>>33)+1)))
+	}
+	return int(b)
+}
+
+// shardKey returns the shard key of the call request cp.
+func (b *Broker) shardKey(cp *message.CallPayload) string {
+	if b.ShardKey != nil {
+		return b.ShardKey(cp)
+	}
+	return cp.ConnUUID.String()
+}
+
+// shard returns the URI of the queue of the call request cp for the
+// queue URI uri, which is the queue of its shard if uri is sharded.
+func (b *Broker) shard(uri string, cp *message.CallPayload) string {
+	n := b.ShardedCalls[uri]
+	if n <= 0 {
+		return uri
+	}
+	return fmt.Sprintf(shardURI, uri, ShardOf(b.shardKey(cp), n))
+}
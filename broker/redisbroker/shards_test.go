@@ -0,0 +1,51 @@
+package redisbroker
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssignShards(t *testing.T) {
+	cases := []struct {
+		n, callees int
+		exp        []ShardRange
+	}{
+		{4, 1, []ShardRange{{0, 3}}},
+		{4, 2, []ShardRange{{0, 1}, {2, 3}}},
+		{5, 2, []ShardRange{{0, 2}, {3, 4}}},
+		{10, 3, []ShardRange{{0, 3}, {4, 6}, {7, 9}}},
+		{2, 3, []ShardRange{{0, 0}, {1, 1}, {0, -1}}},
+	}
+	for _, c := range cases {
+		for i, exp := range c.exp {
+			assert.Equal(t, exp, AssignShards(c.n, c.callees, i), "%d shards, %d callees, index %d", c.n, c.callees, i)
+		}
+	}
+	assert.Equal(t, 0, AssignShards(0, 1, 0).Len(), "no shard")
+	assert.Equal(t, 0, AssignShards(4, 2, 2).Len(), "invalid index")
+	assert.Equal(t, []string{"a#2", "a#3"}, ShardURIs("a", ShardRange{2, 3}), "ShardURIs")
+}
+
+func TestShardOf(t *testing.T) {
+	const keys = 1000
+
+	counts := make([]int, 8)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		k := strconv.Itoa(i)
+		s := ShardOf(k, 8)
+		assert.Equal(t, s, ShardOf(k, 8), "stable shard")
+		counts[s]++
+		if ShardOf(k, 9) != s {
+			moved++
+		}
+	}
+	for i, n := range counts {
+		assert.True(t, n > keys/16, "shard %d has %d keys", i, n)
+	}
+	// about 1/9 of the keys move to the new shard
+	assert.True(t, moved < keys/5, "%d keys moved", moved)
+	assert.Equal(t, 0, ShardOf("a", 1), "single shard")
+}
@@ -0,0 +1,438 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Mode is the redis data structure used to store the call requests
+// and results.
+type Mode int
+
+// The list of supported modes.
+const (
+	// ListMode stores the call requests and results in redis LISTs
+	// consumed with BRPOP. It is the default mode.
+	ListMode Mode = iota
+
+	// StreamMode stores the call requests and results in redis streams
+	// (requires redis 6.2 or later). The call requests are consumed
+	// with XREADGROUP by a consumer group shared by all callees, and are
+	// processed at least once: the calls connections implement
+	// broker.AckCallsConn, and a call request that is not acknowledged
+	// within the visibility timeout is claimed with XAUTOCLAIM by
+	// another callee. The results are consumed with XREAD.
+	StreamMode
+)
+
+var (
+	// DefaultConsumerGroup is the default name of the consumer group of
+	// the calls streams in StreamMode.
+	DefaultConsumerGroup = "juggler"
+
+	// DefaultStreamVisibilityTimeout is the default visibility timeout
+	// of the call requests in StreamMode.
+	DefaultStreamVisibilityTimeout = 30 * time.Second
+)
+
+const (
+	// redis cluster-compliant keys, in the same slot as the timeout keys
+	callStreamKey = "juggler:calls:stream:{%s}"   // 1: URI
+	resStreamKey  = "juggler:results:stream:{%s}" // 1: cUUID
+
+	// maximum number of pending entries claimed per stream at once
+	streamClaimCount = 100
+)
+
+var errUnknownStreamCall = errors.New("juggler/redisbroker: unknown call request")
+
+// script to store the call request or call result in a stream, along
+// with its expiration information. It returns the ID of the stream
+// entry.
+var addCallOrResScript = redis.NewScript(2, `
+	local limit = tonumber(ARGV[3])
+	if limit > 0 and redis.call("XLEN", KEYS[2]) >= limit then
+		return redis.error_reply("stream capacity exceeded")
+	end
+	redis.call("SET", KEYS[1], ARGV[1], "PX", tonumber(ARGV[1]))
+	return redis.call("XADD", KEYS[2], "*", "p", ARGV[2])
+`)
+
+// script to acknowledge a processed call request, deleting its timeout
+// key and its stream entry.
+var ackStreamCallScript = redis.NewScript(2, `
+	redis.call("DEL", KEYS[1])
+	redis.call("XACK", KEYS[2], ARGV[1], ARGV[2])
+	redis.call("XDEL", KEYS[2], ARGV[2])
+`)
+
+func addCallOrRes(pool Pool, pld interface{}, timeout time.Duration, cap int, k1, k2 string) error {
+	p, err := json.Marshal(pld)
+	if err != nil {
+		return err
+	}
+
+	rc := pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k1, k2)
+
+	to := int(timeout / time.Millisecond)
+	if to == 0 {
+		to = int(broker.DefaultCallTimeout / time.Millisecond)
+	}
+
+	_, err = addCallOrResScript.Do(rc,
+		k1,  // key[1] : the SET key with expiration
+		k2,  // key[2] : the stream key
+		to,  // argv[1] : the timeout in milliseconds
+		p,   // argv[2] : the payload
+		cap, // argv[3] : the stream capacity
+	)
+	return err
+}
+
+// createGroup creates the consumer group of the calls stream key if
+// it doesn't exist. The stream is created if needed.
+func (b *Broker) createGroup(key string) error {
+	rc := b.Pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, key)
+
+	_, err := rc.Do("XGROUP", "CREATE", key, b.consumerGroup(), "0", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		err = nil
+	}
+	return err
+}
+
+// consumerGroup returns the name of the consumer group to use in
+// StreamMode.
+func (b *Broker) consumerGroup() string {
+	if b.ConsumerGroup != "" {
+		return b.ConsumerGroup
+	}
+	return DefaultConsumerGroup
+}
+
+// streamEntry is an entry read from a calls or results stream.
+type streamEntry struct {
+	key     string
+	id      string
+	payload []byte
+}
+
+// parseStreams parses the reply of XREAD and XREADGROUP, which is an
+// array of [key, entries] arrays.
+func parseStreams(reply interface{}, err error) ([]streamEntry, error) {
+	streams, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []streamEntry
+	for _, s := range streams {
+		vals, err := redis.Values(s, nil)
+		if err != nil {
+			return nil, err
+		}
+		var key string
+		var entries []interface{}
+		if _, err := redis.Scan(vals, &key, &entries); err != nil {
+			return nil, err
+		}
+		if res, err = parseEntries(res, key, entries); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// parseEntries appends the stream entries of key to dst, each entry
+// being an [id, fields] array. Entries that were deleted have nil
+// fields and are skipped.
+func parseEntries(dst []streamEntry, key string, entries []interface{}) ([]streamEntry, error) {
+	for _, e := range entries {
+		vals, err := redis.Values(e, nil)
+		if err != nil {
+			return nil, err
+		}
+		var id string
+		var fields []interface{}
+		if _, err := redis.Scan(vals, &id, &fields); err != nil {
+			return nil, err
+		}
+
+		se := streamEntry{key: key, id: id}
+		for len(fields) > 1 {
+			var name string
+			var val []byte
+			if fields, err = redis.Scan(fields, &name, &val); err != nil {
+				return nil, err
+			}
+			if name == "p" {
+				se.payload = val
+			}
+		}
+		if se.payload != nil {
+			dst = append(dst, se)
+		}
+	}
+	return dst, nil
+}
+
+var _ broker.AckCallsConn = (*streamCallsConn)(nil)
+
+// streamCallsConn is a calls connection that consumes the call requests
+// from redis streams.
+type streamCallsConn struct {
+	*callsConn
+	group      string
+	consumer   string
+	visibility time.Duration
+
+	// mu protects entries, the stream entry of each call being
+	// processed, by call UUID.
+	mu      sync.Mutex
+	entries map[string]streamEntry
+}
+
+// Calls returns a stream of call requests for the URIs specified when
+// creating the connection. For use in a redis cluster, all URIs must
+// belong to the same cluster slot.
+func (c *streamCallsConn) Calls() <-chan *message.CallPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *message.CallPayload)
+
+		keys := make([]string, len(c.uris))
+		for i, uri := range c.uris {
+			keys[i] = nsKey(c.ns, callStreamKey, uri)
+		}
+		rc := clusterifyConn(c.c, keys...)
+
+		go c.pollCalls(rc, keys)
+	})
+	return c.ch
+}
+
+// Ack acknowledges that the call request cp was processed, so that it
+// is not claimed by another callee.
+func (c *streamCallsConn) Ack(cp *message.CallPayload) error {
+	id := cp.MsgUUID.String()
+	c.mu.Lock()
+	se, ok := c.entries[id]
+	delete(c.entries, id)
+	c.mu.Unlock()
+	if !ok {
+		return errUnknownStreamCall
+	}
+
+	k := nsKey(c.ns, callTimeoutKey, callStreamKeyURI(se.key), cp.MsgUUID)
+	rc := c.pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k, se.key)
+
+	_, err := ackStreamCallScript.Do(rc, k, se.key, c.group, se.id)
+	return err
+}
+
+func (c *streamCallsConn) pollCalls(pollConn redis.Conn, keys []string) {
+	defer close(c.ch)
+
+	// the pending entries are claimed between reads, so the reads must
+	// not block for longer than the claim interval.
+	claimEvery := c.visibility / 2
+	block := c.timeout
+	if block <= 0 || block > claimEvery {
+		block = claimEvery
+	}
+	ms := int(block / time.Millisecond)
+	if ms <= 0 {
+		ms = 1
+	}
+
+	args := redis.Args{"GROUP", c.group, c.consumer, "COUNT", 1, "BLOCK", ms, "STREAMS"}.AddFlat(keys)
+	for range keys {
+		args = args.Add(">")
+	}
+
+	wg := sync.WaitGroup{}
+	var lastClaim time.Time
+	for {
+		if time.Since(lastClaim) >= claimEvery {
+			lastClaim = time.Now()
+			for _, key := range keys {
+				entries, err := c.claim(pollConn, key)
+				if err != nil {
+					c.vars.Add("FailedCallRequeues", 1)
+					logf(c.logFn, "Calls: XAUTOCLAIM failed for %s: %v", key, err)
+					continue
+				}
+				c.vars.Add("RequeuedCalls", int64(len(entries)))
+				for _, se := range entries {
+					wg.Add(1)
+					go c.sendCall(se, &wg)
+				}
+			}
+		}
+
+		entries, err := parseStreams(pollConn.Do("XREADGROUP", args...))
+		if err != nil {
+			if err == redis.ErrNil {
+				// no available value
+				continue
+			}
+
+			// possibly a closed connection, in any case stop
+			// the loop.
+			c.errmu.Lock()
+			c.err = err
+			c.errmu.Unlock()
+			wg.Wait()
+			return
+		}
+
+		for _, se := range entries {
+			wg.Add(1)
+			go c.sendCall(se, &wg)
+		}
+	}
+}
+
+// claim claims the entries of the stream key that were not acknowledged
+// within the visibility timeout, so that they are processed by this
+// connection.
+func (c *streamCallsConn) claim(rc redis.Conn, key string) ([]streamEntry, error) {
+	minIdle := int(c.visibility / time.Millisecond)
+	vals, err := redis.Values(rc.Do("XAUTOCLAIM", key, c.group, c.consumer, minIdle, "0-0", "COUNT", streamClaimCount))
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) < 2 {
+		return nil, nil
+	}
+	entries, err := redis.Values(vals[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseEntries(nil, key, entries)
+}
+
+func (c *streamCallsConn) sendCall(se streamEntry, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var cp message.CallPayload
+	err := json.Unmarshal(se.payload, &cp)
+	if err == nil {
+		err = unpackArgs(c.blobs, &cp.Args, &cp.Compression, &cp.BlobRef)
+	}
+	if err != nil {
+		c.vars.Add("FailedCallPayloadUnmarshals", 1)
+		logf(c.logFn, "Calls: XREADGROUP failed to unmarshal call payload: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	c.entries[cp.MsgUUID.String()] = se
+	c.mu.Unlock()
+
+	// the timeout key is deleted when the call is acknowledged, so that
+	// it is still valid if the call is claimed by another callee.
+	k := nsKey(c.ns, callTimeoutKey, callStreamKeyURI(se.key), cp.MsgUUID)
+
+	rc := c.pool.Get()
+	defer rc.Close()
+	rc = clusterifyConn(rc, k)
+
+	pttl, err := redis.Int(rc.Do("PTTL", k))
+	if err != nil {
+		metrics.AddExemplar(c.vars, "FailedPTTLCalls", 1, cp.CorrelationID)
+		logf(c.logFn, "Calls: PTTL failed: %v [%s]", err, cp.CorrelationID)
+		return
+	}
+	if pttl <= 0 {
+		metrics.AddExemplar(c.vars, "ExpiredCalls", 1, cp.CorrelationID)
+		logf(c.logFn, "Calls: message %v expired, dropping call [%s]", cp.MsgUUID, cp.CorrelationID)
+		c.Ack(&cp)
+		return
+	}
+
+	cp.ReadTimestamp = time.Now().UTC()
+	cp.TTLAfterRead = time.Duration(pttl) * time.Millisecond
+	c.ch <- &cp
+	metrics.AddExemplar(c.vars, "Calls", 1, cp.CorrelationID)
+}
+
+// callStreamKeyURI returns the URI of the calls stream identified by
+// key.
+func callStreamKeyURI(key string) string {
+	return callKeyURI(key)
+}
+
+var _ broker.ResultsConn = (*streamResultsConn)(nil)
+
+// streamResultsConn is a results connection that consumes the call
+// results from a redis stream.
+type streamResultsConn struct {
+	*resultsConn
+}
+
+// Results returns a stream of call results for the connUUID specified
+// when creating the connection.
+func (c *streamResultsConn) Results() <-chan *message.ResPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *message.ResPayload)
+
+		key := nsKey(c.ns, resStreamKey, c.connUUID)
+		rc := clusterifyConn(c.c, key)
+
+		go c.pollResults(rc, key)
+	})
+	return c.ch
+}
+
+func (c *streamResultsConn) pollResults(pollConn redis.Conn, key string) {
+	defer close(c.ch)
+
+	ms := int(c.timeout / time.Millisecond)
+	wg := sync.WaitGroup{}
+	for last := "0"; ; {
+		entries, err := parseStreams(pollConn.Do("XREAD", "BLOCK", ms, "STREAMS", key, last))
+		if err == nil && len(entries) > 0 {
+			// the results are only read by this connection, so they are
+			// deleted as soon as they are received.
+			ids := make([]interface{}, len(entries))
+			for i, se := range entries {
+				ids[i] = se.id
+			}
+			_, err = pollConn.Do("XDEL", redis.Args{key}.Add(ids...)...)
+		}
+		if err != nil {
+			if err == redis.ErrNil {
+				// no available value
+				continue
+			}
+
+			// possibly a closed connection, in any case stop
+			// the loop.
+			c.errmu.Lock()
+			c.err = err
+			c.errmu.Unlock()
+			wg.Wait()
+			return
+		}
+
+		for _, se := range entries {
+			last = se.id
+			wg.Add(1)
+			go c.sendResult([]interface{}{[]byte(se.key), se.payload}, &wg)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package redisbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/redisc/redistest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStreams(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{
+			[]byte("k1"),
+			[]interface{}{
+				[]interface{}{[]byte("1-0"), []interface{}{[]byte("p"), []byte("a")}},
+				[]interface{}{[]byte("2-0"), nil},
+			},
+		},
+		[]interface{}{
+			[]byte("k2"),
+			[]interface{}{
+				[]interface{}{[]byte("3-0"), []interface{}{[]byte("x"), []byte("y"), []byte("p"), []byte("b")}},
+			},
+		},
+	}
+
+	got, err := parseStreams(reply, nil)
+	require.NoError(t, err, "parseStreams")
+	assert.Equal(t, []streamEntry{
+		{key: "k1", id: "1-0", payload: []byte("a")},
+		{key: "k2", id: "3-0", payload: []byte("b")},
+	}, got)
+
+	assert.Equal(t, "a.b", callStreamKeyURI("juggler:calls:stream:{a.b}"), "callStreamKeyURI")
+}
+
+func TestStreamCalls(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	defer pool.Close()
+	brk := &Broker{
+		Pool:              pool,
+		Dial:              pool.Dial,
+		LogFunc:           logIfVerbose,
+		Mode:              StreamMode,
+		VisibilityTimeout: 100 * time.Millisecond,
+	}
+
+	// the consumer group is created by the first calls connection, the
+	// calls registered before are still processed.
+	cc1, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection 1")
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Call(cp, time.Minute), "Call")
+
+	// the first callee receives the call but doesn't acknowledge it
+	select {
+	case got := <-cc1.Calls():
+		assert.Equal(t, cp.MsgUUID, got.MsgUUID, "first receive")
+	case <-time.After(time.Second):
+		require.FailNow(t, "no call received")
+	}
+	require.NoError(t, cc1.Close(), "close Calls connection 1")
+
+	// the call is claimed by the second callee
+	cc2, err := brk.NewCallsConn("a")
+	require.NoError(t, err, "get Calls connection 2")
+	defer cc2.Close()
+	ac, ok := cc2.(broker.AckCallsConn)
+	require.True(t, ok, "AckCallsConn")
+	select {
+	case got := <-ac.Calls():
+		assert.Equal(t, cp.MsgUUID, got.MsgUUID, "claimed receive")
+		require.NoError(t, ac.Ack(got), "Ack")
+	case <-time.After(time.Second):
+		require.FailNow(t, "no claimed call received")
+	}
+
+	// once acknowledged, the call is not claimed again
+	select {
+	case got := <-ac.Calls():
+		assert.Fail(t, "unexpected call", "%v", got.MsgUUID)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestStreamResults(t *testing.T) {
+	cmd, port := redistest.StartServer(t, nil, "")
+	defer cmd.Process.Kill()
+
+	pool := redistest.NewPool(t, ":"+port)
+	defer pool.Close()
+	brk := &Broker{
+		Pool:            pool,
+		Dial:            pool.Dial,
+		BlockingTimeout: time.Second,
+		LogFunc:         logIfVerbose,
+		Mode:            StreamMode,
+		ResultCap:       2,
+	}
+
+	connUUID := uuid.NewRandom()
+	rp1 := &message.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a"}
+	rp2 := &message.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a"}
+	require.NoError(t, brk.Result(rp1, time.Minute), "Result 1")
+	require.NoError(t, brk.Result(rp2, time.Minute), "Result 2")
+	assert.Error(t, brk.Result(&message.ResPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "a"}, time.Minute), "capacity exceeded")
+
+	rc, err := brk.NewResultsConn(connUUID)
+	require.NoError(t, err, "get Results connection")
+	defer rc.Close()
+
+	got := make(map[string]bool)
+	for len(got) < 2 {
+		select {
+		case rp := <-rc.Results():
+			got[rp.MsgUUID.String()] = true
+		case <-time.After(time.Second):
+			require.FailNow(t, "missing results", "%v", got)
+		}
+	}
+	assert.Equal(t, map[string]bool{rp1.MsgUUID.String(): true, rp2.MsgUUID.String(): true}, got)
+}
@@ -0,0 +1,87 @@
+package redisbroker
+
+import (
+	"strings"
+
+	"github.com/mna/juggler/broker"
+)
+
+// topicGlob returns the redis glob-style pattern that matches all the
+// topics matched by the topic filter pattern. It may match more
+// topics, e.g. "*" matches many segments, so the events received for
+// the glob are matched against the filter (see filtersFor).
+func topicGlob(pattern string) string {
+	segs := strings.Split(pattern, ".")
+	for i, seg := range segs {
+		if seg == broker.TopicWildcard {
+			segs[i] = "*"
+		}
+	}
+	if last := len(segs) - 1; segs[last] == broker.TopicMultiWildcard {
+		// the glob must match the parent topic too, e.g. "a.#" matches "a"
+		return strings.Join(segs[:last], ".") + "*"
+	}
+	return strings.Join(segs, ".")
+}
+
+// subTopicFilter subscribes the connection to the topic filter pattern.
+// Many filters may share the same glob, which is subscribed to only
+// once.
+func (c *pubSubConn) subTopicFilter(pattern string) error {
+	glob := topicGlob(pattern)
+
+	c.tmu.Lock()
+	defer c.tmu.Unlock()
+	fs := c.filters[glob]
+	if fs[pattern] {
+		return nil
+	}
+	if len(fs) == 0 {
+		if err := c.subUnsub(glob, true, true); err != nil {
+			return err
+		}
+	}
+	if fs == nil {
+		if c.filters == nil {
+			c.filters = make(map[string]map[string]bool)
+		}
+		fs = make(map[string]bool)
+		c.filters[glob] = fs
+	}
+	fs[pattern] = true
+	return nil
+}
+
+// unsubTopicFilter unsubscribes the connection from the topic filter
+// pattern, and from its glob if no other filter uses it.
+func (c *pubSubConn) unsubTopicFilter(pattern string) error {
+	glob := topicGlob(pattern)
+
+	c.tmu.Lock()
+	defer c.tmu.Unlock()
+	fs := c.filters[glob]
+	if !fs[pattern] {
+		return nil
+	}
+	delete(fs, pattern)
+	if len(fs) > 0 {
+		return nil
+	}
+	delete(c.filters, glob)
+	return c.subUnsub(glob, true, false)
+}
+
+// filtersFor returns the topic filters subscribed with glob that match
+// channel.
+func (c *pubSubConn) filtersFor(glob, channel string) []string {
+	c.tmu.Lock()
+	defer c.tmu.Unlock()
+
+	var res []string
+	for f := range c.filters[glob] {
+		if broker.MatchTopic(f, channel) {
+			res = append(res, f)
+		}
+	}
+	return res
+}
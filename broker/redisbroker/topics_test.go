@@ -0,0 +1,23 @@
+package redisbroker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicGlob(t *testing.T) {
+	cases := map[string]string{
+		"a":       "a",
+		"a.b":     "a.b",
+		"+":       "*",
+		"#":       "*",
+		"a.+.c":   "a.*.c",
+		"a.#":     "a*",
+		"a.+.#":   "a.**",
+		"+.b.+.#": "*.b.**",
+	}
+	for in, exp := range cases {
+		assert.Equal(t, exp, topicGlob(in), in)
+	}
+}
@@ -0,0 +1,98 @@
+package broker
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidTopic is returned when a channel is not a valid topic or
+// a pattern is not a valid topic filter (see ValidTopic and
+// ValidTopicFilter).
+var ErrInvalidTopic = errors.New("juggler/broker: invalid topic")
+
+// The topic wildcards: TopicWildcard matches exactly one segment of a
+// topic, and TopicMultiWildcard, which must be the last segment of a
+// topic filter, matches any number of trailing segments, including
+// none.
+const (
+	TopicWildcard      = "+"
+	TopicMultiWildcard = "#"
+)
+
+// topicReserved is the list of characters that cannot be used in a
+// topic segment, as they are the topic wildcards or the wildcards of
+// the pattern syntax of a backend.
+const topicReserved = "+#*>?[]\\"
+
+// validSegment returns true if s is a valid topic segment.
+func validSegment(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune(topicReserved, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidTopic returns ErrInvalidTopic if channel is not a valid topic.
+// A topic is a list of segments separated by dots (e.g.
+// "sensors.room1.temp"). A segment cannot be empty, and cannot
+// contain whitespace nor any of the "+#*>?[]\" characters, so that
+// topics have the same meaning with all brokers.
+func ValidTopic(channel string) error {
+	for _, seg := range strings.Split(channel, ".") {
+		if !validSegment(seg) {
+			return ErrInvalidTopic
+		}
+	}
+	return nil
+}
+
+// ValidTopicFilter returns ErrInvalidTopic if pattern is not a valid
+// topic filter. A topic filter is a topic whose segments may also be
+// the TopicWildcard, and whose last segment may be the
+// TopicMultiWildcard (e.g. "sensors.+.temp" or "sensors.#"), as for
+// MQTT topics.
+func ValidTopicFilter(pattern string) error {
+	segs := strings.Split(pattern, ".")
+	for i, seg := range segs {
+		switch {
+		case seg == TopicWildcard:
+		case seg == TopicMultiWildcard && i == len(segs)-1:
+		case !validSegment(seg):
+			return ErrInvalidTopic
+		}
+	}
+	return nil
+}
+
+// MatchTopic returns true if the topic filter pattern matches the
+// topic channel. For example, "sensors.+.temp" matches
+// "sensors.room1.temp" but not "sensors.room1.hum", and "sensors.#"
+// matches "sensors", "sensors.room1" and "sensors.room1.temp".
+func MatchTopic(pattern, channel string) bool {
+	pats, segs := strings.Split(pattern, "."), strings.Split(channel, ".")
+	for i, p := range pats {
+		if p == TopicMultiWildcard {
+			return true
+		}
+		if i >= len(segs) || (p != TopicWildcard && p != segs[i]) {
+			return false
+		}
+	}
+	return len(pats) == len(segs)
+}
+
+// ValidateTopicSub returns ErrInvalidTopic if channel is not a valid
+// topic, or not a valid topic filter if pattern is true. Brokers that
+// support topics call it on Subscribe.
+func ValidateTopicSub(channel string, pattern bool) error {
+	if pattern {
+		return ValidTopicFilter(channel)
+	}
+	return ValidTopic(channel)
+}
@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidTopic(t *testing.T) {
+	cases := []struct {
+		in          string
+		topic, filt bool
+	}{
+		{"a", true, true},
+		{"a.b.c", true, true},
+		{"a-1.b_2:c", true, true},
+		{"", false, false},
+		{"a..b", false, false},
+		{"a.", false, false},
+		{".a", false, false},
+		{"a b", false, false},
+		{"a*", false, false},
+		{"a.>", false, false},
+		{"a.[b]", false, false},
+		{"+", false, true},
+		{"#", false, true},
+		{"a.+.c", false, true},
+		{"a.#", false, true},
+		{"+.#", false, true},
+		{"a+.b", false, false},
+		{"a.#.c", false, false},
+		{"a#", false, false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.topic, ValidTopic(c.in) == nil, "topic %q", c.in)
+		assert.Equal(t, c.filt, ValidTopicFilter(c.in) == nil, "filter %q", c.in)
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern, channel string
+		exp              bool
+	}{
+		{"a", "a", true},
+		{"a", "b", false},
+		{"a", "a.b", false},
+		{"+", "a", true},
+		{"+", "a.b", false},
+		{"a.+", "a.b", true},
+		{"a.+", "a", false},
+		{"a.+.c", "a.b.c", true},
+		{"a.+.c", "a.b.d", false},
+		{"#", "a", true},
+		{"#", "a.b.c", true},
+		{"a.#", "a", true},
+		{"a.#", "a.b", true},
+		{"a.#", "a.b.c", true},
+		{"a.#", "ab", false},
+		{"a.#", "b.a", false},
+		{"+.b.#", "a.b", true},
+		{"+.b.#", "a.c.b", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.exp, MatchTopic(c.pattern, c.channel), "%q matches %q", c.pattern, c.channel)
+	}
+}
@@ -0,0 +1,29 @@
+package callee
+
+import (
+	"encoding/json"
+
+	"github.com/mna/juggler/message"
+)
+
+// Validator is implemented by the argument types that validate their
+// fields once decoded by DecodeArgs.
+type Validator interface {
+	Validate() error
+}
+
+// DecodeArgs decodes the JSON-encoded arguments of the call request cp
+// into v and, if v implements Validator, validates them. If the
+// arguments cannot be decoded or are invalid, it returns a *Error with
+// code 400, so that a Thunk can return it as is to the caller.
+func DecodeArgs(cp *message.CallPayload, v interface{}) error {
+	if err := json.Unmarshal(cp.Args, v); err != nil {
+		return &Error{Code: 400, Message: err.Error()}
+	}
+	if vv, ok := v.(Validator); ok {
+		if err := vv.Validate(); err != nil {
+			return &Error{Code: 400, Message: err.Error()}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package callee
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/mna/juggler/message"
+	"github.com/stretchr/testify/assert"
+)
+
+type testArgs struct {
+	Name string `json:"name"`
+}
+
+func (a *testArgs) Validate() error {
+	if a.Name == "" {
+		return errors.New("missing name")
+	}
+	return nil
+}
+
+func TestDecodeArgs(t *testing.T) {
+	cases := []struct {
+		args string
+		want string
+		err  string
+	}{
+		{`{"name":"a"}`, "a", ""},
+		{`{}`, "", "missing name"},
+		{`[1]`, "", "json: cannot unmarshal"},
+	}
+	for i, c := range cases {
+		var v testArgs
+		err := DecodeArgs(&message.CallPayload{Args: json.RawMessage(c.args)}, &v)
+		if c.err == "" {
+			assert.NoError(t, err, "%d", i)
+			assert.Equal(t, c.want, v.Name, "%d", i)
+			continue
+		}
+		if assert.IsType(t, &Error{}, err, "%d", i) {
+			assert.Equal(t, 400, err.(*Error).Code, "%d: code", i)
+			assert.Contains(t, err.Error(), c.err, "%d: message", i)
+		}
+	}
+}
@@ -1,7 +1,8 @@
 // Package callee implements the Callee type to use to listen for
 // and process RPC call requests. A callee listens to some URIs using
 // a broker.CalleeBroker, and stores the result of the calls so that
-// the broker can send it back to the calling client.
+// the broker can send it back to the calling client. The Pool type
+// processes the call requests with a number of concurrent workers.
 package callee
 
 import (
@@ -11,6 +12,7 @@ import (
 
 	"github.com/mna/juggler/broker"
 	"github.com/mna/juggler/message"
+	"golang.org/x/net/context"
 )
 
 // ErrCallExpired is returned when a call is processed but the
@@ -23,9 +25,39 @@ var ErrCallExpired = errors.New("juggler/callee: call expired")
 // to a URI. Generally, it should be used to decode the arguments
 // to the type expected by the actual underlying function, call that
 // strongly-typed function, and transfer the results back in the
-// generic empty interface.
+// generic empty interface. Use WithContext to write a Thunk as a
+// ContextThunk that can react to the expiration of the call.
 type Thunk func(*message.CallPayload) (interface{}, error)
 
+// ContextThunk is like a Thunk, but it also receives a context that
+// is cancelled when the call expires, so that long-running work can
+// be aborted as soon as the client no longer expects the result.
+type ContextThunk func(context.Context, *message.CallPayload) (interface{}, error)
+
+// WithContext returns a Thunk that calls fn with a context created
+// by CallContext for the call request. If the call is already expired,
+// fn is not called and ErrCallExpired is returned. The context is
+// cancelled when fn returns.
+func WithContext(fn ContextThunk) Thunk {
+	return func(cp *message.CallPayload) (interface{}, error) {
+		ctx, cancel := CallContext(context.Background(), cp)
+		defer cancel()
+		if ctx.Err() != nil {
+			return nil, ErrCallExpired
+		}
+		return fn(ctx, cp)
+	}
+}
+
+// CallContext returns a context derived from parent with a deadline
+// set to the expiration of the call cp, that is its TTLAfterRead after
+// its ReadTimestamp (or after now if ReadTimestamp is not set). The
+// returned cancel function should be called to release the resources
+// of the context once the call is processed.
+func CallContext(parent context.Context, cp *message.CallPayload) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, remainingTTL(cp))
+}
+
 // Callee is a peer that handles call requests for some URIs.
 type Callee struct {
 	// prevent unkeyed literals
@@ -34,16 +66,26 @@ type Callee struct {
 	// Broker is the callee broker to use to listen for call requests
 	// and to store results.
 	Broker broker.CalleeBroker
+
+	// Middleware, if set, wraps the Thunk of each call request processed
+	// by InvokeAndStoreResult and Listen. Use Chain to combine many
+	// middleware.
+	Middleware Middleware
 }
 
 // InvokeAndStoreResult processes the provided call payload by calling
 // fn and storing the result so that it can be sent back to the caller.
 // If the call timeout is exceeded, the result is dropped and
-// ErrCallExpired is returned.
+// ErrCallExpired is returned. If the Callee has a Middleware, fn is
+// wrapped by it.
 func (c *Callee) InvokeAndStoreResult(cp *message.CallPayload, fn Thunk) error {
 	ttl := cp.TTLAfterRead
 	start := time.Now()
 
+	if c.Middleware != nil {
+		fn = c.Middleware(fn)
+	}
+
 	v, err := fn(cp)
 	if remain := ttl - time.Now().Sub(start); remain > 0 {
 		// register the result
@@ -56,7 +98,13 @@ func (c *Callee) InvokeAndStoreResult(cp *message.CallPayload, fn Thunk) error {
 // requested URIs and calls the corresponding Thunk to execute the
 // request. The m map has URIs as keys, and the associated Thunk
 // function as value. If a redis cluster is used, all URIs in m
-// must belong to the same hash slot.
+// must belong to the same hash slot. If the broker supports prefix
+// routing, the keys of m can be prefix URIs (see broker.PrefixURIs),
+// and the Thunk of the most specific URI that matches a call request
+// is used. To route the calls based on URI patterns with parameters,
+// use a Router and pass its Thunks as m. If the calls connection
+// implements broker.AckCallsConn, each call request is acknowledged
+// once it is processed.
 //
 // The method implements a single-producer, single-consumer helper,
 // where a single redis connection is used to listen for call requests
@@ -88,12 +136,117 @@ func (c *Callee) Listen(m map[string]Thunk) error {
 
 	for cp := range conn.Calls() {
 		// errors are ignored, use InvokeAndStoreResult directly to handle them.
-		c.InvokeAndStoreResult(cp, m[cp.URI])
+		if fn := lookupThunk(m, cp.URI); fn != nil {
+			c.InvokeAndStoreResult(cp, fn)
+		}
+		if ac, ok := conn.(broker.AckCallsConn); ok {
+			ac.Ack(cp)
+		}
 	}
 	return conn.CallsErr()
 }
 
+// lookupThunk returns the Thunk of uri in m, or the Thunk of the most
+// specific prefix URI that matches uri if there is none, or nil.
+func lookupThunk(m map[string]Thunk, uri string) Thunk {
+	if fn, ok := m[uri]; ok {
+		return fn
+	}
+	for _, p := range broker.PrefixURIs(uri) {
+		if fn, ok := m[p]; ok {
+			return fn
+		}
+	}
+	return nil
+}
+
+// StoreResultChunk stores v as the chunk seq of the result of the
+// call cp, so that it is sent to the caller before the result itself.
+// This allows long-running calls to report progress or to send large
+// results in parts. The sequence numbers should start at 0 and be
+// incremented for each chunk. The result of the call must still be
+// stored (e.g. by InvokeAndStoreResult) to terminate the stream.
+//
+// The chunk expires with the call: if the call timeout is exceeded,
+// the chunk is dropped and ErrCallExpired is returned. It returns an
+// error if v cannot be marshaled to JSON.
+func (c *Callee) StoreResultChunk(cp *message.CallPayload, seq int, v interface{}) error {
+	remain := remainingTTL(cp)
+	if remain <= 0 {
+		return ErrCallExpired
+	}
+
+	rp, err := ResultChunkPayload(cp, seq, v)
+	if err != nil {
+		return err
+	}
+	return c.Broker.Result(rp, remain)
+}
+
+// remainingTTL returns the time left before the call cp expires.
+func remainingTTL(cp *message.CallPayload) time.Duration {
+	remain := cp.TTLAfterRead
+	if !cp.ReadTimestamp.IsZero() {
+		remain -= time.Now().Sub(cp.ReadTimestamp)
+	}
+	return remain
+}
+
 func (c *Callee) storeResult(cp *message.CallPayload, v interface{}, e error, timeout time.Duration) error {
+	rp, err := ResultPayload(cp, v, e)
+	if err != nil {
+		return err
+	}
+	return c.Broker.Result(rp, timeout)
+}
+
+// Error is an error that a Thunk can return to send a code and details
+// to the caller in addition to the error message.
+type Error struct {
+	Code    int
+	Message string
+	Details interface{} // marshaled to JSON
+}
+
+// Error returns the error message of e.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ResultChunkPayload creates the result payload for the chunk seq of
+// the result of the call cp, with v as value. If v is a []byte, the
+// Binary flag of the payload is set. It returns an error if v cannot
+// be marshaled to JSON.
+func ResultChunkPayload(cp *message.CallPayload, seq int, v interface{}) (*message.ResPayload, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &message.ResPayload{
+		ConnUUID: cp.ConnUUID,
+		MsgUUID:  cp.MsgUUID,
+		URI:      cp.URI,
+		Args:     b,
+		Chunk:    true,
+		Seq:      seq,
+		Binary:   isBytes(v),
+
+		CorrelationID: cp.CorrelationID,
+		Priority:      cp.Priority,
+		ResultsQueue:  cp.ResultsQueue,
+	}, nil
+}
+
+// ResultPayload creates the result payload for the call cp, given the
+// value v and error e returned by its Thunk. If e is not nil, it is
+// stored as result instead of v, either as-is if it implements
+// json.Marshaler, or as a message.ErrResult, and the Error flag of the
+// payload is set. If e is a *Error, its code and details are stored in
+// the ErrResult. Otherwise, if v is a []byte, the Binary flag of the
+// payload is set. It returns an error if the result cannot be marshaled
+// to JSON.
+func ResultPayload(cp *message.CallPayload, v interface{}, e error) (*message.ResPayload, error) {
 	// if there's an error, that's what gets stored
 	if e != nil {
 		if ms, ok := e.(json.Marshaler); ok {
@@ -101,20 +254,42 @@ func (c *Callee) storeResult(cp *message.CallPayload, v interface{}, e error, ti
 		} else {
 			var er message.ErrResult
 			er.Error.Message = e.Error()
+			if ce, ok := e.(*Error); ok {
+				er.Error.Code = ce.Code
+				if ce.Details != nil {
+					b, err := json.Marshal(ce.Details)
+					if err != nil {
+						return nil, err
+					}
+					er.Error.Details = b
+				}
+			}
 			v = er
 		}
 	}
 
 	b, err := json.Marshal(v)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	rp := &message.ResPayload{
+	return &message.ResPayload{
 		ConnUUID: cp.ConnUUID,
 		MsgUUID:  cp.MsgUUID,
 		URI:      cp.URI,
+		Error:    e != nil,
 		Args:     b,
-	}
-	return c.Broker.Result(rp, timeout)
+		Binary:   e == nil && isBytes(v),
+
+		CorrelationID: cp.CorrelationID,
+		Priority:      cp.Priority,
+		ResultsQueue:  cp.ResultsQueue,
+	}, nil
+}
+
+// isBytes returns true if v is a []byte, that is marshaled to JSON as
+// a base64 string.
+func isBytes(v interface{}) bool {
+	_, ok := v.([]byte)
+	return ok
 }
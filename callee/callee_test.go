@@ -11,6 +11,7 @@ import (
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 type mockCalleeBroker struct {
@@ -76,8 +77,8 @@ func TestCallee(t *testing.T) {
 
 	exp := []*message.ResPayload{
 		{ConnUUID: cuid, MsgUUID: brk.cps[0].MsgUUID, URI: "ok", Args: json.RawMessage(`"ok"`)},
-		{ConnUUID: cuid, MsgUUID: brk.cps[1].MsgUUID, URI: "err", Args: b},
-		{ConnUUID: cuid, MsgUUID: brk.cps[3].MsgUUID, URI: "err", Args: b},
+		{ConnUUID: cuid, MsgUUID: brk.cps[1].MsgUUID, URI: "err", Args: b, Error: true},
+		{ConnUUID: cuid, MsgUUID: brk.cps[3].MsgUUID, URI: "err", Args: b, Error: true},
 	}
 
 	cle := &Callee{Broker: brk}
@@ -89,3 +90,133 @@ func TestCallee(t *testing.T) {
 	assert.Equal(t, io.EOF, err, "Listen returns expected error")
 	assert.Equal(t, exp, brk.rps, "got expected results")
 }
+
+func TestResultPayloadError(t *testing.T) {
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{io.EOF, `{"error":{"message":"EOF"}}`},
+		{&Error{Message: "not found", Code: 404}, `{"error":{"message":"not found","code":404}}`},
+		{&Error{Message: "invalid", Code: 400, Details: map[string]string{"field": "name"}},
+			`{"error":{"message":"invalid","code":400,"details":{"field":"name"}}}`},
+	}
+	for i, c := range cases {
+		rp, err := ResultPayload(cp, "ignored", c.err)
+		require.NoError(t, err, "%d", i)
+		assert.True(t, rp.Error, "%d: Error flag", i)
+		assert.Equal(t, c.want, string(rp.Args), "%d: args", i)
+	}
+
+	rp, err := ResultPayload(cp, "ok", nil)
+	require.NoError(t, err, "no error")
+	assert.False(t, rp.Error, "no error: Error flag")
+}
+
+func TestStoreResultChunk(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	cle := &Callee{Broker: brk}
+	cp := &message.CallPayload{
+		ConnUUID:      uuid.NewRandom(),
+		MsgUUID:       uuid.NewRandom(),
+		URI:           "a",
+		TTLAfterRead:  time.Second,
+		ReadTimestamp: time.Now().UTC(),
+	}
+
+	require.NoError(t, cle.StoreResultChunk(cp, 0, "x"), "chunk 0")
+	require.NoError(t, cle.StoreResultChunk(cp, 1, 2), "chunk 1")
+	assert.Error(t, cle.StoreResultChunk(cp, 2, func() {}), "unmarshalable chunk")
+	exp := []*message.ResPayload{
+		{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: "a", Args: json.RawMessage(`"x"`), Chunk: true},
+		{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: "a", Args: json.RawMessage(`2`), Chunk: true, Seq: 1},
+	}
+	assert.Equal(t, exp, brk.rps, "got expected chunks")
+
+	cp.ReadTimestamp = time.Now().Add(-2 * time.Second)
+	assert.Equal(t, ErrCallExpired, cle.StoreResultChunk(cp, 3, "y"), "expired call")
+	assert.Equal(t, 2, len(brk.rps), "expired chunk is dropped")
+}
+
+func TestWithContext(t *testing.T) {
+	var called bool
+	fn := WithContext(func(ctx context.Context, cp *message.CallPayload) (interface{}, error) {
+		called = true
+		dl, ok := ctx.Deadline()
+		assert.True(t, ok, "has deadline")
+		assert.WithinDuration(t, cp.ReadTimestamp.Add(cp.TTLAfterRead), dl, 10*time.Millisecond, "deadline")
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+			return "late", nil
+		}
+	})
+
+	cp := &message.CallPayload{TTLAfterRead: 50 * time.Millisecond, ReadTimestamp: time.Now().UTC()}
+	start := time.Now()
+	v, err := fn(cp)
+	assert.Equal(t, context.DeadlineExceeded, err, "context error")
+	assert.Nil(t, v, "no result")
+	assert.True(t, called, "thunk called")
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "aborted early")
+
+	called = false
+	cp.ReadTimestamp = time.Now().Add(-time.Second)
+	_, err = fn(cp)
+	assert.Equal(t, ErrCallExpired, err, "expired call")
+	assert.False(t, called, "thunk not called")
+}
+
+func TestLookupThunk(t *testing.T) {
+	var exact, service, all bool
+	m := map[string]Thunk{
+		"billing.invoice.create": func(cp *message.CallPayload) (interface{}, error) { exact = true; return nil, nil },
+		"billing.*":              func(cp *message.CallPayload) (interface{}, error) { service = true; return nil, nil },
+	}
+
+	lookupThunk(m, "billing.invoice.create")(nil)
+	assert.True(t, exact, "exact URI")
+	lookupThunk(m, "billing.invoice.delete")(nil)
+	assert.True(t, service, "prefix URI")
+	assert.Nil(t, lookupThunk(m, "shipping.create"), "no match")
+
+	m["*"] = func(cp *message.CallPayload) (interface{}, error) { all = true; return nil, nil }
+	lookupThunk(m, "shipping.create")(nil)
+	assert.True(t, all, "catch-all URI")
+}
+
+type mockAckCallsConn struct {
+	mockCallsConn
+	acks []*message.CallPayload
+}
+
+func (c *mockAckCallsConn) Ack(cp *message.CallPayload) error {
+	c.acks = append(c.acks, cp)
+	return nil
+}
+
+type mockAckCalleeBroker struct {
+	mockCalleeBroker
+	conn *mockAckCallsConn
+}
+
+func (b *mockAckCalleeBroker) NewCallsConn(uris ...string) (broker.CallsConn, error) {
+	return b.conn, nil
+}
+
+func TestListenAck(t *testing.T) {
+	cps := []*message.CallPayload{
+		{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "ok", TTLAfterRead: time.Second},
+		{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "none", TTLAfterRead: time.Second},
+	}
+	brk := &mockAckCalleeBroker{conn: &mockAckCallsConn{mockCallsConn: mockCallsConn{cps: cps}}}
+	cle := &Callee{Broker: brk}
+	require.NoError(t, cle.Listen(map[string]Thunk{"ok": okThunk}), "Listen")
+
+	assert.Equal(t, cps, brk.conn.acks, "all calls are acknowledged")
+	assert.Len(t, brk.rps, 1, "results")
+}
@@ -0,0 +1,183 @@
+package callee
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// ErrCallerClosed is returned by the Caller's call methods when the
+// Caller is closed or its results connection failed.
+var ErrCallerClosed = errors.New("juggler/callee: caller closed")
+
+// Caller makes calls to juggler URIs from a callee, so that a Thunk
+// can invoke other URIs and use their results. It calls the URIs
+// directly via a broker.CallerBroker, without a websocket connection,
+// and receives the results using a single results connection
+// identified by a random UUID. It is safe for concurrent use, and
+// can be shared by all thunks of a callee.
+type Caller struct {
+	broker broker.CallerBroker
+	uuid   uuid.UUID
+	conn   broker.ResultsConn
+
+	mu      sync.Mutex
+	pending map[string]chan *message.ResPayload
+	err     error // set once the results loop stopped
+}
+
+// NewCaller returns a Caller that uses b to make calls and to receive
+// their results. It should be closed when it is no longer needed.
+func NewCaller(b broker.CallerBroker) (*Caller, error) {
+	id := uuid.NewRandom()
+	conn, err := b.NewResultsConn(id)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Caller{
+		broker:  b,
+		uuid:    id,
+		conn:    conn,
+		pending: make(map[string]chan *message.ResPayload),
+	}
+	go c.results()
+	return c, nil
+}
+
+// Close closes the results connection of the Caller. Pending calls
+// fail with ErrCallerClosed.
+func (c *Caller) Close() error {
+	return c.conn.Close()
+}
+
+// Call calls uri with the JSON-encoded v value as arguments, on behalf
+// of the call request parent that is being processed by a Thunk. The
+// call has the correlation ID and priority of parent, and its timeout
+// is the time-to-live remaining for parent, so that the result is
+// received while the result of parent can still be stored. It returns
+// ErrCallExpired if parent has expired or if the result is not received
+// before its timeout. See CallTimeout for the returned values.
+func (c *Caller) Call(parent *message.CallPayload, uri string, v interface{}) (json.RawMessage, error) {
+	ttl := parent.TTLAfterRead
+	if !parent.ReadTimestamp.IsZero() {
+		ttl -= time.Now().UTC().Sub(parent.ReadTimestamp)
+	}
+	if ttl <= 0 {
+		return nil, ErrCallExpired
+	}
+	return c.call(uri, v, ttl, parent.CorrelationID, parent.Priority)
+}
+
+// CallTimeout calls uri with the JSON-encoded v value as arguments,
+// and waits for its result for at most timeout. It returns the
+// JSON-encoded result, or ErrCallExpired if the result is not received
+// before the timeout. If the callee of uri returned an error, it
+// returns that error as an *Error, so that a Thunk can return it
+// as-is to forward it to its own caller.
+func (c *Caller) CallTimeout(uri string, v interface{}, timeout time.Duration) (json.RawMessage, error) {
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	return c.call(uri, v, timeout, "", 0)
+}
+
+func (c *Caller) call(uri string, v interface{}, timeout time.Duration, corrID string, priority int) (json.RawMessage, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	cp := &message.CallPayload{
+		ConnUUID:      c.uuid,
+		MsgUUID:       uuid.NewRandom(),
+		URI:           uri,
+		Args:          b,
+		CorrelationID: corrID,
+		Priority:      priority,
+	}
+	key := cp.MsgUUID.String()
+
+	// register the pending call before making the call, as the result
+	// may be received before Call returns.
+	ch := make(chan *message.ResPayload, 1)
+	c.mu.Lock()
+	if err := c.err; err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.pending[key] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, key)
+		c.mu.Unlock()
+	}()
+
+	if err := c.broker.Call(cp, timeout); err != nil {
+		return nil, err
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case rp, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			err := c.err
+			c.mu.Unlock()
+			return nil, err
+		}
+		if rp.Error {
+			return nil, resultError(rp.Args)
+		}
+		return rp.Args, nil
+	case <-t.C:
+		return nil, ErrCallExpired
+	}
+}
+
+// results is the loop that receives the results of the calls and
+// sends them to the pending calls.
+func (c *Caller) results() {
+	for rp := range c.conn.Results() {
+		c.mu.Lock()
+		ch := c.pending[rp.MsgUUID.String()]
+		c.mu.Unlock()
+
+		// drop the result if the call expired already
+		if ch != nil {
+			select {
+			case ch <- rp:
+			default:
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = ErrCallerClosed
+	for k, ch := range c.pending {
+		close(ch)
+		delete(c.pending, k)
+	}
+}
+
+// resultError returns the *Error corresponding to the JSON-encoded
+// error result args.
+func resultError(args json.RawMessage) *Error {
+	var er message.ErrResult
+	if err := json.Unmarshal(args, &er); err != nil || er.Error.Message == "" {
+		// custom error payload, return it as details
+		return &Error{Message: "juggler/callee: call failed", Details: args}
+	}
+	e := &Error{Code: er.Error.Code, Message: er.Error.Message}
+	if len(er.Error.Details) > 0 {
+		e.Details = er.Error.Details
+	}
+	return e
+}
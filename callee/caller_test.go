@@ -0,0 +1,105 @@
+package callee
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockCallerBroker executes the calls with the thunks, and sends the
+// results on its results connection.
+type mockCallerBroker struct {
+	thunks map[string]Thunk
+	conn   *mockResultsConn
+	cps    chan *message.CallPayload
+}
+
+func (b *mockCallerBroker) NewResultsConn(connUUID uuid.UUID) (broker.ResultsConn, error) {
+	b.conn = &mockResultsConn{ch: make(chan *message.ResPayload)}
+	return b.conn, nil
+}
+
+func (b *mockCallerBroker) Call(cp *message.CallPayload, timeout time.Duration) error {
+	b.cps <- cp
+	fn, ok := b.thunks[cp.URI]
+	if !ok {
+		// no callee, the call expires
+		return nil
+	}
+	go func() {
+		v, err := fn(cp)
+		rp, _ := ResultPayload(cp, v, err)
+		b.conn.ch <- rp
+	}()
+	return nil
+}
+
+type mockResultsConn struct {
+	ch chan *message.ResPayload
+}
+
+func (c *mockResultsConn) Results() <-chan *message.ResPayload { return c.ch }
+func (c *mockResultsConn) ResultsErr() error                   { return io.EOF }
+func (c *mockResultsConn) Close() error {
+	close(c.ch)
+	return nil
+}
+
+func TestCaller(t *testing.T) {
+	brk := &mockCallerBroker{
+		thunks: map[string]Thunk{
+			"ok": okThunk,
+			"err": func(cp *message.CallPayload) (interface{}, error) {
+				return nil, &Error{Code: 404, Message: "not found", Details: "x"}
+			},
+		},
+		cps: make(chan *message.CallPayload, 10),
+	}
+	c, err := NewCaller(brk)
+	require.NoError(t, err, "NewCaller")
+
+	res, err := c.CallTimeout("ok", nil, time.Second)
+	require.NoError(t, err, "CallTimeout ok")
+	assert.Equal(t, `"ok"`, string(res), "result")
+	<-brk.cps
+
+	_, err = c.CallTimeout("err", nil, time.Second)
+	if assert.Error(t, err, "CallTimeout err") {
+		assert.Equal(t, &Error{Code: 404, Message: "not found", Details: json.RawMessage(`"x"`)}, err, "error")
+	}
+	<-brk.cps
+
+	_, err = c.CallTimeout("none", nil, 10*time.Millisecond)
+	assert.Equal(t, ErrCallExpired, err, "CallTimeout expired")
+	<-brk.cps
+
+	// the call on behalf of a parent call uses its remaining TTL
+	parent := &message.CallPayload{
+		CorrelationID: "corr",
+		Priority:      1,
+		TTLAfterRead:  time.Second,
+		ReadTimestamp: time.Now().UTC(),
+	}
+	res, err = c.Call(parent, "ok", nil)
+	require.NoError(t, err, "Call ok")
+	assert.Equal(t, `"ok"`, string(res), "parent result")
+	cp := <-brk.cps
+	assert.Equal(t, "corr", cp.CorrelationID, "correlation ID")
+	assert.Equal(t, 1, cp.Priority, "priority")
+
+	parent.ReadTimestamp = parent.ReadTimestamp.Add(-time.Second)
+	_, err = c.Call(parent, "ok", nil)
+	assert.Equal(t, ErrCallExpired, err, "parent expired")
+
+	require.NoError(t, c.Close(), "Close")
+	time.Sleep(10 * time.Millisecond)
+	_, err = c.CallTimeout("ok", nil, time.Second)
+	assert.Equal(t, ErrCallerClosed, err, "closed")
+}
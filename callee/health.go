@@ -0,0 +1,144 @@
+package callee
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/pborman/uuid"
+)
+
+// DefaultHealthInterval is the default interval between the heartbeats
+// of a Health, if its Interval is not set.
+const DefaultHealthInterval = 5 * time.Second
+
+// ErrHealthStarted is returned by Health.Start if the Health is
+// already started or was closed.
+var ErrHealthStarted = errors.New("juggler/callee: health already started or closed")
+
+// Health registers a callee instance in the registry of live callees
+// of a broker.HealthBroker, and refreshes its entry with a heartbeat
+// until it is closed, so that the live callees can be listed (e.g.
+// with the juggler-callee -list flag) and that the servers can reject
+// the calls to URIs that no callee serves (see
+// juggler.Server.CalleeHealth).
+type Health struct {
+	// prevent unkeyed literals
+	_ struct{}
+
+	// Broker is the broker used to register the callee. It must be set.
+	Broker broker.HealthBroker
+
+	// ID identifies the callee instance. If it is empty, a random UUID
+	// is set by Start.
+	ID string
+
+	// URIs is the list of URIs served by the callee, e.g. the keys of
+	// the map of Thunks passed to Listen. A callee that listens to the
+	// shards of a sharded URI should list the URI itself.
+	URIs []string
+
+	// Workers is the number of concurrent workers of the callee, as
+	// set on its Pool.
+	Workers int
+
+	// Interval is the interval between the heartbeats. If it is 0,
+	// DefaultHealthInterval is used.
+	Interval time.Duration
+
+	// TTL is the time-to-live of the callee's entry, after which it
+	// is considered dead if it did not send a heartbeat. It should be
+	// a few times the Interval. If it is 0, 3 times the Interval is
+	// used.
+	TTL time.Duration
+
+	// ErrFunc, if set, is called with the error of each heartbeat that
+	// fails. The heartbeats are retried at the next interval.
+	ErrFunc func(error)
+
+	mu      sync.Mutex
+	started bool
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func (h *Health) interval() time.Duration {
+	if h.Interval > 0 {
+		return h.Interval
+	}
+	return DefaultHealthInterval
+}
+
+func (h *Health) ttl() time.Duration {
+	if h.TTL > 0 {
+		return h.TTL
+	}
+	return 3 * h.interval()
+}
+
+func (h *Health) info() *broker.CalleeInfo {
+	return &broker.CalleeInfo{ID: h.ID, URIs: h.URIs, Workers: h.Workers}
+}
+
+// Start registers the callee and starts sending its heartbeats in a
+// separate goroutine, until Close is called. It returns the error of
+// the initial registration, in which case the heartbeats are not
+// started. It returns ErrHealthStarted if it is called more than once.
+func (h *Health) Start() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.started {
+		return ErrHealthStarted
+	}
+	if h.ID == "" {
+		h.ID = uuid.NewRandom().String()
+	}
+	if err := h.Broker.RegisterCallee(h.info(), h.ttl()); err != nil {
+		return err
+	}
+	h.started = true
+	h.closing = make(chan struct{})
+	h.done = make(chan struct{})
+	go h.heartbeat(h.closing, h.done)
+	return nil
+}
+
+// heartbeat refreshes the callee's entry every Interval until the
+// closing channel is closed, and then closes done.
+func (h *Health) heartbeat(closing, done chan struct{}) {
+	defer close(done)
+
+	t := time.NewTicker(h.interval())
+	defer t.Stop()
+	for {
+		select {
+		case <-closing:
+			return
+		case <-t.C:
+			if err := h.Broker.RegisterCallee(h.info(), h.ttl()); err != nil && h.ErrFunc != nil {
+				h.ErrFunc(err)
+			}
+		}
+	}
+}
+
+// Close stops the heartbeats and removes the callee's entry from the
+// registry, so that it is not considered live anymore. It returns the
+// error of removing the entry. It is a no-op if the Health is not
+// started or is already closed.
+func (h *Health) Close() error {
+	h.mu.Lock()
+	if !h.started || h.closing == nil {
+		h.mu.Unlock()
+		return nil
+	}
+	close(h.closing)
+	h.closing = nil
+	done := h.done
+	h.mu.Unlock()
+
+	<-done
+	return h.Broker.UnregisterCallee(h.ID)
+}
@@ -0,0 +1,35 @@
+package callee
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker/inmembroker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	brk := &inmembroker.Broker{}
+	h := &Health{Broker: brk, URIs: []string{"a", "b"}, Workers: 2, Interval: 10 * time.Millisecond}
+	require.NoError(t, h.Start(), "Start")
+	assert.Equal(t, ErrHealthStarted, h.Start(), "Start twice")
+	assert.NotEmpty(t, h.ID, "random ID")
+
+	// the heartbeats keep the entry alive past its TTL
+	time.Sleep(50 * time.Millisecond)
+	infos, err := brk.Callees()
+	require.NoError(t, err, "Callees")
+	if assert.Equal(t, 1, len(infos), "1 live callee") {
+		assert.Equal(t, h.ID, infos[0].ID, "ID")
+		assert.Equal(t, []string{"a", "b"}, infos[0].URIs, "URIs")
+		assert.Equal(t, 2, infos[0].Workers, "Workers")
+		assert.WithinDuration(t, time.Now(), infos[0].LastSeen, 20*time.Millisecond, "LastSeen")
+	}
+
+	require.NoError(t, h.Close(), "Close")
+	assert.NoError(t, h.Close(), "Close twice")
+	infos, err = brk.Callees()
+	require.NoError(t, err, "Callees after Close")
+	assert.Empty(t, infos, "no live callee")
+}
@@ -0,0 +1,128 @@
+package callee
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+)
+
+// Middleware wraps a Thunk to add behaviour around the processing of
+// the call requests, e.g. logging or panic recovery.
+type Middleware func(Thunk) Thunk
+
+// Chain returns a Middleware that applies the provided middleware in
+// order, so that the first one is the outermost: it is the first to
+// see the call request and the last to see the result.
+func Chain(mws ...Middleware) Middleware {
+	return func(fn Thunk) Thunk {
+		for i := len(mws) - 1; i >= 0; i-- {
+			fn = mws[i](fn)
+		}
+		return fn
+	}
+}
+
+// Log returns a Middleware that logs the call requests and their
+// results to the provided logger function. The correlation ID of the
+// call is logged in brackets.
+func Log(logFn func(string, ...interface{})) Middleware {
+	return func(fn Thunk) Thunk {
+		return func(cp *message.CallPayload) (interface{}, error) {
+			logFn("received call %v %s [%s]", cp.MsgUUID, cp.URI, cp.CorrelationID)
+			start := time.Now()
+			v, err := fn(cp)
+			if err != nil {
+				logFn("call %v %s failed after %v: %v [%s]", cp.MsgUUID, cp.URI, time.Since(start), err, cp.CorrelationID)
+			} else {
+				logFn("call %v %s succeeded after %v [%s]", cp.MsgUUID, cp.URI, time.Since(start), cp.CorrelationID)
+			}
+			return v, err
+		}
+	}
+}
+
+// PanicRecover returns a Middleware that recovers from panics that may
+// happen in the Thunk, and returns them as error so that the caller
+// receives an error result. If a non-nil vars is passed as parameter,
+// the RecoveredPanics counter is incremented for each panic.
+func PanicRecover(vars metrics.Sink) Middleware {
+	vars = metrics.Or(vars)
+	return func(fn Thunk) Thunk {
+		return func(cp *message.CallPayload) (v interface{}, err error) {
+			defer func() {
+				if e := recover(); e != nil {
+					vars.Add("RecoveredPanics", 1)
+
+					switch e := e.(type) {
+					case error:
+						err = e
+					default:
+						err = fmt.Errorf("%v", e)
+					}
+					v = nil
+				}
+			}()
+			return fn(cp)
+		}
+	}
+}
+
+// Metrics returns a Middleware that collects metrics about the calls
+// in vars: the ThunkCalls and FailedThunkCalls counters, and the
+// ThunkDuration distribution of the execution times, in microseconds
+// (see metrics.Observe).
+func Metrics(vars metrics.Sink) Middleware {
+	vars = metrics.Or(vars)
+	return func(fn Thunk) Thunk {
+		return func(cp *message.CallPayload) (interface{}, error) {
+			start := time.Now()
+			v, err := fn(cp)
+			metrics.Observe(vars, "ThunkDuration", int64(time.Since(start)/time.Microsecond))
+			metrics.AddExemplar(vars, "ThunkCalls", 1, cp.CorrelationID)
+			if err != nil {
+				metrics.AddExemplar(vars, "FailedThunkCalls", 1, cp.CorrelationID)
+			}
+			return v, err
+		}
+	}
+}
+
+// Timeout returns a Middleware that returns ErrCallExpired if the Thunk
+// does not return before the call expires, or before max if it is
+// greater than 0 and the call expires later. The Thunk keeps running
+// in its own goroutine, but its result is dropped, so it should not
+// have side effects that are unsafe to abandon.
+func Timeout(max time.Duration) Middleware {
+	return func(fn Thunk) Thunk {
+		return func(cp *message.CallPayload) (interface{}, error) {
+			to := remainingTTL(cp)
+			if to <= 0 {
+				return nil, ErrCallExpired
+			}
+			if max > 0 && max < to {
+				to = max
+			}
+
+			type result struct {
+				v   interface{}
+				err error
+			}
+			ch := make(chan result, 1)
+			go func() {
+				v, err := fn(cp)
+				ch <- result{v, err}
+			}()
+
+			t := time.NewTimer(to)
+			defer t.Stop()
+			select {
+			case res := <-ch:
+				return res.v, res.err
+			case <-t.C:
+				return nil, ErrCallExpired
+			}
+		}
+	}
+}
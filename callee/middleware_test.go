@@ -0,0 +1,138 @@
+package callee
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(fn Thunk) Thunk {
+			return func(cp *message.CallPayload) (interface{}, error) {
+				order = append(order, name)
+				return fn(cp)
+			}
+		}
+	}
+
+	fn := Chain(mw("a"), mw("b"), mw("c"))(okThunk)
+	v, err := fn(&message.CallPayload{})
+	require.NoError(t, err, "call")
+	assert.Equal(t, "ok", v, "result")
+	assert.Equal(t, []string{"a", "b", "c"}, order, "middleware order")
+
+	v, err = Chain()(okThunk)(&message.CallPayload{})
+	require.NoError(t, err, "empty chain")
+	assert.Equal(t, "ok", v, "empty chain result")
+}
+
+func TestLog(t *testing.T) {
+	var lines []string
+	logFn := func(f string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(f, args...))
+	}
+
+	cp := &message.CallPayload{MsgUUID: uuid.NewRandom(), URI: "a", CorrelationID: "cid"}
+	_, err := Log(logFn)(errThunk)(cp)
+	assert.Equal(t, io.ErrUnexpectedEOF, err, "error")
+	if assert.Len(t, lines, 2, "logged lines") {
+		assert.Contains(t, lines[0], "received call", "first line")
+		assert.Contains(t, lines[1], io.ErrUnexpectedEOF.Error(), "second line")
+		assert.Contains(t, lines[1], "[cid]", "correlation ID")
+	}
+}
+
+func TestPanicRecover(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	panicThunk := func(cp *message.CallPayload) (interface{}, error) {
+		panic("boom")
+	}
+	errPanicThunk := func(cp *message.CallPayload) (interface{}, error) {
+		panic(io.EOF)
+	}
+
+	v, err := PanicRecover(vars)(panicThunk)(&message.CallPayload{})
+	assert.Nil(t, v, "value")
+	if assert.Error(t, err, "panic") {
+		assert.Equal(t, "boom", err.Error(), "error message")
+	}
+	_, err = PanicRecover(vars)(errPanicThunk)(&message.CallPayload{})
+	assert.Equal(t, io.EOF, err, "panic with error")
+	_, err = PanicRecover(nil)(okThunk)(&message.CallPayload{})
+	assert.NoError(t, err, "no panic")
+
+	assert.Equal(t, "2", vars.Get("RecoveredPanics").String(), "RecoveredPanics")
+}
+
+func TestMetrics(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	fn := Metrics(vars)
+
+	fn(okThunk)(&message.CallPayload{})
+	fn(okThunk)(&message.CallPayload{})
+	fn(errThunk)(&message.CallPayload{})
+
+	assert.Equal(t, "3", vars.Get("ThunkCalls").String(), "ThunkCalls")
+	assert.Equal(t, "1", vars.Get("FailedThunkCalls").String(), "FailedThunkCalls")
+	assert.NotNil(t, vars.Get("ThunkDuration"), "ThunkDuration")
+}
+
+func TestTimeout(t *testing.T) {
+	slowThunk := func(cp *message.CallPayload) (interface{}, error) {
+		time.Sleep(100 * time.Millisecond)
+		return "slow", nil
+	}
+	newCall := func(ttl time.Duration) *message.CallPayload {
+		return &message.CallPayload{ReadTimestamp: time.Now(), TTLAfterRead: ttl}
+	}
+
+	cases := []struct {
+		fn  Thunk
+		ttl time.Duration
+		max time.Duration
+		v   interface{}
+		err error
+	}{
+		{okThunk, time.Second, 0, "ok", nil},
+		{errThunk, time.Second, 0, nil, io.ErrUnexpectedEOF},
+		{slowThunk, time.Second, 0, "slow", nil},
+		{slowThunk, 10 * time.Millisecond, 0, nil, ErrCallExpired},
+		{slowThunk, time.Second, 10 * time.Millisecond, nil, ErrCallExpired},
+		{slowThunk, 10 * time.Millisecond, time.Second, nil, ErrCallExpired},
+		{okThunk, 0, time.Second, nil, ErrCallExpired},
+	}
+	for i, c := range cases {
+		v, err := Timeout(c.max)(c.fn)(newCall(c.ttl))
+		assert.Equal(t, c.v, v, "%d: value", i)
+		assert.True(t, errors.Is(err, c.err), "%d: expected error %v, got %v", i, c.err, err)
+	}
+}
+
+func TestCalleeMiddleware(t *testing.T) {
+	brk := &mockCalleeBroker{}
+	var n int
+	cle := &Callee{
+		Broker: brk,
+		Middleware: func(fn Thunk) Thunk {
+			return func(cp *message.CallPayload) (interface{}, error) {
+				n++
+				return fn(cp)
+			}
+		},
+	}
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a", TTLAfterRead: time.Second}
+	require.NoError(t, cle.InvokeAndStoreResult(cp, okThunk), "InvokeAndStoreResult")
+	assert.Equal(t, 1, n, "middleware called")
+	assert.Len(t, brk.rps, 1, "result stored")
+}
@@ -0,0 +1,251 @@
+package callee
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+)
+
+// ErrPoolListening is returned by Pool.Listen if the Pool is already
+// listening or was closed.
+var ErrPoolListening = errors.New("juggler/callee: pool already listening or closed")
+
+// Pool processes the call requests received by a Callee with a number
+// of concurrent workers. The call requests are read from the broker
+// only when a worker is available or there is room in the queue of
+// pending calls, so that a busy callee leaves the other requests in
+// the broker for the other callees (backpressure).
+//
+// The call requests with a priority > 0 are queued separately, and an
+// available worker always processes the pending high-priority calls
+// before the others, so that they are not stuck behind the batch work
+// already read from the broker.
+type Pool struct {
+	// prevent unkeyed literals
+	_ struct{}
+
+	// Callee is the callee used to process the call requests. It must
+	// be set.
+	Callee *Callee
+
+	// Workers is the number of concurrent workers that process the
+	// call requests. If it is <= 0, a single worker is used.
+	Workers int
+
+	// QueueSize is the number of call requests read from the broker
+	// and waiting for a worker, for each of the normal and the
+	// high-priority queues. The default of 0 means that a call request
+	// is read only when a worker is available.
+	QueueSize int
+
+	// URILimits sets the maximum number of concurrent calls for some
+	// URIs. A worker that receives a call request for a URI that is
+	// at its limit waits until a call for that URI completes. URIs not
+	// in the map are only limited by the number of workers.
+	URILimits map[string]int
+
+	// Done, if set, is called by the worker once a call request is
+	// processed, with the error returned by InvokeAndStoreResult. It
+	// is not called for call requests with no Thunk.
+	Done func(cp *message.CallPayload, err error)
+
+	mu      sync.Mutex
+	started bool
+	closing chan struct{}
+	done    chan struct{}
+	err     error // error of closing the calls connection
+}
+
+// ListenN is a helper method that listens for call requests for the
+// URIs of m and processes them with the specified number of
+// concurrent workers. See Listen and Pool for details.
+func (c *Callee) ListenN(m map[string]Thunk, workers int) error {
+	p := &Pool{Callee: c, Workers: workers}
+	return p.Listen(m)
+}
+
+func (p *Pool) init() {
+	if p.closing == nil {
+		p.closing = make(chan struct{})
+		p.done = make(chan struct{})
+	}
+}
+
+// Listen listens for call requests for the URIs of m and processes
+// them with the Pool's workers, as Callee.Listen does. It blocks until
+// the Pool is closed or the calls connection fails, and returns the
+// error of the calls connection, or nil if the Pool was closed. It
+// returns ErrPoolListening if it is called more than once.
+func (p *Pool) Listen(m map[string]Thunk) error {
+	p.mu.Lock()
+	p.init()
+	if p.started {
+		p.mu.Unlock()
+		return ErrPoolListening
+	}
+	p.started = true
+	p.mu.Unlock()
+	defer close(p.done)
+
+	if len(m) == 0 {
+		return nil
+	}
+
+	uris := make([]string, 0, len(m))
+	for k := range m {
+		uris = append(uris, k)
+	}
+	conn, err := p.Callee.Broker.NewCallsConn(uris...)
+	if err != nil {
+		return err
+	}
+
+	sems := make(map[string]chan struct{}, len(p.URILimits))
+	for uri, n := range p.URILimits {
+		if n > 0 {
+			sems[uri] = make(chan struct{}, n)
+		}
+	}
+
+	n := p.Workers
+	if n <= 0 {
+		n = 1
+	}
+	queue := make(chan *message.CallPayload, p.QueueSize)
+	high := make(chan *message.CallPayload, p.QueueSize)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			p.work(conn, high, queue, m, sems)
+		}()
+	}
+
+	closed := p.dispatch(conn.Calls(), high, queue)
+	close(high)
+	close(queue)
+	wg.Wait()
+
+	// close the calls connection only once the queued calls are
+	// processed and acknowledged.
+	err = conn.Close()
+	p.mu.Lock()
+	p.err = err
+	p.mu.Unlock()
+	if closed {
+		return nil
+	}
+	return conn.CallsErr()
+}
+
+// Close stops reading call requests and waits for the pending calls
+// to be processed, so that their results are stored before the calls
+// connection is closed. It returns the error of closing the calls
+// connection.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	p.init()
+	select {
+	case <-p.closing:
+	default:
+		close(p.closing)
+	}
+	started := p.started
+	p.mu.Unlock()
+
+	if !started {
+		return nil
+	}
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// dispatch sends the call requests received on calls to the high
+// queue if they have a priority > 0, to the queue otherwise, until the
+// calls channel is closed or the Pool is closed. It returns true if
+// the Pool was closed.
+func (p *Pool) dispatch(calls <-chan *message.CallPayload, high, queue chan<- *message.CallPayload) bool {
+	for {
+		select {
+		case <-p.closing:
+			return true
+		case cp, ok := <-calls:
+			if !ok {
+				return false
+			}
+			// always queue a received call, the workers are running so
+			// it eventually gets processed.
+			if cp.Priority > 0 {
+				high <- cp
+			} else {
+				queue <- cp
+			}
+		}
+	}
+}
+
+// next returns the next call request to process, from the high queue
+// if one is pending, or from the first of the high queue and the
+// queue to receive one. The queues are set to nil once closed, and
+// it returns nil when both are closed.
+func next(high, queue *<-chan *message.CallPayload) *message.CallPayload {
+	for *high != nil || *queue != nil {
+		select {
+		case cp, ok := <-*high:
+			if ok {
+				return cp
+			}
+			*high = nil
+			continue
+		default:
+		}
+
+		select {
+		case cp, ok := <-*high:
+			if ok {
+				return cp
+			}
+			*high = nil
+		case cp, ok := <-*queue:
+			if ok {
+				return cp
+			}
+			*queue = nil
+		}
+	}
+	return nil
+}
+
+// work processes the call requests received on the high queue and the
+// queue until both are closed, the high-priority ones first.
+func (p *Pool) work(conn broker.CallsConn, high, queue <-chan *message.CallPayload, m map[string]Thunk, sems map[string]chan struct{}) {
+	ac, _ := conn.(broker.AckCallsConn)
+	for {
+		cp := next(&high, &queue)
+		if cp == nil {
+			return
+		}
+		if fn := lookupThunk(m, cp.URI); fn != nil {
+			sem := sems[cp.URI]
+			if sem != nil {
+				sem <- struct{}{}
+			}
+			err := p.Callee.InvokeAndStoreResult(cp, fn)
+			if sem != nil {
+				<-sem
+			}
+			if p.Done != nil {
+				p.Done(cp, err)
+			}
+		}
+		if ac != nil {
+			ac.Ack(cp)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package callee
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker/inmembroker"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool(t *testing.T) {
+	brk := &inmembroker.Broker{}
+
+	var mu sync.Mutex
+	var cur, max, curSlow, maxSlow int
+	thunk := func(slow bool) Thunk {
+		return func(cp *message.CallPayload) (interface{}, error) {
+			mu.Lock()
+			cur++
+			if cur > max {
+				max = cur
+			}
+			if slow {
+				curSlow++
+				if curSlow > maxSlow {
+					maxSlow = curSlow
+				}
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			cur--
+			if slow {
+				curSlow--
+			}
+			mu.Unlock()
+			return "ok", nil
+		}
+	}
+
+	done := make(chan string, 20)
+	p := &Pool{
+		Callee:    &Callee{Broker: brk},
+		Workers:   3,
+		QueueSize: 2,
+		URILimits: map[string]int{"slow": 1},
+		Done: func(cp *message.CallPayload, err error) {
+			assert.NoError(t, err, "InvokeAndStoreResult")
+			done <- cp.URI
+		},
+	}
+	m := map[string]Thunk{"slow": thunk(true), "fast": thunk(false)}
+	errc := make(chan error, 1)
+	go func() { errc <- p.Listen(m) }()
+
+	call := func(uri string) {
+		cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: uri}
+		require.NoError(t, brk.Call(cp, time.Second), "Call")
+	}
+	for i := 0; i < 4; i++ {
+		call("slow")
+		call("fast")
+		call("fast")
+	}
+	for i := 0; i < 12; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			require.FailNow(t, "calls not processed")
+		}
+	}
+
+	mu.Lock()
+	assert.Equal(t, 1, maxSlow, "max concurrent slow calls")
+	assert.True(t, max > 1 && max <= 3, "max concurrent calls: %d", max)
+	mu.Unlock()
+
+	// the calls read before Close are processed
+	for i := 0; i < 3; i++ {
+		call("slow")
+	}
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, p.Close(), "Close")
+	assert.NoError(t, <-errc, "Listen")
+	mu.Lock()
+	assert.Equal(t, 0, cur, "no call in progress after Close")
+	mu.Unlock()
+	assert.Equal(t, ErrPoolListening, p.Listen(m), "Listen after Close")
+}
+
+func TestPoolNextPriority(t *testing.T) {
+	hc := make(chan *message.CallPayload, 2)
+	qc := make(chan *message.CallPayload, 2)
+	normal := &message.CallPayload{URI: "normal"}
+	high := &message.CallPayload{URI: "high", Priority: 1}
+	qc <- normal
+	hc <- high
+	close(hc)
+	close(qc)
+
+	var h, q <-chan *message.CallPayload = hc, qc
+	assert.Equal(t, high, next(&h, &q), "high priority call first")
+	assert.Equal(t, normal, next(&h, &q), "then normal call")
+	assert.Nil(t, next(&h, &q), "no more calls")
+	assert.Nil(t, h, "high queue closed")
+	assert.Nil(t, q, "queue closed")
+}
@@ -0,0 +1,276 @@
+package callee
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mna/juggler/message"
+)
+
+// ErrNoRoute is returned by Router.Call when no route matches the URI
+// of the call request.
+var ErrNoRoute = errors.New("juggler/callee: no route for URI")
+
+// Params holds the parameters extracted from the URI of a call request
+// by a Router, by name.
+type Params map[string]string
+
+// ParamThunk is a Thunk that also receives the parameters extracted
+// from the URI of the call request.
+type ParamThunk func(cp *message.CallPayload, params Params) (interface{}, error)
+
+// Router routes the call requests to Thunks based on URI patterns,
+// similar to an HTTP mux for RPC URIs. A pattern is a dot-separated
+// URI where each segment can be a literal, "*" to match any segment,
+// or "{name}" to match any segment and extract it as the parameter
+// name. For example, "user.*.profile" matches "user.42.profile", and
+// "order.{id}.status" matches "order.42.status" with the id parameter
+// set to "42". Each wildcard or parameter matches exactly one segment.
+//
+// If many patterns match a URI, the most specific one is used: the
+// patterns are compared segment by segment, and a literal segment is
+// more specific than a wildcard or parameter.
+//
+// The Router is safe for concurrent use. The zero value is an empty
+// Router ready to use.
+type Router struct {
+	mu     sync.RWMutex
+	exact  map[string]*route
+	routes []*route // patterns with wildcards
+}
+
+type route struct {
+	pattern string
+	segs    []string
+	names   []string // name of the parameter of each segment, if any
+	wild    []bool   // true if the segment is a wildcard or parameter
+	fn      ParamThunk
+}
+
+// Handle registers fn to handle the calls to the URIs that match
+// pattern. It panics if the pattern is invalid or if a pattern that
+// matches the same URIs is already registered.
+func (r *Router) Handle(pattern string, fn Thunk) {
+	r.HandleParams(pattern, func(cp *message.CallPayload, _ Params) (interface{}, error) {
+		return fn(cp)
+	})
+}
+
+// HandleParams registers fn to handle the calls to the URIs that match
+// pattern, with the parameters extracted from the URI. It panics if
+// the pattern is invalid or if a pattern that matches the same URIs is
+// already registered.
+func (r *Router) HandleParams(pattern string, fn ParamThunk) {
+	rt, err := parsePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	rt.fn = fn
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, other := range r.routes {
+		if sameShape(rt, other) {
+			panic(fmt.Sprintf("juggler/callee: pattern %q conflicts with %q", pattern, other.pattern))
+		}
+	}
+	if !rt.hasWildcard() {
+		if r.exact == nil {
+			r.exact = make(map[string]*route)
+		}
+		if _, ok := r.exact[pattern]; ok {
+			panic(fmt.Sprintf("juggler/callee: pattern %q already registered", pattern))
+		}
+		r.exact[pattern] = rt
+		return
+	}
+
+	r.routes = append(r.routes, rt)
+}
+
+// Match returns the ParamThunk of the most specific pattern that
+// matches uri, along with the extracted parameters. It returns nil if
+// no pattern matches.
+func (r *Router) Match(uri string) (ParamThunk, Params) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if rt, ok := r.exact[uri]; ok {
+		return rt.fn, nil
+	}
+
+	var best *route
+	var bestParams Params
+	segs := strings.Split(uri, ".")
+	for _, rt := range r.routes {
+		if params, ok := rt.match(segs); ok && (best == nil || moreSpecific(rt, best)) {
+			best, bestParams = rt, params
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	return best.fn, bestParams
+}
+
+// Call is a Thunk that calls the ParamThunk of the most specific
+// pattern that matches the URI of cp. It returns ErrNoRoute if no
+// pattern matches.
+func (r *Router) Call(cp *message.CallPayload) (interface{}, error) {
+	fn, params := r.Match(cp.URI)
+	if fn == nil {
+		return nil, ErrNoRoute
+	}
+	return fn(cp, params)
+}
+
+// URIs returns the URIs to listen to in order to receive the calls
+// for all registered patterns, sorted. A pattern without wildcard is
+// listened to as-is, and a pattern with wildcards is listened to via
+// the prefix URI of its literal segments before the first wildcard
+// (see broker.PrefixURIs), so the broker must support prefix routing.
+func (r *Router) URIs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	set := make(map[string]bool, len(r.exact)+len(r.routes))
+	for uri := range r.exact {
+		set[uri] = true
+	}
+	for _, rt := range r.routes {
+		set[rt.prefixURI()] = true
+	}
+
+	uris := make([]string, 0, len(set))
+	for uri := range set {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	return uris
+}
+
+// Thunks returns a map of the URIs returned by URIs to the Call method
+// of r, to use with Callee.Listen.
+func (r *Router) Thunks() map[string]Thunk {
+	uris := r.URIs()
+	m := make(map[string]Thunk, len(uris))
+	for _, uri := range uris {
+		m[uri] = r.Call
+	}
+	return m
+}
+
+func parsePattern(pattern string) (*route, error) {
+	segs := strings.Split(pattern, ".")
+	rt := &route{
+		pattern: pattern,
+		segs:    segs,
+		names:   make([]string, len(segs)),
+		wild:    make([]bool, len(segs)),
+	}
+
+	seen := make(map[string]bool)
+	for i, seg := range segs {
+		switch {
+		case seg == "":
+			return nil, fmt.Errorf("juggler/callee: empty segment in pattern %q", pattern)
+
+		case seg == "*":
+			rt.wild[i] = true
+
+		case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}"):
+			name := seg[1 : len(seg)-1]
+			if name == "" || strings.ContainsAny(name, "{}*") {
+				return nil, fmt.Errorf("juggler/callee: invalid parameter %q in pattern %q", seg, pattern)
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("juggler/callee: duplicate parameter %q in pattern %q", name, pattern)
+			}
+			seen[name] = true
+			rt.names[i] = name
+			rt.wild[i] = true
+
+		case strings.ContainsAny(seg, "{}*"):
+			return nil, fmt.Errorf("juggler/callee: invalid segment %q in pattern %q", seg, pattern)
+		}
+	}
+	return rt, nil
+}
+
+func (rt *route) hasWildcard() bool {
+	for _, w := range rt.wild {
+		if w {
+			return true
+		}
+	}
+	return false
+}
+
+func (rt *route) match(segs []string) (Params, bool) {
+	if len(segs) != len(rt.segs) {
+		return nil, false
+	}
+
+	var params Params
+	for i, seg := range segs {
+		if !rt.wild[i] {
+			if seg != rt.segs[i] {
+				return nil, false
+			}
+			continue
+		}
+		if seg == "" {
+			return nil, false
+		}
+		if name := rt.names[i]; name != "" {
+			if params == nil {
+				params = make(Params)
+			}
+			params[name] = seg
+		}
+	}
+	return params, true
+}
+
+// prefixURI returns the prefix URI that matches all the URIs matched by
+// rt.
+func (rt *route) prefixURI() string {
+	for i, w := range rt.wild {
+		if w {
+			if i == 0 {
+				return "*"
+			}
+			return strings.Join(rt.segs[:i], ".") + ".*"
+		}
+	}
+	return rt.pattern
+}
+
+// sameShape returns true if a and b match the same URIs.
+func sameShape(a, b *route) bool {
+	if len(a.segs) != len(b.segs) {
+		return false
+	}
+	for i := range a.segs {
+		if a.wild[i] != b.wild[i] || (!a.wild[i] && a.segs[i] != b.segs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// moreSpecific returns true if a is more specific than b, i.e. if it
+// has a literal segment where b has a wildcard at the first position
+// where they differ.
+func moreSpecific(a, b *route) bool {
+	for i := 0; i < len(a.wild) && i < len(b.wild); i++ {
+		if a.wild[i] != b.wild[i] {
+			return !a.wild[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package callee
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter(t *testing.T) {
+	var r Router
+	named := func(name string) ParamThunk {
+		return func(cp *message.CallPayload, params Params) (interface{}, error) {
+			return name, nil
+		}
+	}
+	r.HandleParams("user.*.profile", named("user profile"))
+	r.HandleParams("user.me.profile", named("my profile"))
+	r.HandleParams("user.{id}", named("user"))
+	r.HandleParams("order.{id}.status", named("order status"))
+	r.HandleParams("order.{id}.{field}", named("order field"))
+	r.HandleParams("*.admin", named("admin"))
+	r.Handle("ping", okThunk)
+
+	cases := []struct {
+		uri    string
+		want   interface{}
+		params Params
+	}{
+		{"user.42.profile", "user profile", nil},
+		{"user.me.profile", "my profile", nil},
+		{"user.42", "user", Params{"id": "42"}},
+		{"order.42.status", "order status", Params{"id": "42"}},
+		{"order.42.total", "order field", Params{"id": "42", "field": "total"}},
+		{"order.admin", "admin", nil},
+		{"user.admin", "user", Params{"id": "admin"}},
+		{"ping", "ok", nil},
+		{"user", nil, nil},
+		{"user.42.profile.x", nil, nil},
+		{"user..profile", nil, nil},
+		{"pong", nil, nil},
+	}
+	for _, c := range cases {
+		fn, params := r.Match(c.uri)
+		if c.want == nil {
+			assert.Nil(t, fn, "%s: no match", c.uri)
+			_, err := r.Call(&message.CallPayload{URI: c.uri})
+			assert.Equal(t, ErrNoRoute, err, "%s: Call error", c.uri)
+			continue
+		}
+		if assert.NotNil(t, fn, "%s: match", c.uri) {
+			assert.Equal(t, c.params, params, "%s: params", c.uri)
+			v, err := r.Call(&message.CallPayload{URI: c.uri})
+			assert.NoError(t, err, "%s: Call", c.uri)
+			assert.Equal(t, c.want, v, "%s: Call result", c.uri)
+		}
+	}
+
+	assert.Equal(t, []string{"*", "order.*", "ping", "user.*", "user.me.profile"}, r.URIs(), "URIs")
+	thunks := r.Thunks()
+	assert.Len(t, thunks, 5, "Thunks")
+	assert.NotNil(t, lookupThunk(thunks, "order.1.status"), "lookupThunk")
+}
+
+func TestRouterInvalidPatterns(t *testing.T) {
+	cases := []string{
+		"",
+		"a..b",
+		"a.",
+		"a.b*",
+		"a.{}",
+		"a.{id",
+		"a.{i*d}",
+		"a.{id}.{id}",
+	}
+	for _, c := range cases {
+		var r Router
+		assert.Panics(t, func() { r.Handle(c, okThunk) }, "%q", c)
+	}
+
+	var r Router
+	r.Handle("a.b", okThunk)
+	r.Handle("a.{id}", okThunk)
+	assert.Panics(t, func() { r.Handle("a.b", okThunk) }, "duplicate exact")
+	assert.Panics(t, func() { r.Handle("a.*", okThunk) }, "duplicate shape")
+	assert.NotPanics(t, func() { r.Handle("a.*.c", okThunk) }, "different length")
+}
+
+func TestListenRouter(t *testing.T) {
+	var r Router
+	var got Params
+	r.HandleParams("order.{id}.status", func(cp *message.CallPayload, params Params) (interface{}, error) {
+		got = params
+		return "ok", nil
+	})
+
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "order.42.status", TTLAfterRead: time.Minute}
+	brk := &mockCalleeBroker{cps: []*message.CallPayload{cp}}
+	cle := &Callee{Broker: brk}
+
+	require.NoError(t, cle.Listen(r.Thunks()), "Listen")
+	assert.Equal(t, Params{"id": "42"}, got, "params")
+	if assert.Len(t, brk.rps, 1, "result stored") {
+		assert.Equal(t, `"ok"`, string(brk.rps[0].Args), "result")
+	}
+}
@@ -0,0 +1,72 @@
+package juggler
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mna/juggler/broker"
+)
+
+// DefaultCalleeHealthInterval is the default interval between reads
+// of the live callees if Server.CalleeHealthInterval is not set.
+const DefaultCalleeHealthInterval = time.Second
+
+// errNoLiveCallee is the error returned to calls for a URI that no
+// live callee serves.
+var errNoLiveCallee = errors.New("juggler: no live callee for URI")
+
+func (srv *Server) calleeHealthInterval() time.Duration {
+	if srv.CalleeHealthInterval > 0 {
+		return srv.CalleeHealthInterval
+	}
+	return DefaultCalleeHealthInterval
+}
+
+// hasLiveCallee returns true if a live callee serves uri, directly or
+// via one of its prefix URIs. It always returns true if the server
+// has no CalleeHealth or if the live callees cannot be read.
+func (srv *Server) hasLiveCallee(uri string) bool {
+	if srv.CalleeHealth == nil {
+		return true
+	}
+
+	live := srv.liveCalleeURIs()
+	if live == nil || live[uri] {
+		return true
+	}
+	for _, p := range broker.PrefixURIs(uri) {
+		if live[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// liveCalleeURIs returns the set of URIs served by the live callees,
+// read from CalleeHealth if the cached set is older than the
+// CalleeHealthInterval. It returns nil if it cannot be read.
+func (srv *Server) liveCalleeURIs() map[string]bool {
+	srv.lmu.Lock()
+	defer srv.lmu.Unlock()
+
+	now := time.Now()
+	if !srv.liveAt.IsZero() && now.Sub(srv.liveAt) < srv.calleeHealthInterval() {
+		return srv.liveURIs
+	}
+	srv.liveAt = now
+
+	infos, err := srv.CalleeHealth.Callees()
+	if err != nil {
+		srv.vars.Add("FailedCalleeHealthReads", 1)
+		srv.liveURIs = nil
+		return nil
+	}
+	live := make(map[string]bool)
+	for _, ci := range infos {
+		for _, uri := range ci.URIs {
+			live[uri] = true
+		}
+	}
+	srv.liveURIs = live
+	return live
+}
@@ -0,0 +1,55 @@
+package juggler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeHealthBroker struct {
+	infos []*broker.CalleeInfo
+	err   error
+	reads int
+}
+
+func (f *fakeHealthBroker) RegisterCallee(*broker.CalleeInfo, time.Duration) error { return nil }
+func (f *fakeHealthBroker) UnregisterCallee(string) error                          { return nil }
+func (f *fakeHealthBroker) Callees() ([]*broker.CalleeInfo, error) {
+	f.reads++
+	return f.infos, f.err
+}
+
+func TestHasLiveCallee(t *testing.T) {
+	hb := &fakeHealthBroker{infos: []*broker.CalleeInfo{
+		{ID: "c1", URIs: []string{"a"}},
+		{ID: "c2", URIs: []string{"b.*"}},
+	}}
+	srv := &Server{CalleeHealth: hb, CalleeHealthInterval: time.Hour}
+	srv.init()
+
+	cases := []struct {
+		uri  string
+		want bool
+	}{
+		{"a", true},
+		{"b.c", true},
+		{"b", false},
+		{"c", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, srv.hasLiveCallee(c.uri), c.uri)
+	}
+	assert.Equal(t, 1, hb.reads, "cached")
+
+	// the calls are not rejected if the live callees cannot be read
+	hb.err = errors.New("fail")
+	srv.liveAt = time.Time{}
+	assert.True(t, srv.hasLiveCallee("c"), "read failed")
+	assert.Equal(t, 2, hb.reads, "read again")
+
+	// no registry
+	assert.True(t, (&Server{}).hasLiveCallee("c"), "no CalleeHealth")
+}
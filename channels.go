@@ -0,0 +1,75 @@
+package juggler
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/mna/juggler/broker"
+)
+
+// ActiveChannels returns the channels that currently have at least one
+// subscriber and that match the glob-style pattern (all channels if
+// pattern is empty), along with their number of subscribers. It
+// requires a PubSubBroker that implements broker.PubSubInfoBroker.
+// Pattern-based subscriptions are not taken into account.
+//
+// The result depends on the broker's view of the deployment, e.g. the
+// redisbroker.Broker only reports the subscribers of all nodes of a
+// redis cluster if its NodePools field is set.
+func (srv *Server) ActiveChannels(pattern string) (map[string]int, error) {
+	ib, ok := srv.PubSubBroker.(broker.PubSubInfoBroker)
+	if !ok {
+		return nil, errNoPubSubInfo
+	}
+	chans, err := ib.Channels(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(chans) == 0 {
+		return map[string]int{}, nil
+	}
+	return ib.NumSub(chans...)
+}
+
+// ChannelInfo is the information about an active channel, as returned
+// by ChannelsHandler.
+type ChannelInfo struct {
+	Channel     string `json:"channel"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// ChannelsHandler returns an HTTP handler that responds with the JSON
+// array of srv's active channels, as returned by ActiveChannels, sorted
+// by channel name. The optional pattern query string parameter filters
+// the channels. It is meant to be used as an admin endpoint, e.g. for
+// operational dashboards, and should not be exposed publicly.
+//
+// It responds with a 501 status code if the PubSubBroker doesn't
+// implement broker.PubSubInfoBroker, and with a 500 status code if the
+// broker fails to list the channels.
+func ChannelsHandler(srv *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counts, err := srv.ActiveChannels(r.URL.Query().Get("pattern"))
+		if err != nil {
+			code := http.StatusInternalServerError
+			if err == errNoPubSubInfo {
+				code = http.StatusNotImplemented
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+
+		infos := make([]ChannelInfo, 0, len(counts))
+		for ch, n := range counts {
+			infos = append(infos, ChannelInfo{Channel: ch, Subscribers: n})
+		}
+		sort.Sort(byChannel(infos))
+		writeJSON(w, http.StatusOK, infos)
+	})
+}
+
+type byChannel []ChannelInfo
+
+func (b byChannel) Len() int           { return len(b) }
+func (b byChannel) Less(i, j int) bool { return b[i].Channel < b[j].Channel }
+func (b byChannel) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,37 @@
+package juggler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActiveChannels(t *testing.T) {
+	srv := &Server{PubSubBroker: &fakePubSubInfoBroker{channels: []string{"bb", "a"}}}
+
+	got, err := srv.ActiveChannels("")
+	require.NoError(t, err, "ActiveChannels")
+	assert.Equal(t, map[string]int{"a": 1, "bb": 2}, got, "all channels")
+
+	w := httptest.NewRecorder()
+	ChannelsHandler(srv).ServeHTTP(w, httptest.NewRequest("GET", "/channels", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "status code")
+	assert.JSONEq(t, `[{"channel":"a","subscribers":1},{"channel":"bb","subscribers":2}]`, w.Body.String(), "body")
+
+	w = httptest.NewRecorder()
+	ChannelsHandler(srv).ServeHTTP(w, httptest.NewRequest("GET", "/channels?pattern=ccc", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "status code with pattern")
+	assert.JSONEq(t, `[{"channel":"ccc","subscribers":3}]`, w.Body.String(), "body with pattern")
+
+	// the broker doesn't support channel queries
+	srv = &Server{PubSubBroker: &fakePubSubBroker{}}
+	_, err = srv.ActiveChannels("")
+	assert.Equal(t, errNoPubSubInfo, err, "ActiveChannels without info broker")
+
+	w = httptest.NewRecorder()
+	ChannelsHandler(srv).ServeHTTP(w, httptest.NewRequest("GET", "/channels", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code, "status code without info broker")
+}
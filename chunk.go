@@ -0,0 +1,81 @@
+package juggler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"github.com/mna/juggler/message"
+)
+
+// maxChunkedCalls is the maximum number of chunked calls that can be
+// pending (waiting for their final chunk) on a connection.
+const maxChunkedCalls = 8
+
+var (
+	errChunkedNotAllowed = errors.New("juggler: chunked calls are not allowed")
+	errTooManyChunked    = errors.New("juggler: too many pending chunked calls")
+	errUnknownChunked    = errors.New("juggler: unknown chunked call")
+	errChunkedTooLarge   = errors.New("juggler: chunked call arguments too large")
+	errChunkedInvalid    = errors.New("juggler: chunked call arguments are not valid JSON")
+)
+
+// chunkedCall is a chunked call for which the chunks are being received.
+type chunkedCall struct {
+	call *message.Call
+	args bytes.Buffer
+}
+
+// startChunked registers the chunked call m, so that its chunks can be
+// assembled. It returns an error and the NACK code to use if the call
+// cannot be registered.
+func (c *Conn) startChunked(m *message.Call) (int, error) {
+	if c.srv.MaxChunkedArgs <= 0 {
+		return 400, errChunkedNotAllowed
+	}
+
+	c.chmu.Lock()
+	defer c.chmu.Unlock()
+
+	if len(c.chunked) >= maxChunkedCalls {
+		return 429, errTooManyChunked
+	}
+	if c.chunked == nil {
+		c.chunked = make(map[string]*chunkedCall)
+	}
+	c.chunked[m.UUID().String()] = &chunkedCall{call: m}
+	return 0, nil
+}
+
+// addChunk adds the chunk m to its chunked call. If it is the final
+// chunk, it returns the call with the assembled arguments. It returns
+// an error and the NACK code to use if the chunk is invalid, in which
+// case the chunked call is dropped.
+func (c *Conn) addChunk(m *message.Chunk) (*message.Call, int, error) {
+	key := m.Payload.For.String()
+
+	c.chmu.Lock()
+	defer c.chmu.Unlock()
+
+	cc := c.chunked[key]
+	if cc == nil {
+		return nil, 404, errUnknownChunked
+	}
+	if int64(cc.args.Len()+len(m.Payload.Data)) > c.srv.MaxChunkedArgs {
+		delete(c.chunked, key)
+		return nil, 413, errChunkedTooLarge
+	}
+	cc.args.WriteString(m.Payload.Data)
+	if !m.Payload.Final {
+		return nil, 0, nil
+	}
+
+	delete(c.chunked, key)
+	args := cc.args.Bytes()
+	if !json.Valid(args) {
+		return nil, 400, errChunkedInvalid
+	}
+	cc.call.Payload.Args = args
+	cc.call.Payload.Chunked = false
+	return cc.call, 0, nil
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// ErrUnknownRequest is returned by WaitForAck when the UUID does not
+// identify a request sent by the client, or when its ACK or NACK was
+// received too long ago to still be known.
+var ErrUnknownRequest = errors.New("juggler: unknown request")
+
+// ackHistorySize is the number of received ACK and NACK outcomes kept
+// for calls to WaitForAck made after the outcome was received.
+const ackHistorySize = 1024
+
+// ackWaiter is the outcome of a request, set when its ACK or NACK is
+// received.
+type ackWaiter struct {
+	ctx  context.Context // context of the request
+	done chan struct{}
+	err  error
+}
+
+// WaitForAck waits for the ACK or NACK of the CALL, PUB, SUB or UNSB
+// request identified by id, as returned when the request was sent. It
+// returns nil if the server acknowledged the request, a *NackError if
+// it rejected it, or a *TransportError if the connection failed before
+// the outcome was received. It returns ctx.Err() if ctx is done before
+// that, and ErrUnknownRequest if id is not a request sent by the
+// client, or if its outcome is too old to still be known.
+//
+// The outcome of a request is kept after it is received, so it is
+// fine to call WaitForAck after the ACK or NACK was sent to the
+// Handler. It may be called many times for the same request.
+func (c *Client) WaitForAck(ctx context.Context, id uuid.UUID) error {
+	c.mu.Lock()
+	w := c.acks[id.String()]
+	c.mu.Unlock()
+	if w == nil {
+		return ErrUnknownRequest
+	}
+
+	select {
+	case <-w.done:
+		return w.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.stop:
+		// the outcome may have been set by failAcks before stop was closed
+		select {
+		case <-w.done:
+			return w.err
+		default:
+		}
+		c.mu.Lock()
+		err := c.err
+		c.mu.Unlock()
+		return &TransportError{Err: err}
+	}
+}
+
+// addAck registers the request identified by key, sent with the
+// context ctx, as waiting for its ACK or NACK.
+func (c *Client) addAck(ctx context.Context, key string) {
+	c.mu.Lock()
+	c.acks[key] = &ackWaiter{ctx: ctx, done: make(chan struct{})}
+	c.mu.Unlock()
+}
+
+// deleteAck removes the request identified by key, e.g. if it could
+// not be sent.
+func (c *Client) deleteAck(key string) {
+	c.mu.Lock()
+	delete(c.acks, key)
+	c.mu.Unlock()
+}
+
+// completeAck sets the outcome of the request identified by key, if it
+// is still waiting for it. It returns the context of the request, or
+// nil if the request is unknown.
+func (c *Client) completeAck(key string, err error) context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.completeAckLocked(key, err)
+	if w := c.acks[key]; w != nil {
+		return w.ctx
+	}
+	return nil
+}
+
+func (c *Client) completeAckLocked(key string, err error) {
+	w := c.acks[key]
+	if w == nil {
+		return
+	}
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+	w.err = err
+	close(w.done)
+
+	// keep the outcome for a while, so that WaitForAck can be called
+	// after it was received.
+	c.ackHist = append(c.ackHist, key)
+	if len(c.ackHist) > ackHistorySize {
+		delete(c.acks, c.ackHist[0])
+		c.ackHist = c.ackHist[1:]
+	}
+}
+
+// failAcks sets err as outcome of all requests still waiting for it.
+func (c *Client) failAcks(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.acks {
+		c.completeAckLocked(key, &TransportError{Err: err})
+	}
+}
+
+// ackKey returns the key of m for WaitForAck, or an empty string if m
+// is not a request that is acknowledged by the server.
+func ackKey(m message.Msg) string {
+	switch m.Type() {
+	case message.CallMsg, message.PubMsg, message.SubMsg, message.UnsbMsg:
+		return m.UUID().String()
+	}
+	return ""
+}
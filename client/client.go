@@ -11,15 +11,45 @@
 // an ACK message, not a NACK) either generates a RES or an EXP,
 // but never both or none.
 //
+// Alternatively, CallFuture and CallSync return the result of a call
+// directly, and convert failures to typed errors that can be checked
+// with errors.Is against ErrNacked, ErrExpired and ErrTransport.
+//
+// WaitForAck waits for the ACK or NACK of any request, so that the
+// caller can confirm that e.g. a subscription or a publish took effect.
+//
+// Subscribe registers a callback for the events of a channel, so that
+// the events are routed to the callbacks of their subscription instead
+// of having to switch on the channel in the Handler.
+//
+// The client can reconnect automatically when the connection fails, and
+// re-subscribe to its channels, see SetReconnect. On a durable channel,
+// the events missed while disconnected are replayed by the server
+// after the reconnection (see SubReplay). The calls that fail with a
+// transient error can be retried automatically, see SetRetryPolicy.
+//
+// The Context variants of the methods that send requests (e.g.
+// CallContext) accept a context.Context that bounds the write of the
+// request, and that is used as parent of the context passed to the
+// Handler for the messages received in response to that request.
+//
+// The client measures the latency of each call, which is available
+// via Future.Latency, via LatencyFromContext in the Handler, and
+// aggregated for all calls via Client.Latencies.
+//
 package client
 
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/net/context"
 
@@ -33,23 +63,59 @@ import (
 // Client is a juggler client based on a websocket connection. It is
 // used to send and receive messages to and from a juggler server.
 type Client struct {
+	cmu  sync.Mutex // lock access to conn, replaced when reconnecting
 	conn *websocket.Conn
 
 	// options
 	callTimeout             time.Duration
 	handler                 Handler
 	readTimeout             time.Duration
+	readLimit               int64
 	writeTimeout            time.Duration
 	acquireWriteLockTimeout time.Duration
 	writeLimit              int64
+	compression             string
+	compressThreshold       int
+	writeCompression        bool
+	compressionLevel        int
+	pingInterval            time.Duration
+	pongTimeout             time.Duration
+	resolveBlob             func(string) ([]byte, error)
+	eventDedup              *eventDedup
+	reconnectOn             bool
+	dial                    func() (*websocket.Conn, error)
+	minBackoff              time.Duration
+	maxBackoff              time.Duration
+	connState               func(ConnState)
+	retryPolicy             RetryPolicy
+	onClose                 func() // called once the client is closed for good
 
 	// stop signal for expiration goroutines, signals close of client
 	stop chan struct{}
 
+	// closing signal, set by Close to stop reconnecting
+	closeOnce sync.Once
+	closing   chan struct{}
+
+	// time of the last pong received, in Unix nanoseconds, accessed
+	// atomically
+	lastPong int64
+
 	wmu     chan struct{} // exclusive write lock
-	mu      sync.Mutex    // lock access to results map and err field
-	results map[string]struct{}
-	err     error
+	mu        sync.Mutex // lock access to results, futures and acks maps, latencies and err field
+	results   map[string]*pendingCall
+	futures   map[string]*Future
+	acks      map[string]*ackWaiter
+	ackHist   []string // keys of the acks with an outcome, oldest first
+	subs      map[subscription]message.Filter
+	routes    map[subscription][]*Subscription
+	lastIDs   map[string]string // ID of the last event received per durable channel
+	latencies LatencyStats
+	err       error
+
+	// serializes Subscribe and Unsubscribe, so that the SUB and UNSB
+	// requests are sent in the order of the changes to routes
+	rmu sync.Mutex
 }
 
 // New creates a juggler client using the provided websocket
@@ -62,54 +128,173 @@ func New(conn *websocket.Conn, opts ...Option) *Client {
 	wmu <- struct{}{}
 
 	c := &Client{
-		conn:    conn,
-		stop:    make(chan struct{}),
-		wmu:     wmu,
-		results: make(map[string]struct{}),
+		conn:             conn,
+		writeCompression: true,
+		stop:             make(chan struct{}),
+		closing:          make(chan struct{}),
+		wmu:              wmu,
+		results:          make(map[string]*pendingCall),
+		futures:          make(map[string]*Future),
+		acks:             make(map[string]*ackWaiter),
+		subs:             make(map[subscription]message.Filter),
+		routes:           make(map[subscription][]*Subscription),
+		lastIDs:          make(map[string]string),
 	}
 	for _, opt := range opts {
 		opt(c)
 	}
+	if c.pingInterval > 0 {
+		conn.SetPongHandler(c.handlePong)
+		go c.keepAlive()
+	}
 	go c.handleMessages()
 	return c
 }
 
+// wsConn returns the current websocket connection.
+func (c *Client) wsConn() *websocket.Conn {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+	return c.conn
+}
+
 func (c *Client) handleMessages() {
 	defer close(c.stop)
 
 	for {
-		_, r, err := c.conn.NextReader()
+		err := c.readMessages(c.wsConn())
+		if c.reconnectOn && c.dial != nil && c.reconnect(err) {
+			continue
+		}
+
+		c.mu.Lock()
+		if c.err == nil {
+			c.err = err
+		}
+		c.mu.Unlock()
+		c.failFutures(err)
+		c.failAcks(err)
+		c.setConnState(Closed)
+		if c.onClose != nil {
+			c.onClose()
+		}
+		return
+	}
+}
+
+// readMessages reads the messages received on conn until it fails, and
+// returns the error.
+func (c *Client) readMessages(conn *websocket.Conn) error {
+	for {
+		_, r, err := conn.NextReader()
 		if err != nil {
-			c.mu.Lock()
-			if c.err == nil {
-				c.err = err
-			}
-			c.mu.Unlock()
-			return
+			return err
 		}
 
-		m, err := message.UnmarshalResponse(r)
+		// the websocket read limit applies to the compressed frames if
+		// permessage-deflate is used, also limit the decompressed message.
+		r = wswriter.LimitReader(r, c.readLimit)
+		msgs, err := message.UnmarshalResponseBatch(message.CodecFor(conn.Subprotocol()), r)
 		if err != nil {
 			continue
 		}
+		for _, m := range msgs {
+			c.receive(m)
+		}
+	}
+}
 
-		switch m := m.(type) {
-		case *message.Res:
-			// got the result, do not trigger an expired message
-			if ok := c.deletePending(m.Payload.For.String()); !ok {
-				// if an expired message got here first, then drop the
-				// result, client treated this call as expired already.
-				continue
+// receive processes the message m received from the server and sends
+// it to the handler.
+func (c *Client) receive(m message.Msg) {
+	if err := message.Decompress(m, 0); err != nil {
+		return
+	}
+	if c.resolveBlob != nil {
+		// if the blob cannot be resolved, the message is sent as-is, with
+		// the blob reference in its metadata.
+		message.Resolve(m, c.resolveBlob)
+	}
+
+	ctx := context.Background()
+	switch m := m.(type) {
+	case *message.Evnt:
+		if c.eventDedup != nil && c.eventDedup.seen(m) {
+			// redelivered event, already sent to the handler
+			return
+		}
+		if m.Payload.ID != "" {
+			c.setLastEventID(m.Payload.Channel, m.Payload.ID)
+		}
+		c.routeEvent(m)
+
+	case *message.ResChunk:
+		if pctx := c.pendingContext(m.Payload.For.String()); pctx != nil {
+			ctx = pctx
+		}
+
+	case *message.Res:
+		if m.Payload.Partial {
+			// partial result of a fan-out call, the call is still pending
+			if pctx := c.pendingContext(m.Payload.For.String()); pctx != nil {
+				ctx = pctx
+			}
+			break
+		}
+		// got the result, do not trigger an expired message
+		p := c.deletePending(m.Payload.For.String())
+		if p == nil {
+			// if an expired message got here first, then drop the
+			// result, client treated this call as expired already.
+			return
+		}
+		lat := p.latency()
+		lat.Res = time.Since(p.sent)
+		c.mu.Lock()
+		c.latencies.Res.add(lat.Res)
+		c.mu.Unlock()
+		ctx = withLatency(p.ctx, lat)
+		c.completeFuture(m.Payload.For.String(), m, lat, nil)
+
+	case *message.Ack:
+		if actx := c.completeAck(m.Payload.For.String(), nil); actx != nil {
+			ctx = actx
+		}
+		if m.Payload.ForType == message.CallMsg {
+			if lat, ok := c.ackPending(m.Payload.For.String()); ok {
+				ctx = withLatency(ctx, lat)
 			}
+		}
 
-		case *message.Nack:
-			if m.Payload.ForType == message.CallMsg {
-				// won't get any result for this call (unless already expired)
-				c.deletePending(m.Payload.For.String())
+	case *message.Nack:
+		if m.Payload.ForType == message.CallMsg && isRetryableNack(m) && c.retry(m.Payload.For.String(), 0) {
+			// the call is sent again, only the outcome of the last
+			// attempt is reported.
+			return
+		}
+		if actx := c.completeAck(m.Payload.For.String(), newNackError(m)); actx != nil {
+			ctx = actx
+		}
+		if m.Payload.ForType == message.CallMsg {
+			// won't get any result for this call (unless already expired)
+			var lat CallLatency
+			if l, ok := c.ackPending(m.Payload.For.String()); ok {
+				lat = l
+				ctx = withLatency(ctx, lat)
 			}
+			c.deletePending(m.Payload.For.String())
+			c.completeFuture(m.Payload.For.String(), nil, lat, newNackError(m))
 		}
+	}
 
-		go c.handler.Handle(context.Background(), m)
+	c.handle(ctx, m)
+}
+
+// handle sends m to the handler in a separate goroutine, if a handler
+// is set.
+func (c *Client) handle(ctx context.Context, m message.Msg) {
+	if c.handler != nil {
+		go c.handler.Handle(ctx, m)
 	}
 }
 
@@ -121,15 +306,27 @@ func (c *Client) handleMessages() {
 // create the client once the connection is established, using New.
 //
 // The Dialer's Subprotocols field should be set to one of (or any/all of)
-// juggler.Subprotocol. To limit the client to a restricted subset of
+// juggler.Subprotocol. The messages are encoded with the codec of the
+// negotiated protocol (see message.CodecFor), e.g. in MessagePack for
+// "juggler.0+msgpack", or in a binary envelope that sends []byte
+// arguments as raw bytes for "juggler.0+binary". With "juggler.0+batch",
+// the server may send many messages in a single websocket message,
+// which the client processes in order. To limit the client to a restricted subset of
 // messages, set the Juggler-Allowed-Messages header on reqHeader
 // (see the documentation of juggler.Upgrade for details).
+//
+// If reconnection is enabled with SetReconnect and no dial function is
+// provided, the client reconnects using d, urlStr and reqHeader.
 func Dial(d *websocket.Dialer, urlStr string, reqHeader http.Header, opts ...Option) (*Client, error) {
 	conn, _, err := d.Dial(urlStr, reqHeader)
 	if err != nil {
 		return nil, err
 	}
-	return New(conn, opts...), nil
+	dial := func() (*websocket.Conn, error) {
+		conn, _, err := d.Dial(urlStr, reqHeader)
+		return conn, err
+	}
+	return New(conn, append([]Option{setDefaultDial(dial)}, opts...)...), nil
 }
 
 // Close closes the connection. No more messages will be received.
@@ -139,8 +336,10 @@ func (c *Client) Close() error {
 	c.mu.Unlock()
 
 	// closing the websocket connection causes the NextReader
-	// call in handleMessages to fail, closing c.stop.
-	err2 := c.conn.Close()
+	// call in handleMessages to fail, closing c.stop. Signal the
+	// close first so that it doesn't reconnect.
+	c.closeOnce.Do(func() { close(c.closing) })
+	err2 := c.wsConn().Close()
 	<-c.stop
 
 	if err == nil {
@@ -166,8 +365,11 @@ func (c *Client) CloseNotify() <-chan struct{} {
 // UnderlyingConn returns the underlying websocket connection used by the
 // client. Care should be taken when using the websocket connection
 // directly, as it may interfere with the normal behaviour of the client.
+//
+// If reconnection is enabled, the returned connection is replaced by a
+// new one when the client reconnects.
 func (c *Client) UnderlyingConn() *websocket.Conn {
-	return c.conn
+	return c.wsConn()
 }
 
 // Call makes a call request to the server for the remote procedure
@@ -178,6 +380,69 @@ func (c *Client) UnderlyingConn() *websocket.Conn {
 // It returns the UUID of the call message on success, or an error if
 // the call request could not be sent to the server.
 func (c *Client) Call(uri string, v interface{}, timeout time.Duration) (uuid.UUID, error) {
+	return c.callPriority(context.Background(), uri, v, 0, timeout)
+}
+
+// CallContext is like Call, with ctx bounding the write of the call
+// request: if ctx is done before the request is written, it returns
+// ctx.Err(). If the deadline of ctx expires while the request is being
+// written, the write fails and the connection should be closed. If
+// timeout is <= 0 and ctx has a deadline, the remaining time is used
+// as timeout of the call.
+//
+// The context passed to the Handler for the ACK, NACK, RES, RCHK and
+// EXP messages of the call is derived from ctx.
+func (c *Client) CallContext(ctx context.Context, uri string, v interface{}, timeout time.Duration) (uuid.UUID, error) {
+	return c.callPriority(ctx, uri, v, 0, timeout)
+}
+
+// CallPriority is like Call, with the specified priority set on the
+// call request (see message.Meta). The priority is set on the ACK,
+// NACK and RES messages of the call too.
+func (c *Client) CallPriority(uri string, v interface{}, priority int, timeout time.Duration) (uuid.UUID, error) {
+	return c.callPriority(context.Background(), uri, v, priority, timeout)
+}
+
+func (c *Client) callPriority(ctx context.Context, uri string, v interface{}, priority int, timeout time.Duration) (uuid.UUID, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout <= 0 {
+		if timeout, err = contextTimeout(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if timeout <= 0 {
+		timeout = c.callTimeout
+	}
+	m, err := message.NewCall(uri, v, timeout)
+	if err != nil {
+		return nil, err
+	}
+	m.Meta.P = priority
+	if err := c.send(ctx, m, timeout); err != nil {
+		return nil, err
+	}
+	return m.UUID(), nil
+}
+
+// fanOutExpiryGrace is the delay added to the timeout of a fan-out call
+// before it expires on the client, so that the combined result sent by
+// the server when the timeout expires can be received.
+const fanOutExpiryGrace = time.Second
+
+// CallFanOut makes a fan-out call request to the server, which
+// dispatches the call with the JSON-encoded v value as arguments to
+// each of the uris, and sends a single RES with the combined results
+// (see message.FanOutResult) identified by uri. If stream is true, the
+// server also sends each result as a partial RES as soon as it is
+// received. The server must allow fan-out calls (see
+// Server.MaxFanOut).
+func (c *Client) CallFanOut(uri string, uris []string, v interface{}, stream bool, timeout time.Duration) (uuid.UUID, error) {
 	c.mu.Lock()
 	err := c.err
 	c.mu.Unlock()
@@ -192,51 +457,171 @@ func (c *Client) Call(uri string, v interface{}, timeout time.Duration) (uuid.UU
 	if err != nil {
 		return nil, err
 	}
-	if err := c.doWrite(m); err != nil {
+	m.Payload.FanOut = uris
+	m.Payload.Stream = stream
+	if err := c.send(context.Background(), m, timeout+fanOutExpiryGrace); err != nil {
+		return nil, err
+	}
+	return m.UUID(), nil
+}
+
+// CallChunked is like Call, except that the JSON-encoded v value is
+// sent to the server in chunks of at most chunkSize bytes, following
+// a CALL message with no arguments. The server assembles the chunks
+// before processing the call, which must be allowed by the server
+// (see Server.MaxChunkedArgs). This is useful to send arguments that
+// would exceed the read limit of the connection in a single message.
+func (c *Client) CallChunked(uri string, v interface{}, chunkSize int, timeout time.Duration) (uuid.UUID, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if chunkSize <= 0 {
+		return nil, errors.New("juggler/client: chunk size must be greater than 0")
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
 		return nil, err
 	}
 
-	// add the expected result
-	c.addPending(m.UUID().String())
+	if timeout <= 0 {
+		timeout = c.callTimeout
+	}
+	m, err := message.NewCall(uri, nil, timeout)
+	if err != nil {
+		return nil, err
+	}
+	m.Payload.Chunked = true
+	if err := c.send(context.Background(), m, timeout); err != nil {
+		return nil, err
+	}
 
-	go c.handleExpiredCall(m, timeout)
+	for len(b) > 0 {
+		n := chunkSize
+		if n >= len(b) {
+			n = len(b)
+		} else {
+			// do not split a UTF-8 encoded rune across chunks
+			for n > 1 && !utf8.RuneStart(b[n]) {
+				n--
+			}
+		}
+		chunk := message.NewChunk(m.UUID(), string(b[:n]), n == len(b))
+		if err := c.doWrite(context.Background(), chunk); err != nil {
+			return nil, err
+		}
+		b = b[n:]
+	}
 	return m.UUID(), nil
 }
 
-func (c *Client) handleExpiredCall(m *message.Call, timeout time.Duration) {
+// contextTimeout returns the time remaining before the deadline of ctx,
+// or 0 if it has no deadline. It returns an error if ctx is done.
+func contextTimeout(ctx context.Context) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	dl, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	timeout := dl.Sub(time.Now())
+	if timeout <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	return timeout, nil
+}
+
+// send writes the call message m and starts the expiration goroutine.
+func (c *Client) send(ctx context.Context, m *message.Call, timeout time.Duration) error {
+	c.withIdempotencyKey(m)
+
+	// add the expected result before sending the call, as the result
+	// may be received before doWrite returns.
+	c.addPending(ctx, m, timeout)
+	if err := c.doWrite(ctx, m); err != nil {
+		c.deletePending(m.UUID().String())
+		return err
+	}
+
+	go c.handleExpiredCall(m, timeout, 1)
+	return nil
+}
+
+// handleExpiredCall expires the call m if its attempt is still waiting
+// for a result once the timeout expired, unless it is retried.
+func (c *Client) handleExpiredCall(m *message.Call, timeout time.Duration, attempt int) {
 	// wait for the timeout
 	if timeout <= 0 {
 		timeout = broker.DefaultCallTimeout
 	}
 	select {
 	case <-c.stop:
+		c.mu.Lock()
+		err := c.err
+		c.mu.Unlock()
+		c.completeFuture(m.UUID().String(), nil, CallLatency{}, &TransportError{Err: err})
 		return
 	case <-time.After(timeout):
 	}
 
 	// check if still waiting for a result
-	if ok := c.deletePending(m.UUID().String()); ok {
+	key := m.UUID().String()
+	if c.retry(key, attempt) {
+		return
+	}
+	if p := c.deletePendingAttempt(key, attempt); p != nil {
 		// if so, send an Exp message
-		exp := newExp(m)
-		go c.handler.Handle(context.Background(), exp)
+		lat := p.latency()
+		c.completeFuture(m.UUID().String(), nil, lat, ErrExpired)
+		c.handle(withLatency(p.ctx, lat), newExp(m))
 	}
 }
 
-// add a pending call.
-func (c *Client) addPending(key string) {
+// add a pending call, sent now with the context ctx.
+func (c *Client) addPending(ctx context.Context, m *message.Call, timeout time.Duration) {
 	c.mu.Lock()
-	c.results[key] = struct{}{}
+	c.results[m.UUID().String()] = &pendingCall{call: m, ctx: ctx, sent: time.Now(), timeout: timeout, attempt: 1}
 	c.mu.Unlock()
 }
 
-// delete the pending call, returning true if it was still pending.
-func (c *Client) deletePending(key string) bool {
+// pendingContext returns the context of the pending call identified by
+// key, or nil if it is not pending.
+func (c *Client) pendingContext(key string) context.Context {
 	c.mu.Lock()
-	_, ok := c.results[key]
+	defer c.mu.Unlock()
+	if p := c.results[key]; p != nil {
+		return p.ctx
+	}
+	return nil
+}
+
+// delete the pending call, returning it if it was still pending, nil
+// otherwise.
+func (c *Client) deletePending(key string) *pendingCall {
+	c.mu.Lock()
+	p := c.results[key]
 	delete(c.results, key)
 	c.mu.Unlock()
 
-	return ok
+	return p
+}
+
+// deletePendingAttempt is like deletePending, but only deletes the
+// pending call if it is waiting for the result of attempt.
+func (c *Client) deletePendingAttempt(key string, attempt int) *pendingCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := c.results[key]
+	if p == nil || p.attempt != attempt {
+		return nil
+	}
+	delete(c.results, key)
+	return p
 }
 
 // Sub makes a subscription request to the server for the specified
@@ -244,6 +629,34 @@ func (c *Client) deletePending(key string) bool {
 // returns the UUID of the sub message on success, or an error if
 // the request could not be sent to the server.
 func (c *Client) Sub(channel string, pattern bool) (uuid.UUID, error) {
+	return c.subFilter(context.Background(), channel, pattern, nil, "")
+}
+
+// SubContext is like Sub, with ctx bounding the write of the request
+// (see CallContext). The context passed to the Handler for the ACK or
+// NACK of the request is derived from ctx.
+func (c *Client) SubContext(ctx context.Context, channel string, pattern bool) (uuid.UUID, error) {
+	return c.subFilter(ctx, channel, pattern, nil, "")
+}
+
+// SubFilter is like Sub, with the specified filter set on the
+// subscription so that the server only sends the events whose
+// arguments match it (see message.Filter).
+func (c *Client) SubFilter(channel string, pattern bool, filter message.Filter) (uuid.UUID, error) {
+	return c.subFilter(context.Background(), channel, pattern, filter, "")
+}
+
+// SubReplay is like Sub for the durable channel, with lastEventID as
+// the ID of the last event received on the channel (see
+// message.Evnt), e.g. as persisted by the application from
+// LastEventID. The server replays the events published after that
+// event, as far as they are retained by the broker. Some events may
+// be received twice, see SetEventDedup.
+func (c *Client) SubReplay(channel, lastEventID string) (uuid.UUID, error) {
+	return c.subFilter(context.Background(), channel, false, nil, lastEventID)
+}
+
+func (c *Client) subFilter(ctx context.Context, channel string, pattern bool, filter message.Filter, lastEventID string) (uuid.UUID, error) {
 	c.mu.Lock()
 	err := c.err
 	c.mu.Unlock()
@@ -252,9 +665,12 @@ func (c *Client) Sub(channel string, pattern bool) (uuid.UUID, error) {
 	}
 
 	m := message.NewSub(channel, pattern)
-	if err := c.doWrite(m); err != nil {
+	m.Payload.Filter = filter
+	m.Payload.LastEventID = lastEventID
+	if err := c.doWrite(ctx, m); err != nil {
 		return nil, err
 	}
+	c.addSub(channel, pattern, filter)
 	return m.UUID(), nil
 }
 
@@ -263,6 +679,13 @@ func (c *Client) Sub(channel string, pattern bool) (uuid.UUID, error) {
 // returns the UUID of the unsb message on success, or an error if
 // the request could not be sent to the server.
 func (c *Client) Unsb(channel string, pattern bool) (uuid.UUID, error) {
+	return c.UnsbContext(context.Background(), channel, pattern)
+}
+
+// UnsbContext is like Unsb, with ctx bounding the write of the request
+// (see CallContext). The context passed to the Handler for the ACK or
+// NACK of the request is derived from ctx.
+func (c *Client) UnsbContext(ctx context.Context, channel string, pattern bool) (uuid.UUID, error) {
 	c.mu.Lock()
 	err := c.err
 	c.mu.Unlock()
@@ -271,9 +694,10 @@ func (c *Client) Unsb(channel string, pattern bool) (uuid.UUID, error) {
 	}
 
 	m := message.NewUnsb(channel, pattern)
-	if err := c.doWrite(m); err != nil {
+	if err := c.doWrite(ctx, m); err != nil {
 		return nil, err
 	}
+	c.deleteSub(channel, pattern)
 	return m.UUID(), nil
 }
 
@@ -282,6 +706,24 @@ func (c *Client) Unsb(channel string, pattern bool) (uuid.UUID, error) {
 // the UUID of the pub message on success, or an error if the request could
 // not be sent to the server.
 func (c *Client) Pub(channel string, v interface{}) (uuid.UUID, error) {
+	return c.pubPriority(context.Background(), channel, v, 0)
+}
+
+// PubContext is like Pub, with ctx bounding the write of the request
+// (see CallContext). The context passed to the Handler for the ACK or
+// NACK of the request is derived from ctx.
+func (c *Client) PubContext(ctx context.Context, channel string, v interface{}) (uuid.UUID, error) {
+	return c.pubPriority(ctx, channel, v, 0)
+}
+
+// PubPriority is like Pub, with the specified priority set on the
+// pub request (see message.Meta). The priority is set on the ACK or
+// NACK of the request and on the resulting EVNT messages too.
+func (c *Client) PubPriority(channel string, v interface{}, priority int) (uuid.UUID, error) {
+	return c.pubPriority(context.Background(), channel, v, priority)
+}
+
+func (c *Client) pubPriority(ctx context.Context, channel string, v interface{}, priority int) (uuid.UUID, error) {
 	c.mu.Lock()
 	err := c.err
 	c.mu.Unlock()
@@ -293,7 +735,8 @@ func (c *Client) Pub(channel string, v interface{}) (uuid.UUID, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := c.doWrite(m); err != nil {
+	m.Meta.P = priority
+	if err := c.doWrite(ctx, m); err != nil {
 		return nil, err
 	}
 	return m.UUID(), nil
@@ -301,8 +744,18 @@ func (c *Client) Pub(channel string, v interface{}) (uuid.UUID, error) {
 
 // doWrite calls writeMsg and handles errors so that the connection is
 // marked as failed if the error is fatal.
-func (c *Client) doWrite(m message.Msg) error {
-	err := c.writeMsg(m)
+func (c *Client) doWrite(ctx context.Context, m message.Msg) error {
+	// register the request before sending it, as the ACK may be
+	// received before writeMsg returns.
+	key := ackKey(m)
+	if key != "" {
+		c.addAck(ctx, key)
+	}
+
+	err := c.writeMsg(ctx, m)
+	if err != nil && key != "" {
+		c.deleteAck(key)
+	}
 	switch err {
 	case wswriter.ErrWriteLimitExceeded,
 		wswriter.ErrWriteLockTimeout:
@@ -315,15 +768,37 @@ func (c *Client) doWrite(m message.Msg) error {
 	return err
 }
 
-func (c *Client) writeMsg(m message.Msg) error {
-	w := wswriter.Exclusive(c.conn, c.wmu, c.acquireWriteLockTimeout, c.writeTimeout)
-	defer w.Close()
+func (c *Client) writeMsg(ctx context.Context, m message.Msg) (err error) {
+	if c.compression != "" {
+		if cm, err := message.Compress(m, c.compression, c.compressThreshold); err == nil {
+			m = cm
+		}
+	}
+
+	conn := c.wsConn()
+	codec := message.CodecFor(conn.Subprotocol())
+	w := wswriter.ExclusiveContext(ctx, conn, wswriter.MessageType(codec.Binary()), c.wmu, c.acquireWriteLockTimeout, c.writeTimeout)
+	defer func() {
+		// with permessage-deflate, the compressed frames may only be
+		// flushed by Close, so its error must be reported too.
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}()
 
 	lw := io.Writer(w)
 	if l := c.writeLimit; l > 0 {
 		lw = wswriter.Limit(w, l)
 	}
-	return json.NewEncoder(lw).Encode(m)
+	if codec == message.JSONCodec {
+		return json.NewEncoder(lw).Encode(m)
+	}
+	b, err := codec.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = lw.Write(b)
+	return err
 }
 
 // Handler defines the method required to handle a message received
@@ -391,6 +866,7 @@ func SetAcquireWriteLockTimeout(timeout time.Duration) Option {
 // should be closed.
 func SetReadLimit(limit int64) Option {
 	return func(c *Client) {
+		c.readLimit = limit
 		c.conn.SetReadLimit(limit)
 	}
 }
@@ -404,6 +880,106 @@ func SetWriteLimit(limit int64) Option {
 	}
 }
 
+// SetCompression sets the compression encoding (see message.Gzip and
+// message.Deflate) used to compress the arguments of CALL and PUB
+// messages larger than threshold bytes. Compressed messages received
+// from the server are always decompressed. To enable compression of
+// the messages sent by the server, set the Juggler-Compression header
+// on the Dial request.
+func SetCompression(enc string, threshold int) Option {
+	return func(c *Client) {
+		c.compression = enc
+		c.compressThreshold = threshold
+	}
+}
+
+// SetWriteCompression sets whether the messages sent on the connection
+// are compressed with the permessage-deflate websocket extension, and
+// the flate compression level to use, from -2 (flate.HuffmanOnly) to
+// 9 (flate.BestCompression). A level of 0 uses the default level of
+// the websocket package. The extension must be negotiated with the
+// server by setting EnableCompression on the websocket.Dialer, in
+// which case the messages are compressed by default. Compressed
+// messages received from the server are always decompressed, and the
+// read and write limits apply to the uncompressed size of the
+// messages.
+func SetWriteCompression(enabled bool, level int) Option {
+	return func(c *Client) {
+		c.writeCompression = enabled
+		c.compressionLevel = level
+		c.setCompression(c.conn)
+	}
+}
+
+// setCompression sets the permessage-deflate options of the client on
+// conn.
+func (c *Client) setCompression(conn *websocket.Conn) {
+	conn.EnableWriteCompression(c.writeCompression)
+	if c.compressionLevel != 0 {
+		// only fails if the level is invalid, the default is used then
+		conn.SetCompressionLevel(c.compressionLevel)
+	}
+}
+
+// SetBlobResolver sets the function used to resolve the blob references
+// of the RES and EVNT messages whose arguments were offloaded by the
+// server (see juggler.Server.OffloadThreshold). The function is called
+// before the message is sent to the handler, with the reference of the
+// blob, and returns the arguments. It blocks the processing of the
+// messages received on the connection, so it should use a timeout. See
+// HTTPBlobResolver for a resolver that uses an HTTP endpoint served by
+// juggler.BlobHandler. To enable offloading of the messages sent by the
+// server, set the Juggler-Offload header to "blob" on the Dial request.
+func SetBlobResolver(fn func(ref string) ([]byte, error)) Option {
+	return func(c *Client) {
+		c.resolveBlob = fn
+	}
+}
+
+// SetEventDedup sets the size of the window of the most recent events
+// remembered by the client, so that an EVNT that is delivered more
+// than once (identified by the UUID of its PUB message) is sent only
+// once to the handler. The default of 0 disables the deduplication.
+func SetEventDedup(size int) Option {
+	return func(c *Client) {
+		if size > 0 {
+			c.eventDedup = newEventDedup(size)
+		} else {
+			c.eventDedup = nil
+		}
+	}
+}
+
+// HTTPBlobResolver returns a blob resolver function that can be set
+// with SetBlobResolver, that fetches the blobs using client from the
+// HTTP endpoint at urlStr, as served by juggler.BlobHandler. If client
+// is nil, http.DefaultClient is used.
+func HTTPBlobResolver(client *http.Client, urlStr string) func(string) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ref string) ([]byte, error) {
+		u, err := url.Parse(urlStr)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Set("ref", ref)
+		u.RawQuery = q.Encode()
+
+		res, err := client.Get(u.String())
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("juggler/client: failed to get blob %s: %s", ref, res.Status)
+		}
+		return ioutil.ReadAll(res.Body)
+	}
+}
+
 // Exp is an expired call message. It is never sent over the network, but
 // it is raised by the client for itself, when the timeout for a call
 // result has expired. As such, its message type returns false for
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"sync"
@@ -12,9 +13,9 @@ import (
 
 	"golang.org/x/net/context"
 
-	"github.com/mna/juggler/internal/wstest"
 	"github.com/mna/juggler/internal/wswriter"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/wstest"
 	"github.com/gorilla/websocket"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
@@ -212,6 +213,229 @@ func TestClientHandler(t *testing.T) {
 	}
 }
 
+func TestClientFuture(t *testing.T) {
+	done := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			m, err := message.UnmarshalRequest(r)
+			if !assert.NoError(t, err, "UnmarshalRequest") {
+				return
+			}
+
+			call := m.(*message.Call)
+			var resp message.Msg
+			switch call.Payload.URI {
+			case "ok":
+				resp = message.NewRes(&message.ResPayload{
+					MsgUUID: call.UUID(),
+					URI:     call.Payload.URI,
+					Args:    []byte(`"ok"`),
+				})
+			case "ko":
+				resp = message.NewNack(call, 404, io.EOF)
+			case "delay":
+				resp = message.NewAck(call)
+			case "close":
+				return
+			}
+			if !assert.NoError(t, c.WriteJSON(resp), "WriteJSON") {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	// no handler set, only futures
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil)
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	res, err := cli.CallSync("ok", nil, time.Second)
+	if assert.NoError(t, err, "CallSync ok") {
+		assert.Equal(t, `"ok"`, string(res.Payload.Args), "result")
+	}
+
+	_, err = cli.CallSync("ko", nil, time.Second)
+	assert.True(t, errors.Is(err, ErrNacked), "ko is ErrNacked")
+	var nerr *NackError
+	if assert.True(t, errors.As(err, &nerr), "ko is *NackError") {
+		assert.Equal(t, 404, nerr.StatusCode(), "NACK code")
+		assert.Equal(t, "ko", nerr.URI, "NACK URI")
+		assert.Equal(t, message.ErrCodeNotFound, nerr.ErrCode, "NACK error code")
+		assert.False(t, nerr.Temporary(), "NACK not retryable")
+	}
+
+	f, err := cli.CallFuture("delay", nil, 10*time.Millisecond)
+	require.NoError(t, err, "CallFuture delay")
+	select {
+	case <-f.Done():
+	case <-time.After(time.Second):
+		require.FailNow(t, "future not done")
+	}
+	_, err = f.Result()
+	assert.Equal(t, ErrExpired, err, "delay expired")
+	assert.False(t, errors.Is(err, ErrTransport), "delay is not a transport error")
+
+	_, err = cli.CallSync("close", nil, time.Second)
+	assert.True(t, errors.Is(err, ErrTransport), "close is ErrTransport")
+	assert.False(t, errors.Is(err, ErrNacked), "close is not ErrNacked")
+	<-done
+
+	_, err = cli.CallSync("ok", nil, time.Second)
+	assert.True(t, errors.Is(err, ErrTransport), "call after close is ErrTransport")
+}
+
+func TestClientRetry(t *testing.T) {
+	done := make(chan bool, 1)
+	var (
+		mu       sync.Mutex
+		attempts = make(map[string]int)
+		keys     = make(map[string]string)
+	)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			m, err := message.UnmarshalRequest(r)
+			if !assert.NoError(t, err, "UnmarshalRequest") {
+				return
+			}
+
+			call := m.(*message.Call)
+			mu.Lock()
+			attempts[call.Payload.URI]++
+			n := attempts[call.Payload.URI]
+			keys[call.Payload.URI] = call.IdempotencyKey()
+			mu.Unlock()
+
+			var resp message.Msg
+			switch {
+			case call.Payload.URI == "nack" && n < 3:
+				resp = message.NewNack(call, 503, io.EOF)
+			case call.Payload.URI == "expire" && n < 2:
+				resp = message.NewAck(call)
+			case call.Payload.URI == "404" || call.Payload.URI == "expire":
+				resp = message.NewNack(call, 404, io.EOF)
+			default:
+				resp = message.NewRes(&message.ResPayload{
+					MsgUUID: call.UUID(),
+					URI:     call.Payload.URI,
+					Args:    []byte(`"ok"`),
+				})
+			}
+			if !assert.NoError(t, c.WriteJSON(resp), "WriteJSON") {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	var nacks int64
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {
+		if m.Type() == message.NackMsg {
+			mu.Lock()
+			nacks++
+			mu.Unlock()
+		}
+	})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h),
+		SetRetryPolicy(RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	f, err := cli.CallFuture("nack", nil, time.Second)
+	require.NoError(t, err, "CallFuture nack")
+	if res, err := f.Result(); assert.NoError(t, err, "nack is retried") {
+		assert.Equal(t, `"ok"`, string(res.Payload.Args), "result")
+	}
+
+	_, err = cli.CallSync("404", nil, time.Second)
+	assert.True(t, errors.Is(err, ErrNacked), "404 is not retried")
+
+	_, err = cli.CallSync("expire", nil, 20*time.Millisecond)
+	assert.True(t, errors.Is(err, ErrNacked), "expired call is retried")
+
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{"nack": 3, "404": 1, "expire": 2}, attempts, "attempts")
+	assert.Equal(t, f.UUID.String(), keys["nack"], "idempotency key")
+	assert.Equal(t, int64(2), nacks, "NACKs sent to the handler")
+}
+
+func TestClientLatency(t *testing.T) {
+	done := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			m, err := message.UnmarshalRequest(r)
+			if !assert.NoError(t, err, "UnmarshalRequest") {
+				return
+			}
+
+			call := m.(*message.Call)
+			if !assert.NoError(t, c.WriteJSON(message.NewAck(call)), "WriteJSON ACK") {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+			res := message.NewRes(&message.ResPayload{
+				MsgUUID: call.UUID(),
+				URI:     call.Payload.URI,
+				Args:    []byte(`"ok"`),
+			})
+			if !assert.NoError(t, c.WriteJSON(res), "WriteJSON RES") {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	lats := make(chan CallLatency, 2)
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {
+		if m.Type() == message.ResMsg {
+			lat, ok := LatencyFromContext(ctx)
+			assert.True(t, ok, "latency in context")
+			lats <- lat
+		}
+	})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	f, err := cli.CallFuture("a", nil, time.Second)
+	require.NoError(t, err, "CallFuture")
+	_, err = f.Result()
+	require.NoError(t, err, "Result")
+
+	lat := f.Latency()
+	assert.False(t, lat.Sent.IsZero(), "sent")
+	assert.True(t, lat.Ack > 0, "ack latency")
+	assert.True(t, lat.Res >= 10*time.Millisecond, "res latency")
+	assert.True(t, lat.Res > lat.Ack, "res after ack")
+
+	select {
+	case hlat := <-lats:
+		assert.Equal(t, lat, hlat, "handler latency")
+	case <-time.After(time.Second):
+		assert.Fail(t, "no RES handled")
+	}
+
+	stats := cli.Latencies()
+	assert.Equal(t, int64(1), stats.Ack.Count, "ack count")
+	assert.Equal(t, int64(1), stats.Res.Count, "res count")
+	assert.Equal(t, lat.Res, stats.Res.Mean(), "res mean")
+	assert.Equal(t, lat.Res, stats.Res.Max, "res max")
+}
+
 func TestClientSend(t *testing.T) {
 	var buf bytes.Buffer
 	done := make(chan bool, 1)
@@ -322,3 +546,587 @@ func TestClientConcurrent(t *testing.T) {
 	<-done
 	<-cli.CloseNotify()
 }
+
+func TestErrorResult(t *testing.T) {
+	cases := []struct {
+		args  string
+		isErr bool
+		want  *ResultError
+	}{
+		{`{"error":{"message":"a"}}`, false, nil},
+		{`{"error":{"message":"a"}}`, true, &ResultError{URI: "u", Message: "a"}},
+		{`{"error":{"message":"b","code":3,"details":{"x":1}}}`, true,
+			&ResultError{URI: "u", Message: "b", Code: 3, Details: json.RawMessage(`{"x":1}`)}},
+		{`"custom"`, true, &ResultError{URI: "u", Message: `"custom"`}},
+	}
+	for i, c := range cases {
+		res := message.NewRes(&message.ResPayload{URI: "u", Args: json.RawMessage(c.args), Error: c.isErr})
+		got, ok := ErrorResult(res)
+		assert.Equal(t, c.isErr, ok, "%d: is error", i)
+		assert.Equal(t, c.want, got, "%d: error", i)
+	}
+}
+
+func TestClientEventDedup(t *testing.T) {
+	pub := uuid.NewRandom()
+	evnts := []*message.Evnt{
+		message.NewEvnt(&message.EvntPayload{MsgUUID: pub, Channel: "a"}),
+		message.NewEvnt(&message.EvntPayload{MsgUUID: pub, Channel: "a"}),
+		message.NewEvnt(&message.EvntPayload{MsgUUID: pub, Channel: "a", Pattern: "a*"}),
+		message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "a"}),
+	}
+
+	done := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		for _, m := range evnts {
+			if !assert.NoError(t, c.WriteJSON(m), "WriteJSON EVNT") {
+				return
+			}
+		}
+		// wait for the client to close the connection
+		c.ReadMessage()
+	})
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var got []uuid.UUID
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {
+		mu.Lock()
+		got = append(got, m.UUID())
+		mu.Unlock()
+	})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h), SetEventDedup(10))
+	require.NoError(t, err, "Dial")
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, cli.Close(), "Close")
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.ElementsMatch(t, []uuid.UUID{evnts[0].UUID(), evnts[2].UUID(), evnts[3].UUID()}, got, "events")
+}
+
+func TestClientWaitForAck(t *testing.T) {
+	done := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			m, err := message.UnmarshalRequest(r)
+			if !assert.NoError(t, err, "UnmarshalRequest") {
+				return
+			}
+
+			var resp message.Msg
+			switch m := m.(type) {
+			case *message.Sub:
+				if m.Payload.Channel == "ko" {
+					resp = message.NewNack(m, 403, io.EOF)
+				} else {
+					resp = message.NewAck(m)
+				}
+			case *message.Pub:
+				return
+			case *message.Unsb:
+				// no response
+				continue
+			}
+			if !assert.NoError(t, c.WriteJSON(resp), "WriteJSON") {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil)
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	id, err := cli.Sub("ok", false)
+	require.NoError(t, err, "Sub ok")
+	assert.NoError(t, cli.WaitForAck(ctx, id), "WaitForAck ok")
+	assert.NoError(t, cli.WaitForAck(ctx, id), "WaitForAck ok again")
+
+	id, err = cli.Sub("ko", false)
+	require.NoError(t, err, "Sub ko")
+	err = cli.WaitForAck(ctx, id)
+	var nerr *NackError
+	if assert.True(t, errors.As(err, &nerr), "ko is *NackError") {
+		assert.Equal(t, 403, nerr.StatusCode(), "NACK code")
+		assert.Equal(t, "ko", nerr.Channel, "NACK channel")
+	}
+
+	assert.Equal(t, ErrUnknownRequest, cli.WaitForAck(ctx, uuid.NewRandom()), "unknown request")
+
+	id, err = cli.Unsb("none", false)
+	require.NoError(t, err, "Unsb")
+	sctx, scancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer scancel()
+	assert.Equal(t, context.DeadlineExceeded, cli.WaitForAck(sctx, id), "no response")
+
+	id, err = cli.Pub("close", nil)
+	require.NoError(t, err, "Pub")
+	<-done
+	assert.True(t, errors.Is(cli.WaitForAck(ctx, id), ErrTransport), "close is ErrTransport")
+	assert.True(t, errors.Is(cli.WaitForAck(ctx, id), ErrTransport), "close is ErrTransport")
+}
+
+func TestClientReconnect(t *testing.T) {
+	var mu sync.Mutex
+	var nconn int
+	subs := make(chan string, 10)
+	lastIDs := make(chan string, 10)
+
+	done := make(chan bool, 10)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		mu.Lock()
+		nconn++
+		n := nconn
+		mu.Unlock()
+
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			m, err := message.UnmarshalRequest(r)
+			if !assert.NoError(t, err, "UnmarshalRequest") {
+				return
+			}
+			switch m := m.(type) {
+			case *message.Sub:
+				subs <- m.Payload.Channel
+				lastIDs <- m.Payload.LastEventID
+				if !assert.NoError(t, c.WriteJSON(message.NewAck(m)), "WriteJSON") {
+					return
+				}
+				if n == 1 && m.Payload.Channel == "a" {
+					// event of a durable channel, replayed after the reconnection
+					ev := message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "a", EventID: "5-0"})
+					if !assert.NoError(t, c.WriteJSON(ev), "WriteJSON") {
+						return
+					}
+				}
+			case *message.Call:
+				if n == 1 {
+					// drop the first connection while the call is pending
+					return
+				}
+			}
+		}
+	})
+	defer srv.Close()
+
+	states := make(chan ConnState, 10)
+	exps := make(chan *Exp, 10)
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {
+		if exp, ok := m.(*Exp); ok {
+			exps <- exp
+		}
+	})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h),
+		SetReconnect(nil, time.Millisecond, 10*time.Millisecond),
+		SetConnStateHandler(func(st ConnState) { states <- st }))
+	require.NoError(t, err, "Dial")
+
+	_, err = cli.Sub("a", false)
+	require.NoError(t, err, "Sub a")
+	_, err = cli.Sub("b", false)
+	require.NoError(t, err, "Sub b")
+	_, err = cli.Unsb("b", false)
+	require.NoError(t, err, "Unsb b")
+	assert.Equal(t, "a", <-subs, "sub a")
+	assert.Equal(t, "b", <-subs, "sub b")
+	assert.Equal(t, "", <-lastIDs, "sub a last event ID")
+	assert.Equal(t, "", <-lastIDs, "sub b last event ID")
+
+	f, err := cli.CallFuture("x", nil, time.Minute)
+	require.NoError(t, err, "CallFuture")
+	<-done
+
+	// the pending call is expired
+	_, err = f.Result()
+	assert.Equal(t, ErrExpired, err, "call expired")
+	select {
+	case exp := <-exps:
+		assert.Equal(t, f.UUID, exp.Payload.For, "EXP for the call")
+	case <-time.After(time.Second):
+		assert.Fail(t, "no EXP received")
+	}
+
+	// the client reconnects and re-subscribes
+	assert.Equal(t, Disconnected, <-states, "disconnected")
+	assert.Equal(t, Connected, <-states, "connected")
+	select {
+	case ch := <-subs:
+		assert.Equal(t, "a", ch, "re-subscribed")
+		assert.Equal(t, "5-0", <-lastIDs, "re-subscribed with last event ID")
+	case <-time.After(time.Second):
+		assert.Fail(t, "no re-subscription")
+	}
+	select {
+	case <-cli.CloseNotify():
+		assert.Fail(t, "client closed")
+	default:
+	}
+
+	_, err = cli.Call("y", nil, time.Second)
+	assert.NoError(t, err, "Call after reconnect")
+
+	require.NoError(t, cli.Close(), "Close")
+	assert.Equal(t, Closed, <-states, "closed")
+	<-done
+	mu.Lock()
+	assert.Equal(t, 2, nconn, "connections")
+	mu.Unlock()
+	assert.Equal(t, 0, len(subs), "no more subscriptions")
+}
+
+func TestClientCallWait(t *testing.T) {
+	done := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			m, err := message.UnmarshalRequest(r)
+			if !assert.NoError(t, err, "UnmarshalRequest") {
+				return
+			}
+
+			call := m.(*message.Call)
+			var resp message.Msg
+			switch call.Payload.URI {
+			case "ok", "err":
+				resp = message.NewRes(&message.ResPayload{
+					MsgUUID: call.UUID(),
+					URI:     call.Payload.URI,
+					Args:    call.Payload.Args,
+					Error:   call.Payload.URI == "err",
+				})
+			case "ko":
+				resp = message.NewNack(call, 404, io.EOF)
+			case "delay":
+				resp = message.NewAck(call)
+			}
+			if !assert.NoError(t, c.WriteJSON(resp), "WriteJSON") {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil)
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	ctx := context.Background()
+	res, err := cli.CallWait(ctx, "ok", 3)
+	if assert.NoError(t, err, "CallWait ok") {
+		assert.Equal(t, `3`, string(res), "result")
+	}
+
+	var n int
+	if assert.NoError(t, cli.CallInto(ctx, "ok", 4, &n), "CallInto ok") {
+		assert.Equal(t, 4, n, "decoded result")
+	}
+
+	_, err = cli.CallWait(ctx, "err", map[string]interface{}{"error": map[string]interface{}{"message": "fail", "code": 5}})
+	var rerr *ResultError
+	if assert.True(t, errors.As(err, &rerr), "err is *ResultError") {
+		assert.Equal(t, 5, rerr.Code, "error code")
+		assert.Equal(t, "fail", rerr.Message, "error message")
+	}
+
+	_, err = cli.CallWait(ctx, "ko", nil)
+	assert.True(t, errors.Is(err, ErrNacked), "ko is ErrNacked")
+
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = cli.CallWait(tctx, "delay", nil)
+	assert.True(t, err == ErrExpired || err == context.DeadlineExceeded, "delay is expired")
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = cli.CallWait(cctx, "delay", nil)
+	assert.Equal(t, context.Canceled, err, "canceled")
+}
+
+type ctxKey int
+
+func TestClientContext(t *testing.T) {
+	done := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			m, err := message.UnmarshalRequest(r)
+			if !assert.NoError(t, err, "UnmarshalRequest") {
+				return
+			}
+
+			resps := []message.Msg{message.NewAck(m)}
+			if call, ok := m.(*message.Call); ok && call.Payload.URI == "ok" {
+				resps = append(resps, message.NewRes(&message.ResPayload{
+					MsgUUID: call.UUID(),
+					URI:     call.Payload.URI,
+					Args:    call.Payload.Args,
+				}))
+			}
+			for _, resp := range resps {
+				if !assert.NoError(t, c.WriteJSON(resp), "WriteJSON") {
+					return
+				}
+			}
+		}
+	})
+	defer srv.Close()
+
+	var mu sync.Mutex
+	vals := make(map[string]interface{})
+	h := HandlerFunc(func(ctx context.Context, m message.Msg) {
+		key := m.Type().String()
+		if ack, ok := m.(*message.Ack); ok {
+			key += "." + ack.Payload.ForType.String()
+		}
+		mu.Lock()
+		vals[key] = ctx.Value(ctxKey(0))
+		mu.Unlock()
+	})
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	// a canceled context fails the write, but not the connection
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cli.CallContext(cctx, "ok", 1, time.Second)
+	assert.Equal(t, context.Canceled, err, "canceled Call")
+	_, err = cli.PubContext(cctx, "a", 1)
+	assert.Equal(t, context.Canceled, err, "canceled Pub")
+
+	ctx := context.WithValue(context.Background(), ctxKey(0), "v")
+	_, err = cli.CallContext(ctx, "ok", 1, time.Second)
+	require.NoError(t, err, "Call ok")
+	_, err = cli.CallContext(ctx, "delay", 1, 10*time.Millisecond)
+	require.NoError(t, err, "Call delay")
+	_, err = cli.SubContext(ctx, "a", false)
+	require.NoError(t, err, "Sub")
+	_, err = cli.Pub("b", 1)
+	require.NoError(t, err, "Pub")
+
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]interface{}{
+		"ACK.CALL": "v",
+		"RES":      "v",
+		"EXP":      "v",
+		"ACK.SUB":  "v",
+		"ACK.PUB":  nil,
+	}, vals, "context values")
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	var mu sync.Mutex
+	var pings int
+	answer := make(chan bool, 2)
+	answer <- true
+	answer <- false
+
+	done := make(chan bool, 2)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		ok := <-answer
+		c.SetPingHandler(func(data string) error {
+			mu.Lock()
+			pings++
+			mu.Unlock()
+			if !ok {
+				return nil
+			}
+			return c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		for {
+			if _, _, err := c.NextReader(); err != nil {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	// the server answers the pings, the connection stays open
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil, SetKeepAlive(5*time.Millisecond, 20*time.Millisecond))
+	require.NoError(t, err, "Dial")
+	select {
+	case <-cli.CloseNotify():
+		require.FailNow(t, "client closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	mu.Lock()
+	assert.True(t, pings > 0, "pings received")
+	mu.Unlock()
+	require.NoError(t, cli.Close(), "Close")
+	<-done
+
+	// the server doesn't answer the pings, the connection is closed
+	cli, err = Dial(&websocket.Dialer{}, srv.URL, nil, SetKeepAlive(5*time.Millisecond, 20*time.Millisecond))
+	require.NoError(t, err, "Dial")
+	select {
+	case <-cli.CloseNotify():
+	case <-time.After(time.Second):
+		require.FailNow(t, "client not closed")
+	}
+	<-done
+}
+
+func TestEndpoints(t *testing.T) {
+	dead := wstest.StartServer(t, nil, func(c *websocket.Conn) {})
+	dead.Close()
+
+	done := make(chan bool, 10)
+	serve := func(c *websocket.Conn) {
+		// drop the connection on the first message
+		c.NextReader()
+	}
+	srvA := wstest.StartServer(t, done, serve)
+	defer srvA.Close()
+	srvB := wstest.StartServer(t, done, serve)
+	defer srvB.Close()
+
+	e := &Endpoints{URLs: []string{dead.URL, srvA.URL, srvB.URL}, Strategy: LeastConns}
+	want := func(a, b int) map[string]int {
+		return map[string]int{dead.URL: 0, srvA.URL: a, srvB.URL: b}
+	}
+
+	// the dead endpoint is skipped, and the connections are distributed
+	cli1, err := e.Dial(&websocket.Dialer{}, nil)
+	require.NoError(t, err, "Dial 1")
+	assert.Equal(t, want(1, 0), e.Conns(), "after Dial 1")
+	cli2, err := e.Dial(&websocket.Dialer{}, nil)
+	require.NoError(t, err, "Dial 2")
+	assert.Equal(t, want(1, 1), e.Conns(), "after Dial 2")
+
+	require.NoError(t, cli1.Close(), "Close 1")
+	<-done
+	assert.Equal(t, want(0, 1), e.Conns(), "after Close 1")
+
+	// when the connection to A fails and A is down, the client fails over to B
+	states := make(chan ConnState, 10)
+	cli3, err := e.Dial(&websocket.Dialer{}, nil,
+		SetReconnect(nil, time.Millisecond, 10*time.Millisecond),
+		SetConnStateHandler(func(st ConnState) { states <- st }))
+	require.NoError(t, err, "Dial 3")
+	assert.Equal(t, want(1, 1), e.Conns(), "after Dial 3")
+
+	srvA.Close()
+	_, err = cli3.Call("a", nil, time.Second)
+	require.NoError(t, err, "Call")
+	<-done
+	assert.Equal(t, Disconnected, <-states, "disconnected")
+	select {
+	case st := <-states:
+		assert.Equal(t, Connected, st, "connected")
+	case <-time.After(time.Second):
+		require.FailNow(t, "no reconnection")
+	}
+	assert.Equal(t, want(0, 2), e.Conns(), "after failover")
+
+	require.NoError(t, cli2.Close(), "Close 2")
+	require.NoError(t, cli3.Close(), "Close 3")
+	<-done
+	<-done
+	assert.Equal(t, want(0, 0), e.Conns(), "after Close")
+
+	// all endpoints failed
+	e = &Endpoints{URLs: []string{dead.URL}}
+	if _, err := e.Dial(&websocket.Dialer{}, nil); assert.Error(t, err, "Dial dead") {
+		assert.Contains(t, err.Error(), "failed to connect", "Dial dead error")
+	}
+}
+
+func TestClientSubscribe(t *testing.T) {
+	reqs := make(chan message.Msg, 10)
+	done := make(chan bool, 1)
+	srv := wstest.StartServer(t, done, func(c *websocket.Conn) {
+		for {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return
+			}
+			m, err := message.UnmarshalRequest(r)
+			if !assert.NoError(t, err, "UnmarshalRequest") {
+				return
+			}
+			reqs <- m
+			if m.Type() != message.SubMsg {
+				continue
+			}
+			evnts := []*message.Evnt{
+				message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "a"}),
+				message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "a", Pattern: "a*"}),
+				message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "b"}),
+			}
+			for _, ev := range evnts {
+				if !assert.NoError(t, c.WriteJSON(ev), "WriteJSON EVNT") {
+					return
+				}
+			}
+		}
+	})
+	defer srv.Close()
+
+	var mu sync.Mutex
+	got := make(map[string][]string)
+	record := func(name string) EventFunc {
+		return func(ev *message.EvntPayload) {
+			mu.Lock()
+			got[name] = append(got[name], ev.Channel+":"+ev.Pattern)
+			mu.Unlock()
+		}
+	}
+
+	cli, err := Dial(&websocket.Dialer{}, srv.URL, nil)
+	require.NoError(t, err, "Dial")
+
+	s1, err := cli.Subscribe("a", false, record("s1"))
+	require.NoError(t, err, "Subscribe s1")
+	s2, err := cli.Subscribe("a", false, record("s2"))
+	require.NoError(t, err, "Subscribe s2")
+
+	// a single SUB is sent for the channel
+	m := <-reqs
+	if assert.Equal(t, message.SubMsg, m.Type(), "SUB") {
+		assert.Equal(t, "a", m.(*message.Sub).Payload.Channel, "SUB channel")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, map[string][]string{"s1": {"a:"}, "s2": {"a:"}}, got, "events")
+	mu.Unlock()
+
+	// the UNSB is only sent once the last callback is removed
+	require.NoError(t, s1.Unsubscribe(), "Unsubscribe s1")
+	require.NoError(t, s1.Unsubscribe(), "Unsubscribe s1 again")
+	select {
+	case m := <-reqs:
+		assert.Fail(t, "unexpected request", "%s", m.Type())
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, s2.Unsubscribe(), "Unsubscribe s2")
+	m = <-reqs
+	if assert.Equal(t, message.UnsbMsg, m.Type(), "UNSB") {
+		assert.Equal(t, "a", m.(*message.Unsb).Payload.Channel, "UNSB channel")
+	}
+
+	require.NoError(t, cli.Close(), "Close")
+	<-done
+}
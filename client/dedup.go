@@ -0,0 +1,44 @@
+package client
+
+import (
+	"container/list"
+
+	"github.com/mna/juggler/message"
+)
+
+// eventDedup is the window of the most recent events received by the
+// client, used to drop the events that are delivered more than once.
+// It is only used by the read loop, so it is not safe for concurrent
+// use.
+type eventDedup struct {
+	max  int
+	ll   *list.List
+	keys map[string]*list.Element
+}
+
+func newEventDedup(max int) *eventDedup {
+	return &eventDedup{
+		max:  max,
+		ll:   list.New(),
+		keys: make(map[string]*list.Element, max),
+	}
+}
+
+// seen records the event m and returns true if it was already in the
+// window. An event is identified by the UUID of its PUB and by the
+// pattern of its subscription, so that an event received for both a
+// channel and a pattern subscription is not a duplicate.
+func (d *eventDedup) seen(m *message.Evnt) bool {
+	key := m.Payload.For.String() + ":" + m.Payload.Pattern
+	if e, ok := d.keys[key]; ok {
+		d.ll.MoveToFront(e)
+		return true
+	}
+	d.keys[key] = d.ll.PushFront(key)
+	if d.ll.Len() > d.max {
+		e := d.ll.Back()
+		d.ll.Remove(e)
+		delete(d.keys, e.Value.(string))
+	}
+	return false
+}
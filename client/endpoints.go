@@ -0,0 +1,194 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Strategy is the strategy used by Endpoints to select the server
+// URL of a new connection.
+type Strategy int
+
+// The list of supported strategies.
+const (
+	// RoundRobin selects the server URLs in turn. It is the default.
+	RoundRobin Strategy = iota
+
+	// LeastConns selects the server URL with the fewest connections
+	// established by the Endpoints, in turn if many have the same
+	// number of connections.
+	LeastConns
+)
+
+// DefaultFailureBackoff is the default time during which a server URL
+// that failed to connect is skipped by Endpoints.
+var DefaultFailureBackoff = 5 * time.Second
+
+// Endpoints is a set of juggler server URLs, e.g. of a fleet of
+// servers behind no load balancer, to which the clients created with
+// its Dial method are connected. The connections are distributed over
+// the URLs according to the Strategy. A URL that fails to connect is
+// skipped for FailureBackoff (DefaultFailureBackoff if it is 0) and
+// the next one is tried, so that the clients fail over transparently
+// to the healthy servers, both when they are created and when they
+// reconnect. If all URLs are failed, they are all tried anyway.
+//
+// The fields should not be updated once the Endpoints is in use. It is
+// safe for concurrent use.
+type Endpoints struct {
+	URLs           []string
+	Strategy       Strategy
+	FailureBackoff time.Duration
+
+	mu     sync.Mutex
+	next   int
+	conns  []int
+	failed []time.Time // time until which each URL is skipped
+}
+
+// Dial creates a Client connected to one of the URLs using the
+// provided *websocket.Dialer and request headers, as Dial does for a
+// single URL. Reconnection is enabled with the default backoff delays
+// (see SetReconnect), and the client reconnects to the next URL
+// selected by the Strategy. It can be overridden by a SetReconnect in
+// opts, but the dial function of that option must be nil for the
+// client to keep using the Endpoints.
+//
+// It returns an error if none of the URLs could be connected.
+func (e *Endpoints) Dial(d *websocket.Dialer, reqHeader http.Header, opts ...Option) (*Client, error) {
+	cur := -1
+	dial := func() (*websocket.Conn, error) {
+		conn, i, err := e.dial(d, reqHeader)
+		if err != nil {
+			return nil, err
+		}
+		// the previous connection of the client is closed when it dials
+		// again, so it is not counted anymore.
+		e.release(cur)
+		cur = i
+		return conn, nil
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	onClose := func(c *Client) {
+		c.onClose = func() { e.release(cur) }
+	}
+	return New(conn, append([]Option{setDefaultDial(dial), SetReconnect(nil, 0, 0), onClose}, opts...)...), nil
+}
+
+// Conns returns the number of connections established by the clients
+// of the Endpoints, by URL.
+func (e *Endpoints) Conns() map[string]int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.init()
+
+	m := make(map[string]int, len(e.URLs))
+	for i, u := range e.URLs {
+		m[u] = e.conns[i]
+	}
+	return m
+}
+
+// init initializes the state of the endpoints. It must be called with
+// the lock held.
+func (e *Endpoints) init() {
+	if e.conns == nil {
+		e.conns = make([]int, len(e.URLs))
+		e.failed = make([]time.Time, len(e.URLs))
+	}
+}
+
+// dial connects to the first URL that succeeds in the order of the
+// strategy, and returns the connection along with the index of its URL.
+func (e *Endpoints) dial(d *websocket.Dialer, reqHeader http.Header) (*websocket.Conn, int, error) {
+	if len(e.URLs) == 0 {
+		return nil, -1, fmt.Errorf("juggler/client: no endpoint URL")
+	}
+
+	var lastErr error
+	for _, i := range e.order() {
+		conn, _, err := d.Dial(e.URLs[i], reqHeader)
+		if err != nil {
+			lastErr = err
+			e.fail(i)
+			continue
+		}
+		e.acquire(i)
+		return conn, i, nil
+	}
+	return nil, -1, fmt.Errorf("juggler/client: failed to connect to all endpoints: %v", lastErr)
+}
+
+// order returns the indices of the URLs in the order they should be
+// tried, with the failed URLs at the end.
+func (e *Endpoints) order() []int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.init()
+
+	n := len(e.URLs)
+	start := e.next % n
+	e.next++
+
+	// start with the round-robin order, then move the least loaded
+	// first if required, keeping the round-robin order for ties (stable
+	// insertion sort).
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = (start + i) % n
+	}
+	if e.Strategy == LeastConns {
+		for i := 1; i < n; i++ {
+			for j := i; j > 0 && e.conns[idx[j]] < e.conns[idx[j-1]]; j-- {
+				idx[j], idx[j-1] = idx[j-1], idx[j]
+			}
+		}
+	}
+
+	now := time.Now()
+	ok := make([]int, 0, n)
+	var failed []int
+	for _, i := range idx {
+		if now.Before(e.failed[i]) {
+			failed = append(failed, i)
+			continue
+		}
+		ok = append(ok, i)
+	}
+	return append(ok, failed...)
+}
+
+func (e *Endpoints) fail(i int) {
+	backoff := e.FailureBackoff
+	if backoff <= 0 {
+		backoff = DefaultFailureBackoff
+	}
+
+	e.mu.Lock()
+	e.failed[i] = time.Now().Add(backoff)
+	e.mu.Unlock()
+}
+
+func (e *Endpoints) acquire(i int) {
+	e.mu.Lock()
+	e.conns[i]++
+	e.failed[i] = time.Time{}
+	e.mu.Unlock()
+}
+
+func (e *Endpoints) release(i int) {
+	if i < 0 {
+		return
+	}
+	e.mu.Lock()
+	e.conns[i]--
+	e.mu.Unlock()
+}
@@ -0,0 +1,276 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// Sentinel errors that identify the class of failure of a call made
+// with CallFuture or CallSync. The errors returned by those methods
+// match one of them with errors.Is.
+var (
+	// ErrNacked is matched by a *NackError, returned when the server
+	// rejected the call with a NACK.
+	ErrNacked = errors.New("juggler: call rejected by the server")
+
+	// ErrExpired is returned when no result was received before the
+	// call timeout.
+	ErrExpired = errors.New("juggler: call expired")
+
+	// ErrTransport is matched by a *TransportError, returned when the
+	// call could not be sent or when the connection failed before the
+	// result was received.
+	ErrTransport = errors.New("juggler: transport failure")
+)
+
+// NackError is the error returned when the server rejected a call,
+// or a PUB, SUB or UNSB request (see WaitForAck), with a NACK. It
+// matches ErrNacked with errors.Is, and can be extracted with errors.As
+// to inspect the NACK code.
+type NackError struct {
+	For       uuid.UUID       // UUID of the request message
+	URI       string          // URI of the call
+	Channel   string          // channel of the PUB, SUB or UNSB request
+	Code      int             // NACK code, e.g. 404 for an unknown URI
+	Message   string          // NACK message
+	ErrCode   string          // machine-readable error code, e.g. message.ErrCodeUnavailable
+	Retryable bool            // true if the request may succeed if sent again later
+	Details   json.RawMessage // JSON-encoded details of the failure, if any
+}
+
+func newNackError(m *message.Nack) *NackError {
+	return &NackError{
+		For:       m.Payload.For,
+		URI:       m.Payload.URI,
+		Channel:   m.Payload.Channel,
+		Code:      m.Payload.Code,
+		Message:   m.Payload.Message,
+		ErrCode:   m.Payload.ErrCode,
+		Retryable: isRetryableNack(m),
+		Details:   m.Payload.Details,
+	}
+}
+
+// Error returns the error message of e.
+func (e *NackError) Error() string {
+	if e.URI == "" && e.Channel != "" {
+		return fmt.Sprintf("juggler: request on channel %s rejected: %d %s", e.Channel, e.Code, e.Message)
+	}
+	return fmt.Sprintf("juggler: call to %s rejected: %d %s", e.URI, e.Code, e.Message)
+}
+
+// StatusCode returns the NACK code of e.
+func (e *NackError) StatusCode() int {
+	return e.Code
+}
+
+// Temporary returns true if the request may succeed if it is sent
+// again later, e.g. because the server is overloaded, and false if it
+// was rejected e.g. because it is invalid.
+func (e *NackError) Temporary() bool {
+	return e.Retryable
+}
+
+// Is returns true if target is ErrNacked.
+func (e *NackError) Is(target error) bool {
+	return target == ErrNacked
+}
+
+// TransportError is the error returned when a call could not be sent
+// or when the connection failed before the result was received. It
+// matches ErrTransport with errors.Is, and wraps the underlying error.
+type TransportError struct {
+	Err error
+}
+
+// Error returns the error message of e.
+func (e *TransportError) Error() string {
+	return "juggler: transport failure: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error of e.
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is ErrTransport.
+func (e *TransportError) Is(target error) bool {
+	return target == ErrTransport
+}
+
+// Future is the pending result of a call made with CallFuture.
+type Future struct {
+	// UUID is the UUID of the CALL message.
+	UUID uuid.UUID
+
+	done chan struct{}
+	res  *message.Res
+	lat  CallLatency
+	err  error
+}
+
+func newFuture(id uuid.UUID) *Future {
+	return &Future{UUID: id, done: make(chan struct{})}
+}
+
+// complete sets the result of the future. It must be called only once.
+func (f *Future) complete(res *message.Res, lat CallLatency, err error) {
+	f.res, f.lat, f.err = res, lat, err
+	close(f.done)
+}
+
+// Done returns a channel that is closed when the result of the call
+// is available.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result waits for the result of the call and returns it. If the
+// call failed, it returns a *NackError, ErrExpired or a
+// *TransportError.
+func (f *Future) Result() (*message.Res, error) {
+	<-f.done
+	return f.res, f.err
+}
+
+// Latency waits for the result of the call and returns its latency.
+func (f *Future) Latency() CallLatency {
+	<-f.done
+	return f.lat
+}
+
+// CallFuture makes a call request like Call, and returns a Future
+// that can be used to wait for the result of the call. The RES, NACK
+// and EXP messages for this call are still sent to the Handler, if
+// one is set.
+func (c *Client) CallFuture(uri string, v interface{}, timeout time.Duration) (*Future, error) {
+	return c.callFuture(context.Background(), uri, v, timeout)
+}
+
+func (c *Client) callFuture(ctx context.Context, uri string, v interface{}, timeout time.Duration) (*Future, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, &TransportError{Err: err}
+	}
+
+	if timeout <= 0 {
+		timeout = c.callTimeout
+	}
+	m, err := message.NewCall(uri, v, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	key := m.UUID().String()
+	f := newFuture(m.UUID())
+	c.mu.Lock()
+	c.futures[key] = f
+	c.mu.Unlock()
+
+	if err := c.send(ctx, m, timeout); err != nil {
+		c.mu.Lock()
+		delete(c.futures, key)
+		c.mu.Unlock()
+		if ctxErr := ctx.Err(); ctxErr != nil && err == ctxErr {
+			return nil, err
+		}
+		return nil, &TransportError{Err: err}
+	}
+	return f, nil
+}
+
+// CallSync makes a call request like Call, and waits for its result.
+// If the call failed, it returns a *NackError, ErrExpired or a
+// *TransportError.
+func (c *Client) CallSync(uri string, v interface{}, timeout time.Duration) (*message.Res, error) {
+	f, err := c.CallFuture(uri, v, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return f.Result()
+}
+
+// CallWait makes a call request to the server for the remote procedure
+// identified by uri, with the JSON-encoded v value as arguments, and
+// blocks until its result is received. It returns the JSON-encoded
+// result on success. If the callee returned an error result, it
+// returns a *ResultError (see ErrorResult). Otherwise, if the call
+// failed, it returns a *NackError, ErrExpired or a *TransportError,
+// as CallSync does.
+//
+// If ctx has a deadline, the remaining time is used as timeout of the
+// call, otherwise Client.CallTimeout is used. If ctx is done before
+// the result is received, it returns ctx.Err(). As for CallContext, ctx
+// also bounds the write of the call request, and the context passed to
+// the Handler for the messages of the call is derived from it.
+func (c *Client) CallWait(ctx context.Context, uri string, v interface{}) (json.RawMessage, error) {
+	timeout, err := contextTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := c.callFuture(ctx, uri, v, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-f.Done():
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	res, err := f.Result()
+	if err != nil {
+		return nil, err
+	}
+	if re, ok := ErrorResult(res); ok {
+		return nil, re
+	}
+	return res.Payload.Args, nil
+}
+
+// CallInto is like CallWait, but it decodes the JSON-encoded result
+// into dst, which must be a pointer. It is used by the typed clients
+// generated by the juggler-gen command.
+func (c *Client) CallInto(ctx context.Context, uri string, v, dst interface{}) error {
+	b, err := c.CallWait(ctx, uri, v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+// completeFuture completes the future of the call identified by key,
+// if there is one.
+func (c *Client) completeFuture(key string, res *message.Res, lat CallLatency, err error) {
+	c.mu.Lock()
+	f := c.futures[key]
+	delete(c.futures, key)
+	c.mu.Unlock()
+
+	if f != nil {
+		f.complete(res, lat, err)
+	}
+}
+
+// failFutures completes all pending futures with err.
+func (c *Client) failFutures(err error) {
+	c.mu.Lock()
+	fs := c.futures
+	c.futures = make(map[string]*Future)
+	c.mu.Unlock()
+
+	for _, f := range fs {
+		f.complete(nil, CallLatency{}, &TransportError{Err: err})
+	}
+}
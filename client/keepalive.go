@@ -0,0 +1,79 @@
+package client
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/mna/juggler/internal/wswriter"
+	"github.com/gorilla/websocket"
+)
+
+// SetKeepAlive sets the interval at which websocket pings are sent to
+// the server to keep the connection alive, e.g. so that an idle
+// connection is not cut by a load balancer. If the pong of a ping is
+// not received before pongTimeout, the connection is considered failed
+// and is closed, and the client reconnects if reconnection is enabled
+// (see SetReconnect). A pongTimeout of 0 never closes the connection
+// for a missed pong. The pings are sent via the exclusive writer of
+// the connection (see SetAcquireWriteLockTimeout and SetWriteTimeout).
+// The default interval of 0 disables the pings.
+func SetKeepAlive(interval, pongTimeout time.Duration) Option {
+	return func(c *Client) {
+		c.pingInterval = interval
+		c.pongTimeout = pongTimeout
+	}
+}
+
+// handlePong records the time of the pong. It is set as pong handler
+// of the websocket connection, so it is called from the read loop.
+func (c *Client) handlePong(string) error {
+	atomic.StoreInt64(&c.lastPong, time.Now().UnixNano())
+	return nil
+}
+
+// keepAlive sends a websocket ping every pingInterval until the client
+// is closed, and closes the current connection if the pong of a ping is
+// not received before pongTimeout, if it is > 0.
+func (c *Client) keepAlive() {
+	// the ping must not block past the next one if there is no write
+	// timeout
+	writeTimeout := c.writeTimeout
+	if writeTimeout <= 0 {
+		writeTimeout = c.pingInterval
+	}
+
+	t := time.NewTicker(c.pingInterval)
+	defer t.Stop()
+
+	// the pong timer of the oldest ping without a pong, nil if none,
+	// along with the connection it was sent on.
+	var pongTimer <-chan time.Time
+	var pinged *websocket.Conn
+	var sent time.Time
+	for {
+		select {
+		case <-c.stop:
+			return
+
+		case <-pongTimer:
+			pongTimer = nil
+			conn := c.wsConn()
+			if conn == pinged && atomic.LoadInt64(&c.lastPong) < sent.UnixNano() {
+				// causes the read loop to fail, and to reconnect if enabled
+				conn.Close()
+			}
+
+		case now := <-t.C:
+			conn := c.wsConn()
+			if err := wswriter.Control(conn, websocket.PingMessage, nil, c.wmu,
+				c.acquireWriteLockTimeout, writeTimeout); err != nil {
+				// the read loop fails too if the connection is broken
+				continue
+			}
+			if c.pongTimeout > 0 && pongTimer == nil {
+				pinged, sent = conn, now
+				pongTimer = time.After(c.pongTimeout)
+			}
+		}
+	}
+}
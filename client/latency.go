@@ -0,0 +1,111 @@
+package client
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/message"
+)
+
+// CallLatency holds the latencies of a call, measured by the client.
+type CallLatency struct {
+	// Sent is the time at which the CALL message was sent.
+	Sent time.Time
+
+	// Ack is the duration between the send of the CALL and the
+	// reception of its ACK or NACK, 0 if none was received.
+	Ack time.Duration
+
+	// Res is the duration between the send of the CALL and the
+	// reception of its RES, 0 if none was received.
+	Res time.Duration
+}
+
+// DurationStats is an aggregate of durations.
+type DurationStats struct {
+	Count int64
+	Min   time.Duration
+	Max   time.Duration
+	Total time.Duration
+}
+
+// Mean returns the mean duration, or 0 if Count is 0.
+func (s DurationStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+func (s *DurationStats) add(d time.Duration) {
+	if s.Count == 0 || d < s.Min {
+		s.Min = d
+	}
+	if d > s.Max {
+		s.Max = d
+	}
+	s.Count++
+	s.Total += d
+}
+
+// LatencyStats is a snapshot of the aggregated latencies of the calls
+// made by a client, as returned by Client.Latencies.
+type LatencyStats struct {
+	Ack DurationStats // send to ACK or NACK
+	Res DurationStats // send to RES
+}
+
+// Latencies returns a snapshot of the aggregated latencies of the
+// calls made by the client.
+func (c *Client) Latencies() LatencyStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latencies
+}
+
+// pendingCall is a call for which a result is expected.
+type pendingCall struct {
+	call    *message.Call
+	ctx     context.Context
+	sent    time.Time
+	ack     time.Duration
+	timeout time.Duration // timeout of each attempt
+	attempt int           // current attempt, starting at 1 (see SetRetryPolicy)
+}
+
+// latency returns the latency of the call p.
+func (p *pendingCall) latency() CallLatency {
+	return CallLatency{Sent: p.sent, Ack: p.ack}
+}
+
+// ackPending records the ACK or NACK latency of the pending call
+// identified by key, and returns the latency of the call. It returns
+// false if the call is not pending.
+func (c *Client) ackPending(key string) (CallLatency, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := c.results[key]
+	if p == nil {
+		return CallLatency{}, false
+	}
+	p.ack = time.Since(p.sent)
+	c.latencies.Ack.add(p.ack)
+	return p.latency(), true
+}
+
+type latencyKey struct{}
+
+// LatencyFromContext returns the latency of the call stored in ctx.
+// The context passed to the Handler for ACK, NACK and RES messages in
+// response to a call holds the latency of the call at the time the
+// message was received.
+func LatencyFromContext(ctx context.Context) (CallLatency, bool) {
+	lat, ok := ctx.Value(latencyKey{}).(CallLatency)
+	return lat, ok
+}
+
+func withLatency(ctx context.Context, lat CallLatency) context.Context {
+	return context.WithValue(ctx, latencyKey{}, lat)
+}
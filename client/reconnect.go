@@ -0,0 +1,247 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/message"
+	"github.com/gorilla/websocket"
+)
+
+// ConnState represents the possible states of the connection of a
+// client, as reported to the function set by SetConnStateHandler.
+type ConnState int
+
+// The list of possible connection states.
+const (
+	Connected    ConnState = iota // reconnected after a failure
+	Disconnected                  // the connection failed, reconnecting
+	Closed                        // closed for good, no more messages will be received
+)
+
+var connStateNames = [...]string{
+	Connected:    "connected",
+	Disconnected: "disconnected",
+	Closed:       "closed",
+}
+
+// String returns the name of the connection state.
+func (s ConnState) String() string {
+	if s >= 0 && int(s) < len(connStateNames) {
+		return connStateNames[s]
+	}
+	return "unknown"
+}
+
+// Default backoff delays of the reconnection, see SetReconnect.
+const (
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+// SetReconnect enables the automatic reconnection of the client when
+// the websocket connection fails. The client dials a new connection
+// using dial, with an exponential backoff that starts at minBackoff and
+// doubles after each failed attempt up to maxBackoff, until it succeeds
+// or the client is closed. If dial is nil, the client must be created
+// with Dial, and it reconnects using the same dialer, URL and headers.
+// If minBackoff or maxBackoff is <= 0, DefaultMinBackoff and
+// DefaultMaxBackoff are used, respectively.
+//
+// When the connection fails, the calls waiting for a result are
+// expired, so that an EXP message is sent to the Handler for each of
+// them and their Future fails with ErrExpired, and the requests
+// waiting for an ACK or NACK (see WaitForAck) fail with a
+// *TransportError. Once reconnected, the client re-issues the SUB
+// requests of the channels that were subscribed. The CloseNotify
+// channel is only closed when the client is closed for good.
+func SetReconnect(dial func() (*websocket.Conn, error), minBackoff, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.reconnectOn = true
+		if dial != nil {
+			c.dial = dial
+		}
+		if minBackoff <= 0 {
+			minBackoff = DefaultMinBackoff
+		}
+		if maxBackoff <= 0 {
+			maxBackoff = DefaultMaxBackoff
+		}
+		if maxBackoff < minBackoff {
+			maxBackoff = minBackoff
+		}
+		c.minBackoff, c.maxBackoff = minBackoff, maxBackoff
+	}
+}
+
+// SetConnStateHandler sets the function called when the state of the
+// connection changes, e.g. so that the application knows when it is
+// offline. It is called synchronously from the client's read loop, so
+// it must not block. The Connected and Disconnected states are only
+// reported if reconnection is enabled (see SetReconnect).
+func SetConnStateHandler(fn func(ConnState)) Option {
+	return func(c *Client) {
+		c.connState = fn
+	}
+}
+
+// setDefaultDial sets the dial function used by SetReconnect if none
+// is provided.
+func setDefaultDial(dial func() (*websocket.Conn, error)) Option {
+	return func(c *Client) {
+		c.dial = dial
+	}
+}
+
+func (c *Client) setConnState(st ConnState) {
+	if c.connState != nil {
+		c.connState(st)
+	}
+}
+
+// reconnect is called when the connection failed with err. It expires
+// the pending calls and dials a new connection until it succeeds or the
+// client is closed. It returns false if the client is closed.
+func (c *Client) reconnect(err error) bool {
+	select {
+	case <-c.closing:
+		return false
+	default:
+	}
+
+	c.setConnState(Disconnected)
+	c.expirePending()
+	c.failAcks(err)
+
+	backoff := c.minBackoff
+	for {
+		// wait between backoff/2 and backoff, so that many clients
+		// disconnected at once don't all reconnect at the same time.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-c.closing:
+			return false
+		case <-time.After(wait):
+		}
+
+		conn, err := c.dial()
+		if err != nil {
+			if backoff *= 2; backoff > c.maxBackoff {
+				backoff = c.maxBackoff
+			}
+			continue
+		}
+
+		if !c.setConn(conn) {
+			conn.Close()
+			return false
+		}
+		c.setConnState(Connected)
+		c.resubscribe()
+		return true
+	}
+}
+
+// setConn replaces the websocket connection with conn. It returns
+// false if the client is closed.
+func (c *Client) setConn(conn *websocket.Conn) bool {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+
+	select {
+	case <-c.closing:
+		return false
+	default:
+	}
+	if c.readLimit > 0 {
+		conn.SetReadLimit(c.readLimit)
+	}
+	c.setCompression(conn)
+	if c.pingInterval > 0 {
+		conn.SetPongHandler(c.handlePong)
+	}
+	c.conn = conn
+	return true
+}
+
+// expirePending expires all calls waiting for a result.
+func (c *Client) expirePending() {
+	c.mu.Lock()
+	ps := c.results
+	c.results = make(map[string]*pendingCall)
+	c.mu.Unlock()
+
+	for key, p := range ps {
+		lat := p.latency()
+		c.completeFuture(key, nil, lat, ErrExpired)
+		c.handle(withLatency(context.Background(), lat), newExp(p.call))
+	}
+}
+
+// subscription identifies a subscription of the client.
+type subscription struct {
+	channel string
+	pattern bool
+}
+
+func (c *Client) addSub(channel string, pattern bool, filter message.Filter) {
+	c.mu.Lock()
+	c.subs[subscription{channel, pattern}] = filter
+	c.mu.Unlock()
+}
+
+func (c *Client) deleteSub(channel string, pattern bool) {
+	c.mu.Lock()
+	delete(c.subs, subscription{channel, pattern})
+	if !pattern {
+		delete(c.lastIDs, channel)
+	}
+	c.mu.Unlock()
+}
+
+func (c *Client) setLastEventID(channel, id string) {
+	c.mu.Lock()
+	c.lastIDs[channel] = id
+	c.mu.Unlock()
+}
+
+// LastEventID returns the ID of the last event received on the durable
+// channel, or an empty string if no event with an ID was received on
+// that channel. It can be persisted to replay the missed events with
+// SubReplay in a later session.
+func (c *Client) LastEventID(channel string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastIDs[channel]
+}
+
+// resubscribe re-issues the SUB requests of the subscriptions of the
+// client, with the ID of the last event received on durable channels
+// so that the missed events are replayed. The ACK or NACK of each
+// request is sent to the Handler as usual.
+func (c *Client) resubscribe() {
+	c.mu.Lock()
+	subs := make(map[subscription]message.Filter, len(c.subs))
+	for sub, filter := range c.subs {
+		subs[sub] = filter
+	}
+	lastIDs := make(map[string]string, len(c.lastIDs))
+	for ch, id := range c.lastIDs {
+		lastIDs[ch] = id
+	}
+	c.mu.Unlock()
+
+	for sub, filter := range subs {
+		m := message.NewSub(sub.channel, sub.pattern)
+		m.Payload.Filter = filter
+		if !sub.pattern {
+			m.Payload.LastEventID = lastIDs[sub.channel]
+		}
+		if err := c.doWrite(context.Background(), m); err != nil {
+			// the connection failed again, the read loop will reconnect
+			return
+		}
+	}
+}
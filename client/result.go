@@ -0,0 +1,47 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/mna/juggler/message"
+)
+
+// ResultError is the error returned by a callee, as received in a RES
+// message (see message.ErrResult).
+type ResultError struct {
+	URI     string          // URI of the call
+	Code    int             // error code, 0 if the callee didn't set one
+	Message string          // error message
+	Details json.RawMessage // JSON-encoded details, if any
+}
+
+// Error returns the error message of e.
+func (e *ResultError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("juggler: call to %s failed: %d %s", e.URI, e.Code, e.Message)
+	}
+	return fmt.Sprintf("juggler: call to %s failed: %s", e.URI, e.Message)
+}
+
+// ErrorResult returns the error returned by the callee if res is an
+// error result, and true. Otherwise, res is a successful result and
+// it returns nil and false. If the error was not encoded as a
+// message.ErrResult by the callee, the Message of the returned error
+// is the raw JSON payload.
+func ErrorResult(res *message.Res) (*ResultError, bool) {
+	if !res.Payload.Error {
+		return nil, false
+	}
+
+	re := &ResultError{URI: res.Payload.URI}
+	var er message.ErrResult
+	if err := json.Unmarshal(res.Payload.Args, &er); err != nil || er.Error.Message == "" {
+		re.Message = string(res.Payload.Args)
+		return re, true
+	}
+	re.Code = er.Error.Code
+	re.Message = er.Error.Message
+	re.Details = er.Error.Details
+	return re, true
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/mna/juggler/message"
+)
+
+// Default backoff delays of the call retries, see SetRetryPolicy.
+const (
+	DefaultRetryMinBackoff = 100 * time.Millisecond
+	DefaultRetryMaxBackoff = 5 * time.Second
+)
+
+// RetryPolicy defines how the calls that failed with a transient
+// error are retried, see SetRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts of a call,
+	// including the first one. A value <= 1 disables the retries.
+	MaxAttempts int
+
+	// MinBackoff is the delay before the first retry, it doubles after
+	// each attempt up to MaxBackoff. If MinBackoff or MaxBackoff is
+	// <= 0, DefaultRetryMinBackoff and DefaultRetryMaxBackoff are used,
+	// respectively.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// backoff returns the delay to wait before the attempt of a call.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.MinBackoff
+	for i := 2; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	// wait between backoff/2 and backoff, so that the calls that failed
+	// at once are not all retried at the same time.
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// SetRetryPolicy enables the automatic retry of the calls that are
+// rejected by the server with a retryable NACK (see
+// message.IsRetryableCode, e.g. when the broker is unavailable or the
+// client is rate-limited), or that expire before their result is
+// received. A call is retried with the same CALL message, so that
+// its UUID does not change, and with an idempotency key set in its
+// metadata (see message.Meta), that callees and brokers can use to
+// detect the duplicate calls.
+//
+// The NACK and EXP messages of the attempts that are retried are not
+// sent to the Handler, and do not complete the Future of the call:
+// only the outcome of the last attempt is reported. The calls are not
+// retried when the connection fails (see SetReconnect).
+func SetRetryPolicy(p RetryPolicy) Option {
+	return func(c *Client) {
+		if p.MinBackoff <= 0 {
+			p.MinBackoff = DefaultRetryMinBackoff
+		}
+		if p.MaxBackoff <= 0 {
+			p.MaxBackoff = DefaultRetryMaxBackoff
+		}
+		if p.MaxBackoff < p.MinBackoff {
+			p.MaxBackoff = p.MinBackoff
+		}
+		c.retryPolicy = p
+	}
+}
+
+// isRetryableNack returns true if a call rejected with m may succeed
+// if retried. The NACKs of servers that don't set the error code are
+// retryable if their code is in the 5xx range.
+func isRetryableNack(m *message.Nack) bool {
+	if m.Payload.ErrCode != "" {
+		return m.Payload.Retryable
+	}
+	return m.Payload.Code >= 500 && m.Payload.Code < 600
+}
+
+// retry retries the pending call identified by key, if it is waiting
+// for the result of attempt (or of any attempt if attempt is 0) and
+// the retry policy allows another attempt. It returns false if the
+// call is not retried, in which case the caller must report the
+// failure. The call is sent again after the backoff delay. The chunked
+// calls are never retried.
+func (c *Client) retry(key string, attempt int) bool {
+	c.mu.Lock()
+	p := c.results[key]
+	if p == nil || (attempt > 0 && p.attempt != attempt) ||
+		p.attempt >= c.retryPolicy.MaxAttempts || p.call.Payload.Chunked {
+		c.mu.Unlock()
+		return false
+	}
+	p.attempt++
+	attempt = p.attempt
+	c.mu.Unlock()
+
+	go func() {
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(c.retryPolicy.backoff(attempt)):
+		}
+
+		c.mu.Lock()
+		p := c.results[key]
+		c.mu.Unlock()
+		if p == nil || p.attempt != attempt {
+			// the call completed or expired in the meantime
+			return
+		}
+
+		// if the write fails, the call expires and may be retried again
+		// (the write of the first attempt registered the ACK waiter).
+		c.writeMsg(p.ctx, p.call)
+		c.handleExpiredCall(p.call, p.timeout, attempt)
+	}()
+	return true
+}
+
+// withIdempotencyKey sets the idempotency key of the call m, if the
+// retries are enabled and it has none.
+func (c *Client) withIdempotencyKey(m *message.Call) {
+	if c.retryPolicy.MaxAttempts > 1 && m.Meta.K == "" {
+		m.Meta.K = m.UUID().String()
+	}
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/message"
+)
+
+// EventFunc is the type of the callbacks registered with
+// Client.Subscribe, called with the payload of each event received
+// for the subscription.
+type EventFunc func(*message.EvntPayload)
+
+// Subscription is a callback registered for a channel with
+// Client.Subscribe.
+type Subscription struct {
+	c   *Client
+	sub subscription
+	fn  EventFunc
+}
+
+// Subscribe registers fn to be called with each event received for
+// the channel, which is treated as a pattern if pattern is true. The
+// events of a pattern subscription are routed by pattern, not by the
+// channel of the event, so that fn only receives the events sent for
+// that subscription. Each invocation of fn runs in its own goroutine,
+// as for the Handler, which still receives all messages.
+//
+// The SUB request is sent when the first callback is registered for
+// the channel and pattern, and the UNSB request when the last one is
+// removed with Unsubscribe. Mixing Subscribe with Sub and Unsb for
+// the same channel is not supported. If the SUB request cannot be
+// sent, fn is not registered and the error is returned.
+func (c *Client) Subscribe(channel string, pattern bool, fn EventFunc) (*Subscription, error) {
+	return c.SubscribeContext(context.Background(), channel, pattern, fn)
+}
+
+// SubscribeContext is like Subscribe, with ctx bounding the write of
+// the SUB request, if one is sent (see CallContext).
+func (c *Client) SubscribeContext(ctx context.Context, channel string, pattern bool, fn EventFunc) (*Subscription, error) {
+	s := &Subscription{c: c, sub: subscription{channel, pattern}, fn: fn}
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	c.mu.Lock()
+	first := len(c.routes[s.sub]) == 0
+	c.mu.Unlock()
+	if first {
+		if _, err := c.subFilter(ctx, channel, pattern, nil, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	c.routes[s.sub] = append(c.routes[s.sub], s)
+	c.mu.Unlock()
+	return s, nil
+}
+
+// Unsubscribe removes the callback of the subscription. If it was the
+// last callback registered for its channel and pattern, an UNSB
+// request is sent and its error, if any, is returned. It is a no-op
+// if the callback was already removed.
+func (s *Subscription) Unsubscribe() error {
+	return s.UnsubscribeContext(context.Background())
+}
+
+// UnsubscribeContext is like Unsubscribe, with ctx bounding the write
+// of the UNSB request, if one is sent (see CallContext).
+func (s *Subscription) UnsubscribeContext(ctx context.Context) error {
+	c := s.c
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	c.mu.Lock()
+	list := c.routes[s.sub]
+	found := false
+	for i, sub := range list {
+		if sub == s {
+			// do not modify list in place, the read loop may be iterating
+			// over it.
+			rest := make([]*Subscription, 0, len(list)-1)
+			rest = append(rest, list[:i]...)
+			list = append(rest, list[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if found {
+		if len(list) == 0 {
+			delete(c.routes, s.sub)
+		} else {
+			c.routes[s.sub] = list
+		}
+	}
+	c.mu.Unlock()
+
+	if !found || len(list) > 0 {
+		return nil
+	}
+	_, err := c.UnsbContext(ctx, s.sub.channel, s.sub.pattern)
+	return err
+}
+
+// routeEvent calls the callbacks registered for the subscription of
+// the event m.
+func (c *Client) routeEvent(m *message.Evnt) {
+	sub := subscription{channel: m.Payload.Channel}
+	if m.Payload.Pattern != "" {
+		sub = subscription{channel: m.Payload.Pattern, pattern: true}
+	}
+
+	c.mu.Lock()
+	list := c.routes[sub]
+	c.mu.Unlock()
+
+	pld := &message.EvntPayload{
+		MsgUUID:       m.Payload.For,
+		Channel:       m.Payload.Channel,
+		Pattern:       m.Payload.Pattern,
+		EventID:       m.Payload.ID,
+		Args:          m.Payload.Args,
+		CorrelationID: m.Meta.C,
+		Priority:      m.Meta.P,
+		Binary:        m.Payload.Binary,
+	}
+	for _, s := range list {
+		go s.fn(pld)
+	}
+}
@@ -5,16 +5,30 @@
 //     - test.reverse (string) : reverses each rune in the received string
 //     - test.delay (string) : sleeps for the duration received as string, converted to number (in ms)
 //
+// It can also make calls on recurring schedules with the -schedule
+// flag, e.g. -schedule "*/5 * * * * test.echo;@every 10s test.reverse"
+// (see the scheduler package for the schedule format).
+//
+// With the -health flag, it registers itself in the registry of live
+// callees and refreshes its entry every -health-interval (see
+// callee.Health). The -list flag prints the live callees registered
+// in redis and exits.
+//
 package main
 
 import (
 	"encoding/json"
 	"expvar"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -22,20 +36,31 @@ import (
 	"github.com/mna/juggler/broker/redisbroker"
 	"github.com/mna/juggler/callee"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/scheduler"
 	"github.com/mna/redisc"
 )
 
 var (
 	brokerBlockingTimeoutFlag = flag.Duration("broker-blocking-timeout", 0, "Blocking `timeout` when polling for call requests.")
+	brokerNamespaceFlag       = flag.String("broker-namespace", "", "`Namespace` prefix of the redis keys.")
+	brokerPrefixRoutingFlag   = flag.Bool("broker-prefix-routing", false, "Register the URIs for prefix routing of the calls.")
 	brokerResultCapFlag       = flag.Int("broker-result-cap", 0, "Capacity of the `results` queue.")
+	brokerVisibilityFlag      = flag.Duration("broker-visibility-timeout", 0, "Visibility `timeout` of the calls processed at least once.")
+	healthFlag                = flag.Bool("health", false, "Register the callee in the registry of live callees.")
+	healthIntervalFlag        = flag.Duration("health-interval", callee.DefaultHealthInterval, "Heartbeat `interval` of the live callee registration.")
 	helpFlag                  = flag.Bool("help", false, "Show help.")
+	listFlag                  = flag.Bool("list", false, "List the live callees and exit.")
 	numDelayURIsFlag          = flag.Int("n", 0, "Number of test.delay `URIs`.")
 	httpServerPortFlag        = flag.Int("port", 9001, "HTTP server `port` to serve debug endpoints.")
 	redisAddrFlag             = flag.String("redis", ":6379", "Redis `address`.")
 	redisClusterFlag          = flag.Bool("redis-cluster", false, "Use redis cluster.")
+	redisDBFlag               = flag.Int("redis-db", 0, "Redis `database` number.")
 	redisPoolIdleTimeoutFlag  = flag.Duration("redis-idle-timeout", 0, "Redis idle connection `timeout`.")
 	redisPoolMaxActiveFlag    = flag.Int("redis-max-active", 0, "Maximum active redis `connections`.")
 	redisPoolMaxIdleFlag      = flag.Int("redis-max-idle", 0, "Maximum idle redis `connections`.")
+	redisPasswordFlag         = flag.String("redis-password", "", "Redis `password`.")
+	redisTLSFlag              = flag.Bool("redis-tls", false, "Connect to redis using TLS.")
+	scheduleFlag              = flag.String("schedule", "", "Scheduled `jobs` to call, separated by ';', each as '<schedule> <URI>'.")
 	workersFlag               = flag.Int("workers", 1, "Number of concurrent `workers` processing call requests.")
 )
 
@@ -74,7 +99,33 @@ func main() {
 	}
 
 	vars := expvar.NewMap("callee")
-	c := &callee.Callee{Broker: newBroker(pool, dial, vars)}
+	brk := newBroker(pool, dial, vars)
+	if *listFlag {
+		if err := listCallees(brk); err != nil {
+			log.Fatalf("failed to list live callees: %v", err)
+		}
+		return
+	}
+
+	c := &callee.Callee{
+		Broker:     brk,
+		Middleware: callee.Chain(callee.PanicRecover(vars), callee.Metrics(vars)),
+	}
+
+	if *scheduleFlag != "" {
+		jobs, err := parseJobs(*scheduleFlag)
+		if err != nil {
+			log.Fatalf("invalid schedule: %v", err)
+		}
+		s := &scheduler.Scheduler{Broker: brk, Vars: vars}
+		log.Printf("running %d scheduled jobs", len(jobs))
+		go func() {
+			// runs until the process exits
+			if err := s.Run(jobs, nil); err != nil {
+				log.Fatalf("scheduler failed: %v", err)
+			}
+		}()
+	}
 
 	// start a web server to serve pprof and expvar data
 	log.Printf("serving debug endpoints on %d", *httpServerPortFlag)
@@ -94,54 +145,86 @@ func main() {
 		keysPerSlot = redisc.SplitBySlot(keys...)
 	}
 
-	// start n workers for each cluster slot
+	// start a pool of n workers for each cluster slot
 	wg := sync.WaitGroup{}
 	for _, keys := range keysPerSlot {
-		cc, err := c.Broker.NewCallsConn(keys...)
-		if err != nil {
-			log.Fatalf("Calls failed: %v", err)
+		m := make(map[string]callee.Thunk, len(keys))
+		for _, k := range keys {
+			m[k] = uris[k]
 		}
-		defer cc.Close()
-
-		wg.Add(*workersFlag)
-		for i := 0; i < *workersFlag; i++ {
-			go func() {
-				defer wg.Done()
-
-				ch := cc.Calls()
-				for cp := range ch {
-					log.Printf("received request %v %s", cp.MsgUUID, cp.URI)
-					vars.Add("Requests", 1)
-					vars.Add("Requests."+cp.URI, 1)
-
-					if err := c.InvokeAndStoreResult(cp, uris[cp.URI]); err != nil {
-						if err != callee.ErrCallExpired {
-							log.Printf("InvokeAndStoreResult failed: %v", err)
-							vars.Add("Failed", 1)
-							vars.Add("Failed."+cp.URI, 1)
-							continue
-						}
-						log.Printf("expired request %v %s", cp.MsgUUID, cp.URI)
-						vars.Add("Expired", 1)
-						vars.Add("Expired."+cp.URI, 1)
-						continue
-					}
-					log.Printf("sent result %v %s", cp.MsgUUID, cp.URI)
-					vars.Add("Succeeded", 1)
-					vars.Add("Succeded."+cp.URI, 1)
-				}
-			}()
+		p := &callee.Pool{Callee: c, Workers: *workersFlag, Done: done(vars)}
+
+		wg.Add(1)
+		go func(p *callee.Pool, m map[string]callee.Thunk) {
+			defer wg.Done()
+			if err := p.Listen(m); err != nil {
+				log.Fatalf("Listen failed: %v", err)
+			}
+		}(p, m)
+	}
+
+	if *healthFlag {
+		h := &callee.Health{
+			Broker:   brk,
+			URIs:     keys,
+			Workers:  *workersFlag * len(keysPerSlot),
+			Interval: *healthIntervalFlag,
+			ErrFunc: func(err error) {
+				log.Printf("heartbeat failed: %v", err)
+			},
 		}
+		if err := h.Start(); err != nil {
+			log.Fatalf("failed to register live callee: %v", err)
+		}
+		log.Printf("registered live callee %s", h.ID)
 	}
 	wg.Wait()
 }
 
-func logWrapThunk(t callee.Thunk) callee.Thunk {
-	return func(cp *message.CallPayload) (interface{}, error) {
-		log.Printf("received call for %s from %v", cp.URI, cp.MsgUUID)
-		v, err := t(cp)
-		log.Printf("sending result for %s from %v", cp.URI, cp.MsgUUID)
-		return v, err
+// listCallees prints the live callees registered with brk.
+func listCallees(brk broker.HealthBroker) error {
+	infos, err := brk.Callees()
+	if err != nil {
+		return err
+	}
+	sort.Sort(byID(infos))
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tWORKERS\tLAST SEEN\tURIS")
+	for _, ci := range infos {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", ci.ID, ci.Workers, ci.LastSeen.Format(time.RFC3339), strings.Join(ci.URIs, ","))
+	}
+	return tw.Flush()
+}
+
+type byID []*broker.CalleeInfo
+
+func (b byID) Len() int           { return len(b) }
+func (b byID) Less(i, j int) bool { return b[i].ID < b[j].ID }
+func (b byID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// done returns the function called when a call request is processed,
+// that logs the result and collects the metrics.
+func done(vars *expvar.Map) func(*message.CallPayload, error) {
+	return func(cp *message.CallPayload, err error) {
+		vars.Add("Requests", 1)
+		vars.Add("Requests."+cp.URI, 1)
+
+		if err != nil {
+			if err != callee.ErrCallExpired {
+				log.Printf("InvokeAndStoreResult failed: %v", err)
+				vars.Add("Failed", 1)
+				vars.Add("Failed."+cp.URI, 1)
+				return
+			}
+			log.Printf("expired request %v %s", cp.MsgUUID, cp.URI)
+			vars.Add("Expired", 1)
+			vars.Add("Expired."+cp.URI, 1)
+			return
+		}
+		log.Printf("sent result %v %s", cp.MsgUUID, cp.URI)
+		vars.Add("Succeeded", 1)
+		vars.Add("Succeded."+cp.URI, 1)
 	}
 }
 
@@ -190,12 +273,37 @@ func echo(s string) string {
 	return s
 }
 
-func newBroker(pool redisbroker.Pool, dial func() (redis.Conn, error), vars *expvar.Map) broker.CalleeBroker {
+// parseJobs parses the jobs of the -schedule flag.
+func parseJobs(s string) ([]*scheduler.Job, error) {
+	var jobs []*scheduler.Job
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.LastIndexAny(spec, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("missing URI in %q", spec)
+		}
+		sched, err := scheduler.Parse(spec[:i])
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &scheduler.Job{Schedule: sched, URI: spec[i+1:]})
+	}
+	return jobs, nil
+}
+
+func newBroker(pool redisbroker.Pool, dial func() (redis.Conn, error), vars *expvar.Map) *redisbroker.Broker {
 	return &redisbroker.Broker{
 		Pool:            pool,
 		Dial:            dial,
+		Namespace:       *brokerNamespaceFlag,
 		BlockingTimeout: *brokerBlockingTimeoutFlag,
 		ResultCap:       *brokerResultCapFlag,
+		PrefixRouting:   *brokerPrefixRoutingFlag,
+
+		VisibilityTimeout: *brokerVisibilityFlag,
 		Vars:            vars,
 	}
 }
@@ -209,13 +317,30 @@ func newRedisCluster(addr string) (*redisc.Cluster, error) {
 	return c, err
 }
 
+// redisDialOptions returns the options to dial a redis connection
+// with the authentication, database and TLS settings of the flags.
+func redisDialOptions() []redis.DialOption {
+	var opts []redis.DialOption
+	if *redisPasswordFlag != "" {
+		opts = append(opts, redis.DialPassword(*redisPasswordFlag))
+	}
+	if *redisDBFlag != 0 {
+		opts = append(opts, redis.DialDatabase(*redisDBFlag))
+	}
+	if *redisTLSFlag {
+		opts = append(opts, redis.DialUseTLS(true))
+	}
+	return opts
+}
+
 func newRedisPool(addr string, opts ...redis.DialOption) (*redis.Pool, error) {
+	opts = append(redisDialOptions(), opts...)
 	return &redis.Pool{
 		MaxIdle:     *redisPoolMaxIdleFlag,
 		MaxActive:   *redisPoolMaxActiveFlag,
 		IdleTimeout: *redisPoolIdleTimeoutFlag,
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", addr)
+			c, err := redis.Dial("tcp", addr, opts...)
 			if err != nil {
 				return nil, err
 			}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Definition is the service definition read from the YAML input file.
+type Definition struct {
+	Package  string    `yaml:"package"`
+	Service  string    `yaml:"service"`
+	Calls    []Call    `yaml:"calls"`
+	Channels []Channel `yaml:"channels"`
+
+	// Source is the name of the input file, set by the command.
+	Source string `yaml:"-"`
+}
+
+// Call defines an RPC call of the service. Request and Response are
+// the names of the Go types of the arguments and result, which must
+// be defined in the target package (or be predeclared types).
+type Call struct {
+	Name     string `yaml:"name"`
+	URI      string `yaml:"uri"`
+	Request  string `yaml:"request"`
+	Response string `yaml:"response"`
+}
+
+// Channel defines a pub-sub channel of the service. Event is the name
+// of the Go type of the events published on the channel.
+type Channel struct {
+	Name    string `yaml:"name"`
+	Channel string `yaml:"channel"`
+	Event   string `yaml:"event"`
+}
+
+// parseDefinition reads and validates the service definition from r.
+func parseDefinition(r io.Reader) (*Definition, error) {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return nil, err
+	}
+	var def Definition
+	if err := yaml.Unmarshal(buf.Bytes(), &def); err != nil {
+		return nil, err
+	}
+	if err := def.validate(); err != nil {
+		return nil, err
+	}
+	return &def, nil
+}
+
+func (d *Definition) validate() error {
+	if !token.IsIdentifier(d.Package) {
+		return fmt.Errorf("invalid package name: %q", d.Package)
+	}
+	if !isExported(d.Service) {
+		return fmt.Errorf("invalid service name: %q", d.Service)
+	}
+	if len(d.Calls) == 0 && len(d.Channels) == 0 {
+		return errors.New("no call or channel defined")
+	}
+
+	// names holds the names of the generated client methods, so that
+	// e.g. calls Get and GetContext are rejected.
+	names := make(map[string]bool)
+	uris := make(map[string]bool)
+	for _, c := range d.Calls {
+		if !isExported(c.Name) || names[c.Name] || names[c.Name+"Context"] {
+			return fmt.Errorf("invalid or duplicate call name: %q", c.Name)
+		}
+		names[c.Name] = true
+		names[c.Name+"Context"] = true
+		if c.URI == "" || uris[c.URI] {
+			return fmt.Errorf("call %s: missing or duplicate URI: %q", c.Name, c.URI)
+		}
+		uris[c.URI] = true
+		if !token.IsIdentifier(c.Request) || !token.IsIdentifier(c.Response) {
+			return fmt.Errorf("call %s: invalid request or response type", c.Name)
+		}
+	}
+
+	chans := make(map[string]bool)
+	for _, c := range d.Channels {
+		if !isExported(c.Name) || names[c.Name] {
+			return fmt.Errorf("invalid or duplicate channel name: %q", c.Name)
+		}
+		names[c.Name] = true
+		for _, prefix := range []string{"Subscribe", "Publish", "On"} {
+			if names[prefix+c.Name] {
+				return fmt.Errorf("channel %s: name conflicts with a call", c.Name)
+			}
+			names[prefix+c.Name] = true
+		}
+		if c.Channel == "" || chans[c.Channel] {
+			return fmt.Errorf("channel %s: missing or duplicate channel: %q", c.Name, c.Channel)
+		}
+		chans[c.Channel] = true
+		if !token.IsIdentifier(c.Event) {
+			return fmt.Errorf("channel %s: invalid event type", c.Name)
+		}
+	}
+	return nil
+}
+
+func isExported(s string) bool {
+	return token.IsIdentifier(s) && token.IsExported(s)
+}
+
+// generate writes the Go source code for the service definition d
+// to w.
+func generate(w io.Writer, d *Definition) error {
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, d); err != nil {
+		return err
+	}
+	b, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("invalid generated code: %v", err)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+var tpl = template.Must(template.New("gen").Parse(`// Code generated by juggler-gen{{with .Source}} from {{.}}{{end}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"encoding/json"
+{{- if .Calls}}
+	"time"
+{{- end}}
+{{if .Calls}}
+	"github.com/mna/juggler/callee"
+{{- end}}
+	"github.com/mna/juggler/client"
+	"github.com/mna/juggler/message"
+{{- if .Channels}}
+	"github.com/pborman/uuid"
+{{- end}}
+{{- if .Calls}}
+	"golang.org/x/net/context"
+{{- end}}
+)
+{{$svc := .Service}}
+{{- if .Calls}}
+// URIs of the {{$svc}} service.
+const (
+{{- range .Calls}}
+	{{$svc}}{{.Name}}URI = {{printf "%q" .URI}}
+{{- end}}
+)
+{{end}}
+{{- if .Channels}}
+// Channels of the {{$svc}} service.
+const (
+{{- range .Channels}}
+	{{$svc}}{{.Name}}Channel = {{printf "%q" .Channel}}
+{{- end}}
+)
+{{end}}
+// {{$svc}}Client is a typed client for the {{$svc}} service.
+type {{$svc}}Client struct {
+	Client *client.Client
+}
+{{range .Calls}}
+// {{.Name}} calls the {{.URI}} URI and waits for its result. If the
+// callee returned an error, it is returned as a *client.ResultError.
+func (c *{{$svc}}Client) {{.Name}}(req *{{.Request}}, timeout time.Duration) (*{{.Response}}, error) {
+	res, err := c.Client.CallSync({{$svc}}{{.Name}}URI, req, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if re, ok := client.ErrorResult(res); ok {
+		return nil, re
+	}
+	var v {{.Response}}
+	if err := json.Unmarshal(res.Payload.Args, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// {{.Name}}Context is like {{.Name}}, with ctx bounding the call and its
+// deadline used as timeout (see client.Client.CallWait).
+func (c *{{$svc}}Client) {{.Name}}Context(ctx context.Context, req *{{.Request}}) (*{{.Response}}, error) {
+	var v {{.Response}}
+	if err := c.Client.CallInto(ctx, {{$svc}}{{.Name}}URI, req, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+{{end}}
+{{- range .Channels}}
+// Subscribe{{.Name}} subscribes to the {{.Channel}} channel.
+func (c *{{$svc}}Client) Subscribe{{.Name}}() (uuid.UUID, error) {
+	return c.Client.Sub({{$svc}}{{.Name}}Channel, false)
+}
+
+// On{{.Name}} registers fn to be called with each event received on
+// the {{.Channel}} channel, decoded, or with the error if it cannot be
+// decoded (see client.Client.Subscribe).
+func (c *{{$svc}}Client) On{{.Name}}(fn func(*{{.Event}}, error)) (*client.Subscription, error) {
+	return c.Client.Subscribe({{$svc}}{{.Name}}Channel, false, func(p *message.EvntPayload) {
+		var v {{.Event}}
+		if err := json.Unmarshal(p.Args, &v); err != nil {
+			fn(nil, err)
+			return
+		}
+		fn(&v, nil)
+	})
+}
+
+// Publish{{.Name}} publishes ev on the {{.Channel}} channel.
+func (c *{{$svc}}Client) Publish{{.Name}}(ev *{{.Event}}) (uuid.UUID, error) {
+	return c.Client.Pub({{$svc}}{{.Name}}Channel, ev)
+}
+
+// Decode{{$svc}}{{.Name}} decodes the event ev received on the
+// {{.Channel}} channel.
+func Decode{{$svc}}{{.Name}}(ev *message.Evnt) (*{{.Event}}, error) {
+	var v {{.Event}}
+	if err := json.Unmarshal(ev.Payload.Args, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+{{end}}
+{{- if .Calls}}
+// {{$svc}}Service is the interface implemented by the callee of the
+// {{$svc}} service.
+type {{$svc}}Service interface {
+{{- range .Calls}}
+	{{.Name}}(*{{.Request}}) (*{{.Response}}, error)
+{{- end}}
+}
+
+// {{$svc}}Thunks returns the thunks that call svc for each URI of the
+// {{$svc}} service, to use with callee.Callee.Listen. The arguments of
+// the calls are decoded and validated with callee.DecodeArgs before
+// calling svc, so invalid arguments return a *callee.Error with code
+// 400.
+func {{$svc}}Thunks(svc {{$svc}}Service) map[string]callee.Thunk {
+	return map[string]callee.Thunk{
+{{- range .Calls}}
+		{{$svc}}{{.Name}}URI: func(cp *message.CallPayload) (interface{}, error) {
+			var req {{.Request}}
+			if err := callee.DecodeArgs(cp, &req); err != nil {
+				return nil, err
+			}
+			return svc.{{.Name}}(&req)
+		},
+{{- end}}
+	}
+}
+
+// Register{{$svc}} registers the thunks of svc (see {{$svc}}Thunks) for
+// the URIs of the {{$svc}} service on the router r.
+func Register{{$svc}}(r *callee.Router, svc {{$svc}}Service) {
+	for uri, fn := range {{$svc}}Thunks(svc) {
+		r.Handle(uri, fn)
+	}
+}
+{{end -}}
+`))
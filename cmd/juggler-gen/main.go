@@ -0,0 +1,84 @@
+// Command juggler-gen generates typed Go code for a juggler service
+// from a small YAML service definition, so that callers and callees
+// share the same URIs, channels and types. The definition looks like
+// this:
+//
+//     package: users
+//     service: Users
+//     calls:
+//     - name: Get
+//       uri: users.get
+//       request: GetRequest
+//       response: User
+//     channels:
+//     - name: Updated
+//       channel: users.updated
+//       event: User
+//
+// The request, response and event types must be defined in the target
+// package. The generated code contains constants for the URIs and
+// channels, a typed client (UsersClient) with methods for each call
+// (Get and GetContext) and channel (SubscribeUpdated, OnUpdated and
+// PublishUpdated), event decoding functions, and the callee
+// scaffolding: a UsersService interface to implement, a UsersThunks
+// function that returns the thunks that decode and validate the
+// arguments (see callee.DecodeArgs) and call the service, and a
+// RegisterUsers function that registers them on a callee.Router.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	helpFlag   = flag.Bool("help", false, "Show help.")
+	inputFlag  = flag.String("i", "", "Service definition `file`.")
+	outputFlag = flag.String("o", "", "Output `file`, stdout if empty.")
+)
+
+func main() {
+	flag.Parse()
+	if *helpFlag {
+		flag.Usage()
+		return
+	}
+	if *inputFlag == "" {
+		fmt.Fprintln(os.Stderr, "missing service definition file")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err := run(*inputFlag, *outputFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+func run(input, output string) error {
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	def, err := parseDefinition(f)
+	if err != nil {
+		return fmt.Errorf("invalid service definition: %v", err)
+	}
+	def.Source = filepath.Base(input)
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		out, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w = out
+	}
+	return generate(w, def)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDef = `
+package: users
+service: Users
+calls:
+- name: Get
+  uri: users.get
+  request: GetRequest
+  response: User
+- name: Delete
+  uri: users.delete
+  request: string
+  response: bool
+channels:
+- name: Updated
+  channel: users.updated
+  event: User
+`
+
+// srcImporter imports the packages from source for typeCheck, and
+// caches them across tests.
+var srcImporter = importer.ForCompiler(token.NewFileSet(), "source", nil)
+
+// typeCheck type-checks the generated code src of package pkg, with
+// the types of the definition declared in decls, so that the
+// generated code that is syntactically valid but does not compile is
+// caught.
+func typeCheck(t *testing.T, pkg string, src []byte, decls string) {
+	fset := token.NewFileSet()
+	gen, err := parser.ParseFile(fset, "gen.go", src, 0)
+	require.NoError(t, err, "parse generated code")
+	typs, err := parser.ParseFile(fset, "types.go", "package "+pkg+"\n"+decls, 0)
+	require.NoError(t, err, "parse types")
+
+	conf := types.Config{Importer: srcImporter}
+	_, err = conf.Check(pkg, fset, []*ast.File{gen, typs}, nil)
+	require.NoError(t, err, "type-check generated code")
+}
+
+func TestGenerate(t *testing.T) {
+	def, err := parseDefinition(strings.NewReader(testDef))
+	require.NoError(t, err, "parseDefinition")
+	def.Source = "users.yml"
+
+	var buf bytes.Buffer
+	require.NoError(t, generate(&buf, def), "generate")
+
+	typeCheck(t, "users", buf.Bytes(), "type GetRequest struct{}\ntype User struct{}")
+
+	src := buf.String()
+	want := []string{
+		"// Code generated by juggler-gen from users.yml. DO NOT EDIT.",
+		"package users",
+		`UsersGetURI    = "users.get"`,
+		`UsersUpdatedChannel = "users.updated"`,
+		"func (c *UsersClient) Get(req *GetRequest, timeout time.Duration) (*User, error) {",
+		"func (c *UsersClient) Delete(req *string, timeout time.Duration) (*bool, error) {",
+		"func (c *UsersClient) GetContext(ctx context.Context, req *GetRequest) (*User, error) {",
+		"func (c *UsersClient) OnUpdated(fn func(*User, error)) (*client.Subscription, error) {",
+		"func (c *UsersClient) SubscribeUpdated() (uuid.UUID, error) {",
+		"func (c *UsersClient) PublishUpdated(ev *User) (uuid.UUID, error) {",
+		"func DecodeUsersUpdated(ev *message.Evnt) (*User, error) {",
+		"Get(*GetRequest) (*User, error)",
+		"func UsersThunks(svc UsersService) map[string]callee.Thunk {",
+		"if err := callee.DecodeArgs(cp, &req); err != nil {",
+		"func RegisterUsers(r *callee.Router, svc UsersService) {",
+	}
+	for _, w := range want {
+		assert.Contains(t, src, w)
+	}
+}
+
+func TestGenerateChannelsOnly(t *testing.T) {
+	def, err := parseDefinition(strings.NewReader(`
+package: events
+service: Events
+channels:
+- name: Created
+  channel: events.created
+  event: Event
+`))
+	require.NoError(t, err, "parseDefinition")
+
+	var buf bytes.Buffer
+	require.NoError(t, generate(&buf, def), "generate")
+	typeCheck(t, "events", buf.Bytes(), "type Event struct{}")
+
+	src := buf.String()
+	assert.NotContains(t, src, "callee", "no callee scaffolding")
+	assert.NotContains(t, src, `"time"`, "no time import")
+	assert.NotContains(t, src, "context", "no context import")
+	assert.Contains(t, src, "// Code generated by juggler-gen. DO NOT EDIT.")
+}
+
+func TestInvalidDefinition(t *testing.T) {
+	cases := []string{
+		"",
+		"package: a\nservice: s\ncalls:\n- {name: A, uri: a, request: R, response: R}",
+		"package: a\nservice: S",
+		"package: a\nservice: S\ncalls:\n- {name: a, uri: a, request: R, response: R}",
+		"package: a\nservice: S\ncalls:\n- {name: A, request: R, response: R}",
+		"package: a\nservice: S\ncalls:\n- {name: A, uri: a, request: '*R', response: R}",
+		"package: a\nservice: S\ncalls:\n- {name: A, uri: a, request: R, response: R}\n- {name: B, uri: a, request: R, response: R}",
+		"package: a\nservice: S\nchannels:\n- {name: A, channel: a}",
+		"package: a\nservice: S\ncalls:\n- {name: A, uri: a, request: R, response: R}\nchannels:\n- {name: A, channel: a, event: E}",
+		"package: a\nservice: S\ncalls:\n- {name: AContext, uri: a, request: R, response: R}\n- {name: A, uri: b, request: R, response: R}",
+		"package: a\nservice: S\ncalls:\n- {name: OnA, uri: a, request: R, response: R}\nchannels:\n- {name: A, channel: a, event: E}",
+	}
+	for i, c := range cases {
+		_, err := parseDefinition(strings.NewReader(c))
+		assert.Error(t, err, "%d", i)
+	}
+}
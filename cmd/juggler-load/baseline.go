@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// report is the JSON report of a run, that can be used as baseline
+// for a subsequent run.
+type report struct {
+	Run        *runStats        `json:"run"`
+	Latencies  map[string]int64 `json:"latencies"`  // in nanoseconds, by percentile name
+	Throughput float64          `json:"throughput"` // results per second
+	Counters   map[string]int   `json:"counters"`   // server counter deltas
+}
+
+// latencyPctls lists the latency percentiles of the report.
+var latencyPctls = []struct {
+	Name string
+	Pctl int
+}{
+	{"p50", 50}, {"p75", 75}, {"p90", 90}, {"p99", 99}, {"max", 100},
+}
+
+// regressionCounters lists the server counters for which an increase
+// (relative to the number of calls) is a regression.
+var regressionCounters = []string{"MsgsNACK", "RecoveredPanics", "SlowProcessMsg"}
+
+// newReport returns the report of the run.
+func newReport(ts templateStats) *report {
+	r := &report{
+		Run:       ts.Run,
+		Latencies: make(map[string]int64, len(latencyPctls)),
+		Counters:  counterDeltas(ts.Before, ts.After),
+	}
+	for _, p := range latencyPctls {
+		r.Latencies[p.Name] = int64(pctlFn(p.Pctl, ts.Latencies))
+	}
+	if d := ts.Run.ActualDuration; d > 0 {
+		r.Throughput = float64(ts.Run.Res) / d.Seconds()
+	}
+	return r
+}
+
+// counterDeltas returns the difference of each juggler server counter
+// between before and after.
+func counterDeltas(before, after *expVars) map[string]int {
+	res := make(map[string]int)
+	bv := reflect.ValueOf(before.Juggler)
+	av := reflect.ValueOf(after.Juggler)
+	for i := 0; i < bv.NumField(); i++ {
+		res[bv.Type().Field(i).Name] = int(av.Field(i).Int() - bv.Field(i).Int())
+	}
+	return res
+}
+
+func writeReport(path string, r *report) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readReport(path string) (*report, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r report
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// thresholds are the regression thresholds, in percent.
+type thresholds struct {
+	Latency    float64
+	Throughput float64
+	Counters   float64
+}
+
+// comparison is the comparison of a metric with its baseline.
+type comparison struct {
+	Name              string
+	Baseline, Current string
+	Change            float64 // in percent
+	Regression        bool
+}
+
+// compareReports compares cur with the baseline base, flagging the
+// metrics that regressed beyond the thresholds.
+func compareReports(base, cur *report, th thresholds) []comparison {
+	var res []comparison
+
+	for _, p := range latencyPctls {
+		b, c := base.Latencies[p.Name], cur.Latencies[p.Name]
+		chg := change(float64(b), float64(c))
+		res = append(res, comparison{
+			Name:       "latency " + p.Name,
+			Baseline:   time.Duration(b).String(),
+			Current:    time.Duration(c).String(),
+			Change:     chg,
+			Regression: chg > th.Latency,
+		})
+	}
+
+	chg := change(base.Throughput, cur.Throughput)
+	res = append(res, comparison{
+		Name:       "throughput",
+		Baseline:   fmt.Sprintf("%.1f/s", base.Throughput),
+		Current:    fmt.Sprintf("%.1f/s", cur.Throughput),
+		Change:     chg,
+		Regression: -chg > th.Throughput,
+	})
+
+	names := make([]string, 0, len(cur.Counters))
+	for name := range cur.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b, c := base.Counters[name], cur.Counters[name]
+		cmp := comparison{
+			Name:     name,
+			Baseline: fmt.Sprint(b),
+			Current:  fmt.Sprint(c),
+			Change:   change(float64(b), float64(c)),
+		}
+		if isIn(regressionCounters, name) {
+			// compare relative to the number of calls of each run
+			br, cr := perCall(b, base.Run.Calls), perCall(c, cur.Run.Calls)
+			if br == 0 {
+				cmp.Regression = cr > 0
+			} else {
+				cmp.Regression = change(br, cr) > th.Counters
+			}
+		}
+		res = append(res, cmp)
+	}
+	return res
+}
+
+// printComparison prints the comparisons to w, and returns true if
+// there is a regression.
+func printComparison(w io.Writer, cmps []comparison) bool {
+	fmt.Fprint(w, "--- BASELINE COMPARISON\n\n")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "Metric\tBaseline\tCurrent\tChange\t")
+
+	var regressed bool
+	for _, c := range cmps {
+		flag := ""
+		if c.Regression {
+			flag = "REGRESSION"
+			regressed = true
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%+.1f%%\t%s\n", c.Name, c.Baseline, c.Current, c.Change, flag)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	return regressed
+}
+
+// change returns the change from b to c, in percent.
+func change(b, c float64) float64 {
+	if b == 0 {
+		if c == 0 {
+			return 0
+		}
+		return 100
+	}
+	return (c - b) / b * 100
+}
+
+func perCall(n int, calls int64) float64 {
+	if calls == 0 {
+		return 0
+	}
+	return float64(n) / float64(calls)
+}
+
+func isIn(list []string, v string) bool {
+	for _, vv := range list {
+		if vv == v {
+			return true
+		}
+	}
+	return false
+}
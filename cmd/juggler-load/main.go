@@ -28,19 +28,26 @@ import (
 )
 
 var (
-	addrFlag        = flag.String("addr", "ws://localhost:9000/ws", "Server `address`.")
-	connFlag        = flag.Int("c", 100, "Number of `connections`.")
-	durationFlag    = flag.Duration("d", 10*time.Second, "Run `duration`.")
-	delayFlag       = flag.Duration("delay", 0, "Start execution after `delay`.")
-	helpFlag        = flag.Bool("help", false, "Show help.")
-	numURIsFlag     = flag.Int("n", 0, "Spread calls to this `number` of URIs (added as a suffix to the URI).")
-	payloadFlag     = flag.String("p", "100", "Call `payload`.")
-	subprotoFlag    = flag.String("proto", "juggler.0", "Websocket `subprotocol`.")
-	callRateFlag    = flag.Duration("r", 100*time.Millisecond, "Call `rate` per connection. A negative rate makes a call once the previous response is received.")
-	callTimeoutFlag = flag.Duration("t", time.Second, "Call `timeout`.")
-	uriFlag         = flag.String("u", "test.delay", "Call `URI`.")
-	noDebugVarsFlag = flag.Bool("V", false, "No debug vars.")
-	waitFlag        = flag.Duration("w", 5*time.Second, "Wait `duration` for connections to stop.")
+	addrFlag         = flag.String("addr", "ws://localhost:9000/ws", "Server `address`.")
+	baselineFlag     = flag.String("baseline", "", "Compare the run with the JSON report in this `file`, exit with status 1 on regressions.")
+	connFlag         = flag.Int("c", 100, "Number of `connections`.")
+	durationFlag     = flag.Duration("d", 10*time.Second, "Run `duration`.")
+	delayFlag        = flag.Duration("delay", 0, "Start execution after `delay`.")
+	helpFlag         = flag.Bool("help", false, "Show help.")
+	jsonFlag         = flag.String("json", "", "Write the JSON report of the run to this `file`.")
+	latencyThFlag    = flag.Float64("latency-threshold", 10, "Regression threshold of the latency percentiles, in `percent`.")
+	counterThFlag    = flag.Float64("counter-threshold", 10, "Regression threshold of the error counters per call, in `percent`.")
+	throughputThFlag = flag.Float64("throughput-threshold", 10, "Regression threshold of the throughput, in `percent`.")
+	numURIsFlag      = flag.Int("n", 0, "Spread calls to this `number` of URIs (added as a suffix to the URI).")
+	payloadFlag      = flag.String("p", "100", "Call `payload`.")
+	resetPathFlag    = flag.String("reset-metrics", "", "Reset the server metrics before the run with a POST to this `path` (e.g. /debug/metrics).")
+	soakFlag         = flag.Duration("soak", 0, "Soak mode, snapshot server debug vars at this `interval` during the run.")
+	subprotoFlag     = flag.String("proto", "juggler.0", "Websocket `subprotocol`.")
+	callRateFlag     = flag.Duration("r", 100*time.Millisecond, "Call `rate` per connection. A negative rate makes a call once the previous response is received.")
+	callTimeoutFlag  = flag.Duration("t", time.Second, "Call `timeout`.")
+	uriFlag          = flag.String("u", "test.delay", "Call `URI`.")
+	noDebugVarsFlag  = flag.Bool("V", false, "No debug vars.")
+	waitFlag         = flag.Duration("w", 5*time.Second, "Wait `duration` for connections to stop.")
 )
 
 var (
@@ -52,6 +59,17 @@ var (
 		"pctl": pctlFn,
 	}
 
+	soakTpl = template.Must(template.New("soak").Parse(`--- SOAK SNAPSHOTS
+
+Interval:  {{ .Interval | printf "%s" }}
+Snapshots: {{ len .Snapshots }}
+
+Metric              First           Last            Min             Max             Growth
+------------------------------------------------------------------------------------------------------
+{{ range .Series }}{{ .Name | printf "%-19s" }} {{ .First | printf "%-15.0f" }} {{ .Last | printf "%-15.0f" }} {{ .Min | printf "%-15.0f" }} {{ .Max | printf "%-15.0f" }} {{ if .Leak }}MONOTONIC (possible leak){{ else }}-{{ end }}
+{{ end }}
+`))
+
 	tpl = template.Must(template.New("output").Funcs(fnMap).Parse(`
 --- CONFIGURATION
 
@@ -238,6 +256,77 @@ func (b byteSize) String() string {
 	return fmt.Sprintf("%.2fB", b)
 }
 
+// soakMetrics lists the metrics tracked over time in soak mode to detect
+// leaks.
+var soakMetrics = []struct {
+	Name string
+	Fn   func(*expVars) float64
+}{
+	{"Goroutines", func(ev *expVars) float64 { return float64(ev.Goroutines) }},
+	{"ActiveConnGoros", func(ev *expVars) float64 { return float64(ev.Juggler.ActiveConnGoros) }},
+	{"ActiveConns", func(ev *expVars) float64 { return float64(ev.Juggler.ActiveConns) }},
+	{"HeapAlloc", func(ev *expVars) float64 { return float64(ev.Memstats.HeapAlloc) }},
+	{"HeapInuse", func(ev *expVars) float64 { return float64(ev.Memstats.HeapInuse) }},
+	{"HeapObjects", func(ev *expVars) float64 { return float64(ev.Memstats.HeapObjects) }},
+}
+
+type soakStats struct {
+	Interval  time.Duration
+	Snapshots []*expVars
+	Series    []*soakSeries
+}
+
+type soakSeries struct {
+	Name                  string
+	First, Last, Min, Max float64
+	Leak                  bool
+}
+
+// analyzeSoak computes the series of each soak metric over the snapshots,
+// flagging the metrics that grow monotonically over the whole run.
+func analyzeSoak(snaps []*expVars) []*soakSeries {
+	if len(snaps) == 0 {
+		return nil
+	}
+
+	series := make([]*soakSeries, 0, len(soakMetrics))
+	for _, sm := range soakMetrics {
+		vals := make([]float64, len(snaps))
+		for i, snap := range snaps {
+			vals[i] = sm.Fn(snap)
+		}
+		ss := &soakSeries{
+			Name:  sm.Name,
+			First: vals[0],
+			Last:  vals[len(vals)-1],
+			Min:   vals[0],
+			Max:   vals[0],
+		}
+		for _, v := range vals[1:] {
+			ss.Min = math.Min(ss.Min, v)
+			ss.Max = math.Max(ss.Max, v)
+		}
+		ss.Leak = isMonotonicGrowth(vals)
+		series = append(series, ss)
+	}
+	return series
+}
+
+// isMonotonicGrowth returns true if vals never decrease and the last
+// value is greater than the first. At least 3 values are required
+// to flag a growth.
+func isMonotonicGrowth(vals []float64) bool {
+	if len(vals) < 3 {
+		return false
+	}
+	for i := 1; i < len(vals); i++ {
+		if vals[i] < vals[i-1] {
+			return false
+		}
+	}
+	return vals[len(vals)-1] > vals[0]
+}
+
 type templateStats struct {
 	Run       *runStats
 	Before    *expVars
@@ -266,6 +355,8 @@ type runStats struct {
 }
 
 type expVars struct {
+	Goroutines int `json:"goroutines"`
+
 	Juggler struct {
 		ActiveConnGoros    int
 		ActiveConns        int
@@ -335,6 +426,10 @@ func main() {
 	parsed.Scheme = "http"
 	parsed.Path = "/debug/vars"
 
+	if p := *resetPathFlag; p != "" {
+		resetMetrics(parsed, p)
+	}
+
 	before, after := &expVars{}, &expVars{}
 	if !*noDebugVarsFlag {
 		before = getExpVars(parsed)
@@ -355,8 +450,15 @@ func main() {
 		<-clientStarted
 	}
 
-	// run for the requested duration and signal stop
-	<-time.After(stats.Duration)
+	// run for the requested duration and signal stop, taking snapshots
+	// of the debug vars in soak mode.
+	var snaps []*expVars
+	if *soakFlag > 0 && !*noDebugVarsFlag {
+		snaps = append(snaps, getExpVars(parsed))
+		snaps = runSoak(parsed, stats.Duration, *soakFlag, snaps)
+	} else {
+		<-time.After(stats.Duration)
+	}
 	close(stop)
 	log.Printf("stopping...")
 
@@ -389,6 +491,54 @@ func main() {
 	if err := tpl.Execute(os.Stdout, ts); err != nil {
 		log.Fatalf("template.Execute failed: %v", err)
 	}
+
+	rep := newReport(ts)
+	if *jsonFlag != "" {
+		if err := writeReport(*jsonFlag, rep); err != nil {
+			log.Fatalf("failed to write JSON report: %v", err)
+		}
+	}
+
+	var regressed bool
+	if *baselineFlag != "" {
+		base, err := readReport(*baselineFlag)
+		if err != nil {
+			log.Fatalf("failed to read baseline: %v", err)
+		}
+		th := thresholds{Latency: *latencyThFlag, Throughput: *throughputThFlag, Counters: *counterThFlag}
+		regressed = printComparison(os.Stdout, compareReports(base, rep, th))
+	}
+
+	if len(snaps) > 0 {
+		// the after snapshot is taken once all clients are stopped, include
+		// it so that leaks of stopped connections are detected.
+		snaps = append(snaps, after)
+		ss := soakStats{Interval: *soakFlag, Snapshots: snaps, Series: analyzeSoak(snaps)}
+		if err := soakTpl.Execute(os.Stdout, ss); err != nil {
+			log.Fatalf("template.Execute failed: %v", err)
+		}
+	}
+
+	if regressed {
+		os.Exit(1)
+	}
+}
+
+// runSoak takes a snapshot of the debug vars at each interval for the
+// specified duration, appending them to snaps.
+func runSoak(u *url.URL, dur, interval time.Duration, snaps []*expVars) []*expVars {
+	done := time.After(dur)
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-done:
+			return snaps
+		case <-tick.C:
+			snaps = append(snaps, getExpVars(u))
+		}
+	}
 }
 
 func getExpVars(u *url.URL) *expVars {
@@ -408,6 +558,21 @@ func getExpVars(u *url.URL) *expVars {
 	return &ev
 }
 
+// resetMetrics resets the server metrics so that the run's counters
+// start from zero, see juggler.MetricsHandler.
+func resetMetrics(u *url.URL, path string) {
+	ru := *u
+	ru.Path = path
+	res, err := http.Post(ru.String(), "application/json", nil)
+	if err != nil {
+		log.Fatalf("failed to reset metrics: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		log.Fatalf("failed to reset metrics: %d %s", res.StatusCode, res.Status)
+	}
+}
+
 func getURI(stats *runStats) string {
 	uri := stats.URI
 	if stats.NURIs > 0 {
@@ -419,9 +584,8 @@ func getURI(stats *runStats) string {
 
 func runClient(stats *runStats, started chan<- struct{}, stop <-chan struct{}, resLatencies chan<- []time.Duration) {
 	var wgResults sync.WaitGroup
-	var mu sync.Mutex // protects latencies slice and startTimes map
+	var mu sync.Mutex // protects latencies slice
 	var latencies []time.Duration
-	startTimes := make(map[string]time.Time)
 
 	var next chan int
 	if stats.Rate < 0 {
@@ -437,11 +601,11 @@ func runClient(stats *runStats, started chan<- struct{}, stop <-chan struct{}, r
 		client.SetHandler(client.HandlerFunc(func(ctx context.Context, m message.Msg) {
 			switch m.Type() {
 			case message.ResMsg:
-				rm := m.(*message.Res)
-				mu.Lock()
-				dur := time.Now().Sub(startTimes[rm.Payload.For.String()])
-				latencies = append(latencies, dur)
-				mu.Unlock()
+				if lat, ok := client.LatencyFromContext(ctx); ok {
+					mu.Lock()
+					latencies = append(latencies, lat.Res)
+					mu.Unlock()
+				}
 				atomic.AddInt64(&stats.Res, 1)
 
 				if stats.Rate < 0 {
@@ -486,13 +650,9 @@ loop:
 
 		wgResults.Add(1)
 		atomic.AddInt64(&stats.Calls, 1)
-		uid, err := cli.Call(getURI(stats), stats.Payload, stats.Timeout)
-		if err != nil {
+		if _, err := cli.Call(getURI(stats), stats.Payload, stats.Timeout); err != nil {
 			log.Fatalf("Call failed: %v", err)
 		}
-		mu.Lock()
-		startTimes[uid.String()] = time.Now()
-		mu.Unlock()
 
 		if stats.Rate >= 0 {
 			after = time.After(stats.Rate)
@@ -38,3 +38,91 @@ func TestPctlFn(t *testing.T) {
 		assert.Equal(t, c.out, got, "%d", i)
 	}
 }
+
+func TestIsMonotonicGrowth(t *testing.T) {
+	cases := []struct {
+		in  []float64
+		out bool
+	}{
+		{nil, false},
+		{[]float64{1}, false},
+		{[]float64{1, 2}, false},
+		{[]float64{1, 2, 3}, true},
+		{[]float64{1, 1, 1}, false},
+		{[]float64{1, 1, 2}, true},
+		{[]float64{1, 3, 2}, false},
+		{[]float64{3, 2, 1}, false},
+		{[]float64{1, 2, 2, 2, 5}, true},
+	}
+
+	for i, c := range cases {
+		got := isMonotonicGrowth(c.in)
+		assert.Equal(t, c.out, got, "%d", i)
+	}
+}
+
+func TestAnalyzeSoak(t *testing.T) {
+	snaps := make([]*expVars, 4)
+	for i := range snaps {
+		snaps[i] = &expVars{Goroutines: 10 + i}
+		snaps[i].Juggler.ActiveConns = 5
+	}
+
+	series := analyzeSoak(snaps)
+	for _, ss := range series {
+		switch ss.Name {
+		case "Goroutines":
+			assert.True(t, ss.Leak, "goroutines leak")
+			assert.Equal(t, 10.0, ss.First, "first")
+			assert.Equal(t, 13.0, ss.Last, "last")
+			assert.Equal(t, 10.0, ss.Min, "min")
+			assert.Equal(t, 13.0, ss.Max, "max")
+		default:
+			assert.False(t, ss.Leak, "%s leak", ss.Name)
+		}
+	}
+	assert.Nil(t, analyzeSoak(nil), "no snapshot")
+}
+
+func TestCompareReports(t *testing.T) {
+	base := &report{
+		Run:        &runStats{Calls: 100},
+		Latencies:  map[string]int64{"p50": 100, "p75": 200, "p90": 300, "p99": 400, "max": 500},
+		Throughput: 1000,
+		Counters:   map[string]int{"MsgsNACK": 10, "MsgsCALL": 100, "RecoveredPanics": 0},
+	}
+	cur := &report{
+		Run:        &runStats{Calls: 200},
+		Latencies:  map[string]int64{"p50": 105, "p75": 200, "p90": 300, "p99": 500, "max": 500},
+		Throughput: 950,
+		Counters:   map[string]int{"MsgsNACK": 20, "MsgsCALL": 200, "RecoveredPanics": 1},
+	}
+
+	cmps := compareReports(base, cur, thresholds{Latency: 10, Throughput: 10, Counters: 10})
+	regs := make(map[string]bool)
+	for _, c := range cmps {
+		regs[c.Name] = c.Regression
+	}
+	assert.Equal(t, map[string]bool{
+		"latency p50":     false, // +5%
+		"latency p75":     false,
+		"latency p90":     false,
+		"latency p99":     true, // +25%
+		"latency max":     false,
+		"throughput":      false, // -5%
+		"MsgsCALL":        false, // not a regression counter
+		"MsgsNACK":        false, // same ratio per call
+		"RecoveredPanics": true,  // from 0
+	}, regs)
+
+	cur.Throughput = 800
+	cmps = compareReports(base, cur, thresholds{Latency: 30, Throughput: 10, Counters: 10})
+	for _, c := range cmps {
+		if c.Name == "throughput" {
+			assert.True(t, c.Regression, "throughput -20%")
+		}
+		if c.Name == "latency p99" {
+			assert.False(t, c.Regression, "p99 within threshold")
+		}
+	}
+}
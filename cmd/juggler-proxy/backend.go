@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backend is a juggler server that receives the proxied connections.
+type backend struct {
+	URL    *url.URL
+	Weight int
+
+	active int64 // number of active proxied connections, accessed atomically
+
+	mu       sync.Mutex
+	healthy  bool
+	draining bool
+}
+
+// available returns true if the backend can receive new connections.
+func (b *backend) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy && !b.draining
+}
+
+func (b *backend) setHealthy(v bool) {
+	b.mu.Lock()
+	b.healthy = v
+	b.mu.Unlock()
+}
+
+func (b *backend) setDraining(v bool) {
+	b.mu.Lock()
+	b.draining = v
+	b.mu.Unlock()
+}
+
+// backendStatus is the JSON-encoded status of a backend, as returned
+// by the /backends admin endpoint.
+type backendStatus struct {
+	URL      string `json:"url"`
+	Weight   int    `json:"weight"`
+	Healthy  bool   `json:"healthy"`
+	Draining bool   `json:"draining"`
+	Active   int64  `json:"active"`
+}
+
+func (b *backend) status() *backendStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &backendStatus{
+		URL:      b.URL.String(),
+		Weight:   b.Weight,
+		Healthy:  b.healthy,
+		Draining: b.draining,
+		Active:   atomic.LoadInt64(&b.active),
+	}
+}
+
+// check checks the health of the backend. If path is empty, the
+// backend is healthy if a TCP connection can be established, otherwise
+// an HTTP GET request is made on path and the backend is healthy if
+// it returns a 200 status code.
+func (b *backend) check(client *http.Client, path string) bool {
+	if path == "" {
+		conn, err := net.DialTimeout("tcp", b.URL.Host, client.Timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	u := *b.URL
+	u.Scheme = "http"
+	if b.URL.Scheme == "wss" {
+		u.Scheme = "https"
+	}
+	u.Path = path
+	u.RawQuery = ""
+	res, err := client.Get(u.String())
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusOK
+}
+
+// backendList is the list of backends, it implements flag.Value so
+// that the -backend flag can be repeated.
+type backendList []*backend
+
+func (l *backendList) String() string {
+	parts := make([]string, 0, len(*l))
+	for _, b := range *l {
+		parts = append(parts, fmt.Sprintf("%s=%d", b.URL, b.Weight))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses a backend in the form URL[=weight] and adds it to the
+// list. The default weight is 1.
+func (l *backendList) Set(v string) error {
+	weight := 1
+	if ix := strings.LastIndex(v, "="); ix >= 0 {
+		w, err := strconv.Atoi(v[ix+1:])
+		if err != nil || w <= 0 {
+			return fmt.Errorf("invalid weight in %q", v)
+		}
+		weight = w
+		v = v[:ix]
+	}
+
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return fmt.Errorf("invalid backend scheme in %q, must be ws or wss", v)
+	}
+	*l = append(*l, &backend{URL: u, Weight: weight, healthy: true})
+	return nil
+}
+
+// pick selects an available backend using weighted random routing,
+// with rnd returning a random number in [0, n). It returns nil if no
+// backend is available.
+func (l backendList) pick(rnd func(n int) int) *backend {
+	var total int
+	avail := make([]*backend, 0, len(l))
+	for _, b := range l {
+		if b.available() {
+			avail = append(avail, b)
+			total += b.Weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rnd(total)
+	for _, b := range avail {
+		if n < b.Weight {
+			return b
+		}
+		n -= b.Weight
+	}
+	return nil
+}
+
+// find returns the backend with the specified URL, or nil.
+func (l backendList) find(rawurl string) *backend {
+	for _, b := range l {
+		if b.URL.String() == rawurl {
+			return b
+		}
+	}
+	return nil
+}
+
+// healthCheck checks the health of all backends every interval, until
+// stop is closed.
+func (l backendList) healthCheck(interval time.Duration, path string, stop <-chan struct{}, logFn func(string, ...interface{})) {
+	client := &http.Client{Timeout: interval}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		for _, b := range l {
+			ok := b.check(client, path)
+			if was := b.status().Healthy; was != ok {
+				logFn("backend %s healthy: %t", b.URL, ok)
+			}
+			b.setHealthy(ok)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
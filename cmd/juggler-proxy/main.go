@@ -0,0 +1,288 @@
+// Command juggler-proxy implements a front-end proxy that terminates
+// the client websocket connections and forwards the juggler frames
+// to a pool of backend juggler servers. It is useful to change the
+// topology of the backend servers without touching the clients.
+//
+// Backends are specified with the -backend flag, in the form
+// URL[=weight] (e.g. ws://10.0.0.1:9000/ws=2), and the flag can be
+// repeated. New connections are routed to a random healthy backend,
+// weighted by the backend's weight. The health of the backends is
+// checked periodically, and backends can be drained (no new
+// connection is routed to them, but existing connections are kept)
+// using the admin endpoints, served on the -admin-addr address if it
+// is set (it should not be reachable by the clients):
+//
+//     GET /backends                          : list the backends and their status
+//     POST /backends/drain?url=URL[&drain=0] : drain (or undrain) the backend
+//
+// On SIGINT or SIGTERM, the proxy stops accepting new connections and
+// waits for the existing connections to terminate, up to the
+// -drain-timeout duration.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	adminAddrFlag      = flag.String("admin-addr", "", "Admin endpoints `address`, disabled if empty.")
+	backendsFlag       backendList
+	drainTimeoutFlag   = flag.Duration("drain-timeout", 30*time.Second, "Maximum `duration` to wait for connections to terminate on shutdown.")
+	healthIntervalFlag = flag.Duration("health-interval", 5*time.Second, "Backends health check `interval`.")
+	healthPathFlag     = flag.String("health-path", "", "HTTP `path` to check the health of backends, TCP connection check if empty.")
+	helpFlag           = flag.Bool("help", false, "Show help.")
+	noLogFlag          = flag.Bool("L", false, "Disable logging.")
+	pathFlag           = flag.String("path", "/ws", "Websocket `path` to listen on.")
+	portFlag           = flag.Int("port", 9000, "Proxy `port`.")
+)
+
+func init() {
+	flag.Var(&backendsFlag, "backend", "Backend `URL[=weight]`, can be repeated.")
+}
+
+func main() {
+	flag.Parse()
+	if *helpFlag {
+		flag.Usage()
+		return
+	}
+	if len(backendsFlag) == 0 {
+		fmt.Fprintln(os.Stderr, "at least one backend must be specified.")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	logFn := log.Printf
+	if *noLogFlag {
+		logFn = func(_ string, _ ...interface{}) {}
+	}
+
+	stop := make(chan struct{})
+	go backendsFlag.healthCheck(*healthIntervalFlag, *healthPathFlag, stop, logFn)
+
+	p := &proxy{
+		backends: backendsFlag,
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())).Intn,
+		logFn:    logFn,
+	}
+	http.Handle(*pathFlag, p)
+
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(*portFlag))
+	if err != nil {
+		log.Fatalf("Listen failed: %v", err)
+	}
+
+	var al net.Listener
+	if *adminAddrFlag != "" {
+		if al, err = net.Listen("tcp", *adminAddrFlag); err != nil {
+			log.Fatalf("admin Listen failed: %v", err)
+		}
+		admin := http.NewServeMux()
+		admin.HandleFunc("/backends", p.serveBackends)
+		admin.HandleFunc("/backends/drain", p.serveDrain)
+		go func() {
+			logFn("listening for admin requests on %s", *adminAddrFlag)
+			if err := http.Serve(al, admin); err != nil {
+				select {
+				case <-stop:
+				default:
+					log.Fatalf("admin Serve failed: %v", err)
+				}
+			}
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		logFn("shutting down, waiting for active connections to terminate")
+		close(stop)
+		l.Close()
+		if al != nil {
+			al.Close()
+		}
+	}()
+
+	logFn("listening for connections on :%d%s", *portFlag, *pathFlag)
+	if err := http.Serve(l, nil); err != nil {
+		select {
+		case <-stop:
+		default:
+			log.Fatalf("Serve failed: %v", err)
+		}
+	}
+
+	if !p.wait(*drainTimeoutFlag) {
+		logFn("drain timeout expired, %d connections dropped", p.activeConns())
+	}
+}
+
+// proxy is the http.Handler that proxies the websocket connections to
+// the backends.
+type proxy struct {
+	backends backendList
+	rnd      func(int) int
+	logFn    func(string, ...interface{})
+
+	mu     sync.Mutex // protects rnd, which is not safe for concurrent use, and closed
+	closed bool       // set when waiting for the connections to terminate
+	wg     sync.WaitGroup
+}
+
+// ServeHTTP connects to a backend, upgrades the client connection to
+// the same subprotocol as the one negotiated with the backend, and
+// forwards the frames in both directions until either side closes
+// the connection.
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// add to the wait group under the lock, so that it cannot race
+	// with wait.
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	p.wg.Add(1)
+	b := p.backends.pick(p.rnd)
+	p.mu.Unlock()
+	defer p.wg.Done()
+
+	if b == nil {
+		http.Error(w, "no backend available", http.StatusServiceUnavailable)
+		return
+	}
+
+	hdr := http.Header{}
+	if v := r.Header.Get("Juggler-Allowed-Messages"); v != "" {
+		hdr.Set("Juggler-Allowed-Messages", v)
+	}
+	d := &websocket.Dialer{Subprotocols: websocket.Subprotocols(r)}
+	bconn, _, err := d.Dial(b.URL.String(), hdr)
+	if err != nil {
+		p.logFn("%s: failed to dial backend %s: %v", r.RemoteAddr, b.URL, err)
+		http.Error(w, "backend unavailable", http.StatusBadGateway)
+		return
+	}
+	defer bconn.Close()
+
+	// when the Upgrader has no Subprotocols, the subprotocol is taken
+	// from the response header.
+	upg := &websocket.Upgrader{}
+	var rhdr http.Header
+	if proto := bconn.Subprotocol(); proto != "" {
+		rhdr = http.Header{"Sec-WebSocket-Protocol": {proto}}
+	}
+	cconn, err := upg.Upgrade(w, r, rhdr)
+	if err != nil {
+		return
+	}
+	defer cconn.Close()
+
+	atomic.AddInt64(&b.active, 1)
+	defer atomic.AddInt64(&b.active, -1)
+
+	p.logFn("%s: proxying to %s", r.RemoteAddr, b.URL)
+	errc := make(chan error, 2)
+	go func() { errc <- forward(bconn, cconn) }()
+	go func() { errc <- forward(cconn, bconn) }()
+
+	err = <-errc
+	p.logFn("%s: connection closed: %v", r.RemoteAddr, err)
+}
+
+// forward copies the messages read from src to dst, until an error
+// occurs.
+func forward(dst, src *websocket.Conn) error {
+	for {
+		mt, r, err := src.NextReader()
+		if err != nil {
+			dst.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(time.Second))
+			return err
+		}
+		w, err := dst.NextWriter(mt)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *proxy) activeConns() int64 {
+	var n int64
+	for _, b := range p.backends {
+		n += atomic.LoadInt64(&b.active)
+	}
+	return n
+}
+
+// wait waits for the active connections to terminate, up to timeout.
+// The new connections are refused once it is called. It returns false
+// if the timeout expired.
+func (p *proxy) wait(timeout time.Duration) bool {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (p *proxy) serveBackends(w http.ResponseWriter, r *http.Request) {
+	list := make([]*backendStatus, 0, len(p.backends))
+	for _, b := range p.backends {
+		list = append(list, b.status())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (p *proxy) serveDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b := p.backends.find(r.FormValue("url"))
+	if b == nil {
+		http.Error(w, "backend not found", http.StatusNotFound)
+		return
+	}
+
+	drain := r.FormValue("drain") != "0"
+	b.setDraining(drain)
+	p.logFn("backend %s draining: %t", b.URL, drain)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendListSet(t *testing.T) {
+	cases := []struct {
+		in     string
+		url    string
+		weight int
+		err    bool
+	}{
+		{"ws://a:9000/ws", "ws://a:9000/ws", 1, false},
+		{"wss://a/ws=3", "wss://a/ws", 3, false},
+		{"ws://a/ws?x=1=2", "ws://a/ws?x=1", 2, false},
+		{"http://a/ws", "", 0, true},
+		{"ws://a/ws=0", "", 0, true},
+		{"ws://a/ws=x", "", 0, true},
+	}
+	for i, c := range cases {
+		var l backendList
+		err := l.Set(c.in)
+		if c.err {
+			assert.Error(t, err, "%d: %s", i, c.in)
+			continue
+		}
+		if assert.NoError(t, err, "%d: %s", i, c.in) {
+			assert.Equal(t, c.url, l[0].URL.String(), "%d: url", i)
+			assert.Equal(t, c.weight, l[0].Weight, "%d: weight", i)
+		}
+	}
+}
+
+func TestBackendListPick(t *testing.T) {
+	var l backendList
+	require.NoError(t, l.Set("ws://a=1"), "Set a")
+	require.NoError(t, l.Set("ws://b=2"), "Set b")
+	require.NoError(t, l.Set("ws://c=3"), "Set c")
+
+	pick := func(n int) string {
+		b := l.pick(func(int) int { return n })
+		if b == nil {
+			return ""
+		}
+		return b.URL.Host
+	}
+	assert.Equal(t, "a", pick(0), "0")
+	assert.Equal(t, "b", pick(1), "1")
+	assert.Equal(t, "b", pick(2), "2")
+	assert.Equal(t, "c", pick(3), "3")
+	assert.Equal(t, "c", pick(5), "5")
+
+	// b is draining, c is unhealthy
+	l[1].setDraining(true)
+	l[2].setHealthy(false)
+	assert.Equal(t, "a", pick(0), "only a")
+
+	l[0].setHealthy(false)
+	assert.Equal(t, "", pick(0), "none available")
+}
+
+func TestProxy(t *testing.T) {
+	// backend echoes messages
+	upg := &websocket.Upgrader{Subprotocols: []string{"juggler.0"}}
+	bsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upg.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(mt, b); err != nil {
+				return
+			}
+		}
+	}))
+	defer bsrv.Close()
+
+	var l backendList
+	require.NoError(t, l.Set(strings.Replace(bsrv.URL, "http:", "ws:", 1)), "Set")
+	p := &proxy{backends: l, rnd: func(int) int { return 0 }, logFn: func(string, ...interface{}) {}}
+	psrv := httptest.NewServer(p)
+	defer psrv.Close()
+
+	d := &websocket.Dialer{Subprotocols: []string{"juggler.0"}}
+	conn, _, err := d.Dial(strings.Replace(psrv.URL, "http:", "ws:", 1), nil)
+	require.NoError(t, err, "Dial")
+	defer conn.Close()
+	assert.Equal(t, "juggler.0", conn.Subprotocol(), "subprotocol")
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("hello")), "WriteMessage")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, b, err := conn.ReadMessage()
+	require.NoError(t, err, "ReadMessage")
+	assert.Equal(t, "hello", string(b), "echoed message")
+	assert.Equal(t, int64(1), p.activeConns(), "active connections")
+
+	conn.Close()
+
+	// no backend available
+	l[0].setHealthy(false)
+	_, res, err := d.Dial(strings.Replace(psrv.URL, "http:", "ws:", 1), nil)
+	if assert.Error(t, err, "Dial without backend") {
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "status")
+	}
+	l[0].setHealthy(true)
+
+	// new connections are refused once shutting down
+	assert.True(t, p.wait(time.Second), "connections terminated")
+	_, res, err = d.Dial(strings.Replace(psrv.URL, "http:", "ws:", 1), nil)
+	if assert.Error(t, err, "Dial when shutting down") {
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode, "status")
+	}
+	assert.Equal(t, int64(0), p.activeConns(), "no active connection")
+}
@@ -0,0 +1,212 @@
+// Command juggler-replay replays a stream of messages recorded by the
+// srvhandler.Recorder (see the record_file option of juggler-server).
+// It is mostly useful to reproduce bugs observed in production, and to
+// run load scenarios based on actual traffic.
+//
+// In server mode (the default), the requests (CALL, SUB, UNSB, PUB)
+// of each recorded connection are sent to a juggler server using one
+// client per recorded connection. In client mode, it serves websocket
+// connections and sends the responses (ACK, NACK, RES, EVNT) of the
+// recorded connections to each connecting client.
+//
+// Messages are replayed at the original speed by default, but the
+// -speed flag can be used to scale it (e.g. 2 to replay twice as fast,
+// 0 to replay without delay).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/gorilla/websocket"
+	"github.com/mna/juggler"
+	"github.com/mna/juggler/client"
+	"github.com/mna/juggler/internal/srvhandler"
+	"github.com/mna/juggler/message"
+)
+
+var (
+	addrFlag     = flag.String("addr", "ws://localhost:9000/ws", "Server `address` in server mode.")
+	connFlag     = flag.String("conn", "", "Replay only this recorded connection `UUID`.")
+	helpFlag     = flag.Bool("help", false, "Show help.")
+	modeFlag     = flag.String("mode", "server", "Replay `mode`, server or client.")
+	portFlag     = flag.Int("port", 9000, "Listening `port` in client mode.")
+	speedFlag    = flag.Float64("speed", 1, "Replay speed `factor`, 0 means no delay.")
+	subprotoFlag = flag.String("proto", "juggler.0", "Websocket `subprotocol`.")
+)
+
+// recording is the loaded recorded stream, grouped by connection.
+type recording struct {
+	start time.Time
+	all   []*srvhandler.RecordEntry // in recorded order
+	conns map[string][]*srvhandler.RecordEntry
+	order []string
+}
+
+func main() {
+	flag.Parse()
+	if *helpFlag || flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] FILE\n", os.Args[0])
+		flag.PrintDefaults()
+		return
+	}
+
+	rec, err := loadRecording(flag.Arg(0), *connFlag)
+	if err != nil {
+		log.Fatalf("failed to load recording: %v", err)
+	}
+	log.Printf("loaded %d connections", len(rec.order))
+
+	switch *modeFlag {
+	case "server":
+		replayToServer(rec)
+	case "client":
+		replayToClients(rec)
+	default:
+		log.Fatalf("invalid -mode value %q, must be server or client", *modeFlag)
+	}
+}
+
+func loadRecording(file, connUUID string) (*recording, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rec := &recording{conns: make(map[string][]*srvhandler.RecordEntry)}
+	err = srvhandler.ReadRecords(f, func(e *srvhandler.RecordEntry) error {
+		key := e.ConnUUID.String()
+		if connUUID != "" && key != connUUID {
+			return nil
+		}
+		if rec.start.IsZero() {
+			rec.start = e.Time
+		}
+		if _, ok := rec.conns[key]; !ok {
+			rec.order = append(rec.order, key)
+		}
+		rec.conns[key] = append(rec.conns[key], e)
+		rec.all = append(rec.all, e)
+		return nil
+	})
+	return rec, err
+}
+
+// waitUntil waits until the scaled offset of t relative to the start
+// of the recording has elapsed since the start of the replay.
+func waitUntil(rec *recording, replayStart, t time.Time) {
+	if *speedFlag <= 0 {
+		return
+	}
+	off := time.Duration(float64(t.Sub(rec.start)) / *speedFlag)
+	if d := replayStart.Add(off).Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func replayToServer(rec *recording) {
+	var sent, recv int64
+
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		atomic.AddInt64(&recv, 1)
+	})
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	wg.Add(len(rec.order))
+	for _, key := range rec.order {
+		go func(key string, entries []*srvhandler.RecordEntry) {
+			defer wg.Done()
+
+			cli, err := client.Dial(&websocket.Dialer{Subprotocols: []string{*subprotoFlag}},
+				*addrFlag, nil, client.SetHandler(h))
+			if err != nil {
+				log.Printf("%s: Dial failed: %v", key, err)
+				return
+			}
+			defer cli.Close()
+
+			for _, e := range entries {
+				m, err := e.Message()
+				if err != nil {
+					log.Printf("%s: invalid message: %v", key, err)
+					continue
+				}
+				if !m.Type().IsRead() {
+					continue
+				}
+
+				waitUntil(rec, start, e.Time)
+				if err := sendRequest(cli, m); err != nil {
+					log.Printf("%s: failed to send %s: %v", key, m.Type(), err)
+					return
+				}
+				atomic.AddInt64(&sent, 1)
+			}
+		}(key, rec.conns[key])
+	}
+	wg.Wait()
+
+	log.Printf("replayed %d requests in %s, received %d responses",
+		atomic.LoadInt64(&sent), time.Now().Sub(start), atomic.LoadInt64(&recv))
+}
+
+func sendRequest(cli *client.Client, m message.Msg) error {
+	var err error
+	switch m := m.(type) {
+	case *message.Call:
+		_, err = cli.Call(m.Payload.URI, m.Payload.Args, m.Payload.Timeout)
+	case *message.Sub:
+		_, err = cli.Sub(m.Payload.Channel, m.Payload.Pattern)
+	case *message.Unsb:
+		_, err = cli.Unsb(m.Payload.Channel, m.Payload.Pattern)
+	case *message.Pub:
+		_, err = cli.Pub(m.Payload.Channel, m.Payload.Args)
+	}
+	return err
+}
+
+func replayToClients(rec *recording) {
+	upg := &websocket.Upgrader{Subprotocols: juggler.Subprotocols}
+	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upg.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		log.Printf("%v: replaying to client", conn.RemoteAddr())
+		start := time.Now()
+		var sent int
+		for _, e := range rec.all {
+			m, err := e.Message()
+			if err != nil || !m.Type().IsWrite() {
+				continue
+			}
+
+			waitUntil(rec, start, e.Time)
+			if err := conn.WriteJSON(m); err != nil {
+				log.Printf("%v: failed to send %s: %v", conn.RemoteAddr(), m.Type(), err)
+				return
+			}
+			sent++
+		}
+		log.Printf("%v: replayed %d responses in %s", conn.RemoteAddr(), sent, time.Now().Sub(start))
+	})
+
+	addr := ":" + strconv.Itoa(*portFlag)
+	log.Printf("listening for client connections on %s/ws", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Fatalf("ListenAndServe failed: %v", err)
+	}
+}
@@ -13,9 +13,15 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-// Redis defines the redis-specific configuration options.
+// Redis defines the redis-specific configuration options. Namespace
+// is the prefix of the redis keys and channels of the brokers (see
+// redisbroker.Broker.Namespace).
 type Redis struct {
 	Addr        string        `yaml:"addr"`
+	Password    string        `yaml:"password"`
+	DB          int           `yaml:"db"`
+	Namespace   string        `yaml:"namespace"`
+	TLS         *RedisTLS     `yaml:"tls"`
 	MaxActive   int           `yaml:"max_active"`
 	MaxIdle     int           `yaml:"max_idle"`
 	IdleTimeout time.Duration `yaml:"idle_timeout"`
@@ -23,22 +29,68 @@ type Redis struct {
 	Caller      *Redis        `yaml:"caller"`
 }
 
+// RedisTLS defines the TLS configuration options of the connections
+// to redis. If it is set, the connections use TLS, verified with the
+// system's root CAs unless CAFile is set. CertFile and KeyFile set
+// the client certificate, if the server requires one.
+type RedisTLS struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
 // CallerBroker defines the configuration options for the caller broker.
 type CallerBroker struct {
 	BlockingTimeout time.Duration `yaml:"blocking_timeout"`
 	CallCap         int           `yaml:"call_cap"`
+	PrefixRouting   bool          `yaml:"prefix_routing"`
+	FlushInterval   time.Duration `yaml:"flush_interval"`
+	Dispatchers     int           `yaml:"dispatchers"`
+	DedupWindow     time.Duration `yaml:"dedup_window"`
+	PriorityQueues  bool          `yaml:"priority_queues"`
+}
+
+// PubSubBroker defines the configuration options for the pub-sub broker.
+type PubSubBroker struct {
+	DurableChannels  []string      `yaml:"durable_channels"`
+	DurableRetention time.Duration `yaml:"durable_retention"`
+	Topics           bool          `yaml:"topics"`
+}
+
+// ChannelPolicy defines a channel policy, see juggler.ChannelPolicy.
+type ChannelPolicy struct {
+	Pattern string `yaml:"pattern"`
+	Sub     bool   `yaml:"sub"`
+	PSub    bool   `yaml:"psub"`
+	Pub     bool   `yaml:"pub"`
 }
 
 // Server defines the juggler server configuration options.
 type Server struct {
 	// HTTP server configuration for the websocket handshake/upgrade
-	Addr               string        `yaml:"addr"`
-	Paths              []string      `yaml:"paths"`
-	MaxHeaderBytes     int           `yaml:"max_header_bytes"`
-	ReadBufferSize     int           `yaml:"read_buffer_size"`
-	WriteBufferSize    int           `yaml:"write_buffer_size"`
-	HandshakeTimeout   time.Duration `yaml:"handshake_timeout"`
-	WhitelistedOrigins []string      `yaml:"whitelisted_origins"`
+	Addr                      string        `yaml:"addr"`
+	AdminAddr                 string        `yaml:"admin_addr"`
+	Paths                     []string      `yaml:"paths"`
+	MaxHeaderBytes            int           `yaml:"max_header_bytes"`
+	ReadBufferSize            int           `yaml:"read_buffer_size"`
+	WriteBufferSize           int           `yaml:"write_buffer_size"`
+	HandshakeTimeout          time.Duration `yaml:"handshake_timeout"`
+	WhitelistedOrigins        []string      `yaml:"whitelisted_origins"`
+	WhitelistedOriginPatterns []string      `yaml:"whitelisted_origin_patterns"`
+	AllowAllOrigins           bool          `yaml:"allow_all_origins"`
+	AllowNoOrigin             bool          `yaml:"allow_no_origin"`
+	AllowSameOrigin           bool          `yaml:"allow_same_origin"`
+	TrustProxyHeaders         bool          `yaml:"trust_proxy_headers"`
+	MaxConns                  int           `yaml:"max_conns"`
+	AcceptQueueSize           int           `yaml:"accept_queue_size"`
+	AcceptQueueTimeout        time.Duration `yaml:"accept_queue_timeout"`
+	HealthPath                string        `yaml:"health_path"`
+	ReadyPath                 string        `yaml:"ready_path"`
+	ChannelsPath              string        `yaml:"channels_path"`
+	MetricsPath               string        `yaml:"metrics_path"`
+	CallPath                  string        `yaml:"call_path"`
 
 	// websocket/juggler configuration
 	ReadLimit               int64         `yaml:"read_limit"`
@@ -47,17 +99,61 @@ type Server struct {
 	WriteTimeout            time.Duration `yaml:"write_timeout"`
 	AcquireWriteLockTimeout time.Duration `yaml:"acquire_write_lock_timeout"`
 	AllowEmptySubprotocol   bool          `yaml:"allow_empty_subprotocol"`
+	CompressThreshold       int           `yaml:"compress_threshold"`
+	EnableCompression       bool          `yaml:"enable_compression"`
+	CompressionLevel        int           `yaml:"compression_level"`
+	OffloadThreshold        int           `yaml:"offload_threshold"`
+	BlobPath                string        `yaml:"blob_path"`
+	MaxChunkedArgs          int64         `yaml:"max_chunked_args"`
+	DegradedMode            bool          `yaml:"degraded_mode"`
+	RecoverInterval         time.Duration `yaml:"recover_interval"`
+	RTTInterval             time.Duration `yaml:"rtt_interval"`
+	PingInterval            time.Duration `yaml:"ping_interval"`
+	PongTimeout             time.Duration `yaml:"pong_timeout"`
+	SendQueueSize           int           `yaml:"send_queue_size"`
+	WritePolicy             string        `yaml:"write_policy"`
+	SendQueueOverflow       string        `yaml:"send_queue_overflow"`
+	WriteBatchSize          int           `yaml:"write_batch_size"`
+	MaxFanOut               int           `yaml:"max_fan_out"`
+	ResultDedupSize         int           `yaml:"result_dedup_size"`
+	NackNoCallee            bool          `yaml:"nack_no_callee"`
+	CalleeHealthInterval    time.Duration `yaml:"callee_health_interval"`
+
+	// message field limits
+	MaxURILen     int `yaml:"max_uri_len"`
+	MaxChannelLen int `yaml:"max_channel_len"`
+	MaxCallArgs   int `yaml:"max_call_args"`
+	MaxPubArgs    int `yaml:"max_pub_args"`
+
+	// call URI policy
+	AllowedURIs []string `yaml:"allowed_uris"`
+	DeniedURIs  []string `yaml:"denied_uris"`
+
+	// channel policies
+	ChannelPolicies []ChannelPolicy `yaml:"channel_policies"`
 
 	// handler options
 	CloseURI                string        `yaml:"close_uri"`
 	PanicURI                string        `yaml:"panic_uri"`
+	CloseOnPanic            bool          `yaml:"close_on_panic"`
 	SlowProcessMsgThreshold time.Duration `yaml:"slow_process_msg_threshold"`
+
+	// logging options
+	LogLevel string `yaml:"log_level"`
+
+	// debug options
+	FirehosePath       string  `yaml:"firehose_path"`
+	FirehoseSampleRate float64 `yaml:"firehose_sample_rate"`
+	FirehoseMaxPayload int     `yaml:"firehose_max_payload"`
+	FirehoseRedactArgs bool    `yaml:"firehose_redact_args"`
+	RecordFile         string  `yaml:"record_file"`
 }
 
 // Config defines the configuration options of the server.
 type Config struct {
 	Redis        *Redis        `yaml:"redis"`
 	CallerBroker *CallerBroker `yaml:"caller_broker"`
+	PubSubBroker *PubSubBroker `yaml:"pubsub_broker"`
 	Server       *Server       `yaml:"server"`
 }
 
@@ -73,6 +169,9 @@ func getDefaultConfig() *Config {
 			BlockingTimeout: 0,
 			CallCap:         0,
 		},
+		PubSubBroker: &PubSubBroker{
+			DurableRetention: 0,
+		},
 		Server: &Server{
 			Addr:                    ":" + strconv.Itoa(*portFlag),
 			Paths:                   []string{"/ws"},
@@ -134,8 +233,13 @@ func isZeroRedis(rc *Redis) bool {
 
 // check redis configuration: use Config.Redis to use the same pool
 // for pubsub and caller, or use Config.Redis.PubSub and Config.Redis.Caller.
-// No other combination is accepted.
+// No other combination is accepted. Redis cluster only supports the
+// database 0.
 func checkRedisConfig(conf *Redis) error {
+	if *redisClusterFlag && conf.DB != 0 {
+		return errors.New("redis.db cannot be set with redis cluster")
+	}
+
 	// if either PubSub or Caller is set, then both must be set
 	if !isZeroRedis(conf.PubSub) || !isZeroRedis(conf.Caller) {
 		if (conf.PubSub == nil || conf.PubSub.Addr == "") || (conf.Caller == nil || conf.Caller.Addr == "") {
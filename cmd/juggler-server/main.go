@@ -2,16 +2,38 @@
 // connections and serves the requests. It is mostly useful as a testing
 // and debugging tool, typical applications will use the juggler package
 // as a library in their own main command.
+//
+// When it receives SIGHUP, it reloads its configuration file and
+// applies the new timeouts, limits, whitelisted origins, log level and
+// close and panic URIs of the server section without closing the
+// active connections. The other options require a restart.
+//
+// The admin and debug handlers (the firehose, the channels listing,
+// the metrics snapshot, the HTTP call bridge, the blobs and the expvar
+// and pprof endpoints) are only served on the admin address of the
+// server section, if it is set. It should not be reachable by the
+// untrusted clients, as the call bridge bypasses the authentication
+// and the URI policies of the server, and the blobs can be read by
+// anyone who knows their reference.
+//
+// On SIGINT or SIGTERM, it closes the HTTP servers and the call
+// bridge, and exits.
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"expvar"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
@@ -21,6 +43,7 @@ import (
 	"github.com/mna/juggler"
 	"github.com/mna/juggler/broker"
 	"github.com/mna/juggler/broker/redisbroker"
+	"github.com/mna/juggler/httpbridge"
 	"github.com/mna/juggler/internal/srvhandler"
 	"github.com/mna/juggler/message"
 	"github.com/mna/redisc"
@@ -59,7 +82,18 @@ func main() {
 		os.Exit(3)
 	}
 
-	logFn := log.Printf
+	if _, ok := logLevels[conf.Server.LogLevel]; !ok {
+		fmt.Fprintf(os.Stderr, "invalid log level: %q\n", conf.Server.LogLevel)
+		flag.Usage()
+		os.Exit(1)
+	}
+	live, err := newLiveConfig(conf.Server)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	logFn := live.logFunc(logInfo)
 	if *noLogFlag {
 		logFn = func(_ string, _ ...interface{}) {}
 	}
@@ -108,42 +142,168 @@ func main() {
 		logFn("redis pool configured on %s (pubsub) and %s (caller)", conf.Redis.PubSub.Addr, conf.Redis.Caller.Addr)
 	}
 
-	psb := newPubSubBroker(poolp, dialp, logFn)
-	cb := newCallerBroker(conf.CallerBroker, poolc, dialc, logFn)
+	psb := newPubSubBroker(conf.PubSubBroker, conf.Redis.Namespace, poolp, dialp, logFn)
+	cb := newCallerBroker(conf.CallerBroker, conf.Redis.Namespace, poolc, dialc, logFn)
+	if err := cb.(*redisbroker.Broker).LoadScripts(); err != nil {
+		logFn("failed to preload redis scripts: %v", err)
+	}
+
+	// the websocket and health handlers are served on mux, the admin
+	// and debug handlers on admin, which has the expvar and pprof ones.
+	mux := http.NewServeMux()
+	admin := http.DefaultServeMux
+
+	vars := expvar.NewMap("juggler")
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	fh := newFirehose(conf.Server, vars)
+	if fh != nil {
+		admin.Handle(conf.Server.FirehosePath, fh)
+		logFn("firehose debug tap enabled on %s%s", conf.Server.AdminAddr, conf.Server.FirehosePath)
+	}
+
+	rec, err := newRecorder(conf.Server)
+	if err != nil {
+		log.Fatalf("failed to open record file: %v", err)
+	}
+	if rec != nil {
+		logFn("recording messages to %s", conf.Server.RecordFile)
+	}
 
 	srv := newServer(conf.Server, psb, cb, logFn)
-	srv.Handler = newHandler(conf.Server, logFn)
-	srv.Vars = expvar.NewMap("juggler")
+	wp, err := juggler.ParseWritePolicy(conf.Server.WritePolicy)
+	if err != nil {
+		log.Fatalf("invalid write policy: %v", err)
+	}
+	srv.WritePolicy = wp
+	op, err := juggler.ParseOverflowPolicy(conf.Server.SendQueueOverflow)
+	if err != nil {
+		log.Fatalf("invalid send queue overflow policy: %v", err)
+	}
+	srv.SendQueueOverflow = op
+	srv.Topics = conf.PubSubBroker.Topics
+	srv.Handler = newHandler(live, fh, rec, logFn)
+	srv.Vars = vars
 	juggler.SlowProcessMsgThreshold = conf.Server.SlowProcessMsgThreshold
 
-	upg := newUpgrader(conf.Server) // must be after newServer, for Subprotocols
+	if bs, ok := cb.(broker.BlobStore); ok && conf.Server.OffloadThreshold > 0 {
+		srv.BlobStore = bs
+		if p := conf.Server.BlobPath; p != "" {
+			admin.Handle(p, juggler.BlobHandler(bs))
+		}
+	}
+	if hb, ok := cb.(broker.HealthBroker); ok && conf.Server.NackNoCallee {
+		srv.CalleeHealth = hb
+		srv.CalleeHealthInterval = conf.Server.CalleeHealthInterval
+	}
+
+	upg := newUpgrader(conf.Server, live) // must be after newServer, for Subprotocols
 
-	upgh := juggler.Upgrade(upg, srv)
+	upgh := juggler.UpgradeWithConfig(upg, srv, juggler.UpgradeConfig{
+		TrustProxyHeaders: conf.Server.TrustProxyHeaders,
+	})
 	for _, p := range conf.Server.Paths {
-		http.Handle(p, upgh)
+		mux.Handle(p, upgh)
 	}
 
-	httpSrv := newHTTPServer(conf.Server)
+	if p := conf.Server.HealthPath; p != "" {
+		mux.HandleFunc(p, juggler.HealthHandler)
+	}
+	if p := conf.Server.ReadyPath; p != "" {
+		mux.Handle(p, juggler.ReadyHandler(srv))
+	}
+	if p := conf.Server.ChannelsPath; p != "" {
+		admin.Handle(p, juggler.ChannelsHandler(srv))
+	}
+	if p := conf.Server.MetricsPath; p != "" {
+		admin.Handle(p, juggler.MetricsHandler(srv))
+	}
+	var bridge *httpbridge.Handler
+	if p := conf.Server.CallPath; p != "" {
+		bridge = &httpbridge.Handler{Broker: cb, Prefix: p, Vars: vars}
+		admin.Handle(p, bridge)
+	}
+
+	if *configFlag != "" {
+		go reloadOnSignal(*configFlag, live, srv, logFn)
+	}
+
+	servers := []*http.Server{newHTTPServer(conf.Server, mux)}
+	if addr := conf.Server.AdminAddr; addr != "" {
+		adminSrv := newAdminServer(conf.Server, admin)
+		servers = append(servers, adminSrv)
+		go func() {
+			logFn("listening for admin requests on %s", addr)
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("admin ListenAndServe failed: %v", err)
+			}
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		logFn("shutting down")
+		for _, s := range servers {
+			s.Close()
+		}
+	}()
 
 	logFn("listening for connections on %s", conf.Server.Addr)
-	if err := httpSrv.ListenAndServe(); err != nil {
+	if err := servers[0].ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("ListenAndServe failed: %v", err)
 	}
+
+	// the servers are closed, no new call can be made on the bridge
+	if bridge != nil {
+		if err := bridge.Close(); err != nil {
+			logFn("failed to close the HTTP call bridge: %v", err)
+		}
+	}
+}
+
+// newFirehose returns the firehose of the configuration conf, or nil
+// if it is disabled. It requires the admin address, as the firehose
+// streams the messages of all connections.
+func newFirehose(conf *Server, vars *expvar.Map) *srvhandler.Firehose {
+	if conf.FirehosePath == "" || conf.AdminAddr == "" {
+		return nil
+	}
+	fh := &srvhandler.Firehose{
+		SampleRate: conf.FirehoseSampleRate,
+		MaxPayload: conf.FirehoseMaxPayload,
+		Vars:       vars,
+	}
+	if conf.FirehoseRedactArgs {
+		fh.Redact = srvhandler.RedactArgs
+	}
+	return fh
 }
 
-func newHandler(conf *Server, logFn func(string, ...interface{})) juggler.Handler {
-	closeURI := conf.CloseURI
-	panicURI := conf.PanicURI
-	writeTimeout := conf.WriteTimeout
+func newRecorder(conf *Server) (*srvhandler.Recorder, error) {
+	if conf.RecordFile == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(conf.RecordFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &srvhandler.Recorder{W: f}, nil
+}
 
+func newHandler(live *liveConfig, fh *srvhandler.Firehose, rec *srvhandler.Recorder, logFn func(string, ...interface{})) juggler.Handler {
 	process := juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
 		if call, ok := m.(*message.Call); ok {
+			// the URIs may be changed by a reload of the configuration
+			conf := live.get()
 			switch call.Payload.URI {
-			case closeURI:
+			case conf.CloseURI:
 				wsc := c.UnderlyingConn()
 
-				deadline := time.Now().Add(writeTimeout)
-				if writeTimeout == 0 {
+				deadline := time.Now().Add(conf.WriteTimeout)
+				if conf.WriteTimeout == 0 {
 					deadline = time.Time{}
 				}
 
@@ -155,7 +315,7 @@ func newHandler(conf *Server, logFn func(string, ...interface{})) juggler.Handle
 				}
 				return
 
-			case panicURI:
+			case conf.PanicURI:
 				panic("called panic URI")
 			}
 		}
@@ -163,66 +323,77 @@ func newHandler(conf *Server, logFn func(string, ...interface{})) juggler.Handle
 	})
 
 	chain := []juggler.Handler{process}
+	if fh != nil {
+		chain = append([]juggler.Handler{fh}, chain...)
+	}
+	if rec != nil {
+		chain = append([]juggler.Handler{rec}, chain...)
+	}
 	if !*noLogFlag {
-		chain = append([]juggler.Handler{srvhandler.LogMsg(logFn)}, chain...)
+		chain = append([]juggler.Handler{srvhandler.LogMsg(live.logFunc(logDebug))}, chain...)
 	}
-	return srvhandler.PanicRecover(srvhandler.Chain(chain...), nil)
+	return srvhandler.Chain(chain...)
 }
 
-func newPubSubBroker(pool redisbroker.Pool, dial func() (redis.Conn, error), logFn func(string, ...interface{})) broker.PubSubBroker {
+func newPubSubBroker(conf *PubSubBroker, ns string, pool redisbroker.Pool, dial func() (redis.Conn, error), logFn func(string, ...interface{})) broker.PubSubBroker {
 	return &redisbroker.Broker{
-		Pool:    pool,
-		Dial:    dial,
-		LogFunc: logFn,
+		Pool:             pool,
+		Dial:             dial,
+		Namespace:        ns,
+		DurableChannels:  conf.DurableChannels,
+		DurableRetention: conf.DurableRetention,
+		Topics:           conf.Topics,
+		LogFunc:          logFn,
 	}
 }
 
-func newCallerBroker(conf *CallerBroker, pool redisbroker.Pool, dial func() (redis.Conn, error), logFn func(string, ...interface{})) broker.CallerBroker {
+func newCallerBroker(conf *CallerBroker, ns string, pool redisbroker.Pool, dial func() (redis.Conn, error), logFn func(string, ...interface{})) broker.CallerBroker {
 	return &redisbroker.Broker{
 		Pool:            pool,
 		Dial:            dial,
+		Namespace:       ns,
 		BlockingTimeout: conf.BlockingTimeout,
 		CallCap:         conf.CallCap,
+		PrefixRouting:   conf.PrefixRouting,
+		FlushInterval:   conf.FlushInterval,
+		Dispatchers:     conf.Dispatchers,
+		DedupWindow:     conf.DedupWindow,
+		PriorityQueues:  conf.PriorityQueues,
 		LogFunc:         logFn,
 	}
 }
 
-func isIn(list []string, v string) bool {
-	for _, vv := range list {
-		if v == vv {
-			return true
-		}
-	}
-	return false
-}
-
-func newUpgrader(conf *Server) *websocket.Upgrader {
-	upg := &websocket.Upgrader{
+func newUpgrader(conf *Server, live *liveConfig) *websocket.Upgrader {
+	return &websocket.Upgrader{
 		HandshakeTimeout: conf.HandshakeTimeout,
 		ReadBufferSize:   conf.ReadBufferSize,
 		WriteBufferSize:  conf.WriteBufferSize,
 		Subprotocols:     juggler.Subprotocols,
+		CheckOrigin:      checkOrigin(live),
 	}
-
-	if len(conf.WhitelistedOrigins) > 0 {
-		oris := conf.WhitelistedOrigins
-		upg.CheckOrigin = func(r *http.Request) bool {
-			o := r.Header.Get("Origin")
-			return isIn(oris, o)
-		}
-	}
-	return upg
 }
 
-func newHTTPServer(conf *Server) *http.Server {
+func newHTTPServer(conf *Server, h http.Handler) *http.Server {
 	return &http.Server{
 		Addr:           conf.Addr,
+		Handler:        h,
 		ReadTimeout:    conf.ReadTimeout,
 		WriteTimeout:   conf.WriteTimeout,
 		MaxHeaderBytes: conf.MaxHeaderBytes,
 	}
 }
 
+// newAdminServer returns the HTTP server of the admin address of conf.
+// It has no read and write timeouts, as the firehose and the pprof
+// profiles stream their responses.
+func newAdminServer(conf *Server, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:           conf.AdminAddr,
+		Handler:        h,
+		MaxHeaderBytes: conf.MaxHeaderBytes,
+	}
+}
+
 func newServer(conf *Server, pubSub broker.PubSubBroker, caller broker.CallerBroker, logFn func(string, ...interface{})) *juggler.Server {
 	if conf.AllowEmptySubprotocol {
 		juggler.Subprotocols = append(juggler.Subprotocols, "")
@@ -238,10 +409,50 @@ func newServer(conf *Server, pubSub broker.PubSubBroker, caller broker.CallerBro
 		WriteLimit:              conf.WriteLimit,
 		WriteTimeout:            conf.WriteTimeout,
 		AcquireWriteLockTimeout: conf.AcquireWriteLockTimeout,
-		ConnState:               cs,
-		PubSubBroker:            pubSub,
-		CallerBroker:            caller,
+		MaxConns:                conf.MaxConns,
+		AcceptQueueSize:         conf.AcceptQueueSize,
+		AcceptQueueTimeout:      conf.AcceptQueueTimeout,
+		CompressThreshold:       conf.CompressThreshold,
+		EnableCompression:       conf.EnableCompression,
+		CompressionLevel:        conf.CompressionLevel,
+		OffloadThreshold:        conf.OffloadThreshold,
+		MaxChunkedArgs:          conf.MaxChunkedArgs,
+		DegradedMode:            conf.DegradedMode,
+		RecoverInterval:         conf.RecoverInterval,
+		RTTInterval:             conf.RTTInterval,
+		PingInterval:            conf.PingInterval,
+		PongTimeout:             conf.PongTimeout,
+		SendQueueSize:           conf.SendQueueSize,
+		WriteBatchSize:          conf.WriteBatchSize,
+		MaxFanOut:               conf.MaxFanOut,
+		ResultDedupSize:         conf.ResultDedupSize,
+		CloseOnPanic:            conf.CloseOnPanic,
+		Limits: message.Limits{
+			MaxURILen:     conf.MaxURILen,
+			MaxChannelLen: conf.MaxChannelLen,
+			MaxCallArgs:   conf.MaxCallArgs,
+			MaxPubArgs:    conf.MaxPubArgs,
+		},
+		AllowedURIs:     conf.AllowedURIs,
+		DeniedURIs:      conf.DeniedURIs,
+		ChannelPolicies: channelPolicies(conf.ChannelPolicies),
+		ConnState:       cs,
+		PubSubBroker:    pubSub,
+		CallerBroker:    caller,
+	}
+}
+
+func channelPolicies(conf []ChannelPolicy) []juggler.ChannelPolicy {
+	var pols []juggler.ChannelPolicy
+	for _, p := range conf {
+		pols = append(pols, juggler.ChannelPolicy{
+			Pattern: p.Pattern,
+			Sub:     p.Sub,
+			PSub:    p.PSub,
+			Pub:     p.Pub,
+		})
 	}
+	return pols
 }
 
 func newRedisCluster(addr string, createPool func(string, ...redis.DialOption) (*redis.Pool, error)) (*redisc.Cluster, error) {
@@ -253,8 +464,60 @@ func newRedisCluster(addr string, createPool func(string, ...redis.DialOption) (
 	return c, err
 }
 
+// redisDialOptions returns the options to dial a redis connection
+// with the authentication, database and TLS settings of conf.
+func redisDialOptions(conf *Redis) ([]redis.DialOption, error) {
+	var opts []redis.DialOption
+	if conf.Password != "" {
+		opts = append(opts, redis.DialPassword(conf.Password))
+	}
+	if conf.DB != 0 {
+		opts = append(opts, redis.DialDatabase(conf.DB))
+	}
+	if conf.TLS != nil {
+		tlsConf, err := newRedisTLSConfig(conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConf))
+	}
+	return opts, nil
+}
+
+func newRedisTLSConfig(conf *RedisTLS) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+	if conf.CAFile != "" {
+		b, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.CAFile)
+		}
+		tlsConf.RootCAs = roots
+	}
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
 func redisPoolCreateFunc(conf *Redis) func(string, ...redis.DialOption) (*redis.Pool, error) {
 	return func(addr string, opts ...redis.DialOption) (*redis.Pool, error) {
+		confOpts, err := redisDialOptions(conf)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(confOpts, opts...)
+
 		p := &redis.Pool{
 			MaxIdle:     conf.MaxIdle,
 			MaxActive:   conf.MaxActive,
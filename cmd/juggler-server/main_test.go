@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http"
 	"strings"
 	"testing"
 	"time"
@@ -74,6 +75,7 @@ redis:
 				Redis:        &Redis{Addr: "localhost:1234"},
 				Server:       &Server{Addr: ":9000", Paths: []string{"/ws"}, SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold},
 				CallerBroker: &CallerBroker{},
+				PubSubBroker: &PubSubBroker{},
 			},
 		},
 		{
@@ -98,12 +100,19 @@ redis:
 				},
 				Server:       &Server{Addr: ":9000", Paths: []string{"/ws"}, SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold},
 				CallerBroker: &CallerBroker{},
+				PubSubBroker: &PubSubBroker{},
 			},
 		},
 		{
 			`
 redis:
     addr: localhost:1234
+    password: secret
+    db: 3
+    namespace: tenant1
+    tls:
+        ca_file: /etc/redis/ca.pem
+        server_name: redis.local
     max_active: 34
     max_idle: 5
     idle_timeout: 1s
@@ -111,9 +120,20 @@ redis:
 caller_broker:
     blocking_timeout: 2s
     call_cap: 987
+    prefix_routing: true
+    flush_interval: 5ms
+    dispatchers: 4
+    dedup_window: 1m
+    priority_queues: true
+
+pubsub_broker:
+    durable_channels:
+    - dashboard.*
+    durable_retention: 10m
 
 server:
     addr: :9876
+    admin_addr: 127.0.0.1:9877
 
     paths:
     - /ws
@@ -126,6 +146,18 @@ server:
 
     whitelisted_origins:
     - http://localhost:4444
+    whitelisted_origin_patterns:
+    - ^https://[a-z]+\.example\.com$
+    allow_all_origins: true
+    allow_no_origin: true
+    allow_same_origin: true
+    trust_proxy_headers: true
+    max_conns: 12
+    health_path: /healthz
+    ready_path: /readyz
+    channels_path: /debug/channels
+    metrics_path: /debug/metrics
+    call_path: /call/
 
     read_limit: 6
     write_limit: 7
@@ -134,13 +166,71 @@ server:
     acquire_write_lock_timeout: 3h
 
     allow_empty_subprotocol: true
+    compress_threshold: 13
+    offload_threshold: 14
+    max_chunked_args: 15
+    degraded_mode: true
+    recover_interval: 16s
+    rtt_interval: 17s
+    ping_interval: 21s
+    pong_timeout: 22s
+    send_queue_size: 18
+    write_policy: priority
+    send_queue_overflow: drop-oldest
+    write_batch_size: 24
+    max_fan_out: 19
+    result_dedup_size: 20
+    nack_no_callee: true
+    callee_health_interval: 25s
+    blob_path: /blobs
+
+    max_uri_len: 8
+    max_channel_len: 9
+    max_call_args: 10
+    max_pub_args: 11
+
+    allowed_uris:
+    - app.*
+    denied_uris:
+    - app.old.*
+
+    channel_policies:
+    - pattern: user.{tag:user}.*
+      sub: true
+      psub: true
+    - pattern: public.*
+      sub: true
+      pub: true
+
+    close_on_panic: true
+
+    log_level: info
+
+    firehose_path: /debug/firehose
+    firehose_sample_rate: 0.5
+    firehose_max_payload: 100
+    firehose_redact_args: true
+    record_file: /tmp/juggler.rec
 `, &Config{
-				Redis: &Redis{Addr: "localhost:1234", MaxActive: 34, MaxIdle: 5, IdleTimeout: time.Second},
-				Server: &Server{Addr: ":9876", Paths: []string{"/ws", "/"}, MaxHeaderBytes: 23, ReadBufferSize: 4,
+				Redis: &Redis{Addr: "localhost:1234", Password: "secret", DB: 3, Namespace: "tenant1", TLS: &RedisTLS{CAFile: "/etc/redis/ca.pem", ServerName: "redis.local"},
+					MaxActive: 34, MaxIdle: 5, IdleTimeout: time.Second},
+				Server: &Server{Addr: ":9876", AdminAddr: "127.0.0.1:9877", Paths: []string{"/ws", "/"}, MaxHeaderBytes: 23, ReadBufferSize: 4,
 					WriteBufferSize: 5, HandshakeTimeout: time.Minute, WhitelistedOrigins: []string{"http://localhost:4444"},
+					WhitelistedOriginPatterns: []string{`^https://[a-z]+\.example\.com$`}, AllowAllOrigins: true, AllowNoOrigin: true, AllowSameOrigin: true, TrustProxyHeaders: true,
+					MaxConns: 12, HealthPath: "/healthz", ReadyPath: "/readyz", ChannelsPath: "/debug/channels", MetricsPath: "/debug/metrics", CallPath: "/call/",
 					ReadLimit: 6, WriteLimit: 7, ReadTimeout: time.Hour, WriteTimeout: 2 * time.Hour,
-					AcquireWriteLockTimeout: 3 * time.Hour, AllowEmptySubprotocol: true, SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold},
-				CallerBroker: &CallerBroker{BlockingTimeout: 2 * time.Second, CallCap: 987},
+					AcquireWriteLockTimeout: 3 * time.Hour, AllowEmptySubprotocol: true, CompressThreshold: 13, OffloadThreshold: 14, BlobPath: "/blobs", MaxChunkedArgs: 15, DegradedMode: true, RecoverInterval: 16 * time.Second, RTTInterval: 17 * time.Second, PingInterval: 21 * time.Second, PongTimeout: 22 * time.Second, SendQueueSize: 18, WritePolicy: "priority", SendQueueOverflow: "drop-oldest", WriteBatchSize: 24, MaxFanOut: 19, ResultDedupSize: 20, NackNoCallee: true, CalleeHealthInterval: 25 * time.Second, SlowProcessMsgThreshold: juggler.SlowProcessMsgThreshold,
+					MaxURILen: 8, MaxChannelLen: 9, MaxCallArgs: 10, MaxPubArgs: 11,
+					AllowedURIs: []string{"app.*"}, DeniedURIs: []string{"app.old.*"},
+					ChannelPolicies: []ChannelPolicy{
+						{Pattern: "user.{tag:user}.*", Sub: true, PSub: true},
+						{Pattern: "public.*", Sub: true, Pub: true},
+					},
+					CloseOnPanic: true,
+					LogLevel:     "info",
+					FirehosePath: "/debug/firehose", FirehoseSampleRate: 0.5, FirehoseMaxPayload: 100, FirehoseRedactArgs: true, RecordFile: "/tmp/juggler.rec"},
+				CallerBroker: &CallerBroker{BlockingTimeout: 2 * time.Second, CallCap: 987, PrefixRouting: true, FlushInterval: 5 * time.Millisecond, Dispatchers: 4, DedupWindow: time.Minute, PriorityQueues: true},
+				PubSubBroker: &PubSubBroker{DurableChannels: []string{"dashboard.*"}, DurableRetention: 10 * time.Minute},
 			},
 		},
 	}
@@ -153,3 +243,50 @@ server:
 		}
 	}
 }
+
+func TestCheckOrigin(t *testing.T) {
+	live, err := newLiveConfig(&Server{})
+	require.NoError(t, err, "newLiveConfig")
+	fn := checkOrigin(live)
+
+	cases := []struct {
+		conf   Server
+		origin string
+		want   bool
+	}{
+		{Server{}, "", true},
+		{Server{}, "http://example.com", true},
+		{Server{}, "http://other.com", false},
+		{Server{WhitelistedOrigins: []string{"http://other.com"}}, "http://other.com", true},
+		{Server{WhitelistedOrigins: []string{"http://other.com"}}, "http://example.com", false},
+		{Server{WhitelistedOrigins: []string{"http://other.com"}}, "", false},
+		{Server{WhitelistedOriginPatterns: []string{`^http://[a-z]+\.other\.com$`}}, "http://a.other.com", true},
+		{Server{WhitelistedOriginPatterns: []string{`^http://[a-z]+\.other\.com$`}}, "http://other.com", false},
+		{Server{WhitelistedOriginPatterns: []string{`(`}}, "http://example.com", false},
+		{Server{AllowAllOrigins: true}, "http://other.com", true},
+		{Server{WhitelistedOrigins: []string{"http://other.com"}, AllowSameOrigin: true}, "http://example.com", true},
+		{Server{WhitelistedOrigins: []string{"http://other.com"}, AllowSameOrigin: true}, "", false},
+		{Server{WhitelistedOrigins: []string{"http://other.com"}, AllowNoOrigin: true}, "", true},
+		{Server{WhitelistedOrigins: []string{"http://other.com"}, AllowNoOrigin: true}, "http://example.com", false},
+	}
+	for i, c := range cases {
+		// the whitelisted origins are reloaded, an invalid configuration
+		// is rejected and the current one is kept
+		conf := c.conf
+		live.set(&conf)
+
+		r, err := http.NewRequest("GET", "http://example.com/ws", nil)
+		require.NoError(t, err, "%d: NewRequest", i)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		assert.Equal(t, c.want, fn(r), "%d", i)
+	}
+
+	// an invalid pattern is rejected and the current policy is kept
+	assert.Error(t, live.set(&Server{WhitelistedOriginPatterns: []string{`(`}}), "set invalid pattern")
+	r, err := http.NewRequest("GET", "http://example.com/ws", nil)
+	require.NoError(t, err, "NewRequest")
+	r.Header.Set("Origin", "http://other.com")
+	assert.True(t, fn(r), "policy kept")
+}
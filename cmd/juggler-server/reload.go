@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/mna/juggler"
+	"github.com/mna/juggler/message"
+)
+
+// The log levels of the server, set by Server.LogLevel. The default
+// level is logDebug.
+const (
+	logNone  = "none"  // nothing is logged
+	logInfo  = "info"  // connections and errors are logged
+	logDebug = "debug" // each message is logged too
+)
+
+var logLevels = map[string]int{
+	logNone:  0,
+	logInfo:  1,
+	logDebug: 2,
+	"":       2,
+}
+
+// liveConfig holds the server configuration that is reloaded when the
+// process receives SIGHUP. The options that are read from it apply
+// without restarting the server, the others are only read at startup.
+type liveConfig struct {
+	v atomic.Value // *liveState
+}
+
+// liveState is the configuration stored in a liveConfig, with the
+// origin policy built from it.
+type liveState struct {
+	conf   *Server
+	policy *juggler.OriginPolicy
+}
+
+// newLiveConfig returns a liveConfig that holds conf. It returns an
+// error if a whitelisted origin pattern of conf is invalid.
+func newLiveConfig(conf *Server) (*liveConfig, error) {
+	var lc liveConfig
+	if err := lc.set(conf); err != nil {
+		return nil, err
+	}
+	return &lc, nil
+}
+
+// set builds the origin policy of conf and stores conf as the current
+// configuration. If a whitelisted origin pattern is invalid, it
+// returns an error and the current configuration is kept.
+func (lc *liveConfig) set(conf *Server) error {
+	p, err := originPolicy(conf)
+	if err != nil {
+		return err
+	}
+	lc.v.Store(&liveState{conf: conf, policy: p})
+	return nil
+}
+
+func (lc *liveConfig) get() *Server {
+	return lc.v.Load().(*liveState).conf
+}
+
+func (lc *liveConfig) policy() *juggler.OriginPolicy {
+	return lc.v.Load().(*liveState).policy
+}
+
+// logFunc returns a logging function that logs using log.Printf if
+// the current log level is at least level.
+func (lc *liveConfig) logFunc(level string) func(string, ...interface{}) {
+	return func(f string, args ...interface{}) {
+		if logLevels[lc.get().LogLevel] >= logLevels[level] {
+			log.Printf(f, args...)
+		}
+	}
+}
+
+// serverSettings returns the juggler.Settings of the configuration
+// conf.
+func serverSettings(conf *Server) juggler.Settings {
+	return juggler.Settings{
+		ReadLimit:               conf.ReadLimit,
+		ReadTimeout:             conf.ReadTimeout,
+		WriteLimit:              conf.WriteLimit,
+		WriteTimeout:            conf.WriteTimeout,
+		AcquireWriteLockTimeout: conf.AcquireWriteLockTimeout,
+		Limits: message.Limits{
+			MaxURILen:     conf.MaxURILen,
+			MaxChannelLen: conf.MaxChannelLen,
+			MaxCallArgs:   conf.MaxCallArgs,
+			MaxPubArgs:    conf.MaxPubArgs,
+		},
+	}
+}
+
+// reloadOnSignal reloads the configuration file each time the process
+// receives SIGHUP, and applies the timeouts, limits, whitelisted
+// origins, log level and close and panic URIs of the server
+// configuration. The active connections stay open. If the file cannot
+// be loaded, the current configuration is kept. It never returns.
+func reloadOnSignal(file string, live *liveConfig, srv *juggler.Server, logFn func(string, ...interface{})) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		conf, err := getConfigFromFile(file)
+		if err != nil {
+			logFn("failed to reload configuration file: %v", err)
+			continue
+		}
+		if _, ok := logLevels[conf.Server.LogLevel]; !ok {
+			logFn("failed to reload configuration file: invalid log level %q", conf.Server.LogLevel)
+			continue
+		}
+		if err := live.set(conf.Server); err != nil {
+			logFn("failed to reload configuration file: %v", err)
+			continue
+		}
+		srv.UpdateSettings(serverSettings(conf.Server))
+		logFn("configuration reloaded from %s", file)
+	}
+}
+
+// originPolicy returns the origin policy of the configuration conf.
+// It returns an error if a whitelisted origin pattern is invalid.
+func originPolicy(conf *Server) (*juggler.OriginPolicy, error) {
+	p := &juggler.OriginPolicy{
+		AllowedOrigins:  conf.WhitelistedOrigins,
+		AllowAll:        conf.AllowAllOrigins,
+		AllowNoOrigin:   conf.AllowNoOrigin,
+		AllowSameOrigin: conf.AllowSameOrigin,
+	}
+	for _, pat := range conf.WhitelistedOriginPatterns {
+		re, err := regexp.Compile(pat)
+		if err != nil {
+			return nil, fmt.Errorf("invalid whitelisted origin pattern %q: %v", pat, err)
+		}
+		p.AllowedOriginPatterns = append(p.AllowedOriginPatterns, re)
+	}
+	return p, nil
+}
+
+// checkOrigin returns the CheckOrigin function of the upgrader, that
+// applies the origin policy of the current configuration: it accepts
+// all origins if AllowAllOrigins is set, otherwise only the origins
+// whitelisted in it, or the requests from the same origin (or without
+// origin) if there are none or if AllowSameOrigin (or AllowNoOrigin)
+// is set.
+func checkOrigin(live *liveConfig) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		return live.policy().CheckOrigin(r)
+	}
+}
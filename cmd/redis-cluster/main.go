@@ -0,0 +1,94 @@
+// Command redis-cluster starts a local redis cluster for development.
+// It starts the redis-server processes in cluster mode, assigns the
+// hash slots evenly between the nodes, waits for the cluster to be
+// ready, prints the addresses of the nodes and waits for SIGINT or
+// SIGTERM. With -disjoint, the nodes are started but the cluster is
+// not formed. By default,
+// the nodes are stopped and their working directory is removed on exit.
+// With -teardown=false, the command exits once the nodes are started
+// and leaves them running.
+//
+// The configuration file of each node is generated from a text/template
+// that receives the Port and Dir of the node, see the default template
+// in the internal/localcluster package.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/mna/juggler/internal/localcluster"
+)
+
+var (
+	configFlag   = flag.String("config", "", "Path of the node configuration template `file`.")
+	disjointFlag = flag.Bool("disjoint", false, "Start the nodes without forming the cluster.")
+	dirFlag      = flag.String("dir", "", "Working `directory` of the nodes, a temporary directory if empty.")
+	helpFlag     = flag.Bool("help", false, "Show help.")
+	nodesFlag    = flag.Int("n", 3, "Number of `nodes`.")
+	portFlag     = flag.Int("port", 7000, "Base `port`, each node uses the next port.")
+	redisFlag    = flag.String("redis-server", "redis-server", "Path of the redis-server `binary`.")
+	teardownFlag = flag.Bool("teardown", true, "Stop the nodes on exit.")
+	verboseFlag  = flag.Bool("v", false, "Print the output of the nodes.")
+)
+
+func main() {
+	flag.Parse()
+	if *helpFlag {
+		flag.Usage()
+		return
+	}
+
+	conf := localcluster.Config{
+		Nodes:       *nodesFlag,
+		BasePort:    *portFlag,
+		RedisServer: *redisFlag,
+		Dir:         *dirFlag,
+		Disjoint:    *disjointFlag,
+	}
+	if *configFlag != "" {
+		b, err := ioutil.ReadFile(*configFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read configuration template: %v\n", err)
+			os.Exit(1)
+		}
+		conf.Template = string(b)
+	}
+	if *verboseFlag {
+		conf.Stdout, conf.Stderr = os.Stdout, os.Stderr
+	}
+	if !*teardownFlag && conf.Dir == "" {
+		fmt.Fprintln(os.Stderr, "-dir must be set when -teardown is false.")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cluster, err := localcluster.Start(conf)
+	if err != nil {
+		log.Fatalf("failed to start cluster: %v", err)
+	}
+
+	addrs := make([]string, len(cluster.Ports))
+	for i, p := range cluster.Ports {
+		addrs[i] = ":" + p
+	}
+	log.Printf("cluster nodes started on %s", strings.Join(addrs, ","))
+	if !*teardownFlag {
+		return
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	log.Printf("stopping cluster nodes")
+	if err := cluster.Close(); err != nil {
+		log.Fatalf("failed to stop cluster: %v", err)
+	}
+}
@@ -3,6 +3,10 @@
 // theoretically reach. The scenario closest to jugger is the -e 4, which
 // marshals/unmarshals a JSON payload and sets a timeout key via a script
 // along with pushing/popping the call to the redis list.
+//
+// The -e 6 and -e 7 scenarios measure the pub-sub path, respectively
+// the PUBLISH/SUBSCRIBE throughput and latency, with the payload size
+// and number of channels controlled by the -payload and -channels flags.
 package main
 
 import (
@@ -10,6 +14,8 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -19,8 +25,10 @@ import (
 )
 
 var (
+	channelsFlag  = flag.Int("channels", 1, "Number of pub-sub `channels`.")
 	durationFlag  = flag.Duration("d", 10*time.Second, "Duration of the test.")
 	execTypeFlag  = flag.Int("e", 0, "Type of execution.")
+	payloadFlag   = flag.Int("payload", 16, "Size of the pub-sub payload, in `bytes`.")
 	redisAddrFlag = flag.String("redis", ":6379", "Redis `address`.")
 )
 
@@ -72,6 +80,13 @@ func main() {
 	case 5:
 		// pure push/pop with N goroutines each
 		push, pop = purePushPopGoros()
+	case 6:
+		// pub-sub throughput, push is PUBLISH and pop is received events
+		push, pop = pubSubThroughput(c1, c2)
+	case 7:
+		// pub-sub latency, publishes an event and waits for it
+		pubSubLatency(c1, c2)
+		return
 	default:
 		panic("unknown exec type")
 	}
@@ -253,6 +268,137 @@ loop:
 	return push, atomic.LoadInt64(&pop)
 }
 
+// channels returns the list of pub-sub channels to use.
+func channels() []interface{} {
+	n := *channelsFlag
+	if n <= 0 {
+		n = 1
+	}
+	chans := make([]interface{}, n)
+	for i := range chans {
+		chans[i] = "test:channel:" + strconv.Itoa(i)
+	}
+	return chans
+}
+
+// subscribe subscribes c to chans and returns the PubSubConn once
+// all subscriptions are confirmed.
+func subscribe(c redis.Conn, chans []interface{}) redis.PubSubConn {
+	psc := redis.PubSubConn{Conn: c}
+	if err := psc.Subscribe(chans...); err != nil {
+		log.Fatalf("SUBSCRIBE failed: %v", err)
+	}
+	for i := 0; i < len(chans); i++ {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+		case error:
+			log.Fatalf("SUBSCRIBE failed: %v", v)
+		}
+	}
+	return psc
+}
+
+// payload returns a payload of the -payload size, that starts with
+// the current time in nanoseconds.
+func payload() []byte {
+	b := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	for len(b) < *payloadFlag {
+		b = append(b, 'x')
+	}
+	return b
+}
+
+func pubSubThroughput(c1, c2 redis.Conn) (int64, int64) {
+	var push, pop int64
+	chans := channels()
+	psc := subscribe(c2, chans)
+	go func() {
+		for {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				atomic.AddInt64(&pop, 1)
+			case error:
+				log.Fatalf("Receive failed: %v", v)
+			}
+		}
+	}()
+
+	p := payload()
+	done := time.After(*durationFlag)
+loop:
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			break loop
+		default:
+		}
+		if _, err := c1.Do("PUBLISH", chans[i%len(chans)], p); err != nil {
+			log.Fatalf("PUBLISH failed: %v", err)
+		}
+		push++
+	}
+
+	time.Sleep(time.Second)
+	return push, atomic.LoadInt64(&pop)
+}
+
+func pubSubLatency(c1, c2 redis.Conn) {
+	chans := channels()
+	psc := subscribe(c2, chans)
+
+	var lats []time.Duration
+	done := time.After(*durationFlag)
+loop:
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			break loop
+		default:
+		}
+		if _, err := c1.Do("PUBLISH", chans[i%len(chans)], payload()); err != nil {
+			log.Fatalf("PUBLISH failed: %v", err)
+		}
+
+		for {
+			v := psc.Receive()
+			if err, ok := v.(error); ok {
+				log.Fatalf("Receive failed: %v", err)
+			}
+			if m, ok := v.(redis.Message); ok {
+				ix := 0
+				for ix < len(m.Data) && m.Data[ix] != 'x' {
+					ix++
+				}
+				ns, err := strconv.ParseInt(string(m.Data[:ix]), 10, 64)
+				if err != nil {
+					log.Fatalf("invalid payload: %v", err)
+				}
+				lats = append(lats, time.Duration(time.Now().UnixNano()-ns))
+				break
+			}
+		}
+	}
+
+	if len(lats) == 0 {
+		fmt.Println("no event received")
+		return
+	}
+	sort.Sort(durations(lats))
+	var total time.Duration
+	for _, d := range lats {
+		total += d
+	}
+	fmt.Printf("events: %d, avg: %s, p50: %s, p99: %s, max: %s\n",
+		len(lats), total/time.Duration(len(lats)), lats[len(lats)/2],
+		lats[len(lats)*99/100], lats[len(lats)-1])
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
 func unmarshalBRPOPValue(dst interface{}, src []interface{}) error {
 	var p []byte
 	if _, err := redis.Scan(src, nil, &p); err != nil {
@@ -0,0 +1,71 @@
+package juggler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/mna/juggler/message"
+)
+
+// CompressionHeader is the name of the HTTP header used to negotiate
+// the compression of the message arguments on a connection. The client
+// sends the comma-separated list of encodings it supports, in order of
+// preference, and Upgrade responds with the encoding selected for the
+// connection, if any (see message.Gzip and message.Deflate).
+const CompressionHeader = "Juggler-Compression"
+
+// DefaultMaxDecompressedSize is the maximum size, in bytes, of the
+// decompressed arguments of the requests, used if the server has no
+// MaxDecompressedSize and the connection has no read limit.
+const DefaultMaxDecompressedSize = 1 << 20
+
+// negotiateCompression returns the first supported compression encoding
+// listed in the CompressionHeader of h, or an empty string if there is
+// none.
+func negotiateCompression(h http.Header) string {
+	for _, v := range h[CompressionHeader] {
+		for _, enc := range strings.Split(v, ",") {
+			enc = strings.TrimSpace(strings.ToLower(enc))
+			if message.IsCompressionSupported(enc) {
+				return enc
+			}
+		}
+	}
+	return ""
+}
+
+// Compression returns the compression encoding negotiated for the
+// connection, or an empty string if compression is not enabled.
+func (c *Conn) Compression() string {
+	return c.compression
+}
+
+// maxDecompressedSize returns the maximum size, in bytes, of the
+// decompressed arguments of the requests received on the connection.
+func (c *Conn) maxDecompressedSize() int64 {
+	if n := c.srv.MaxDecompressedSize; n > 0 {
+		return n
+	}
+	if n := c.ReadLimit(); n > 0 {
+		return n
+	}
+	return DefaultMaxDecompressedSize
+}
+
+// compress returns m with its arguments compressed if compression was
+// negotiated for the connection and the arguments are larger than the
+// server's CompressThreshold. It returns m as-is if the compression
+// fails.
+func (c *Conn) compress(m message.Msg) message.Msg {
+	if c.compression == "" || c.srv.CompressThreshold <= 0 {
+		return m
+	}
+	cm, err := message.Compress(m, c.compression, c.srv.CompressThreshold)
+	if err != nil {
+		return m
+	}
+	if cm != m {
+		c.srv.vars.Add("MsgsCompressed", 1)
+	}
+	return cm
+}
@@ -1,10 +1,12 @@
 package juggler
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
@@ -27,8 +29,24 @@ const (
 	Closed
 )
 
+// transport defines the methods of the underlying connection of a
+// Conn. It is implemented by *websocket.Conn, and by the fallback
+// transport for the clients that cannot establish a websocket
+// connection (see Server.Fallback).
+type transport interface {
+	wswriter.Conn
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Subprotocol() string
+	NextReader() (messageType int, r io.Reader, err error)
+	SetReadDeadline(t time.Time) error
+	SetReadLimit(limit int64)
+	SetPongHandler(h func(appData string) error)
+}
+
 // Conn is a juggler connection. Each connection is identified by
-// a UUID and has an underlying websocket connection. It is safe to
+// a UUID and has an underlying websocket connection, or a fallback
+// transport (see Server.Fallback). It is safe to
 // call methods on a Conn concurrently, but the fields should be
 // treated as read-only.
 type Conn struct {
@@ -40,42 +58,132 @@ type Conn struct {
 	// has been received (i.e. after a <-conn.CloseNotify()).
 	CloseErr error
 
-	// the underlying websocket connection.
-	wsConn *websocket.Conn
+	// the underlying websocket connection or fallback transport.
+	wsConn transport
 	// allowed types of messages from the client (empty means any)
 	allowedMsgs []message.Type
 
-	wmu  chan struct{} // exclusive write lock
-	srv  *Server
-	psc  broker.PubSubConn  // single pub-sub-dedicated broker connection
-	resc broker.ResultsConn // single results-dedicated broker connection
+	// read limit of the connection, accessed atomically
+	readLimit int64
+
+	// smoothed round-trip time, in nanoseconds, accessed atomically
+	rtt int64
+
+	// time of the last pong received, in Unix nanoseconds, accessed
+	// atomically
+	lastPong int64
+
+	wmu   chan struct{} // exclusive write lock
+	srv   *Server
+	sendq *sendQueue // nil if the server has no SendQueueSize
+
+	// broker connections, replaced when they are recovered in degraded
+	// mode (see Server.DegradedMode)
+	bmu      sync.Mutex
+	psc      broker.PubSubConn  // single pub-sub-dedicated broker connection
+	resc     broker.ResultsConn // single results-dedicated broker connection
+	pscDown  bool
+	rescDown bool
+	subs     map[subscription]message.Filter
+
+	// rooms joined by the connection
+	rmu   sync.Mutex
+	rooms map[string]struct{}
+
+	// signed affinity token, if Server.Affinity is set
+	affinity string
+
+	// negotiated compression encoding, empty if disabled
+	compression string
+
+	// true if offloading of the arguments was negotiated, in which case
+	// callTTLs holds the timeouts of the pending calls by call UUID, so
+	// that the blobs of their results expire with the calls.
+	offloading bool
+	omu        sync.Mutex
+	callTTLs   map[string]callTTL
+	nextSweep  time.Time
+
+	// authenticated identity, nil if the server has no Authenticator
+	identity *Identity
+
+	// remote address reported by the proxy headers, nil to use the
+	// address of the transport (see UpgradeConfig.TrustProxyHeaders)
+	remoteAddr net.Addr
+
+	// tags attached to the connection
+	tmu  sync.Mutex
+	tags map[string]string
+
+	// event hooks installed on the connection
+	emu         sync.Mutex
+	evFilter    EventFilter
+	evTransform EventTransform
+
+	// chunked calls for which chunks are being received, by call UUID
+	chmu    sync.Mutex
+	chunked map[string]*chunkedCall
+
+	// fan-out calls for which results are being gathered, by sub-call
+	// UUID
+	fmu     sync.Mutex
+	fanOuts map[string]fanOutCall
+
+	// UUIDs of the calls for which a RES was sent, nil if the server has
+	// no ResultDedupSize
+	dmu         sync.Mutex
+	sentResults *lru
+
+	// channels on which the connection is present
+	pmu      sync.Mutex
+	presence map[string]struct{}
+
+	// base context of the messages, canceled when the connection is
+	// closed
+	cmu    sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	// ensure the kill channel can only be closed once
 	closeOnce sync.Once
 	kill      chan struct{}
 }
 
-func newConn(c *websocket.Conn, srv *Server, allowedMsgs ...message.Type) *Conn {
+func newConn(c transport, srv *Server, allowedMsgs ...message.Type) *Conn {
 	// wmu is the write lock, used as mutex so it can be select'ed upon.
 	// start with an available slot (initialize with a sent value).
 	wmu := make(chan struct{}, 1)
 	wmu <- struct{}{}
 
+	srv.init()
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Conn{
 		UUID:        uuid.NewRandom(),
 		wsConn:      c,
 		allowedMsgs: allowedMsgs,
+		readLimit:   srv.Settings().ReadLimit,
 		wmu:         wmu,
 		srv:         srv,
+		ctx:         ctx,
+		cancel:      cancel,
 		kill:        make(chan struct{}),
 	}
 }
 
-// UnderlyingConn returns the underlying websocket connection. Care
-// should be taken when using the websocket connection directly,
-// as it may interfere with the normal juggler connection behaviour.
+// UnderlyingConn returns the underlying websocket connection, or nil
+// if the connection uses the fallback transport. Care should be taken
+// when using the websocket connection directly, as it may interfere
+// with the normal juggler connection behaviour.
 func (c *Conn) UnderlyingConn() *websocket.Conn {
-	return c.wsConn
+	wsConn, _ := c.wsConn.(*websocket.Conn)
+	return wsConn
+}
+
+// Fallback returns true if the connection uses the fallback transport
+// instead of a websocket connection (see Server.Fallback).
+func (c *Conn) Fallback() bool {
+	_, ok := c.wsConn.(*fallbackConn)
+	return ok
 }
 
 // CloseNotify returns a signal channel that is closed when the
@@ -84,13 +192,46 @@ func (c *Conn) CloseNotify() <-chan struct{} {
 	return c.kill
 }
 
+// Context returns the base context of the connection. The context
+// passed to the Handler for each message is the base context, so that
+// values stored in it are available for all messages of the
+// connection. It is canceled when the connection is closed. If the
+// connection has an authenticated identity, it is available via
+// IdentityFromContext.
+func (c *Conn) Context() context.Context {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+	return c.ctx
+}
+
+// WithContext sets the base context of the connection to ctx, e.g.
+// so that a Handler can store per-connection values once the client
+// is authenticated. The values are available to the handlers of the
+// subsequent messages. ctx should be derived from the context returned
+// by Context, so that it is canceled when the connection is closed.
+// It panics if ctx is nil.
+func (c *Conn) WithContext(ctx context.Context) {
+	if ctx == nil {
+		panic("juggler: nil context")
+	}
+	c.cmu.Lock()
+	c.ctx = ctx
+	c.cmu.Unlock()
+}
+
 // LocalAddr returns the local network address.
 func (c *Conn) LocalAddr() net.Addr {
 	return c.wsConn.LocalAddr()
 }
 
-// RemoteAddr returns the remote network address.
+// RemoteAddr returns the remote network address. If the connection
+// was upgraded with the TrustProxyHeaders option and the request had
+// a valid proxy header, it is the client address reported by that
+// header (see UpgradeConfig).
 func (c *Conn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
 	return c.wsConn.RemoteAddr()
 }
 
@@ -99,6 +240,31 @@ func (c *Conn) Subprotocol() string {
 	return c.wsConn.Subprotocol()
 }
 
+// Codec returns the codec used to encode and decode the messages of
+// the connection, as defined by its negotiated protocol (see
+// message.CodecFor).
+func (c *Conn) Codec() message.Codec {
+	return message.CodecFor(c.Subprotocol())
+}
+
+// SetReadLimit sets the maximum size, in bytes, of incoming messages
+// for this connection, overriding the server's ReadLimit. It can be
+// used e.g. by a Handler to raise the limit for trusted clients once
+// they are authenticated. A limit of 0 means no limit.
+//
+// The new limit is applied by the connection's read loop before reading
+// the next message, so it is safe to call concurrently with reads.
+// If called while processing a message, it applies to the messages
+// that follow.
+func (c *Conn) SetReadLimit(limit int64) {
+	atomic.StoreInt64(&c.readLimit, limit)
+}
+
+// ReadLimit returns the current read limit of the connection.
+func (c *Conn) ReadLimit() int64 {
+	return atomic.LoadInt64(&c.readLimit)
+}
+
 // Close closes the connection, setting err as CloseErr to identify
 // the reason of the close. It does not send a websocket close message,
 // nor does it close the underlying websocket connection.
@@ -107,16 +273,43 @@ func (c *Conn) Subprotocol() string {
 func (c *Conn) Close(err error) {
 	c.closeOnce.Do(func() {
 		c.CloseErr = err
+		// signal the close before closing the broker connections, so that
+		// the loops know that they are stopped because of the close.
+		close(c.kill)
+		c.cancel()
+
+		c.bmu.Lock()
 		if c.psc != nil {
 			c.psc.Close()
 		}
 		if c.resc != nil {
 			c.resc.Close()
 		}
-		close(c.kill)
+		c.bmu.Unlock()
 	})
 }
 
+// maxCloseReason is the maximum length of the reason of a websocket
+// close message.
+const maxCloseReason = 123
+
+// reject sends a websocket close message with the policy violation
+// code and the message of err as reason, and closes the connection
+// with err. It is used to reject a connection before it is served.
+func (c *Conn) reject(err error) {
+	reason := err.Error()
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+	var deadline time.Time
+	if to := c.srv.Settings().WriteTimeout; to > 0 {
+		deadline = time.Now().Add(to)
+	}
+	c.wsConn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), deadline)
+	c.Close(err)
+}
+
 // Writer returns an io.WriteCloser that can be used to send a
 // message on the connection. Only one writer can be active at
 // any moment for a given connection, so the returned writer
@@ -132,75 +325,175 @@ func (c *Conn) Close(err error) {
 // To avoid this, make sure each goroutine closes the Writer
 // before asking for another one, and ideally always use a timeout.
 //
+// The written data is sent as a websocket binary message if the codec
+// of the connection is binary, as a text message otherwise.
+//
 // The returned writer itself is not safe for concurrent use, but
 // as all Conn methods, Writer can be called concurrently.
 func (c *Conn) Writer(timeout time.Duration) io.WriteCloser {
 	return wswriter.Exclusive(
 		c.wsConn,
+		wswriter.MessageType(c.Codec().Binary()),
 		c.wmu,
 		timeout,
-		c.srv.WriteTimeout,
+		c.srv.Settings().WriteTimeout,
 	)
 }
 
 // Send sends the message to the client. It calls the server's
-// Handler if any, or ProcessMsg if nil.
+// Handler if any, with the connection's Context, or ProcessMsg if nil.
 func (c *Conn) Send(m message.Msg) {
+	c.handle(m)
+}
+
+// handle calls the server's Handler with m, or ProcessMsg if nil,
+// recovering from panics.
+func (c *Conn) handle(m message.Msg) {
+	defer c.recoverPanic(m)
+
 	if h := c.srv.Handler; h != nil {
-		h.Handle(context.Background(), c, m)
+		h.Handle(c.Context(), c, m)
 	} else {
 		ProcessMsg(c, m)
 	}
 }
 
+// errRecoveredPanic is the error of the NACK sent for a request that
+// panicked, the panic value itself is not sent to the client.
+var errRecoveredPanic = errors.New("juggler: internal server error")
+
+// recoverPanic recovers from a panic raised while processing m. It
+// NACKs m if it is a request, and closes the connection if the server
+// has CloseOnPanic set. It must be called directly by a deferred
+// statement.
+func (c *Conn) recoverPanic(m message.Msg) {
+	e := recover()
+	if e == nil {
+		return
+	}
+	c.srv.vars.Add("RecoveredPanics", 1)
+
+	err, ok := e.(error)
+	if !ok {
+		err = fmt.Errorf("%v", e)
+	}
+	if m.Type().IsRead() {
+		// the request would likely panic again, it must not be retried
+		nack := message.NewNackWithDetails(m, 500, message.ErrCodeInternal, errRecoveredPanic, nil)
+		nack.Payload.Retryable = false
+		c.Send(nack)
+	}
+	if c.srv.CloseOnPanic {
+		c.Close(err)
+	}
+}
+
+// recoverGo recovers from a panic raised in a goroutine started to
+// process a message of the connection, such as an in-process call or
+// the timeout of a fan-out call. It increments the RecoveredPanics
+// metric and closes the connection if the server has CloseOnPanic set.
+// It must be called directly by a deferred statement.
+func (c *Conn) recoverGo() {
+	if e := recover(); e != nil {
+		c.panicked(e)
+	}
+}
+
+// panicked records the recovered panic e and closes the connection if
+// the server has CloseOnPanic set.
+func (c *Conn) panicked(e interface{}) {
+	c.srv.vars.Add("RecoveredPanics", 1)
+	if c.srv.CloseOnPanic {
+		err, ok := e.(error)
+		if !ok {
+			err = fmt.Errorf("%v", e)
+		}
+		c.Close(err)
+	}
+}
+
 // results is the loop that looks for call results, started in its own
 // goroutine.
 func (c *Conn) results() {
-	if c.srv.Vars != nil {
-		c.srv.Vars.Add("TotalConnGoros", 1)
-		c.srv.Vars.Add("ActiveConnGoros", 1)
-		defer c.srv.Vars.Add("ActiveConnGoros", -1)
-	}
+	c.srv.vars.Add("TotalConnGoros", 1)
+	c.srv.vars.Add("ActiveConnGoros", 1)
+	defer c.srv.vars.Add("ActiveConnGoros", -1)
 
-	ch := c.resc.Results()
-	for res := range ch {
-		c.Send(message.NewRes(res))
-	}
+	for {
+		resc := c.resultsConn()
+		for res := range resc.Results() {
+			if res.Chunk {
+				c.Send(message.NewResChunk(res))
+				continue
+			}
+			c.Send(message.NewRes(res))
+		}
 
-	// results loop was stopped, the connection should be closed if it
-	// isn't already.
-	c.Close(c.resc.ResultsErr())
+		// results loop was stopped, the connection should be closed if it
+		// isn't already, unless the results connection is recovered in
+		// degraded mode.
+		if !c.recoverBrokerConn(resc.ResultsErr(), &c.rescDown, c.newResultsConn) {
+			return
+		}
+	}
 }
 
 // pubSub is the loop that receives events that the connection is subscribed
 // to, started in its own goroutine.
 func (c *Conn) pubSub() {
-	if c.srv.Vars != nil {
-		c.srv.Vars.Add("TotalConnGoros", 1)
-		c.srv.Vars.Add("ActiveConnGoros", 1)
-		defer c.srv.Vars.Add("ActiveConnGoros", -1)
+	c.srv.vars.Add("TotalConnGoros", 1)
+	c.srv.vars.Add("ActiveConnGoros", 1)
+	defer c.srv.vars.Add("ActiveConnGoros", -1)
+
+	for {
+		psc := c.pubSubConn()
+		for ev := range psc.Events() {
+			c.Send(message.NewEvnt(ev))
+		}
+
+		// pubsub loop was stopped, the connection should be closed if it
+		// isn't already, unless the pub-sub connection is recovered in
+		// degraded mode.
+		if !c.recoverBrokerConn(psc.EventsErr(), &c.pscDown, c.newPubSubConn) {
+			return
+		}
 	}
+}
 
-	ch := c.psc.Events()
-	for ev := range ch {
-		c.Send(message.NewEvnt(ev))
+// setCorrelationID sets the correlation ID of the request m to its
+// UUID if the client didn't provide one.
+func setCorrelationID(m message.Msg) {
+	if m.CorrelationID() != "" {
+		return
 	}
 
-	// pubsub loop was stopped, the connection should be closed if it
-	// isn't already.
-	c.Close(c.psc.EventsErr())
+	var meta *message.Meta
+	switch m := m.(type) {
+	case *message.Call:
+		meta = &m.Meta
+	case *message.Pub:
+		meta = &m.Meta
+	case *message.Sub:
+		meta = &m.Meta
+	case *message.Unsb:
+		meta = &m.Meta
+	default:
+		return
+	}
+	meta.C = m.UUID().String()
 }
 
 // receive is the read loop, started in its own goroutine.
 func (c *Conn) receive() {
-	if c.srv.Vars != nil {
-		c.srv.Vars.Add("TotalConnGoros", 1)
-		c.srv.Vars.Add("ActiveConnGoros", 1)
-		defer c.srv.Vars.Add("ActiveConnGoros", -1)
-	}
+	c.srv.vars.Add("TotalConnGoros", 1)
+	c.srv.vars.Add("ActiveConnGoros", 1)
+	defer c.srv.vars.Add("ActiveConnGoros", -1)
 
+	codec := c.Codec()
+	wantType := wswriter.MessageType(codec.Binary())
 	for {
 		c.wsConn.SetReadDeadline(time.Time{})
+		c.wsConn.SetReadLimit(c.ReadLimit())
 
 		// NextReader returns with an error once a connection is closed,
 		// so this loop doesn't need to check the c.kill channel.
@@ -209,24 +502,35 @@ func (c *Conn) receive() {
 			c.Close(err)
 			return
 		}
-		if mt != websocket.TextMessage {
+		if mt != wantType {
 			c.Close(fmt.Errorf("invalid websocket message type: %d", mt))
 			return
 		}
-		if to := c.srv.ReadTimeout; to > 0 {
+		if to := c.srv.Settings().ReadTimeout; to > 0 {
 			c.wsConn.SetReadDeadline(time.Now().Add(to))
 		}
 
-		m, err := message.UnmarshalRequest(r, c.allowedMsgs...)
+		// the websocket read limit applies to the compressed frames if
+		// permessage-deflate is used, also limit the decompressed message.
+		r = wswriter.LimitReader(r, c.ReadLimit())
+		m, err := message.UnmarshalRequestLimits(codec, r, c.srv.Settings().Limits, c.allowedMsgs...)
+		if le, ok := err.(*message.LimitError); ok {
+			// reject the request before it reaches the Handler and the
+			// brokers, the connection stays open.
+			setCorrelationID(m)
+			c.srv.vars.Add("MsgsLimitExceeded", 1)
+			c.Send(message.NewNack(m, le.Code, le))
+			continue
+		}
 		if err != nil {
 			c.Close(err)
 			return
 		}
-
-		if h := c.srv.Handler; h != nil {
-			h.Handle(context.Background(), c, m)
-		} else {
-			ProcessMsg(c, m)
+		if err := message.Decompress(m, c.maxDecompressedSize()); err != nil {
+			c.Close(err)
+			return
 		}
+		setCorrelationID(m)
+		c.handle(m)
 	}
 }
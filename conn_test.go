@@ -2,21 +2,32 @@ package juggler
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"golang.org/x/net/context"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/broker/inmembroker"
+	"github.com/mna/juggler/callee"
 	"github.com/mna/juggler/client"
-	"github.com/mna/juggler/internal/wstest"
 	"github.com/mna/juggler/internal/wswriter"
+	"github.com/mna/juggler/jugglertest"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/mna/juggler/wstest"
 	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -56,11 +67,10 @@ func TestDelegatedMethods(t *testing.T) {
 func TestSendBinaryMessage(t *testing.T) {
 	server := &Server{}
 	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
-	srv := httptest.NewServer(Upgrade(upg, server))
-	srv.URL = strings.Replace(srv.URL, "http:", "ws:", 1)
-	defer srv.Close()
+	l := jugglertest.StartPipeServer(Upgrade(upg, server))
+	defer l.Close()
 
-	cli, err := client.Dial(&websocket.Dialer{Subprotocols: Subprotocols}, srv.URL, http.Header{"Juggler-Allowed-Messages": {"pub"}})
+	cli, err := client.Dial(l.Dialer(Subprotocols...), jugglertest.PipeURL, http.Header{"Juggler-Allowed-Messages": {"pub"}})
 	require.NoError(t, err, "Dial")
 
 	wsc := cli.UnderlyingConn()
@@ -76,6 +86,1102 @@ func TestSendBinaryMessage(t *testing.T) {
 	}
 }
 
+type fakeCallerBroker struct {
+	calls int32
+}
+
+func (f *fakeCallerBroker) NewResultsConn(uuid.UUID) (broker.ResultsConn, error) {
+	return &chanResultsConn{ch: make(chan *message.ResPayload)}, nil
+}
+
+func (f *fakeCallerBroker) Call(cp *message.CallPayload, timeout time.Duration) error {
+	atomic.AddInt32(&f.calls, 1)
+	return nil
+}
+
+type chanResultsConn struct {
+	once sync.Once
+	ch   chan *message.ResPayload
+}
+
+func (c *chanResultsConn) Results() <-chan *message.ResPayload { return c.ch }
+func (c *chanResultsConn) ResultsErr() error                   { return nil }
+func (c *chanResultsConn) Close() error {
+	c.once.Do(func() { close(c.ch) })
+	return nil
+}
+
+// dialCallOnly starts an in-memory server serving server and connects a
+// client allowed to make calls. It returns the client, a function to
+// receive n messages (in any order, as the client handles messages in
+// separate goroutines) and a function to close the client and server.
+func dialCallOnly(t *testing.T, server *Server) (*client.Client, func(int) map[message.Type]message.Msg, func()) {
+	return dialAllowed(t, server, "call")
+}
+
+// connected sets the ConnState of server so that the returned function
+// returns its connections in the order they are connected. It fails the
+// test if no connection is connected within a second.
+func connected(t *testing.T, server *Server) func() *Conn {
+	conns := make(chan *Conn, 10)
+	server.ConnState = func(c *Conn, cs ConnState) {
+		if cs == Connected {
+			conns <- c
+		}
+	}
+	return func() *Conn {
+		select {
+		case c := <-conns:
+			return c
+		case <-time.After(time.Second):
+			require.FailNow(t, "no connection")
+		}
+		return nil
+	}
+}
+
+// dialConn is like dialAllowed, but also returns the server-side
+// connection. It sets the ConnState of server (see connected).
+func dialConn(t *testing.T, server *Server, allowed string) (*client.Client, *Conn, func(int) map[message.Type]message.Msg, func()) {
+	nextConn := connected(t, server)
+	cli, recv, closeFn := dialAllowed(t, server, allowed)
+	var c *Conn
+	defer func() {
+		if c == nil {
+			closeFn()
+		}
+	}()
+	c = nextConn()
+	return cli, c, recv, closeFn
+}
+
+// dialAllowed is like dialCallOnly, but the client is allowed to send
+// the allowed message types (as specified in the
+// Juggler-Allowed-Messages header).
+func dialAllowed(t *testing.T, server *Server, allowed string) (*client.Client, func(int) map[message.Type]message.Msg, func()) {
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	l := jugglertest.StartPipeServer(Upgrade(upg, server))
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	cli, err := client.Dial(l.Dialer(Subprotocols...), jugglertest.PipeURL,
+		http.Header{"Juggler-Allowed-Messages": {allowed}}, client.SetHandler(h))
+	if err != nil {
+		l.Close()
+		require.NoError(t, err, "Dial")
+	}
+
+	recv := func(n int) map[message.Type]message.Msg {
+		got := make(map[message.Type]message.Msg, n)
+		for i := 0; i < n; i++ {
+			select {
+			case m := <-msgs:
+				got[m.Type()] = m
+			case <-time.After(100 * time.Millisecond):
+				require.FailNow(t, "no message received")
+			}
+		}
+		return got
+	}
+	return cli, recv, func() {
+		cli.Close()
+		l.Close()
+	}
+}
+
+type fakePubSubBroker struct {
+	delivered int
+}
+
+func (f *fakePubSubBroker) NewPubSubConn() (broker.PubSubConn, error) {
+	return fakePubSubConn{}, nil
+}
+
+func (f *fakePubSubBroker) Publish(channel string, pp *message.PubPayload) (int, error) {
+	return f.delivered, nil
+}
+
+type fakePubSubInfoBroker struct {
+	fakePubSubBroker
+	channels []string
+}
+
+func (f *fakePubSubInfoBroker) NumSub(channels ...string) (map[string]int, error) {
+	res := make(map[string]int, len(channels))
+	for _, ch := range channels {
+		res[ch] = len(ch)
+	}
+	return res, nil
+}
+
+func (f *fakePubSubInfoBroker) Channels(pattern string) ([]string, error) {
+	if pattern == "" {
+		return f.channels, nil
+	}
+	return []string{pattern}, nil
+}
+
+func TestChannelQueries(t *testing.T) {
+	allowAll := AuthorizerFunc(func(c *Conn, t message.Type, target string) (bool, int, error) {
+		return true, 0, nil
+	})
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		PubSubBroker: &fakePubSubInfoBroker{channels: []string{"a", "b"}},
+		ChannelURIs:  true,
+	}
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	// disabled without an Authorizer
+	_, err := cli.Call("juggler.channels", nil, time.Second)
+	require.NoError(t, err, "Call channels")
+	if m, ok := recv(1)[message.NackMsg]; assert.True(t, ok, "channels NACK") {
+		assert.Equal(t, 404, m.(*message.Nack).Payload.Code, "channels NACK code")
+	}
+	server.Authorizer = allowAll
+
+	call := func(uri string, args interface{}, v interface{}) {
+		_, err := cli.Call(uri, args, time.Second)
+		require.NoError(t, err, "Call %s", uri)
+		if m, ok := recv(2)[message.ResMsg]; assert.True(t, ok, "%s RES", uri) {
+			require.NoError(t, json.Unmarshal(m.(*message.Res).Payload.Args, v), "%s Unmarshal", uri)
+		}
+	}
+
+	var numsub map[string]int
+	call("juggler.numsub", []string{"a", "bcd"}, &numsub)
+	assert.Equal(t, map[string]int{"a": 1, "bcd": 3}, numsub, "numsub")
+
+	var channels []string
+	call("juggler.channels", nil, &channels)
+	assert.Equal(t, []string{"a", "b"}, channels, "all channels")
+	call("juggler.channels", "x*", &channels)
+	assert.Equal(t, []string{"x*"}, channels, "channels with pattern")
+
+	// broker without channel queries support
+	server = &Server{
+		CallerBroker: &fakeCallerBroker{},
+		PubSubBroker: &fakePubSubBroker{},
+		ChannelURIs:  true,
+		Authorizer:   allowAll,
+	}
+	cli, recv, closeFn = dialCallOnly(t, server)
+	defer closeFn()
+
+	var er message.ErrResult
+	call("juggler.channels", nil, &er)
+	assert.Equal(t, errNoPubSubInfo.Error(), er.Error.Message, "unsupported error")
+}
+
+func TestPubAckDelivered(t *testing.T) {
+	server := &Server{PubSubBroker: &fakePubSubBroker{delivered: 3}}
+	cli, recv, closeFn := dialAllowed(t, server, "pub")
+	defer closeFn()
+
+	_, err := cli.Pub("a", "b")
+	require.NoError(t, err, "Pub")
+	if m, ok := recv(1)[message.AckMsg]; assert.True(t, ok, "ACK") {
+		ack := m.(*message.Ack)
+		if assert.NotNil(t, ack.Payload.Delivered, "delivered") {
+			assert.Equal(t, 3, *ack.Payload.Delivered, "delivered count")
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		PubSubBroker: &fakePubSubBroker{},
+		Limits:       message.Limits{MaxChannelLen: 3, MaxPubArgs: 10},
+		Vars:         vars,
+	}
+	cli, recv, closeFn := dialAllowed(t, server, "pub")
+	defer closeFn()
+
+	cases := []struct {
+		ch   string
+		args interface{}
+		code int
+	}{
+		{"abc", "x", 0},
+		{"abcd", "x", message.CodeChannelTooLong},
+		{"abc", "abcdefghijkl", message.CodeArgsTooLarge},
+	}
+	for i, c := range cases {
+		_, err := cli.Pub(c.ch, c.args)
+		require.NoError(t, err, "Pub %d", i)
+		got := recv(1)
+		if c.code == 0 {
+			assert.NotNil(t, got[message.AckMsg], "%d: ACK", i)
+			continue
+		}
+		if m, ok := got[message.NackMsg]; assert.True(t, ok, "%d: NACK", i) {
+			assert.Equal(t, c.code, m.(*message.Nack).Payload.Code, "%d: NACK code", i)
+		}
+	}
+	assert.Equal(t, "2", vars.Get("MsgsLimitExceeded").String(), "MsgsLimitExceeded")
+}
+
+func TestValidators(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	vs := new(message.Validators)
+	vs.RegisterChannel("a", message.RequiredFields("id"))
+	server := &Server{
+		PubSubBroker: &fakePubSubBroker{},
+		Validators:   vs,
+		Vars:         vars,
+	}
+	cli, recv, closeFn := dialAllowed(t, server, "pub")
+	defer closeFn()
+
+	_, err := cli.Pub("a", map[string]int{"id": 1})
+	require.NoError(t, err, "Pub")
+	assert.NotNil(t, recv(1)[message.AckMsg], "ACK")
+
+	_, err = cli.Pub("a", map[string]int{"x": 1})
+	require.NoError(t, err, "Pub")
+	if m, ok := recv(1)[message.NackMsg]; assert.True(t, ok, "NACK") {
+		nack := m.(*message.Nack)
+		assert.Equal(t, message.CodeInvalidArgs, nack.Payload.Code, "NACK code")
+		assert.JSONEq(t, `{"missing":["id"]}`, string(nack.Payload.Details), "NACK details")
+	}
+	assert.Equal(t, "1", vars.Get("InvalidMsgs").String(), "InvalidMsgs")
+}
+
+func TestTopics(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		PubSubBroker: &fakePubSubBroker{},
+		Topics:       true,
+		Vars:         vars,
+	}
+	cli, recv, closeFn := dialAllowed(t, server, "pub, sub")
+	defer closeFn()
+
+	_, err := cli.Pub("a.b", 1)
+	require.NoError(t, err, "Pub")
+	assert.NotNil(t, recv(1)[message.AckMsg], "ACK")
+	_, err = cli.Sub("a.+", true)
+	require.NoError(t, err, "Sub pattern")
+	assert.NotNil(t, recv(1)[message.AckMsg], "ACK")
+
+	_, err = cli.Pub("a.+", 1)
+	require.NoError(t, err, "Pub wildcard")
+	_, err = cli.Sub("a*", true)
+	require.NoError(t, err, "Sub glob")
+	msgs := recv(2)
+	if m, ok := msgs[message.NackMsg]; assert.True(t, ok, "NACK") {
+		assert.Equal(t, 400, m.(*message.Nack).Payload.Code, "NACK code")
+	}
+	assert.Equal(t, "2", vars.Get("InvalidChannels").String(), "InvalidChannels")
+}
+
+func TestURIPolicy(t *testing.T) {
+	brk := &fakeCallerBroker{}
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		CallerBroker: brk,
+		AllowedURIs:  []string{"app.*", "other"},
+		DeniedURIs:   []string{"app.old*"},
+		Vars:         vars,
+	}
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	cases := []struct {
+		uri  string
+		want bool
+	}{
+		{"app.a", true},
+		{"other", true},
+		{"app.old", false},
+		{"app.oldest", false},
+		{"others", false},
+		{"x", false},
+	}
+	for _, c := range cases {
+		_, err := cli.Call(c.uri, nil, time.Second)
+		require.NoError(t, err, "Call %s", c.uri)
+		got := recv(1)
+		if c.want {
+			assert.NotNil(t, got[message.AckMsg], "%s: ACK", c.uri)
+			continue
+		}
+		if m, ok := got[message.NackMsg]; assert.True(t, ok, "%s: NACK", c.uri) {
+			assert.Equal(t, 404, m.(*message.Nack).Payload.Code, "%s: NACK code", c.uri)
+		}
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&brk.calls), "broker calls")
+	assert.Equal(t, "4", vars.Get("DeniedCalls").String(), "DeniedCalls")
+
+	// system URIs are always allowed
+	_, err := cli.Call("juggler.ping", nil, time.Second)
+	require.NoError(t, err, "Call juggler.ping")
+	got := recv(2)
+	assert.NotNil(t, got[message.AckMsg], "ping ACK")
+	assert.NotNil(t, got[message.ResMsg], "ping RES")
+}
+
+func TestChannelPolicies(t *testing.T) {
+	connUUID := make(chan string, 1)
+	server := &Server{
+		PubSubBroker: &fakePubSubBroker{},
+		ChannelPolicies: []ChannelPolicy{
+			{Pattern: "user.{tag:user}.*", Sub: true, PSub: true},
+			{Pattern: "team.{tag:team}.*", Sub: true, PSub: true},
+			{Pattern: "conn.{conn}", Sub: true, Pub: true},
+			{Pattern: "public.*", Sub: true, Pub: true},
+			{Pattern: "*", Pub: true},
+		},
+		ConnState: func(c *Conn, state ConnState) {
+			if state == Connected {
+				c.SetTag("user", "u*1")
+				c.SetTag("team", "t1")
+				connUUID <- c.UUID.String()
+			}
+		},
+	}
+	cli, recv, closeFn := dialAllowed(t, server, "pub, sub")
+	defer closeFn()
+	uid := <-connUUID
+
+	cases := []struct {
+		pub     bool
+		ch      string
+		pattern bool
+		want    bool
+	}{
+		{false, "user.u*1.a", false, true},
+		{false, "user.u*1.*", true, false}, // the tag would act as a wildcard
+		{false, "team.t1.*", true, true},
+		{false, "team.t?.*", true, false},
+		{false, "user.u*2.a", false, false},
+		{false, "user.uX1.a", false, false},
+		{false, "user.*", true, false},
+		{true, "user.u*1.a", false, false},
+		{false, "conn." + uid, false, true},
+		{false, "conn.x", false, false},
+		{true, "public.a", false, true},
+		{false, "public.*", true, false},
+		{false, "other", false, false},
+		{true, "other", false, true},
+	}
+	for i, c := range cases {
+		var err error
+		if c.pub {
+			_, err = cli.Pub(c.ch, nil)
+		} else {
+			_, err = cli.Sub(c.ch, c.pattern)
+		}
+		require.NoError(t, err, "%d: send", i)
+		got := recv(1)
+		if c.want {
+			assert.NotNil(t, got[message.AckMsg], "%d: ACK", i)
+			continue
+		}
+		if m, ok := got[message.NackMsg]; assert.True(t, ok, "%d: NACK", i) {
+			assert.Equal(t, 403, m.(*message.Nack).Payload.Code, "%d: NACK code", i)
+		}
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		PubSubBroker: &fakePubSubBroker{},
+		Vars:         vars,
+		Authorizer: AuthorizerFunc(func(c *Conn, mt message.Type, target string) (bool, int, error) {
+			switch {
+			case target == "admin":
+				return false, 0, nil
+			case mt == message.PubMsg && target == "ro":
+				return false, 401, errors.New("read-only")
+			}
+			return true, 0, nil
+		}),
+	}
+	cli, recv, closeFn := dialAllowed(t, server, "call, pub, sub")
+	defer closeFn()
+
+	cases := []struct {
+		mt     message.Type
+		target string
+		code   int
+	}{
+		{message.CallMsg, "a", 0},
+		{message.CallMsg, "admin", 403},
+		{message.PubMsg, "ro", 401},
+		{message.SubMsg, "ro", 0},
+		{message.SubMsg, "admin", 403},
+	}
+	for i, c := range cases {
+		var err error
+		switch c.mt {
+		case message.CallMsg:
+			_, err = cli.Call(c.target, nil, time.Second)
+		case message.PubMsg:
+			_, err = cli.Pub(c.target, nil)
+		case message.SubMsg:
+			_, err = cli.Sub(c.target, false)
+		}
+		require.NoError(t, err, "%d: send", i)
+		got := recv(1)
+		if c.code == 0 {
+			assert.NotNil(t, got[message.AckMsg], "%d: ACK", i)
+			continue
+		}
+		if m, ok := got[message.NackMsg]; assert.True(t, ok, "%d: NACK", i) {
+			nack := m.(*message.Nack)
+			assert.Equal(t, c.code, nack.Payload.Code, "%d: NACK code", i)
+			if c.code == 401 {
+				assert.Equal(t, "read-only", nack.Payload.Message, "%d: NACK message", i)
+			}
+		}
+	}
+	assert.Equal(t, "3", vars.Get("UnauthorizedMsgs").String(), "UnauthorizedMsgs")
+}
+
+type ctxKey struct{}
+
+func TestConnContext(t *testing.T) {
+	vals := make(chan interface{}, 10)
+	conns := make(chan *Conn, 10)
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		Handler: HandlerFunc(func(ctx context.Context, c *Conn, m message.Msg) {
+			if call, ok := m.(*message.Call); ok {
+				vals <- ctx.Value(ctxKey{})
+				conns <- c
+				if call.Payload.URI == "login" {
+					c.WithContext(context.WithValue(c.Context(), ctxKey{}, "user"))
+				}
+			}
+			ProcessMsg(c, m)
+		}),
+	}
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	for i, uri := range []string{"a", "login", "b"} {
+		_, err := cli.Call(uri, nil, time.Second)
+		require.NoError(t, err, "%d: Call", i)
+		recv(1)
+	}
+	assert.Nil(t, <-vals, "before login")
+	assert.Nil(t, <-vals, "login")
+	assert.Equal(t, "user", <-vals, "after login")
+
+	c := <-conns
+	assert.Nil(t, c.Context().Err(), "context not canceled")
+	closeFn()
+	select {
+	case <-c.Context().Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "context not canceled on close")
+	}
+	assert.Panics(t, func() { c.WithContext(nil) }, "nil context")
+}
+
+type metricsPubSubBroker struct {
+	fakePubSubBroker
+	sink metrics.Sink
+}
+
+func (b *metricsPubSubBroker) SetMetrics(s metrics.Sink) {
+	b.sink = s
+}
+
+func TestMetricsPropagation(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	brk := &metricsPubSubBroker{}
+	server := &Server{PubSubBroker: brk, Vars: vars}
+	cli, recv, closeFn := dialAllowed(t, server, "pub")
+	_, err := cli.Pub("a", nil)
+	require.NoError(t, err, "Pub")
+	recv(1)
+	closeFn()
+	assert.Equal(t, vars, brk.sink, "sink set on the broker")
+
+	// typed nil sink is not propagated and doesn't panic
+	var nilVars *expvar.Map
+	brk = &metricsPubSubBroker{}
+	server = &Server{PubSubBroker: brk, Vars: nilVars}
+	cli, recv, closeFn = dialAllowed(t, server, "pub")
+	defer closeFn()
+	_, err = cli.Pub("a", nil)
+	require.NoError(t, err, "Pub")
+	recv(1)
+	assert.Nil(t, brk.sink, "no sink set on the broker")
+}
+
+func TestCorrelationID(t *testing.T) {
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		Callees: map[string]callee.Thunk{
+			"corr": func(cp *message.CallPayload) (interface{}, error) {
+				return cp.CorrelationID, nil
+			},
+		},
+	}
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	// the server generates the correlation ID from the request UUID
+	// and propagates it to the callee and the responses.
+	id, err := cli.Call("corr", nil, time.Second)
+	require.NoError(t, err, "Call")
+	got := recv(2)
+	if m, ok := got[message.AckMsg]; assert.True(t, ok, "ACK") {
+		assert.Equal(t, id.String(), m.CorrelationID(), "ACK correlation ID")
+	}
+	if m, ok := got[message.ResMsg]; assert.True(t, ok, "RES") {
+		assert.Equal(t, id.String(), m.CorrelationID(), "RES correlation ID")
+		assert.Equal(t, `"`+id.String()+`"`, string(m.(*message.Res).Payload.Args), "callee correlation ID")
+	}
+
+	// a correlation ID provided by the client is kept
+	call, err := message.NewCall("corr", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	call.Meta.C = "abc"
+	setCorrelationID(call)
+	assert.Equal(t, "abc", call.CorrelationID(), "provided correlation ID")
+	call.Meta.C = ""
+	setCorrelationID(call)
+	assert.Equal(t, call.UUID().String(), call.CorrelationID(), "generated correlation ID")
+}
+
+func TestCompression(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		CallerBroker:      &fakeCallerBroker{},
+		CompressThreshold: 10,
+		Vars:              vars,
+		Callees: map[string]callee.Thunk{
+			"echo": func(cp *message.CallPayload) (interface{}, error) {
+				return cp.Args, nil
+			},
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	l := jugglertest.StartPipeServer(Upgrade(upg, server))
+	defer l.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	cli, err := client.Dial(l.Dialer(Subprotocols...), jugglertest.PipeURL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}, CompressionHeader: {"zstd, gzip"}},
+		client.SetHandler(h), client.SetCompression(message.Deflate, 10))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	// the compressed CALL is decompressed by the server, and the
+	// compressed RES is decompressed by the client.
+	args := strings.Repeat("abcd", 100)
+	_, err = cli.Call("echo", args, time.Second)
+	require.NoError(t, err, "Call")
+
+	var res *message.Res
+	for res == nil {
+		select {
+		case m := <-msgs:
+			if r, ok := m.(*message.Res); ok {
+				res = r
+			}
+		case <-time.After(time.Second):
+			require.FailNow(t, "no RES received")
+		}
+	}
+	assert.Equal(t, `"`+args+`"`, string(res.Payload.Args), "result")
+	assert.Equal(t, "", res.Meta.Z, "decompressed")
+	assert.Equal(t, "1", vars.Get("MsgsCompressed").String(), "compressed messages")
+}
+
+func TestMaxDecompressedSize(t *testing.T) {
+	// the default applies if there is no read limit
+	c := &Conn{srv: &Server{}}
+	assert.Equal(t, int64(DefaultMaxDecompressedSize), c.maxDecompressedSize(), "default")
+	c.SetReadLimit(10)
+	assert.Equal(t, int64(10), c.maxDecompressedSize(), "read limit")
+
+	server := &Server{
+		CallerBroker:        &fakeCallerBroker{},
+		MaxDecompressedSize: 100,
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	l := jugglertest.StartPipeServer(Upgrade(upg, server))
+	defer l.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	cli, err := client.Dial(l.Dialer(Subprotocols...), jugglertest.PipeURL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}},
+		client.SetHandler(h), client.SetCompression(message.Deflate, 10))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+
+	_, err = cli.Call("a", strings.Repeat("a", 50), time.Second)
+	require.NoError(t, err, "Call small")
+	select {
+	case m := <-msgs:
+		assert.Equal(t, message.AckMsg, m.Type(), "small ACK")
+	case <-time.After(time.Second):
+		require.FailNow(t, "no ACK received")
+	}
+
+	// the compressed arguments are small, the decompressed ones are not
+	_, err = cli.Call("a", strings.Repeat("a", 1000), time.Second)
+	require.NoError(t, err, "Call large")
+	select {
+	case <-cli.CloseNotify():
+	case <-time.After(time.Second):
+		assert.Fail(t, "connection not closed")
+	}
+}
+
+type fakeBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+	ttls  map[string]time.Duration
+}
+
+func (f *fakeBlobStore) PutBlob(b []byte, ttl time.Duration) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ref := uuid.NewRandom().String()
+	f.blobs[ref] = b
+	f.ttls[ref] = ttl
+	return ref, nil
+}
+
+func (f *fakeBlobStore) GetBlob(ref string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.blobs[ref]
+	if !ok {
+		return nil, broker.ErrBlobNotFound
+	}
+	return b, nil
+}
+
+func (f *fakeBlobStore) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.blobs)
+}
+
+func TestOffload(t *testing.T) {
+	store := &fakeBlobStore{blobs: make(map[string][]byte), ttls: make(map[string]time.Duration)}
+	blobSrv := httptest.NewServer(BlobHandler(store))
+	defer blobSrv.Close()
+
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		CallerBroker:     &fakeCallerBroker{},
+		PubSubBroker:     &inmembroker.Broker{},
+		OffloadThreshold: 10,
+		BlobStore:        store,
+		Vars:             vars,
+		Callees: map[string]callee.Thunk{
+			"echo": func(cp *message.CallPayload) (interface{}, error) {
+				return cp.Args, nil
+			},
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	l := jugglertest.StartPipeServer(Upgrade(upg, server))
+	defer l.Close()
+
+	dial := func(hdr http.Header, opts ...client.Option) (*client.Client, chan message.Msg) {
+		msgs := make(chan message.Msg, 10)
+		h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+			msgs <- m
+		})
+		cli, err := client.Dial(l.Dialer(Subprotocols...), jugglertest.PipeURL, hdr, append(opts, client.SetHandler(h))...)
+		require.NoError(t, err, "Dial")
+		return cli, msgs
+	}
+	recv := func(msgs chan message.Msg, typ message.Type) message.Msg {
+		for {
+			select {
+			case m := <-msgs:
+				if m.Type() == typ {
+					return m
+				}
+			case <-time.After(time.Second):
+				require.FailNow(t, "no message received", "%s", typ)
+			}
+		}
+	}
+
+	// cli negotiates offloading, plain does not
+	cli, msgs := dial(http.Header{OffloadHeader: {"blob"}},
+		client.SetBlobResolver(client.HTTPBlobResolver(nil, blobSrv.URL)))
+	defer cli.Close()
+	plain, plainMsgs := dial(nil)
+	defer plain.Close()
+
+	// the result is offloaded to the blob store, with the timeout of the
+	// call, and resolved by the client
+	args := strings.Repeat("abcd", 10)
+	_, err := cli.Call("echo", args, 2*time.Second)
+	require.NoError(t, err, "Call")
+	res := recv(msgs, message.ResMsg).(*message.Res)
+	assert.Equal(t, `"`+args+`"`, string(res.Payload.Args), "resolved result")
+	assert.Equal(t, "", res.Meta.R, "blob reference cleared")
+	require.Equal(t, 1, store.count(), "blob stored")
+	for _, ttl := range store.ttls {
+		assert.Equal(t, 2*time.Second, ttl, "blob TTL")
+	}
+
+	// small results are sent as-is
+	_, err = cli.Call("echo", "a", time.Second)
+	require.NoError(t, err, "Call")
+	res = recv(msgs, message.ResMsg).(*message.Res)
+	assert.Equal(t, `"a"`, string(res.Payload.Args), "small result")
+	assert.Equal(t, 1, store.count(), "no blob stored")
+
+	// the results are not offloaded if it was not negotiated
+	_, err = plain.Call("echo", args, time.Second)
+	require.NoError(t, err, "Call plain")
+	res = recv(plainMsgs, message.ResMsg).(*message.Res)
+	assert.Equal(t, `"`+args+`"`, string(res.Payload.Args), "plain result")
+	assert.Equal(t, 1, store.count(), "no blob stored for plain")
+
+	// the event is offloaded once when published, and resolved by the
+	// server for the connection that did not negotiate offloading
+	_, err = cli.Sub("ch", false)
+	require.NoError(t, err, "Sub")
+	recv(msgs, message.AckMsg)
+	_, err = plain.Sub("ch", false)
+	require.NoError(t, err, "Sub plain")
+	recv(plainMsgs, message.AckMsg)
+
+	_, err = plain.Pub("ch", args)
+	require.NoError(t, err, "Pub")
+	ev := recv(msgs, message.EvntMsg).(*message.Evnt)
+	assert.Equal(t, `"`+args+`"`, string(ev.Payload.Args), "resolved event")
+	ev = recv(plainMsgs, message.EvntMsg).(*message.Evnt)
+	assert.Equal(t, `"`+args+`"`, string(ev.Payload.Args), "plain event")
+	assert.Equal(t, "", ev.Meta.R, "plain event blob reference")
+	assert.Equal(t, 2, store.count(), "event blob stored once")
+	assert.Equal(t, "2", vars.Get("MsgsOffloaded").String(), "offloaded messages")
+
+	// unknown blob
+	resp, err := http.Get(blobSrv.URL + "?ref=nope")
+	require.NoError(t, err, "GET unknown blob")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "unknown blob status")
+}
+
+func TestLocalCalleePanicClose(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		CloseOnPanic: true,
+		Vars:         vars,
+		Callees: map[string]callee.Thunk{
+			"panic": func(cp *message.CallPayload) (interface{}, error) {
+				panic("boom")
+			},
+		},
+	}
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	_, err := cli.Call("panic", nil, time.Second)
+	require.NoError(t, err, "Call panic")
+	assert.NotNil(t, recv(1)[message.AckMsg], "ACK")
+	select {
+	case <-cli.CloseNotify():
+	case <-time.After(time.Second):
+		assert.Fail(t, "connection not closed on panic")
+	}
+	assert.Equal(t, "1", vars.Get("RecoveredPanics").String(), "RecoveredPanics")
+}
+
+func TestLocalCallees(t *testing.T) {
+	brk := &fakeCallerBroker{}
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		CallerBroker: brk,
+		Callees: map[string]callee.Thunk{
+			"local": func(cp *message.CallPayload) (interface{}, error) {
+				var s string
+				if err := json.Unmarshal(cp.Args, &s); err != nil {
+					return nil, err
+				}
+				return strings.ToUpper(s), nil
+			},
+			"slow": func(cp *message.CallPayload) (interface{}, error) {
+				time.Sleep(2 * cp.TTLAfterRead)
+				return nil, nil
+			},
+			"fail": func(cp *message.CallPayload) (interface{}, error) {
+				return nil, &callee.Error{Code: 409, Message: "conflict", Details: []int{1, 2}}
+			},
+			"panic": func(cp *message.CallPayload) (interface{}, error) {
+				panic("boom")
+			},
+		},
+		Vars: vars,
+	}
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	// in-process call
+	_, err := cli.Call("local", "abc", time.Second)
+	require.NoError(t, err, "Call local")
+	got := recv(2)
+	assert.NotNil(t, got[message.AckMsg], "local ACK")
+	if m, ok := got[message.ResMsg]; assert.True(t, ok, "local RES") {
+		assert.Equal(t, `"ABC"`, string(m.(*message.Res).Payload.Args), "local result")
+	}
+
+	// in-process call that returns an error
+	_, err = cli.Call("fail", nil, time.Second)
+	require.NoError(t, err, "Call fail")
+	got = recv(2)
+	if m, ok := got[message.ResMsg]; assert.True(t, ok, "fail RES") {
+		res := m.(*message.Res)
+		assert.Equal(t, `{"error":{"message":"conflict","code":409,"details":[1,2]}}`, string(res.Payload.Args), "fail result")
+		if re, ok := client.ErrorResult(res); assert.True(t, ok, "fail is an error result") {
+			assert.Equal(t, 409, re.Code, "fail code")
+			assert.Equal(t, "conflict", re.Message, "fail message")
+			assert.Equal(t, `[1,2]`, string(re.Details), "fail details")
+		}
+	}
+
+	// in-process call that panics
+	_, err = cli.Call("panic", nil, time.Second)
+	require.NoError(t, err, "Call panic")
+	got = recv(2)
+	if m, ok := got[message.ResMsg]; assert.True(t, ok, "panic RES") {
+		if re, ok := client.ErrorResult(m.(*message.Res)); assert.True(t, ok, "panic is an error result") {
+			assert.Equal(t, 500, re.Code, "panic code")
+			assert.Equal(t, errRecoveredPanic.Error(), re.Message, "panic message")
+		}
+	}
+	assert.Equal(t, "1", vars.Get("RecoveredPanics").String(), "RecoveredPanics")
+
+	// in-process call that expires
+	_, err = cli.Call("slow", nil, 10*time.Millisecond)
+	require.NoError(t, err, "Call slow")
+	got = recv(2)
+	assert.NotNil(t, got[message.AckMsg], "slow ACK")
+	assert.NotNil(t, got[client.ExpMsg], "slow expired")
+
+	// unknown URI goes to the broker
+	_, err = cli.Call("remote", nil, time.Second)
+	require.NoError(t, err, "Call remote")
+	got = recv(1)
+	assert.NotNil(t, got[message.AckMsg], "remote ACK")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&brk.calls), "broker calls")
+}
+
+func TestChunkedCall(t *testing.T) {
+	server := &Server{
+		CallerBroker:   &fakeCallerBroker{},
+		MaxChunkedArgs: 100,
+		Callees: map[string]callee.Thunk{
+			"echo": func(cp *message.CallPayload) (interface{}, error) {
+				return cp.Args, nil
+			},
+		},
+	}
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	args := map[string]interface{}{"a": "héllo wörld", "b": []int{1, 2, 3}}
+	_, err := cli.CallChunked("echo", args, 4, time.Second)
+	require.NoError(t, err, "CallChunked")
+	got := recv(2)
+	assert.NotNil(t, got[message.AckMsg], "chunked ACK")
+	if m, ok := got[message.ResMsg]; assert.True(t, ok, "chunked RES") {
+		assert.Equal(t, `{"a":"héllo wörld","b":[1,2,3]}`, string(m.(*message.Res).Payload.Args), "chunked result")
+	}
+
+	// arguments too large, the second chunk exceeds the maximum
+	_, err = cli.CallChunked("echo", strings.Repeat("a", 100), 80, time.Second)
+	require.NoError(t, err, "CallChunked too large")
+	got = recv(1)
+	if m, ok := got[message.NackMsg]; assert.True(t, ok, "too large NACK") {
+		assert.Equal(t, 413, m.(*message.Nack).Payload.Code, "too large code")
+	}
+
+	// chunk for an unknown call
+	require.NoError(t, cli.UnderlyingConn().WriteJSON(message.NewChunk(uuid.NewRandom(), "1", true)), "write chunk")
+	got = recv(1)
+	if m, ok := got[message.NackMsg]; assert.True(t, ok, "unknown NACK") {
+		assert.Equal(t, 404, m.(*message.Nack).Payload.Code, "unknown code")
+	}
+
+	// chunked calls disabled
+	server.MaxChunkedArgs = 0
+	_, err = cli.CallChunked("echo", "abc", 10, time.Second)
+	require.NoError(t, err, "CallChunked disabled")
+	got = recv(1)
+	if m, ok := got[message.NackMsg]; assert.True(t, ok, "disabled NACK") {
+		assert.Equal(t, 400, m.(*message.Nack).Payload.Code, "disabled code")
+	}
+}
+
+func TestSystemCallees(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	brk := &fakeCallerBroker{}
+	server := &Server{
+		CallerBroker: brk,
+		ReadLimit:    1000,
+		WriteTimeout: time.Second,
+		Vars:         vars,
+		Callees: map[string]callee.Thunk{
+			"juggler.ping": func(cp *message.CallPayload) (interface{}, error) {
+				return "overridden", nil
+			},
+		},
+	}
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	call := func(uri string, v interface{}) {
+		_, err := cli.Call(uri, nil, time.Second)
+		require.NoError(t, err, "Call %s", uri)
+		got := recv(2)
+		assert.NotNil(t, got[message.AckMsg], "%s ACK", uri)
+		if m, ok := got[message.ResMsg]; assert.True(t, ok, "%s RES", uri) {
+			require.NoError(t, json.Unmarshal(m.(*message.Res).Payload.Args, v), "%s Unmarshal", uri)
+		}
+	}
+
+	var ping PingResult
+	call("juggler.ping", &ping)
+	assert.False(t, ping.Time.IsZero(), "ping time")
+
+	var info InfoResult
+	call("juggler.info", &info)
+	assert.Equal(t, InfoResult{
+		Version:      Version,
+		Subprotocols: Subprotocols,
+		ReadLimit:    1000,
+		WriteTimeout: 1000,
+	}, info, "info")
+
+	var stats map[string]int64
+	call("juggler.stats", &stats)
+	assert.Equal(t, int64(1), stats["ActiveConns"], "ActiveConns stat")
+	assert.Equal(t, int64(3), stats["LocalCalls"], "LocalCalls stat") // including this call
+
+	_, err := cli.Call("juggler.unknown", nil, time.Second)
+	require.NoError(t, err, "Call unknown")
+	got := recv(1)
+	if m, ok := got[message.NackMsg]; assert.True(t, ok, "unknown NACK") {
+		assert.Equal(t, 404, m.(*message.Nack).Payload.Code, "unknown NACK code")
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&brk.calls), "broker calls")
+}
+
+func TestAdminURIs(t *testing.T) {
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		AdminURIs:    true,
+	}
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	// disabled without an Authorizer
+	_, err := cli.Call("juggler.conns.list", nil, time.Second)
+	require.NoError(t, err, "Call conns.list")
+	if m, ok := recv(1)[message.NackMsg]; assert.True(t, ok, "conns.list NACK") {
+		assert.Equal(t, 404, m.(*message.Nack).Payload.Code, "conns.list NACK code")
+	}
+
+	var caller atomic.Value
+	server.Authorizer = AuthorizerFunc(func(c *Conn, t message.Type, target string) (bool, int, error) {
+		caller.Store(c.UUID.String())
+		return true, 0, nil
+	})
+	other, _, closeOther := dialCallOnly(t, server)
+	defer closeOther()
+
+	call := func(uri string, args, v interface{}) {
+		_, err := cli.Call(uri, args, time.Second)
+		require.NoError(t, err, "Call %s", uri)
+		got := recv(2)
+		assert.NotNil(t, got[message.AckMsg], "%s ACK", uri)
+		if m, ok := got[message.ResMsg]; assert.True(t, ok, "%s RES", uri) {
+			require.NoError(t, json.Unmarshal(m.(*message.Res).Payload.Args, v), "%s Unmarshal", uri)
+		}
+	}
+
+	var infos []ConnInfo
+	call("juggler.conns.list", nil, &infos)
+	require.Len(t, infos, 2, "conns.list")
+	var otherUUID string
+	for _, info := range infos {
+		assert.NotEmpty(t, info.Subprotocol, "Subprotocol")
+		if info.UUID != caller.Load().(string) {
+			otherUUID = info.UUID
+		}
+	}
+	require.NotEmpty(t, otherUUID, "other connection")
+
+	var kicked bool
+	call("juggler.conn.kick", otherUUID, &kicked)
+	assert.True(t, kicked, "conn.kick")
+	select {
+	case <-other.CloseNotify():
+	case <-time.After(time.Second):
+		assert.Fail(t, "kicked connection should be closed")
+	}
+
+	call("juggler.conn.kick", uuid.NewRandom().String(), &kicked)
+	assert.False(t, kicked, "conn.kick unknown")
+}
+
+func TestConnSetReadLimit(t *testing.T) {
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		ReadLimit:    200,
+		Handler: HandlerFunc(func(ctx context.Context, c *Conn, m message.Msg) {
+			if call, ok := m.(*message.Call); ok && call.Payload.URI == "raise" {
+				c.SetReadLimit(2000)
+			}
+			ProcessMsg(c, m)
+		}),
+	}
+	large := strings.Repeat("a", 1000)
+
+	// without raising the limit, the connection gets closed
+	cli, _, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	_, err := cli.Call("x", large, time.Second)
+	require.NoError(t, err, "Call large 1")
+	select {
+	case <-cli.CloseNotify():
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "connection should be closed")
+	}
+
+	// after raising the limit, the large message is accepted
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	_, err = cli.Call("raise", nil, time.Second)
+	require.NoError(t, err, "Call raise")
+	assert.NotNil(t, recv(1)[message.AckMsg], "raise ACK")
+	_, err = cli.Call("x", large, time.Second)
+	require.NoError(t, err, "Call large 2")
+	assert.NotNil(t, recv(1)[message.AckMsg], "large ACK")
+}
+
 func TestExclusiveWriter(t *testing.T) {
 	var buf bytes.Buffer
 	done := make(chan bool, 1)
@@ -171,3 +1277,603 @@ func TestConnClose(t *testing.T) {
 
 	assert.Equal(t, errors.New("a"), conn.CloseErr, "got expected close error")
 }
+
+type fakeRoomsBroker struct {
+	mu    sync.Mutex
+	rooms map[string]map[string]bool
+}
+
+func (f *fakeRoomsBroker) Join(room string, connUUID uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rooms == nil {
+		f.rooms = make(map[string]map[string]bool)
+	}
+	if f.rooms[room] == nil {
+		f.rooms[room] = make(map[string]bool)
+	}
+	f.rooms[room][connUUID.String()] = true
+	return nil
+}
+
+func (f *fakeRoomsBroker) Leave(room string, connUUID uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.rooms[room], connUUID.String())
+	return nil
+}
+
+func (f *fakeRoomsBroker) Members(room string) ([]uuid.UUID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var uuids []uuid.UUID
+	for k := range f.rooms[room] {
+		uuids = append(uuids, uuid.Parse(k))
+	}
+	return uuids, nil
+}
+
+func TestRooms(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		PubSubBroker: &fakePubSubBroker{delivered: 1},
+		RoomsBroker:  &fakeRoomsBroker{},
+		Handler: HandlerFunc(func(ctx context.Context, c *Conn, m message.Msg) {
+			if call, ok := m.(*message.Call); ok && call.Payload.URI == "join" {
+				var room string
+				json.Unmarshal(call.Payload.Args, &room)
+				assert.NoError(t, c.Join(room), "Join %s", room)
+				conns <- c
+			}
+			ProcessMsg(c, m)
+		}),
+	}
+	cli, recv, closeFn := dialAllowed(t, server, "call, sub, unsb, pub")
+	defer closeFn()
+
+	_, err := cli.Call("join", "a", time.Second)
+	require.NoError(t, err, "Call join a")
+	recv(1)
+	c := <-conns
+	_, err = cli.Call("join", "b", time.Second)
+	require.NoError(t, err, "Call join b")
+	recv(1)
+	<-conns
+
+	assert.Equal(t, []string{"a", "b"}, c.Rooms(), "rooms")
+	members, err := server.RoomMembers("a")
+	require.NoError(t, err, "RoomMembers a")
+	assert.Equal(t, []uuid.UUID{c.UUID}, members, "members of a")
+
+	// the clients cannot use the room channels directly
+	_, err = cli.Sub(RoomChannel("c"), false)
+	require.NoError(t, err, "Sub room channel")
+	_, err = cli.Unsb(RoomChannel("a"), false)
+	require.NoError(t, err, "Unsb room channel")
+	_, err = cli.Pub(RoomChannel("a"), "x")
+	require.NoError(t, err, "Pub room channel")
+	for i := 0; i < 3; i++ {
+		if m, ok := recv(1)[message.NackMsg]; assert.True(t, ok, "%d: NACK", i) {
+			assert.Equal(t, 403, m.(*message.Nack).Payload.Code, "%d: NACK code", i)
+		}
+	}
+	assert.Equal(t, []string{"a", "b"}, c.Rooms(), "rooms after Unsb")
+
+	// the room events are not sent for the pattern subscriptions
+	c.Send(message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: RoomChannel("c"), Pattern: "juggler.*"}))
+	c.Send(message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: RoomChannel("a")}))
+	if m, ok := recv(1)[message.EvntMsg]; assert.True(t, ok, "EVNT") {
+		assert.Equal(t, RoomChannel("a"), m.(*message.Evnt).Payload.Channel, "room event")
+	}
+
+	n, err := server.PublishRoom("a", "hello")
+	require.NoError(t, err, "PublishRoom")
+	assert.Equal(t, 1, n, "delivered")
+
+	require.NoError(t, c.Leave("a"), "Leave a")
+	assert.Equal(t, []string{"b"}, c.Rooms(), "rooms after leave")
+	members, err = server.RoomMembers("a")
+	require.NoError(t, err, "RoomMembers a after leave")
+	assert.Empty(t, members, "members of a after leave")
+
+	// closing the connection leaves all rooms
+	cli.Close()
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for {
+		members, err = server.RoomMembers("b")
+		require.NoError(t, err, "RoomMembers b after close")
+		if len(members) == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Empty(t, members, "members of b after close")
+
+	// without a rooms broker
+	server = &Server{}
+	_, err = server.RoomMembers("a")
+	assert.Equal(t, ErrNoRoomsBroker, err, "RoomMembers without broker")
+}
+
+type fakePresenceBroker struct {
+	mu   sync.Mutex
+	sets int
+	pres map[string]map[string]bool
+}
+
+func (f *fakePresenceBroker) SetPresence(channel string, connUUID uuid.UUID, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sets++
+	if f.pres == nil {
+		f.pres = make(map[string]map[string]bool)
+	}
+	if f.pres[channel] == nil {
+		f.pres[channel] = make(map[string]bool)
+	}
+	f.pres[channel][connUUID.String()] = true
+	return nil
+}
+
+func (f *fakePresenceBroker) RemovePresence(channel string, connUUID uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.pres[channel], connUUID.String())
+	return nil
+}
+
+func (f *fakePresenceBroker) Presence(channel string) ([]uuid.UUID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var uuids []uuid.UUID
+	for k := range f.pres[channel] {
+		uuids = append(uuids, uuid.Parse(k))
+	}
+	return uuids, nil
+}
+
+func (f *fakePresenceBroker) setCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sets
+}
+
+func TestPresence(t *testing.T) {
+	pb := &fakePresenceBroker{}
+	server := &Server{
+		PubSubBroker:   &fakePubSubBroker{},
+		PresenceBroker: pb,
+		PresenceTTL:    10 * time.Millisecond,
+	}
+	cli, recv, closeFn := dialAllowed(t, server, "sub, unsb")
+	defer closeFn()
+
+	_, err := cli.Sub("a", false)
+	require.NoError(t, err, "Sub a")
+	recv(1)
+	_, err = cli.Sub("b", false)
+	require.NoError(t, err, "Sub b")
+	recv(1)
+	_, err = cli.Sub("c*", true)
+	require.NoError(t, err, "Sub c*")
+	recv(1)
+
+	for _, ch := range []string{"a", "b"} {
+		uuids, err := server.Presence(ch)
+		require.NoError(t, err, "Presence %s", ch)
+		assert.Equal(t, 1, len(uuids), "Presence %s", ch)
+	}
+	uuids, err := server.Presence("c*")
+	require.NoError(t, err, "Presence c*")
+	assert.Empty(t, uuids, "no presence for patterns")
+
+	// entries get refreshed
+	time.Sleep(30 * time.Millisecond)
+	assert.True(t, pb.setCount() > 2, "entries are refreshed")
+
+	_, err = cli.Unsb("a", false)
+	require.NoError(t, err, "Unsb a")
+	recv(1)
+	uuids, err = server.Presence("a")
+	require.NoError(t, err, "Presence a after unsb")
+	assert.Empty(t, uuids, "Presence a after unsb")
+
+	// closing the connection removes its presence
+	cli.Close()
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for {
+		uuids, err = server.Presence("b")
+		require.NoError(t, err, "Presence b after close")
+		if len(uuids) == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Empty(t, uuids, "Presence b after close")
+}
+
+func TestConnTags(t *testing.T) {
+	c := newConn(&websocket.Conn{}, &Server{})
+	assert.True(t, TagSelector(nil).Matches(c), "empty selector")
+	assert.False(t, TagSelector{"a": ""}.Matches(c), "missing tag")
+
+	c.SetTag("a", "1")
+	c.SetTag("b", "2")
+	v, ok := c.Tag("a")
+	assert.True(t, ok, "tag a set")
+	assert.Equal(t, "1", v, "tag a")
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, c.Tags(), "tags")
+
+	assert.True(t, TagSelector{"a": ""}.Matches(c), "any value")
+	assert.True(t, TagSelector{"a": "1", "b": "2"}.Matches(c), "all tags")
+	assert.False(t, TagSelector{"a": "1", "b": "3"}.Matches(c), "different value")
+
+	c.DeleteTag("a")
+	_, ok = c.Tag("a")
+	assert.False(t, ok, "tag a deleted")
+}
+
+func TestTaggedBroadcast(t *testing.T) {
+	tagged := make(chan struct{}, 1)
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		Handler: HandlerFunc(func(ctx context.Context, c *Conn, m message.Msg) {
+			if call, ok := m.(*message.Call); ok && call.Payload.URI == "tag" {
+				var user string
+				json.Unmarshal(call.Payload.Args, &user)
+				c.SetTag("user", user)
+				tagged <- struct{}{}
+			}
+			ProcessMsg(c, m)
+		}),
+	}
+
+	var recvs []func(int) map[message.Type]message.Msg
+	for _, user := range []string{"a", "b", "a"} {
+		cli, recv, closeFn := dialCallOnly(t, server)
+		defer closeFn()
+
+		_, err := cli.Call("tag", user, time.Second)
+		require.NoError(t, err, "Call tag %s", user)
+		<-tagged
+		recv(1)
+		recvs = append(recvs, recv)
+	}
+
+	n, err := server.PublishTagged(TagSelector{"user": "a"}, "c", "hello")
+	require.NoError(t, err, "PublishTagged")
+	assert.Equal(t, 2, n, "sent to 2 connections")
+	for _, i := range []int{0, 2} {
+		if m, ok := recvs[i](1)[message.EvntMsg]; assert.True(t, ok, "EVNT %d", i) {
+			ev := m.(*message.Evnt)
+			assert.Equal(t, "c", ev.Payload.Channel, "channel %d", i)
+			assert.Equal(t, `"hello"`, string(ev.Payload.Args), "args %d", i)
+		}
+	}
+
+	n = server.SendTagged(TagSelector{"user": "c"}, message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom()}))
+	assert.Equal(t, 0, n, "no match")
+}
+
+func TestConnRegistry(t *testing.T) {
+	server := &Server{CallerBroker: &fakeCallerBroker{}}
+
+	var recvs []func(int) map[message.Type]message.Msg
+	var uuids []uuid.UUID
+	for i := 0; i < 2; i++ {
+		_, c, recv, closeFn := dialConn(t, server, "call")
+		defer closeFn()
+		recvs = append(recvs, recv)
+		uuids = append(uuids, c.UUID)
+	}
+	assert.Equal(t, 2, len(server.Conns()), "Conns")
+
+	c, ok := server.ConnByUUID(uuids[1])
+	if assert.True(t, ok, "ConnByUUID") {
+		assert.Equal(t, uuids[1], c.UUID, "ConnByUUID UUID")
+	}
+	_, ok = server.ConnByUUID(uuid.NewRandom())
+	assert.False(t, ok, "ConnByUUID unknown")
+
+	ev := message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "c"})
+	assert.True(t, server.SendTo(uuids[1], ev), "SendTo")
+	assert.NotNil(t, recvs[1](1)[message.EvntMsg], "SendTo EVNT")
+	assert.False(t, server.SendTo(uuid.NewRandom(), ev), "SendTo unknown")
+
+	assert.Equal(t, 2, server.Broadcast(ev), "Broadcast")
+	for i, recv := range recvs {
+		assert.NotNil(t, recv(1)[message.EvntMsg], "Broadcast EVNT %d", i)
+	}
+}
+
+func TestResultChunks(t *testing.T) {
+	brk := &inmembroker.Broker{}
+	server := &Server{CallerBroker: brk}
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	cc, err := brk.NewCallsConn("stream")
+	require.NoError(t, err, "NewCallsConn")
+	defer cc.Close()
+	go func() {
+		cle := &callee.Callee{Broker: brk}
+		for cp := range cc.Calls() {
+			for i := 0; i < 3; i++ {
+				cle.StoreResultChunk(cp, i, i*10)
+			}
+			cle.InvokeAndStoreResult(cp, func(cp *message.CallPayload) (interface{}, error) {
+				return "done", nil
+			})
+		}
+	}()
+
+	uid, err := cli.Call("stream", nil, time.Second)
+	require.NoError(t, err, "Call")
+
+	chunks := make([]string, 3)
+	var res *message.Res
+	for i := 0; i < 5; i++ {
+		for _, m := range recv(1) {
+			switch m := m.(type) {
+			case *message.ResChunk:
+				assert.Equal(t, uid, m.Payload.For, "chunk for call")
+				assert.Equal(t, "stream", m.Payload.URI, "chunk URI")
+				chunks[m.Payload.Seq] = string(m.Payload.Args)
+			case *message.Res:
+				res = m
+			}
+		}
+	}
+	assert.Equal(t, []string{"0", "10", "20"}, chunks, "chunks")
+	if assert.NotNil(t, res, "RES") {
+		assert.Equal(t, `"done"`, string(res.Payload.Args), "result")
+	}
+}
+
+func TestMsgpackSubprotocol(t *testing.T) {
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		Callees: map[string]callee.Thunk{
+			"echo": func(cp *message.CallPayload) (interface{}, error) {
+				return cp.Args, nil
+			},
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	l := jugglertest.StartPipeServer(Upgrade(upg, server))
+	defer l.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	proto := "juggler.0" + message.MsgpackSuffix
+	cli, err := client.Dial(l.Dialer(proto), jugglertest.PipeURL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}}, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+	require.Equal(t, proto, cli.UnderlyingConn().Subprotocol(), "negotiated protocol")
+
+	_, err = cli.Call("echo", map[string]int{"a": 1}, time.Second)
+	require.NoError(t, err, "Call")
+
+	got := make(map[message.Type]message.Msg)
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-msgs:
+			got[m.Type()] = m
+		case <-time.After(100 * time.Millisecond):
+			require.FailNow(t, "no message received")
+		}
+	}
+	assert.NotNil(t, got[message.AckMsg], "ACK")
+	if m, ok := got[message.ResMsg]; assert.True(t, ok, "RES") {
+		assert.Equal(t, `{"a":1}`, string(m.(*message.Res).Payload.Args), "result")
+	}
+}
+
+func TestBinarySubprotocol(t *testing.T) {
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		Callees: map[string]callee.Thunk{
+			"reverse": func(cp *message.CallPayload) (interface{}, error) {
+				if !cp.Binary {
+					return nil, errors.New("not binary")
+				}
+				var b []byte
+				if err := json.Unmarshal(cp.Args, &b); err != nil {
+					return nil, err
+				}
+				for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+					b[i], b[j] = b[j], b[i]
+				}
+				return b, nil
+			},
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	l := jugglertest.StartPipeServer(Upgrade(upg, server))
+	defer l.Close()
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	proto := "juggler.0" + message.BinarySuffix
+	cli, err := client.Dial(l.Dialer(proto), jugglertest.PipeURL,
+		http.Header{"Juggler-Allowed-Messages": {"call"}}, client.SetHandler(h))
+	require.NoError(t, err, "Dial")
+	defer cli.Close()
+	require.Equal(t, proto, cli.UnderlyingConn().Subprotocol(), "negotiated protocol")
+
+	_, err = cli.Call("reverse", []byte{1, 2, 0xff}, time.Second)
+	require.NoError(t, err, "Call")
+
+	got := make(map[message.Type]message.Msg)
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-msgs:
+			got[m.Type()] = m
+		case <-time.After(100 * time.Millisecond):
+			require.FailNow(t, "no message received")
+		}
+	}
+	assert.NotNil(t, got[message.AckMsg], "ACK")
+	if m, ok := got[message.ResMsg]; assert.True(t, ok, "RES") {
+		res := m.(*message.Res)
+		assert.False(t, res.Payload.Error, "not an error")
+		assert.True(t, res.Payload.Binary, "binary result")
+		var b []byte
+		require.NoError(t, json.Unmarshal(res.Payload.Args, &b), "Unmarshal result")
+		assert.Equal(t, []byte{0xff, 2, 1}, b, "result")
+	}
+}
+
+func TestPerMessageDeflate(t *testing.T) {
+	server := &Server{
+		ReadLimit:         4096,
+		EnableCompression: true,
+		CompressionLevel:  9,
+		CallerBroker:      &fakeCallerBroker{},
+		Callees: map[string]callee.Thunk{
+			"echo": func(cp *message.CallPayload) (interface{}, error) {
+				return cp.Args, nil
+			},
+		},
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	l := jugglertest.StartPipeServer(Upgrade(upg, server))
+	defer l.Close()
+
+	d := l.Dialer(Subprotocols...)
+	d.EnableCompression = true
+	wsc, resp, err := d.Dial(jugglertest.PipeURL, http.Header{"Juggler-Allowed-Messages": {"call"}})
+	require.NoError(t, err, "Dial")
+	assert.Contains(t, resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate", "negotiated extension")
+
+	msgs := make(chan message.Msg, 10)
+	h := client.HandlerFunc(func(ctx context.Context, m message.Msg) {
+		msgs <- m
+	})
+	cli := client.New(wsc, client.SetHandler(h), client.SetWriteCompression(true, 9))
+	defer cli.Close()
+
+	// compressed and within the read limit once decompressed
+	arg := strings.Repeat("a", 2000)
+	_, err = cli.Call("echo", arg, time.Second)
+	require.NoError(t, err, "Call")
+
+	got := make(map[message.Type]message.Msg)
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-msgs:
+			got[m.Type()] = m
+		case <-time.After(100 * time.Millisecond):
+			require.FailNow(t, "no message received")
+		}
+	}
+	if m, ok := got[message.ResMsg]; assert.True(t, ok, "RES") {
+		assert.Equal(t, `"`+arg+`"`, string(m.(*message.Res).Payload.Args), "result")
+	}
+
+	// the compressed frames are within the read limit, but not the
+	// decompressed message
+	_, err = cli.Call("echo", strings.Repeat("a", 10000), time.Second)
+	require.NoError(t, err, "Call")
+	select {
+	case <-cli.CloseNotify():
+	case <-time.After(100 * time.Millisecond):
+		t.Errorf("client connection not closed as expected")
+	}
+}
+
+func TestUpgradeWithConfig(t *testing.T) {
+	brk := &inmembroker.Broker{}
+	vars := expvar.NewMap("TestUpgradeWithConfig")
+	server := &Server{CallerBroker: brk, PubSubBroker: brk, Vars: vars}
+
+	conns := make(chan *Conn, 1)
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	l := jugglertest.StartPipeServer(UpgradeWithConfig(upg, server, UpgradeConfig{
+		OnUpgrade: func(r *http.Request, c *Conn) error {
+			tenant := r.Header.Get("X-Tenant")
+			if tenant == "" {
+				return errors.New("missing tenant")
+			}
+			c.SetTag("tenant", tenant)
+			conns <- c
+			return nil
+		},
+	}))
+	defer l.Close()
+
+	// the metadata is attached to the connection before it is served
+	cli, err := client.Dial(l.Dialer(Subprotocols...), jugglertest.PipeURL, http.Header{"X-Tenant": {"a"}})
+	require.NoError(t, err, "Dial with tenant")
+	defer cli.Close()
+	select {
+	case c := <-conns:
+		tenant, _ := c.Tag("tenant")
+		assert.Equal(t, "a", tenant, "tenant tag")
+	case <-time.After(time.Second):
+		require.FailNow(t, "OnUpgrade not called")
+	}
+
+	// the connection is rejected with a close message
+	wsc, _, err := l.Dialer(Subprotocols...).Dial(jugglertest.PipeURL, nil)
+	require.NoError(t, err, "Dial without tenant")
+	defer wsc.Close()
+	wsc.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = wsc.ReadMessage()
+	if assert.IsType(t, &websocket.CloseError{}, err, "close error") {
+		ce := err.(*websocket.CloseError)
+		assert.Equal(t, websocket.ClosePolicyViolation, ce.Code, "close code")
+		assert.Equal(t, "missing tenant", ce.Text, "close reason")
+	}
+	assert.Equal(t, "1", vars.Get("RejectedUpgrades").String(), "RejectedUpgrades")
+}
+
+func TestPanicRecovery(t *testing.T) {
+	for _, closeOnPanic := range []bool{false, true} {
+		vars := new(expvar.Map).Init()
+		conns := make(chan *Conn, 1)
+		server := &Server{
+			CallerBroker: &fakeCallerBroker{},
+			CloseOnPanic: closeOnPanic,
+			Vars:         vars,
+			Handler: HandlerFunc(func(ctx context.Context, c *Conn, m message.Msg) {
+				if call, ok := m.(*message.Call); ok && call.Payload.URI == "panic" {
+					conns <- c
+					panic("boom")
+				}
+				ProcessMsg(c, m)
+			}),
+		}
+		cli, recv, closeFn := dialCallOnly(t, server)
+
+		_, err := cli.Call("panic", nil, time.Second)
+		require.NoError(t, err, "%t: Call panic", closeOnPanic)
+		if m, ok := recv(1)[message.NackMsg]; assert.True(t, ok, "%t: NACK", closeOnPanic) {
+			nack := m.(*message.Nack)
+			assert.Equal(t, 500, nack.Payload.Code, "%t: NACK code", closeOnPanic)
+			assert.Equal(t, errRecoveredPanic.Error(), nack.Payload.Message, "%t: NACK message", closeOnPanic)
+			assert.False(t, nack.Payload.Retryable, "%t: NACK not retryable", closeOnPanic)
+		}
+		assert.Equal(t, "1", vars.Get("RecoveredPanics").String(), "%t: RecoveredPanics", closeOnPanic)
+
+		c := <-conns
+		if closeOnPanic {
+			select {
+			case <-c.CloseNotify():
+			case <-time.After(time.Second):
+				assert.Fail(t, "connection not closed on panic")
+			}
+		} else {
+			_, err = cli.Call("a", nil, time.Second)
+			require.NoError(t, err, "Call after panic")
+			assert.NotNil(t, recv(1)[message.AckMsg], "ACK after panic")
+		}
+		closeFn()
+	}
+}
@@ -0,0 +1,52 @@
+package juggler
+
+import (
+	"container/list"
+
+	"github.com/mna/juggler/message"
+)
+
+// lru is a set of keys that holds at most max keys, evicting the least
+// recently added or seen keys. It is not safe for concurrent use.
+type lru struct {
+	max  int
+	ll   *list.List
+	keys map[string]*list.Element
+}
+
+func newLRU(max int) *lru {
+	return &lru{
+		max:  max,
+		ll:   list.New(),
+		keys: make(map[string]*list.Element, max),
+	}
+}
+
+// add adds key to the set, and returns false if it was already in it.
+func (l *lru) add(key string) bool {
+	if e, ok := l.keys[key]; ok {
+		l.ll.MoveToFront(e)
+		return false
+	}
+	l.keys[key] = l.ll.PushFront(key)
+	if l.ll.Len() > l.max {
+		e := l.ll.Back()
+		l.ll.Remove(e)
+		delete(l.keys, e.Value.(string))
+	}
+	return true
+}
+
+// isDuplicateResult returns true if a RES for the same call as m was
+// already sent on the connection, as recorded in its results LRU (see
+// Server.ResultDedupSize). The partial results of fan-out calls are
+// never duplicates, as they are all for the same call.
+func (c *Conn) isDuplicateResult(m *message.Res) bool {
+	if c.sentResults == nil || m.Payload.Partial {
+		return false
+	}
+
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	return !c.sentResults.add(m.Payload.For.String())
+}
@@ -0,0 +1,47 @@
+package juggler
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRU(t *testing.T) {
+	l := newLRU(2)
+	assert.True(t, l.add("a"), "add a")
+	assert.True(t, l.add("b"), "add b")
+	assert.False(t, l.add("a"), "a exists")
+	assert.True(t, l.add("c"), "add c, evicts b")
+	assert.True(t, l.add("b"), "b was evicted")
+	assert.False(t, l.add("b"), "b exists")
+	assert.True(t, l.add("a"), "a was evicted")
+}
+
+func TestResultDedup(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		CallerBroker:    &fakeCallerBroker{},
+		Vars:            vars,
+		ResultDedupSize: 10,
+	}
+	cli, c, recv, closeFn := dialConn(t, server, "call")
+	defer closeFn()
+
+	// the client only handles the results of its pending calls
+	id, err := cli.Call("a", nil, time.Second)
+	require.NoError(t, err, "Call")
+	_, ok := recv(1)[message.AckMsg]
+	require.True(t, ok, "ACK")
+
+	rp := &message.ResPayload{ConnUUID: c.UUID, MsgUUID: id, URI: "a"}
+	c.Send(message.NewRes(rp))
+	c.Send(message.NewRes(rp))
+	if m, ok := recv(1)[message.ResMsg]; assert.True(t, ok, "RES") {
+		assert.Equal(t, id, m.(*message.Res).Payload.For, "result for the call")
+	}
+	assert.Equal(t, "1", vars.Get("DuplicateResults").String(), "duplicate results")
+}
@@ -0,0 +1,209 @@
+package juggler
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/mna/juggler/broker"
+)
+
+// DefaultRecoverInterval is the default interval between attempts to
+// recover a failed broker connection in degraded mode, if
+// Server.RecoverInterval is not set.
+const DefaultRecoverInterval = time.Second
+
+// errBrokerUnavailable is the error returned to requests that need the
+// broker while the server is in degraded mode.
+var errBrokerUnavailable = errors.New("juggler: broker unavailable")
+
+func (srv *Server) recoverInterval() time.Duration {
+	if srv.RecoverInterval > 0 {
+		return srv.RecoverInterval
+	}
+	return DefaultRecoverInterval
+}
+
+// Degraded returns true if the server is in degraded mode, that is if
+// DegradedMode is set, the broker connection of at least one of its
+// connections failed and is not recovered yet, and its brokers are
+// unhealthy: the CallerBroker or the PubSubBroker fails to respond to
+// a ping (see broker.Pinger). The health of the brokers is checked at
+// most once per RecoverInterval. If neither broker implements
+// broker.Pinger, the brokers are considered unhealthy as soon as a
+// broker connection failed. In degraded mode, CALL requests to the
+// CallerBroker and PUB requests are rejected with a NACK with code 503.
+//
+// A connection whose broker connection failed while the brokers are
+// healthy does not put the server in degraded mode, but its own CALL
+// requests to the CallerBroker (if its results connection failed) or
+// its SUB and UNSB requests (if its pub-sub connection failed) are
+// rejected until it is recovered.
+func (srv *Server) Degraded() bool {
+	if atomic.LoadInt32(&srv.brokenConns) == 0 {
+		return false
+	}
+	return !srv.brokersHealthy()
+}
+
+// brokersHealthy returns true if the CallerBroker and PubSubBroker
+// respond to a ping, as checked at most once per RecoverInterval. It
+// returns false if neither of them implements broker.Pinger.
+func (srv *Server) brokersHealthy() bool {
+	now := time.Now()
+	srv.hmu.Lock()
+	if now.Sub(srv.healthAt) < srv.recoverInterval() {
+		healthy := srv.healthy
+		srv.hmu.Unlock()
+		return healthy
+	}
+	srv.hmu.Unlock()
+
+	// ping without holding the lock, concurrent checks are harmless
+	var pinged bool
+	healthy := true
+	for _, b := range []interface{}{srv.CallerBroker, srv.PubSubBroker} {
+		p, ok := b.(broker.Pinger)
+		if !ok {
+			continue
+		}
+		pinged = true
+		if err := p.Ping(); err != nil {
+			healthy = false
+			break
+		}
+	}
+	healthy = healthy && pinged
+
+	srv.hmu.Lock()
+	srv.healthy = healthy
+	srv.healthAt = now
+	srv.hmu.Unlock()
+	return healthy
+}
+
+// resultsDown returns true if the results connection of c failed and
+// is not recovered yet.
+func (c *Conn) resultsDown() bool {
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+	return c.rescDown
+}
+
+// brokerErrCode returns the NACK code to use for the broker error err.
+func brokerErrCode(err error) int {
+	switch err {
+	case errBrokerUnavailable:
+		return 503
+	case broker.ErrInvalidTopic:
+		return 400
+	}
+	return 500
+}
+
+// pubSubConn returns the current pub-sub connection.
+func (c *Conn) pubSubConn() broker.PubSubConn {
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+	return c.psc
+}
+
+// resultsConn returns the current results connection.
+func (c *Conn) resultsConn() broker.ResultsConn {
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+	return c.resc
+}
+
+// recoverBrokerConn is called when a broker connection of c failed with
+// err. If the server is not in DegradedMode, it closes c and returns
+// false. Otherwise it marks the broker connection as down and calls
+// newFn every RecoverInterval until it succeeds, and returns true. It
+// returns false if c is closed before then.
+func (c *Conn) recoverBrokerConn(err error, down *bool, newFn func() error) bool {
+	if c.isClosed() {
+		return false
+	}
+	if !c.srv.DegradedMode {
+		c.Close(err)
+		return false
+	}
+
+	c.srv.vars.Add("FailedBrokerConns", 1)
+	atomic.AddInt32(&c.srv.brokenConns, 1)
+	defer atomic.AddInt32(&c.srv.brokenConns, -1)
+
+	c.bmu.Lock()
+	*down = true
+	c.bmu.Unlock()
+
+	for {
+		select {
+		case <-c.kill:
+			return false
+		case <-time.After(c.srv.recoverInterval()):
+		}
+		if err := newFn(); err == nil {
+			c.srv.vars.Add("RecoveredBrokerConns", 1)
+			return true
+		}
+	}
+}
+
+// newPubSubConn creates a new pub-sub connection to replace the failed
+// one, and restores its subscriptions.
+func (c *Conn) newPubSubConn() error {
+	psc, err := c.srv.PubSubBroker.NewPubSubConn()
+	if err != nil {
+		return err
+	}
+
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+
+	if c.isClosed() {
+		psc.Close()
+		return errBrokerUnavailable
+	}
+	for s := range c.subs {
+		if err := psc.Subscribe(s.channel, s.pattern); err != nil {
+			psc.Close()
+			return err
+		}
+	}
+	c.psc.Close()
+	c.psc = psc
+	c.pscDown = false
+	return nil
+}
+
+// newResultsConn creates a new results connection to replace the
+// failed one.
+func (c *Conn) newResultsConn() error {
+	resc, err := c.srv.CallerBroker.NewResultsConn(c.UUID)
+	if err != nil {
+		return err
+	}
+
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+
+	if c.isClosed() {
+		resc.Close()
+		return errBrokerUnavailable
+	}
+	c.resc.Close()
+	c.resc = resc
+	c.rescDown = false
+	return nil
+}
+
+// isClosed returns true if c is closed.
+func (c *Conn) isClosed() bool {
+	select {
+	case <-c.kill:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,201 @@
+package juggler
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingCallerBroker is a caller broker whose results connection can
+// be failed, and that refuses new connections until it is recovered.
+type failingCallerBroker struct {
+	fakeCallerBroker
+
+	mu   sync.Mutex
+	down bool
+	rc   *failingResultsConn
+}
+
+func (f *failingCallerBroker) NewResultsConn(uuid.UUID) (broker.ResultsConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return nil, errors.New("down")
+	}
+	f.rc = &failingResultsConn{ch: make(chan *message.ResPayload)}
+	return f.rc, nil
+}
+
+// waitConn waits for a results connection different from prev to be
+// created and returns it.
+func (f *failingCallerBroker) waitConn(prev *failingResultsConn) *failingResultsConn {
+	for {
+		f.mu.Lock()
+		rc := f.rc
+		f.mu.Unlock()
+		if rc != nil && rc != prev {
+			return rc
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (f *failingCallerBroker) fail() *failingResultsConn {
+	rc := f.waitConn(nil)
+
+	f.mu.Lock()
+	f.down = true
+	f.mu.Unlock()
+
+	rc.err = errors.New("failed")
+	rc.Close()
+	return rc
+}
+
+func (f *failingCallerBroker) recover(prev *failingResultsConn) *failingResultsConn {
+	f.mu.Lock()
+	f.down = false
+	f.mu.Unlock()
+	return f.waitConn(prev)
+}
+
+type failingResultsConn struct {
+	once sync.Once
+	ch   chan *message.ResPayload
+	err  error
+}
+
+func (c *failingResultsConn) Results() <-chan *message.ResPayload { return c.ch }
+func (c *failingResultsConn) ResultsErr() error                   { return c.err }
+func (c *failingResultsConn) Close() error {
+	c.once.Do(func() { close(c.ch) })
+	return nil
+}
+
+func waitDegraded(t *testing.T, srv *Server, want bool) {
+	deadline := time.Now().Add(time.Second)
+	for srv.Degraded() != want {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "degraded state not reached", "want %t", want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDegradedMode(t *testing.T) {
+	brk := &failingCallerBroker{}
+	server := &Server{
+		CallerBroker:    brk,
+		DegradedMode:    true,
+		RecoverInterval: 10 * time.Millisecond,
+	}
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	_, err := cli.Call("a", nil, time.Second)
+	require.NoError(t, err, "Call before failure")
+	assert.NotNil(t, recv(1)[message.AckMsg], "ACK before failure")
+
+	// fail the results connection, the server enters degraded mode
+	failed := brk.fail()
+	waitDegraded(t, server, true)
+
+	_, err = cli.Call("a", nil, time.Second)
+	require.NoError(t, err, "Call in degraded mode")
+	if m, ok := recv(1)[message.NackMsg]; assert.True(t, ok, "NACK in degraded mode") {
+		assert.Equal(t, 503, m.(*message.Nack).Payload.Code, "NACK code")
+	}
+	select {
+	case <-cli.CloseNotify():
+		assert.Fail(t, "connection closed in degraded mode")
+	default:
+	}
+
+	// recover the broker, results are received on the new connection
+	rc := brk.recover(failed)
+	waitDegraded(t, server, false)
+
+	uid, err := cli.Call("a", nil, time.Second)
+	require.NoError(t, err, "Call after recovery")
+	assert.NotNil(t, recv(1)[message.AckMsg], "ACK after recovery")
+	rc.ch <- &message.ResPayload{MsgUUID: uid, URI: "a", Args: []byte("1")}
+	if m, ok := recv(1)[message.ResMsg]; assert.True(t, ok, "RES after recovery") {
+		assert.Equal(t, "1", string(m.(*message.Res).Payload.Args), "RES args")
+	}
+}
+
+// pingingCallerBroker is a failingCallerBroker that implements
+// broker.Pinger.
+type pingingCallerBroker struct {
+	failingCallerBroker
+	unreachable int32 // accessed atomically
+}
+
+func (p *pingingCallerBroker) Ping() error {
+	if atomic.LoadInt32(&p.unreachable) != 0 {
+		return errors.New("unreachable")
+	}
+	return nil
+}
+
+func TestDegradedModeBrokerHealth(t *testing.T) {
+	brk := &pingingCallerBroker{}
+	server := &Server{
+		CallerBroker:    brk,
+		DegradedMode:    true,
+		RecoverInterval: 10 * time.Millisecond,
+	}
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+	brk.waitConn(nil)
+
+	// the results connection fails but the broker responds to pings, only
+	// the calls of this connection are rejected.
+	failed := brk.fail()
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := cli.Call("a", nil, time.Second)
+		require.NoError(t, err, "Call with failed results connection")
+		if _, ok := recv(1)[message.NackMsg]; ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			require.FailNow(t, "calls not rejected")
+		}
+	}
+	assert.False(t, server.Degraded(), "not degraded with a healthy broker")
+
+	// the broker fails to respond to pings, the server is degraded
+	atomic.StoreInt32(&brk.unreachable, 1)
+	waitDegraded(t, server, true)
+
+	atomic.StoreInt32(&brk.unreachable, 0)
+	brk.recover(failed)
+	waitDegraded(t, server, false)
+	_, err := cli.Call("a", nil, time.Second)
+	require.NoError(t, err, "Call after recovery")
+	assert.NotNil(t, recv(1)[message.AckMsg], "ACK after recovery")
+}
+
+func TestDegradedModeDisabled(t *testing.T) {
+	brk := &failingCallerBroker{}
+	server := &Server{CallerBroker: brk}
+	cli, _, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	brk.fail()
+	select {
+	case <-cli.CloseNotify():
+	case <-time.After(time.Second):
+		assert.Fail(t, "connection not closed")
+	}
+	assert.False(t, server.Degraded(), "not degraded")
+}
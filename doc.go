@@ -9,7 +9,9 @@
 // All messages sent by the client receive an acknowledge message
 // (ACK) when processed successfully or a negative acknowledge (NACK)
 // if the request was rejected. See the message package documentation
-// for all details regarding the supported messages.
+// for all details regarding the supported messages. The ACK of a PUB
+// reports the number of subscribers the event was delivered to, so that
+// publishers can detect when nobody is listening.
 //
 // Server
 //
@@ -30,18 +32,37 @@
 // Additional fields allow for more advanced configuration, such as
 // read and write timeouts and limits, and custom message handling,
 // via the Handler. Metrics can be collected by setting the Vars field
-// to an *expvar.Map. See the Server type documentation for all details.
+// to a metrics.Sink such as an *expvar.Map, which is also used by the
+// brokers that don't have their own. See the Server type documentation
+// for all details.
 //
 // The ServeConn method serves a connection using a configured Server.
 // The Upgrade function creates an http.Handler that upgrades the
 // HTTP connection to a websocket connection, and serves it using the
-// provided Server.
+// provided Server. For the clients that cannot establish a websocket
+// connection, the Fallback field enables a transport that sends the
+// messages as server-sent events and receives them via HTTP POST
+// requests, served by the same handler.
 //
 // Because HTTP/2 does not support websockets, the HTTP server used
 // to run the juggler server must not use HTTP/2. Since Go1.6, HTTP/2
 // is automatically enabled over HTTPS. See https://golang.org/doc/go1.6#http2
 // for details on how to explicitly disable it.
 //
+// Rooms are a higher-level abstraction over pub-sub channels. When the
+// RoomsBroker field is set, a Handler can add a connection to a room
+// with Conn.Join, after which the connection receives the events
+// published to the room with Server.PublishRoom. The members of a room
+// can be listed with Server.RoomMembers, and a connection automatically
+// leaves its rooms when it is closed. The clients cannot publish,
+// subscribe or unsubscribe on the channels of the rooms directly.
+//
+// When the PresenceBroker field is set, the server maintains presence
+// sets of the connections subscribed to each channel (including room
+// channels), shared by all servers. Entries expire unless they are
+// refreshed, so that the connections of a server that crashed are
+// eventually removed. See Server.Presence.
+//
 // One or many callees must be registered to listen for RPC requests.
 // The callees are decoupled from the server, with redis acting as the
 // broker. The pub-sub part is handled natively by redis. See the
@@ -86,11 +107,17 @@
 // Typical use of handlers can be:
 //
 //     - to implement logging of requests/responses
-//     - to recover in case of panics
 //     - to implement authentication for some requests
 //     - to implement authorization checks for some requests
 //     - etc.
 //
+// The panics raised by the handler or by ProcessMsg, including in the
+// goroutines it starts to run in-process callees and fan-out calls,
+// are recovered by the Server: the request being processed is NACKed
+// with a 500 code that is not retryable, or for an in-process callee,
+// an error result with a 500 code is sent, and the connection stays
+// open unless Server.CloseOnPanic is set.
+//
 // If a handler detects that the message cannot be executed as requested,
 // e.g. because the caller is not authenticated or doesn't have access
 // to the requested RPC URI, ProcessMsg must not be called. The message
@@ -116,7 +143,10 @@
 // which have their Type.IsRead method return true. Responses (messages
 // sent by the server) have their Type.IsWrite method return true.
 //
-// A new context.Context is passed for each message processed to maintain
-// values for the duration of a specific message.
+// The context.Context passed for each message processed is the base
+// context of the connection (see Conn.Context), so that the values
+// stored on it, e.g. by an authentication handler with Conn.WithContext,
+// are available to the handlers of all the subsequent messages of the
+// connection. It is canceled when the connection is closed.
 //
 package juggler
@@ -0,0 +1,101 @@
+package juggler
+
+import (
+	"encoding/json"
+
+	"github.com/mna/juggler/message"
+)
+
+// EventFilter is a function that decides if the event m is sent to
+// the client of the connection c. It returns false to drop the event.
+type EventFilter func(c *Conn, m *message.Evnt) bool
+
+// SetEventFilter sets fn as the event filter of the connection,
+// replacing any existing filter. A nil fn removes the filter. The
+// filter is called by ProcessMsg before each EVNT message is written
+// to the connection, and the events for which it returns false are
+// dropped. It can be used e.g. to drop the events that the client is
+// not allowed to see, or to deduplicate events, without creating a
+// channel per combination of permissions.
+//
+// The filter is called from the goroutine that receives the events
+// of the connection, so it should return quickly.
+func (c *Conn) SetEventFilter(fn EventFilter) {
+	c.emu.Lock()
+	c.evFilter = fn
+	c.emu.Unlock()
+}
+
+// filterEvent returns true if m should be sent on the connection.
+func (c *Conn) filterEvent(m *message.Evnt) bool {
+	c.emu.Lock()
+	fn := c.evFilter
+	c.emu.Unlock()
+
+	return fn == nil || fn(c, m)
+}
+
+// EventTransform is a function that rewrites the event m before it is
+// sent to the client of the connection c. It returns the event to
+// send, or an error to drop the event. The same event may be sent to
+// many connections, so it must not modify m, it must return a copy
+// instead.
+type EventTransform func(c *Conn, m *message.Evnt) (*message.Evnt, error)
+
+// SetEventTransform sets fn as the event transform of the connection,
+// replacing any existing transform. A nil fn removes the transform.
+// The transform is called by ProcessMsg after the event filter (see
+// SetEventFilter) and before the EVNT message is encoded and written
+// to the connection. It can be used e.g. to redact the fields of the
+// events that the client is not allowed to see (see RedactFields).
+//
+// As for the event filter, it is called from the goroutine that
+// receives the events of the connection, so it should return quickly.
+func (c *Conn) SetEventTransform(fn EventTransform) {
+	c.emu.Lock()
+	c.evTransform = fn
+	c.emu.Unlock()
+}
+
+// transformEvent returns the event to send for m.
+func (c *Conn) transformEvent(m *message.Evnt) (*message.Evnt, error) {
+	c.emu.Lock()
+	fn := c.evTransform
+	c.emu.Unlock()
+
+	if fn == nil {
+		return m, nil
+	}
+	return fn(c, m)
+}
+
+// RedactFields returns an EventTransform that removes the specified
+// top-level fields from the arguments of the events. Events whose
+// arguments are not a JSON object are sent unchanged.
+func RedactFields(fields ...string) EventTransform {
+	return func(c *Conn, m *message.Evnt) (*message.Evnt, error) {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(m.Payload.Args, &obj); err != nil || obj == nil {
+			return m, nil
+		}
+
+		var n int
+		for _, f := range fields {
+			if _, ok := obj[f]; ok {
+				delete(obj, f)
+				n++
+			}
+		}
+		if n == 0 {
+			return m, nil
+		}
+
+		b, err := json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		ev := *m
+		ev.Payload.Args = b
+		return &ev, nil
+	}
+}
@@ -0,0 +1,66 @@
+package juggler
+
+import (
+	"errors"
+	"expvar"
+	"testing"
+
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventFilter(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &Server{CallerBroker: &fakeCallerBroker{}, Vars: vars}
+	_, c, recv, closeFn := dialConn(t, server, "call")
+	defer closeFn()
+
+	c.SetEventFilter(func(c *Conn, m *message.Evnt) bool {
+		return m.Payload.Channel != "secret"
+	})
+	c.Send(message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "secret"}))
+	c.Send(message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "public"}))
+
+	if m, ok := recv(1)[message.EvntMsg]; assert.True(t, ok, "EVNT") {
+		assert.Equal(t, "public", m.(*message.Evnt).Payload.Channel, "channel")
+	}
+	assert.Equal(t, "1", vars.Get("FilteredEvnts").String(), "filtered events")
+
+	// remove the filter
+	c.SetEventFilter(nil)
+	c.Send(message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "secret"}))
+	if m, ok := recv(1)[message.EvntMsg]; assert.True(t, ok, "EVNT without filter") {
+		assert.Equal(t, "secret", m.(*message.Evnt).Payload.Channel, "channel without filter")
+	}
+}
+
+func TestEventTransform(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &Server{CallerBroker: &fakeCallerBroker{}, Vars: vars}
+	_, c, recv, closeFn := dialConn(t, server, "call")
+	defer closeFn()
+
+	redact := RedactFields("secret")
+	c.SetEventTransform(func(c *Conn, m *message.Evnt) (*message.Evnt, error) {
+		if m.Payload.Channel == "fail" {
+			return nil, errors.New("fail")
+		}
+		return redact(c, m)
+	})
+
+	ep := &message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "a", Args: []byte(`{"public":1,"secret":2}`)}
+	ev := message.NewEvnt(ep)
+	c.Send(ev)
+	if m, ok := recv(1)[message.EvntMsg]; assert.True(t, ok, "EVNT") {
+		assert.Equal(t, `{"public":1}`, string(m.(*message.Evnt).Payload.Args), "redacted args")
+	}
+	assert.Equal(t, `{"public":1,"secret":2}`, string(ev.Payload.Args), "original event unchanged")
+
+	c.Send(message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "fail"}))
+	c.Send(message.NewEvnt(&message.EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "b", Args: []byte(`[1]`)}))
+	if m, ok := recv(1)[message.EvntMsg]; assert.True(t, ok, "EVNT not an object") {
+		assert.Equal(t, `[1]`, string(m.(*message.Evnt).Payload.Args), "args not an object")
+	}
+	assert.Equal(t, "1", vars.Get("FailedEvntTransforms").String(), "failed transforms")
+}
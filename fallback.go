@@ -0,0 +1,357 @@
+package juggler
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+)
+
+// Query string parameters of the requests of the fallback transport
+// (see Server.Fallback). FallbackConnParam is the UUID of the
+// connection of a message posted by the client, and
+// FallbackProtocolParam the juggler subprotocol requested when the
+// events stream is opened.
+const (
+	FallbackConnParam     = "conn"
+	FallbackProtocolParam = "protocol"
+)
+
+// fallbackOpenEvent is the type of the first server-sent event of a
+// fallback connection, that holds the UUID of the connection.
+const fallbackOpenEvent = "open"
+
+// errFallbackClosed is returned by the fallback transport once the
+// events stream is closed.
+var errFallbackClosed = errors.New("juggler: fallback connection closed")
+
+// httpAddr is the net.Addr of an endpoint of an HTTP request.
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
+
+// fallbackConn is the transport of a connection that cannot use the
+// websocket protocol. The messages are sent to the client as
+// server-sent events on a long-lived response, and the messages of the
+// client are received via HTTP POST requests.
+type fallbackConn struct {
+	uuid        uuid.UUID
+	identity    *Identity
+	local       net.Addr
+	remote      net.Addr
+	subprotocol string
+
+	// read limit, accessed atomically
+	readLimit int64
+
+	// bodies of the posted messages, sent when the read loop is ready
+	// to process them
+	reads chan []byte
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error // set before done is closed
+
+	// wmu protects the response writer and the pong handler
+	wmu  sync.Mutex
+	w    io.Writer
+	fl   http.Flusher
+	pong func(string) error
+}
+
+func newFallbackConn(w http.ResponseWriter, fl http.Flusher, r *http.Request, connUUID uuid.UUID, proto string, id *Identity) *fallbackConn {
+	return &fallbackConn{
+		uuid:        connUUID,
+		identity:    id,
+		local:       httpAddr(r.Host),
+		remote:      httpAddr(r.RemoteAddr),
+		subprotocol: proto,
+		reads:       make(chan []byte),
+		done:        make(chan struct{}),
+		w:           w,
+		fl:          fl,
+	}
+}
+
+// close closes the transport, so that the read loop fails with err and
+// the pending and subsequent writes are dropped.
+func (c *fallbackConn) close(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+// post sends the posted message b to the read loop. It returns false
+// if the transport is closed or cancel is signaled before the message
+// is read.
+func (c *fallbackConn) post(b []byte, cancel <-chan bool) bool {
+	select {
+	case c.reads <- b:
+		return true
+	case <-c.done:
+		return false
+	case <-cancel:
+		return false
+	}
+}
+
+// writeEvent writes the server-sent event of type event (the default
+// type if it is empty) with data, and flushes it to the client.
+func (c *fallbackConn) writeEvent(event string, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	select {
+	case <-c.done:
+		return c.err
+	default:
+	}
+
+	var buf bytes.Buffer
+	if event != "" {
+		buf.WriteString("event: " + event + "\n")
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	if _, err := c.w.Write(buf.Bytes()); err != nil {
+		c.close(err)
+		return err
+	}
+	c.fl.Flush()
+	return nil
+}
+
+func (c *fallbackConn) LocalAddr() net.Addr  { return c.local }
+func (c *fallbackConn) RemoteAddr() net.Addr { return c.remote }
+func (c *fallbackConn) Subprotocol() string  { return c.subprotocol }
+
+// NextReader returns the next message posted by the client. The
+// messages are always text messages.
+func (c *fallbackConn) NextReader() (int, io.Reader, error) {
+	select {
+	case b := <-c.reads:
+		return websocket.TextMessage, bytes.NewReader(b), nil
+	case <-c.done:
+		return 0, nil, c.err
+	}
+}
+
+// SetReadDeadline is a no-op, the posted messages are read in full
+// before they are returned by NextReader.
+func (c *fallbackConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetReadLimit sets the maximum size of the posted messages. A message
+// that exceeds it is rejected and the transport is closed.
+func (c *fallbackConn) SetReadLimit(limit int64) {
+	atomic.StoreInt64(&c.readLimit, limit)
+}
+
+// SetPongHandler sets the handler called when a ping is flushed to
+// the client, as the events stream has no pong.
+func (c *fallbackConn) SetPongHandler(h func(appData string) error) {
+	c.wmu.Lock()
+	c.pong = h
+	c.wmu.Unlock()
+}
+
+// NextWriter returns a writer for the next message sent to the
+// client, that is written as a single event when it is closed.
+func (c *fallbackConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	select {
+	case <-c.done:
+		return nil, c.err
+	default:
+	}
+	return &fallbackWriter{c: c}, nil
+}
+
+// SetWriteDeadline is a no-op, the write timeout of the events stream
+// is the WriteTimeout of the http.Server.
+func (c *fallbackConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// WriteControl writes a ping as a comment on the events stream, and
+// calls the pong handler once it is flushed. The other control
+// messages are ignored.
+func (c *fallbackConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType != websocket.PingMessage {
+		return nil
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	select {
+	case <-c.done:
+		return c.err
+	default:
+	}
+	if _, err := c.w.Write([]byte(": ping " + string(data) + "\n\n")); err != nil {
+		c.close(err)
+		return err
+	}
+	c.fl.Flush()
+	if c.pong != nil {
+		c.pong(string(data))
+	}
+	return nil
+}
+
+// fallbackWriter buffers a message written to a fallbackConn.
+type fallbackWriter struct {
+	c   *fallbackConn
+	buf bytes.Buffer
+}
+
+func (w *fallbackWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *fallbackWriter) Close() error {
+	return w.c.writeEvent("", w.buf.Bytes())
+}
+
+func (srv *Server) addFallback(c *fallbackConn) {
+	srv.fmu.Lock()
+	if srv.fallbacks == nil {
+		srv.fallbacks = make(map[string]*fallbackConn)
+	}
+	srv.fallbacks[c.uuid.String()] = c
+	srv.fmu.Unlock()
+}
+
+func (srv *Server) removeFallback(c *fallbackConn) {
+	srv.fmu.Lock()
+	delete(srv.fallbacks, c.uuid.String())
+	srv.fmu.Unlock()
+}
+
+func (srv *Server) getFallback(connUUID uuid.UUID) *fallbackConn {
+	srv.fmu.Lock()
+	defer srv.fmu.Unlock()
+	return srv.fallbacks[connUUID.String()]
+}
+
+// serveFallback opens the events stream of a fallback connection on w
+// and serves it as a juggler connection identified by connUUID, until
+// it is closed. The setup function, if any, is passed to serveConn.
+func (srv *Server) serveFallback(w http.ResponseWriter, r *http.Request, connUUID uuid.UUID, affinity, compression string, offloading bool, id *Identity, setup func(*Conn) error) {
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// only the text protocols can be sent as server-sent events
+	proto := r.URL.Query().Get(FallbackProtocolParam)
+	if proto == "" {
+		proto = Subprotocols[0]
+	}
+	if !isInStr(Subprotocols, proto) || message.CodecFor(proto).Binary() {
+		http.Error(w, "unsupported protocol", http.StatusBadRequest)
+		return
+	}
+
+	c := newFallbackConn(w, fl, r, connUUID, proto, id)
+	srv.addFallback(c)
+	defer func() {
+		srv.removeFallback(c)
+		c.close(errFallbackClosed)
+		// wait for the write in progress, if any, the response writer
+		// must not be used once the handler returns.
+		c.wmu.Lock()
+		c.wmu.Unlock()
+	}()
+
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed := cn.CloseNotify()
+		go func() {
+			select {
+			case <-closed:
+				c.close(io.EOF)
+			case <-c.done:
+			}
+		}()
+	}
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/event-stream")
+	hdr.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// the first event holds the UUID of the connection, that the client
+	// sets in the FallbackConnParam of the messages it posts.
+	if err := c.writeEvent(fallbackOpenEvent, []byte(connUUID.String())); err != nil {
+		return
+	}
+
+	msgs := AllowedMessagesFromHeader(r.Header)
+	// this call blocks until the juggler connection is closed
+	srv.serveConn(c, connUUID, affinity, compression, offloading, id, setup, msgs...)
+}
+
+// postFallback receives a message posted by the client of a fallback
+// connection. It responds once the message is read by the connection.
+func (srv *Server) postFallback(w http.ResponseWriter, r *http.Request) {
+	c := srv.getFallback(uuid.Parse(r.URL.Query().Get(FallbackConnParam)))
+	if c == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	// the poster must be the authenticated client of the connection
+	if auth := srv.Authenticator; auth != nil {
+		id, err := auth.Authenticate(r)
+		if err != nil {
+			srv.init()
+			srv.vars.Add("FailedAuthentications", 1)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if c.identity == nil || id.Subject != c.identity.Subject {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	var body io.Reader = r.Body
+	limit := atomic.LoadInt64(&c.readLimit)
+	if limit > 0 {
+		body = io.LimitReader(body, limit+1)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if limit > 0 && int64(len(b)) > limit {
+		// as for a websocket connection, the connection is closed
+		c.close(websocket.ErrReadLimit)
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var cancel <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		cancel = cn.CloseNotify()
+	}
+	if !c.post(b, cancel) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,123 @@
+package juggler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sseEvent struct {
+	typ  string
+	data string
+}
+
+// readEvents sends the server-sent events read from r on the returned
+// channel, which is closed when r is closed.
+func readEvents(r io.Reader) <-chan sseEvent {
+	ch := make(chan sseEvent, 10)
+	go func() {
+		defer close(ch)
+
+		var ev sseEvent
+		var data []string
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			line := s.Text()
+			switch {
+			case line == "":
+				if len(data) > 0 {
+					ev.data = strings.Join(data, "\n")
+					ch <- ev
+				}
+				ev, data = sseEvent{}, nil
+			case strings.HasPrefix(line, "event: "):
+				ev.typ = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			}
+		}
+	}()
+	return ch
+}
+
+func nextEvent(t *testing.T, ch <-chan sseEvent) sseEvent {
+	select {
+	case ev, ok := <-ch:
+		require.True(t, ok, "events stream closed")
+		return ev
+	case <-time.After(time.Second):
+		require.FailNow(t, "no event received")
+	}
+	return sseEvent{}
+}
+
+func TestFallback(t *testing.T) {
+	srv := &Server{Fallback: true, CallerBroker: &fakeCallerBroker{}, PubSubBroker: &fakePubSubBroker{}}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	hs := httptest.NewServer(Upgrade(upg, srv))
+	defer hs.Close()
+
+	res, err := http.Get(hs.URL + "?" + FallbackProtocolParam + "=juggler.0" + message.MsgpackSuffix)
+	require.NoError(t, err, "Get binary protocol")
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "binary protocol status")
+
+	res, err = http.Get(hs.URL)
+	require.NoError(t, err, "Get")
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode, "status")
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"), "content type")
+
+	events := readEvents(res.Body)
+	ev := nextEvent(t, events)
+	assert.Equal(t, fallbackOpenEvent, ev.typ, "open event")
+	connUUID := uuid.Parse(ev.data)
+	require.NotNil(t, connUUID, "connection UUID")
+
+	call, err := message.NewCall("a", "b", time.Second)
+	require.NoError(t, err, "NewCall")
+	b, err := json.Marshal(call)
+	require.NoError(t, err, "Marshal")
+	res2, err := http.Post(hs.URL+"?"+FallbackConnParam+"="+connUUID.String(), "application/json", bytes.NewReader(b))
+	require.NoError(t, err, "Post")
+	res2.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res2.StatusCode, "post status")
+
+	ev = nextEvent(t, events)
+	m, err := message.UnmarshalResponse(strings.NewReader(ev.data))
+	require.NoError(t, err, "UnmarshalResponse")
+	if assert.Equal(t, message.AckMsg, m.Type(), "ACK") {
+		assert.Equal(t, call.UUID(), m.(*message.Ack).Payload.For, "ACK for call")
+	}
+
+	c, ok := srv.ConnByUUID(connUUID)
+	require.True(t, ok, "connection registered")
+	assert.True(t, c.Fallback(), "fallback connection")
+	assert.Nil(t, c.UnderlyingConn(), "no websocket connection")
+	assert.Equal(t, "juggler.0", c.Subprotocol(), "subprotocol")
+
+	res3, err := http.Post(hs.URL+"?"+FallbackConnParam+"="+uuid.NewRandom().String(), "application/json", bytes.NewReader(b))
+	require.NoError(t, err, "Post unknown connection")
+	res3.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res3.StatusCode, "unknown connection status")
+
+	// closing the events stream closes the connection
+	res.Body.Close()
+	select {
+	case <-c.CloseNotify():
+	case <-time.After(time.Second):
+		t.Errorf("connection not closed")
+	}
+}
@@ -0,0 +1,241 @@
+package juggler
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/callee"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+var (
+	errFanOutDisabled = errors.New("juggler: fan-out calls are disabled")
+	errTooManyFanOut  = errors.New("juggler: too many fan-out URIs")
+)
+
+// fanOut is a fan-out call for which the results are being gathered.
+type fanOut struct {
+	call    *message.Call
+	results []message.FanOutResult // in the order of the fan-out URIs
+	pending int
+	timer   *time.Timer
+}
+
+// fanOutCall identifies the sub-call at index i of the fan-out call fo.
+type fanOutCall struct {
+	fo *fanOut
+	i  int
+}
+
+// processFanOut processes the fan-out CALL m, dispatching a call to
+// each of its fan-out URIs. The results are gathered by gatherResult.
+func processFanOut(c *Conn, m *message.Call, addFn func(string, int64)) {
+	uris := m.Payload.FanOut
+	if c.srv.MaxFanOut <= 0 {
+		c.Send(message.NewNack(m, 400, errFanOutDisabled))
+		return
+	}
+	if len(uris) > c.srv.MaxFanOut {
+		c.Send(message.NewNack(m, 400, errTooManyFanOut))
+		return
+	}
+	for _, uri := range uris {
+		if !isSystemURI(uri) && !c.srv.uriAllowed(uri) {
+			addFn("DeniedCalls", 1)
+			c.Send(message.NewNack(m, 404, errURINotAllowed))
+			return
+		}
+	}
+	addFn("FanOutCalls", 1)
+
+	timeout := m.Payload.Timeout
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+
+	fo := &fanOut{
+		call:    m,
+		results: make([]message.FanOutResult, len(uris)),
+		pending: len(uris),
+	}
+	cps := make([]*message.CallPayload, len(uris))
+	for i, uri := range uris {
+		fo.results[i].URI = uri
+		cps[i] = &message.CallPayload{
+			ConnUUID: c.UUID,
+			MsgUUID:  uuid.NewRandom(),
+			URI:      uri,
+			Args:     m.Payload.Args,
+
+			CorrelationID: m.CorrelationID(),
+			Priority:      m.Priority(),
+		}
+	}
+
+	// register the sub-calls before dispatching them, so that their
+	// results are gathered even if they arrive immediately.
+	c.fmu.Lock()
+	if c.fanOuts == nil {
+		c.fanOuts = make(map[string]fanOutCall)
+	}
+	for i, cp := range cps {
+		c.fanOuts[cp.MsgUUID.String()] = fanOutCall{fo, i}
+	}
+	c.fmu.Unlock()
+
+	c.Send(message.NewAck(m))
+	for _, cp := range cps {
+		if err := dispatchFanOut(c, cp, timeout, addFn); err != nil {
+			rp, _ := callee.ResultPayload(cp, nil, err)
+			c.gatherResult(message.NewRes(rp))
+		}
+	}
+
+	c.fmu.Lock()
+	if fo.pending > 0 {
+		fo.timer = time.AfterFunc(timeout, func() {
+			defer c.recoverGo()
+			c.expireFanOut(fo, cps, addFn)
+		})
+	}
+	c.fmu.Unlock()
+}
+
+// dispatchFanOut dispatches the sub-call cp of a fan-out call.
+func dispatchFanOut(c *Conn, cp *message.CallPayload, timeout time.Duration, addFn func(string, int64)) error {
+	if isSystemURI(cp.URI) {
+		fn, ok := c.srv.systemCallee(cp.URI)
+		if !ok {
+			return errUnknownSystemURI
+		}
+		go invokeLocal(c, cp, fn, timeout, addFn)
+		return nil
+	}
+	if fn, ok := c.srv.Callees[cp.URI]; ok {
+		go invokeLocal(c, cp, fn, timeout, addFn)
+		return nil
+	}
+	if c.srv.Degraded() || c.resultsDown() {
+		return errBrokerUnavailable
+	}
+	if !c.srv.hasLiveCallee(cp.URI) {
+		addFn("NoCalleeNacks", 1)
+		return errNoLiveCallee
+	}
+	return c.srv.CallerBroker.Call(cp, timeout)
+}
+
+// gatherResult records the result m if it is the result of a sub-call
+// of a fan-out call, and returns true in that case. If the fan-out call
+// streams its results, m is sent as a partial result of the call. Once
+// all results are received, the combined result is sent.
+func (c *Conn) gatherResult(m *message.Res) bool {
+	key := m.Payload.For.String()
+
+	c.fmu.Lock()
+	foc, ok := c.fanOuts[key]
+	if !ok {
+		c.fmu.Unlock()
+		return false
+	}
+	delete(c.fanOuts, key)
+
+	fo := foc.fo
+	res := &fo.results[foc.i]
+	res.Error = m.Payload.Error
+	if !fo.call.Payload.Stream {
+		// the partial results are not repeated in the combined result
+		res.Args = m.Payload.Args
+	}
+	fo.pending--
+	done := fo.pending == 0
+	if done && fo.timer != nil {
+		fo.timer.Stop()
+	}
+	c.fmu.Unlock()
+
+	if fo.call.Payload.Stream {
+		partial := *m
+		partial.Payload.For = fo.call.UUID()
+		partial.Payload.Partial = true
+		c.Send(&partial)
+	}
+	if done {
+		c.sendFanOut(fo)
+	}
+	return true
+}
+
+// gatherChunk returns true if the result chunk m is a chunk of the
+// result of a sub-call of a fan-out call. If the fan-out call streams
+// its results, m is sent as a chunk of the fan-out call, otherwise it
+// is dropped, as the combined result only holds the results.
+func (c *Conn) gatherChunk(m *message.ResChunk) bool {
+	c.fmu.Lock()
+	foc, ok := c.fanOuts[m.Payload.For.String()]
+	c.fmu.Unlock()
+	if !ok {
+		return false
+	}
+
+	if fo := foc.fo; fo.call.Payload.Stream {
+		chunk := *m
+		chunk.Payload.For = fo.call.UUID()
+		c.Send(&chunk)
+	}
+	return true
+}
+
+// expireFanOut sends the combined result of the fan-out call fo whose
+// timeout expired, with the sub-calls cps that did not return a result
+// flagged as timed out.
+func (c *Conn) expireFanOut(fo *fanOut, cps []*message.CallPayload, addFn func(string, int64)) {
+	c.fmu.Lock()
+	var expired bool
+	for i, cp := range cps {
+		key := cp.MsgUUID.String()
+		if _, ok := c.fanOuts[key]; ok {
+			delete(c.fanOuts, key)
+			fo.results[i].Timeout = true
+			expired = true
+		}
+	}
+	c.fmu.Unlock()
+
+	if expired {
+		addFn("FanOutTimeouts", 1)
+		c.sendFanOut(fo)
+	}
+}
+
+// sendFanOut sends the combined result of the fan-out call fo. The
+// result is flagged as an error only if all sub-calls failed.
+func (c *Conn) sendFanOut(fo *fanOut) {
+	select {
+	case <-c.CloseNotify():
+		return
+	default:
+	}
+
+	failed := true
+	for _, r := range fo.results {
+		if !r.Error && !r.Timeout {
+			failed = false
+			break
+		}
+	}
+	b, _ := json.Marshal(fo.results)
+	c.Send(message.NewRes(&message.ResPayload{
+		ConnUUID: c.UUID,
+		MsgUUID:  fo.call.UUID(),
+		URI:      fo.call.Payload.URI,
+		Args:     b,
+		Error:    failed,
+
+		CorrelationID: fo.call.CorrelationID(),
+		Priority:      fo.call.Priority(),
+	}))
+}
@@ -0,0 +1,105 @@
+package juggler
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/callee"
+	"github.com/mna/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFanOutCall(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		Vars:         vars,
+		Callees: map[string]callee.Thunk{
+			"ok": func(cp *message.CallPayload) (interface{}, error) {
+				return cp.URI, nil
+			},
+			"fail": func(cp *message.CallPayload) (interface{}, error) {
+				return nil, errors.New("failed")
+			},
+			"slow": func(cp *message.CallPayload) (interface{}, error) {
+				time.Sleep(200 * time.Millisecond)
+				return nil, nil
+			},
+			"panic": func(cp *message.CallPayload) (interface{}, error) {
+				panic("boom")
+			},
+		},
+	}
+	cli, recv, closeFn := dialCallOnly(t, server)
+	defer closeFn()
+
+	// fan-out calls are disabled
+	_, err := cli.CallFanOut("all", []string{"ok"}, nil, false, time.Second)
+	require.NoError(t, err, "CallFanOut disabled")
+	if m, ok := recv(1)[message.NackMsg]; assert.True(t, ok, "NACK") {
+		assert.Equal(t, 400, m.(*message.Nack).Payload.Code, "code")
+	}
+
+	server.MaxFanOut = 2
+	_, err = cli.CallFanOut("all", []string{"ok", "ok", "ok"}, nil, false, time.Second)
+	require.NoError(t, err, "CallFanOut too many")
+	if m, ok := recv(1)[message.NackMsg]; assert.True(t, ok, "NACK too many") {
+		assert.Equal(t, 400, m.(*message.Nack).Payload.Code, "code too many")
+	}
+
+	// combined results, with a partial failure
+	_, err = cli.CallFanOut("all", []string{"ok", "fail"}, nil, false, time.Second)
+	require.NoError(t, err, "CallFanOut")
+	got := recv(2)
+	require.Contains(t, got, message.AckMsg, "ACK")
+	if m, ok := got[message.ResMsg]; assert.True(t, ok, "RES") {
+		res := m.(*message.Res)
+		assert.Equal(t, "all", res.Payload.URI, "URI")
+		assert.False(t, res.Payload.Error, "not an error")
+
+		var results []message.FanOutResult
+		require.NoError(t, json.Unmarshal(res.Payload.Args, &results), "unmarshal results")
+		require.Len(t, results, 2, "results")
+		assert.Equal(t, message.FanOutResult{URI: "ok", Args: json.RawMessage(`"ok"`)}, results[0], "ok result")
+		assert.Equal(t, message.FanOutResult{URI: "fail", Args: json.RawMessage(`{"error":{"message":"failed"}}`), Error: true}, results[1], "fail result")
+	}
+
+	// streamed results, with a timeout
+	_, err = cli.CallFanOut("all", []string{"ok", "slow"}, nil, true, 50*time.Millisecond)
+	require.NoError(t, err, "CallFanOut stream")
+	got = recv(2)
+	require.Contains(t, got, message.AckMsg, "ACK stream")
+	if m, ok := got[message.ResMsg]; assert.True(t, ok, "partial RES") {
+		res := m.(*message.Res)
+		assert.True(t, res.Payload.Partial, "partial")
+		assert.Equal(t, "ok", res.Payload.URI, "partial URI")
+		assert.Equal(t, `"ok"`, string(res.Payload.Args), "partial args")
+	}
+	if m, ok := recv(1)[message.ResMsg]; assert.True(t, ok, "combined RES") {
+		res := m.(*message.Res)
+		assert.False(t, res.Payload.Partial, "not partial")
+
+		var results []message.FanOutResult
+		require.NoError(t, json.Unmarshal(res.Payload.Args, &results), "unmarshal streamed results")
+		assert.Equal(t, []message.FanOutResult{{URI: "ok"}, {URI: "slow", Timeout: true}}, results, "streamed results")
+	}
+
+	// a panic in a sub-call is recovered and returned as its result
+	_, err = cli.CallFanOut("all", []string{"ok", "panic"}, nil, false, time.Second)
+	require.NoError(t, err, "CallFanOut panic")
+	got = recv(2)
+	require.Contains(t, got, message.AckMsg, "ACK panic")
+	if m, ok := got[message.ResMsg]; assert.True(t, ok, "RES panic") {
+		var results []message.FanOutResult
+		require.NoError(t, json.Unmarshal(m.(*message.Res).Payload.Args, &results), "unmarshal panic results")
+		require.Len(t, results, 2, "panic results")
+		assert.Equal(t, message.FanOutResult{URI: "panic", Args: json.RawMessage(`{"error":{"message":"juggler: internal server error","code":500}}`), Error: true}, results[1], "panic result")
+	}
+	assert.Equal(t, "3", vars.Get("FanOutCalls").String(), "fan-out calls")
+	assert.Equal(t, "1", vars.Get("FanOutTimeouts").String(), "fan-out timeouts")
+	assert.Equal(t, "1", vars.Get("RecoveredPanics").String(), "recovered panics")
+}
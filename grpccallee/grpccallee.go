@@ -0,0 +1,159 @@
+// Package grpccallee implements a juggler callee in front of existing
+// gRPC services, so that they can be called by juggler clients without
+// rewriting their handlers. Each URI is mapped to a gRPC method, and
+// the Thunks of the Adapter translate the JSON-encoded arguments of
+// the call requests to the protobuf request messages of the methods,
+// and their responses back to JSON-encoded results, using the protobuf
+// JSON mapping.
+//
+// The messages are built dynamically from the descriptors of the
+// methods, so the generated code of the services is not required, only
+// their descriptors must be registered (which is the case if the
+// generated code is linked in the binary).
+package grpccallee
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/callee"
+	"github.com/mna/juggler/message"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Adapter translates the call requests to calls of the gRPC methods
+// of the services available on Conn.
+type Adapter struct {
+	// Conn is the gRPC client connection used to call the methods,
+	// typically a *grpc.ClientConn. It must be set.
+	Conn grpc.ClientConnInterface
+
+	// Methods maps the URIs to the full names of the gRPC methods to
+	// call, e.g. "billing.invoice.get" to "billing.v1.Invoices/Get".
+	// The method name can also be in the gRPC path form, e.g.
+	// "/billing.v1.Invoices/Get", or in the protobuf form, e.g.
+	// "billing.v1.Invoices.Get".
+	Methods map[string]string
+
+	// Files is the registry of the descriptors of the services. If it
+	// is nil, protoregistry.GlobalFiles is used, where the generated
+	// code registers its descriptors.
+	Files *protoregistry.Files
+
+	// CallOptions are the options used for each call of a gRPC method.
+	CallOptions []grpc.CallOption
+}
+
+// method is a gRPC method resolved from its descriptor.
+type method struct {
+	path string // gRPC path, e.g. "/billing.v1.Invoices/Get"
+	desc protoreflect.MethodDescriptor
+}
+
+// Thunks returns the Thunks to use with Callee.Listen to handle the
+// calls to the URIs of Methods. It returns an error if a method cannot
+// be found in Files, or if it is a streaming method.
+func (a *Adapter) Thunks() (map[string]callee.Thunk, error) {
+	files := a.Files
+	if files == nil {
+		files = protoregistry.GlobalFiles
+	}
+
+	m := make(map[string]callee.Thunk, len(a.Methods))
+	for uri, name := range a.Methods {
+		meth, err := resolveMethod(files, name)
+		if err != nil {
+			return nil, err
+		}
+		m[uri] = a.thunk(meth)
+	}
+	return m, nil
+}
+
+// resolveMethod returns the method named name in files.
+func resolveMethod(files *protoregistry.Files, name string) (*method, error) {
+	fullName := strings.Replace(strings.TrimPrefix(name, "/"), "/", ".", 1)
+	d, err := files.FindDescriptorByName(protoreflect.FullName(fullName))
+	if err != nil {
+		return nil, fmt.Errorf("juggler/grpccallee: method %s: %v", name, err)
+	}
+	md, ok := d.(protoreflect.MethodDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("juggler/grpccallee: %s is not a method", name)
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, fmt.Errorf("juggler/grpccallee: method %s is a streaming method", name)
+	}
+	return &method{
+		path: "/" + string(md.Parent().FullName()) + "/" + string(md.Name()),
+		desc: md,
+	}, nil
+}
+
+// thunk returns the Thunk that calls the gRPC method meth.
+func (a *Adapter) thunk(meth *method) callee.Thunk {
+	return func(cp *message.CallPayload) (interface{}, error) {
+		req := dynamicpb.NewMessage(meth.desc.Input())
+		if len(cp.Args) > 0 && string(cp.Args) != "null" {
+			if err := protojson.Unmarshal(cp.Args, req); err != nil {
+				return nil, &callee.Error{
+					Code:    int(codes.InvalidArgument),
+					Message: fmt.Sprintf("juggler/grpccallee: invalid arguments: %v", err),
+				}
+			}
+		}
+
+		// the gRPC call expires with the call request
+		ttl := cp.TTLAfterRead
+		if ttl <= 0 {
+			ttl = broker.DefaultCallTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ttl)
+		defer cancel()
+
+		res := dynamicpb.NewMessage(meth.desc.Output())
+		if err := a.Conn.Invoke(ctx, meth.path, req, res, a.CallOptions...); err != nil {
+			return nil, statusError(err)
+		}
+
+		b, err := protojson.Marshal(res)
+		if err != nil {
+			return nil, err
+		}
+		return json.RawMessage(b), nil
+	}
+}
+
+// statusError converts the error returned by a gRPC call to a
+// *callee.Error with the gRPC status code and message, and the
+// JSON-encoded status details, if any.
+func statusError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	ce := &callee.Error{Code: int(st.Code()), Message: st.Message()}
+	var details []json.RawMessage
+	for _, d := range st.Proto().GetDetails() {
+		b, err := protojson.Marshal(d)
+		if err != nil {
+			// unknown detail type, skip it
+			continue
+		}
+		details = append(details, b)
+	}
+	if len(details) > 0 {
+		ce.Details = details
+	}
+	return ce
+}
@@ -0,0 +1,151 @@
+package grpccallee
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/callee"
+	"github.com/mna/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// echoFiles returns a registry with the test.Echo service, that has
+// the Upper and Stream methods.
+func echoFiles(t *testing.T) *protoregistry.Files {
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("test/echo.proto"),
+		Package:    proto.String("test"),
+		Dependency: []string{"google/protobuf/wrappers.proto"},
+		Syntax:     proto.String("proto3"),
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Echo"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Upper"),
+				InputType:  proto.String(".google.protobuf.StringValue"),
+				OutputType: proto.String(".google.protobuf.StringValue"),
+			}, {
+				Name:            proto.String("Stream"),
+				InputType:       proto.String(".google.protobuf.StringValue"),
+				OutputType:      proto.String(".google.protobuf.StringValue"),
+				ServerStreaming: proto.Bool(true),
+			}},
+		}},
+	}
+	fd, err := protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+	require.NoError(t, err, "NewFile")
+
+	files := new(protoregistry.Files)
+	require.NoError(t, files.RegisterFile(fd), "RegisterFile")
+	return files
+}
+
+// startEcho starts a gRPC server that implements the Upper method of
+// the test.Echo service, and returns a client connection to it.
+func startEcho(t *testing.T) (*grpc.ClientConn, func()) {
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Echo",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Upper",
+			Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				var in wrapperspb.StringValue
+				if err := dec(&in); err != nil {
+					return nil, err
+				}
+				if in.Value == "" {
+					return nil, status.Error(codes.InvalidArgument, "empty value")
+				}
+				if _, ok := ctx.Deadline(); !ok {
+					return nil, status.Error(codes.Internal, "no deadline")
+				}
+				return wrapperspb.String(strings.ToUpper(in.Value)), nil
+			},
+		}},
+	}, struct{}{})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Listen")
+	go srv.Serve(l)
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err, "NewClient")
+	return conn, func() {
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+func TestAdapter(t *testing.T) {
+	conn, stop := startEcho(t)
+	defer stop()
+
+	a := &Adapter{
+		Conn:  conn,
+		Files: echoFiles(t),
+		Methods: map[string]string{
+			"echo.upper":  "test.Echo/Upper",
+			"echo.upper2": "/test.Echo/Upper",
+			"echo.upper3": "test.Echo.Upper",
+		},
+	}
+	thunks, err := a.Thunks()
+	require.NoError(t, err, "Thunks")
+	require.Len(t, thunks, 3, "Thunks")
+
+	call := func(uri, args string) (*message.ResPayload, error) {
+		cp := &message.CallPayload{URI: uri, Args: json.RawMessage(args), TTLAfterRead: time.Second}
+		v, err := thunks[uri](cp)
+		return callee.ResultPayload(cp, v, err)
+	}
+
+	for uri := range a.Methods {
+		rp, err := call(uri, `"abc"`)
+		require.NoError(t, err, "%s: ResultPayload", uri)
+		assert.False(t, rp.Error, "%s: error", uri)
+		assert.Equal(t, `"ABC"`, string(rp.Args), "%s: result", uri)
+	}
+
+	// gRPC error
+	rp, err := call("echo.upper", `""`)
+	require.NoError(t, err, "ResultPayload")
+	assert.True(t, rp.Error, "error")
+	var er message.ErrResult
+	require.NoError(t, json.Unmarshal(rp.Args, &er), "unmarshal ErrResult")
+	assert.Equal(t, int(codes.InvalidArgument), er.Error.Code, "error code")
+	assert.Equal(t, "empty value", er.Error.Message, "error message")
+
+	// invalid arguments
+	rp, err = call("echo.upper", `{"a": 1}`)
+	require.NoError(t, err, "ResultPayload")
+	assert.True(t, rp.Error, "error")
+	require.NoError(t, json.Unmarshal(rp.Args, &er), "unmarshal ErrResult")
+	assert.Equal(t, int(codes.InvalidArgument), er.Error.Code, "error code")
+	assert.Contains(t, er.Error.Message, "invalid arguments", "error message")
+
+	// unimplemented method
+	_, err = resolveMethod(a.Files, "test.Echo/Nope")
+	assert.Error(t, err, "unknown method")
+	_, err = resolveMethod(a.Files, "test.Echo/Stream")
+	if assert.Error(t, err, "streaming method") {
+		assert.Contains(t, err.Error(), "streaming", "error message")
+	}
+	_, err = resolveMethod(a.Files, "test.Echo")
+	if assert.Error(t, err, "service") {
+		assert.Contains(t, err.Error(), "not a method", "error message")
+	}
+}
@@ -2,14 +2,16 @@ package juggler
 
 import (
 	"encoding/json"
-	"expvar"
 	"io"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/callee"
 	"github.com/mna/juggler/internal/wswriter"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 )
 
 // SlowProcessMsgThreshold defines the threshold at which calls to
@@ -33,7 +35,7 @@ func (h HandlerFunc) Handle(ctx context.Context, c *Conn, m message.Msg) {
 	h(ctx, c, m)
 }
 
-func saveMsgMetrics(vars *expvar.Map, m message.Msg) func() {
+func saveMsgMetrics(vars metrics.Sink, m message.Msg) func() {
 	vars.Add("Msgs", 1)
 	if m.Type().IsRead() {
 		vars.Add("MsgsRead", 1)
@@ -63,7 +65,8 @@ func saveMsgMetrics(vars *expvar.Map, m message.Msg) func() {
 // ProcessMsg implements the standard message processing. For requests
 // (client-sent messages), it calls the appropriate RPC or pub-sub
 // mechanisms. For responses (server-sent messages), it marshals the
-// message and sends it to the client. If a write to the connection fails,
+// message and sends it to the client, or adds it to the connection's
+// send queue if the Server has a SendQueueSize. If a write to the connection fails,
 // the connection is closed and the write error is stored as CloseErr
 // on the connection (unless an earlier error already caused the
 // connection to close).
@@ -72,63 +75,316 @@ func saveMsgMetrics(vars *expvar.Map, m message.Msg) func() {
 // point call ProcessMsg so the expected behaviour happens.
 func ProcessMsg(c *Conn, m message.Msg) {
 	addFn := func(string, int64) {}
-	if c.srv.Vars != nil {
-		if fn := saveMsgMetrics(c.srv.Vars, m); fn != nil {
+	if c.srv.vars != metrics.Discard {
+		if fn := saveMsgMetrics(c.srv.vars, m); fn != nil {
 			defer fn()
 		}
 
-		addFn = c.srv.Vars.Add
+		corr := m.CorrelationID()
+		addFn = func(key string, delta int64) {
+			metrics.AddExemplar(c.srv.vars, key, delta, corr)
+		}
+	}
+
+	if err := c.srv.Settings().Limits.Check(m); err != nil {
+		addFn("MsgsLimitExceeded", 1)
+		c.Send(message.NewNack(m, err.(*message.LimitError).Code, err))
+		return
+	}
+	if err := c.srv.Validators.Check(m); err != nil {
+		addFn("InvalidMsgs", 1)
+		c.Send(message.NewNack(m, message.CodeInvalidArgs, err))
+		return
+	}
+	if err := c.srv.checkTopic(m); err != nil {
+		addFn("InvalidChannels", 1)
+		c.Send(message.NewNack(m, 400, err))
+		return
+	}
+	if nack := c.rateLimit(m); nack != nil {
+		addFn("RateLimitedMsgs", 1)
+		c.Send(nack)
+		return
+	}
+	if nack := c.authorize(m); nack != nil {
+		addFn("UnauthorizedMsgs", 1)
+		c.Send(nack)
+		return
 	}
 
 	switch m := m.(type) {
 	case *message.Call:
-		cp := &message.CallPayload{
-			ConnUUID: c.UUID,
-			MsgUUID:  m.UUID(),
-			URI:      m.Payload.URI,
-			Args:     m.Payload.Args,
+		if m.Payload.Chunked {
+			// the call is processed once its final chunk is received
+			if code, err := c.startChunked(m); err != nil {
+				c.Send(message.NewNack(m, code, err))
+			}
+			return
 		}
-		if err := c.srv.CallerBroker.Call(cp, m.Payload.Timeout); err != nil {
-			c.Send(message.NewNack(m, 500, err))
+		processCall(c, m, addFn)
+
+	case *message.Chunk:
+		call, code, err := c.addChunk(m)
+		if err != nil {
+			c.Send(message.NewNack(m, code, err))
 			return
 		}
-		c.Send(message.NewAck(m))
+		if call == nil {
+			return
+		}
+		if err := c.srv.Settings().Limits.Check(call); err != nil {
+			addFn("MsgsLimitExceeded", 1)
+			c.Send(message.NewNack(call, err.(*message.LimitError).Code, err))
+			return
+		}
+		if err := c.srv.Validators.Check(call); err != nil {
+			addFn("InvalidMsgs", 1)
+			c.Send(message.NewNack(call, message.CodeInvalidArgs, err))
+			return
+		}
+		processCall(c, call, addFn)
 
 	case *message.Pub:
+		if !c.pubAllowed(m.Payload.Channel) {
+			addFn("DeniedChannels", 1)
+			c.Send(message.NewNack(m, 403, errChannelNotAllowed))
+			return
+		}
+		if c.srv.Degraded() {
+			addFn("DegradedNacks", 1)
+			c.Send(message.NewNack(m, 503, errBrokerUnavailable))
+			return
+		}
 		pp := &message.PubPayload{
-			MsgUUID: m.UUID(),
-			Args:    m.Payload.Args,
+			MsgUUID:       m.UUID(),
+			Args:          m.Payload.Args,
+			CorrelationID: m.CorrelationID(),
+			Priority:      m.Priority(),
+			Binary:        m.Payload.Binary,
 		}
-		if err := c.srv.PubSubBroker.Publish(m.Payload.Channel, pp); err != nil {
+		c.offloadPub(pp)
+		n, err := c.srv.PubSubBroker.Publish(m.Payload.Channel, pp)
+		if err != nil {
 			c.Send(message.NewNack(m, 500, err))
 			return
 		}
-		c.Send(message.NewAck(m))
+		ack := message.NewAck(m)
+		ack.Payload.Delivered = &n
+		c.Send(ack)
 
 	case *message.Sub:
-		if err := c.psc.Subscribe(m.Payload.Channel, m.Payload.Pattern); err != nil {
-			c.Send(message.NewNack(m, 500, err))
+		if !c.subAllowed(m.Payload.Channel, m.Payload.Pattern) {
+			addFn("DeniedChannels", 1)
+			c.Send(message.NewNack(m, 403, errChannelNotAllowed))
+			return
+		}
+		if err := c.subscribe(m.Payload.Channel, m.Payload.Pattern, m.Payload.Filter); err != nil {
+			c.Send(message.NewNack(m, brokerErrCode(err), err))
 			return
 		}
+		if !m.Payload.Pattern {
+			c.addPresence(m.Payload.Channel)
+		}
+
+		// get the missed events once subscribed, so that none is lost in
+		// between. Some may be sent twice, the client can deduplicate them.
+		var replay []*message.EvntPayload
+		if id := m.Payload.LastEventID; id != "" && !m.Payload.Pattern {
+			var err error
+			if replay, err = c.replay(m.Payload.Channel, id); err != nil {
+				// the connection stays subscribed, the SUB can be retried
+				addFn("FailedReplays", 1)
+				c.Send(message.NewNack(m, brokerErrCode(err), err))
+				return
+			}
+		}
 		c.Send(message.NewAck(m))
+		for _, ep := range replay {
+			addFn("ReplayedEvnts", 1)
+			c.Send(message.NewEvnt(ep))
+		}
 
 	case *message.Unsb:
-		if err := c.psc.Unsubscribe(m.Payload.Channel, m.Payload.Pattern); err != nil {
-			c.Send(message.NewNack(m, 500, err))
+		if isRoomChannel(m.Payload.Channel) {
+			addFn("DeniedChannels", 1)
+			c.Send(message.NewNack(m, 403, errChannelNotAllowed))
 			return
 		}
+		if err := c.unsubscribe(m.Payload.Channel, m.Payload.Pattern); err != nil {
+			c.Send(message.NewNack(m, brokerErrCode(err), err))
+			return
+		}
+		if !m.Payload.Pattern {
+			c.removePresence(m.Payload.Channel)
+		}
 		c.Send(message.NewAck(m))
 
-	case *message.Ack, *message.Nack, *message.Evnt, *message.Res:
-		doWrite(c, m, addFn)
+	case *message.Ack, *message.Nack:
+		write(c, m, addFn)
+
+	case *message.Evnt:
+		if !c.matchSubscription(m) {
+			addFn("UnmatchedEvnts", 1)
+			return
+		}
+		if err := c.resolveEvent(m); err != nil {
+			addFn("FailedBlobResolves", 1)
+			return
+		}
+		if !c.filterEvent(m) {
+			addFn("FilteredEvnts", 1)
+			return
+		}
+		ev, err := c.transformEvent(m)
+		if err != nil {
+			addFn("FailedEvntTransforms", 1)
+			return
+		}
+		write(c, c.compress(ev), addFn)
+
+	case *message.Res:
+		if c.isDuplicateResult(m) {
+			addFn("DuplicateResults", 1)
+			return
+		}
+		if c.gatherResult(m) {
+			return
+		}
+		write(c, c.compress(c.offloadResult(m)), addFn)
+
+	case *message.ResChunk:
+		if c.gatherChunk(m) {
+			return
+		}
+		write(c, c.compress(c.offloadResult(m)), addFn)
 
 	default:
 		addFn("MsgsUnknown", 1)
 	}
 }
 
-func doWrite(c *Conn, m message.Msg, addFn func(string, int64)) {
-	if err := writeMsg(c, m); err != nil {
+// processCall processes the CALL message m, with its complete arguments.
+func processCall(c *Conn, m *message.Call, addFn func(string, int64)) {
+	c.trackCall(m.UUID(), m.Payload.Timeout)
+	if len(m.Payload.FanOut) > 0 {
+		processFanOut(c, m, addFn)
+		return
+	}
+
+	cp := &message.CallPayload{
+		ConnUUID: c.UUID,
+		MsgUUID:  m.UUID(),
+		URI:      m.Payload.URI,
+		Args:     m.Payload.Args,
+		Binary:   m.Payload.Binary,
+
+		CorrelationID:  m.CorrelationID(),
+		Priority:       m.Priority(),
+		IdempotencyKey: m.IdempotencyKey(),
+	}
+	if isSystemURI(cp.URI) {
+		fn, ok := c.srv.systemCallee(cp.URI)
+		if !ok {
+			c.Send(message.NewNack(m, 404, errUnknownSystemURI))
+			return
+		}
+		c.Send(message.NewAck(m))
+		go invokeLocal(c, cp, fn, m.Payload.Timeout, addFn)
+		return
+	}
+	if !c.srv.uriAllowed(cp.URI) {
+		addFn("DeniedCalls", 1)
+		c.Send(message.NewNack(m, 404, errURINotAllowed))
+		return
+	}
+	if fn, ok := c.srv.Callees[cp.URI]; ok {
+		c.Send(message.NewAck(m))
+		go invokeLocal(c, cp, fn, m.Payload.Timeout, addFn)
+		return
+	}
+	if c.srv.Degraded() || c.resultsDown() {
+		addFn("DegradedNacks", 1)
+		c.Send(message.NewNack(m, 503, errBrokerUnavailable))
+		return
+	}
+	if !c.srv.hasLiveCallee(cp.URI) {
+		addFn("NoCalleeNacks", 1)
+		c.Send(message.NewNack(m, 503, errNoLiveCallee))
+		return
+	}
+	if err := c.srv.CallerBroker.Call(cp, m.Payload.Timeout); err != nil {
+		if err != broker.ErrDuplicate {
+			c.Send(message.NewNack(m, 500, err))
+			return
+		}
+		// the call is already registered, its result will be sent as for
+		// the original request.
+		addFn("DuplicateCalls", 1)
+	}
+	c.Send(message.NewAck(m))
+}
+
+// invokeLocal executes the in-process callee fn for the call cp and
+// sends the result on c, unless the call has expired or the connection
+// is closed. If fn panics, the panic is recovered and an error result
+// with a 500 code is sent, unless the server has CloseOnPanic set.
+func invokeLocal(c *Conn, cp *message.CallPayload, fn callee.Thunk, timeout time.Duration, addFn func(string, int64)) {
+	defer c.recoverGo()
+
+	addFn("LocalCalls", 1)
+	if timeout <= 0 {
+		timeout = broker.DefaultCallTimeout
+	}
+	cp.TTLAfterRead = timeout
+
+	start := time.Now()
+	v, err := callLocal(c, fn, cp)
+	if time.Now().Sub(start) >= timeout {
+		addFn("ExpiredLocalCalls", 1)
+		return
+	}
+
+	rp, err := callee.ResultPayload(cp, v, err)
+	if err != nil {
+		// the result could not be marshaled, send that error as result
+		rp, _ = callee.ResultPayload(cp, nil, err)
+	}
+
+	select {
+	case <-c.CloseNotify():
+	default:
+		c.Send(message.NewRes(rp))
+	}
+}
+
+// callLocal calls fn with cp and returns its result. If fn panics, the
+// RecoveredPanics metric is incremented, the connection c is closed if
+// the server has CloseOnPanic set, and an error with a 500 code is
+// returned, the panic itself is not sent to the caller.
+func callLocal(c *Conn, fn callee.Thunk, cp *message.CallPayload) (v interface{}, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			c.panicked(e)
+			v, err = nil, &callee.Error{Code: 500, Message: errRecoveredPanic.Error()}
+		}
+	}()
+	return fn(cp)
+}
+
+// write writes m to the connection, or adds it to the connection's
+// send queue if the server has a SendQueueSize.
+func write(c *Conn, m message.Msg, addFn func(string, int64)) {
+	if c.sendq != nil {
+		c.enqueue(m, addFn)
+		return
+	}
+	doWrite(c, m, addFn)
+}
+
+// doWrite writes v, a message or a batch of JSON-encoded messages, to
+// the connection, and closes the connection if it fails.
+func doWrite(c *Conn, v interface{}, addFn func(string, int64)) {
+	if err := writeMsg(c, v); err != nil {
 		switch err {
 		case wswriter.ErrWriteLockTimeout:
 			addFn("WriteLockTimeouts", 1)
@@ -145,13 +401,29 @@ func doWrite(c *Conn, m message.Msg, addFn func(string, int64)) {
 	}
 }
 
-func writeMsg(c *Conn, m message.Msg) error {
-	w := c.Writer(c.srv.AcquireWriteLockTimeout)
-	defer w.Close()
+func writeMsg(c *Conn, v interface{}) (err error) {
+	settings := c.srv.Settings()
+	w := c.Writer(settings.AcquireWriteLockTimeout)
+	defer func() {
+		// with permessage-deflate, the compressed frames may only be
+		// flushed by Close, so its error must be reported too.
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}()
 
 	lw := io.Writer(w)
-	if l := c.srv.WriteLimit; l > 0 {
+	if l := settings.WriteLimit; l > 0 {
 		lw = wswriter.Limit(w, l)
 	}
-	return json.NewEncoder(lw).Encode(m)
+	codec := c.Codec()
+	if codec == message.JSONCodec {
+		return json.NewEncoder(lw).Encode(v)
+	}
+	b, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = lw.Write(b)
+	return err
 }
@@ -0,0 +1,96 @@
+package juggler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mna/juggler/broker"
+)
+
+// ReadyStatus is the JSON response body written by ReadyHandler.
+type ReadyStatus struct {
+	// Status is "ok" if the server is ready to accept connections,
+	// "unavailable" otherwise.
+	Status string `json:"status"`
+
+	// Draining is true if the server is in draining mode.
+	Draining bool `json:"draining"`
+
+	// Degraded is true if the server is in degraded mode (see
+	// Server.DegradedMode). It does not affect the readiness, as the
+	// server keeps serving its connections.
+	Degraded bool `json:"degraded,omitempty"`
+
+	// Conns is the number of active connections, and MaxConns the
+	// maximum number of connections (0 if there is no limit).
+	Conns    int `json:"conns"`
+	MaxConns int `json:"max_conns"`
+
+	// Brokers reports the reachability of the server's brokers that
+	// implement broker.Pinger, by role ("pubsub", "caller", "rooms",
+	// "presence"). The value is "ok" or the error returned by Ping.
+	Brokers map[string]string `json:"brokers,omitempty"`
+}
+
+// HealthHandler is a liveness probe handler. It always responds with
+// a 200 status code and a {"status":"ok"} JSON body, as long as the
+// process is able to serve HTTP requests.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadyHandler returns a readiness probe handler for srv. It responds
+// with a JSON-encoded ReadyStatus. The status code is 200 if srv is
+// ready to accept connections, and 503 if it is draining, if it has
+// reached its MaxConns limit or if any of its brokers that implement
+// broker.Pinger is unreachable.
+func ReadyHandler(srv *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := ReadyStatus{
+			Draining: srv.Draining(),
+			Degraded: srv.Degraded(),
+			Conns:    srv.NumConns(),
+			MaxConns: srv.MaxConns,
+		}
+		ready := srv.accepting()
+
+		brokers := []struct {
+			role string
+			b    interface{}
+		}{
+			{"pubsub", srv.PubSubBroker},
+			{"caller", srv.CallerBroker},
+			{"rooms", srv.RoomsBroker},
+			{"presence", srv.PresenceBroker},
+		}
+		for _, b := range brokers {
+			p, ok := b.b.(broker.Pinger)
+			if !ok {
+				continue
+			}
+			if st.Brokers == nil {
+				st.Brokers = make(map[string]string)
+			}
+			if err := p.Ping(); err != nil {
+				st.Brokers[b.role] = err.Error()
+				ready = false
+				continue
+			}
+			st.Brokers[b.role] = "ok"
+		}
+
+		code := http.StatusOK
+		st.Status = "ok"
+		if !ready {
+			code = http.StatusServiceUnavailable
+			st.Status = "unavailable"
+		}
+		writeJSON(w, code, st)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
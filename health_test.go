@@ -0,0 +1,133 @@
+package juggler
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/client"
+	"github.com/mna/juggler/jugglertest"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakePingBroker struct {
+	fakePubSubBroker
+	err error
+}
+
+func (f *fakePingBroker) Ping() error { return f.err }
+
+func getReady(t *testing.T, srv *Server) (int, ReadyStatus) {
+	w := httptest.NewRecorder()
+	ReadyHandler(srv).ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+
+	var st ReadyStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &st), "Unmarshal")
+	return w.Code, st
+}
+
+func TestHealthHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	HealthHandler(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "status code")
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"), "content type")
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String(), "body")
+}
+
+func TestReadyHandler(t *testing.T) {
+	brk := &fakePingBroker{}
+	srv := &Server{PubSubBroker: brk, CallerBroker: &fakeCallerBroker{}, MaxConns: 1}
+
+	code, st := getReady(t, srv)
+	assert.Equal(t, http.StatusOK, code, "ready")
+	assert.Equal(t, ReadyStatus{Status: "ok", MaxConns: 1, Brokers: map[string]string{"pubsub": "ok"}}, st, "ready status")
+
+	brk.err = errors.New("unreachable")
+	code, st = getReady(t, srv)
+	assert.Equal(t, http.StatusServiceUnavailable, code, "broker down")
+	assert.Equal(t, "unavailable", st.Status, "broker down status")
+	assert.Equal(t, "unreachable", st.Brokers["pubsub"], "broker down error")
+	brk.err = nil
+
+	// reach the MaxConns limit
+	_, _, done := dialAllowed(t, srv, "pub, sub")
+	defer done()
+	deadline := time.Now().Add(time.Second)
+	for srv.NumConns() < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	code, st = getReady(t, srv)
+	assert.Equal(t, http.StatusServiceUnavailable, code, "max conns")
+	assert.Equal(t, 1, st.Conns, "max conns count")
+
+	// further connections are refused
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	l := jugglertest.StartPipeServer(Upgrade(upg, srv))
+	defer l.Close()
+	_, err := client.Dial(l.Dialer(Subprotocols...), jugglertest.PipeURL, nil)
+	assert.Error(t, err, "Dial over MaxConns")
+
+	srv.MaxConns = 0
+	srv.Drain()
+	code, st = getReady(t, srv)
+	assert.Equal(t, http.StatusServiceUnavailable, code, "draining")
+	assert.True(t, st.Draining, "draining flag")
+	_, err = client.Dial(l.Dialer(Subprotocols...), jugglertest.PipeURL, nil)
+	assert.Error(t, err, "Dial while draining")
+}
+
+func TestAcceptQueue(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	srv := &Server{
+		PubSubBroker:       &fakePubSubBroker{},
+		CallerBroker:       &fakeCallerBroker{},
+		MaxConns:           1,
+		AcceptQueueSize:    1,
+		AcceptQueueTimeout: time.Second,
+		Vars:               vars,
+	}
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	l := jugglertest.StartPipeServer(Upgrade(upg, srv))
+	defer l.Close()
+
+	cli1, err := client.Dial(l.Dialer(Subprotocols...), jugglertest.PipeURL, nil)
+	require.NoError(t, err, "Dial 1")
+
+	// the second handshake waits in the queue until the first
+	// connection is closed
+	res := make(chan error, 1)
+	var cli2 *client.Client
+	go func() {
+		var err error
+		cli2, err = client.Dial(l.Dialer(Subprotocols...), jugglertest.PipeURL, nil)
+		res <- err
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&srv.queued) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the queue is full, the third handshake is refused
+	_, err = client.Dial(l.Dialer(Subprotocols...), jugglertest.PipeURL, nil)
+	assert.Error(t, err, "Dial with full queue")
+
+	require.NoError(t, cli1.Close(), "Close 1")
+	select {
+	case err := <-res:
+		require.NoError(t, err, "Dial 2")
+		defer cli2.Close()
+	case <-time.After(time.Second):
+		require.FailNow(t, "queued handshake not accepted")
+	}
+
+	assert.Equal(t, "1", vars.Get("QueuedConns").String(), "queued conns")
+	assert.Equal(t, "1", vars.Get("RejectedConns").String(), "rejected conns")
+}
@@ -0,0 +1,221 @@
+// Package httpbridge implements an HTTP gateway to make juggler RPC
+// calls without a websocket connection, e.g. from cron jobs or
+// webhooks. A POST request to /call/{uri} calls uri with the request
+// body as JSON-encoded arguments, waits for the result and returns it
+// as the response.
+//
+// The Handler does not authenticate nor authorize the requests, it
+// should be wrapped in an http.Handler that does so if it is exposed
+// to untrusted clients.
+package httpbridge
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/callee"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+)
+
+const (
+	// DefaultPrefix is the default path prefix of the call requests.
+	DefaultPrefix = "/call/"
+
+	// DefaultMaxBodySize is the default maximum size of the body of a
+	// call request, in bytes.
+	DefaultMaxBodySize = 1 << 20
+)
+
+// Handler is an http.Handler that translates POST requests to
+// {Prefix}{uri} into calls to uri via its Broker. The body of the
+// request is the JSON-encoded arguments of the call, and may be empty.
+// The call timeout can be set with the "timeout" query string
+// parameter, as a duration (e.g. "?timeout=5s"), and it is
+// broker.DefaultCallTimeout otherwise.
+//
+// The response is the JSON-encoded result of the call, with status
+// code 200. If the callee returned an error, the response is the
+// error result (see message.ErrResult) with status code 502, and if
+// the result is not received before the timeout, the status code is
+// 504.
+//
+// The results are received using a single results connection,
+// created on the first request. The Handler should be closed when it
+// is no longer needed.
+type Handler struct {
+	// Broker is the caller broker used to make the calls and to receive
+	// their results. It must be set.
+	Broker broker.CallerBroker
+
+	// Prefix is the path prefix of the call requests, the rest of the
+	// path being the URI to call. If it is empty, DefaultPrefix is used.
+	Prefix string
+
+	// MaxBodySize is the maximum size of the body of a request, in
+	// bytes. If it is 0, DefaultMaxBodySize is used.
+	MaxBodySize int64
+
+	// MaxTimeout is the maximum timeout of a call. If it is > 0, the
+	// timeout of the requests is capped to this value.
+	MaxTimeout time.Duration
+
+	// Vars can be set to a metrics.Sink (e.g. an *expvar.Map) to
+	// collect metrics about the calls.
+	Vars metrics.Sink
+
+	mu     sync.Mutex
+	caller *callee.Caller
+}
+
+// ServeHTTP implements http.Handler for the Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := h.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	uri := strings.TrimPrefix(r.URL.Path, prefix)
+	if uri == "" || uri == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout := broker.DefaultCallTimeout
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+	if h.MaxTimeout > 0 && timeout > h.MaxTimeout {
+		timeout = h.MaxTimeout
+	}
+
+	args, status, err := h.readArgs(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	vars := metrics.Or(h.Vars)
+	vars.Add("HTTPCalls", 1)
+
+	res, err := h.call(uri, args, timeout)
+	switch err := err.(type) {
+	case nil:
+		writeJSON(w, http.StatusOK, res)
+
+	case *callee.Error:
+		vars.Add("FailedHTTPCalls", 1)
+		var er message.ErrResult
+		er.Error.Message = err.Message
+		er.Error.Code = err.Code
+		if d, ok := err.Details.(json.RawMessage); ok {
+			er.Error.Details = d
+		}
+		b, _ := json.Marshal(er)
+		writeJSON(w, http.StatusBadGateway, b)
+
+	default:
+		if err == callee.ErrCallExpired {
+			vars.Add("ExpiredHTTPCalls", 1)
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+			return
+		}
+		vars.Add("FailedHTTPCalls", 1)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+}
+
+// Close closes the results connection of the Handler. The pending
+// requests fail with status code 503.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.caller == nil {
+		return nil
+	}
+	err := h.caller.Close()
+	h.caller = nil
+	return err
+}
+
+// readArgs reads the JSON-encoded arguments from the body of r. It
+// returns the status code to use if it fails.
+func (h *Handler) readArgs(r *http.Request) (json.RawMessage, int, error) {
+	max := h.MaxBodySize
+	if max <= 0 {
+		max = DefaultMaxBodySize
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if int64(len(b)) > max {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("request body too large")
+	}
+	if len(b) == 0 {
+		return json.RawMessage("null"), 0, nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, http.StatusBadRequest, errors.New("invalid JSON arguments")
+	}
+	return json.RawMessage(b), 0, nil
+}
+
+// call calls uri with args and waits for its result. If the results
+// connection failed, it is replaced for the subsequent calls.
+func (h *Handler) call(uri string, args json.RawMessage, timeout time.Duration) (json.RawMessage, error) {
+	c, err := h.getCaller()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.CallTimeout(uri, args, timeout)
+	if err == callee.ErrCallerClosed {
+		h.mu.Lock()
+		if h.caller == c {
+			h.caller = nil
+		}
+		h.mu.Unlock()
+	}
+	return res, err
+}
+
+func (h *Handler) getCaller() (*callee.Caller, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.caller == nil {
+		c, err := callee.NewCaller(h.Broker)
+		if err != nil {
+			return nil, err
+		}
+		h.caller = c
+	}
+	return h.caller, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, b []byte) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
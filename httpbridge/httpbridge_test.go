@@ -0,0 +1,95 @@
+package httpbridge
+
+import (
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker/inmembroker"
+	"github.com/mna/juggler/callee"
+	"github.com/mna/juggler/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	brk := &inmembroker.Broker{}
+	cc, err := brk.NewCallsConn("echo", "fail")
+	require.NoError(t, err, "NewCallsConn")
+	defer cc.Close()
+	go func() {
+		cle := &callee.Callee{Broker: brk}
+		for cp := range cc.Calls() {
+			cle.InvokeAndStoreResult(cp, func(cp *message.CallPayload) (interface{}, error) {
+				if cp.URI == "fail" {
+					return nil, &callee.Error{Code: 42, Message: "failed"}
+				}
+				return cp.Args, nil
+			})
+		}
+	}()
+
+	vars := new(expvar.Map).Init()
+	h := &Handler{Broker: brk, MaxBodySize: 20, Vars: vars}
+	defer h.Close()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{"POST", "/call/echo", `{"a":1}`, 200, `{"a":1}`},
+		{"POST", "/call/echo", ``, 200, `null`},
+		{"POST", "/call/fail", `1`, 502, `{"error":{"message":"failed","code":42}}`},
+		{"POST", "/call/none?timeout=10ms", `1`, 504, "juggler/callee: call expired\n"},
+		{"POST", "/call/echo?timeout=x", `1`, 400, "invalid timeout\n"},
+		{"POST", "/call/echo", `{"a":`, 400, "invalid JSON arguments\n"},
+		{"POST", "/call/echo", `"a very long argument"`, 413, "request body too large\n"},
+		{"GET", "/call/echo", ``, 405, "Method Not Allowed\n"},
+		{"POST", "/call/", `1`, 404, "404 page not found\n"},
+		{"POST", "/other/echo", `1`, 404, "404 page not found\n"},
+	}
+	for i, c := range cases {
+		req, err := http.NewRequest(c.method, srv.URL+c.path, strings.NewReader(c.body))
+		require.NoError(t, err, "%d: NewRequest", i)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err, "%d: Do", i)
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(t, err, "%d: ReadAll", i)
+
+		assert.Equal(t, c.status, res.StatusCode, "%d: status", i)
+		assert.Equal(t, c.want, string(b), "%d: body", i)
+	}
+
+	assert.Equal(t, "4", vars.Get("HTTPCalls").String(), "HTTPCalls")
+	assert.Equal(t, "1", vars.Get("FailedHTTPCalls").String(), "FailedHTTPCalls")
+	assert.Equal(t, "1", vars.Get("ExpiredHTTPCalls").String(), "ExpiredHTTPCalls")
+}
+
+type failingCallerBroker struct {
+	*inmembroker.Broker
+}
+
+func (b failingCallerBroker) Call(cp *message.CallPayload, timeout time.Duration) error {
+	return errors.New("broker down")
+}
+
+func TestHandlerBrokerError(t *testing.T) {
+	h := &Handler{Broker: failingCallerBroker{&inmembroker.Broker{}}}
+	defer h.Close()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/call/a", strings.NewReader("1")))
+	assert.Equal(t, 503, w.Code, "status")
+	assert.Equal(t, "broker down\n", w.Body.String(), "body")
+}
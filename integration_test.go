@@ -22,7 +22,7 @@ import (
 	"github.com/mna/juggler/broker/redisbroker"
 	"github.com/mna/juggler/callee"
 	"github.com/mna/juggler/client"
-	"github.com/mna/juggler/internal/jugglertest"
+	"github.com/mna/juggler/jugglertest"
 	"github.com/mna/juggler/message"
 	"github.com/mna/redisc/redistest"
 	"github.com/gorilla/websocket"
@@ -205,7 +205,7 @@ func serverHandler(t *testing.T, brk broker.PubSubBroker, rc *runConfig, stats *
 		once.Do(func() {
 			go func() {
 				for _, m := range rc.serverPubs {
-					err := brk.Publish(m.Payload.Channel, &message.PubPayload{
+					_, err := brk.Publish(m.Payload.Channel, &message.PubPayload{
 						MsgUUID: uuid.NewRandom(),
 						Args:    m.Payload.Args,
 					})
@@ -0,0 +1,274 @@
+// Package localcluster starts local redis-server processes configured
+// in cluster mode and forms a usable cluster with them. It is used by
+// the redis-cluster command to spin up a local cluster for development,
+// and by tests that need a cluster.
+package localcluster
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// DefaultTemplate is the default template of the configuration file of
+// each node. The template receives a NodeConfig value.
+const DefaultTemplate = `port {{.Port}}
+dir {{.Dir}}
+cluster-enabled yes
+cluster-config-file nodes.{{.Port}}.conf
+cluster-node-timeout 5000
+appendonly no
+save ""
+`
+
+// DefaultStartTimeout is the default time to wait for a node to accept
+// connections, and for the cluster to be ready.
+const DefaultStartTimeout = 10 * time.Second
+
+// numSlots is the number of hash slots in a redis cluster.
+const numSlots = 16384
+
+// NodeConfig is the data passed to the configuration template of a
+// node.
+type NodeConfig struct {
+	Port int
+	Dir  string
+}
+
+// Config is the configuration of a local cluster.
+type Config struct {
+	// Nodes is the number of nodes to start. The default of 0 starts
+	// 3 nodes, the minimum for a redis cluster.
+	Nodes int
+
+	// BasePort is the port of the first node, the other nodes use
+	// the following ports. The default of 0 uses 7000.
+	BasePort int
+
+	// Template is the text/template of the configuration file of each
+	// node. The default uses DefaultTemplate.
+	Template string
+
+	// RedisServer is the path of the redis-server binary. The default
+	// looks for redis-server in the PATH.
+	RedisServer string
+
+	// Dir is the working directory of the nodes, where the configuration
+	// and data files are stored. The default creates a temporary
+	// directory that is removed when the cluster is closed.
+	Dir string
+
+	// StartTimeout is the time to wait for each node to accept
+	// connections, and for the cluster state to be ok once the nodes
+	// are started. The default of 0 uses DefaultStartTimeout.
+	StartTimeout time.Duration
+
+	// Disjoint starts the nodes without forming the cluster, so that
+	// slots can be assigned manually. By default, the slots are split
+	// evenly between the nodes, the nodes are introduced to each other
+	// and Start waits for the cluster state to be ok.
+	Disjoint bool
+
+	// Stdout and Stderr receive the output of the redis-server
+	// processes. The default discards the output.
+	Stdout, Stderr io.Writer
+}
+
+// Cluster is a set of running redis-server processes.
+type Cluster struct {
+	// Ports is the port of each node, as a string.
+	Ports []string
+
+	cmds  []*exec.Cmd
+	dir   string
+	rmDir bool
+}
+
+// Start starts the nodes of a local cluster as configured by conf.
+// It returns once all nodes accept connections. The cluster should
+// be closed by the caller to stop the nodes.
+func Start(conf Config) (*Cluster, error) {
+	if conf.Nodes <= 0 {
+		conf.Nodes = 3
+	}
+	if conf.BasePort <= 0 {
+		conf.BasePort = 7000
+	}
+	if conf.Template == "" {
+		conf.Template = DefaultTemplate
+	}
+	if conf.RedisServer == "" {
+		conf.RedisServer = "redis-server"
+	}
+	if conf.StartTimeout <= 0 {
+		conf.StartTimeout = DefaultStartTimeout
+	}
+
+	tpl, err := template.New("config").Parse(conf.Template)
+	if err != nil {
+		return nil, err
+	}
+	bin, err := exec.LookPath(conf.RedisServer)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{dir: conf.Dir}
+	if c.dir == "" {
+		dir, err := ioutil.TempDir("", "juggler-cluster-")
+		if err != nil {
+			return nil, err
+		}
+		c.dir, c.rmDir = dir, true
+	}
+
+	for i := 0; i < conf.Nodes; i++ {
+		port := conf.BasePort + i
+		if err := c.startNode(bin, tpl, port, conf); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.Ports = append(c.Ports, strconv.Itoa(port))
+	}
+
+	if !conf.Disjoint {
+		if err := c.form(conf.StartTimeout); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// form assigns the slots to the nodes, introduces the nodes to each
+// other and waits for the cluster state to be ok.
+func (c *Cluster) form(timeout time.Duration) error {
+	conns := make([]redis.Conn, len(c.Ports))
+	for i, p := range c.Ports {
+		conn, err := redis.Dial("tcp", ":"+p)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	// split the slots evenly, the last node gets the remaining slots
+	per := numSlots / len(conns)
+	for i, conn := range conns {
+		start, end := i*per, (i+1)*per
+		if i == len(conns)-1 {
+			end = numSlots
+		}
+		args := make(redis.Args, 0, end-start+1)
+		args = append(args, "ADDSLOTS")
+		for s := start; s < end; s++ {
+			args = append(args, s)
+		}
+		if _, err := conn.Do("CLUSTER", args...); err != nil {
+			return fmt.Errorf("ADDSLOTS failed on node %s: %v", c.Ports[i], err)
+		}
+	}
+
+	for _, p := range c.Ports[1:] {
+		if _, err := conns[0].Do("CLUSTER", "MEET", "127.0.0.1", p); err != nil {
+			return fmt.Errorf("MEET failed for node %s: %v", p, err)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for i, conn := range conns {
+		for {
+			info, err := redis.String(conn.Do("CLUSTER", "INFO"))
+			if err == nil && strings.Contains(info, "cluster_state:ok") {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("cluster state not ok on node %s", c.Ports[i])
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) startNode(bin string, tpl *template.Template, port int, conf Config) error {
+	path := filepath.Join(c.dir, fmt.Sprintf("redis.%d.conf", port))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = tpl.Execute(f, NodeConfig{Port: port, Dir: c.dir})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(bin, path)
+	cmd.Dir = c.dir
+	cmd.Stdout, cmd.Stderr = conf.Stdout, conf.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	c.cmds = append(c.cmds, cmd)
+
+	return waitForNode(":"+strconv.Itoa(port), conf.StartTimeout)
+}
+
+// waitForNode waits until the node at addr responds to PING.
+func waitForNode(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := redis.Dial("tcp", addr)
+		if err == nil {
+			_, err = conn.Do("PING")
+			conn.Close()
+			if err == nil {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("node %s failed to start: %v", addr, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Close stops the nodes and removes the working directory if it was
+// created by Start. It returns the first error encountered.
+func (c *Cluster) Close() error {
+	var errs []error
+	for _, cmd := range c.cmds {
+		if err := cmd.Process.Kill(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// Wait returns an error because the process was killed
+		cmd.Wait()
+	}
+	c.cmds = nil
+
+	if c.rmDir {
+		if err := os.RemoveAll(c.dir); err != nil {
+			errs = append(errs, err)
+		}
+		c.rmDir = false
+	}
+
+	if len(errs) > 0 {
+		return errors.New("localcluster: " + errs[0].Error())
+	}
+	return nil
+}
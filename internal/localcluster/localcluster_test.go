@@ -0,0 +1,37 @@
+package localcluster
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStart(t *testing.T) {
+	if _, err := exec.LookPath("redis-server"); err != nil {
+		t.Skip("redis-server not found")
+	}
+
+	c, err := Start(Config{Nodes: 3, BasePort: 17000})
+	require.NoError(t, err, "Start")
+	assert.Equal(t, []string{"17000", "17001", "17002"}, c.Ports, "ports")
+
+	for _, p := range c.Ports {
+		conn, err := redis.Dial("tcp", ":"+p)
+		require.NoError(t, err, "Dial %s", p)
+		info, err := redis.String(conn.Do("CLUSTER", "INFO"))
+		conn.Close()
+		if assert.NoError(t, err, "CLUSTER INFO %s", p) {
+			assert.Contains(t, info, "cluster_state:ok", "cluster state %s", p)
+			assert.Contains(t, info, "cluster_known_nodes:3", "known nodes %s", p)
+		}
+	}
+
+	dir := c.dir
+	require.NoError(t, c.Close(), "Close")
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err), "working directory removed")
+}
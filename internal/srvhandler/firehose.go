@@ -0,0 +1,213 @@
+package srvhandler
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+)
+
+// FirehoseEntry is the entry streamed by the Firehose for each sampled
+// message. It is encoded as JSON, one entry per line.
+type FirehoseEntry struct {
+	Time      time.Time       `json:"time"`
+	ConnUUID  uuid.UUID       `json:"conn_uuid"`
+	Type      string          `json:"type"`
+	MsgUUID   uuid.UUID       `json:"msg_uuid"`
+	Msg       json.RawMessage `json:"msg,omitempty"`
+	Truncated string          `json:"truncated,omitempty"` // set instead of Msg if the message was truncated
+}
+
+// Firehose is an opt-in debug tap that streams a sampled copy of every
+// message it handles to its HTTP watchers. It implements juggler.Handler
+// so that it can be added to a Chain, and http.Handler so that it can be
+// registered on an admin-only path (e.g. alongside the expvar and pprof
+// debug endpoints).
+//
+// The Firehose never blocks the processing of messages: if a watcher
+// doesn't read the stream fast enough, entries are dropped for that
+// watcher.
+type Firehose struct {
+	// SampleRate is the fraction of messages copied to the stream,
+	// between 0 and 1. The default of 0 means that all messages are
+	// copied.
+	SampleRate float64
+
+	// MaxPayload is the maximum size, in bytes, of the JSON-encoded
+	// message in an entry. Longer messages are truncated and sent as
+	// a string in the Truncated field of the entry. The default of
+	// 0 means no limit.
+	MaxPayload int
+
+	// Redact is an optional function called with the message before
+	// it is encoded in the stream. It can return a different message
+	// with sensitive fields removed. It must not modify m.
+	Redact func(m message.Msg) message.Msg
+
+	// BufferSize is the number of entries buffered for each watcher
+	// before entries get dropped. The default of 0 uses a buffer of 100.
+	BufferSize int
+
+	// Vars can be set to a metrics.Sink (e.g. an *expvar.Map) to
+	// collect metrics about the firehose.
+	Vars metrics.Sink
+
+	mu       sync.Mutex
+	watchers map[chan *FirehoseEntry]struct{}
+}
+
+// RedactArgs is a Redact function for the Firehose that removes the
+// arguments of the CALL, CHUNK, PUB, RES, RCHK and EVNT messages, as
+// they may hold sensitive data. The other messages are returned as-is.
+func RedactArgs(m message.Msg) message.Msg {
+	switch m := m.(type) {
+	case *message.Call:
+		cp := *m
+		cp.Payload.Args = nil
+		return &cp
+	case *message.Chunk:
+		cp := *m
+		cp.Payload.Data = ""
+		return &cp
+	case *message.Pub:
+		cp := *m
+		cp.Payload.Args = nil
+		return &cp
+	case *message.Res:
+		cp := *m
+		cp.Payload.Args = nil
+		return &cp
+	case *message.ResChunk:
+		cp := *m
+		cp.Payload.Args = nil
+		return &cp
+	case *message.Evnt:
+		cp := *m
+		cp.Payload.Args = nil
+		return &cp
+	}
+	return m
+}
+
+// Handle implements juggler.Handler for the Firehose. It copies the
+// message to the stream of each watcher, if it is sampled. It does
+// not call ProcessMsg, so it should be used in a Chain.
+func (f *Firehose) Handle(ctx context.Context, c *juggler.Conn, m message.Msg) {
+	f.mu.Lock()
+	n := len(f.watchers)
+	f.mu.Unlock()
+	if n == 0 {
+		return
+	}
+
+	if r := f.SampleRate; r > 0 && r < 1 && rand.Float64() >= r {
+		return
+	}
+
+	e := f.newEntry(c, m)
+
+	f.mu.Lock()
+	for ch := range f.watchers {
+		select {
+		case ch <- e:
+		default:
+			f.vars().Add("FirehoseDropped", 1)
+		}
+	}
+	f.mu.Unlock()
+}
+
+func (f *Firehose) newEntry(c *juggler.Conn, m message.Msg) *FirehoseEntry {
+	e := &FirehoseEntry{
+		Time:     time.Now().UTC(),
+		ConnUUID: c.UUID,
+		Type:     m.Type().String(),
+		MsgUUID:  m.UUID(),
+	}
+
+	if f.Redact != nil {
+		m = f.Redact(m)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		e.Truncated = "<failed to marshal message: " + err.Error() + ">"
+		return e
+	}
+	if l := f.MaxPayload; l > 0 && len(b) > l {
+		e.Truncated = string(b[:l])
+		return e
+	}
+	e.Msg = b
+	return e
+}
+
+// ServeHTTP implements http.Handler for the Firehose. It streams the
+// sampled messages as newline-delimited JSON entries until the client
+// disconnects.
+func (f *Firehose) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+
+	n := f.BufferSize
+	if n <= 0 {
+		n = 100
+	}
+	ch := make(chan *FirehoseEntry, n)
+	f.addWatcher(ch)
+	defer f.removeWatcher(ch)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	fl.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-closed:
+			return
+		case e := <-ch:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			fl.Flush()
+		}
+	}
+}
+
+func (f *Firehose) addWatcher(ch chan *FirehoseEntry) {
+	f.mu.Lock()
+	if f.watchers == nil {
+		f.watchers = make(map[chan *FirehoseEntry]struct{})
+	}
+	f.watchers[ch] = struct{}{}
+	f.mu.Unlock()
+
+	f.vars().Add("FirehoseWatchers", 1)
+}
+
+func (f *Firehose) removeWatcher(ch chan *FirehoseEntry) {
+	f.mu.Lock()
+	delete(f.watchers, ch)
+	f.mu.Unlock()
+
+	f.vars().Add("FirehoseWatchers", -1)
+}
+
+// vars returns the metrics sink of the firehose, never nil.
+func (f *Firehose) vars() metrics.Sink {
+	return metrics.Or(f.Vars)
+}
@@ -0,0 +1,71 @@
+package srvhandler
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mna/juggler"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestFirehose(t *testing.T) {
+	fh := &Firehose{MaxPayload: 150}
+	srv := httptest.NewServer(fh)
+	defer srv.Close()
+
+	// no watcher, does nothing
+	fh.Handle(context.Background(), &juggler.Conn{}, message.NewSub("a", false))
+
+	res, err := http.Get(srv.URL)
+	require.NoError(t, err, "Get")
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode, "status")
+
+	conn := &juggler.Conn{UUID: uuid.NewRandom()}
+	sub := message.NewSub("a", false)
+	fh.Handle(context.Background(), conn, sub)
+	long, err := message.NewPub("b", "a very long payload that will exceed the max payload limit")
+	require.NoError(t, err, "NewPub")
+	fh.Handle(context.Background(), conn, long)
+
+	sc := bufio.NewScanner(res.Body)
+
+	var e FirehoseEntry
+	require.True(t, sc.Scan(), "Scan 1")
+	require.NoError(t, json.Unmarshal(sc.Bytes(), &e), "Unmarshal 1")
+	assert.Equal(t, conn.UUID, e.ConnUUID, "conn UUID 1")
+	assert.Equal(t, "SUB", e.Type, "type 1")
+	assert.Equal(t, sub.UUID(), e.MsgUUID, "msg UUID 1")
+	assert.NotEmpty(t, e.Msg, "msg 1")
+	assert.Empty(t, e.Truncated, "truncated 1")
+
+	e = FirehoseEntry{}
+	require.True(t, sc.Scan(), "Scan 2")
+	require.NoError(t, json.Unmarshal(sc.Bytes(), &e), "Unmarshal 2")
+	assert.Equal(t, "PUB", e.Type, "type 2")
+	assert.Empty(t, e.Msg, "msg 2")
+	assert.Equal(t, 150, len(e.Truncated), "truncated 2")
+}
+
+func TestRedactArgs(t *testing.T) {
+	call, err := message.NewCall("a", "secret", 0)
+	require.NoError(t, err, "NewCall")
+	pub, err := message.NewPub("b", "secret")
+	require.NoError(t, err, "NewPub")
+	sub := message.NewSub("c", false)
+
+	for _, m := range []message.Msg{call, pub, sub} {
+		b, err := json.Marshal(RedactArgs(m))
+		require.NoError(t, err, "Marshal %s", m.Type())
+		assert.NotContains(t, string(b), "secret", "%s", m.Type())
+	}
+	assert.Equal(t, json.RawMessage(`"secret"`), call.Payload.Args, "original not modified")
+	assert.Equal(t, sub, RedactArgs(sub), "other message as-is")
+}
@@ -0,0 +1,114 @@
+package srvhandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+)
+
+// RecordEntry is an entry written by the Recorder for each recorded
+// message. It is encoded as JSON, one entry per line.
+type RecordEntry struct {
+	Time     time.Time       `json:"time"`
+	ConnUUID uuid.UUID       `json:"conn_uuid"`
+	Msg      json.RawMessage `json:"msg"`
+}
+
+// Message unmarshals the recorded message into its concrete type.
+func (e *RecordEntry) Message() (message.Msg, error) {
+	return message.Unmarshal(bytes.NewReader(e.Msg))
+}
+
+// Recorder is a juggler.Handler that serializes the standard messages
+// of selected connections to a writer, with a timestamp. The resulting
+// stream can be read back with ReadRecords, e.g. to replay it against
+// a server or a client (see the juggler-replay command).
+type Recorder struct {
+	// W is the writer where the entries are recorded. It must be set.
+	W io.Writer
+
+	// Filter is an optional function that selects the connections to
+	// record. If nil, all connections are recorded.
+	Filter func(*juggler.Conn) bool
+
+	// mu protects writes to W and the err field.
+	mu  sync.Mutex
+	err error
+}
+
+// Handle implements juggler.Handler for the Recorder. It records the
+// message if the connection is selected. It does not call ProcessMsg,
+// so it should be used in a Chain.
+func (r *Recorder) Handle(ctx context.Context, c *juggler.Conn, m message.Msg) {
+	if !m.Type().IsStd() {
+		return
+	}
+	if r.Filter != nil && !r.Filter(c) {
+		return
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		r.setErr(err)
+		return
+	}
+	e := &RecordEntry{
+		Time:     time.Now().UTC(),
+		ConnUUID: c.UUID,
+		Msg:      b,
+	}
+	if b, err = json.Marshal(e); err != nil {
+		r.setErr(err)
+		return
+	}
+	b = append(b, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		_, r.err = r.W.Write(b)
+	}
+}
+
+func (r *Recorder) setErr(err error) {
+	r.mu.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.mu.Unlock()
+}
+
+// Err returns the first error that occurred while recording, if any.
+// Once an error occurred, no more messages are recorded.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	err := r.err
+	r.mu.Unlock()
+	return err
+}
+
+// ReadRecords reads the entries written by a Recorder from rd and
+// calls fn for each entry, in order. It stops and returns the error
+// if fn returns an error.
+func ReadRecords(rd io.Reader, fn func(*RecordEntry) error) error {
+	dec := json.NewDecoder(rd)
+	for {
+		var e RecordEntry
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package srvhandler
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mna/juggler"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestRecorder(t *testing.T) {
+	var buf bytes.Buffer
+
+	c1 := &juggler.Conn{UUID: uuid.NewRandom()}
+	c2 := &juggler.Conn{UUID: uuid.NewRandom()}
+	rec := &Recorder{
+		W:      &buf,
+		Filter: func(c *juggler.Conn) bool { return uuid.Equal(c.UUID, c1.UUID) },
+	}
+
+	call, err := message.NewCall("a", "b", 0)
+	require.NoError(t, err, "NewCall")
+	msgs := []message.Msg{call, message.NewAck(call), message.NewSub("c", true)}
+	for _, m := range msgs {
+		rec.Handle(context.Background(), c1, m)
+		rec.Handle(context.Background(), c2, m)
+	}
+	require.NoError(t, rec.Err(), "Err")
+
+	var got []message.Msg
+	err = ReadRecords(&buf, func(e *RecordEntry) error {
+		assert.Equal(t, c1.UUID, e.ConnUUID, "conn UUID")
+		assert.False(t, e.Time.IsZero(), "time is set")
+		m, err := e.Message()
+		if err != nil {
+			return err
+		}
+		got = append(got, m)
+		return nil
+	})
+	require.NoError(t, err, "ReadRecords")
+	assert.Equal(t, msgs, got, "recorded messages")
+}
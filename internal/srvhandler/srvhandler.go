@@ -3,9 +3,6 @@
 package srvhandler
 
 import (
-	"expvar"
-	"fmt"
-
 	"github.com/mna/juggler"
 	"github.com/mna/juggler/message"
 	"golang.org/x/net/context"
@@ -21,32 +18,6 @@ func Chain(hs ...juggler.Handler) juggler.Handler {
 	})
 }
 
-// PanicRecover returns a juggler.Handler that recovers from panics that
-// may happen in h. The connection is closed on a panic. If a non-nil
-// vars is passed as parameter, the RecoveredPanics counter is incremented
-// for each panic.
-func PanicRecover(h juggler.Handler, vars *expvar.Map) juggler.Handler {
-	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
-		defer func() {
-			if e := recover(); e != nil {
-				if vars != nil {
-					vars.Add("RecoveredPanics", 1)
-				}
-
-				var err error
-				switch e := e.(type) {
-				case error:
-					err = e
-				default:
-					err = fmt.Errorf("%v", e)
-				}
-				c.Close(err)
-			}
-		}()
-		h.Handle(ctx, c, m)
-	})
-}
-
 // LogConn returns a function compatible with the Server.ConnState field
 // type that logs connections and disconnections to the provided logger
 // function. It is not a juggler.Handler.
@@ -62,13 +33,14 @@ func LogConn(logFn func(string, ...interface{})) func(*juggler.Conn, juggler.Con
 }
 
 // LogMsg returns a juggler.Handler that logs messages received or sent on
-// the connection to the provided logger function.
+// the connection to the provided logger function. The correlation ID
+// of the message is logged in brackets.
 func LogMsg(logFn func(string, ...interface{})) juggler.Handler {
 	return juggler.HandlerFunc(func(ctx context.Context, c *juggler.Conn, m message.Msg) {
 		if m.Type().IsRead() {
-			logFn("%v: received message %v %s", c.UUID, m.UUID(), m.Type())
+			logFn("%v: received message %v %s [%s]", c.UUID, m.UUID(), m.Type(), m.CorrelationID())
 		} else if m.Type().IsWrite() {
-			logFn("%v: sending message %v %s", c.UUID, m.UUID(), m.Type())
+			logFn("%v: sending message %v %s [%s]", c.UUID, m.UUID(), m.Type(), m.CorrelationID())
 		}
 	})
 }
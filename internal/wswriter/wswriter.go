@@ -1,5 +1,5 @@
 // Package wswriter implements an exclusive writer and a limited writer
-// for websocket connections.
+// for websocket connections, and a limited reader for their messages.
 package wswriter
 
 import (
@@ -7,6 +7,8 @@ import (
 	"io"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/gorilla/websocket"
 )
 
@@ -15,6 +17,14 @@ import (
 // the timeout.
 var ErrWriteLockTimeout = errors.New("juggler: timed out waiting for write lock")
 
+// Conn defines the methods of the connection written to by the writers
+// of this package. It is implemented by *websocket.Conn.
+type Conn interface {
+	NextWriter(messageType int) (io.WriteCloser, error)
+	SetWriteDeadline(t time.Time) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+}
+
 // exclusiveWriter implements an io.WriteCloser that acquires the
 // connection's write lock prior to writing.
 type exclusiveWriter struct {
@@ -23,28 +33,55 @@ type exclusiveWriter struct {
 	writeLock    chan struct{}
 	lockTimeout  time.Duration
 	writeTimeout time.Duration
-	wsConn       *websocket.Conn
+	wsConn       Conn
+	messageType  int
+	ctx          context.Context
+}
+
+// MessageType returns the type of the websocket messages to write for
+// a binary encoding if binary is true, or for a text encoding
+// otherwise.
+func MessageType(binary bool) int {
+	if binary {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
 }
 
 // Exclusive creates an exclusive websocket writer. It uses the lock channel
 // to acquire and release the lock, and fails with an ErrWriteLockTimeout
 // if it can't acquire one before acquireTimeout. The writeTimeout is
 // used to set the write deadline on the connection, and conn is the
-// websocket connection to write to.
-func Exclusive(conn *websocket.Conn, lock chan struct{}, acquireTimeout, writeTimeout time.Duration) io.WriteCloser {
+// websocket connection to write to, with messages of type messageType
+// (websocket.TextMessage or websocket.BinaryMessage).
+func Exclusive(conn Conn, messageType int, lock chan struct{}, acquireTimeout, writeTimeout time.Duration) io.WriteCloser {
+	return ExclusiveContext(context.Background(), conn, messageType, lock, acquireTimeout, writeTimeout)
+}
+
+// ExclusiveContext is like Exclusive, except that it fails with
+// ctx.Err() if ctx is done before the lock is acquired, and that the
+// write deadline is set to the deadline of ctx if it is earlier than
+// the writeTimeout.
+func ExclusiveContext(ctx context.Context, conn Conn, messageType int, lock chan struct{}, acquireTimeout, writeTimeout time.Duration) io.WriteCloser {
 	return &exclusiveWriter{
 		writeLock:    lock,
 		lockTimeout:  acquireTimeout,
 		writeTimeout: writeTimeout,
 		wsConn:       conn,
+		messageType:  messageType,
+		ctx:          ctx,
 	}
 }
 
-// Write writes a text message to the websocket connection. The first
+// Write writes a message to the websocket connection. The first
 // call tries to acquire the exclusive writer lock, returning
 // ErrWriteLockTimeout if it fails doing so before the timeout.
 func (w *exclusiveWriter) Write(p []byte) (int, error) {
 	if !w.init {
+		if err := w.ctx.Err(); err != nil {
+			return 0, err
+		}
+
 		var wait <-chan time.Time
 		if to := w.lockTimeout; to > 0 {
 			wait = time.After(to)
@@ -55,16 +92,27 @@ func (w *exclusiveWriter) Write(p []byte) (int, error) {
 		case <-wait:
 			return 0, ErrWriteLockTimeout
 
+		case <-w.ctx.Done():
+			return 0, w.ctx.Err()
+
 		case <-w.writeLock:
 			// lock acquired, get next writer from the websocket connection
 			w.init = true
-			wc, err := w.wsConn.NextWriter(websocket.TextMessage)
+			wc, err := w.wsConn.NextWriter(w.messageType)
 			if err != nil {
 				return 0, err
 			}
 			w.w = wc
+
+			var deadline time.Time
 			if to := w.writeTimeout; to > 0 {
-				w.wsConn.SetWriteDeadline(time.Now().Add(to))
+				deadline = time.Now().Add(to)
+			}
+			if dl, ok := w.ctx.Deadline(); ok && (deadline.IsZero() || dl.Before(deadline)) {
+				deadline = dl
+			}
+			if !deadline.IsZero() {
+				w.wsConn.SetWriteDeadline(deadline)
 			}
 		}
 	}
@@ -93,6 +141,33 @@ func (w *exclusiveWriter) Close() error {
 	return err
 }
 
+// Control writes a control message of type messageType (e.g.
+// websocket.PingMessage) with data to conn once the exclusive write
+// lock is acquired, so that it doesn't compete with the messages
+// written by the exclusive writers of the connection. It fails with
+// an ErrWriteLockTimeout if it can't acquire the lock before
+// acquireTimeout. The write deadline of the control message is set to
+// writeTimeout.
+func Control(conn Conn, messageType int, data []byte, lock chan struct{}, acquireTimeout, writeTimeout time.Duration) error {
+	var wait <-chan time.Time
+	if acquireTimeout > 0 {
+		wait = time.After(acquireTimeout)
+	}
+
+	select {
+	case <-wait:
+		return ErrWriteLockTimeout
+	case <-lock:
+	}
+	defer func() { lock <- struct{}{} }()
+
+	var deadline time.Time
+	if writeTimeout > 0 {
+		deadline = time.Now().Add(writeTimeout)
+	}
+	return conn.WriteControl(messageType, data, deadline)
+}
+
 // ErrWriteLimitExceeded is returned when a Write call to a limited
 // writer fails because the limit is exceeded.
 var ErrWriteLimitExceeded = errors.New("write limit exceeded")
@@ -115,3 +190,39 @@ func (w *limitedWriter) Write(p []byte) (int, error) {
 	}
 	return w.w.Write(p)
 }
+
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+// LimitReader returns an io.Reader that reads from r, the reader of a
+// websocket message, and fails with websocket.ErrReadLimit if the
+// message exceeds limit bytes. A limit <= 0 returns r as-is.
+//
+// The read limit of the websocket connection applies to the size of
+// the frames, which is the compressed size of the message when the
+// permessage-deflate extension is used. This reader applies the limit
+// to the decompressed size.
+func LimitReader(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, n: limit}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.n < 0 {
+		return 0, websocket.ErrReadLimit
+	}
+	// read up to one byte more than the limit to detect the overflow
+	if int64(len(p)) > r.n+1 {
+		p = p[:r.n+1]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	if r.n < 0 {
+		return n - int(-r.n), websocket.ErrReadLimit
+	}
+	return n, err
+}
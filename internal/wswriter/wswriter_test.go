@@ -1,10 +1,15 @@
 package wswriter
 
 import (
+	"bytes"
 	"io/ioutil"
 	"testing"
 	"testing/quick"
+	"time"
 
+	"golang.org/x/net/context"
+
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -38,3 +43,48 @@ func TestLimitedWriter(t *testing.T) {
 	}
 	assert.NoError(t, quick.Check(checker, nil))
 }
+
+func TestLimitReader(t *testing.T) {
+	t.Parallel()
+
+	checker := func(limit, n uint8) bool {
+		r := LimitReader(bytes.NewReader(make([]byte, n)), int64(limit))
+		b, err := ioutil.ReadAll(r)
+
+		// property 1: the number of bytes read cannot be > limit.
+		if len(b) > int(limit) && limit > 0 {
+			return false
+		}
+		// property 2: it fails with ErrReadLimit only if the message
+		// exceeds the limit.
+		if limit > 0 && n > limit {
+			return err == websocket.ErrReadLimit
+		}
+		return err == nil && len(b) == int(n)
+	}
+	assert.NoError(t, quick.Check(checker, nil))
+}
+
+func TestExclusiveContext(t *testing.T) {
+	t.Parallel()
+
+	// the lock is never available
+	lock := make(chan struct{}, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := ExclusiveContext(ctx, nil, websocket.TextMessage, lock, 0, 0)
+	_, err := w.Write([]byte("a"))
+	assert.Equal(t, context.Canceled, err, "canceled context")
+	assert.NoError(t, w.Close(), "Close without write")
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	w = ExclusiveContext(ctx, nil, websocket.TextMessage, lock, time.Second, 0)
+	_, err = w.Write([]byte("a"))
+	assert.Equal(t, context.DeadlineExceeded, err, "context deadline")
+
+	w = ExclusiveContext(context.Background(), nil, websocket.TextMessage, lock, 10*time.Millisecond, 0)
+	_, err = w.Write([]byte("a"))
+	assert.Equal(t, ErrWriteLockTimeout, err, "lock timeout")
+}
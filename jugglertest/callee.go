@@ -0,0 +1,137 @@
+package jugglertest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/callee"
+	"github.com/mna/juggler/message"
+)
+
+// Callee is a fake callee that processes the call requests with the
+// Thunks of their URI, like callee.Callee, and injects faults in the
+// storage of the results: the results are delayed, dropped, stored
+// twice or stored after the result of the next call, and the callee
+// fails as if it crashed, so that the callers' handling of missing,
+// duplicate and out-of-order results can be tested.
+type Callee struct {
+	// prevent unkeyed literals
+	_ struct{}
+
+	// Broker is the callee broker to use to listen for call requests
+	// and to store results.
+	Broker broker.CalleeBroker
+
+	// Seed is the seed of the random faults, so that a test can
+	// reproduce them. If it is 0, the current time is used.
+	Seed int64
+
+	inOnce sync.Once
+	in     *injector
+}
+
+// SetFaults sets the faults injected by the callee. It can be called
+// while the callee is listening.
+func (c *Callee) SetFaults(f Faults) {
+	c.injector().set(f)
+}
+
+func (c *Callee) injector() *injector {
+	c.inOnce.Do(func() {
+		c.in = newInjector(c.Seed)
+	})
+	return c.in
+}
+
+// callResult is a result to store, with the call it is for.
+type callResult struct {
+	cp *message.CallPayload
+	rp *message.ResPayload
+}
+
+// Listen listens for the call requests for the URIs that are the keys
+// of m, and processes them one at a time with the corresponding Thunk,
+// until the calls connection is closed or the callee fails. It returns
+// ErrInjected if the callee failed because of the FailRate, in which
+// case the calls connection is closed without storing the pending
+// results, otherwise it returns the error of the calls connection.
+// The errors to store the results are ignored. If the calls
+// connection implements broker.AckCallsConn, each call request is
+// acknowledged once it is processed.
+func (c *Callee) Listen(m map[string]callee.Thunk) error {
+	if len(m) == 0 {
+		return nil
+	}
+
+	uris := make([]string, 0, len(m))
+	for k := range m {
+		uris = append(uris, k)
+	}
+	conn, err := c.Broker.NewCallsConn(uris...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	in := c.injector()
+	calls := conn.Calls()
+	var failed error
+
+	recv := func(flush <-chan time.Time) (interface{}, bool) {
+		for {
+			var cp *message.CallPayload
+			select {
+			case v, ok := <-calls:
+				if !ok {
+					return nil, false
+				}
+				cp = v
+			case <-flush:
+				return nil, true
+			}
+
+			if in.draw(failRate) {
+				failed = ErrInjected
+				return nil, false
+			}
+
+			fn := m[cp.URI]
+			if fn == nil {
+				continue
+			}
+			v, err := fn(cp)
+			rp, err := callee.ResultPayload(cp, v, err)
+			if err != nil {
+				// the result could not be marshaled, send that error as result
+				rp, _ = callee.ResultPayload(cp, nil, err)
+			}
+			if ac, ok := conn.(broker.AckCallsConn); ok {
+				ac.Ack(cp)
+			}
+			return callResult{cp, rp}, true
+		}
+	}
+
+	send := func(v interface{}) bool {
+		if failed != nil {
+			// crashed, the pending results are lost
+			return false
+		}
+		res := v.(callResult)
+		remain := res.cp.TTLAfterRead
+		if !res.cp.ReadTimestamp.IsZero() {
+			remain -= time.Now().Sub(res.cp.ReadTimestamp)
+		}
+		if remain > 0 {
+			c.Broker.Result(res.rp, remain)
+		}
+		return true
+	}
+
+	in.relay(recv, send)
+	if failed != nil {
+		return failed
+	}
+	return conn.CallsErr()
+}
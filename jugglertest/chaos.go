@@ -0,0 +1,511 @@
+package jugglertest
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// ErrInjected is the error returned by the operations that fail, and
+// by the connections that are closed, because of an injected fault.
+var ErrInjected = errors.New("jugglertest: injected fault")
+
+// Faults defines the faults injected by a ChaosBroker or a Callee. The
+// rates are probabilities between 0 (never) and 1 (always), drawn
+// independently for each operation or message. The zero value injects
+// no fault.
+type Faults struct {
+	// Latency is added before each operation and each message
+	// delivered, plus a random duration up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// DropRate is the rate of the messages that are dropped instead of
+	// being delivered (or, for a Callee, of the results that are not
+	// stored).
+	DropRate float64
+
+	// DuplicateRate is the rate of the messages that are delivered
+	// (or stored) twice.
+	DuplicateRate float64
+
+	// ReorderRate is the rate of the messages that are held back and
+	// delivered (or stored) after the next one, or after a short delay
+	// if there is no next message by then.
+	ReorderRate float64
+
+	// FailRate is the rate of the operations that fail with
+	// ErrInjected (or, for a Callee, of the calls that make it fail as
+	// if it crashed).
+	FailRate float64
+}
+
+// injector draws the faults to inject. It is safe for concurrent use.
+type injector struct {
+	mu     sync.Mutex
+	faults Faults
+	rnd    *rand.Rand
+}
+
+// newInjector returns an injector that draws the faults using seed,
+// or the current time if seed is 0.
+func newInjector(seed int64) *injector {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &injector{rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (in *injector) set(f Faults) {
+	in.mu.Lock()
+	in.faults = f
+	in.mu.Unlock()
+}
+
+// draw returns true with the probability returned by rate.
+func (in *injector) draw(rate func(Faults) float64) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	r := rate(in.faults)
+	return r > 0 && in.rnd.Float64() < r
+}
+
+// delay sleeps for the latency of the faults.
+func (in *injector) delay() {
+	in.mu.Lock()
+	d := in.faults.Latency
+	if in.faults.Jitter > 0 {
+		d += time.Duration(in.rnd.Int63n(int64(in.faults.Jitter)))
+	}
+	in.mu.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// fail delays the operation and returns ErrInjected if it must fail.
+func (in *injector) fail() error {
+	in.delay()
+	if in.draw(failRate) {
+		return ErrInjected
+	}
+	return nil
+}
+
+func failRate(f Faults) float64      { return f.FailRate }
+func dropRate(f Faults) float64      { return f.DropRate }
+func duplicateRate(f Faults) float64 { return f.DuplicateRate }
+func reorderRate(f Faults) float64   { return f.ReorderRate }
+
+// reorderHold is the maximum duration a message is held back to be
+// reordered, if no other message is received in the meantime.
+const reorderHold = 50 * time.Millisecond
+
+// relay sends the messages returned by recv to send, applying the
+// faults of the injector, until recv or send returns false. While a
+// message is held back to be reordered, recv is called with a flush
+// channel that receives a value after reorderHold, in which case recv
+// must return nil, true and the held message is sent. The held message,
+// if any, is also sent when recv returns false.
+func (in *injector) relay(recv func(flush <-chan time.Time) (interface{}, bool), send func(interface{}) bool) {
+	var held interface{}
+	for {
+		var flush <-chan time.Time
+		if held != nil {
+			flush = time.After(reorderHold)
+		}
+
+		v, ok := recv(flush)
+		if !ok {
+			if held != nil {
+				send(held)
+			}
+			return
+		}
+		if v == nil {
+			if !send(held) {
+				return
+			}
+			held = nil
+			continue
+		}
+
+		in.delay()
+		if in.draw(dropRate) {
+			continue
+		}
+		if held == nil && in.draw(reorderRate) {
+			held = v
+			continue
+		}
+		if !send(v) {
+			return
+		}
+		if in.draw(duplicateRate) && !send(v) {
+			return
+		}
+		if held != nil {
+			if !send(held) {
+				return
+			}
+			held = nil
+		}
+	}
+}
+
+var (
+	// static check that *ChaosBroker implements the broker interfaces
+	_ broker.CallerBroker = (*ChaosBroker)(nil)
+	_ broker.CalleeBroker = (*ChaosBroker)(nil)
+	_ broker.PubSubBroker = (*ChaosBroker)(nil)
+)
+
+// ChaosBroker is a broker that injects faults in the operations of the
+// brokers it wraps, so that the error handling of the juggler
+// components and applications can be tested without redis. It can be
+// used as the CallerBroker and PubSubBroker of a juggler.Server and as
+// the Broker of a callee.Callee, typically wrapping an
+// inmembroker.Broker. The methods of a role whose broker is nil must
+// not be called.
+//
+// The faults can be changed at any time with SetFaults, e.g. to fail
+// for a while and then recover, and the connections returned by the
+// broker can be failed at once with FailConns. The call requests,
+// results and events are delayed, dropped, duplicated and reordered
+// as they are delivered by the connections, and the other operations
+// are delayed and failed.
+type ChaosBroker struct {
+	// prevent unkeyed literals
+	_ struct{}
+
+	CallerBroker broker.CallerBroker
+	CalleeBroker broker.CalleeBroker
+	PubSubBroker broker.PubSubBroker
+
+	// Seed is the seed of the random faults, so that a test can
+	// reproduce them. If it is 0, the current time is used.
+	Seed int64
+
+	inOnce sync.Once
+	in     *injector
+
+	mu    sync.Mutex
+	conns map[*chaosConn]bool
+}
+
+// SetFaults sets the faults injected by the broker.
+func (b *ChaosBroker) SetFaults(f Faults) {
+	b.injector().set(f)
+}
+
+func (b *ChaosBroker) injector() *injector {
+	b.inOnce.Do(func() {
+		b.in = newInjector(b.Seed)
+	})
+	return b.in
+}
+
+// FailConns closes all the connections currently open on the broker,
+// as if the backend failed, so that their streams are closed and
+// their error is ErrInjected.
+func (b *ChaosBroker) FailConns() {
+	b.mu.Lock()
+	conns := b.conns
+	b.conns = nil
+	b.mu.Unlock()
+
+	for c := range conns {
+		c.fail(ErrInjected)
+	}
+}
+
+// op delays the operation and returns ErrInjected if it must fail.
+func (b *ChaosBroker) op() error {
+	return b.injector().fail()
+}
+
+// Call registers a call request in the CallerBroker, unless the
+// operation fails.
+func (b *ChaosBroker) Call(cp *message.CallPayload, timeout time.Duration) error {
+	if err := b.op(); err != nil {
+		return err
+	}
+	return b.CallerBroker.Call(cp, timeout)
+}
+
+// Result registers a call result in the CalleeBroker, unless the
+// operation fails.
+func (b *ChaosBroker) Result(rp *message.ResPayload, timeout time.Duration) error {
+	if err := b.op(); err != nil {
+		return err
+	}
+	return b.CalleeBroker.Result(rp, timeout)
+}
+
+// Publish publishes an event in the PubSubBroker, unless the
+// operation fails.
+func (b *ChaosBroker) Publish(channel string, pp *message.PubPayload) (int, error) {
+	if err := b.op(); err != nil {
+		return 0, err
+	}
+	return b.PubSubBroker.Publish(channel, pp)
+}
+
+// NewResultsConn returns a results connection of the CallerBroker
+// that delivers the results with the faults of the broker.
+func (b *ChaosBroker) NewResultsConn(connUUID uuid.UUID) (broker.ResultsConn, error) {
+	if err := b.op(); err != nil {
+		return nil, err
+	}
+	rc, err := b.CallerBroker.NewResultsConn(connUUID)
+	if err != nil {
+		return nil, err
+	}
+	return &chaosResultsConn{ResultsConn: rc, chaosConn: b.newConn(rc)}, nil
+}
+
+// NewCallsConn returns a calls connection of the CalleeBroker that
+// delivers the call requests with the faults of the broker.
+func (b *ChaosBroker) NewCallsConn(uris ...string) (broker.CallsConn, error) {
+	if err := b.op(); err != nil {
+		return nil, err
+	}
+	cc, err := b.CalleeBroker.NewCallsConn(uris...)
+	if err != nil {
+		return nil, err
+	}
+	c := &chaosCallsConn{CallsConn: cc, chaosConn: b.newConn(cc)}
+	if acc, ok := cc.(broker.AckCallsConn); ok {
+		return &chaosAckCallsConn{chaosCallsConn: c, ack: acc}, nil
+	}
+	return c, nil
+}
+
+// NewPubSubConn returns a pub-sub connection of the PubSubBroker that
+// delivers the events with the faults of the broker.
+func (b *ChaosBroker) NewPubSubConn() (broker.PubSubConn, error) {
+	if err := b.op(); err != nil {
+		return nil, err
+	}
+	psc, err := b.PubSubBroker.NewPubSubConn()
+	if err != nil {
+		return nil, err
+	}
+	return &chaosPubSubConn{PubSubConn: psc, chaosConn: b.newConn(psc)}, nil
+}
+
+type closer interface {
+	Close() error
+}
+
+// chaosConn is the state shared by the connections of a ChaosBroker.
+type chaosConn struct {
+	b     *ChaosBroker
+	inner closer
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error // set before done is closed
+}
+
+func (b *ChaosBroker) newConn(inner closer) *chaosConn {
+	c := &chaosConn{b: b, inner: inner, done: make(chan struct{})}
+	b.mu.Lock()
+	if b.conns == nil {
+		b.conns = make(map[*chaosConn]bool)
+	}
+	b.conns[c] = true
+	b.mu.Unlock()
+	return c
+}
+
+// fail closes the connection with err, which is returned by the
+// stream error method of the connection if it is not nil.
+func (c *chaosConn) fail(err error) error {
+	var cerr error
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		cerr = c.inner.Close()
+
+		c.b.mu.Lock()
+		delete(c.b.conns, c)
+		c.b.mu.Unlock()
+	})
+	return cerr
+}
+
+// Close closes the connection.
+func (c *chaosConn) Close() error {
+	return c.fail(nil)
+}
+
+// streamErr returns the injected error if the connection was failed,
+// or the error of the wrapped stream otherwise.
+func (c *chaosConn) streamErr(inner func() error) error {
+	select {
+	case <-c.done:
+		if c.err != nil {
+			return c.err
+		}
+	default:
+	}
+	return inner()
+}
+
+// relay relays the messages returned by recv to send, with the faults
+// of the broker.
+func (c *chaosConn) relay(recv func(<-chan time.Time) (interface{}, bool), send func(interface{}) bool) {
+	c.b.injector().relay(recv, send)
+}
+
+type chaosResultsConn struct {
+	broker.ResultsConn
+	*chaosConn
+
+	once sync.Once
+	ch   chan *message.ResPayload
+}
+
+func (c *chaosResultsConn) Close() error      { return c.chaosConn.Close() }
+func (c *chaosResultsConn) ResultsErr() error { return c.streamErr(c.ResultsConn.ResultsErr) }
+
+func (c *chaosResultsConn) Results() <-chan *message.ResPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *message.ResPayload)
+		in := c.ResultsConn.Results()
+		go func() {
+			defer close(c.ch)
+			c.relay(func(flush <-chan time.Time) (interface{}, bool) {
+				select {
+				case rp, ok := <-in:
+					return rp, ok
+				case <-flush:
+					return nil, true
+				case <-c.done:
+					return nil, false
+				}
+			}, func(v interface{}) bool {
+				select {
+				case c.ch <- v.(*message.ResPayload):
+					return true
+				case <-c.done:
+					return false
+				}
+			})
+		}()
+	})
+	return c.ch
+}
+
+type chaosCallsConn struct {
+	broker.CallsConn
+	*chaosConn
+
+	once sync.Once
+	ch   chan *message.CallPayload
+}
+
+func (c *chaosCallsConn) Close() error    { return c.chaosConn.Close() }
+func (c *chaosCallsConn) CallsErr() error { return c.streamErr(c.CallsConn.CallsErr) }
+
+func (c *chaosCallsConn) Calls() <-chan *message.CallPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *message.CallPayload)
+		in := c.CallsConn.Calls()
+		go func() {
+			defer close(c.ch)
+			c.relay(func(flush <-chan time.Time) (interface{}, bool) {
+				select {
+				case cp, ok := <-in:
+					return cp, ok
+				case <-flush:
+					return nil, true
+				case <-c.done:
+					return nil, false
+				}
+			}, func(v interface{}) bool {
+				select {
+				case c.ch <- v.(*message.CallPayload):
+					return true
+				case <-c.done:
+					return false
+				}
+			})
+		}()
+	})
+	return c.ch
+}
+
+// chaosAckCallsConn is the chaosCallsConn of a calls connection that
+// implements broker.AckCallsConn.
+type chaosAckCallsConn struct {
+	*chaosCallsConn
+	ack broker.AckCallsConn
+}
+
+func (c *chaosAckCallsConn) Ack(cp *message.CallPayload) error {
+	if err := c.b.op(); err != nil {
+		return err
+	}
+	return c.ack.Ack(cp)
+}
+
+type chaosPubSubConn struct {
+	broker.PubSubConn
+	*chaosConn
+
+	once sync.Once
+	ch   chan *message.EvntPayload
+}
+
+func (c *chaosPubSubConn) Close() error     { return c.chaosConn.Close() }
+func (c *chaosPubSubConn) EventsErr() error { return c.streamErr(c.PubSubConn.EventsErr) }
+
+func (c *chaosPubSubConn) Subscribe(channel string, pattern bool) error {
+	if err := c.b.op(); err != nil {
+		return err
+	}
+	return c.PubSubConn.Subscribe(channel, pattern)
+}
+
+func (c *chaosPubSubConn) Unsubscribe(channel string, pattern bool) error {
+	if err := c.b.op(); err != nil {
+		return err
+	}
+	return c.PubSubConn.Unsubscribe(channel, pattern)
+}
+
+func (c *chaosPubSubConn) Events() <-chan *message.EvntPayload {
+	c.once.Do(func() {
+		c.ch = make(chan *message.EvntPayload)
+		in := c.PubSubConn.Events()
+		go func() {
+			defer close(c.ch)
+			c.relay(func(flush <-chan time.Time) (interface{}, bool) {
+				select {
+				case ep, ok := <-in:
+					return ep, ok
+				case <-flush:
+					return nil, true
+				case <-c.done:
+					return nil, false
+				}
+			}, func(v interface{}) bool {
+				select {
+				case c.ch <- v.(*message.EvntPayload):
+					return true
+				case <-c.done:
+					return false
+				}
+			})
+		}()
+	})
+	return c.ch
+}
@@ -0,0 +1,165 @@
+package jugglertest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker/inmembroker"
+	"github.com/mna/juggler/callee"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInjectorRelay(t *testing.T) {
+	cases := []struct {
+		faults Faults
+		want   []int
+	}{
+		{Faults{}, []int{1, 2, 3}},
+		{Faults{DropRate: 1}, nil},
+		{Faults{DuplicateRate: 1}, []int{1, 1, 2, 2, 3, 3}},
+		{Faults{ReorderRate: 1}, []int{2, 1, 3}},
+	}
+	for i, c := range cases {
+		in := newInjector(1)
+		in.set(c.faults)
+
+		src := []int{1, 2, 3}
+		var got []int
+		in.relay(func(flush <-chan time.Time) (interface{}, bool) {
+			if len(src) == 0 {
+				return nil, false
+			}
+			v := src[0]
+			src = src[1:]
+			return v, true
+		}, func(v interface{}) bool {
+			got = append(got, v.(int))
+			return true
+		})
+		assert.Equal(t, c.want, got, "%d", i)
+	}
+
+	// the held message is sent if the next one is not received in time
+	in := newInjector(1)
+	in.set(Faults{ReorderRate: 1})
+	src, dst := make(chan int, 1), make(chan int, 1)
+	go in.relay(func(flush <-chan time.Time) (interface{}, bool) {
+		select {
+		case v, ok := <-src:
+			return v, ok
+		case <-flush:
+			return nil, true
+		}
+	}, func(v interface{}) bool {
+		dst <- v.(int)
+		return true
+	})
+	defer close(src)
+
+	src <- 1
+	select {
+	case v := <-dst:
+		assert.Equal(t, 1, v, "held message")
+	case <-time.After(time.Second):
+		require.FailNow(t, "held message not sent")
+	}
+}
+
+func TestChaosBroker(t *testing.T) {
+	inmem := &inmembroker.Broker{LogFunc: inmembroker.DiscardLog}
+	b := &ChaosBroker{CallerBroker: inmem, CalleeBroker: inmem, PubSubBroker: inmem, Seed: 1}
+
+	b.SetFaults(Faults{FailRate: 1})
+	cp := &message.CallPayload{ConnUUID: uuid.NewRandom(), MsgUUID: uuid.NewRandom(), URI: "a"}
+	assert.Equal(t, ErrInjected, b.Call(cp, time.Second), "Call fails")
+	_, err := b.Publish("a", &message.PubPayload{})
+	assert.Equal(t, ErrInjected, err, "Publish fails")
+
+	b.SetFaults(Faults{DuplicateRate: 1})
+	rc, err := b.NewResultsConn(cp.ConnUUID)
+	require.NoError(t, err, "NewResultsConn")
+	require.NoError(t, b.Result(&message.ResPayload{ConnUUID: cp.ConnUUID, MsgUUID: cp.MsgUUID, URI: "a"}, time.Second), "Result")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case rp := <-rc.Results():
+			assert.Equal(t, cp.MsgUUID, rp.MsgUUID, "%d: result", i)
+		case <-time.After(time.Second):
+			require.FailNow(t, "no result", "%d", i)
+		}
+	}
+
+	// failing the connections closes the results stream
+	b.FailConns()
+	select {
+	case _, ok := <-rc.Results():
+		assert.False(t, ok, "results closed")
+	case <-time.After(time.Second):
+		require.FailNow(t, "results not closed")
+	}
+	assert.Equal(t, ErrInjected, rc.ResultsErr(), "ResultsErr")
+	assert.NoError(t, rc.Close(), "Close")
+}
+
+func TestCallee(t *testing.T) {
+	inmem := &inmembroker.Broker{LogFunc: inmembroker.DiscardLog}
+	cle := &Callee{Broker: inmem, Seed: 1}
+	cle.SetFaults(Faults{ReorderRate: 1})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cle.Listen(map[string]callee.Thunk{
+			"echo": func(cp *message.CallPayload) (interface{}, error) {
+				return cp.Args, nil
+			},
+			"crash": func(cp *message.CallPayload) (interface{}, error) {
+				cle.SetFaults(Faults{FailRate: 1})
+				return nil, nil
+			},
+		})
+	}()
+
+	connUUID := uuid.NewRandom()
+	rc, err := inmem.NewResultsConn(connUUID)
+	require.NoError(t, err, "NewResultsConn")
+	defer rc.Close()
+
+	for i := 0; i < 2; i++ {
+		cp := &message.CallPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "echo", Args: json.RawMessage(`"` + string('a'+rune(i)) + `"`)}
+		require.NoError(t, inmem.Call(cp, time.Second), "Call %d", i)
+	}
+
+	// the first result is held back and stored after the second one
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case rp := <-rc.Results():
+			got = append(got, string(rp.Args))
+		case <-time.After(time.Second):
+			require.FailNow(t, "no result", "%d", i)
+		}
+	}
+	assert.Equal(t, []string{`"b"`, `"a"`}, got, "results")
+
+	// the callee crashes on the call after "crash", wait for the result
+	// of "crash" before the next call, the URIs have distinct queues.
+	crash := &message.CallPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "crash"}
+	require.NoError(t, inmem.Call(crash, time.Second), "Call crash")
+	select {
+	case rp := <-rc.Results():
+		assert.Equal(t, crash.MsgUUID, rp.MsgUUID, "crash result")
+	case <-time.After(time.Second):
+		require.FailNow(t, "no crash result")
+	}
+	require.NoError(t, inmem.Call(&message.CallPayload{ConnUUID: connUUID, MsgUUID: uuid.NewRandom(), URI: "echo"}, time.Second), "Call after crash")
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrInjected, err, "Listen")
+	case <-time.After(time.Second):
+		require.FailNow(t, "callee did not fail")
+	}
+}
@@ -1,3 +1,9 @@
+// Package jugglertest provides helpers to test juggler servers, brokers,
+// callees and clients, such as debug loggers and leak checks.
+//
+// The ChaosBroker and the Callee inject faults such as latency, lost,
+// duplicate and out-of-order messages and connection failures, so
+// that applications can test their error handling without redis.
 package jugglertest
 
 import (
@@ -0,0 +1,107 @@
+package jugglertest
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// leakCheckInterval is the interval between checks when waiting for
+// goroutines or redis connections to terminate.
+const leakCheckInterval = 10 * time.Millisecond
+
+// GoroutineSnapshot is a snapshot of the number of goroutines at a
+// given time. It can be used to check that a test doesn't leak
+// goroutines, e.g.:
+//
+//     snap := jugglertest.SnapshotGoroutines()
+//     // ... run the test, close all connections
+//     snap.AssertNoLeak(t, time.Second)
+//
+// Because the number of goroutines is process-wide, it should not be
+// used in tests that run in parallel with other tests.
+type GoroutineSnapshot struct {
+	n int
+}
+
+// SnapshotGoroutines takes a snapshot of the current number of
+// goroutines.
+func SnapshotGoroutines() *GoroutineSnapshot {
+	return &GoroutineSnapshot{n: runtime.NumGoroutine()}
+}
+
+// Count returns the number of goroutines at the time of the snapshot.
+func (s *GoroutineSnapshot) Count() int {
+	return s.n
+}
+
+// AssertNoLeak checks that the number of goroutines goes back to
+// at most the number of goroutines at the time of the snapshot before
+// the timeout. Goroutines may take some time to terminate after a
+// connection is closed, so it checks repeatedly until the timeout
+// expires. If it fails, it reports the error on t along with the
+// stack traces of all goroutines and returns false.
+func (s *GoroutineSnapshot) AssertNoLeak(t testing.TB, timeout time.Duration) bool {
+	var n int
+	deadline := time.Now().Add(timeout)
+	for {
+		if n = runtime.NumGoroutine(); n <= s.n {
+			return true
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(leakCheckInterval)
+	}
+
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	t.Errorf("goroutine leak: %d goroutines, want at most %d\n%s", n, s.n, buf)
+	return false
+}
+
+// CountRedisClients returns the number of clients connected to the
+// redis server of rc, as reported by CLIENT LIST. The count includes
+// rc itself.
+func CountRedisClients(rc redis.Conn) (int, error) {
+	b, err := redis.Bytes(rc.Do("CLIENT", "LIST"))
+	if err != nil {
+		return 0, err
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return bytes.Count(b, []byte("\n")) + 1, nil
+}
+
+// AssertRedisClients checks that the number of clients connected to
+// the redis server of rc (including rc itself) becomes want before the
+// timeout. It checks repeatedly until the timeout expires, as closed
+// connections may take some time to be reported as such by redis.
+// If it fails, it reports the error on t and returns false.
+func AssertRedisClients(t testing.TB, rc redis.Conn, want int, timeout time.Duration) bool {
+	var n int
+	var err error
+	deadline := time.Now().Add(timeout)
+	for {
+		n, err = CountRedisClients(rc)
+		if err == nil && n == want {
+			return true
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(leakCheckInterval)
+	}
+
+	if err != nil {
+		t.Errorf("failed to count redis clients: %v", err)
+		return false
+	}
+	t.Errorf("redis connection leak: %d clients, want %d", n, want)
+	return false
+}
@@ -0,0 +1,107 @@
+package jugglertest
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// PipeURL is the URL to use to connect to a server started with
+// StartPipeServer. The host is ignored, all connections are made
+// in-memory.
+const PipeURL = "ws://pipe/"
+
+// ErrListenerClosed is returned when dialing or accepting on a
+// closed PipeListener.
+var ErrListenerClosed = errors.New("jugglertest: listener closed")
+
+// pipeAddr is the net.Addr of in-memory connections.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// PipeListener is a net.Listener that creates in-memory connections
+// using net.Pipe. It can be used to connect a client.Client and a
+// juggler.Server inside a single test process without binding a TCP
+// port.
+type PipeListener struct {
+	conns     chan net.Conn
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewPipeListener creates a new in-memory listener. It should be
+// closed by the caller.
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept implements net.Listener for the PipeListener. It waits for
+// and returns the next connection made with Dial.
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close implements net.Listener for the PipeListener. Blocked Accept
+// and Dial calls return ErrListenerClosed. Connections already
+// established are not closed.
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr implements net.Listener for the PipeListener.
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial creates a new in-memory connection to the listener. The network
+// and address are ignored, the signature matches the NetDial field of
+// the websocket.Dialer.
+func (l *PipeListener) Dial(network, addr string) (net.Conn, error) {
+	cli, srv := net.Pipe()
+	select {
+	case l.conns <- srv:
+		return cli, nil
+	case <-l.done:
+		cli.Close()
+		srv.Close()
+		return nil, ErrListenerClosed
+	}
+}
+
+// Dialer returns a websocket.Dialer that connects to the listener
+// and requests the provided subprotocols.
+func (l *PipeListener) Dialer(subprotocols ...string) *websocket.Dialer {
+	return &websocket.Dialer{
+		NetDial:      l.Dial,
+		Subprotocols: subprotocols,
+	}
+}
+
+// StartPipeServer starts an HTTP server that serves h over an
+// in-memory PipeListener. Use the listener's Dialer with PipeURL to
+// connect to it, e.g. with a juggler.Upgrade handler:
+//
+//     l := jugglertest.StartPipeServer(juggler.Upgrade(upg, srv))
+//     defer l.Close()
+//     cli, err := client.Dial(l.Dialer(juggler.Subprotocols...), jugglertest.PipeURL, nil)
+//
+// Closing the listener stops the server.
+func StartPipeServer(h http.Handler) *PipeListener {
+	l := NewPipeListener()
+	go (&http.Server{Handler: h}).Serve(l)
+	return l
+}
@@ -0,0 +1,65 @@
+package juggler
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/mna/juggler/internal/wswriter"
+	"github.com/gorilla/websocket"
+)
+
+// errPongTimeout is the CloseErr of a connection closed because it
+// missed a pong (see Server.PongTimeout).
+var errPongTimeout = errors.New("juggler: pong timeout")
+
+// keepAlive sends a websocket ping every interval until the connection
+// is closed, and closes the connection if the pong of a ping is not
+// received before timeout, if timeout > 0, or if a ping cannot be
+// sent. It is started in its own goroutine.
+func (c *Conn) keepAlive(interval, timeout time.Duration) {
+	c.srv.vars.Add("TotalConnGoros", 1)
+	c.srv.vars.Add("ActiveConnGoros", 1)
+	defer c.srv.vars.Add("ActiveConnGoros", -1)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	// the pong timer of the oldest ping without a pong, nil if none
+	var pongTimer <-chan time.Time
+	var sent time.Time
+	for {
+		select {
+		case <-c.kill:
+			return
+
+		case <-pongTimer:
+			if atomic.LoadInt64(&c.lastPong) < sent.UnixNano() {
+				c.srv.vars.Add("MissedPongs", 1)
+				c.Close(errPongTimeout)
+				return
+			}
+			pongTimer = nil
+
+		case now := <-t.C:
+			// the ping must not block past the next one if there is no
+			// WriteTimeout
+			settings := c.srv.Settings()
+			writeTimeout := settings.WriteTimeout
+			if writeTimeout <= 0 {
+				writeTimeout = interval
+			}
+			if err := wswriter.Control(c.wsConn, websocket.PingMessage, nil, c.wmu,
+				settings.AcquireWriteLockTimeout, writeTimeout); err != nil {
+				// as for other writes, the connection is unusable
+				c.srv.vars.Add("FailedPings", 1)
+				c.Close(err)
+				return
+			}
+			if timeout > 0 && pongTimer == nil {
+				sent = now
+				pongTimer = time.After(timeout)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// BatchSuffix is the suffix of the juggler subprotocols that allow the
+// server to write many messages in a single websocket message, as a
+// JSON array of messages (e.g. "juggler.0+batch"). It is only
+// supported with the JSON encoding, the messages are encoded with the
+// JSONCodec.
+const BatchSuffix = "+batch"
+
+// IsBatch returns true if the juggler subprotocol allows batches of
+// messages.
+func IsBatch(subprotocol string) bool {
+	return strings.HasSuffix(subprotocol, BatchSuffix)
+}
+
+// UnmarshalResponseBatch is like UnmarshalResponseCodec, but if c is
+// the JSONCodec, r may hold a batch of messages encoded as a JSON
+// array, in which case all messages of the batch are returned, in
+// order. It returns an error if any message of the batch is invalid.
+func UnmarshalResponseBatch(c Codec, r io.Reader) ([]Msg, error) {
+	if _, ok := c.(jsonCodec); !ok {
+		m, err := UnmarshalResponseCodec(c, r)
+		if err != nil {
+			return nil, err
+		}
+		return []Msg{m}, nil
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if t := bytes.TrimLeft(b, " \t\r\n"); len(t) == 0 || t[0] != '[' {
+		m, err := UnmarshalResponseCodec(c, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return []Msg{m}, nil
+	}
+
+	var raws []json.RawMessage
+	if err := json.Unmarshal(b, &raws); err != nil {
+		return nil, fmt.Errorf("invalid JSON batch: %v", err)
+	}
+	msgs := make([]Msg, 0, len(raws))
+	for _, raw := range raws {
+		m, err := UnmarshalResponseCodec(c, bytes.NewReader(raw))
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
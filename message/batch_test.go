@@ -0,0 +1,58 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshalResponseBatch(t *testing.T) {
+	assert.True(t, IsBatch("juggler.0+batch"), "juggler.0+batch")
+	assert.False(t, IsBatch("juggler.0"), "juggler.0")
+	assert.Equal(t, JSONCodec, CodecFor("juggler.0+batch"), "batch codec")
+
+	call, err := NewCall("a", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	ack := NewAck(call)
+	res := NewRes(&ResPayload{URI: "a", Args: json.RawMessage(`1`)})
+
+	// single message
+	b, err := json.Marshal(ack)
+	require.NoError(t, err, "Marshal ack")
+	msgs, err := UnmarshalResponseBatch(JSONCodec, bytes.NewReader(b))
+	require.NoError(t, err, "single")
+	if assert.Equal(t, 1, len(msgs), "single") {
+		assert.Equal(t, AckMsg, msgs[0].Type(), "single type")
+	}
+
+	// batch
+	b, err = json.Marshal([]Msg{ack, res})
+	require.NoError(t, err, "Marshal batch")
+	msgs, err = UnmarshalResponseBatch(JSONCodec, bytes.NewReader(append([]byte(" \n"), b...)))
+	require.NoError(t, err, "batch")
+	if assert.Equal(t, 2, len(msgs), "batch") {
+		assert.Equal(t, AckMsg, msgs[0].Type(), "batch type 0")
+		assert.Equal(t, ResMsg, msgs[1].Type(), "batch type 1")
+		assert.Equal(t, `1`, string(msgs[1].(*Res).Payload.Args), "batch res args")
+	}
+
+	// invalid message in batch, or request message
+	_, err = UnmarshalResponseBatch(JSONCodec, strings.NewReader(`[{"meta":{}}]`))
+	assert.Error(t, err, "invalid message")
+	b, err = json.Marshal([]Msg{ack, call})
+	require.NoError(t, err, "Marshal call batch")
+	_, err = UnmarshalResponseBatch(JSONCodec, bytes.NewReader(b))
+	assert.Error(t, err, "request message")
+
+	// other codecs never batch
+	b, err = MsgpackCodec.Marshal(ack)
+	require.NoError(t, err, "msgpack Marshal")
+	msgs, err = UnmarshalResponseBatch(MsgpackCodec, bytes.NewReader(b))
+	require.NoError(t, err, "msgpack")
+	assert.Equal(t, 1, len(msgs), "msgpack")
+}
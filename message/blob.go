@@ -0,0 +1,49 @@
+package message
+
+import "encoding/json"
+
+// Offload returns m with its arguments replaced by a reference to a
+// blob if m is a CALL, PUB, RES, RCHK or EVNT message whose arguments are
+// larger than threshold bytes. The arguments are stored by calling
+// put, which returns the reference of the blob. The reference is
+// stored in the blob reference field of the metadata (Meta.R), and
+// the arguments are set to null. Otherwise it returns m as-is.
+//
+// As for Compress, the returned message is a copy of m, m itself is
+// never modified.
+func Offload(m Msg, threshold int, put func([]byte) (string, error)) (Msg, error) {
+	meta, args := argsOf(m)
+	if meta == nil || meta.R != "" || len(*args) <= threshold {
+		return m, nil
+	}
+
+	ref, err := put(*args)
+	if err != nil {
+		return nil, err
+	}
+
+	m = copyMsg(m)
+	meta, args = argsOf(m)
+	meta.R = ref
+	*args = json.RawMessage("null")
+	return m, nil
+}
+
+// Resolve replaces in-place the arguments of m with the blob referenced
+// in the blob reference field of its metadata (Meta.R), if it is set,
+// and clears that field. The blob is retrieved by calling get with the
+// reference.
+func Resolve(m Msg, get func(string) ([]byte, error)) error {
+	meta, args := argsOf(m)
+	if meta == nil || meta.R == "" {
+		return nil
+	}
+
+	b, err := get(meta.R)
+	if err != nil {
+		return err
+	}
+	meta.R = ""
+	*args = b
+	return nil
+}
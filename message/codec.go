@@ -0,0 +1,214 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackSuffix is the suffix of the juggler subprotocols that use the
+// MessagePack encoding (e.g. "juggler.0+msgpack").
+const MsgpackSuffix = "+msgpack"
+
+// BinarySuffix is the suffix of the juggler subprotocols that use the
+// binary envelope encoding (e.g. "juggler.0+binary").
+const BinarySuffix = "+binary"
+
+// Codec defines the methods required to encode and decode messages
+// for the wire.
+type Codec interface {
+	// Marshal returns the encoding of v.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes data into v.
+	Unmarshal(data []byte, v interface{}) error
+
+	// Binary returns true if the encoding is binary, in which case the
+	// messages are sent as websocket.BinaryMessage instead of
+	// websocket.TextMessage.
+	Binary() bool
+}
+
+var (
+	// JSONCodec encodes messages in JSON. It is the codec of the
+	// juggler.0 subprotocol.
+	JSONCodec Codec = jsonCodec{}
+
+	// MsgpackCodec encodes messages in MessagePack, with the same
+	// structure and field names as in JSON. The arguments of the
+	// messages are opaque JSON values, so they are encoded as binary
+	// values that hold the JSON encoding, and the UUIDs are encoded as
+	// 16-byte binary values. It is the codec of the subprotocols with
+	// the MsgpackSuffix.
+	MsgpackCodec Codec = msgpackCodec{}
+
+	// BinaryCodec encodes messages in a binary envelope, so that binary
+	// arguments (see the Binary flag of Call) are sent as raw bytes
+	// instead of base64. The envelope is the length of the JSON-encoded
+	// message as a 4-byte big-endian unsigned integer, followed by the
+	// JSON-encoded message, followed by the raw bytes of the arguments
+	// if the message has binary arguments, in which case the args field
+	// of the JSON-encoded message is null. The other messages are sent
+	// as JSON in the envelope. It is the codec of the subprotocols with
+	// the BinarySuffix.
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// ErrInvalidEnvelope is returned by BinaryCodec when decoding a
+// message that is not a valid binary envelope.
+var ErrInvalidEnvelope = errors.New("juggler/message: invalid binary envelope")
+
+// CodecFor returns the codec of the juggler subprotocol: the
+// MsgpackCodec if it has the MsgpackSuffix, the BinaryCodec if it has
+// the BinarySuffix, the ProtobufCodec if it has the ProtobufSuffix, the
+// JSONCodec otherwise.
+func CodecFor(subprotocol string) Codec {
+	switch {
+	case strings.HasSuffix(subprotocol, MsgpackSuffix):
+		return MsgpackCodec
+	case strings.HasSuffix(subprotocol, BinarySuffix):
+		return BinaryCodec
+	case strings.HasSuffix(subprotocol, ProtobufSuffix):
+		return ProtobufCodec
+	}
+	return JSONCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Binary() bool { return false }
+
+type msgpackCodec struct{}
+
+// wireMsg is the structure of an encoded message. The msgpack package
+// would otherwise inline the embedded Meta in the message.
+type wireMsg struct {
+	Meta    *Meta       `json:"meta"`
+	Payload interface{} `json:"payload"`
+}
+
+// toWire returns the wireMsg that points to the metadata and payload
+// of v if v is a pointer to a message, or v otherwise.
+func toWire(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return v
+	}
+	meta, pld := rv.Elem().FieldByName("Meta"), rv.Elem().FieldByName("Payload")
+	if !meta.IsValid() || meta.Type() != reflect.TypeOf(Meta{}) || !pld.IsValid() {
+		return v
+	}
+	return &wireMsg{
+		Meta:    meta.Addr().Interface().(*Meta),
+		Payload: pld.Addr().Interface(),
+	}
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(toWire(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(toWire(v))
+}
+
+func (msgpackCodec) Binary() bool { return true }
+
+type binaryCodec struct{}
+
+// binaryArgs returns a pointer to the Args of m if it is a message
+// with binary arguments, or nil.
+func binaryArgs(m Msg) *json.RawMessage {
+	switch m := m.(type) {
+	case *Call:
+		if m.Payload.Binary {
+			return &m.Payload.Args
+		}
+	case *Pub:
+		if m.Payload.Binary {
+			return &m.Payload.Args
+		}
+	case *Res:
+		if m.Payload.Binary {
+			return &m.Payload.Args
+		}
+	case *ResChunk:
+		if m.Payload.Binary {
+			return &m.Payload.Args
+		}
+	case *Evnt:
+		if m.Payload.Binary {
+			return &m.Payload.Args
+		}
+	}
+	return nil
+}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	var raw []byte
+	if m, ok := v.(Msg); ok {
+		// if the arguments are not a valid base64 string, they are sent
+		// as-is in the JSON-encoded message.
+		if args := binaryArgs(m); args != nil && json.Unmarshal(*args, &raw) == nil && raw != nil {
+			m = copyMsg(m)
+			*binaryArgs(m) = nil
+			v = m
+		}
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4, 4+len(b)+len(raw))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	buf = append(buf, b...)
+	return append(buf, raw...), nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) < 4 {
+		return ErrInvalidEnvelope
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return ErrInvalidEnvelope
+	}
+	if err := json.Unmarshal(data[4:4+n], v); err != nil {
+		return err
+	}
+
+	if m, ok := v.(Msg); ok {
+		if args := binaryArgs(m); args != nil && (len(*args) == 0 || string(*args) == "null") {
+			b, err := json.Marshal(data[4+n:])
+			if err != nil {
+				return err
+			}
+			*args = b
+		}
+	}
+	return nil
+}
+
+func (binaryCodec) Binary() bool { return true }
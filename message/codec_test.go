@@ -0,0 +1,231 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestCodecFor(t *testing.T) {
+	assert.Equal(t, JSONCodec, CodecFor("juggler.0"), "juggler.0")
+	assert.Equal(t, JSONCodec, CodecFor(""), "empty")
+	assert.Equal(t, MsgpackCodec, CodecFor("juggler.0+msgpack"), "juggler.0+msgpack")
+	assert.Equal(t, BinaryCodec, CodecFor("juggler.0+binary"), "juggler.0+binary")
+	assert.Equal(t, ProtobufCodec, CodecFor("juggler.0+proto"), "juggler.0+proto")
+	assert.False(t, JSONCodec.Binary(), "JSON is not binary")
+	assert.True(t, MsgpackCodec.Binary(), "msgpack is binary")
+	assert.True(t, BinaryCodec.Binary(), "binary envelope is binary")
+	assert.True(t, ProtobufCodec.Binary(), "protobuf is binary")
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	call, err := NewCall("a", map[string]interface{}{"x": 3}, time.Second)
+	require.NoError(t, err, "NewCall")
+	call.Meta.C = "corr"
+	call.Meta.P = 1
+	pub, err := NewPub("d", "ok")
+	require.NoError(t, err, "NewPub")
+	sub := NewSub("b", false)
+	sub.Payload.Filter = Filter{"id": json.RawMessage(`1`)}
+	rp := &ResPayload{MsgUUID: uuid.NewRandom(), URI: "g", Args: json.RawMessage(`{"y":1}`), Seq: 1}
+	ep := &EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "h", Pattern: "h*", Args: json.RawMessage(`"s"`)}
+	n := 3
+	ack := NewAck(pub)
+	ack.Payload.Delivered = &n
+
+	cases := []Msg{
+		call,
+		sub,
+		NewUnsb("c", true),
+		pub,
+		NewNack(call, 500, io.EOF),
+		ack,
+		NewRes(rp),
+		NewResChunk(rp),
+		NewEvnt(ep),
+		NewChunk(call.UUID(), `{"a":`, true),
+	}
+	for i, m := range cases {
+		b, err := MsgpackCodec.Marshal(m)
+		require.NoError(t, err, "Marshal %d", i)
+
+		// the structure is the same as in JSON
+		var raw map[string]interface{}
+		require.NoError(t, msgpack.Unmarshal(b, &raw), "msgpack.Unmarshal %d", i)
+		assert.Contains(t, raw, "meta", "%d: meta", i)
+		assert.Contains(t, raw, "payload", "%d: payload", i)
+
+		var unmarshal func(Codec, io.Reader) (Msg, error)
+		if m.Type().IsRead() {
+			unmarshal = func(c Codec, r io.Reader) (Msg, error) { return UnmarshalRequestCodec(c, r) }
+		} else {
+			unmarshal = UnmarshalResponseCodec
+		}
+		mm, err := unmarshal(MsgpackCodec, bytes.NewReader(b))
+		require.NoError(t, err, "Unmarshal %d", i)
+
+		if m.Type() == NackMsg {
+			m.(*Nack).Payload.Err = nil
+		}
+		assert.True(t, reflect.DeepEqual(m, mm), "DeepEqual %d: %#v", i, mm)
+	}
+
+	// invalid messages
+	_, err = UnmarshalRequestCodec(MsgpackCodec, bytes.NewReader([]byte("{")))
+	assert.Error(t, err, "invalid encoding")
+	b, err := MsgpackCodec.Marshal(NewEvnt(ep))
+	require.NoError(t, err, "Marshal EVNT")
+	_, err = UnmarshalRequestCodec(MsgpackCodec, bytes.NewReader(b))
+	assert.Error(t, err, "response message as request")
+}
+
+func TestBinaryCodec(t *testing.T) {
+	data := []byte{0, 1, 2, 0xff, '"'}
+	call, err := NewCall("a", data, time.Second)
+	require.NoError(t, err, "NewCall")
+	assert.True(t, call.Payload.Binary, "binary call")
+	empty, err := NewPub("b", []byte{})
+	require.NoError(t, err, "NewPub")
+	pub, err := NewPub("b", "not binary")
+	require.NoError(t, err, "NewPub")
+	assert.False(t, pub.Payload.Binary, "not binary pub")
+	rp := &ResPayload{MsgUUID: uuid.NewRandom(), URI: "g", Args: json.RawMessage(`"AAE="`), Binary: true}
+	ep := &EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "h", Args: json.RawMessage(`{"x":1}`), Binary: true}
+
+	cases := []struct {
+		m   Msg
+		raw []byte // the raw bytes after the JSON message
+	}{
+		{call, data},
+		{empty, []byte{}},
+		{pub, nil},
+		{NewSub("c", false), nil},
+		{NewRes(rp), []byte{0, 1}},
+		{NewResChunk(rp), []byte{0, 1}},
+		{NewEvnt(ep), nil}, // invalid binary args are sent as JSON
+	}
+	for i, c := range cases {
+		b, err := BinaryCodec.Marshal(c.m)
+		require.NoError(t, err, "Marshal %d", i)
+
+		require.True(t, len(b) >= 4, "%d: envelope length", i)
+		n := int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		assert.Equal(t, len(c.raw), len(b)-4-n, "%d: raw bytes length", i)
+		if len(c.raw) > 0 {
+			assert.Equal(t, c.raw, b[4+n:], "%d: raw bytes", i)
+		}
+
+		var unmarshal func(Codec, io.Reader) (Msg, error)
+		if c.m.Type().IsRead() {
+			unmarshal = func(c Codec, r io.Reader) (Msg, error) { return UnmarshalRequestCodec(c, r) }
+		} else {
+			unmarshal = UnmarshalResponseCodec
+		}
+		mm, err := unmarshal(BinaryCodec, bytes.NewReader(b))
+		require.NoError(t, err, "Unmarshal %d", i)
+		assert.True(t, reflect.DeepEqual(c.m, mm), "DeepEqual %d: %#v", i, mm)
+	}
+
+	// invalid envelopes
+	_, err = UnmarshalRequestCodec(BinaryCodec, bytes.NewReader([]byte{0, 0}))
+	if assert.Error(t, err, "short envelope") {
+		assert.Contains(t, err.Error(), ErrInvalidEnvelope.Error(), "short envelope error")
+	}
+	_, err = UnmarshalRequestCodec(BinaryCodec, bytes.NewReader([]byte{0, 0, 0, 10, '{', '}'}))
+	assert.Error(t, err, "invalid length")
+}
+
+func TestProtobufCodec(t *testing.T) {
+	call, err := NewCall("a", map[string]interface{}{"x": 3}, time.Second)
+	require.NoError(t, err, "NewCall")
+	call.Meta.C = "corr"
+	call.Meta.P = -1
+	call.Meta.K = "key"
+	call.Payload.FanOut = []string{"b", "c"}
+	call.Payload.Stream = true
+	bcall, err := NewCall("a", []byte{0, 1, 0xff}, 0)
+	require.NoError(t, err, "NewCall")
+	ecall, err := NewCall("", nil, 0)
+	require.NoError(t, err, "NewCall")
+	pub, err := NewPub("d", "ok")
+	require.NoError(t, err, "NewPub")
+	empty, err := NewPub("d", []byte{})
+	require.NoError(t, err, "NewPub")
+	sub := NewSub("b", false)
+	sub.Payload.Filter = Filter{"id": json.RawMessage(`1`), "a.b": json.RawMessage(`"x"`)}
+	sub.Payload.LastEventID = "1-0"
+	rp := &ResPayload{MsgUUID: uuid.NewRandom(), URI: "g", Args: json.RawMessage(`{"y":1}`), Seq: 2, Error: true}
+	brp := &ResPayload{MsgUUID: uuid.NewRandom(), URI: "g", Args: json.RawMessage(`"AAE="`), Binary: true}
+	ep := &EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "h", Pattern: "h*", EventID: "2-0", Args: json.RawMessage(`"s"`)}
+	n := 0
+	ack := NewAck(pub)
+	ack.Payload.Delivered = &n
+	nack := NewNack(call, 400, &ValidationError{URI: "a", Details: []string{"x"}})
+	nack.Payload.Err = nil
+
+	cases := []Msg{
+		call,
+		bcall,
+		ecall,
+		sub,
+		NewUnsb("c", true),
+		pub,
+		empty,
+		nack,
+		ack,
+		NewAck(sub),
+		NewRes(rp),
+		NewRes(brp),
+		NewResChunk(rp),
+		NewEvnt(ep),
+		NewChunk(call.UUID(), `{"a":`, true),
+	}
+	for i, m := range cases {
+		b, err := ProtobufCodec.Marshal(m)
+		require.NoError(t, err, "Marshal %d", i)
+
+		var unmarshal func(Codec, io.Reader) (Msg, error)
+		if m.Type().IsRead() {
+			unmarshal = func(c Codec, r io.Reader) (Msg, error) { return UnmarshalRequestCodec(c, r) }
+		} else {
+			unmarshal = UnmarshalResponseCodec
+		}
+		mm, err := unmarshal(ProtobufCodec, bytes.NewReader(b))
+		require.NoError(t, err, "Unmarshal %d", i)
+		assert.True(t, reflect.DeepEqual(m, mm), "DeepEqual %d: %#v", i, mm)
+	}
+
+	// binary arguments are sent as raw bytes
+	b, err := ProtobufCodec.Marshal(bcall)
+	require.NoError(t, err, "Marshal binary CALL")
+	assert.True(t, bytes.Contains(b, []byte{0, 1, 0xff}), "raw bytes")
+
+	// invalid binary arguments are sent as JSON
+	inv := NewEvnt(&EvntPayload{MsgUUID: uuid.NewRandom(), Channel: "h", Args: json.RawMessage(`{"x":1}`), Binary: true})
+	b, err = ProtobufCodec.Marshal(inv)
+	require.NoError(t, err, "Marshal invalid binary")
+	mm, err := UnmarshalResponseCodec(ProtobufCodec, bytes.NewReader(b))
+	require.NoError(t, err, "Unmarshal invalid binary")
+	assert.False(t, mm.(*Evnt).Payload.Binary, "not binary")
+	assert.Equal(t, `{"x":1}`, string(mm.(*Evnt).Payload.Args), "JSON args")
+
+	// invalid messages
+	_, err = UnmarshalRequestCodec(ProtobufCodec, bytes.NewReader([]byte{0xff}))
+	assert.Error(t, err, "invalid encoding")
+	_, err = UnmarshalRequestCodec(ProtobufCodec, bytes.NewReader(nil))
+	assert.Error(t, err, "no payload")
+	b, err = ProtobufCodec.Marshal(NewEvnt(ep))
+	require.NoError(t, err, "Marshal EVNT")
+	_, err = UnmarshalRequestCodec(ProtobufCodec, bytes.NewReader(b))
+	assert.Error(t, err, "response message as request")
+	_, err = ProtobufCodec.Marshal(struct{}{})
+	assert.Error(t, err, "not a message")
+}
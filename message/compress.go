@@ -0,0 +1,206 @@
+package message
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// List of supported compression encodings. zstd is not supported, as
+// it is not available in the standard library.
+const (
+	Gzip    = "gzip"
+	Deflate = "deflate"
+)
+
+// ErrDecompressedTooLarge is returned by Decompress and DecompressBytes
+// when the decompressed arguments exceed the maximum size.
+var ErrDecompressedTooLarge = errors.New("juggler/message: decompressed payload too large")
+
+// IsCompressionSupported returns true if enc is a supported compression
+// encoding.
+func IsCompressionSupported(enc string) bool {
+	return enc == Gzip || enc == Deflate
+}
+
+// CompressBytes compresses b using the enc encoding.
+func CompressBytes(enc string, b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch enc {
+	case Gzip:
+		w = gzip.NewWriter(&buf)
+	case Deflate:
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = fw
+	default:
+		return nil, fmt.Errorf("juggler/message: unsupported compression %q", enc)
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecompressBytes decompresses b using the enc encoding. If max is
+// greater than 0, ErrDecompressedTooLarge is returned if the
+// decompressed value is larger than max bytes.
+func DecompressBytes(enc string, b []byte, max int64) ([]byte, error) {
+	var r io.ReadCloser
+	switch enc {
+	case Gzip:
+		gr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	case Deflate:
+		r = flate.NewReader(bytes.NewReader(b))
+	default:
+		return nil, fmt.Errorf("juggler/message: unsupported compression %q", enc)
+	}
+	defer r.Close()
+
+	lr := io.Reader(r)
+	if max > 0 {
+		lr = io.LimitReader(r, max+1)
+	}
+	res, err := ioutil.ReadAll(lr)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && int64(len(res)) > max {
+		return nil, ErrDecompressedTooLarge
+	}
+	return res, nil
+}
+
+// CompressArgs compresses the JSON-encoded args using the enc encoding.
+// The compressed value is returned as a JSON string holding the
+// base64-encoded compressed bytes.
+func CompressArgs(enc string, args json.RawMessage) (json.RawMessage, error) {
+	b, err := CompressBytes(enc, args)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(b)
+}
+
+// DecompressArgs reverses CompressArgs, returning the JSON-encoded
+// arguments. See DecompressBytes for the meaning of max.
+func DecompressArgs(enc string, args json.RawMessage, max int64) (json.RawMessage, error) {
+	var b []byte
+	if err := json.Unmarshal(args, &b); err != nil {
+		return nil, err
+	}
+	res, err := DecompressBytes(enc, b, max)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(res) {
+		return nil, errors.New("juggler/message: decompressed payload is not valid JSON")
+	}
+	return res, nil
+}
+
+// argsOf returns a pointer to the Meta and the Args of m, or nils if
+// m is not a message with arguments.
+func argsOf(m Msg) (*Meta, *json.RawMessage) {
+	switch m := m.(type) {
+	case *Call:
+		return &m.Meta, &m.Payload.Args
+	case *Pub:
+		return &m.Meta, &m.Payload.Args
+	case *Res:
+		return &m.Meta, &m.Payload.Args
+	case *ResChunk:
+		return &m.Meta, &m.Payload.Args
+	case *Evnt:
+		return &m.Meta, &m.Payload.Args
+	}
+	return nil, nil
+}
+
+// copyMsg returns a shallow copy of m, which must be a message with
+// arguments.
+func copyMsg(m Msg) Msg {
+	switch m := m.(type) {
+	case *Call:
+		c := *m
+		return &c
+	case *Pub:
+		c := *m
+		return &c
+	case *Res:
+		c := *m
+		return &c
+	case *ResChunk:
+		c := *m
+		return &c
+	case *Evnt:
+		c := *m
+		return &c
+	}
+	return m
+}
+
+// Compress returns m with its arguments compressed using the enc
+// encoding if m is a CALL, PUB, RES, RCHK or EVNT message whose arguments are
+// larger than threshold bytes, and are not compressed already. The
+// encoding is stored in the compression field of the metadata (Meta.Z).
+// Otherwise it returns m as-is.
+//
+// The returned message is a copy of m, m itself is never modified, so
+// it is safe to call concurrently for the same message (e.g. an event
+// sent to many connections).
+func Compress(m Msg, enc string, threshold int) (Msg, error) {
+	meta, args := argsOf(m)
+	if meta == nil || meta.Z != "" || len(*args) <= threshold {
+		return m, nil
+	}
+
+	b, err := CompressArgs(enc, *args)
+	if err != nil {
+		return nil, err
+	}
+	// do not bother if compression didn't help
+	if len(b) >= len(*args) {
+		return m, nil
+	}
+
+	m = copyMsg(m)
+	meta, args = argsOf(m)
+	meta.Z = enc
+	*args = b
+	return m, nil
+}
+
+// Decompress decompresses in-place the arguments of m if it has
+// the compression field set in its metadata (Meta.Z), and clears
+// that field. See DecompressBytes for the meaning of max.
+func Decompress(m Msg, max int64) error {
+	meta, args := argsOf(m)
+	if meta == nil || meta.Z == "" {
+		return nil
+	}
+
+	b, err := DecompressArgs(meta.Z, *args, max)
+	if err != nil {
+		return err
+	}
+	meta.Z = ""
+	*args = b
+	return nil
+}
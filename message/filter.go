@@ -0,0 +1,59 @@
+package message
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Filter is a subscription filter, evaluated by the server on the
+// arguments of the events of the subscription so that only the
+// matching events are sent to the client. Each key of the filter is
+// the dot-separated path of a field in the arguments (e.g. "user.id"),
+// and the value is the JSON value that the field must be equal to.
+// An event matches if its arguments are a JSON object with all the
+// fields of the filter, with the same values. An empty filter matches
+// all events.
+type Filter map[string]json.RawMessage
+
+// Match returns true if the JSON-encoded event arguments args match
+// the filter.
+func (f Filter) Match(args json.RawMessage) bool {
+	if len(f) == 0 {
+		return true
+	}
+
+	var obj interface{}
+	if err := json.Unmarshal(args, &obj); err != nil {
+		return false
+	}
+	for path, raw := range f {
+		got, ok := lookupField(obj, path)
+		if !ok {
+			return false
+		}
+		var want interface{}
+		if err := json.Unmarshal(raw, &want); err != nil {
+			return false
+		}
+		if !reflect.DeepEqual(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupField returns the value of the field at the dot-separated path
+// in v, and false if there is no such field.
+func lookupField(v interface{}, path string) (interface{}, bool) {
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,35 @@
+package message
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterMatch(t *testing.T) {
+	t.Parallel()
+
+	args := json.RawMessage(`{"a":1,"b":{"c":"x","d":[1,2]},"e":null}`)
+	cases := []struct {
+		f   Filter
+		exp bool
+	}{
+		{nil, true},
+		{Filter{"a": json.RawMessage(`1`)}, true},
+		{Filter{"a": json.RawMessage(`2`)}, false},
+		{Filter{"a": json.RawMessage(`"1"`)}, false},
+		{Filter{"b.c": json.RawMessage(`"x"`)}, true},
+		{Filter{"b.d": json.RawMessage(`[1, 2]`)}, true},
+		{Filter{"a": json.RawMessage(`1`), "b.c": json.RawMessage(`"y"`)}, false},
+		{Filter{"e": json.RawMessage(`null`)}, true},
+		{Filter{"z": json.RawMessage(`null`)}, false},
+		{Filter{"a.b": json.RawMessage(`1`)}, false},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.exp, c.f.Match(args), "%d", i)
+	}
+
+	assert.False(t, Filter{"a": json.RawMessage(`1`)}.Match(json.RawMessage(`[1]`)), "not an object")
+	assert.False(t, Filter{"a": json.RawMessage(`1`)}.Match(nil), "no args")
+}
@@ -0,0 +1,81 @@
+package message
+
+import "fmt"
+
+// Limits defines the maximum length of the variable-length fields of
+// request messages. A value of 0 means no limit for that field.
+type Limits struct {
+	// MaxURILen is the maximum length, in bytes, of the URI of a CALL.
+	MaxURILen int
+
+	// MaxChannelLen is the maximum length, in bytes, of the channel
+	// of a SUB, UNSB or PUB.
+	MaxChannelLen int
+
+	// MaxCallArgs is the maximum size, in bytes, of the JSON-encoded
+	// arguments of a CALL.
+	MaxCallArgs int
+
+	// MaxPubArgs is the maximum size, in bytes, of the JSON-encoded
+	// arguments of a PUB.
+	MaxPubArgs int
+}
+
+// Codes of the LimitError, that can be used as Nack codes.
+const (
+	// CodeArgsTooLarge is the code used when the arguments of a
+	// CALL or PUB exceed the limit.
+	CodeArgsTooLarge = 413
+
+	// CodeURITooLong is the code used when the URI of a CALL
+	// exceeds the limit.
+	CodeURITooLong = 414
+
+	// CodeChannelTooLong is the code used when the channel of a
+	// SUB, UNSB or PUB exceeds the limit.
+	CodeChannelTooLong = 431
+)
+
+// LimitError is the error returned when a message field exceeds its
+// limit.
+type LimitError struct {
+	Field string // name of the field that exceeded its limit
+	Len   int    // actual length of the field
+	Max   int    // maximum length of the field
+	Code  int    // one of the Code* constants
+}
+
+// Error returns the error message of e.
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s exceeds limit: %d > %d", e.Field, e.Len, e.Max)
+}
+
+// Check validates the fields of the request message m against the
+// limits. It returns nil if m is valid or is not a request, a
+// *LimitError otherwise.
+func (l Limits) Check(m Msg) error {
+	switch m := m.(type) {
+	case *Call:
+		if err := checkLen("uri", len(m.Payload.URI), l.MaxURILen, CodeURITooLong); err != nil {
+			return err
+		}
+		return checkLen("args", len(m.Payload.Args), l.MaxCallArgs, CodeArgsTooLarge)
+	case *Pub:
+		if err := checkLen("channel", len(m.Payload.Channel), l.MaxChannelLen, CodeChannelTooLong); err != nil {
+			return err
+		}
+		return checkLen("args", len(m.Payload.Args), l.MaxPubArgs, CodeArgsTooLarge)
+	case *Sub:
+		return checkLen("channel", len(m.Payload.Channel), l.MaxChannelLen, CodeChannelTooLong)
+	case *Unsb:
+		return checkLen("channel", len(m.Payload.Channel), l.MaxChannelLen, CodeChannelTooLong)
+	}
+	return nil
+}
+
+func checkLen(field string, n, max, code int) error {
+	if max > 0 && n > max {
+		return &LimitError{Field: field, Len: n, Max: max, Code: code}
+	}
+	return nil
+}
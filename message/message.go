@@ -7,18 +7,25 @@
 //     - SUB  : to subscribe to a pub-sub channel
 //     - UNSB : to unsubscribe from a pub-sub channel
 //     - PUB  : to publish to a pub-sub channel
+//     - CHNK : to send a chunk of the arguments of a chunked CALL
 //
 // And the following messages for the server:
 //
 //     - ACK  : successful CALL (but no result yet), SUB, UNSB or PUB
 //     - NACK : failed CALL, SUB, UNSB or PUB
 //     - RES  : the result of a CALL message
+//     - RCHK : a chunk of the result of a CALL message, sent before its RES
 //     - EVNT : an event triggered on a channel that the client is subscribed to
 //
-// All messages must be of type websocket.TextMessage. Failing to properly
-// speak the protocol terminates the connection without notice from the
-// peer. That includes sending binary messages and sending unknown (or
-// invalid for the peer) message types.
+// All messages must be of type websocket.TextMessage, encoded in JSON.
+// Failing to properly speak the protocol terminates the connection
+// without notice from the peer. That includes sending binary messages
+// and sending unknown (or invalid for the peer) message types.
+//
+// The juggler.0+msgpack protocol defines the same messages, but they
+// are encoded in MessagePack and must be of type
+// websocket.BinaryMessage (see Codec). The juggler.0+proto protocol
+// encodes them in protocol buffers, as defined in juggler.proto.
 //
 package message
 
@@ -26,6 +33,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"time"
 
 	"github.com/pborman/uuid"
@@ -50,6 +58,14 @@ const (
 	EvntMsg
 	endWrite
 
+	// ChunkMsg is a read message, but it is defined after the write
+	// messages so that the values of the existing types don't change.
+	ChunkMsg
+
+	// ResChunkMsg is a write message, defined after ChunkMsg for the
+	// same reason.
+	ResChunkMsg
+
 	// customMsg allows for definition of custom message types,
 	// starting at ID 256 (first 255 are reserved).
 	customMsg Type = 256
@@ -58,14 +74,17 @@ const (
 var nextCustomMsg = customMsg
 
 var lookupType = map[Type]string{
-	CallMsg: "CALL",
-	PubMsg:  "PUB",
-	SubMsg:  "SUB",
-	UnsbMsg: "UNSB",
-	NackMsg: "NACK",
-	AckMsg:  "ACK",
-	ResMsg:  "RES",
-	EvntMsg: "EVNT",
+	CallMsg:  "CALL",
+	PubMsg:   "PUB",
+	SubMsg:   "SUB",
+	UnsbMsg:  "UNSB",
+	ChunkMsg: "CHNK",
+	NackMsg:  "NACK",
+	AckMsg:   "ACK",
+	ResMsg:   "RES",
+	EvntMsg:  "EVNT",
+
+	ResChunkMsg: "RCHK",
 }
 
 // Register registers a new custom message having the
@@ -109,14 +128,14 @@ func (mt Type) String() string {
 // point of view of the server (that is, if this is a message
 // that was sent by a client).
 func (mt Type) IsRead() bool {
-	return startRead < mt && mt < endRead
+	return (startRead < mt && mt < endRead) || mt == ChunkMsg
 }
 
 // IsWrite returns true if the message type is a "write" from the
 // point of view of the server (that is, if this is a message
 // that is being sent by the server).
 func (mt Type) IsWrite() bool {
-	return startWrite < mt && mt < endWrite
+	return (startWrite < mt && mt < endWrite) || mt == ResChunkMsg
 }
 
 // IsStd returns true if the message is a standard juggler message
@@ -132,12 +151,46 @@ type Msg interface {
 
 	// UUID is the unique identifier of the message.
 	UUID() uuid.UUID
+
+	// CorrelationID is the identifier used to correlate the message
+	// with the request that caused it.
+	CorrelationID() string
+
+	// Priority is the priority of the message (see Meta).
+	Priority() int
 }
 
-// Meta contains the metadata for a message.
+// Meta contains the metadata for a message. C is the correlation
+// ID, it is optional on requests sent by the client (the server
+// generates one if it is missing) and is set on the responses to the
+// correlation ID of the request, so that a single request can be
+// traced through the logs of the server, broker and callee.
+//
+// Z is the compression encoding of the payload's arguments, if they
+// are compressed (see Compress), and R is the reference of the blob
+// that holds the arguments, if they are offloaded (see Offload).
+//
+// P is the priority of the message, optional on CALL and PUB requests
+// and set on the responses and events to the priority of the request.
+// A message with a priority > 0 is latency-critical, and one with a
+// priority < 0 is not. The default of 0 is the normal priority, and
+// it depends on the type of the message: ACK, NACK and RES messages
+// are latency-critical, EVNT messages are not. The priority is
+// honored by the server's send queue (see juggler.WritePolicy) and by
+// the brokers that support it.
+//
+// K is the idempotency key of a CALL request, optional. It is the
+// same for all the attempts of a call that is retried by the client
+// (see client.SetRetryPolicy), so that the callees and brokers can
+// detect the duplicate calls.
 type Meta struct {
 	T Type      `json:"type"`
 	U uuid.UUID `json:"uuid"`
+	C string    `json:"correlation_id,omitempty"`
+	Z string    `json:"compression,omitempty"`
+	R string    `json:"blob_ref,omitempty"`
+	P int       `json:"priority,omitempty"`
+	K string    `json:"idempotency_key,omitempty"`
 }
 
 // NewMeta returns a new, initialized Meta.
@@ -162,24 +215,63 @@ func (m Meta) UUID() uuid.UUID {
 	return m.U
 }
 
+// CorrelationID returns the message's correlation ID.
+func (m Meta) CorrelationID() string {
+	return m.C
+}
+
+// Priority returns the message's priority.
+func (m Meta) Priority() int {
+	return m.P
+}
+
+// IdempotencyKey returns the message's idempotency key.
+func (m Meta) IdempotencyKey() string {
+	return m.K
+}
+
+func (m *Meta) setMeta(meta Meta) {
+	*m = meta
+}
+
 // Call is a message that triggers an RPC call to a callee
 // listening on the specified URI. The Args opaque field
 // is transferred as-is to the callee. If the result is not
 // available and sent back to the caller before the specified
 // timeout, it is dropped.
+//
+// If Chunked is true, Args is ignored and the arguments are sent
+// in the Chunk messages that follow the Call.
+//
+// If FanOut is set, the call is a fan-out call: it is dispatched to
+// each of the FanOut URIs, and URI only identifies the call in its
+// result. The results are combined in a single Res message once all
+// calls returned or the timeout expired, whose Args is a JSON array
+// of FanOutResult values. The combined result is an error only if all
+// calls failed. If Stream is true, each result is also sent as it is
+// received, in a Res message with the Partial flag set.
+//
+// If Binary is true, Args holds binary data, encoded as a JSON string
+// of the base64-encoded bytes (as encoding/json encodes a []byte).
+// With the BinaryCodec, such arguments are sent as raw bytes.
 type Call struct {
 	Meta    `json:"meta"`
 	Payload struct {
 		URI     string          `json:"uri"`
 		Timeout time.Duration   `json:"timeout"`
 		Args    json.RawMessage `json:"args"`
+		Chunked bool            `json:"chunked,omitempty"`
+		FanOut  []string        `json:"fanout,omitempty"`
+		Stream  bool            `json:"stream,omitempty"`
+		Binary  bool            `json:"binary,omitempty"`
 	} `json:"payload"`
 }
 
 // NewCall creates a Call message using the provided arguments. The uri
 // identifies the function to call. The args value is marshaled to JSON
 // and used as the parameters to the call. If the result is not available
-// before the timeout, it is dropped.
+// before the timeout, it is dropped. If args is a []byte, the Binary
+// flag is set.
 func NewCall(uri string, args interface{}, timeout time.Duration) (*Call, error) {
 	b, err := json.Marshal(args)
 	if err != nil {
@@ -192,17 +284,54 @@ func NewCall(uri string, args interface{}, timeout time.Duration) (*Call, error)
 	c.Payload.URI = uri
 	c.Payload.Timeout = timeout
 	c.Payload.Args = json.RawMessage(b)
+	c.Payload.Binary = isBytes(args)
 	return c, nil
 }
 
+// Chunk is a chunk of the arguments of a chunked Call message, that
+// is identified by the For field. The arguments of the call are the
+// concatenation of the Data of its chunks, in the order they are
+// sent, the last chunk having Final set to true. This allows sending
+// arguments that are larger than the read limit of the server.
+type Chunk struct {
+	Meta    `json:"meta"`
+	Payload struct {
+		For   uuid.UUID `json:"for"` // no ForType, because always CALL
+		Data  string    `json:"data"`
+		Final bool      `json:"final,omitempty"`
+	} `json:"payload"`
+}
+
+// NewChunk creates a Chunk message for the chunked call identified
+// by callUUID, with data as part of the arguments. If final is true,
+// it is the last chunk of the call.
+func NewChunk(callUUID uuid.UUID, data string, final bool) *Chunk {
+	ch := &Chunk{
+		Meta: NewMeta(ChunkMsg),
+	}
+	ch.Payload.For = callUUID
+	ch.Payload.Data = data
+	ch.Payload.Final = final
+	return ch
+}
+
 // Sub is a subscription message. It subscribes the caller to the
 // Channel, which is treated as a pattern if Pattern is true. The
-// pattern behaviour is the same as that of Redis.
+// pattern behaviour is the same as that of Redis. If Filter is set,
+// only the events that match it are sent to the caller. A new SUB
+// for the same Channel and Pattern replaces the filter.
+//
+// If LastEventID is set and the Channel is a durable channel (see
+// Evnt), the events published on the Channel after that event are
+// replayed to the caller after the ACK, as far as they are retained
+// by the broker. It is ignored for a pattern.
 type Sub struct {
 	Meta    `json:"meta"`
 	Payload struct {
-		Channel string `json:"channel"`
-		Pattern bool   `json:"pattern"`
+		Channel     string `json:"channel"`
+		Pattern     bool   `json:"pattern"`
+		Filter      Filter `json:"filter,omitempty"`
+		LastEventID string `json:"last_event_id,omitempty"`
 	} `json:"payload"`
 }
 
@@ -220,7 +349,8 @@ func NewSub(channel string, pattern bool) *Sub {
 
 // Unsb is an unsubscription message. It unsubscribes the caller from
 // the Channel, which is treated as a pattern if Pattern is true. The
-// pattern behaviour is the same as that of Redis.
+// pattern behaviour is the same as that of Redis. The Filter and
+// LastEventID are ignored.
 type Unsb Sub
 
 // NewUnsb creates an Unsb message using the provided arguments. The
@@ -237,18 +367,20 @@ func NewUnsb(channel string, pattern bool) *Unsb {
 
 // Pub is a publish message. It publishes an event on the specified
 // Channel. The Args opaque field is transferred as-is to subscribers
-// of that channel.
+// of that channel. Binary has the same meaning as for a Call.
 type Pub struct {
 	Meta    `json:"meta"`
 	Payload struct {
 		Channel string          `json:"channel"`
 		Args    json.RawMessage `json:"args"`
+		Binary  bool            `json:"binary,omitempty"`
 	} `json:"payload"`
 }
 
 // NewPub creates a Pub message using the provided arguments. The channel
 // identifies the channel on which this event is published. The args value
-// is marshaled to JSON and used as the payload of the event.
+// is marshaled to JSON and used as the payload of the event. If args
+// is a []byte, the Binary flag is set.
 func NewPub(channel string, args interface{}) (*Pub, error) {
 	b, err := json.Marshal(args)
 	if err != nil {
@@ -260,6 +392,7 @@ func NewPub(channel string, args interface{}) (*Pub, error) {
 	}
 	p.Payload.Channel = channel
 	p.Payload.Args = json.RawMessage(b)
+	p.Payload.Binary = isBytes(args)
 	return p, nil
 }
 
@@ -279,20 +412,41 @@ type Nack struct {
 		Code    int       `json:"code"`
 		Message string    `json:"message"` // defaults to Err.Error()
 		Err     error     `json:"-"`       // useful in the handler to have access to the source error, but not sent to the peer
+
+		// ErrCode is the machine-readable error code of the failure
+		// (one of the ErrCode* constants, or an application-defined
+		// code), and Retryable is true if the request may succeed if
+		// it is sent again later, e.g. when the server is overloaded.
+		ErrCode   string `json:"error_code,omitempty"`
+		Retryable bool   `json:"retryable,omitempty"`
+
+		// Details provides more information on the failure, e.g. the
+		// Details of a *ValidationError.
+		Details json.RawMessage `json:"details,omitempty"`
 	} `json:"payload"`
 }
 
 // NewNack creates a new Nack message to notify a failure to process
-// the from message.
+// the from message. Its ErrCode and Retryable fields are set based on
+// the code (see ErrCodeFor and IsRetryableCode).
 func NewNack(from Msg, code int, e error) *Nack {
 	nack := &Nack{
 		Meta: NewMeta(NackMsg),
 	}
+	nack.Meta.C = from.CorrelationID()
+	nack.Meta.P = from.Priority()
 	nack.Payload.For = from.UUID()
 	nack.Payload.ForType = from.Type()
 	nack.Payload.Code = code
+	nack.Payload.ErrCode = ErrCodeFor(code)
+	nack.Payload.Retryable = IsRetryableCode(code)
 	nack.Payload.Err = e
 	nack.Payload.Message = e.Error()
+	if ve, ok := e.(*ValidationError); ok && ve.Details != nil {
+		if b, err := json.Marshal(ve.Details); err == nil {
+			nack.Payload.Details = b
+		}
+	}
 
 	switch from := from.(type) {
 	case *Call:
@@ -303,6 +457,10 @@ func NewNack(from Msg, code int, e error) *Nack {
 		nack.Payload.Channel = from.Payload.Channel
 	case *Unsb:
 		nack.Payload.Channel = from.Payload.Channel
+	case *Chunk:
+		// a failed chunk fails the call
+		nack.Payload.For = from.Payload.For
+		nack.Payload.ForType = CallMsg
 
 		// other cases can happen e.g. if the message is too large
 		// instead of sending the "from" info from the never-sent
@@ -326,6 +484,10 @@ func NewNack(from Msg, code int, e error) *Nack {
 		nack.Payload.For = from.Payload.For
 		nack.Payload.ForType = CallMsg
 		nack.Payload.URI = from.Payload.URI
+	case *ResChunk:
+		nack.Payload.For = from.Payload.For
+		nack.Payload.ForType = CallMsg
+		nack.Payload.URI = from.Payload.URI
 	}
 	return nack
 }
@@ -341,6 +503,11 @@ type Ack struct {
 		ForType Type      `json:"for_type"`
 		URI     string    `json:"uri,omitempty"`     // when in response to a CALL
 		Channel string    `json:"channel,omitempty"` // when in response to a PUB, SUB or UNSB
+
+		// Delivered is the number of subscribers the event was delivered
+		// to, when in response to a PUB. It is nil if the broker doesn't
+		// report it.
+		Delivered *int `json:"delivered,omitempty"`
 	} `json:"payload"`
 }
 
@@ -350,6 +517,8 @@ func NewAck(from Msg) *Ack {
 	ack := &Ack{
 		Meta: NewMeta(AckMsg),
 	}
+	ack.Meta.C = from.CorrelationID()
+	ack.Meta.P = from.Priority()
 	ack.Payload.For = from.UUID()
 	ack.Payload.ForType = from.Type()
 
@@ -367,27 +536,53 @@ func NewAck(from Msg) *Ack {
 }
 
 // Res is a result message. It returns the result of the invocation
-// of a Call message.
+// of a Call message. Binary has the same meaning as for a Call.
 type Res struct {
 	Meta    `json:"meta"`
 	Payload struct {
-		For  uuid.UUID       `json:"for"`           // no ForType, because always CALL
-		URI  string          `json:"uri,omitempty"` // URI of the CALL
-		Args json.RawMessage `json:"args"`
+		For   uuid.UUID       `json:"for"`             // no ForType, because always CALL
+		URI   string          `json:"uri,omitempty"`   // URI of the CALL
+		Args  json.RawMessage `json:"args"`            // the result, or the error if Error is true
+		Error bool            `json:"error,omitempty"` // true if the callee returned an error
+
+		// Partial is true for the individual results of a fan-out call
+		// that streams its results, in which case URI is the fan-out URI
+		// that returned the result.
+		Partial bool `json:"partial,omitempty"`
+
+		Binary bool `json:"binary,omitempty"`
 	} `json:"payload"`
 }
 
+// FanOutResult is the result of a call to one of the fan-out URIs of
+// a fan-out Call. The combined result of a fan-out call is a JSON
+// array of FanOutResult values, in the order of the fan-out URIs.
+// Error is true if the call failed (Args is then the error), and
+// Timeout is true if no result was received before the timeout of
+// the call. If the fan-out call streams its results, Args is not
+// set, as it is sent in the partial result.
+type FanOutResult struct {
+	URI     string          `json:"uri"`
+	Args    json.RawMessage `json:"args,omitempty"`
+	Error   bool            `json:"error,omitempty"`
+	Timeout bool            `json:"timeout,omitempty"`
+}
+
 // ErrResult is the payload of a Res message when the call results in
 // an error (that is, the callee was invoked, and returned an error).
 // It marshals to {"error": {"message": "<error message>"}}, which is
-// similar to a standard Javascript error object.
+// similar to a standard Javascript error object. If the error has a
+// code or details (see callee.Error), they are added to the error
+// object as "code" and "details".
 //
 // To return a custom payload for an error, implement json.Marshaler
 // for the error type. All errors that do not implement json.Marshaler
 // are returned using ErrResult.
 type ErrResult struct {
 	Error struct {
-		Message string `json:"message"`
+		Message string          `json:"message"`
+		Code    int             `json:"code,omitempty"`
+		Details json.RawMessage `json:"details,omitempty"`
 	} `json:"error"`
 }
 
@@ -396,21 +591,64 @@ func NewRes(pld *ResPayload) *Res {
 	res := &Res{
 		Meta: NewMeta(ResMsg),
 	}
+	res.Meta.C = pld.CorrelationID
+	res.Meta.P = pld.Priority
 	res.Payload.For = pld.MsgUUID
 	res.Payload.URI = pld.URI
 	res.Payload.Args = pld.Args
+	res.Payload.Error = pld.Error
+	res.Payload.Binary = pld.Binary
 	return res
 }
 
+// ResChunk is a chunk of the result of a Call message, sent when the
+// callee streams its result (e.g. to report progress or to send a
+// large result set in parts, see callee.Callee.StoreResultChunk). The
+// stream is terminated by the Res message of the call. Seq is the
+// sequence number of the chunk, starting at 0, so that the caller can
+// order the chunks, as they may not be received in order (e.g. if the
+// call has a priority > 0). Binary has the same meaning as for a Call.
+type ResChunk struct {
+	Meta    `json:"meta"`
+	Payload struct {
+		For    uuid.UUID       `json:"for"`           // no ForType, because always CALL
+		URI    string          `json:"uri,omitempty"` // URI of the CALL
+		Args   json.RawMessage `json:"args"`
+		Seq    int             `json:"seq"`
+		Binary bool            `json:"binary,omitempty"`
+	} `json:"payload"`
+}
+
+// NewResChunk creates a new ResChunk message corresponding to a chunk
+// of a call result.
+func NewResChunk(pld *ResPayload) *ResChunk {
+	ch := &ResChunk{
+		Meta: NewMeta(ResChunkMsg),
+	}
+	ch.Meta.C = pld.CorrelationID
+	ch.Meta.P = pld.Priority
+	ch.Payload.For = pld.MsgUUID
+	ch.Payload.URI = pld.URI
+	ch.Payload.Args = pld.Args
+	ch.Payload.Seq = pld.Seq
+	ch.Payload.Binary = pld.Binary
+	return ch
+}
+
 // Evnt is a published event. It is sent to all subscribers of the
-// Channel.
+// Channel. If the Channel is durable, that is if the broker stores its
+// events so that they can be replayed, ID is the identifier of the
+// event in the Channel, to set as LastEventID on a SUB to receive the
+// events that follow. Binary has the same meaning as for a Call.
 type Evnt struct {
 	Meta    `json:"meta"`
 	Payload struct {
 		For     uuid.UUID       `json:"for"` // no ForType, because always PUB
 		Channel string          `json:"channel,omitempty"`
 		Pattern string          `json:"pattern,omitempty"` // if triggered because of a pattern-based subscription
+		ID      string          `json:"id,omitempty"`      // if sent on a durable channel
 		Args    json.RawMessage `json:"args"`
+		Binary  bool            `json:"binary,omitempty"`
 	} `json:"payload"`
 }
 
@@ -420,20 +658,38 @@ func NewEvnt(pld *EvntPayload) *Evnt {
 	ev := &Evnt{
 		Meta: NewMeta(EvntMsg),
 	}
+	ev.Meta.C = pld.CorrelationID
+	ev.Meta.P = pld.Priority
 	ev.Payload.Channel = pld.Channel
 	ev.Payload.Pattern = pld.Pattern
+	ev.Payload.ID = pld.EventID
 	ev.Payload.For = pld.MsgUUID
 	ev.Payload.Args = pld.Args
+	ev.Payload.Binary = pld.Binary
+	ev.Meta.R = pld.OffloadRef
 	return ev
 }
 
-var allReqMsgs = []Type{CallMsg, SubMsg, UnsbMsg, PubMsg}
+// isBytes returns true if v is a []byte, that encoding/json encodes as
+// a base64 string.
+func isBytes(v interface{}) bool {
+	_, ok := v.([]byte)
+	return ok
+}
+
+var allReqMsgs = []Type{CallMsg, SubMsg, UnsbMsg, PubMsg, ChunkMsg}
 
 // UnmarshalRequest unmarshals a JSON-encoded message from r into the
 // correct concrete message type. It returns an error if the message
 // type is invalid for a request (client -> server) and for the restricted
 // list of allowed messages, if any.
 func UnmarshalRequest(r io.Reader, allowedMsgs ...Type) (Msg, error) {
+	return UnmarshalRequestCodec(JSONCodec, r, allowedMsgs...)
+}
+
+// UnmarshalRequestCodec is like UnmarshalRequest, but the message is
+// decoded using the codec c.
+func UnmarshalRequestCodec(c Codec, r io.Reader, allowedMsgs ...Type) (Msg, error) {
 	var cleaned []Type
 	for _, t := range allowedMsgs {
 		if t.IsRead() {
@@ -443,20 +699,39 @@ func UnmarshalRequest(r io.Reader, allowedMsgs ...Type) (Msg, error) {
 	if len(cleaned) == 0 {
 		cleaned = allReqMsgs
 	}
-	return unmarshalIf(r, cleaned...)
+	return unmarshalIf(c, r, cleaned...)
+}
+
+// UnmarshalRequestLimits is like UnmarshalRequestCodec, and it also
+// checks the fields of the message against the limits l (see
+// Limits.Check). If a field exceeds its limit, it returns the decoded
+// message along with the *LimitError, so that the request can be
+// rejected with a Nack with the code of the error.
+func UnmarshalRequestLimits(c Codec, r io.Reader, l Limits, allowedMsgs ...Type) (Msg, error) {
+	m, err := UnmarshalRequestCodec(c, r, allowedMsgs...)
+	if err != nil {
+		return nil, err
+	}
+	return m, l.Check(m)
 }
 
 // UnmarshalResponse unmarshals a JSON-encoded message from r into the
 // correct concrete message type. It returns an error if the message
 // type is invalid for a response (client <- server).
 func UnmarshalResponse(r io.Reader) (Msg, error) {
-	return unmarshalIf(r, NackMsg, AckMsg, EvntMsg, ResMsg)
+	return UnmarshalResponseCodec(JSONCodec, r)
+}
+
+// UnmarshalResponseCodec is like UnmarshalResponse, but the message is
+// decoded using the codec c.
+func UnmarshalResponseCodec(c Codec, r io.Reader) (Msg, error) {
+	return unmarshalIf(c, r, NackMsg, AckMsg, EvntMsg, ResMsg, ResChunkMsg)
 }
 
 // Unmarshal unmarshals a JSON-encoded message from r into the correct
 // concrete message type.
 func Unmarshal(r io.Reader) (Msg, error) {
-	return unmarshalIf(r)
+	return unmarshalIf(JSONCodec, r)
 }
 
 func isIn(list []Type, v Type) bool {
@@ -468,89 +743,83 @@ func isIn(list []Type, v Type) bool {
 	return false
 }
 
-func unmarshalIf(r io.Reader, allowed ...Type) (Msg, error) {
-	var pm partialMsg
-	if err := json.NewDecoder(r).Decode(&pm); err != nil {
-		return nil, fmt.Errorf("invalid JSON message: %v", err)
-	}
-
-	if len(allowed) > 0 && !isIn(allowed, pm.Meta.T) {
-		return nil, fmt.Errorf("invalid message %s for this peer", pm.Meta.T)
-	}
-
-	genericUnmarshal := func(v interface{}, metaDst *Meta) error {
-		var b []byte
-		b = append(b, `{"payload":`...)
-		b = append(b, pm.Payload...)
-		b = append(b, '}')
-		if err := json.Unmarshal(b, v); err != nil {
-			return fmt.Errorf("invalid %s message: %v", pm.Meta.T, err)
-		}
-		*metaDst = pm.Meta
-		return nil
-	}
-
-	var m Msg
-	switch pm.Meta.T {
+// newMsg returns a new zero value of the concrete message type t, or
+// nil if t is not a standard message type.
+func newMsg(t Type) Msg {
+	switch t {
 	case CallMsg:
-		var call Call
-		if err := genericUnmarshal(&call, &call.Meta); err != nil {
-			return nil, err
-		}
-		m = &call
-
+		return &Call{}
 	case SubMsg:
-		var sub Sub
-		if err := genericUnmarshal(&sub, &sub.Meta); err != nil {
-			return nil, err
-		}
-		m = &sub
-
+		return &Sub{}
 	case UnsbMsg:
-		var uns Unsb
-		if err := genericUnmarshal(&uns, &uns.Meta); err != nil {
-			return nil, err
-		}
-		m = &uns
-
+		return &Unsb{}
 	case PubMsg:
-		var pub Pub
-		if err := genericUnmarshal(&pub, &pub.Meta); err != nil {
-			return nil, err
-		}
-		m = &pub
-
+		return &Pub{}
+	case ChunkMsg:
+		return &Chunk{}
 	case NackMsg:
-		var nack Nack
-		if err := genericUnmarshal(&nack, &nack.Meta); err != nil {
-			return nil, err
-		}
-		m = &nack
-
+		return &Nack{}
 	case AckMsg:
-		var ack Ack
-		if err := genericUnmarshal(&ack, &ack.Meta); err != nil {
-			return nil, err
-		}
-		m = &ack
-
+		return &Ack{}
 	case ResMsg:
-		var res Res
-		if err := genericUnmarshal(&res, &res.Meta); err != nil {
-			return nil, err
-		}
-		m = &res
-
+		return &Res{}
+	case ResChunkMsg:
+		return &ResChunk{}
 	case EvntMsg:
-		var ev Evnt
-		if err := genericUnmarshal(&ev, &ev.Meta); err != nil {
+		return &Evnt{}
+	}
+	return nil
+}
+
+func unmarshalIf(c Codec, r io.Reader, allowed ...Type) (Msg, error) {
+	var (
+		meta   Meta
+		decode func(Msg) error
+	)
+
+	if _, ok := c.(jsonCodec); ok {
+		// decode the payload only once the type is known
+		var pm partialMsg
+		if err := json.NewDecoder(r).Decode(&pm); err != nil {
+			return nil, fmt.Errorf("invalid JSON message: %v", err)
+		}
+		meta = pm.Meta
+		decode = func(m Msg) error {
+			var b []byte
+			b = append(b, `{"payload":`...)
+			b = append(b, pm.Payload...)
+			b = append(b, '}')
+			return json.Unmarshal(b, m)
+		}
+	} else {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
 			return nil, err
 		}
-		m = &ev
+		var hdr header
+		if err := c.Unmarshal(b, &hdr); err != nil {
+			return nil, fmt.Errorf("invalid message: %v", err)
+		}
+		meta = hdr.Meta
+		decode = func(m Msg) error {
+			return c.Unmarshal(b, m)
+		}
+	}
 
-	default:
-		return nil, fmt.Errorf("unknown message %s", pm.Meta.T)
+	if len(allowed) > 0 && !isIn(allowed, meta.T) {
+		return nil, fmt.Errorf("invalid message %s for this peer", meta.T)
+	}
+
+	m := newMsg(meta.T)
+	if m == nil {
+		return nil, fmt.Errorf("unknown message %s", meta.T)
+	}
+	if err := decode(m); err != nil {
+		return nil, fmt.Errorf("invalid %s message: %v", meta.T, err)
 	}
 
+	m.(interface {
+		setMeta(Meta)
+	}).setMeta(meta)
 	return m, nil
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -55,6 +56,8 @@ func TestMarshalUnmarshal(t *testing.T) {
 		NewAck(pub),
 		NewRes(rp),
 		NewEvnt(ep),
+		NewChunk(call.UUID(), `{"a":`, false),
+		NewResChunk(&ResPayload{MsgUUID: call.UUID(), URI: "a", Args: json.RawMessage(`1`), Chunk: true, Seq: 2}),
 	}
 	for i, m := range cases {
 		b, err := json.Marshal(m)
@@ -93,6 +96,121 @@ func TestNewNackFromAck(t *testing.T) {
 	assert.Equal(t, nack.Payload.Channel, ack.Payload.Channel, "Channel")
 }
 
+func TestPriority(t *testing.T) {
+	t.Parallel()
+
+	call, err := NewCall("a", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	call.Meta.P = 2
+
+	assert.Equal(t, 2, NewAck(call).Priority(), "Ack")
+	assert.Equal(t, 2, NewNack(call, 500, io.EOF).Priority(), "Nack")
+	assert.Equal(t, 2, NewNack(NewAck(call), 500, io.EOF).Priority(), "Nack from Ack")
+	assert.Equal(t, -1, NewRes(&ResPayload{Priority: -1}).Priority(), "Res")
+	assert.Equal(t, 3, NewEvnt(&EvntPayload{Priority: 3}).Priority(), "Evnt")
+
+	b, err := json.Marshal(call)
+	require.NoError(t, err, "Marshal")
+	m, err := Unmarshal(bytes.NewReader(b))
+	require.NoError(t, err, "Unmarshal")
+	assert.Equal(t, 2, m.Priority(), "unmarshaled priority")
+}
+
+func TestCorrelationID(t *testing.T) {
+	t.Parallel()
+
+	pub, err := NewPub("d", nil)
+	require.NoError(t, err, "NewPub")
+	pub.Meta.C = "abc"
+
+	assert.Equal(t, "abc", NewAck(pub).CorrelationID(), "Ack")
+	assert.Equal(t, "abc", NewNack(pub, 500, io.EOF).CorrelationID(), "Nack")
+	assert.Equal(t, "abc", NewNack(NewAck(pub), 500, io.EOF).CorrelationID(), "Nack from Ack")
+	assert.Equal(t, "def", NewRes(&ResPayload{CorrelationID: "def"}).CorrelationID(), "Res")
+	assert.Equal(t, "ghi", NewEvnt(&EvntPayload{CorrelationID: "ghi"}).CorrelationID(), "Evnt")
+
+	b, err := json.Marshal(pub)
+	require.NoError(t, err, "Marshal")
+	got, err := Unmarshal(bytes.NewReader(b))
+	require.NoError(t, err, "Unmarshal")
+	assert.Equal(t, "abc", got.CorrelationID(), "unmarshaled")
+}
+
+func TestCompress(t *testing.T) {
+	t.Parallel()
+
+	args := strings.Repeat("abcd", 100)
+	for _, enc := range []string{Gzip, Deflate} {
+		res := NewRes(&ResPayload{Args: json.RawMessage(`"` + args + `"`)})
+
+		// below the threshold
+		m, err := Compress(res, enc, 1000)
+		require.NoError(t, err, "%s: Compress below threshold", enc)
+		assert.True(t, m == Msg(res), "%s: same message below threshold", enc)
+
+		m, err = Compress(res, enc, 10)
+		require.NoError(t, err, "%s: Compress", enc)
+		cres := m.(*Res)
+		assert.Equal(t, enc, cres.Meta.Z, "%s: compression set", enc)
+		assert.True(t, len(cres.Payload.Args) < len(res.Payload.Args), "%s: compressed", enc)
+		assert.Equal(t, "", res.Meta.Z, "%s: source message unchanged", enc)
+
+		// marshal and unmarshal the compressed message
+		b, err := json.Marshal(cres)
+		require.NoError(t, err, "%s: Marshal", enc)
+		got, err := Unmarshal(bytes.NewReader(b))
+		require.NoError(t, err, "%s: Unmarshal", enc)
+
+		assert.Equal(t, ErrDecompressedTooLarge, Decompress(got, 10), "%s: Decompress too large", enc)
+		require.NoError(t, Decompress(got, 0), "%s: Decompress", enc)
+		assert.Equal(t, "", got.(*Res).Meta.Z, "%s: compression cleared", enc)
+		assert.Equal(t, `"`+args+`"`, string(got.(*Res).Payload.Args), "%s: decompressed args", enc)
+	}
+
+	_, err := Compress(NewRes(&ResPayload{Args: json.RawMessage(`"` + args + `"`)}), "zip", 10)
+	assert.Error(t, err, "unsupported compression")
+}
+
+func TestOffload(t *testing.T) {
+	t.Parallel()
+
+	blobs := make(map[string][]byte)
+	put := func(b []byte) (string, error) {
+		ref := fmt.Sprintf("%d", len(blobs))
+		blobs[ref] = b
+		return ref, nil
+	}
+	get := func(ref string) ([]byte, error) {
+		b, ok := blobs[ref]
+		if !ok {
+			return nil, io.EOF
+		}
+		return b, nil
+	}
+
+	ev := NewEvnt(&EvntPayload{Args: json.RawMessage(`"abcdef"`)})
+	m, err := Offload(ev, 10, put)
+	require.NoError(t, err, "Offload below threshold")
+	assert.True(t, m == Msg(ev), "same message below threshold")
+
+	m, err = Offload(ev, 2, put)
+	require.NoError(t, err, "Offload")
+	oev := m.(*Evnt)
+	assert.Equal(t, "0", oev.Meta.R, "blob reference")
+	assert.Equal(t, "null", string(oev.Payload.Args), "offloaded args")
+	assert.Equal(t, `"abcdef"`, string(ev.Payload.Args), "source message unchanged")
+
+	require.NoError(t, Resolve(oev, get), "Resolve")
+	assert.Equal(t, "", oev.Meta.R, "blob reference cleared")
+	assert.Equal(t, `"abcdef"`, string(oev.Payload.Args), "resolved args")
+
+	oev.Meta.R = "x"
+	assert.Equal(t, io.EOF, Resolve(oev, get), "Resolve unknown reference")
+
+	_, err = Offload(ev, 2, func([]byte) (string, error) { return "", io.ErrShortWrite })
+	assert.Equal(t, io.ErrShortWrite, err, "Offload failure")
+}
+
 func TestRegister(t *testing.T) {
 	nm := uuid.NewRandom().String() // avoid failures when running tests multiple times
 
@@ -116,7 +234,7 @@ func TestUnmarshalIfUnknown(t *testing.T) {
 	meta := NewMeta(Type(-1)) // invalid message
 	b, err := json.Marshal(partialMsg{Meta: meta})
 	require.NoError(t, err, "Marshal failed")
-	_, err = unmarshalIf(bytes.NewReader(b), Type(-1))
+	_, err = unmarshalIf(JSONCodec, bytes.NewReader(b), Type(-1))
 	assert.Error(t, err)
 	t.Log(err)
 }
@@ -161,3 +279,66 @@ func TestUnmarshalRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestLimitsCheck(t *testing.T) {
+	call, err := NewCall("abcd", "xyz", time.Second)
+	require.NoError(t, err, "NewCall")
+	pub, err := NewPub("abcd", "xyz")
+	require.NoError(t, err, "NewPub")
+	rp := &ResPayload{URI: "abcdef", Args: json.RawMessage(`"abcdef"`)}
+
+	cases := []struct {
+		l     Limits
+		m     Msg
+		field string
+		code  int
+	}{
+		{Limits{}, call, "", 0},
+		{Limits{MaxURILen: 4, MaxCallArgs: 5}, call, "", 0},
+		{Limits{MaxURILen: 3}, call, "uri", CodeURITooLong},
+		{Limits{MaxCallArgs: 4}, call, "args", CodeArgsTooLarge},
+		{Limits{MaxPubArgs: 4}, call, "", 0},
+		{Limits{MaxChannelLen: 4, MaxPubArgs: 5}, pub, "", 0},
+		{Limits{MaxChannelLen: 3}, pub, "channel", CodeChannelTooLong},
+		{Limits{MaxPubArgs: 4}, pub, "args", CodeArgsTooLarge},
+		{Limits{MaxChannelLen: 3}, NewSub("abcd", false), "channel", CodeChannelTooLong},
+		{Limits{MaxChannelLen: 3}, NewUnsb("abcd", true), "channel", CodeChannelTooLong},
+		{Limits{MaxURILen: 1, MaxCallArgs: 1}, NewRes(rp), "", 0},
+	}
+	for i, c := range cases {
+		err := c.l.Check(c.m)
+		if c.field == "" {
+			assert.NoError(t, err, "%d", i)
+			continue
+		}
+		if le, ok := err.(*LimitError); assert.True(t, ok, "%d: expected *LimitError, got %v", i, err) {
+			assert.Equal(t, c.field, le.Field, "%d: field", i)
+			assert.Equal(t, c.code, le.Code, "%d: code", i)
+		}
+	}
+}
+
+func TestUnmarshalRequestLimits(t *testing.T) {
+	pub, err := NewPub("abcd", "xyz")
+	require.NoError(t, err, "NewPub")
+	b, err := json.Marshal(pub)
+	require.NoError(t, err, "Marshal")
+
+	m, err := UnmarshalRequestLimits(JSONCodec, bytes.NewReader(b), Limits{MaxChannelLen: 4})
+	require.NoError(t, err, "within limits")
+	assert.Equal(t, pub.UUID(), m.UUID(), "within limits UUID")
+
+	// the message is returned with the error, so that it can be NACKed
+	m, err = UnmarshalRequestLimits(JSONCodec, bytes.NewReader(b), Limits{MaxChannelLen: 3})
+	if le, ok := err.(*LimitError); assert.True(t, ok, "expected *LimitError, got %v", err) {
+		assert.Equal(t, CodeChannelTooLong, le.Code, "code")
+	}
+	if assert.NotNil(t, m, "message") {
+		assert.Equal(t, pub.UUID(), m.UUID(), "exceeded UUID")
+	}
+
+	// invalid requests are not returned
+	m, err = UnmarshalRequestLimits(JSONCodec, bytes.NewReader(b), Limits{MaxChannelLen: 3}, CallMsg)
+	assert.Error(t, err, "not allowed")
+	assert.Nil(t, m, "not allowed message")
+}
@@ -0,0 +1,71 @@
+package message
+
+import "encoding/json"
+
+// Machine-readable error codes of the Nack messages, set by NewNack
+// based on the Nack code (see ErrCodeFor).
+const (
+	ErrCodeBadRequest      = "bad_request"     // 400, e.g. invalid arguments
+	ErrCodeUnauthenticated = "unauthenticated" // 401
+	ErrCodeForbidden       = "forbidden"       // 403
+	ErrCodeNotFound        = "not_found"       // 404, e.g. URI not allowed
+	ErrCodeTooLarge        = "too_large"       // 413, 414 and 431
+	ErrCodeRateLimited     = "rate_limited"    // 429
+	ErrCodeInternal        = "internal"        // 500 and other codes
+	ErrCodeUnavailable     = "unavailable"     // 503, e.g. degraded mode
+	ErrCodeTimeout         = "timeout"         // 504
+)
+
+// ErrCodeFor returns the error code that corresponds to the Nack
+// code. The codes that don't have a specific error code return
+// ErrCodeBadRequest if they are in the 4xx range, ErrCodeInternal
+// otherwise.
+func ErrCodeFor(code int) string {
+	switch code {
+	case 400:
+		return ErrCodeBadRequest
+	case 401:
+		return ErrCodeUnauthenticated
+	case 403:
+		return ErrCodeForbidden
+	case 404:
+		return ErrCodeNotFound
+	case 413, 414, 431:
+		return ErrCodeTooLarge
+	case 429:
+		return ErrCodeRateLimited
+	case 503:
+		return ErrCodeUnavailable
+	case 504:
+		return ErrCodeTimeout
+	}
+	if code >= 400 && code < 500 {
+		return ErrCodeBadRequest
+	}
+	return ErrCodeInternal
+}
+
+// IsRetryableCode returns true if a request rejected with the Nack
+// code may succeed if it is sent again later, that is if the code is
+// 429 or in the 5xx range.
+func IsRetryableCode(code int) bool {
+	return code == 429 || (code >= 500 && code < 600)
+}
+
+// NewNackWithDetails creates a new Nack message like NewNack, with
+// the machine-readable errCode and the details, encoded in JSON. If
+// errCode is empty, the error code of the Nack code is used. The
+// details are ignored if they cannot be encoded. The Retryable flag
+// is set based on the code and can be changed on the returned Nack.
+func NewNackWithDetails(from Msg, code int, errCode string, e error, details interface{}) *Nack {
+	nack := NewNack(from, code, e)
+	if errCode != "" {
+		nack.Payload.ErrCode = errCode
+	}
+	if details != nil {
+		if b, err := json.Marshal(details); err == nil {
+			nack.Payload.Details = b
+		}
+	}
+	return nack
+}
@@ -0,0 +1,65 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrCodeFor(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		code      int
+		errCode   string
+		retryable bool
+	}{
+		{400, ErrCodeBadRequest, false},
+		{401, ErrCodeUnauthenticated, false},
+		{403, ErrCodeForbidden, false},
+		{404, ErrCodeNotFound, false},
+		{409, ErrCodeBadRequest, false},
+		{413, ErrCodeTooLarge, false},
+		{414, ErrCodeTooLarge, false},
+		{431, ErrCodeTooLarge, false},
+		{429, ErrCodeRateLimited, true},
+		{500, ErrCodeInternal, true},
+		{503, ErrCodeUnavailable, true},
+		{504, ErrCodeTimeout, true},
+		{0, ErrCodeInternal, false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.errCode, ErrCodeFor(c.code), "%d: error code", c.code)
+		assert.Equal(t, c.retryable, IsRetryableCode(c.code), "%d: retryable", c.code)
+	}
+}
+
+func TestNewNackWithDetails(t *testing.T) {
+	t.Parallel()
+
+	call, err := NewCall("a", "x", 0)
+	require.NoError(t, err, "NewCall")
+
+	nack := NewNackWithDetails(call, 503, "", errors.New("overloaded"), map[string]int{"retry_after": 2})
+	assert.Equal(t, ErrCodeUnavailable, nack.Payload.ErrCode, "default error code")
+	assert.True(t, nack.Payload.Retryable, "retryable")
+	assert.Equal(t, `{"retry_after":2}`, string(nack.Payload.Details), "details")
+
+	nack = NewNackWithDetails(call, 400, "quota_exceeded", errors.New("quota"), nil)
+	assert.Equal(t, "quota_exceeded", nack.Payload.ErrCode, "error code")
+	assert.False(t, nack.Payload.Retryable, "not retryable")
+	assert.Nil(t, nack.Payload.Details, "no details")
+
+	b, err := json.Marshal(nack)
+	require.NoError(t, err, "Marshal")
+	m, err := UnmarshalResponse(bytes.NewReader(b))
+	require.NoError(t, err, "UnmarshalResponse")
+	if got, ok := m.(*Nack); assert.True(t, ok, "Nack") {
+		assert.Equal(t, "quota_exceeded", got.Payload.ErrCode, "unmarshaled error code")
+		assert.Equal(t, 400, got.Payload.Code, "unmarshaled code")
+	}
+}
@@ -15,6 +15,34 @@ type CallPayload struct {
 	URI      string          `json:"uri"`
 	Args     json.RawMessage `json:"args,omitempty"`
 
+	// CorrelationID is the correlation ID of the Call message.
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	// Priority is the priority of the Call message.
+	Priority int `json:"priority,omitempty"`
+
+	// IdempotencyKey is the idempotency key of the Call message, the
+	// same for all the attempts of a retried call.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Compression is the compression encoding of Args, if they are
+	// compressed by the broker (see CompressArgs).
+	Compression string `json:"compression,omitempty"`
+
+	// BlobRef is the reference of the blob that holds the arguments,
+	// if they are offloaded by the broker (see broker.BlobStore).
+	BlobRef string `json:"blob_ref,omitempty"`
+
+	// Binary is true if Args holds binary data, encoded as a JSON
+	// string of the base64-encoded bytes (see Call).
+	Binary bool `json:"binary,omitempty"`
+
+	// ResultsQueue is the name of the queue where the result of the
+	// call must be stored, if the broker of the caller dispatches the
+	// results of all its connections from a shared queue (see
+	// redisbroker.Broker.Dispatchers).
+	ResultsQueue string `json:"results_queue,omitempty"`
+
 	// TTLAfterRead is the time-to-live remaining for the call request
 	// once it has been extracted from the connector and just before it
 	// is sent for processing to the callee.
@@ -34,18 +62,63 @@ type ResPayload struct {
 	MsgUUID  uuid.UUID       `json:"msg_uuid"`
 	URI      string          `json:"uri"`
 	Args     json.RawMessage `json:"args,omitempty"`
+
+	// Error is true if the callee returned an error, in which case
+	// Args is the JSON-encoded error (see ErrResult).
+	Error bool `json:"error,omitempty"`
+
+	// Chunk is true if the payload is a chunk of the result, sent as a
+	// ResChunk message, in which case Seq is its sequence number.
+	Chunk bool `json:"chunk,omitempty"`
+	Seq   int  `json:"seq,omitempty"`
+
+	// CorrelationID is the correlation ID of the call request.
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	// Priority is the priority of the call request.
+	Priority int `json:"priority,omitempty"`
+
+	// Compression is the compression encoding of Args, if they are
+	// compressed by the broker (see CompressArgs).
+	Compression string `json:"compression,omitempty"`
+
+	// BlobRef is the reference of the blob that holds the arguments,
+	// if they are offloaded by the broker (see broker.BlobStore).
+	BlobRef string `json:"blob_ref,omitempty"`
+
+	// Binary is true if Args holds binary data, encoded as a JSON
+	// string of the base64-encoded bytes (see Call).
+	Binary bool `json:"binary,omitempty"`
+
+	// ResultsQueue is the name of the queue where the result of the
+	// call must be stored, if the broker of the caller dispatches the
+	// results of all its connections from a shared queue (see
+	// redisbroker.Broker.Dispatchers).
+	ResultsQueue string `json:"results_queue,omitempty"`
 }
 
 // PubPayload is the payload to publish an event.
 type PubPayload struct {
-	MsgUUID uuid.UUID       `json:"msg_uuid"`
-	Args    json.RawMessage `json:"args,omitempty"`
+	MsgUUID       uuid.UUID       `json:"msg_uuid"`
+	Args          json.RawMessage `json:"args,omitempty"`
+	CorrelationID string          `json:"correlation_id,omitempty"` // of the Pub message
+	Priority      int             `json:"priority,omitempty"`       // of the Pub message
+	Compression   string          `json:"compression,omitempty"`    // of Args, if compressed by the broker
+	BlobRef       string          `json:"blob_ref,omitempty"`       // of Args, if offloaded by the broker
+	EventID       string          `json:"event_id,omitempty"`       // set by the broker on a durable channel
+	Binary        bool            `json:"binary,omitempty"`         // if Args holds binary data (see Call)
+	OffloadRef    string          `json:"offload_ref,omitempty"`    // of Args, if offloaded by the server (see Offload)
 }
 
 // EvntPayload is the payload of an event received by a subscriber.
 type EvntPayload struct {
-	MsgUUID uuid.UUID       `json:"msg_uuid"`
-	Channel string          `json:"channel"`           // channel on which the event was sent
-	Pattern string          `json:"pattern,omitempty"` // if received because of a pattern-based subscription
-	Args    json.RawMessage `json:"args,omitempty"`
+	MsgUUID       uuid.UUID       `json:"msg_uuid"`
+	Channel       string          `json:"channel"`            // channel on which the event was sent
+	Pattern       string          `json:"pattern,omitempty"`  // if received because of a pattern-based subscription
+	EventID       string          `json:"event_id,omitempty"` // if sent on a durable channel
+	Args          json.RawMessage `json:"args,omitempty"`
+	CorrelationID string          `json:"correlation_id,omitempty"` // of the Pub message
+	Priority      int             `json:"priority,omitempty"`       // of the Pub message
+	Binary        bool            `json:"binary,omitempty"`         // if Args holds binary data (see Call)
+	OffloadRef    string          `json:"offload_ref,omitempty"`    // of Args, if offloaded by the server (see Offload)
 }
@@ -0,0 +1,563 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/pborman/uuid"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ProtobufSuffix is the suffix of the juggler subprotocols that use the
+// protocol buffers encoding (e.g. "juggler.0+proto").
+const ProtobufSuffix = "+proto"
+
+// ProtobufCodec encodes messages in protocol buffers, as defined by
+// the Msg message of juggler.proto, so that clients in other languages
+// can generate their bindings. The arguments are sent as the bytes of
+// their JSON encoding, or as raw bytes if the message has binary
+// arguments. It is the codec of the subprotocols with the
+// ProtobufSuffix.
+var ProtobufCodec Codec = protobufCodec{}
+
+// ErrInvalidProtobuf is returned by ProtobufCodec when decoding a
+// message that is not a valid juggler protocol buffers message.
+var ErrInvalidProtobuf = errors.New("juggler/message: invalid protobuf message")
+
+// field numbers of the Msg protocol buffers message, the payload
+// fields are numbered by message Type.
+const pbMetaField protowire.Number = 15
+
+type protobufCodec struct{}
+
+func (protobufCodec) Binary() bool { return true }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(Msg)
+	if !ok || newMsg(m.Type()) == nil {
+		return nil, fmt.Errorf("juggler/message: cannot encode %T in protobuf", v)
+	}
+
+	var b pbBuffer
+	b.message(pbMetaField, pbMeta(m))
+	b.message(protowire.Number(m.Type()), pbPayload(m))
+	return b, nil
+}
+
+// header is the metadata of an encoded message, decoded before the
+// message itself to check its type.
+type header struct {
+	Meta Meta `json:"meta"`
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, err := decodeProtobuf(data)
+	if err != nil {
+		return err
+	}
+
+	if hdr, ok := v.(*header); ok {
+		hdr.Meta = *metaOf(m)
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Type() != reflect.TypeOf(m) {
+		return fmt.Errorf("juggler/message: cannot decode %s message in %T", m.Type(), v)
+	}
+	rv.Elem().Set(reflect.ValueOf(m).Elem())
+	return nil
+}
+
+// metaOf returns a pointer to the metadata of the standard message m.
+func metaOf(m Msg) *Meta {
+	return reflect.ValueOf(m).Elem().FieldByName("Meta").Addr().Interface().(*Meta)
+}
+
+func pbMeta(m Msg) pbBuffer {
+	meta := metaOf(m)
+
+	var b pbBuffer
+	b.bytes(1, meta.U)
+	b.string(2, meta.C)
+	b.string(3, meta.Z)
+	b.string(4, meta.R)
+	b.sint(5, int64(meta.P))
+	b.string(6, meta.K)
+	return b
+}
+
+func pbPayload(m Msg) pbBuffer {
+	var b pbBuffer
+	switch m := m.(type) {
+	case *Call:
+		binary, args := pbArgs(m.Payload.Binary, m.Payload.Args)
+		b.string(1, m.Payload.URI)
+		b.varint(2, uint64(m.Payload.Timeout))
+		b.bytes(3, args)
+		b.bool(4, m.Payload.Chunked)
+		for _, uri := range m.Payload.FanOut {
+			b.field(5, protowire.BytesType)
+			b = protowire.AppendString(b, uri)
+		}
+		b.bool(6, m.Payload.Stream)
+		b.bool(7, binary)
+
+	case *Chunk:
+		b.bytes(1, m.Payload.For)
+		b.string(2, m.Payload.Data)
+		b.bool(3, m.Payload.Final)
+
+	case *Sub:
+		pbSub(&b, m.Payload.Channel, m.Payload.Pattern, m.Payload.Filter, m.Payload.LastEventID)
+
+	case *Unsb:
+		pbSub(&b, m.Payload.Channel, m.Payload.Pattern, m.Payload.Filter, m.Payload.LastEventID)
+
+	case *Pub:
+		binary, args := pbArgs(m.Payload.Binary, m.Payload.Args)
+		b.string(1, m.Payload.Channel)
+		b.bytes(2, args)
+		b.bool(3, binary)
+
+	case *Nack:
+		b.bytes(1, m.Payload.For)
+		b.varint(2, uint64(m.Payload.ForType))
+		b.string(3, m.Payload.URI)
+		b.string(4, m.Payload.Channel)
+		b.sint(5, int64(m.Payload.Code))
+		b.string(6, m.Payload.Message)
+		b.bytes(7, m.Payload.Details)
+		b.string(8, m.Payload.ErrCode)
+		b.bool(9, m.Payload.Retryable)
+
+	case *Ack:
+		b.bytes(1, m.Payload.For)
+		b.varint(2, uint64(m.Payload.ForType))
+		b.string(3, m.Payload.URI)
+		b.string(4, m.Payload.Channel)
+		if m.Payload.Delivered != nil {
+			// optional field, always encoded if set
+			b.field(5, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(*m.Payload.Delivered))
+		}
+
+	case *Res:
+		binary, args := pbArgs(m.Payload.Binary, m.Payload.Args)
+		b.bytes(1, m.Payload.For)
+		b.string(2, m.Payload.URI)
+		b.bytes(3, args)
+		b.bool(4, m.Payload.Error)
+		b.bool(5, m.Payload.Partial)
+		b.bool(6, binary)
+
+	case *ResChunk:
+		binary, args := pbArgs(m.Payload.Binary, m.Payload.Args)
+		b.bytes(1, m.Payload.For)
+		b.string(2, m.Payload.URI)
+		b.bytes(3, args)
+		b.varint(4, uint64(m.Payload.Seq))
+		b.bool(5, binary)
+
+	case *Evnt:
+		binary, args := pbArgs(m.Payload.Binary, m.Payload.Args)
+		b.bytes(1, m.Payload.For)
+		b.string(2, m.Payload.Channel)
+		b.string(3, m.Payload.Pattern)
+		b.string(4, m.Payload.ID)
+		b.bytes(5, args)
+		b.bool(6, binary)
+	}
+	return b
+}
+
+func pbSub(b *pbBuffer, channel string, pattern bool, filter Filter, lastEventID string) {
+	b.string(1, channel)
+	b.bool(2, pattern)
+	for k, v := range filter {
+		var entry pbBuffer
+		entry.string(1, k)
+		entry.bytes(2, v)
+		b.message(3, entry)
+	}
+	b.string(4, lastEventID)
+}
+
+// pbArgs returns the binary flag and the bytes to encode for the
+// arguments args. Binary arguments are encoded as raw bytes, unless
+// they are not a valid base64 JSON string, in which case they are
+// encoded as-is and the binary flag is unset.
+func pbArgs(binary bool, args json.RawMessage) (bool, []byte) {
+	if !binary {
+		return false, args
+	}
+	var raw []byte
+	if json.Unmarshal(args, &raw) != nil || raw == nil {
+		return false, args
+	}
+	return true, raw
+}
+
+// jsonArgs reverses pbArgs.
+func jsonArgs(binary bool, b []byte) (json.RawMessage, error) {
+	if !binary {
+		if len(b) == 0 {
+			return nil, nil
+		}
+		return json.RawMessage(b), nil
+	}
+	if b == nil {
+		b = []byte{}
+	}
+	return json.Marshal(b)
+}
+
+func decodeProtobuf(data []byte) (Msg, error) {
+	var (
+		meta Meta
+		m    Msg
+	)
+	err := pbFields(data, func(f pbField) error {
+		if f.num == pbMetaField {
+			return decodeMeta(f.b, &meta)
+		}
+		pm := newMsg(Type(f.num))
+		if pm == nil || f.typ != protowire.BytesType {
+			// unknown field, ignore it
+			return nil
+		}
+		m, meta.T = pm, Type(f.num)
+		return decodePayload(f.b, m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, ErrInvalidProtobuf
+	}
+	*metaOf(m) = meta
+	return m, nil
+}
+
+func decodeMeta(data []byte, meta *Meta) error {
+	return pbFields(data, func(f pbField) (err error) {
+		switch f.num {
+		case 1:
+			meta.U, err = f.uuid()
+		case 2:
+			meta.C = string(f.b)
+		case 3:
+			meta.Z = string(f.b)
+		case 4:
+			meta.R = string(f.b)
+		case 5:
+			meta.P = int(f.sint())
+		case 6:
+			meta.K = string(f.b)
+		}
+		return err
+	})
+}
+
+func decodePayload(data []byte, m Msg) error {
+	var args []byte
+	err := pbFields(data, func(f pbField) (err error) {
+		switch m := m.(type) {
+		case *Call:
+			switch f.num {
+			case 1:
+				m.Payload.URI = string(f.b)
+			case 2:
+				m.Payload.Timeout = time.Duration(int64(f.u))
+			case 3:
+				args = f.b
+			case 4:
+				m.Payload.Chunked = f.bool()
+			case 5:
+				m.Payload.FanOut = append(m.Payload.FanOut, string(f.b))
+			case 6:
+				m.Payload.Stream = f.bool()
+			case 7:
+				m.Payload.Binary = f.bool()
+			}
+
+		case *Chunk:
+			switch f.num {
+			case 1:
+				m.Payload.For, err = f.uuid()
+			case 2:
+				m.Payload.Data = string(f.b)
+			case 3:
+				m.Payload.Final = f.bool()
+			}
+
+		case *Sub:
+			return decodeSub(f, &m.Payload.Channel, &m.Payload.Pattern, &m.Payload.Filter, &m.Payload.LastEventID)
+
+		case *Unsb:
+			return decodeSub(f, &m.Payload.Channel, &m.Payload.Pattern, &m.Payload.Filter, &m.Payload.LastEventID)
+
+		case *Pub:
+			switch f.num {
+			case 1:
+				m.Payload.Channel = string(f.b)
+			case 2:
+				args = f.b
+			case 3:
+				m.Payload.Binary = f.bool()
+			}
+
+		case *Nack:
+			switch f.num {
+			case 1:
+				m.Payload.For, err = f.uuid()
+			case 2:
+				m.Payload.ForType = Type(f.u)
+			case 3:
+				m.Payload.URI = string(f.b)
+			case 4:
+				m.Payload.Channel = string(f.b)
+			case 5:
+				m.Payload.Code = int(f.sint())
+			case 6:
+				m.Payload.Message = string(f.b)
+			case 7:
+				m.Payload.Details = json.RawMessage(f.b)
+			case 8:
+				m.Payload.ErrCode = string(f.b)
+			case 9:
+				m.Payload.Retryable = f.bool()
+			}
+
+		case *Ack:
+			switch f.num {
+			case 1:
+				m.Payload.For, err = f.uuid()
+			case 2:
+				m.Payload.ForType = Type(f.u)
+			case 3:
+				m.Payload.URI = string(f.b)
+			case 4:
+				m.Payload.Channel = string(f.b)
+			case 5:
+				n := int(f.u)
+				m.Payload.Delivered = &n
+			}
+
+		case *Res:
+			switch f.num {
+			case 1:
+				m.Payload.For, err = f.uuid()
+			case 2:
+				m.Payload.URI = string(f.b)
+			case 3:
+				args = f.b
+			case 4:
+				m.Payload.Error = f.bool()
+			case 5:
+				m.Payload.Partial = f.bool()
+			case 6:
+				m.Payload.Binary = f.bool()
+			}
+
+		case *ResChunk:
+			switch f.num {
+			case 1:
+				m.Payload.For, err = f.uuid()
+			case 2:
+				m.Payload.URI = string(f.b)
+			case 3:
+				args = f.b
+			case 4:
+				m.Payload.Seq = int(f.u)
+			case 5:
+				m.Payload.Binary = f.bool()
+			}
+
+		case *Evnt:
+			switch f.num {
+			case 1:
+				m.Payload.For, err = f.uuid()
+			case 2:
+				m.Payload.Channel = string(f.b)
+			case 3:
+				m.Payload.Pattern = string(f.b)
+			case 4:
+				m.Payload.ID = string(f.b)
+			case 5:
+				args = f.b
+			case 6:
+				m.Payload.Binary = f.bool()
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// the binary flag may be decoded after the arguments
+	if p := protoArgsOf(m); p != nil {
+		*p.args, err = jsonArgs(*p.binary, args)
+	}
+	return err
+}
+
+// msgArgs points to the arguments of a message and their binary flag.
+type msgArgs struct {
+	args   *json.RawMessage
+	binary *bool
+}
+
+// protoArgsOf returns the arguments of m, or nil if m has no arguments.
+func protoArgsOf(m Msg) *msgArgs {
+	switch m := m.(type) {
+	case *Call:
+		return &msgArgs{&m.Payload.Args, &m.Payload.Binary}
+	case *Pub:
+		return &msgArgs{&m.Payload.Args, &m.Payload.Binary}
+	case *Res:
+		return &msgArgs{&m.Payload.Args, &m.Payload.Binary}
+	case *ResChunk:
+		return &msgArgs{&m.Payload.Args, &m.Payload.Binary}
+	case *Evnt:
+		return &msgArgs{&m.Payload.Args, &m.Payload.Binary}
+	}
+	return nil
+}
+
+func decodeSub(f pbField, channel *string, pattern *bool, filter *Filter, lastEventID *string) error {
+	switch f.num {
+	case 1:
+		*channel = string(f.b)
+	case 2:
+		*pattern = f.bool()
+	case 3:
+		var (
+			k string
+			v json.RawMessage
+		)
+		err := pbFields(f.b, func(f pbField) error {
+			switch f.num {
+			case 1:
+				k = string(f.b)
+			case 2:
+				v = json.RawMessage(f.b)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if *filter == nil {
+			*filter = make(Filter)
+		}
+		(*filter)[k] = v
+	case 4:
+		*lastEventID = string(f.b)
+	}
+	return nil
+}
+
+// pbBuffer is a buffer to encode protocol buffers fields. The fields
+// with the zero value are not encoded, as in proto3.
+type pbBuffer []byte
+
+func (b *pbBuffer) field(num protowire.Number, typ protowire.Type) {
+	*b = protowire.AppendTag(*b, num, typ)
+}
+
+func (b *pbBuffer) bytes(num protowire.Number, v []byte) {
+	if len(v) > 0 {
+		b.field(num, protowire.BytesType)
+		*b = protowire.AppendBytes(*b, v)
+	}
+}
+
+func (b *pbBuffer) string(num protowire.Number, v string) {
+	if v != "" {
+		b.field(num, protowire.BytesType)
+		*b = protowire.AppendString(*b, v)
+	}
+}
+
+func (b *pbBuffer) varint(num protowire.Number, v uint64) {
+	if v != 0 {
+		b.field(num, protowire.VarintType)
+		*b = protowire.AppendVarint(*b, v)
+	}
+}
+
+func (b *pbBuffer) sint(num protowire.Number, v int64) {
+	b.varint(num, protowire.EncodeZigZag(v))
+}
+
+func (b *pbBuffer) bool(num protowire.Number, v bool) {
+	if v {
+		b.varint(num, 1)
+	}
+}
+
+// message encodes the embedded message v, even if it is empty.
+func (b *pbBuffer) message(num protowire.Number, v pbBuffer) {
+	b.field(num, protowire.BytesType)
+	*b = protowire.AppendBytes(*b, v)
+}
+
+// pbField is a decoded protocol buffers field, with its value in u for
+// the varint fields and in b for the length-delimited fields.
+type pbField struct {
+	num protowire.Number
+	typ protowire.Type
+	u   uint64
+	b   []byte
+}
+
+func (f pbField) bool() bool  { return f.u != 0 }
+func (f pbField) sint() int64 { return protowire.DecodeZigZag(f.u) }
+
+func (f pbField) uuid() (uuid.UUID, error) {
+	switch len(f.b) {
+	case 0:
+		return nil, nil
+	case 16:
+		return uuid.UUID(append([]byte(nil), f.b...)), nil
+	}
+	return nil, ErrInvalidProtobuf
+}
+
+// pbFields calls fn for each field encoded in data, in order. The
+// fields with an unsupported wire type are skipped.
+func pbFields(data []byte, fn func(pbField) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return ErrInvalidProtobuf
+		}
+		data = data[n:]
+
+		f := pbField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.u, n = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			f.b, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n >= 0 {
+				data = data[n:]
+				continue
+			}
+		}
+		if n < 0 {
+			return ErrInvalidProtobuf
+		}
+		data = data[n:]
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
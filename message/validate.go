@@ -0,0 +1,158 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// CodeInvalidArgs is the code used when the arguments of a CALL or
+// PUB are rejected by a Validator.
+const CodeInvalidArgs = 400
+
+// Validator validates the JSON-encoded arguments of a CALL or PUB.
+// It can be implemented e.g. with a JSON Schema library. It returns
+// a non-nil error if the arguments are invalid.
+type Validator interface {
+	Validate(args json.RawMessage) error
+}
+
+// ValidatorFunc is a function that implements the Validator
+// interface.
+type ValidatorFunc func(json.RawMessage) error
+
+// Validate implements Validator for f.
+func (f ValidatorFunc) Validate(args json.RawMessage) error {
+	return f(args)
+}
+
+// ValidationError is the error returned when the arguments of a
+// request are rejected by a Validator. A Validator may return a
+// *ValidationError to provide Details, the other errors are wrapped
+// in a *ValidationError with no details.
+type ValidationError struct {
+	URI     string      // URI of the CALL
+	Channel string      // channel of the PUB
+	Err     error       // error returned by the Validator
+	Details interface{} // marshaled to JSON as NACK details
+}
+
+// Error returns the error message of e.
+func (e *ValidationError) Error() string {
+	target := e.URI
+	if target == "" {
+		target = e.Channel
+	}
+	if e.Err == nil {
+		return fmt.Sprintf("invalid arguments for %s", target)
+	}
+	return fmt.Sprintf("invalid arguments for %s: %v", target, e.Err)
+}
+
+// Validators holds the Validators registered for the URIs of CALL
+// requests and the channels of PUB requests. It is safe for concurrent
+// use, and the zero value is ready to use, with no Validator.
+type Validators struct {
+	mu       sync.RWMutex
+	uris     map[string]Validator
+	channels map[string]Validator
+}
+
+// RegisterURI registers v to validate the arguments of the calls to
+// uri. It replaces any Validator previously registered for uri. A nil
+// v removes the Validator of uri.
+func (vs *Validators) RegisterURI(uri string, v Validator) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.uris = register(vs.uris, uri, v)
+}
+
+// RegisterChannel registers v to validate the arguments of the
+// publications on channel. It replaces any Validator previously
+// registered for channel. A nil v removes the Validator of channel.
+func (vs *Validators) RegisterChannel(channel string, v Validator) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.channels = register(vs.channels, channel, v)
+}
+
+func register(m map[string]Validator, k string, v Validator) map[string]Validator {
+	if v == nil {
+		delete(m, k)
+		return m
+	}
+	if m == nil {
+		m = make(map[string]Validator)
+	}
+	m[k] = v
+	return m
+}
+
+// Check validates the arguments of the request message m with the
+// Validator registered for its URI or channel. It returns nil if m is
+// valid, has no Validator or is not a CALL or PUB, a *ValidationError
+// otherwise. It can be called on a nil *Validators, in which case it
+// returns nil.
+func (vs *Validators) Check(m Msg) error {
+	if vs == nil {
+		return nil
+	}
+
+	var (
+		v    Validator
+		args json.RawMessage
+		verr ValidationError
+	)
+	vs.mu.RLock()
+	switch m := m.(type) {
+	case *Call:
+		v, args, verr.URI = vs.uris[m.Payload.URI], m.Payload.Args, m.Payload.URI
+	case *Pub:
+		v, args, verr.Channel = vs.channels[m.Payload.Channel], m.Payload.Args, m.Payload.Channel
+	}
+	vs.mu.RUnlock()
+
+	if v == nil {
+		return nil
+	}
+	err := v.Validate(args)
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*ValidationError); ok {
+		verr.Err, verr.Details = e.Err, e.Details
+	} else {
+		verr.Err = err
+	}
+	return &verr
+}
+
+// RequiredFields returns a Validator that requires the arguments to
+// be a JSON object with all the fields, which are dot-separated paths
+// as for the Filter (e.g. "user.id"). The Details of the returned
+// *ValidationError list the missing fields.
+func RequiredFields(fields ...string) Validator {
+	return ValidatorFunc(func(args json.RawMessage) error {
+		var obj interface{}
+		if err := json.Unmarshal(args, &obj); err != nil {
+			return err
+		}
+		if _, ok := obj.(map[string]interface{}); !ok {
+			return fmt.Errorf("arguments must be an object")
+		}
+
+		var missing []string
+		for _, f := range fields {
+			if _, ok := lookupField(obj, f); !ok {
+				missing = append(missing, f)
+			}
+		}
+		if len(missing) > 0 {
+			return &ValidationError{
+				Err:     fmt.Errorf("missing required fields"),
+				Details: map[string][]string{"missing": missing},
+			}
+		}
+		return nil
+	})
+}
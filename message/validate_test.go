@@ -0,0 +1,73 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidators(t *testing.T) {
+	t.Parallel()
+
+	var nilVs *Validators
+	assert.NoError(t, nilVs.Check(&Call{}), "nil Validators")
+
+	vs := new(Validators)
+	vs.RegisterURI("a", RequiredFields("x", "y.z"))
+	vs.RegisterChannel("c", ValidatorFunc(func(args json.RawMessage) error {
+		if string(args) != `1` {
+			return errors.New("not 1")
+		}
+		return nil
+	}))
+
+	call := func(uri, args string) *Call {
+		m := &Call{}
+		m.Payload.URI = uri
+		m.Payload.Args = json.RawMessage(args)
+		return m
+	}
+	pub := func(ch, args string) *Pub {
+		m := &Pub{}
+		m.Payload.Channel = ch
+		m.Payload.Args = json.RawMessage(args)
+		return m
+	}
+
+	cases := []struct {
+		m     Msg
+		valid bool
+	}{
+		{call("a", `{"x":1,"y":{"z":null}}`), true},
+		{call("a", `{"x":1}`), false},
+		{call("a", `[1]`), false},
+		{call("b", `[1]`), true},
+		{pub("c", `1`), true},
+		{pub("c", `2`), false},
+		{pub("a", `2`), true},
+		{&Sub{}, true},
+	}
+	for i, c := range cases {
+		err := vs.Check(c.m)
+		if c.valid {
+			assert.NoError(t, err, "%d", i)
+			continue
+		}
+		if assert.Error(t, err, "%d", i) {
+			assert.IsType(t, &ValidationError{}, err, "%d", i)
+		}
+	}
+
+	// details are sent in the NACK
+	err := vs.Check(call("a", `{"y":1}`))
+	require.Error(t, err, "Check")
+	assert.Equal(t, "invalid arguments for a: missing required fields", err.Error(), "error message")
+	nack := NewNack(call("a", ""), CodeInvalidArgs, err)
+	assert.JSONEq(t, `{"missing":["x","y.z"]}`, string(nack.Payload.Details), "NACK details")
+
+	vs.RegisterURI("a", nil)
+	assert.NoError(t, vs.Check(call("a", `1`)), "removed Validator")
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// Observer is implemented by sinks that can record the distribution of
+// a value, e.g. to report its percentiles.
+type Observer interface {
+	Sink
+	Observe(key string, v int64)
+}
+
+// varMap is the subset of the *expvar.Map methods used by Observe.
+type varMap interface {
+	Get(key string) expvar.Var
+	Set(key string, v expvar.Var)
+}
+
+// mu protects the creation of histograms in a varMap.
+var mu sync.Mutex
+
+// Observe records the value v in the distribution identified by key on
+// s. If s implements Observer, its Observe method is called. Otherwise,
+// if s is an *expvar.Map, v is recorded in a Histogram stored in the
+// map under key, which is created if it doesn't exist. Otherwise v is
+// ignored.
+func Observe(s Sink, key string, v int64) {
+	switch s := s.(type) {
+	case Observer:
+		s.Observe(key, v)
+
+	case varMap:
+		mu.Lock()
+		h, ok := s.Get(key).(*Histogram)
+		if !ok {
+			h = new(Histogram)
+			s.Set(key, h)
+		}
+		mu.Unlock()
+		h.Observe(v)
+	}
+}
+
+// numBuckets is the number of buckets of a Histogram. Bucket i counts
+// the values v such that 2^(i-1) <= v < 2^i, bucket 0 counts the
+// values < 1 and the last bucket counts all values that don't fit in
+// the others.
+const numBuckets = 48
+
+// Histogram records the distribution of values in exponential buckets,
+// so that its percentiles can be estimated. It implements expvar.Var,
+// its String method returns a JSON object with the count of values and
+// the 50th, 90th and 99th percentiles. It is safe for concurrent use.
+// The zero value is ready to use.
+type Histogram struct {
+	mu      sync.Mutex
+	count   int64
+	buckets [numBuckets]int64
+}
+
+// Observe records the value v.
+func (h *Histogram) Observe(v int64) {
+	i := 0
+	for ; v > 0 && i < numBuckets-1; i++ {
+		v >>= 1
+	}
+
+	h.mu.Lock()
+	h.count++
+	h.buckets[i]++
+	h.mu.Unlock()
+}
+
+// Count returns the number of values recorded.
+func (h *Histogram) Count() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// reset clears the recorded values and returns the number of values
+// that were recorded.
+func (h *Histogram) reset() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.count
+	h.count = 0
+	h.buckets = [numBuckets]int64{}
+	return n
+}
+
+// Percentile returns an estimate of the p percentile (e.g. 0.99 for
+// the 99th percentile) of the values recorded. The estimate is the
+// upper bound of the bucket of the percentile, so it is at most twice
+// the actual value. It returns 0 if no value was recorded.
+func (h *Histogram) Percentile(p float64) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.percentile(p)
+}
+
+func (h *Histogram) percentile(p float64) int64 {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := int64(p * float64(h.count))
+	if rank >= h.count {
+		rank = h.count - 1
+	}
+	var n int64
+	for i, c := range h.buckets {
+		n += c
+		if n > rank {
+			return int64(1)<<uint(i) - 1
+		}
+	}
+	return 0
+}
+
+// String returns the JSON representation of the histogram.
+func (h *Histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return fmt.Sprintf(`{"count": %d, "p50": %d, "p90": %d, "p99": %d}`,
+		h.count, h.percentile(0.5), h.percentile(0.9), h.percentile(0.99))
+}
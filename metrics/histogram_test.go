@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	assert.Equal(t, int64(0), h.Percentile(0.5), "empty")
+
+	for i := int64(1); i <= 100; i++ {
+		h.Observe(i)
+	}
+	assert.Equal(t, int64(100), h.Count(), "count")
+	assert.Equal(t, int64(63), h.Percentile(0.5), "p50")
+	assert.Equal(t, int64(127), h.Percentile(0.99), "p99")
+	assert.Equal(t, int64(0), (&Histogram{}).Percentile(1), "empty p100")
+
+	var got map[string]int64
+	require.NoError(t, json.Unmarshal([]byte(h.String()), &got), "Unmarshal")
+	assert.Equal(t, map[string]int64{"count": 100, "p50": 63, "p90": 127, "p99": 127}, got, "String")
+}
+
+type observerSink struct {
+	observed map[string][]int64
+}
+
+func (s *observerSink) Add(key string, delta int64) {}
+
+func (s *observerSink) Observe(key string, v int64) {
+	s.observed[key] = append(s.observed[key], v)
+}
+
+func TestObserve(t *testing.T) {
+	s := &observerSink{observed: make(map[string][]int64)}
+	Observe(s, "a", 1)
+	Observe(s, "a", 2)
+	assert.Equal(t, map[string][]int64{"a": {1, 2}}, s.observed, "observed")
+
+	m := new(expvar.Map).Init()
+	Observe(m, "a", 3)
+	Observe(m, "a", 4)
+	if h, ok := m.Get("a").(*Histogram); assert.True(t, ok, "histogram in the map") {
+		assert.Equal(t, int64(2), h.Count(), "count")
+	}
+
+	Observe(Discard, "a", 1)
+}
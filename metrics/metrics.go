@@ -0,0 +1,70 @@
+// Package metrics defines the Sink used by the juggler packages to
+// collect metrics. An *expvar.Map implements Sink, so it can be used
+// directly to publish the metrics on the /debug/vars endpoint.
+//
+// The same Sink is meant to be shared by all components: the
+// juggler.Server passes its Sink to the brokers that implement Setter
+// and that don't have a Sink already, so that the broker metrics are
+// collected along with the server metrics without having to set the
+// sink on each component.
+package metrics
+
+import "reflect"
+
+// Sink is the interface of the metrics collectors. Add increments the
+// counter identified by key by delta, which may be negative.
+type Sink interface {
+	Add(key string, delta int64)
+}
+
+// Setter is implemented by components that report metrics to a Sink
+// and accept the Sink of their parent component. SetMetrics should only
+// set s if the component doesn't have a Sink already.
+type Setter interface {
+	SetMetrics(s Sink)
+}
+
+// ExemplarSink is implemented by sinks that can attach an exemplar to
+// a counter increment, e.g. the correlation ID of the request that
+// caused it, so that a metric can be linked to the logs of a request.
+type ExemplarSink interface {
+	Sink
+	AddExemplar(key string, delta int64, exemplar string)
+}
+
+// AddExemplar increments the counter identified by key by delta on s,
+// attaching exemplar if s implements ExemplarSink and exemplar is not
+// empty.
+func AddExemplar(s Sink, key string, delta int64, exemplar string) {
+	if es, ok := s.(ExemplarSink); ok && exemplar != "" {
+		es.AddExemplar(key, delta, exemplar)
+		return
+	}
+	s.Add(key, delta)
+}
+
+// Discard is a Sink that discards all metrics.
+var Discard Sink = discard{}
+
+type discard struct{}
+
+func (discard) Add(string, int64) {}
+
+// Or returns s if it is a valid Sink, or Discard if s is nil or is an
+// interface holding a nil pointer (e.g. a nil *expvar.Map).
+func Or(s Sink) Sink {
+	if IsNil(s) {
+		return Discard
+	}
+	return s
+}
+
+// IsNil returns true if s is nil or is an interface holding a nil
+// pointer.
+func IsNil(s Sink) bool {
+	if s == nil {
+		return true
+	}
+	v := reflect.ValueOf(s)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
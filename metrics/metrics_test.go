@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"expvar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOr(t *testing.T) {
+	var m *expvar.Map
+	assert.Equal(t, Discard, Or(nil), "nil")
+	assert.Equal(t, Discard, Or(m), "nil *expvar.Map")
+
+	m = new(expvar.Map).Init()
+	s := Or(m)
+	assert.Equal(t, m, s, "*expvar.Map")
+	s.Add("a", 2)
+	assert.Equal(t, "2", m.Get("a").String(), "added to the map")
+
+	Discard.Add("a", 1)
+}
+
+type exemplarSink struct {
+	added     map[string]int64
+	exemplars map[string]string
+}
+
+func (s *exemplarSink) Add(key string, delta int64) {
+	s.added[key] += delta
+}
+
+func (s *exemplarSink) AddExemplar(key string, delta int64, exemplar string) {
+	s.added[key] += delta
+	s.exemplars[key] = exemplar
+}
+
+func TestAddExemplar(t *testing.T) {
+	s := &exemplarSink{added: make(map[string]int64), exemplars: make(map[string]string)}
+	AddExemplar(s, "a", 1, "x")
+	AddExemplar(s, "b", 2, "")
+	assert.Equal(t, map[string]int64{"a": 1, "b": 2}, s.added, "added")
+	assert.Equal(t, map[string]string{"a": "x"}, s.exemplars, "exemplars")
+
+	m := new(expvar.Map).Init()
+	AddExemplar(m, "a", 3, "x")
+	assert.Equal(t, "3", m.Get("a").String(), "added to the map")
+}
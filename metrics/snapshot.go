@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"expvar"
+	"strings"
+)
+
+// Snapshotter is implemented by sinks that can take a snapshot of their
+// counters and optionally reset them.
+type Snapshotter interface {
+	Sink
+	Snapshot(reset bool) map[string]int64
+}
+
+// doMap is the subset of the *expvar.Map methods used by Snapshot.
+type doMap interface {
+	Do(f func(expvar.KeyValue))
+}
+
+// gauges is the set of metrics that report a current value instead of
+// a count of events, in addition to those with the "Active" prefix.
+var gauges = map[string]bool{
+	"FirehoseWatchers": true,
+}
+
+// IsGauge returns true if the metric identified by key reports a
+// current value (e.g. the number of active connections) instead of a
+// count of events. Gauges are never reset by Snapshot.
+func IsGauge(key string) bool {
+	return strings.HasPrefix(key, "Active") || gauges[key]
+}
+
+// Snapshot returns the current value of the counters of s. For a
+// Histogram, the value is its count. If reset is true, the counters
+// that are not gauges are reset to zero, so that the next snapshot
+// only reports the activity since this one.
+//
+// If s implements Snapshotter, its Snapshot method is called.
+// Otherwise, if s is an *expvar.Map, the reset of each counter is
+// atomic with its snapshot: the snapshotted value is subtracted from
+// the counter, so that increments that happen concurrently are
+// reported by the next snapshot instead of being lost. Otherwise an
+// empty snapshot is returned.
+func Snapshot(s Sink, reset bool) map[string]int64 {
+	if IsNil(s) {
+		return map[string]int64{}
+	}
+
+	switch s := s.(type) {
+	case Snapshotter:
+		return s.Snapshot(reset)
+
+	case doMap:
+		snap := make(map[string]int64)
+		s.Do(func(kv expvar.KeyValue) {
+			reset := reset && !IsGauge(kv.Key)
+			switch v := kv.Value.(type) {
+			case *expvar.Int:
+				n := v.Value()
+				if reset {
+					v.Add(-n)
+				}
+				snap[kv.Key] = n
+			case *Histogram:
+				if reset {
+					snap[kv.Key] = v.reset()
+				} else {
+					snap[kv.Key] = v.Count()
+				}
+			}
+		})
+		return snap
+	}
+	return map[string]int64{}
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"expvar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	var nilMap *expvar.Map
+	assert.Equal(t, map[string]int64{}, Snapshot(nil, true), "nil")
+	assert.Equal(t, map[string]int64{}, Snapshot(nilMap, true), "nil *expvar.Map")
+	assert.Equal(t, map[string]int64{}, Snapshot(Discard, true), "Discard")
+
+	m := new(expvar.Map).Init()
+	m.Add("Msgs", 3)
+	m.Add("ActiveConns", 2)
+	m.Add("FirehoseWatchers", 1)
+	m.Set("Other", new(expvar.String))
+	Observe(m, "RTT", 10)
+	Observe(m, "RTT", 20)
+
+	want := map[string]int64{"Msgs": 3, "ActiveConns": 2, "FirehoseWatchers": 1, "RTT": 2}
+	assert.Equal(t, want, Snapshot(m, false), "snapshot")
+	assert.Equal(t, want, Snapshot(m, true), "snapshot and reset")
+
+	m.Add("Msgs", 1)
+	want = map[string]int64{"Msgs": 1, "ActiveConns": 2, "FirehoseWatchers": 1, "RTT": 0}
+	assert.Equal(t, want, Snapshot(m, true), "after reset")
+	assert.Equal(t, int64(0), m.Get("RTT").(*Histogram).Percentile(0.5), "histogram reset")
+}
+
+type snapSink struct {
+	reset bool
+}
+
+func (s *snapSink) Add(string, int64) {}
+
+func (s *snapSink) Snapshot(reset bool) map[string]int64 {
+	s.reset = reset
+	return map[string]int64{"a": 1}
+}
+
+func TestSnapshotSnapshotter(t *testing.T) {
+	s := &snapSink{}
+	assert.Equal(t, map[string]int64{"a": 1}, Snapshot(s, true), "snapshot")
+	assert.True(t, s.reset, "reset")
+}
@@ -0,0 +1,135 @@
+package juggler
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// OriginPolicy defines the origins that are allowed to connect to the
+// server, for the CheckOrigin function of the websocket upgrader and
+// the requests of the fallback transport (see UpgradeConfig). If no
+// origin is allowed explicitly, the requests without an Origin header,
+// that are not sent by browsers, and the requests from the same origin
+// as the server are allowed, like the default CheckOrigin of the
+// websocket upgrader. Otherwise, only the allowed origins are, unless
+// AllowNoOrigin or AllowSameOrigin is set.
+type OriginPolicy struct {
+	// AllowedOrigins is the list of allowed origins, e.g.
+	// "https://example.com". The origins are compared case-
+	// insensitively.
+	AllowedOrigins []string
+
+	// AllowedOriginPatterns is the list of regular expressions that
+	// match allowed origins, e.g. `^https://[a-z0-9-]+\.example\.com$`.
+	// The patterns should be anchored.
+	AllowedOriginPatterns []*regexp.Regexp
+
+	// AllowAll, if true, allows all origins. It should only be used in
+	// development.
+	AllowAll bool
+
+	// AllowNoOrigin, if true, allows the requests without an Origin
+	// header even if AllowedOrigins or AllowedOriginPatterns is set.
+	AllowNoOrigin bool
+
+	// AllowSameOrigin, if true, allows the requests from the same
+	// origin as the server even if AllowedOrigins or
+	// AllowedOriginPatterns is set.
+	AllowSameOrigin bool
+}
+
+// AllowOrigin returns true if origin is allowed by the policy, that is
+// if AllowAll is set, or if it is one of the AllowedOrigins or matches
+// one of the AllowedOriginPatterns.
+func (p *OriginPolicy) AllowOrigin(origin string) bool {
+	if p.AllowAll {
+		return true
+	}
+	for _, o := range p.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	for _, re := range p.AllowedOriginPatterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOrigin returns true if the request r is allowed by the policy,
+// that is if its origin is allowed by AllowOrigin, or if it has no
+// Origin header or its origin is the host of the request and no origin
+// is allowed explicitly (or AllowNoOrigin or AllowSameOrigin is set,
+// respectively). It can be used as the CheckOrigin function of a
+// websocket.Upgrader.
+func (p *OriginPolicy) CheckOrigin(r *http.Request) bool {
+	whitelist := len(p.AllowedOrigins) > 0 || len(p.AllowedOriginPatterns) > 0
+	o := r.Header.Get("Origin")
+	if o == "" {
+		return p.AllowAll || !whitelist || p.AllowNoOrigin
+	}
+	if p.AllowOrigin(o) {
+		return true
+	}
+	if whitelist && !p.AllowSameOrigin {
+		return false
+	}
+	u, err := url.Parse(o)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// setCORSHeaders sets the CORS response headers of a fallback request
+// from an allowed origin, so that the browsers of the clients served
+// from another origin can read the responses. It returns true if r is
+// a preflight request, that has been fully handled.
+func (p *OriginPolicy) setCORSHeaders(w http.ResponseWriter, r *http.Request) bool {
+	hdr := w.Header()
+	hdr.Add("Vary", "Origin")
+	o := r.Header.Get("Origin")
+	if o == "" {
+		return false
+	}
+	hdr.Set("Access-Control-Allow-Origin", o)
+	hdr.Set("Access-Control-Allow-Credentials", "true")
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	hdr.Set("Access-Control-Allow-Methods", "GET, POST")
+	if h := r.Header.Get("Access-Control-Request-Headers"); h != "" {
+		hdr.Set("Access-Control-Allow-Headers", h)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// forwardedAddr returns the address of the client that sent r, as
+// reported by the X-Real-IP header or, if it is not set, by the first
+// address of the X-Forwarded-For header. It returns nil if none of
+// those headers holds a valid IP address.
+func forwardedAddr(r *http.Request) net.Addr {
+	v := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+	if v == "" {
+		v = r.Header.Get("X-Forwarded-For")
+		if i := strings.IndexByte(v, ','); i >= 0 {
+			v = v[:i]
+		}
+		v = strings.TrimSpace(v)
+	}
+	if host, _, err := net.SplitHostPort(v); err == nil {
+		v = host
+	}
+	v = strings.Trim(v, "[]")
+	if net.ParseIP(v) == nil {
+		return nil
+	}
+	return httpAddr(v)
+}
@@ -0,0 +1,108 @@
+package juggler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	p := &OriginPolicy{
+		AllowedOrigins:        []string{"https://example.com"},
+		AllowedOriginPatterns: []*regexp.Regexp{regexp.MustCompile(`^https://[a-z0-9-]+\.example\.org$`)},
+	}
+
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"", false},
+		{"http://juggler.local", false}, // same origin
+		{"https://example.com", true},
+		{"HTTPS://EXAMPLE.COM", true},
+		{"https://a.example.org", true},
+		{"https://example.org", false},
+		{"https://evil.com", false},
+		{"https://a.example.org.evil.com", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://juggler.local/ws", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		assert.Equal(t, c.want, p.CheckOrigin(r), c.origin)
+	}
+
+	// the requests without origin and from the same origin are allowed
+	// if there is no whitelist, or if it is enabled explicitly
+	for _, p := range []*OriginPolicy{
+		{},
+		{AllowedOrigins: []string{"https://example.com"}, AllowNoOrigin: true, AllowSameOrigin: true},
+	} {
+		r := httptest.NewRequest("GET", "http://juggler.local/ws", nil)
+		assert.True(t, p.CheckOrigin(r), "no origin")
+		r.Header.Set("Origin", "http://juggler.local")
+		assert.True(t, p.CheckOrigin(r), "same origin")
+		r.Header.Set("Origin", "https://evil.com")
+		assert.False(t, p.CheckOrigin(r), "other origin")
+	}
+
+	all := &OriginPolicy{AllowAll: true}
+	assert.True(t, all.AllowOrigin("https://evil.com"), "AllowAll")
+}
+
+func TestOriginPolicyCORS(t *testing.T) {
+	p := &OriginPolicy{AllowedOrigins: []string{"https://example.com"}}
+
+	r := httptest.NewRequest("OPTIONS", "http://juggler.local/ws", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	r.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	w := httptest.NewRecorder()
+	assert.True(t, p.setCORSHeaders(w, r), "preflight")
+	assert.Equal(t, http.StatusNoContent, w.Code, "preflight status")
+	assert.Equal(t, "https://example.com", w.Header().Get("Access-Control-Allow-Origin"), "allow origin")
+	assert.Equal(t, "Content-Type", w.Header().Get("Access-Control-Allow-Headers"), "allow headers")
+
+	r = httptest.NewRequest("POST", "http://juggler.local/ws", nil)
+	r.Header.Set("Origin", "https://example.com")
+	w = httptest.NewRecorder()
+	assert.False(t, p.setCORSHeaders(w, r), "not a preflight")
+	assert.Equal(t, "https://example.com", w.Header().Get("Access-Control-Allow-Origin"), "allow origin")
+}
+
+func TestForwardedAddr(t *testing.T) {
+	cases := []struct {
+		realIP, forwardedFor string
+		want                 string
+	}{
+		{"", "", ""},
+		{"10.0.0.1", "", "10.0.0.1"},
+		{"10.0.0.1", "10.0.0.2", "10.0.0.1"},
+		{"", "10.0.0.2, 10.0.0.3", "10.0.0.2"},
+		{"", "10.0.0.2:1234", "10.0.0.2"},
+		{"", "[::1]:1234", "::1"},
+		{"", "2001:db8::1", "2001:db8::1"},
+		{"", "not-an-ip", ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://juggler.local/ws", nil)
+		if c.realIP != "" {
+			r.Header.Set("X-Real-IP", c.realIP)
+		}
+		if c.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+		addr := forwardedAddr(r)
+		if c.want == "" {
+			assert.Nil(t, addr, "%s %s", c.realIP, c.forwardedFor)
+			continue
+		}
+		if assert.NotNil(t, addr, "%s %s", c.realIP, c.forwardedFor) {
+			assert.Equal(t, c.want, addr.String(), "%s %s", c.realIP, c.forwardedFor)
+		}
+	}
+}
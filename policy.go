@@ -0,0 +1,206 @@
+package juggler
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+)
+
+// errURINotAllowed is returned for calls to a URI that is denied by
+// the Server's AllowedURIs and DeniedURIs.
+var errURINotAllowed = errors.New("juggler: URI not allowed")
+
+// errChannelNotAllowed is returned for PUB and SUB requests that are
+// denied by the Server's ChannelPolicies.
+var errChannelNotAllowed = errors.New("juggler: channel not allowed")
+
+// ChannelPolicy defines what clients can do on the channels that match
+// Pattern. The Pattern is a glob-style pattern (see path.Match) that
+// may contain the following placeholders, replaced with the value for
+// the connection that sent the request:
+//
+//     {conn}     : the UUID of the connection.
+//     {tag:NAME} : the value of the NAME tag of the connection (see
+//                  Conn.SetTag). If the connection doesn't have this
+//                  tag, the policy doesn't match.
+//
+// The values of the placeholders match literally. For pattern
+// subscriptions, a policy doesn't match if the value of one of its
+// placeholders contains wildcards (the glob special characters, or
+// "+" and "#" if the server has Topics set), as they would act as
+// wildcards in the subscribed pattern.
+//
+// For example, the pattern "user.{tag:user}.*" with Sub and PSub set
+// allows clients to subscribe to their own user channels, and because
+// Pub is not set, only the backend may publish there.
+type ChannelPolicy struct {
+	Pattern string
+
+	// Sub allows subscribing to the channels that match Pattern.
+	Sub bool
+
+	// PSub allows pattern subscriptions, where the subscribed pattern
+	// matches Pattern (e.g. "user.123.*" for "user.{tag:user}.*").
+	PSub bool
+
+	// Pub allows publishing to the channels that match Pattern.
+	Pub bool
+}
+
+// uriAllowed returns true if calls to uri are allowed by the server's
+// URI policy.
+func (srv *Server) uriAllowed(uri string) bool {
+	if matchAny(srv.DeniedURIs, uri) {
+		return false
+	}
+	return len(srv.AllowedURIs) == 0 || matchAny(srv.AllowedURIs, uri)
+}
+
+// checkTopic returns broker.ErrInvalidTopic if the server has Topics
+// set and the channel of the PUB, SUB or UNSB request m is not a valid
+// topic, or not a valid topic filter for a pattern.
+func (srv *Server) checkTopic(m message.Msg) error {
+	if !srv.Topics {
+		return nil
+	}
+	switch m := m.(type) {
+	case *message.Pub:
+		return broker.ValidTopic(m.Payload.Channel)
+	case *message.Sub:
+		return broker.ValidateTopicSub(m.Payload.Channel, m.Payload.Pattern)
+	case *message.Unsb:
+		return broker.ValidateTopicSub(m.Payload.Channel, m.Payload.Pattern)
+	}
+	return nil
+}
+
+// channelPolicy returns the first channel policy of the server that
+// matches channel for the connection c, which is a pattern if pattern
+// is true. It returns false if no policy matches.
+func (c *Conn) channelPolicy(channel string, pattern bool) (ChannelPolicy, bool) {
+	for _, p := range c.srv.ChannelPolicies {
+		pat, ok := c.expandPattern(p.Pattern, pattern)
+		if !ok {
+			continue
+		}
+		if ok, err := path.Match(pat, channel); ok && err == nil {
+			return p, true
+		}
+	}
+	return ChannelPolicy{}, false
+}
+
+// subAllowed returns true if the connection c is allowed to subscribe
+// to channel, which is a pattern if pattern is true. The room channels
+// are never allowed.
+func (c *Conn) subAllowed(channel string, pattern bool) bool {
+	if isRoomChannel(channel) {
+		return false
+	}
+	if len(c.srv.ChannelPolicies) == 0 {
+		return true
+	}
+	p, ok := c.channelPolicy(channel, pattern)
+	if pattern {
+		return ok && p.PSub
+	}
+	return ok && p.Sub
+}
+
+// pubAllowed returns true if the connection c is allowed to publish
+// to channel. The room channels are never allowed.
+func (c *Conn) pubAllowed(channel string) bool {
+	if isRoomChannel(channel) {
+		return false
+	}
+	if len(c.srv.ChannelPolicies) == 0 {
+		return true
+	}
+	p, ok := c.channelPolicy(channel, false)
+	return ok && p.Pub
+}
+
+// expandPattern replaces the placeholders in pat with the values for
+// the connection c. It returns false if a placeholder cannot be
+// replaced, or if wildcards is true and the value of a placeholder
+// contains wildcards.
+func (c *Conn) expandPattern(pat string, wildcards bool) (string, bool) {
+	if !strings.Contains(pat, "{") {
+		return pat, true
+	}
+
+	var buf []byte
+	for {
+		start := strings.Index(pat, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(pat[start:], "}")
+		if end < 0 {
+			break
+		}
+		end += start
+
+		var v string
+		switch name := pat[start+1 : end]; {
+		case name == "conn":
+			v = c.UUID.String()
+		case strings.HasPrefix(name, "tag:"):
+			tv, ok := c.Tag(strings.TrimPrefix(name, "tag:"))
+			if !ok {
+				return "", false
+			}
+			v = tv
+		default:
+			return "", false
+		}
+		if wildcards && c.srv.hasWildcards(v) {
+			return "", false
+		}
+		buf = append(buf, pat[:start]...)
+		buf = append(buf, escapeGlob(v)...)
+		pat = pat[end+1:]
+	}
+	buf = append(buf, pat...)
+	return string(buf), true
+}
+
+// hasWildcards returns true if s contains characters that act as
+// wildcards in the patterns of pattern subscriptions.
+func (srv *Server) hasWildcards(s string) bool {
+	if strings.ContainsAny(s, `*?[\`) {
+		return true
+	}
+	return srv.Topics && strings.ContainsAny(s, "+#")
+}
+
+// escapeGlob escapes the glob special characters in s so that it
+// matches literally in a path.Match pattern.
+func escapeGlob(s string) string {
+	if !strings.ContainsAny(s, `*?[\`) {
+		return s
+	}
+	buf := make([]byte, 0, len(s)*2)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', '\\':
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+// matchAny returns true if v matches any of the glob-style patterns.
+// Invalid patterns never match.
+func matchAny(patterns []string, v string) bool {
+	for _, p := range patterns {
+		if ok, err := path.Match(p, v); ok && err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package juggler
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// DefaultPresenceTTL is the default time-to-live of presence entries
+// if Server.PresenceTTL is not set.
+const DefaultPresenceTTL = 30 * time.Second
+
+func (srv *Server) presenceTTL() time.Duration {
+	if srv.PresenceTTL > 0 {
+		return srv.PresenceTTL
+	}
+	return DefaultPresenceTTL
+}
+
+// Presence returns the UUIDs of the connections present on channel,
+// across all servers that share the same PresenceBroker. The presence
+// of a room's members can be queried using the room's channel (see
+// RoomChannel).
+func (srv *Server) Presence(channel string) ([]uuid.UUID, error) {
+	if srv.PresenceBroker == nil {
+		return nil, ErrNoPresenceBroker
+	}
+	return srv.PresenceBroker.Presence(channel)
+}
+
+// addPresence adds the connection to the presence set of channel,
+// if the server has a PresenceBroker.
+func (c *Conn) addPresence(channel string) {
+	pb := c.srv.PresenceBroker
+	if pb == nil {
+		return
+	}
+
+	c.pmu.Lock()
+	if c.presence == nil {
+		c.presence = make(map[string]struct{})
+	}
+	c.presence[channel] = struct{}{}
+	c.pmu.Unlock()
+
+	c.setPresence(channel)
+}
+
+// removePresence removes the connection from the presence set of
+// channel, if the server has a PresenceBroker.
+func (c *Conn) removePresence(channel string) {
+	pb := c.srv.PresenceBroker
+	if pb == nil {
+		return
+	}
+
+	c.pmu.Lock()
+	delete(c.presence, channel)
+	c.pmu.Unlock()
+
+	if err := pb.RemovePresence(channel, c.UUID); err != nil {
+		c.srv.vars.Add("FailedPresenceUpdates", 1)
+	}
+}
+
+// removeAllPresence removes the connection from all its presence sets.
+// It is called once the connection is closed.
+func (c *Conn) removeAllPresence() {
+	for _, ch := range c.presenceChannels() {
+		c.removePresence(ch)
+	}
+}
+
+// presenceChannels returns the sorted list of channels on which the
+// connection is present.
+func (c *Conn) presenceChannels() []string {
+	c.pmu.Lock()
+	chans := make([]string, 0, len(c.presence))
+	for ch := range c.presence {
+		chans = append(chans, ch)
+	}
+	c.pmu.Unlock()
+
+	sort.Strings(chans)
+	return chans
+}
+
+func (c *Conn) setPresence(channel string) {
+	if err := c.srv.PresenceBroker.SetPresence(channel, c.UUID, c.srv.presenceTTL()); err != nil {
+		c.srv.vars.Add("FailedPresenceUpdates", 1)
+	}
+}
+
+// refreshPresence is the loop that refreshes the presence entries of
+// the connection before they expire, started in its own goroutine.
+func (c *Conn) refreshPresence() {
+	c.srv.vars.Add("TotalConnGoros", 1)
+	c.srv.vars.Add("ActiveConnGoros", 1)
+	defer c.srv.vars.Add("ActiveConnGoros", -1)
+
+	t := time.NewTicker(c.srv.presenceTTL() / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.kill:
+			return
+		case <-t.C:
+			for _, ch := range c.presenceChannels() {
+				c.setPresence(ch)
+			}
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package juggler
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/message"
+)
+
+// DefaultTokenBucketIdle is the time after which the bucket of a key
+// that is not used is removed from a TokenBucket, if its Idle field is
+// not set.
+const DefaultTokenBucketIdle = 10 * time.Minute
+
+// errRateLimited is the error sent in the NACK of a request throttled
+// by the Server's RateLimiter.
+var errRateLimited = errors.New("juggler: rate limit exceeded")
+
+// RateLimiter defines the method required to throttle the requests of
+// the connections. Allow is called with the connection, the type of
+// the request (CALL or PUB) and its target, that is the URI of a CALL
+// or the channel of a PUB. It returns true if the request is allowed,
+// otherwise the request is rejected with a NACK with code 429.
+//
+// It is called concurrently for all connections, so it must be safe
+// for concurrent use.
+type RateLimiter interface {
+	Allow(c *Conn, t message.Type, target string) bool
+}
+
+// RateLimiterFunc is a function signature that implements the
+// RateLimiter interface.
+type RateLimiterFunc func(*Conn, message.Type, string) bool
+
+// Allow implements RateLimiter for the RateLimiterFunc by calling the
+// function itself.
+func (f RateLimiterFunc) Allow(c *Conn, t message.Type, target string) bool {
+	return f(c, t, target)
+}
+
+// RateLimitKey returns the key of the token bucket to use for a request
+// in a TokenBucket. An empty key means that the request is not limited.
+type RateLimitKey func(c *Conn, t message.Type, target string) string
+
+// RateLimitByConn is a RateLimitKey that limits the requests of each
+// connection.
+func RateLimitByConn(c *Conn, _ message.Type, _ string) string {
+	return c.UUID.String()
+}
+
+// RateLimitByIdentity is a RateLimitKey that limits the requests of
+// each authenticated identity (see Server.Authenticator), across all
+// its connections. The requests of connections without an identity
+// are limited per connection.
+func RateLimitByIdentity(c *Conn, t message.Type, target string) string {
+	if id := c.Identity(); id != nil && id.Subject != "" {
+		return "sub:" + id.Subject
+	}
+	return RateLimitByConn(c, t, target)
+}
+
+// RateLimitByTarget is a RateLimitKey that limits the requests to each
+// URI (for CALL requests) or channel (for PUB requests), across all
+// connections.
+func RateLimitByTarget(_ *Conn, t message.Type, target string) string {
+	return t.String() + ":" + target
+}
+
+// TokenBucket is a RateLimiter that uses a token bucket for each key
+// returned by Key (RateLimitByConn if Key is nil). A bucket holds at
+// most Burst tokens (1 if Burst is <= 0) and is refilled at Rate tokens
+// per second. Each request takes a token from its bucket, and is
+// denied if the bucket is empty. A Rate <= 0 denies all requests once
+// the bucket is empty, until the bucket is removed because it is idle
+// (see Idle).
+//
+// The fields should not be updated once the TokenBucket is in use.
+type TokenBucket struct {
+	Rate  float64
+	Burst int
+	Key   RateLimitKey
+
+	// Idle is the time after which the bucket of a key that is not used
+	// is removed, so that the buckets of e.g. closed connections do not
+	// accumulate. The bucket of a key is full again when it is next
+	// used, so with a Rate <= 0, a key is allowed Burst requests again
+	// once it has been idle for that long. If Rate > 0, the buckets are
+	// removed as soon as they are full, if that is sooner, as they are
+	// then equivalent to a new bucket. If it is 0,
+	// DefaultTokenBucketIdle is used.
+	Idle time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+var _ RateLimiter = (*TokenBucket)(nil)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Allow implements RateLimiter for the TokenBucket.
+func (tb *TokenBucket) Allow(c *Conn, t message.Type, target string) bool {
+	keyFn := tb.Key
+	if keyFn == nil {
+		keyFn = RateLimitByConn
+	}
+	key := keyFn(c, t, target)
+	if key == "" {
+		return true
+	}
+
+	burst := float64(tb.Burst)
+	if burst <= 0 {
+		burst = 1
+	}
+	now := time.Now()
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if tb.buckets == nil {
+		tb.buckets = make(map[string]*bucket)
+		tb.lastSweep = now
+	}
+	tb.sweep(now, burst)
+
+	b := tb.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: burst, last: now}
+		tb.buckets[key] = b
+	}
+	if tb.Rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * tb.Rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep removes the buckets that are idle or full (see Idle), so that
+// the buckets of e.g. closed connections do not accumulate. It runs at
+// most once per idle period.
+func (tb *TokenBucket) sweep(now time.Time, burst float64) {
+	idle := tb.Idle
+	if idle <= 0 {
+		idle = DefaultTokenBucketIdle
+	}
+	if tb.Rate > 0 {
+		if full := time.Duration(burst / tb.Rate * float64(time.Second)); full < idle {
+			idle = full
+		}
+	}
+	if now.Sub(tb.lastSweep) < idle {
+		return
+	}
+	tb.lastSweep = now
+	for k, b := range tb.buckets {
+		if now.Sub(b.last) >= idle {
+			delete(tb.buckets, k)
+		}
+	}
+}
+
+// rateLimit returns nil if the request m is allowed by the server's
+// RateLimiter, or the NACK to send otherwise. Only CALL and PUB
+// requests are limited.
+func (c *Conn) rateLimit(m message.Msg) *message.Nack {
+	rl := c.srv.RateLimiter
+	if rl == nil {
+		return nil
+	}
+
+	var target string
+	switch m := m.(type) {
+	case *message.Call:
+		target = m.Payload.URI
+	case *message.Pub:
+		target = m.Payload.Channel
+	default:
+		return nil
+	}
+
+	if rl.Allow(c, m.Type(), target) {
+		return nil
+	}
+	return message.NewNack(m, 429, errRateLimited)
+}
@@ -0,0 +1,106 @@
+package juggler
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	c1 := &Conn{UUID: uuid.NewRandom()}
+	c2 := &Conn{UUID: uuid.NewRandom()}
+
+	tb := &TokenBucket{Rate: 100, Burst: 2}
+	assert.True(t, tb.Allow(c1, message.CallMsg, "a"), "1st")
+	assert.True(t, tb.Allow(c1, message.PubMsg, "b"), "2nd")
+	assert.False(t, tb.Allow(c1, message.CallMsg, "a"), "3rd")
+	assert.True(t, tb.Allow(c2, message.CallMsg, "a"), "other connection")
+
+	// refilled after 1/rate
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, tb.Allow(c1, message.CallMsg, "a"), "refilled")
+
+	// full buckets are swept
+	time.Sleep(30 * time.Millisecond)
+	tb.Allow(c1, message.CallMsg, "a")
+	tb.mu.Lock()
+	assert.Len(t, tb.buckets, 1, "swept buckets")
+	tb.mu.Unlock()
+
+	// idle buckets are swept even if they are never refilled
+	tb = &TokenBucket{Idle: 20 * time.Millisecond}
+	assert.True(t, tb.Allow(c1, message.CallMsg, "a"), "no rate 1st")
+	assert.False(t, tb.Allow(c1, message.CallMsg, "a"), "no rate 2nd")
+	time.Sleep(30 * time.Millisecond)
+	assert.True(t, tb.Allow(c2, message.CallMsg, "a"), "no rate other connection")
+	tb.mu.Lock()
+	assert.Len(t, tb.buckets, 1, "swept idle buckets")
+	tb.mu.Unlock()
+
+	tb = &TokenBucket{Key: RateLimitByTarget}
+	assert.True(t, tb.Allow(c1, message.CallMsg, "a"), "a")
+	assert.False(t, tb.Allow(c2, message.CallMsg, "a"), "a on other connection")
+	assert.True(t, tb.Allow(c2, message.PubMsg, "a"), "pub a")
+	assert.True(t, tb.Allow(c2, message.CallMsg, "b"), "b")
+
+	tb = &TokenBucket{Key: func(*Conn, message.Type, string) string { return "" }}
+	for i := 0; i < 3; i++ {
+		assert.True(t, tb.Allow(c1, message.CallMsg, "a"), "no key %d", i)
+	}
+
+	c1.identity = &Identity{Subject: "u"}
+	c2.identity = &Identity{Subject: "u"}
+	assert.Equal(t, "sub:u", RateLimitByIdentity(c1, message.CallMsg, "a"), "identity")
+	tb = &TokenBucket{Key: RateLimitByIdentity}
+	assert.True(t, tb.Allow(c1, message.CallMsg, "a"), "identity 1")
+	assert.False(t, tb.Allow(c2, message.CallMsg, "a"), "identity 2")
+}
+
+func TestRateLimiter(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		PubSubBroker: &fakePubSubBroker{},
+		Vars:         vars,
+		RateLimiter:  &TokenBucket{Burst: 2},
+	}
+	cli, recv, closeFn := dialAllowed(t, server, "call, pub, sub")
+	defer closeFn()
+
+	cases := []struct {
+		mt   message.Type
+		code int
+	}{
+		{message.CallMsg, 0},
+		{message.PubMsg, 0},
+		{message.CallMsg, 429},
+		{message.PubMsg, 429},
+		{message.SubMsg, 0},
+	}
+	for i, c := range cases {
+		var err error
+		switch c.mt {
+		case message.CallMsg:
+			_, err = cli.Call("a", nil, time.Second)
+		case message.PubMsg:
+			_, err = cli.Pub("a", nil)
+		case message.SubMsg:
+			_, err = cli.Sub("a", false)
+		}
+		require.NoError(t, err, "%d: send", i)
+		got := recv(1)
+		if c.code == 0 {
+			assert.NotNil(t, got[message.AckMsg], "%d: ACK", i)
+			continue
+		}
+		if m, ok := got[message.NackMsg]; assert.True(t, ok, "%d: NACK", i) {
+			assert.Equal(t, c.code, m.(*message.Nack).Payload.Code, "%d: NACK code", i)
+		}
+	}
+	assert.Equal(t, "2", vars.Get("RateLimitedMsgs").String(), "RateLimitedMsgs")
+}
@@ -0,0 +1,101 @@
+package juggler
+
+import (
+	"sync"
+
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// ConnRegistry tracks live connections by UUID. The zero value is an
+// empty registry ready to use. It is safe for concurrent use.
+//
+// The Server registers each connection it serves in its own registry
+// for the lifetime of the connection, see Server.Conns and
+// Server.ConnByUUID.
+type ConnRegistry struct {
+	mu    sync.Mutex
+	conns map[string]*Conn
+}
+
+// Add adds the connection c to the registry.
+func (r *ConnRegistry) Add(c *Conn) {
+	r.mu.Lock()
+	if r.conns == nil {
+		r.conns = make(map[string]*Conn)
+	}
+	r.conns[c.UUID.String()] = c
+	r.mu.Unlock()
+}
+
+// Remove removes the connection c from the registry.
+func (r *ConnRegistry) Remove(c *Conn) {
+	r.mu.Lock()
+	delete(r.conns, c.UUID.String())
+	r.mu.Unlock()
+}
+
+// Get returns the connection identified by connUUID, and false if it
+// is not in the registry.
+func (r *ConnRegistry) Get(connUUID uuid.UUID) (*Conn, bool) {
+	r.mu.Lock()
+	c, ok := r.conns[connUUID.String()]
+	r.mu.Unlock()
+	return c, ok
+}
+
+// Conns returns the connections in the registry, in no specific
+// order.
+func (r *ConnRegistry) Conns() []*Conn {
+	r.mu.Lock()
+	conns := make([]*Conn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+	return conns
+}
+
+// Len returns the number of connections in the registry.
+func (r *ConnRegistry) Len() int {
+	r.mu.Lock()
+	n := len(r.conns)
+	r.mu.Unlock()
+	return n
+}
+
+// Conns returns the active connections served by the server, in no
+// specific order.
+func (srv *Server) Conns() []*Conn {
+	return srv.conns.Conns()
+}
+
+// ConnByUUID returns the active connection identified by connUUID, and
+// false if the server doesn't serve such a connection.
+func (srv *Server) ConnByUUID(connUUID uuid.UUID) (*Conn, bool) {
+	return srv.conns.Get(connUUID)
+}
+
+// Broadcast sends the message m to all connections served by this
+// server, as Conn.Send does. It returns the number of connections the
+// message was sent to. Only the connections of this server are
+// considered, it does not go through the brokers.
+func (srv *Server) Broadcast(m message.Msg) int {
+	conns := srv.conns.Conns()
+	for _, c := range conns {
+		c.Send(m)
+	}
+	return len(conns)
+}
+
+// SendTo sends the message m to the connection identified by connUUID,
+// as Conn.Send does. It returns false if the server doesn't serve such
+// a connection. It does not go through the brokers, so the connection
+// must be served by this server.
+func (srv *Server) SendTo(connUUID uuid.UUID, m message.Msg) bool {
+	c, ok := srv.conns.Get(connUUID)
+	if ok {
+		c.Send(m)
+	}
+	return ok
+}
@@ -0,0 +1,151 @@
+package juggler
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// RoomChannelPrefix is the prefix of the pub-sub channels used for
+// rooms. The members of a room receive the events published to the
+// room as EVNT messages on channel RoomChannelPrefix + room. The
+// prefix is reserved, the clients cannot publish, subscribe or
+// unsubscribe on those channels, the members of the rooms are managed
+// by the server with Join and Leave.
+const RoomChannelPrefix = "juggler.room."
+
+var (
+	// ErrNoRoomsBroker is returned when a rooms method is called on a
+	// Server or Conn that has no RoomsBroker.
+	ErrNoRoomsBroker = errors.New("juggler: no rooms broker")
+
+	// ErrNoPresenceBroker is returned when Server.Presence is called on
+	// a Server that has no PresenceBroker.
+	ErrNoPresenceBroker = errors.New("juggler: no presence broker")
+
+	// ErrNoEvents is returned when a connection that is not allowed to
+	// receive events (SUB is not allowed) tries to join a room.
+	ErrNoEvents = errors.New("juggler: connection does not receive events")
+)
+
+// RoomChannel returns the pub-sub channel used for room.
+func RoomChannel(room string) string {
+	return RoomChannelPrefix + room
+}
+
+// isRoomChannel returns true if channel starts with the reserved
+// RoomChannelPrefix.
+func isRoomChannel(channel string) bool {
+	return strings.HasPrefix(channel, RoomChannelPrefix)
+}
+
+// Join adds the connection to the room. The connection receives the
+// events published to the room until it leaves it or until it is
+// closed - the connection automatically leaves all its rooms when it
+// is closed.
+func (c *Conn) Join(room string) error {
+	rb := c.srv.RoomsBroker
+	if rb == nil {
+		return ErrNoRoomsBroker
+	}
+	if c.pubSubConn() == nil {
+		return ErrNoEvents
+	}
+
+	if err := rb.Join(room, c.UUID); err != nil {
+		return err
+	}
+	if err := c.subscribe(RoomChannel(room), false, nil); err != nil {
+		rb.Leave(room, c.UUID)
+		return err
+	}
+	c.addPresence(RoomChannel(room))
+
+	c.rmu.Lock()
+	if c.rooms == nil {
+		c.rooms = make(map[string]struct{})
+	}
+	c.rooms[room] = struct{}{}
+	c.rmu.Unlock()
+	return nil
+}
+
+// Leave removes the connection from the room.
+func (c *Conn) Leave(room string) error {
+	rb := c.srv.RoomsBroker
+	if rb == nil {
+		return ErrNoRoomsBroker
+	}
+	if c.pubSubConn() == nil {
+		return ErrNoEvents
+	}
+
+	c.rmu.Lock()
+	delete(c.rooms, room)
+	c.rmu.Unlock()
+
+	if err := c.unsubscribe(RoomChannel(room), false); err != nil {
+		return err
+	}
+	c.removePresence(RoomChannel(room))
+	return rb.Leave(room, c.UUID)
+}
+
+// Rooms returns the sorted list of rooms that the connection is a
+// member of.
+func (c *Conn) Rooms() []string {
+	c.rmu.Lock()
+	rooms := make([]string, 0, len(c.rooms))
+	for r := range c.rooms {
+		rooms = append(rooms, r)
+	}
+	c.rmu.Unlock()
+
+	sort.Strings(rooms)
+	return rooms
+}
+
+// leaveAll removes the connection from all its rooms. It is called
+// once the connection is closed, so the pub-sub connection is already
+// closed and only the membership is removed.
+func (c *Conn) leaveAll() {
+	rb := c.srv.RoomsBroker
+	if rb == nil {
+		return
+	}
+
+	for _, room := range c.Rooms() {
+		rb.Leave(room, c.UUID)
+	}
+	c.rmu.Lock()
+	c.rooms = nil
+	c.rmu.Unlock()
+}
+
+// PublishRoom publishes an event with v as arguments to all members
+// of the room. It returns the number of subscribers that received the
+// event.
+func (srv *Server) PublishRoom(room string, v interface{}) (int, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	pp := &message.PubPayload{
+		MsgUUID: uuid.NewRandom(),
+		Args:    b,
+	}
+	return srv.PubSubBroker.Publish(RoomChannel(room), pp)
+}
+
+// RoomMembers returns the UUIDs of the connections that are members
+// of the room, across all servers that share the same RoomsBroker.
+func (srv *Server) RoomMembers(room string) ([]uuid.UUID, error) {
+	if srv.RoomsBroker == nil {
+		return nil, ErrNoRoomsBroker
+	}
+	return srv.RoomsBroker.Members(room)
+}
@@ -0,0 +1,72 @@
+package juggler
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mna/juggler/metrics"
+	"github.com/gorilla/websocket"
+)
+
+// RTT returns the smoothed round-trip time of the connection, measured
+// with websocket pings if the server's RTTInterval is set. It returns
+// 0 if no round-trip time was measured yet. It can be called in the
+// ConnState callback for the Closed state, e.g. to log the statistics
+// of the connection.
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// handlePong records the time of the pong for the keep-alive, and the
+// round-trip time of the ping whose payload is the pong's payload. It
+// is set as pong handler of the websocket connection, so it is called
+// from the read loop.
+func (c *Conn) handlePong(data string) error {
+	atomic.StoreInt64(&c.lastPong, time.Now().UnixNano())
+
+	sent, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		// not a ping sent by measureRTT, e.g. a keep-alive ping
+		return nil
+	}
+	rtt := time.Since(time.Unix(0, sent))
+	if rtt < 0 {
+		return nil
+	}
+
+	// smoothed as TCP does (RFC 6298): srtt = 7/8 srtt + 1/8 rtt
+	srtt := c.RTT()
+	if srtt == 0 {
+		srtt = rtt
+	} else {
+		srtt = srtt - srtt/8 + rtt/8
+	}
+	atomic.StoreInt64(&c.rtt, int64(srtt))
+
+	metrics.Observe(c.srv.vars, "RTT", int64(rtt/time.Microsecond))
+	return nil
+}
+
+// measureRTT sends a websocket ping with the current time as payload
+// every interval, until the connection is closed. It is started in its
+// own goroutine.
+func (c *Conn) measureRTT(interval time.Duration) {
+	c.srv.vars.Add("TotalConnGoros", 1)
+	c.srv.vars.Add("ActiveConnGoros", 1)
+	defer c.srv.vars.Add("ActiveConnGoros", -1)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.kill:
+			return
+		case now := <-t.C:
+			data := strconv.FormatInt(now.UnixNano(), 10)
+			if err := c.wsConn.WriteControl(websocket.PingMessage, []byte(data), now.Add(interval)); err != nil {
+				c.srv.vars.Add("FailedPings", 1)
+			}
+		}
+	}
+}
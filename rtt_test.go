@@ -0,0 +1,108 @@
+package juggler
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/jugglertest"
+	"github.com/mna/juggler/metrics"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTT(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		RTTInterval:  5 * time.Millisecond,
+		Vars:         vars,
+	}
+	_, c, _, closeFn := dialConn(t, server, "call")
+	defer closeFn()
+
+	deadline := time.Now().Add(time.Second)
+	for c.RTT() == 0 {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "no round-trip time measured")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if h, ok := vars.Get("RTT").(*metrics.Histogram); assert.True(t, ok, "RTT histogram") {
+		assert.True(t, h.Count() > 0, "RTT observed")
+	}
+}
+
+func TestHandlePong(t *testing.T) {
+	srv := &Server{}
+	c := newConn(nil, srv)
+
+	ping := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(-d).UnixNano(), 10)
+	}
+
+	require.NoError(t, c.handlePong("invalid"), "invalid pong")
+	assert.Equal(t, time.Duration(0), c.RTT(), "no RTT for invalid pong")
+
+	require.NoError(t, c.handlePong(ping(80*time.Millisecond)), "first pong")
+	rtt := c.RTT()
+	assert.True(t, rtt >= 80*time.Millisecond && rtt < 90*time.Millisecond, "first RTT %s", rtt)
+
+	// smoothed, so a single faster pong only reduces it by 1/8th of the difference
+	require.NoError(t, c.handlePong(ping(0)), "second pong")
+	rtt = c.RTT()
+	assert.True(t, rtt >= 70*time.Millisecond && rtt < 80*time.Millisecond, "smoothed RTT %s", rtt)
+}
+
+func TestKeepAlive(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		PingInterval: 5 * time.Millisecond,
+		PongTimeout:  20 * time.Millisecond,
+		Vars:         vars,
+	}
+	nextConn := connected(t, server)
+	upg := &websocket.Upgrader{Subprotocols: Subprotocols}
+	l := jugglertest.StartPipeServer(Upgrade(upg, server))
+	defer l.Close()
+
+	connect := func(answer bool) *Conn {
+		wsc, _, err := l.Dialer(Subprotocols...).Dial(jugglertest.PipeURL, http.Header{"Juggler-Allowed-Messages": {"call"}})
+		require.NoError(t, err, "Dial")
+		if !answer {
+			wsc.SetPingHandler(func(string) error { return nil })
+		}
+		// pongs are sent by the read loop
+		go func() {
+			for {
+				if _, _, err := wsc.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		return nextConn()
+	}
+
+	// the client answers the pings, the connection stays open
+	c := connect(true)
+	select {
+	case <-c.CloseNotify():
+		require.FailNow(t, "connection closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Nil(t, vars.Get("MissedPongs"), "no missed pong")
+
+	// the client doesn't answer the pings
+	c = connect(false)
+	select {
+	case <-c.CloseNotify():
+		assert.Equal(t, errPongTimeout, c.CloseErr, "CloseErr")
+	case <-time.After(time.Second):
+		require.FailNow(t, "connection not closed")
+	}
+	assert.Equal(t, "1", vars.Get("MissedPongs").String(), "MissedPongs")
+}
@@ -0,0 +1,176 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule defines when a job is fired.
+type Schedule interface {
+	// Next returns the first time strictly after t at which the job
+	// should be fired.
+	Next(t time.Time) time.Time
+}
+
+// Every is a Schedule that fires at a fixed interval. The ticks are
+// aligned on multiples of the interval since the Unix epoch, so that
+// all instances of a scheduler fire at the same times.
+type Every time.Duration
+
+// Next returns the first tick strictly after t.
+func (e Every) Next(t time.Time) time.Time {
+	d := time.Duration(e)
+	if d <= 0 {
+		d = time.Second
+	}
+	return t.Truncate(d).Add(d)
+}
+
+// Parse parses a schedule specification, which is either a standard
+// cron expression with 5 fields (minute, hour, day of month, month
+// and day of week), "@every <duration>" (see time.ParseDuration), or
+// one of "@hourly", "@daily", "@weekly" and "@monthly". The fields
+// of a cron expression support "*", numbers, lists (1,2), ranges (1-5)
+// and steps (*/5 or 1-30/5). Months and days of week are numbers, with
+// Sunday as 0 or 7. Cron expressions are evaluated in the location of
+// the time passed to Next.
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("juggler/scheduler: invalid schedule %q: %v", spec, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("juggler/scheduler: invalid schedule %q: interval must be positive", spec)
+		}
+		return Every(d), nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("juggler/scheduler: invalid schedule %q: expected 5 fields", spec)
+	}
+	var c cron
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	dst := [5]*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, f := range fields {
+		bits, err := parseField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("juggler/scheduler: invalid schedule %q: %v", spec, err)
+		}
+		*dst[i] = bits
+	}
+	// Sunday is 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.anyDom = fields[2] == "*"
+	c.anyDow = fields[4] == "*"
+	return &c, nil
+}
+
+// parseField parses a field of a cron expression, with values in
+// [min, max], and returns the bitset of the values.
+func parseField(f string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if step > 1 {
+				// "n/step" means from n to max
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value out of range in %q", part)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// cron is a Schedule defined by a cron expression, with the allowed
+// values of each field stored as bitsets.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+// maxSearch is the limit of the search for the next time of a cron
+// schedule, after which it is assumed to never fire (e.g. February 30).
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+// Next returns the first time strictly after t that matches the cron
+// expression, or the zero time if there is none.
+func (c *cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxSearch)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchDay returns true if the day of t matches the cron expression.
+// As for the standard cron, if both the day of month and the day of
+// week are restricted, the day matches if either one matches.
+func (c *cron) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,49 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	start := time.Date(2016, 3, 15, 10, 30, 20, 0, time.UTC) // a Tuesday
+	cases := []struct {
+		spec string
+		exp  time.Time // zero if invalid
+	}{
+		{"* * * * *", time.Date(2016, 3, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2016, 3, 15, 10, 45, 0, 0, time.UTC)},
+		{"5 * * * *", time.Date(2016, 3, 15, 11, 5, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2016, 3, 15, 13, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2016, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2016, 3, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 4", time.Date(2016, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC).AddDate(4, 0, 0)},
+		{"1,2 3 * 12 *", time.Date(2016, 12, 1, 3, 1, 0, 0, time.UTC)},
+		{"@daily", time.Date(2016, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{"@every 1h", time.Date(2016, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{"@every 0s", time.Time{}},
+		{"@every x", time.Time{}},
+		{"* * * *", time.Time{}},
+		{"60 * * * *", time.Time{}},
+		{"5-1 * * * *", time.Time{}},
+		{"*/0 * * * *", time.Time{}},
+		{"a * * * *", time.Time{}},
+	}
+	for _, c := range cases {
+		s, err := Parse(c.spec)
+		if c.exp.IsZero() {
+			assert.Error(t, err, c.spec)
+			continue
+		}
+		require.NoError(t, err, c.spec)
+		assert.Equal(t, c.exp, s.Next(start), c.spec)
+	}
+
+	s, err := Parse("0 0 30 2 *")
+	require.NoError(t, err, "February 30")
+	assert.True(t, s.Next(start).IsZero(), "never fires")
+}
@@ -0,0 +1,184 @@
+// Package scheduler implements a Scheduler that makes juggler calls
+// on recurring schedules, so that the RPC infrastructure can be used
+// to run periodic jobs. The calls are made via a broker.CallerBroker,
+// so the jobs are executed by the callees listening on their URIs.
+//
+// Multiple instances of a scheduler can run the same jobs for high
+// availability: if the broker implements broker.Locker, a distributed
+// lock ensures that a single instance makes the call of each tick.
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/pborman/uuid"
+)
+
+// DefaultLockTTL is the default time-to-live of the lock of a tick.
+// It should be longer than the clock skew between the instances of
+// the scheduler.
+var DefaultLockTTL = time.Minute
+
+// Job is a call made on a recurring schedule.
+type Job struct {
+	// Name identifies the job for the distributed lock of each tick.
+	// If it is empty, the URI is used.
+	Name string
+
+	// Schedule defines when the call is made.
+	Schedule Schedule
+
+	// URI is the URI to call, with Args as JSON-encoded arguments. The
+	// call expires after Timeout, or broker.DefaultCallTimeout if it
+	// is 0.
+	URI     string
+	Args    json.RawMessage
+	Timeout time.Duration
+}
+
+// Scheduler makes the calls of jobs on their schedules.
+type Scheduler struct {
+	// prevent unkeyed literals
+	_ struct{}
+
+	// Broker is the broker used to make the calls. If it implements
+	// broker.Locker, a lock is acquired for each tick of a job, so that
+	// only one instance of the scheduler makes the call.
+	Broker broker.CallerBroker
+
+	// LockTTL is the time-to-live of the lock of each tick. If it is
+	// 0, DefaultLockTTL is used.
+	LockTTL time.Duration
+
+	// LogFunc is the logging function to use. If nil, log.Printf
+	// is used.
+	LogFunc func(string, ...interface{})
+
+	// Vars can be set to a metrics.Sink (e.g. an *expvar.Map) to
+	// collect metrics about the scheduler.
+	Vars metrics.Sink
+}
+
+// Run runs the jobs until stop is closed. The results of the calls
+// are received on a results connection identified by a random UUID,
+// and the errors are logged. It returns an error if the results
+// connection cannot be created, otherwise it returns nil once stop
+// is closed and the jobs are stopped.
+func (s *Scheduler) Run(jobs []*Job, stop <-chan struct{}) error {
+	connUUID := uuid.NewRandom()
+	rc, err := s.Broker.NewResultsConn(connUUID)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.results(rc)
+	}()
+
+	var jwg sync.WaitGroup
+	for _, job := range jobs {
+		jwg.Add(1)
+		go func(job *Job) {
+			defer jwg.Done()
+			s.runJob(connUUID, job, stop)
+		}(job)
+	}
+	jwg.Wait()
+
+	rc.Close()
+	wg.Wait()
+	return nil
+}
+
+// runJob makes the calls of job on its schedule until stop is closed.
+func (s *Scheduler) runJob(connUUID uuid.UUID, job *Job, stop <-chan struct{}) {
+	for {
+		now := time.Now()
+		next := job.Schedule.Next(now)
+		if next.IsZero() {
+			s.logf("scheduler: job %s will never fire", job.name())
+			return
+		}
+
+		t := time.NewTimer(next.Sub(now))
+		select {
+		case <-stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		s.fire(connUUID, job, next)
+	}
+}
+
+// fire makes the call of job for the tick at t, if it acquires the
+// lock of the tick.
+func (s *Scheduler) fire(connUUID uuid.UUID, job *Job, t time.Time) {
+	vars := metrics.Or(s.Vars)
+
+	if l, ok := s.Broker.(broker.Locker); ok {
+		ttl := s.LockTTL
+		if ttl <= 0 {
+			ttl = DefaultLockTTL
+		}
+		ok, err := l.TryLock(fmt.Sprintf("scheduler:%s:%d", job.name(), t.UnixNano()), ttl)
+		if err != nil {
+			vars.Add("FailedJobLocks", 1)
+			s.logf("scheduler: failed to lock job %s: %v", job.name(), err)
+			return
+		}
+		if !ok {
+			// another instance makes the call
+			vars.Add("LockedJobs", 1)
+			return
+		}
+	}
+
+	cp := &message.CallPayload{
+		ConnUUID: connUUID,
+		MsgUUID:  uuid.NewRandom(),
+		URI:      job.URI,
+		Args:     job.Args,
+	}
+	if err := s.Broker.Call(cp, job.Timeout); err != nil {
+		vars.Add("FailedJobCalls", 1)
+		s.logf("scheduler: failed to call %s for job %s: %v", job.URI, job.name(), err)
+		return
+	}
+	vars.Add("JobCalls", 1)
+}
+
+// results receives the results of the calls, logging the errors.
+func (s *Scheduler) results(rc broker.ResultsConn) {
+	for rp := range rc.Results() {
+		if rp.Error {
+			metrics.Or(s.Vars).Add("FailedJobs", 1)
+			s.logf("scheduler: call %v to %s failed: %s", rp.MsgUUID, rp.URI, rp.Args)
+		}
+	}
+}
+
+func (s *Scheduler) logf(f string, args ...interface{}) {
+	if s.LogFunc != nil {
+		s.LogFunc(f, args...)
+	} else {
+		log.Printf(f, args...)
+	}
+}
+
+func (j *Job) name() string {
+	if j.Name != "" {
+		return j.Name
+	}
+	return j.URI
+}
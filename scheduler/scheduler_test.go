@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"expvar"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBroker struct {
+	mu    sync.Mutex
+	calls []*message.CallPayload
+	locks map[string]bool
+}
+
+func (b *fakeBroker) NewResultsConn(uuid.UUID) (broker.ResultsConn, error) {
+	return &fakeResultsConn{ch: make(chan *message.ResPayload)}, nil
+}
+
+func (b *fakeBroker) Call(cp *message.CallPayload, timeout time.Duration) error {
+	b.mu.Lock()
+	b.calls = append(b.calls, cp)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *fakeBroker) TryLock(key string, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.locks[key] {
+		return false, nil
+	}
+	b.locks[key] = true
+	return true, nil
+}
+
+type fakeResultsConn struct {
+	ch chan *message.ResPayload
+}
+
+func (c *fakeResultsConn) Results() <-chan *message.ResPayload { return c.ch }
+func (c *fakeResultsConn) ResultsErr() error                   { return nil }
+func (c *fakeResultsConn) Close() error {
+	close(c.ch)
+	return nil
+}
+
+func TestScheduler(t *testing.T) {
+	brk := &fakeBroker{locks: make(map[string]bool)}
+	vars := new(expvar.Map).Init()
+	jobs := []*Job{{Schedule: Every(20 * time.Millisecond), URI: "a"}}
+
+	// two instances of the scheduler run the same job
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := &Scheduler{Broker: brk, Vars: vars}
+			require.NoError(t, s.Run(jobs, stop), "Run")
+		}()
+	}
+	time.Sleep(110 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	brk.mu.Lock()
+	defer brk.mu.Unlock()
+	assert.True(t, len(brk.calls) >= 4 && len(brk.calls) <= 6, "number of calls: %d", len(brk.calls))
+	assert.Equal(t, len(brk.locks), len(brk.calls), "one call per tick")
+	for _, cp := range brk.calls {
+		assert.Equal(t, "a", cp.URI, "URI")
+	}
+	assert.Equal(t, vars.Get("JobCalls").String(), vars.Get("LockedJobs").String(), "locked jobs")
+}
@@ -0,0 +1,346 @@
+package juggler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+)
+
+// WritePolicy defines the order in which the messages waiting in the
+// send queue of a connection are written (see Server.SendQueueSize).
+type WritePolicy int
+
+// List of write policies.
+const (
+	// WriteFIFO writes the messages in the order they are queued.
+	WriteFIFO WritePolicy = iota
+
+	// WritePriority writes the latency-critical messages before the
+	// others, so that a burst of events doesn't delay the responses to
+	// the requests of the client. By default, ACK, NACK and RES messages
+	// are latency-critical and EVNT messages are not, but this can be
+	// changed with the priority of the messages (see message.Meta).
+	WritePriority
+
+	// WritePriorityDropEvents is like WritePriority, but EVNT messages
+	// that are not latency-critical are dropped instead of waiting for
+	// room in the queue when their queue is full.
+	WritePriorityDropEvents
+)
+
+var writePolicyNames = [...]string{
+	WriteFIFO:               "fifo",
+	WritePriority:           "priority",
+	WritePriorityDropEvents: "priority-drop-events",
+}
+
+// String returns the name of the write policy.
+func (p WritePolicy) String() string {
+	if p >= 0 && int(p) < len(writePolicyNames) {
+		return writePolicyNames[p]
+	}
+	return fmt.Sprintf("WritePolicy(%d)", int(p))
+}
+
+// ParseWritePolicy returns the write policy identified by name, as
+// returned by WritePolicy.String. An empty name returns WriteFIFO.
+func ParseWritePolicy(name string) (WritePolicy, error) {
+	if name == "" {
+		return WriteFIFO, nil
+	}
+	for i, n := range writePolicyNames {
+		if n == name {
+			return WritePolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("juggler: unknown write policy %q", name)
+}
+
+// OverflowPolicy defines what happens when a message is sent while the
+// send queue of a connection is full (see Server.SendQueueSize), e.g.
+// because the client is too slow to read its messages.
+type OverflowPolicy int
+
+// List of overflow policies.
+const (
+	// OverflowBlock waits for room in the queue for at most the server's
+	// AcquireWriteLockTimeout, after which the connection is closed. If
+	// AcquireWriteLockTimeout is 0, it waits until there is room in the
+	// queue or the connection is closed.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropOldest drops the oldest queued EVNT messages to make
+	// room for a new EVNT message, so that a slow client receives the
+	// most recent events. The EVNT messages that are not
+	// latency-critical are then always queued separately from the other
+	// messages, even with WriteFIFO, and the other messages wait for
+	// room in the queue as with OverflowBlock.
+	OverflowDropOldest
+
+	// OverflowClose closes the connection as soon as a message is sent
+	// while the queue is full, so that a slow client never delays the
+	// goroutines that send its messages.
+	OverflowClose
+)
+
+var overflowPolicyNames = [...]string{
+	OverflowBlock:      "block",
+	OverflowDropOldest: "drop-oldest",
+	OverflowClose:      "close",
+}
+
+// String returns the name of the overflow policy.
+func (p OverflowPolicy) String() string {
+	if p >= 0 && int(p) < len(overflowPolicyNames) {
+		return overflowPolicyNames[p]
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// ParseOverflowPolicy returns the overflow policy identified by name,
+// as returned by OverflowPolicy.String. An empty name returns
+// OverflowBlock.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	if name == "" {
+		return OverflowBlock, nil
+	}
+	for i, n := range overflowPolicyNames {
+		if n == name {
+			return OverflowPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("juggler: unknown overflow policy %q", name)
+}
+
+var errSendQueueFull = errors.New("juggler: send queue full")
+
+// queuedMsg is a message waiting in a send queue.
+type queuedMsg struct {
+	m     message.Msg
+	addFn func(string, int64)
+}
+
+// sendQueue is the send queue of a connection. With the WriteFIFO
+// policy, both channels are the same, unless the oldest events are
+// dropped.
+type sendQueue struct {
+	rpc        chan queuedMsg // latency-critical messages
+	evnt       chan queuedMsg // other messages
+	dropOldest bool           // evnt only holds the droppable EVNT messages
+}
+
+// isLatencyCritical returns true if m is latency-critical, based on
+// its priority and, for the default priority, its type.
+func isLatencyCritical(m message.Msg) bool {
+	if p := m.Priority(); p != 0 {
+		return p > 0
+	}
+	return m.Type() != message.EvntMsg
+}
+
+func newSendQueue(size int, policy WritePolicy, overflow OverflowPolicy) *sendQueue {
+	q := &sendQueue{
+		rpc:        make(chan queuedMsg, size),
+		dropOldest: overflow == OverflowDropOldest,
+	}
+	q.evnt = q.rpc
+	if policy != WriteFIFO || q.dropOldest {
+		q.evnt = make(chan queuedMsg, size)
+	}
+	return q
+}
+
+// len returns the number of messages in the queue.
+func (q *sendQueue) len() int {
+	if q.evnt == q.rpc {
+		return len(q.rpc)
+	}
+	return len(q.rpc) + len(q.evnt)
+}
+
+// queueFor returns the channel of the queue that holds m, and true if
+// it is a droppable EVNT message.
+func (q *sendQueue) queueFor(m message.Msg) (chan queuedMsg, bool) {
+	critical := isLatencyCritical(m)
+	evnt := !critical && m.Type() == message.EvntMsg
+	if evnt || (!critical && !q.dropOldest) {
+		return q.evnt, evnt
+	}
+	return q.rpc, false
+}
+
+// SendQueueLen returns the number of messages waiting in the send queue
+// of the connection, or 0 if the server has no SendQueueSize.
+func (c *Conn) SendQueueLen() int {
+	if c.sendq == nil {
+		return 0
+	}
+	return c.sendq.len()
+}
+
+// enqueue adds m to the send queue of the connection. If the queue is
+// full, it drops m if it is an EVNT message and the write policy drops
+// them, otherwise it applies the server's SendQueueOverflow policy.
+func (c *Conn) enqueue(m message.Msg, addFn func(string, int64)) {
+	ch, droppable := c.sendq.queueFor(m)
+
+	qm := queuedMsg{m: m, addFn: addFn}
+	select {
+	case ch <- qm:
+		metrics.Observe(c.srv.vars, "SendQueueDepth", int64(c.sendq.len()))
+		return
+	default:
+	}
+
+	addFn("SendQueueFull", 1)
+	if droppable && c.srv.WritePolicy == WritePriorityDropEvents {
+		addFn("DroppedEvnts", 1)
+		return
+	}
+
+	switch c.srv.SendQueueOverflow {
+	case OverflowClose:
+		addFn("SendQueueOverflows", 1)
+		c.Close(errSendQueueFull)
+		return
+
+	case OverflowDropOldest:
+		if droppable {
+			c.dropOldest(ch, qm)
+			return
+		}
+	}
+
+	var timeout <-chan time.Time
+	if to := c.srv.Settings().AcquireWriteLockTimeout; to > 0 {
+		t := time.NewTimer(to)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case ch <- qm:
+	case <-c.kill:
+	case <-timeout:
+		addFn("SendQueueTimeouts", 1)
+		c.Close(errSendQueueFull)
+	}
+}
+
+// dropOldest drops the oldest messages of the queue ch until qm can be
+// added to it.
+func (c *Conn) dropOldest(ch chan queuedMsg, qm queuedMsg) {
+	for {
+		select {
+		case old := <-ch:
+			old.addFn("DroppedEvnts", 1)
+		default:
+		}
+
+		select {
+		case ch <- qm:
+			return
+		case <-c.kill:
+			return
+		default:
+		}
+	}
+}
+
+// writeQueued is the loop that writes the messages of the send queue,
+// started in its own goroutine.
+func (c *Conn) writeQueued() {
+	c.srv.vars.Add("TotalConnGoros", 1)
+	c.srv.vars.Add("ActiveConnGoros", 1)
+	defer c.srv.vars.Add("ActiveConnGoros", -1)
+
+	q := c.sendq
+	batch := 0
+	if n := c.srv.WriteBatchSize; n > 1 && message.IsBatch(c.Subprotocol()) {
+		batch = n
+	}
+	for {
+		// always write the pending latency-critical messages first
+		select {
+		case qm := <-q.rpc:
+			c.writeQueuedMsg(qm, batch)
+			continue
+		case <-c.kill:
+			return
+		default:
+		}
+
+		select {
+		case qm := <-q.rpc:
+			c.writeQueuedMsg(qm, batch)
+		case qm := <-q.evnt:
+			c.writeQueuedMsg(qm, batch)
+		case <-c.kill:
+			return
+		}
+	}
+}
+
+// writeQueuedMsg writes qm and, if batch is > 1, the other messages
+// already in the send queue, up to batch messages, in as few websocket
+// messages as the WriteLimit allows.
+func (c *Conn) writeQueuedMsg(qm queuedMsg, batch int) {
+	if batch <= 1 {
+		doWrite(c, qm.m, qm.addFn)
+		return
+	}
+
+	qms := []queuedMsg{qm}
+	q := c.sendq
+loop:
+	for len(qms) < batch {
+		select {
+		case qm := <-q.rpc:
+			qms = append(qms, qm)
+		default:
+			select {
+			case qm := <-q.evnt:
+				qms = append(qms, qm)
+			default:
+				break loop
+			}
+		}
+	}
+	if len(qms) == 1 {
+		doWrite(c, qm.m, qm.addFn)
+		return
+	}
+
+	// encode the messages to split the batches at the write limit, each
+	// batch has at least one message.
+	limit := c.srv.Settings().WriteLimit
+	var msgs []json.RawMessage
+	size := 1
+	for _, qm := range qms {
+		b, err := json.Marshal(qm.m)
+		if err != nil {
+			c.Close(err)
+			return
+		}
+		if limit > 0 && len(msgs) > 0 && int64(size+len(b)+2) > limit {
+			c.writeBatch(msgs, qm.addFn)
+			msgs, size = nil, 1
+		}
+		msgs = append(msgs, b)
+		size += len(b) + 1
+	}
+	c.writeBatch(msgs, qm.addFn)
+}
+
+// writeBatch writes the JSON-encoded messages msgs in a single
+// websocket message.
+func (c *Conn) writeBatch(msgs []json.RawMessage, addFn func(string, int64)) {
+	if len(msgs) > 1 {
+		addFn("BatchedWrites", 1)
+		addFn("BatchedMsgs", int64(len(msgs)))
+	}
+	doWrite(c, msgs, addFn)
+}
@@ -0,0 +1,246 @@
+package juggler
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/mna/juggler/wstest"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, p := range []OverflowPolicy{OverflowBlock, OverflowDropOldest, OverflowClose} {
+		got, err := ParseOverflowPolicy(p.String())
+		if assert.NoError(t, err, "parse %s", p) {
+			assert.Equal(t, p, got, "parse %s", p)
+		}
+	}
+	got, err := ParseOverflowPolicy("")
+	assert.NoError(t, err, "empty")
+	assert.Equal(t, OverflowBlock, got, "empty")
+
+	_, err = ParseOverflowPolicy("x")
+	assert.Error(t, err, "unknown")
+	assert.Equal(t, "OverflowPolicy(10)", OverflowPolicy(10).String(), "unknown String")
+}
+
+func TestParseWritePolicy(t *testing.T) {
+	for _, p := range []WritePolicy{WriteFIFO, WritePriority, WritePriorityDropEvents} {
+		got, err := ParseWritePolicy(p.String())
+		if assert.NoError(t, err, "parse %s", p) {
+			assert.Equal(t, p, got, "parse %s", p)
+		}
+	}
+	got, err := ParseWritePolicy("")
+	assert.NoError(t, err, "empty")
+	assert.Equal(t, WriteFIFO, got, "empty")
+
+	_, err = ParseWritePolicy("x")
+	assert.Error(t, err, "unknown")
+	assert.Equal(t, "WritePolicy(10)", WritePolicy(10).String(), "unknown String")
+}
+
+// queuedTypes queues msgs on a connection with the specified write
+// policy before starting its write loop, and returns the types of the
+// messages in the order they were written.
+func queuedTypes(t *testing.T, policy WritePolicy, msgs ...message.Msg) []message.Type {
+	var buf bytes.Buffer
+	done := make(chan bool, 1)
+	srv := wstest.StartRecordingServer(t, done, &buf)
+	defer srv.Close()
+
+	wsc := wstest.Dial(t, srv.URL)
+	defer wsc.Close()
+
+	server := &Server{SendQueueSize: len(msgs), WritePolicy: policy}
+	jc := newConn(wsc, server)
+	jc.sendq = newSendQueue(server.SendQueueSize, server.WritePolicy, server.SendQueueOverflow)
+	for _, m := range msgs {
+		jc.enqueue(m, server.vars.Add)
+	}
+
+	wdone := make(chan struct{})
+	go func() {
+		jc.writeQueued()
+		close(wdone)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for len(jc.sendq.rpc) > 0 || len(jc.sendq.evnt) > 0 {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "send queue not drained")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	jc.Close(nil)
+	<-wdone
+	wsc.Close()
+	<-done
+
+	var types []message.Type
+	dec := json.NewDecoder(&buf)
+	for {
+		var m struct {
+			Meta message.Meta `json:"meta"`
+		}
+		if err := dec.Decode(&m); err != nil {
+			require.Equal(t, io.EOF, err, "Decode")
+			break
+		}
+		types = append(types, m.Meta.T)
+	}
+	return types
+}
+
+func TestSendQueuePolicies(t *testing.T) {
+	call, err := message.NewCall("a", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+	msgs := []message.Msg{
+		message.NewEvnt(&message.EvntPayload{Channel: "c"}),
+		message.NewEvnt(&message.EvntPayload{Channel: "c"}),
+		message.NewRes(&message.ResPayload{URI: "a"}),
+		message.NewAck(call),
+	}
+
+	got := queuedTypes(t, WriteFIFO, msgs...)
+	assert.Equal(t, []message.Type{message.EvntMsg, message.EvntMsg, message.ResMsg, message.AckMsg}, got, "fifo")
+
+	got = queuedTypes(t, WritePriority, msgs...)
+	assert.Equal(t, []message.Type{message.ResMsg, message.AckMsg, message.EvntMsg, message.EvntMsg}, got, "priority")
+
+	// latency-critical event, and RES that is not
+	msgs[1] = message.NewEvnt(&message.EvntPayload{Channel: "c", Priority: 1})
+	msgs[2] = message.NewRes(&message.ResPayload{URI: "a", Priority: -1})
+	got = queuedTypes(t, WritePriority, msgs...)
+	assert.Equal(t, []message.Type{message.EvntMsg, message.AckMsg, message.EvntMsg, message.ResMsg}, got, "message priorities")
+}
+
+func TestSendQueueFull(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	evnt := message.NewEvnt(&message.EvntPayload{Channel: "c"})
+
+	// events are dropped when the queue is full
+	server := &Server{SendQueueSize: 1, WritePolicy: WritePriorityDropEvents}
+	jc := newConn(nil, server)
+	jc.sendq = newSendQueue(server.SendQueueSize, server.WritePolicy, server.SendQueueOverflow)
+	jc.enqueue(evnt, vars.Add)
+	jc.enqueue(evnt, vars.Add)
+	assert.Equal(t, 1, len(jc.sendq.evnt), "queued events")
+	assert.Equal(t, "1", vars.Get("DroppedEvnts").String(), "dropped events")
+
+	// the connection is closed if there is no room before the timeout
+	server = &Server{SendQueueSize: 1, AcquireWriteLockTimeout: 10 * time.Millisecond}
+	jc = newConn(nil, server)
+	jc.sendq = newSendQueue(server.SendQueueSize, server.WritePolicy, server.SendQueueOverflow)
+	jc.enqueue(evnt, vars.Add)
+	jc.enqueue(evnt, vars.Add)
+	select {
+	case <-jc.CloseNotify():
+		assert.Equal(t, errSendQueueFull, jc.CloseErr, "close error")
+	default:
+		assert.Fail(t, "connection not closed")
+	}
+	assert.Equal(t, "1", vars.Get("SendQueueTimeouts").String(), "timeouts")
+}
+
+func TestSendQueueOverflow(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	evnt := func(ch string) message.Msg {
+		return message.NewEvnt(&message.EvntPayload{Channel: ch})
+	}
+	res := message.NewRes(&message.ResPayload{URI: "a"})
+
+	// the oldest events are dropped, the other messages are not
+	server := &Server{SendQueueSize: 2, SendQueueOverflow: OverflowDropOldest, Vars: vars}
+	jc := newConn(nil, server)
+	jc.sendq = newSendQueue(server.SendQueueSize, server.WritePolicy, server.SendQueueOverflow)
+	for _, ch := range []string{"a", "b", "c"} {
+		jc.enqueue(evnt(ch), vars.Add)
+	}
+	jc.enqueue(res, vars.Add)
+	assert.Equal(t, 3, jc.SendQueueLen(), "queued messages")
+	assert.Equal(t, "1", vars.Get("DroppedEvnts").String(), "dropped events")
+	qm := <-jc.sendq.evnt
+	assert.Equal(t, "b", qm.m.(*message.Evnt).Payload.Channel, "oldest event dropped")
+	assert.Equal(t, message.ResMsg, (<-jc.sendq.rpc).m.Type(), "res queued")
+	if h, ok := vars.Get("SendQueueDepth").(*metrics.Histogram); assert.True(t, ok, "depth histogram") {
+		assert.Equal(t, int64(3), h.Count(), "depth observations")
+	}
+
+	// the connection is closed as soon as the queue is full
+	server = &Server{SendQueueSize: 1, SendQueueOverflow: OverflowClose, AcquireWriteLockTimeout: time.Hour}
+	jc = newConn(nil, server)
+	jc.sendq = newSendQueue(server.SendQueueSize, server.WritePolicy, server.SendQueueOverflow)
+	jc.enqueue(res, vars.Add)
+	jc.enqueue(res, vars.Add)
+	select {
+	case <-jc.CloseNotify():
+		assert.Equal(t, errSendQueueFull, jc.CloseErr, "close error")
+	default:
+		assert.Fail(t, "connection not closed")
+	}
+	assert.Equal(t, "1", vars.Get("SendQueueOverflows").String(), "overflows")
+}
+
+func TestSendQueueBatch(t *testing.T) {
+	proto := "juggler.0" + message.BatchSuffix
+	frames := make(chan string, 10)
+	upg := &websocket.Upgrader{Subprotocols: []string{proto}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upg.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			_, b, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			frames <- string(b)
+		}
+	}))
+	defer srv.Close()
+
+	d := &websocket.Dialer{Subprotocols: []string{proto}}
+	wsc, _, err := d.Dial(strings.Replace(srv.URL, "http:", "ws:", 1), nil)
+	require.NoError(t, err, "Dial")
+	defer wsc.Close()
+
+	call, err := message.NewCall("a", nil, time.Second)
+	require.NoError(t, err, "NewCall")
+
+	// queue the messages before starting the write loop
+	vars := new(expvar.Map).Init()
+	server := &Server{SendQueueSize: 4, WriteBatchSize: 3, Vars: vars}
+	jc := newConn(wsc, server)
+	jc.sendq = newSendQueue(server.SendQueueSize, server.WritePolicy, server.SendQueueOverflow)
+	for i := 0; i < 4; i++ {
+		jc.enqueue(message.NewAck(call), vars.Add)
+	}
+	go jc.writeQueued()
+	defer jc.Close(nil)
+
+	for i, want := range []int{3, 1} {
+		select {
+		case f := <-frames:
+			msgs, err := message.UnmarshalResponseBatch(message.JSONCodec, strings.NewReader(f))
+			require.NoError(t, err, "frame %d", i)
+			assert.Equal(t, want, len(msgs), "frame %d", i)
+		case <-time.After(time.Second):
+			require.FailNow(t, "no frame", "%d", i)
+		}
+	}
+	assert.Equal(t, "1", vars.Get("BatchedWrites").String(), "batched writes")
+	assert.Equal(t, "3", vars.Get("BatchedMsgs").String(), "batched messages")
+}
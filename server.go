@@ -1,22 +1,47 @@
 package juggler
 
 import (
-	"expvar"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/callee"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
 	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
 )
 
 // Subprotocols is the list of juggler protocol versions supported by this
 // package. It should be set as-is on the websocket.Upgrader Subprotocols
 // field.
+//
+// The "juggler.0+msgpack" protocol is the same as "juggler.0", but
+// the messages are encoded in MessagePack instead of JSON (see
+// message.MsgpackCodec), and sent as websocket binary messages. The
+// "juggler.0+binary" protocol is also the same, but the messages are
+// sent as websocket binary messages in a binary envelope, so that the
+// binary arguments are sent as raw bytes instead of base64 (see
+// message.BinaryCodec). The "juggler.0+proto" protocol encodes the
+// messages in protocol buffers, as defined in message/juggler.proto
+// (see message.ProtobufCodec). The "juggler.0+batch" protocol is the
+// same as "juggler.0", but the server may write many messages in a
+// single websocket message, as a JSON array (see Server.WriteBatchSize
+// and message.UnmarshalResponseBatch). As the server prefers
+// "juggler.0", clients that support many should only request the
+// protocol they want to use.
 var Subprotocols = []string{
 	"juggler.0",
+	"juggler.0" + message.MsgpackSuffix,
+	"juggler.0" + message.BinarySuffix,
+	"juggler.0" + message.ProtobufSuffix,
+	"juggler.0" + message.BatchSuffix,
 }
 
 func isInStr(list []string, v string) bool {
@@ -34,7 +59,8 @@ func isInStr(list []string, v string) bool {
 // Server.ServeConn.
 //
 // The fields should not be updated once a server has started
-// serving connections.
+// serving connections, but some options can be changed with
+// UpdateSettings.
 type Server struct {
 	// prevent unkeyed literals
 	_ struct{}
@@ -42,6 +68,8 @@ type Server struct {
 	// ReadLimit defines the maximum size, in bytes, of incoming
 	// messages. If a client sends a message that exceeds this limit,
 	// the connection is closed. The default of 0 means no limit.
+	// It can be changed for a specific connection with
+	// Conn.SetReadLimit.
 	ReadLimit int64
 
 	// ReadTimeout is the timeout to read an incoming message. It is
@@ -49,11 +77,44 @@ type Server struct {
 	// reading each message. The default of 0 means no timeout.
 	ReadTimeout time.Duration
 
+	// Limits defines the maximum length of the URI, channel and
+	// arguments of incoming requests. Requests that exceed a limit are
+	// rejected with a NACK when they are read, before reaching the
+	// Handler and the brokers, with the Code of the message.LimitError
+	// as NACK code (see message.UnmarshalRequestLimits). ProcessMsg
+	// checks them again once the arguments are decompressed or the
+	// chunked calls are assembled. The connection stays open. The zero
+	// value means no limit.
+	Limits message.Limits
+
+	// Validators validates the arguments of incoming CALL and PUB
+	// requests with the Validator registered for their URI or channel.
+	// Invalid requests are rejected with a NACK before reaching the
+	// brokers, with message.CodeInvalidArgs as NACK code and the
+	// Details of the message.ValidationError, if any. If nil, the
+	// arguments are not validated.
+	Validators *message.Validators
+
 	// WriteLimit defines the maximum size, in bytes, of outgoing
 	// messages. If a message exceeds this limit, the connection is
 	// closed. The default of 0 means no limit.
 	WriteLimit int64
 
+	// EnableCompression negotiates the permessage-deflate websocket
+	// extension (RFC 7692) with the clients that support it, even if
+	// the EnableCompression field of the Upgrader passed to Upgrade is
+	// false. Messages sent to those clients are compressed, which
+	// greatly reduces the size of large JSON payloads. The ReadLimit
+	// and WriteLimit apply to the uncompressed size of the messages.
+	EnableCompression bool
+
+	// CompressionLevel is the flate compression level of the messages
+	// sent on connections that negotiated the permessage-deflate
+	// extension, from -2 (flate.HuffmanOnly) to 9 (flate.BestCompression).
+	// The default of 0 uses the default level of the websocket package,
+	// as does an invalid level.
+	CompressionLevel int
+
 	// WriteTimeout is the timeout to write an outgoing message. It is
 	// set on the websocket connection with SetWriteDeadline before
 	// writing each message. The default of 0 means no timeout.
@@ -84,22 +145,416 @@ type Server struct {
 	// nil value is set. If a custom handler is set, it is assumed
 	// that it will call ProcessMsg at some point, or otherwise
 	// manually process the messages.
+	//
+	// The panics raised while processing a message, in the Handler or
+	// in ProcessMsg, are recovered so that they don't kill the
+	// goroutines of the connection, and the RecoveredPanics metric is
+	// incremented. If the message is a request from the client, it is
+	// NACKed with a 500 code that is not retryable. The panics raised
+	// in the goroutines started by ProcessMsg, to run the in-process
+	// Callees and the fan-out calls, are recovered too, and a panic in
+	// an in-process callee is sent to the caller as an error result
+	// with a 500 code. The connection is kept open unless CloseOnPanic
+	// is set.
 	Handler Handler
 
+	// CloseOnPanic, if true, closes the connection with the panic as
+	// error when a panic is recovered while processing one of its
+	// messages (see Handler). By default, the connection is kept open
+	// and the next messages are processed.
+	CloseOnPanic bool
+
 	// PubSubBroker is the broker to use for pub-sub messages. It must be
-	// set before the Server can be used.
+	// set before the Server can be used. If it implements
+	// broker.ReplayBroker, a SUB with a LastEventID on a durable channel
+	// replays the events published after that event.
 	PubSubBroker broker.PubSubBroker
 
 	// CallerBroker is the broker to use for caller messages. It must be
 	// set before the server can be used.
 	CallerBroker broker.CallerBroker
 
-	// Vars can be set to an *expvar.Map to collect metrics about the
+	// RoomsBroker is the broker to use to store the membership of
+	// rooms. It is optional, it must be set to use rooms (see Conn.Join
+	// and Server.PublishRoom).
+	RoomsBroker broker.RoomsBroker
+
+	// PresenceBroker is the broker to use to maintain the presence sets
+	// of channels, shared by all servers. It is optional, if it is set,
+	// connections are added to the presence set of a channel when they
+	// subscribe to it (pattern-based subscriptions excepted) or join
+	// the corresponding room, and removed when they unsubscribe, leave
+	// or disconnect. See Server.Presence.
+	PresenceBroker broker.PresenceBroker
+
+	// PresenceTTL is the time-to-live of the presence entries. Entries
+	// of active connections are refreshed every PresenceTTL / 2, so
+	// that the entries of a server that crashed expire after at most
+	// PresenceTTL. The default of 0 uses a TTL of 30 seconds.
+	PresenceTTL time.Duration
+
+	// CalleeHealth is the registry of live callees, registered e.g.
+	// with callee.Health. It is optional, if it is set, CALL requests
+	// that go to the CallerBroker for a URI that no live callee serves,
+	// directly or via a prefix URI (see broker.PrefixURIs), are
+	// rejected with a NACK with code 503 instead of expiring in the
+	// broker. The live callees are read at most once per
+	// CalleeHealthInterval, and the calls are sent to the CallerBroker
+	// as usual if they cannot be read. The default of 0 for
+	// CalleeHealthInterval uses DefaultCalleeHealthInterval.
+	CalleeHealth         broker.HealthBroker
+	CalleeHealthInterval time.Duration
+
+	// Callees registers in-process callees for some URIs. Calls to those
+	// URIs are executed directly by the server, in their own goroutine,
+	// instead of going through the CallerBroker. The call timeout is
+	// still honored - if the Thunk doesn't return in time, the result
+	// is dropped - and the result is sent to the client as a RES message.
+	// Calls to URIs that are not in the map are sent to the CallerBroker.
+	// URIs with the reserved SystemURIPrefix cannot be registered, they
+	// are always handled by the built-in system callees.
+	Callees map[string]callee.Thunk
+
+	// AllowedURIs and DeniedURIs define the URIs that clients are
+	// allowed to call, as glob-style patterns (see path.Match, where
+	// the "*" matches any sequence of characters in a URI that has
+	// no "/"). A call to a URI that matches a DeniedURIs pattern, or
+	// that doesn't match any AllowedURIs pattern if AllowedURIs is not
+	// empty, is rejected with a NACK with code 404 instead of being
+	// sent to the CallerBroker. The system URIs are always allowed.
+	AllowedURIs []string
+	DeniedURIs  []string
+
+	// ChannelPolicies defines what clients can do on which channels. If
+	// it is not empty, PUB and SUB requests are checked against the
+	// first policy whose pattern matches the channel, and requests that
+	// are not allowed by that policy, or that don't match any policy,
+	// are rejected with a NACK with code 403. UNSB requests are always
+	// allowed. Events published by the server itself (e.g. with
+	// PublishRoom) are not subject to the policies.
+	ChannelPolicies []ChannelPolicy
+
+	// Authorizer, if set, is called by ProcessMsg for each CALL, PUB,
+	// SUB and UNSB request, before it is processed, to authorize it
+	// based on the connection and the URI or channel. Requests that are
+	// denied are rejected with a NACK with the code returned by the
+	// Authorizer. It is checked before the AllowedURIs, DeniedURIs and
+	// ChannelPolicies.
+	Authorizer Authorizer
+
+	// Topics, if true, requires the channels of the PUB, SUB and UNSB
+	// requests to be topics, dot-separated segments such as
+	// "sensors.room1.temp", and the patterns of pattern-based
+	// subscriptions to be topic filters, with the "+" and "#" wildcards
+	// as for MQTT (see broker.ValidTopic and broker.ValidTopicFilter).
+	// Requests with an invalid channel are rejected with a NACK with
+	// code 400. The PubSubBroker should have its Topics option set too,
+	// so that the patterns are matched as topic filters.
+	Topics bool
+
+	// AdminURIs enables the admin system URIs, juggler.conns.list and
+	// juggler.conn.kick (see SystemURIPrefix), to inspect and close the
+	// connections of the server over the juggler protocol. They are
+	// only enabled if an Authorizer is set, as it is the only way to
+	// restrict them to the operators.
+	AdminURIs bool
+
+	// ChannelURIs enables the channel system URIs, juggler.numsub and
+	// juggler.channels (see SystemURIPrefix), that return the number of
+	// subscribers and the active channels, including those of the other
+	// clients. As for AdminURIs, they are only enabled if an Authorizer
+	// is set, to restrict them to the clients allowed to query them.
+	ChannelURIs bool
+
+	// RateLimiter, if set, is called by ProcessMsg for each CALL and
+	// PUB request, before it is authorized, to throttle the requests
+	// e.g. per connection, per identity or per URI (see TokenBucket).
+	// Requests that are not allowed are rejected with a NACK with code
+	// 429.
+	RateLimiter RateLimiter
+
+	// Affinity, if set, generates a signed affinity token for each
+	// connection, that identifies this server instance. The token is
+	// sent in the Juggler-Affinity response header by Upgrade and is
+	// available via Conn.AffinityToken, so that load balancers can
+	// route a reconnecting client to the same server. No token is
+	// generated if its Key is empty.
+	Affinity *Affinity
+
+	// Authenticator, if set, is called by Upgrade to authenticate the
+	// HTTP request before it is upgraded to the websocket protocol
+	// (e.g. with a JWTAuth). If it fails, the handshake is rejected
+	// with a 401 status code. Otherwise the identity is available via
+	// Conn.Identity, e.g. to the Handler and the Authorizer.
+	Authenticator Authenticator
+
+	// CompressThreshold is the size, in bytes, above which the arguments
+	// of RES and EVNT messages are compressed, on the connections that
+	// negotiated compression with the CompressionHeader (see Upgrade).
+	// Compressed messages have the encoding set in their metadata, and
+	// requests sent compressed by clients are always decompressed. The
+	// default of 0 disables compression of the messages sent by the
 	// server.
-	Vars *expvar.Map
+	CompressThreshold int
+
+	// MaxDecompressedSize is the maximum size, in bytes, of the
+	// decompressed arguments of the requests sent compressed by the
+	// clients. The connection is closed if a request exceeds it. If it
+	// is 0, the read limit of the connection is used, or
+	// DefaultMaxDecompressedSize if there is no read limit.
+	MaxDecompressedSize int64
+
+	// OffloadThreshold is the size, in bytes, above which the arguments
+	// of RES and EVNT messages are stored in BlobStore instead of being
+	// sent in the message, which then only holds the reference of the
+	// blob in its metadata. Clients resolve the reference e.g. via an
+	// HTTP endpoint served by BlobHandler (see client.SetBlobResolver).
+	// Only the connections that negotiated it with the OffloadHeader
+	// receive offloaded arguments (see Upgrade), the others receive the
+	// arguments in the message.
+	//
+	// The blobs of the results expire after the timeout of their call.
+	// The arguments of the events are offloaded once, when the PUB is
+	// processed, and their blobs expire after broker.DefaultCallTimeout.
+	// The servers of the subscribers must use the same BlobStore to
+	// resolve them. Offloading is disabled if it is 0 (the default) or if
+	// BlobStore is nil.
+	OffloadThreshold int
+	BlobStore        broker.BlobStore
+
+	// MaxChunkedArgs is the maximum size, in bytes, of the arguments of
+	// a chunked CALL, whose arguments are sent in CHNK messages that
+	// are assembled by the server, so that they can be larger than the
+	// ReadLimit. A chunked call that exceeds it is rejected with a NACK
+	// with code 413. The default of 0 disables chunked calls, which
+	// are rejected with a NACK with code 400.
+	MaxChunkedArgs int64
+
+	// MaxFanOut is the maximum number of URIs of a fan-out CALL, that
+	// is dispatched to each of its fan-out URIs and whose results are
+	// combined in a single RES (see message.Call). A fan-out call
+	// with more URIs is rejected with a NACK with code 400. The default
+	// of 0 disables fan-out calls, which are rejected with a NACK with
+	// code 400.
+	MaxFanOut int
+
+	// DegradedMode, if true, keeps the connections open when their
+	// results or pub-sub broker connection fails (e.g. because redis is
+	// unavailable), instead of closing them. The server is then in
+	// degraded mode (see Degraded) until the failed broker connections
+	// are recovered: CALL requests that go to the CallerBroker and PUB
+	// requests are rejected with a NACK with code 503, as are SUB and
+	// UNSB requests on a connection whose pub-sub connection failed.
+	// A single failed broker connection only puts the server in degraded
+	// mode if the brokers are unhealthy (see Degraded).
+	// The failed broker connections are recreated every RecoverInterval,
+	// and the subscriptions of the connections are restored. Events
+	// and results sent while the broker connections are down are lost.
+	// The default of 0 for RecoverInterval uses DefaultRecoverInterval.
+	DegradedMode    bool
+	RecoverInterval time.Duration
+
+	// SendQueueSize is the size of the send queue of each connection.
+	// If it is > 0, the messages sent to the client (ACK, NACK, RES and
+	// EVNT) are added to the queue and written by a single goroutine
+	// per connection, in the order defined by WritePolicy, instead of
+	// being written directly by the goroutine that sends them. With a
+	// priority policy, the messages that are not latency-critical (by
+	// default, the EVNT messages) have their own queue of the same size. If a queue is full, the EVNT messages are dropped if the
+	// write policy drops them, otherwise SendQueueOverflow defines
+	// what happens: by default, the sender waits for room in the queue
+	// for at most AcquireWriteLockTimeout, after which the connection
+	// is closed. The default of 0 disables the send queue.
+	SendQueueSize     int
+	WritePolicy       WritePolicy
+	SendQueueOverflow OverflowPolicy
+
+	// WriteBatchSize is the maximum number of queued messages that are
+	// written in a single websocket message, as a JSON array, on the
+	// connections that negotiated a subprotocol with the
+	// message.BatchSuffix. It requires the send queue (see
+	// SendQueueSize): when the write loop of a connection takes a
+	// message from the queue, it also takes the other messages already
+	// queued, up to WriteBatchSize, without waiting for more, so that a
+	// burst of ACK messages under high call rates is written with a
+	// single frame. The batches are split so that they do not exceed
+	// the WriteLimit. The default of 0 (or 1) disables the batches.
+	WriteBatchSize int
+
+	// ResultDedupSize is the number of call UUIDs for which a RES was
+	// sent that each connection remembers, so that a result that is
+	// delivered more than once (e.g. because a call was requeued and
+	// processed again by another callee) is sent only once to the
+	// client. The duplicates are dropped and counted in the
+	// DuplicateResults metric. The default of 0 disables the
+	// deduplication.
+	ResultDedupSize int
+
+	// PingInterval is the interval at which websocket pings are sent on
+	// each connection to keep it alive, e.g. so that idle connections
+	// are not cut by load balancers. The pings are sent via the
+	// exclusive writer of the connection (see AcquireWriteLockTimeout
+	// and WriteTimeout, PingInterval is used as write timeout if it is
+	// 0), and the connection is closed if a ping cannot be sent. The
+	// default of 0 disables the pings.
+	PingInterval time.Duration
+
+	// PongTimeout is the time to wait for the pong of a ping sent every
+	// PingInterval. If no pong is received in time, the connection is
+	// closed and the MissedPongs metric is incremented. The default of
+	// 0 never closes the connections for missed pongs. It is ignored if
+	// PingInterval is 0.
+	PongTimeout time.Duration
+
+	// RTTInterval is the interval at which websocket pings are sent on
+	// each connection to measure its round-trip time (see Conn.RTT).
+	// The distribution of the round-trip times is reported in the RTT
+	// metric, in microseconds (see metrics.Observe). The default of 0
+	// disables the measurement.
+	RTTInterval time.Duration
+
+	// MaxConns is the maximum number of active connections served by
+	// the server. Once it is reached, Upgrade refuses new connections
+	// with a 503 status code, and the RejectedConns metric is
+	// incremented. The connections are counted from the start of their
+	// handshake, so that a spike of handshakes cannot exceed the limit.
+	// The connections served directly by ServeConn are not limited.
+	// The default of 0 means no limit.
+	//
+	// If AcceptQueueSize is > 0, up to that number of handshakes wait
+	// for a connection to close when the limit is reached, instead of
+	// being refused immediately. A handshake that doesn't get a slot
+	// within AcceptQueueTimeout is refused. The default of 0 for
+	// AcceptQueueTimeout uses DefaultAcceptQueueTimeout.
+	MaxConns           int
+	AcceptQueueSize    int
+	AcceptQueueTimeout time.Duration
+
+	// Fallback enables the fallback transport for the clients that
+	// cannot establish a websocket connection, e.g. because a proxy
+	// blocks the websocket protocol. The requests served by Upgrade
+	// that are not websocket handshakes are then served as follows:
+	//
+	// A GET request opens a stream of server-sent events (the
+	// text/event-stream content type), that is served as a juggler
+	// connection until it is closed. The first event has the "open"
+	// type and holds the UUID of the connection, the messages sent to
+	// the client are the following events, of the default type. Only
+	// the protocols that are not binary are supported, they can be
+	// requested with the FallbackProtocolParam query string parameter
+	// (the default is "juggler.0").
+	//
+	// The client sends each of its messages in the body of a POST
+	// request with the UUID of the connection in the FallbackConnParam
+	// query string parameter. The response has a 204 status code once
+	// the message is read by the connection, or a 404 if the connection
+	// is unknown or closed. If an Authenticator is set, the POST
+	// requests must be authenticated with the identity of the
+	// connection. The requests of a connection must be routed to the
+	// same server, e.g. with the affinity token.
+	//
+	// The pings of the connection are sent as comments on the events
+	// stream, and are considered as ponged once they are flushed. The
+	// WriteTimeout of the http.Server applies to the whole events
+	// stream, so it should not be set.
+	Fallback bool
+
+	// Vars can be set to a metrics.Sink (e.g. an *expvar.Map) to
+	// collect metrics about the server. The same sink is set on the
+	// brokers that implement metrics.Setter and that don't have a
+	// sink already, so that the broker metrics are collected too.
+	Vars metrics.Sink
+
+	// active connections served by this server
+	conns ConnRegistry
+
+	// transports of the active fallback connections, by UUID
+	fmu       sync.Mutex
+	fallbacks map[string]*fallbackConn
+
+	// set to 1 when the server is draining, accessed atomically
+	draining int32
+
+	// connection slots reserved by Upgrade, nil if there is no MaxConns,
+	// and number of handshakes waiting for a slot, accessed atomically
+	slots  chan struct{}
+	queued int32
+
+	// number of failed broker connections not yet recovered in degraded
+	// mode, accessed atomically
+	brokenConns int32
+
+	// health of the brokers in degraded mode, checked at healthAt
+	hmu      sync.Mutex
+	healthy  bool
+	healthAt time.Time
+
+	// URIs served by the live callees, read from CalleeHealth at
+	// liveAt, nil if they could not be read
+	lmu      sync.Mutex
+	liveURIs map[string]bool
+	liveAt   time.Time
+
+	// initialized once, when the first connection is served
+	initOnce sync.Once
+	vars     metrics.Sink // never nil
+
+	// settings set by UpdateSettings, if any
+	live atomic.Value
+}
+
+// init initializes the server's internal state and passes its metrics
+// sink to the brokers. It is called when the first connection is
+// served, so the Server's fields must be set before then.
+func (srv *Server) init() {
+	srv.initOnce.Do(func() {
+		if srv.MaxConns > 0 {
+			srv.slots = make(chan struct{}, srv.MaxConns)
+		}
+
+		srv.vars = metrics.Or(srv.Vars)
+		if metrics.IsNil(srv.Vars) {
+			return
+		}
+		brokers := []interface{}{srv.PubSubBroker, srv.CallerBroker, srv.RoomsBroker, srv.PresenceBroker}
+		for _, b := range brokers {
+			if s, ok := b.(metrics.Setter); ok {
+				s.SetMetrics(srv.Vars)
+			}
+		}
+	})
+}
+
+// Drain puts the server in draining mode. A draining server refuses
+// new connections in Upgrade and is reported as not ready by
+// ReadyHandler, but the active connections are not closed, so that
+// load balancers can stop routing clients to the server before it
+// is stopped.
+func (srv *Server) Drain() {
+	atomic.StoreInt32(&srv.draining, 1)
+}
+
+// Draining returns true if the server is in draining mode.
+func (srv *Server) Draining() bool {
+	return atomic.LoadInt32(&srv.draining) == 1
+}
+
+// NumConns returns the number of active connections served by the
+// server.
+func (srv *Server) NumConns() int {
+	return srv.conns.Len()
+}
+
+// accepting returns true if the server accepts new connections, that
+// is if it is not draining and the MaxConns limit is not reached.
+func (srv *Server) accepting() bool {
+	if srv.Draining() {
+		return false
+	}
+	return srv.MaxConns <= 0 || srv.NumConns() < srv.MaxConns
 }
 
-var allReqMsgs = []message.Type{message.CallMsg, message.SubMsg, message.UnsbMsg, message.PubMsg}
+var allReqMsgs = []message.Type{message.CallMsg, message.SubMsg, message.UnsbMsg, message.PubMsg, message.ChunkMsg}
 
 func isInType(list []message.Type, v message.Type) bool {
 	for _, vv := range list {
@@ -115,18 +570,62 @@ func isInType(list []message.Type, v message.Type) bool {
 // connection open. If allowedMsgs is not empty, only those message types
 // are allowed on that connection.
 func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type) {
-	if srv.Vars != nil {
-		srv.Vars.Add("ActiveConns", 1)
-		srv.Vars.Add("TotalConns", 1)
-		defer srv.Vars.Add("ActiveConns", -1)
+	connUUID := uuid.NewRandom()
+	srv.serveConn(conn, connUUID, srv.affinityToken(connUUID), "", false, nil, nil, allowedMsgs...)
+}
+
+func (srv *Server) affinityToken(connUUID uuid.UUID) string {
+	if srv.Affinity == nil {
+		return ""
+	}
+	return srv.Affinity.Token(connUUID)
+}
+
+// serveConn serves conn as a juggler connection identified by connUUID,
+// with the specified affinity token, negotiated compression and
+// offloading, and authenticated identity. If setup is not nil, it is
+// called before the connection is served, and the connection is
+// rejected if it fails.
+func (srv *Server) serveConn(conn transport, connUUID uuid.UUID, affinity, compression string, offloading bool, id *Identity, setup func(*Conn) error, allowedMsgs ...message.Type) {
+	srv.init()
+	srv.vars.Add("ActiveConns", 1)
+	srv.vars.Add("TotalConns", 1)
+	defer srv.vars.Add("ActiveConns", -1)
+
+	if wsConn, ok := conn.(*websocket.Conn); ok && srv.CompressionLevel != 0 {
+		// only fails if the level is invalid, the default is used then
+		wsConn.SetCompressionLevel(srv.CompressionLevel)
 	}
 
-	conn.SetReadLimit(srv.ReadLimit)
 	c := newConn(conn, srv, allowedMsgs...)
+	c.UUID = connUUID
+	c.affinity = affinity
+	c.compression = compression
+	c.offloading = offloading
+	c.identity = id
+	if id != nil {
+		c.ctx = context.WithValue(c.ctx, identityKey{}, id)
+	}
+	if srv.SendQueueSize > 0 {
+		c.sendq = newSendQueue(srv.SendQueueSize, srv.WritePolicy, srv.SendQueueOverflow)
+	}
+	if srv.ResultDedupSize > 0 {
+		c.sentResults = newLRU(srv.ResultDedupSize)
+	}
 	if len(allowedMsgs) == 0 {
 		allowedMsgs = allReqMsgs
 	}
 
+	// per-connection setup, before the connection is visible to the
+	// ConnState and the Handler
+	if setup != nil {
+		if err := setup(c); err != nil {
+			srv.vars.Add("RejectedUpgrades", 1)
+			c.reject(err)
+			return
+		}
+	}
+
 	// start lifecycle - Accepting, and ensure Closing is called on exit
 	if cs := srv.ConnState; cs != nil {
 		defer func() {
@@ -158,6 +657,9 @@ func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type)
 		c.psc = pubSubConn
 	}
 
+	srv.conns.Add(c)
+	defer srv.conns.Remove(c)
+
 	// switch to connected state
 	if cs := srv.ConnState; cs != nil {
 		cs(c, Connected)
@@ -171,10 +673,29 @@ func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type)
 	if callOK {
 		go c.results()
 	}
+	if subOK && srv.PresenceBroker != nil {
+		go c.refreshPresence()
+	}
+	if c.sendq != nil {
+		go c.writeQueued()
+	}
+	if srv.RTTInterval > 0 || srv.PingInterval > 0 {
+		conn.SetPongHandler(c.handlePong)
+	}
+	if srv.RTTInterval > 0 {
+		go c.measureRTT(srv.RTTInterval)
+	}
+	if srv.PingInterval > 0 {
+		go c.keepAlive(srv.PingInterval, srv.PongTimeout)
+	}
 	go c.receive()
 
 	kill := c.CloseNotify()
 	<-kill
+
+	// leave all rooms the connection joined and remove its presence
+	c.leaveAll()
+	c.removeAllPresence()
 }
 
 // Upgrade returns an http.Handler that upgrades connections to
@@ -185,17 +706,180 @@ func (srv *Server) ServeConn(conn *websocket.Conn, allowedMsgs ...message.Type)
 // Once connected, the websocket connection is served via srv.ServeConn.
 // The websocket connection is closed when the juggler connection is closed.
 //
+// If srv.Affinity is set, the affinity token of the connection is
+// sent in the Juggler-Affinity response header.
+//
+// If srv.EnableCompression is set, the permessage-deflate websocket
+// extension is negotiated with the clients that support it.
+//
+// If the Juggler-Compression header is set on the request, the first
+// supported encoding it lists is used to compress the messages sent on
+// the connection (see Server.CompressThreshold), and it is sent back
+// in the Juggler-Compression response header. Likewise, if the
+// Juggler-Offload header is set on the request and the server offloads
+// the arguments of the messages (see Server.OffloadThreshold), it is
+// sent back in the Juggler-Offload response header.
+//
+// If the server is draining or has reached its MaxConns limit, the
+// request is refused with a 503 status code, possibly after waiting
+// in the accept queue (see Server.AcceptQueueSize).
+//
+// If srv.Authenticator is set, the request is authenticated before
+// the upgrade, and it is refused with a 401 status code if it fails.
+//
 // If the Juggler-Allowed-Messages header is set on the request, the
 // connection is restricted to that set of message types. The value
 // is a comma-separated list of request message types:
 //
-//     Any of "call, sub, unsb, pub"
+//     Any of "call, sub, unsb, pub" ("call" allows chunked calls too)
 //     "*" can be used for any message type (same as if the header wasn't there)
 //
+// If srv.Fallback is set, the requests that are not websocket
+// handshakes are served with the fallback transport, so that each
+// client can fall back to it if it cannot establish a websocket
+// connection (see Server.Fallback). The same rules apply to the
+// requests that open the events stream of the fallback connections.
+//
+// Use UpgradeWithConfig to set up each connection before it is served.
 func Upgrade(upgrader *websocket.Upgrader, srv *Server) http.Handler {
+	return UpgradeWithConfig(upgrader, srv, UpgradeConfig{})
+}
+
+// UpgradeConfig defines the per-connection setup of the handler
+// returned by UpgradeWithConfig.
+type UpgradeConfig struct {
+	// OnUpgrade, if set, is called for each connection once the HTTP
+	// request is upgraded (or the events stream of a fallback
+	// connection is opened), before the connection is served, with
+	// the HTTP request of the handshake. It can attach metadata
+	// derived from the request, such as cookies, headers or the
+	// client IP address, to the connection, e.g. with Conn.SetTag or
+	// Conn.WithContext, so that it is available when its messages are
+	// processed. If it returns an error, the connection is rejected:
+	// it is closed with that error without being served, after a
+	// websocket close message with the 1008 (policy violation) code is
+	// sent, and the ConnState and Handler are not called for it.
+	OnUpgrade func(r *http.Request, c *Conn) error
+
+	// OriginPolicy, if set, defines the origins allowed to connect. It
+	// replaces the CheckOrigin function of the upgrader, and the
+	// requests of the fallback transport from origins that are not
+	// allowed are refused with a 403 status code. The responses to the
+	// fallback requests from allowed origins have the CORS headers set,
+	// and the CORS preflight requests are handled, so that browser
+	// clients served from another origin can use the fallback transport.
+	OriginPolicy *OriginPolicy
+
+	// TrustProxyHeaders, if true, sets the remote address of the
+	// connections (see Conn.RemoteAddr) to the client address reported
+	// by the X-Real-IP header or, if it is not set, the first address
+	// of the X-Forwarded-For header, when the server is behind a load
+	// balancer or a reverse proxy, before OnUpgrade is called. It must
+	// only be set if the proxy always sets those headers, otherwise
+	// clients can spoof their address.
+	TrustProxyHeaders bool
+}
+
+// UpgradeWithConfig returns an http.Handler that upgrades connections
+// to the websocket protocol using upgrader, like Upgrade, and that sets
+// up each connection as defined by conf before it is served.
+func UpgradeWithConfig(upgrader *websocket.Upgrader, srv *Server, conf UpgradeConfig) http.Handler {
+	if (srv.EnableCompression && !upgrader.EnableCompression) || conf.OriginPolicy != nil {
+		upg := *upgrader
+		upg.EnableCompression = upg.EnableCompression || srv.EnableCompression
+		if conf.OriginPolicy != nil {
+			upg.CheckOrigin = conf.OriginPolicy.CheckOrigin
+		}
+		upgrader = &upg
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var setup func(*Conn) error
+		if conf.OnUpgrade != nil || conf.TrustProxyHeaders {
+			setup = func(c *Conn) error {
+				if conf.TrustProxyHeaders {
+					c.remoteAddr = forwardedAddr(r)
+				}
+				if conf.OnUpgrade != nil {
+					return conf.OnUpgrade(r, c)
+				}
+				return nil
+			}
+		}
+
+		fallback := srv.Fallback && !websocket.IsWebSocketUpgrade(r)
+		if fallback {
+			if p := conf.OriginPolicy; p != nil {
+				if !p.CheckOrigin(r) {
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+				if p.setCORSHeaders(w, r) {
+					return
+				}
+			}
+			switch r.Method {
+			case "GET":
+			case "POST":
+				// messages of an existing connection
+				srv.postFallback(w, r)
+				return
+			default:
+				w.Header().Set("Allow", "GET, POST")
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+		}
+
+		// reserve a connection slot for the lifetime of the connection,
+		// waiting in the accept queue if it is enabled
+		srv.init()
+		if srv.Draining() || !srv.acquireSlot() {
+			srv.vars.Add("RejectedConns", 1)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		defer srv.releaseSlot()
+
+		// authenticate the request before the upgrade, if enabled
+		var id *Identity
+		if auth := srv.Authenticator; auth != nil {
+			var err error
+			if id, err = auth.Authenticate(r); err != nil {
+				srv.vars.Add("FailedAuthentications", 1)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		// send the affinity token in the response headers, if enabled
+		connUUID := uuid.NewRandom()
+		token := srv.affinityToken(connUUID)
+		hdr := make(http.Header)
+		if token != "" {
+			hdr.Set(AffinityHeader, token)
+		}
+		comp := negotiateCompression(r.Header)
+		if comp != "" {
+			hdr.Set(CompressionHeader, comp)
+		}
+		offloading := srv.negotiateOffload(r.Header)
+		if offloading {
+			hdr.Set(OffloadHeader, OffloadBlob)
+		}
+
+		if fallback {
+			for k, v := range hdr {
+				w.Header()[k] = v
+			}
+			// this call blocks until the juggler connection is closed
+			srv.serveFallback(w, r, connUUID, token, comp, offloading, id, setup)
+			return
+		}
+
 		// upgrade the HTTP connection to the websocket protocol
-		wsConn, err := upgrader.Upgrade(w, r, nil)
+		wsConn, err := upgrader.Upgrade(w, r, hdr)
 		if err != nil {
 			return
 		}
@@ -208,7 +892,7 @@ func Upgrade(upgrader *websocket.Upgrader, srv *Server) http.Handler {
 
 		msgs := AllowedMessagesFromHeader(r.Header)
 		// this call blocks until the juggler connection is closed
-		srv.ServeConn(wsConn, msgs...)
+		srv.serveConn(wsConn, connUUID, token, comp, offloading, id, setup, msgs...)
 	})
 }
 
@@ -225,7 +909,7 @@ func AllowedMessagesFromHeader(h http.Header) []message.Type {
 			typ := strings.TrimSpace(strings.ToLower(typ))
 			switch typ {
 			case "call":
-				msgs = append(msgs, message.CallMsg)
+				msgs = append(msgs, message.CallMsg, message.ChunkMsg)
 			case "sub":
 				msgs = append(msgs, message.SubMsg)
 			case "unsb":
@@ -13,9 +13,11 @@ import (
 	"github.com/mna/juggler"
 	"github.com/mna/juggler/broker/redisbroker"
 	"github.com/mna/juggler/client"
-	"github.com/mna/juggler/internal/wstest"
+	"github.com/mna/juggler/jugglertest"
 	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/wstest"
 	"github.com/mna/redisc/redistest"
+	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -48,6 +50,7 @@ func TestServerServe(t *testing.T) {
 	}
 	server := &juggler.Server{ConnState: fn, CallerBroker: broker, PubSubBroker: broker}
 
+	snap := jugglertest.SnapshotGoroutines()
 	go server.ServeConn(conn)
 
 	var got juggler.ConnState
@@ -75,6 +78,15 @@ func TestServerServe(t *testing.T) {
 	case <-time.After(100 * time.Millisecond):
 		assert.Fail(t, "no closed state received")
 	}
+
+	// all goroutines and redis connections started to serve the
+	// connection are terminated.
+	snap.AssertNoLeak(t, time.Second)
+	require.NoError(t, pool.Close(), "close pool")
+	rc, err := redis.Dial("tcp", ":"+port)
+	require.NoError(t, err, "Dial")
+	defer rc.Close()
+	jugglertest.AssertRedisClients(t, rc, 1, time.Second)
 }
 
 func TestUpgrade(t *testing.T) {
@@ -0,0 +1,47 @@
+package juggler
+
+import (
+	"time"
+
+	"github.com/mna/juggler/message"
+)
+
+// Settings are the options of a Server that can be changed while it is
+// serving connections, with Server.UpdateSettings. They have the same
+// meaning as the Server fields of the same name.
+type Settings struct {
+	ReadLimit               int64
+	ReadTimeout             time.Duration
+	WriteLimit              int64
+	WriteTimeout            time.Duration
+	AcquireWriteLockTimeout time.Duration
+	Limits                  message.Limits
+}
+
+// Settings returns the current settings of the server. Until
+// UpdateSettings is called, they are the values of the fields of the
+// server.
+func (srv *Server) Settings() Settings {
+	if s, ok := srv.live.Load().(*Settings); ok {
+		return *s
+	}
+	return Settings{
+		ReadLimit:               srv.ReadLimit,
+		ReadTimeout:             srv.ReadTimeout,
+		WriteLimit:              srv.WriteLimit,
+		WriteTimeout:            srv.WriteTimeout,
+		AcquireWriteLockTimeout: srv.AcquireWriteLockTimeout,
+		Limits:                  srv.Limits,
+	}
+}
+
+// UpdateSettings replaces the settings of the server, e.g. when its
+// configuration is reloaded, without closing the active connections.
+// The fields of the server are not modified. The new settings apply to
+// the messages read and written after the call, on all connections,
+// except for the ReadLimit, which applies to the connections accepted
+// after the call (see Conn.SetReadLimit to change the read limit of an
+// active connection). It is safe to call concurrently.
+func (srv *Server) UpdateSettings(s Settings) {
+	srv.live.Store(&s)
+}
@@ -0,0 +1,25 @@
+package juggler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mna/juggler/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateSettings(t *testing.T) {
+	srv := &Server{ReadLimit: 10, WriteTimeout: time.Second}
+	assert.Equal(t, Settings{ReadLimit: 10, WriteTimeout: time.Second}, srv.Settings(), "initial settings")
+
+	c1 := newConn(nil, srv)
+	want := Settings{ReadLimit: 20, ReadTimeout: time.Minute, Limits: message.Limits{MaxURILen: 5}}
+	srv.UpdateSettings(want)
+	assert.Equal(t, want, srv.Settings(), "updated settings")
+	assert.Equal(t, int64(10), srv.ReadLimit, "fields are not modified")
+
+	// the read limit applies to the new connections
+	c2 := newConn(nil, srv)
+	assert.Equal(t, int64(10), c1.ReadLimit(), "read limit of existing connection")
+	assert.Equal(t, int64(20), c2.ReadLimit(), "read limit of new connection")
+}
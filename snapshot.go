@@ -0,0 +1,41 @@
+package juggler
+
+import (
+	"net/http"
+
+	"github.com/mna/juggler/metrics"
+)
+
+// SnapshotMetrics returns the current value of srv's metric counters,
+// as collected in Server.Vars, including the metrics of the brokers
+// that share the server's sink. If reset is true, the counters are
+// atomically reset to zero after the snapshot, except for the gauges
+// such as ActiveConns (see metrics.Snapshot). This is useful e.g. for
+// a load test to measure exactly the activity of one run.
+//
+// It returns an empty snapshot if Server.Vars is not set, or if it is
+// neither a metrics.Snapshotter nor an *expvar.Map.
+func (srv *Server) SnapshotMetrics(reset bool) map[string]int64 {
+	return metrics.Snapshot(srv.Vars, reset)
+}
+
+// MetricsHandler returns an HTTP handler that responds with the JSON
+// object of srv's metrics, as returned by SnapshotMetrics. A GET
+// request only takes the snapshot, while a POST request takes the
+// snapshot and resets the counters. It is meant to be used as an
+// admin endpoint and should not be exposed publicly.
+//
+// It responds with a 405 status code for other request methods.
+func MetricsHandler(srv *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD":
+			writeJSON(w, http.StatusOK, srv.SnapshotMetrics(false))
+		case "POST":
+			writeJSON(w, http.StatusOK, srv.SnapshotMetrics(true))
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+}
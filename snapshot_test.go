@@ -0,0 +1,35 @@
+package juggler
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	vars.Add("Msgs", 2)
+	vars.Add("ActiveConns", 1)
+	srv := &Server{Vars: vars}
+
+	w := httptest.NewRecorder()
+	MetricsHandler(srv).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "GET status code")
+	assert.JSONEq(t, `{"Msgs":2,"ActiveConns":1}`, w.Body.String(), "GET body")
+
+	w = httptest.NewRecorder()
+	MetricsHandler(srv).ServeHTTP(w, httptest.NewRequest("POST", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "POST status code")
+	assert.JSONEq(t, `{"Msgs":2,"ActiveConns":1}`, w.Body.String(), "POST body")
+	assert.Equal(t, map[string]int64{"Msgs": 0, "ActiveConns": 1}, srv.SnapshotMetrics(false), "after reset")
+
+	w = httptest.NewRecorder()
+	MetricsHandler(srv).ServeHTTP(w, httptest.NewRequest("DELETE", "/metrics", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code, "DELETE status code")
+
+	srv = &Server{}
+	assert.Equal(t, map[string]int64{}, srv.SnapshotMetrics(true), "no vars")
+}
@@ -0,0 +1,81 @@
+package juggler
+
+import (
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/message"
+)
+
+// subscription identifies a subscription of a pub-sub connection.
+type subscription struct {
+	channel string
+	pattern bool
+}
+
+// subscribe subscribes the connection to channel, which is treated as
+// a pattern if pattern is true, with the optional filter of the
+// events. The subscription is recorded so that its filter can be
+// applied to the events, and so that it can be restored if the pub-sub
+// connection is recovered in degraded mode.
+func (c *Conn) subscribe(channel string, pattern bool, filter message.Filter) error {
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+
+	if c.pscDown {
+		return errBrokerUnavailable
+	}
+	if err := c.psc.Subscribe(channel, pattern); err != nil {
+		return err
+	}
+	if c.subs == nil {
+		c.subs = make(map[subscription]message.Filter)
+	}
+	c.subs[subscription{channel, pattern}] = filter
+	return nil
+}
+
+// unsubscribe unsubscribes the connection from channel, which is
+// treated as a pattern if pattern is true.
+func (c *Conn) unsubscribe(channel string, pattern bool) error {
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+
+	if c.pscDown {
+		return errBrokerUnavailable
+	}
+	if err := c.psc.Unsubscribe(channel, pattern); err != nil {
+		return err
+	}
+	delete(c.subs, subscription{channel, pattern})
+	return nil
+}
+
+// matchSubscription returns true if the event m matches the filter of
+// the subscription that triggered it, if any. The events of the room
+// channels do not match the pattern subscriptions, they are only sent
+// to the members of the rooms.
+func (c *Conn) matchSubscription(m *message.Evnt) bool {
+	sub := subscription{m.Payload.Channel, false}
+	if m.Payload.Pattern != "" {
+		if isRoomChannel(m.Payload.Channel) {
+			return false
+		}
+		sub = subscription{m.Payload.Pattern, true}
+	}
+
+	c.bmu.Lock()
+	filter := c.subs[sub]
+	c.bmu.Unlock()
+
+	return filter.Match(m.Payload.Args)
+}
+
+// replay returns the events published on the durable channel after the
+// event identified by lastID, if the PubSubBroker supports it (see
+// broker.ReplayBroker).
+func (c *Conn) replay(channel, lastID string) ([]*message.EvntPayload, error) {
+	rb, ok := c.srv.PubSubBroker.(broker.ReplayBroker)
+	if !ok {
+		return nil, nil
+	}
+	return rb.Replay(channel, lastID)
+}
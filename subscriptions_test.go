@@ -0,0 +1,113 @@
+package juggler
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"testing"
+
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscriptionFilter(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		PubSubBroker: &fakePubSubBroker{},
+		Vars:         vars,
+	}
+	cli, c, recv, closeFn := dialConn(t, server, "sub")
+	defer closeFn()
+
+	_, err := cli.SubFilter("a", false, message.Filter{"user": json.RawMessage(`"x"`)})
+	require.NoError(t, err, "SubFilter")
+	_, ok := recv(1)[message.AckMsg]
+	require.True(t, ok, "ACK")
+
+	newEvnt := func(channel, pattern, args string) *message.Evnt {
+		return message.NewEvnt(&message.EvntPayload{
+			MsgUUID: uuid.NewRandom(),
+			Channel: channel,
+			Pattern: pattern,
+			Args:    json.RawMessage(args),
+		})
+	}
+	c.Send(newEvnt("a", "", `{"user":"y"}`))
+	c.Send(newEvnt("a", "", `{"user":"x","v":1}`))
+	if m, ok := recv(1)[message.EvntMsg]; assert.True(t, ok, "EVNT") {
+		assert.Equal(t, `{"user":"x","v":1}`, string(m.(*message.Evnt).Payload.Args), "args")
+	}
+	assert.Equal(t, "1", vars.Get("UnmatchedEvnts").String(), "unmatched events")
+
+	// events of other subscriptions are not filtered
+	c.Send(newEvnt("b", "b*", `{"user":"y"}`))
+	if m, ok := recv(1)[message.EvntMsg]; assert.True(t, ok, "EVNT of pattern") {
+		assert.Equal(t, "b", m.(*message.Evnt).Payload.Channel, "channel")
+	}
+
+	// a new subscription replaces the filter
+	_, err = cli.Sub("a", false)
+	require.NoError(t, err, "Sub")
+	_, ok = recv(1)[message.AckMsg]
+	require.True(t, ok, "ACK")
+	c.Send(newEvnt("a", "", `{"user":"y"}`))
+	if m, ok := recv(1)[message.EvntMsg]; assert.True(t, ok, "EVNT without filter") {
+		assert.Equal(t, `{"user":"y"}`, string(m.(*message.Evnt).Payload.Args), "args without filter")
+	}
+}
+
+type fakeReplayBroker struct {
+	fakePubSubBroker
+	lastID string
+	events []*message.EvntPayload
+	err    error
+}
+
+func (f *fakeReplayBroker) Replay(channel, lastID string) ([]*message.EvntPayload, error) {
+	f.lastID = lastID
+	return f.events, f.err
+}
+
+func TestSubscriptionReplay(t *testing.T) {
+	vars := new(expvar.Map).Init()
+	brk := &fakeReplayBroker{
+		events: []*message.EvntPayload{
+			{MsgUUID: uuid.NewRandom(), Channel: "a", EventID: "2-0", Args: json.RawMessage(`1`)},
+			{MsgUUID: uuid.NewRandom(), Channel: "a", EventID: "3-0", Args: json.RawMessage(`2`)},
+		},
+	}
+	server := &Server{
+		CallerBroker: &fakeCallerBroker{},
+		PubSubBroker: brk,
+		Vars:         vars,
+	}
+	cli, recv, closeFn := dialAllowed(t, server, "sub")
+	defer closeFn()
+
+	// no replay without a last event ID
+	_, err := cli.Sub("a", false)
+	require.NoError(t, err, "Sub")
+	_, ok := recv(1)[message.AckMsg]
+	require.True(t, ok, "ACK")
+
+	_, err = cli.SubReplay("a", "1-0")
+	require.NoError(t, err, "SubReplay")
+	got := recv(3)
+	assert.NotNil(t, got[message.AckMsg], "ACK")
+	assert.Equal(t, "1-0", brk.lastID, "last event ID")
+	assert.Equal(t, "2", vars.Get("ReplayedEvnts").String(), "ReplayedEvnts")
+
+	// the client tracks the ID of the last event received
+	assert.Equal(t, "3-0", cli.LastEventID("a"), "LastEventID")
+
+	brk.err = io.ErrUnexpectedEOF
+	_, err = cli.SubReplay("a", "3-0")
+	require.NoError(t, err, "SubReplay with error")
+	if m, ok := recv(1)[message.NackMsg]; assert.True(t, ok, "NACK") {
+		assert.Equal(t, 500, m.(*message.Nack).Payload.Code, "NACK code")
+	}
+	assert.Equal(t, "1", vars.Get("FailedReplays").String(), "FailedReplays")
+}
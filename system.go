@@ -0,0 +1,247 @@
+package juggler
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mna/juggler/broker"
+	"github.com/mna/juggler/callee"
+	"github.com/mna/juggler/message"
+	"github.com/mna/juggler/metrics"
+	"github.com/pborman/uuid"
+)
+
+// Version is the version of the juggler server package, as returned
+// by the juggler.info system URI.
+const Version = "0.1.0"
+
+// SystemURIPrefix is the reserved prefix for the built-in system URIs.
+// Calls to URIs with this prefix are always executed in-process by the
+// server and are never sent to the CallerBroker. The following system
+// URIs are supported:
+//
+//     juggler.ping  : returns the server's current time, can be used to
+//                     check the round-trip time.
+//     juggler.info  : returns the server's version, supported protocols
+//                     and configured limits.
+//     juggler.stats : returns a selected set of the server's metrics,
+//                     if Server.Vars is set to an *expvar.Map.
+//
+// The following channel URIs are also supported if Server.ChannelURIs
+// is true and a Server.Authorizer is set, which must only allow them
+// for the clients that may know the channels of the others. They
+// require a PubSubBroker that implements broker.PubSubInfoBroker:
+//
+//     juggler.numsub : returns the number of subscribers of each
+//                     channel in the arguments (an array of channel
+//                     names), as an object with channel names as keys.
+//     juggler.channels : returns the active channels matching the
+//                     glob-style pattern in the arguments (a string,
+//                     all channels if null or empty).
+//
+// The following admin URIs are also supported if Server.AdminURIs is
+// true and a Server.Authorizer is set, which must only allow them for
+// the operators:
+//
+//     juggler.conns.list : returns the active connections served by the
+//                     server, as an array of ConnInfo.
+//     juggler.conn.kick : closes the connection identified by the UUID
+//                     in the arguments (a string), returns true if the
+//                     server was serving that connection.
+//
+const SystemURIPrefix = "juggler."
+
+// errUnknownSystemURI is returned for calls to an unsupported URI with
+// the reserved SystemURIPrefix.
+var errUnknownSystemURI = errors.New("juggler: unknown system URI")
+
+// errNoPubSubInfo is returned for calls to the system URIs that require
+// a broker.PubSubInfoBroker when the PubSubBroker doesn't implement it.
+var errNoPubSubInfo = errors.New("juggler: broker does not support channel queries")
+
+// errKicked is the error set as CloseErr on the connections closed by
+// the juggler.conn.kick admin URI.
+var errKicked = errors.New("juggler: connection closed by an administrator")
+
+// statsVars is the list of server metrics returned by juggler.stats.
+var statsVars = []string{
+	"ActiveConns",
+	"TotalConns",
+	"ActiveConnGoros",
+	"Msgs",
+	"MsgsRead",
+	"MsgsWrite",
+	"LocalCalls",
+	"ExpiredLocalCalls",
+}
+
+// PingResult is the result of the juggler.ping system URI.
+type PingResult struct {
+	Time time.Time `json:"time"`
+}
+
+// InfoResult is the result of the juggler.info system URI. Durations
+// are in milliseconds.
+type InfoResult struct {
+	Version      string   `json:"version"`
+	Subprotocols []string `json:"subprotocols"`
+	ReadLimit    int64    `json:"read_limit"`
+	WriteLimit   int64    `json:"write_limit"`
+	ReadTimeout  int64    `json:"read_timeout"`
+	WriteTimeout int64    `json:"write_timeout"`
+}
+
+// ConnInfo is the description of a connection returned by the
+// juggler.conns.list admin URI. The RTT is in milliseconds.
+type ConnInfo struct {
+	UUID        string            `json:"uuid"`
+	RemoteAddr  string            `json:"remote_addr"`
+	Subprotocol string            `json:"subprotocol"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Rooms       []string          `json:"rooms,omitempty"`
+	RTT         int64             `json:"rtt"`
+}
+
+// isSystemURI returns true if uri has the reserved system prefix.
+func isSystemURI(uri string) bool {
+	return strings.HasPrefix(uri, SystemURIPrefix)
+}
+
+// systemCallee returns the in-process callee for the system uri, or
+// false if uri is not a supported system URI.
+func (srv *Server) systemCallee(uri string) (callee.Thunk, bool) {
+	switch strings.TrimPrefix(uri, SystemURIPrefix) {
+	case "ping":
+		return func(cp *message.CallPayload) (interface{}, error) {
+			return &PingResult{Time: time.Now().UTC()}, nil
+		}, true
+
+	case "info":
+		return func(cp *message.CallPayload) (interface{}, error) {
+			settings := srv.Settings()
+			return &InfoResult{
+				Version:      Version,
+				Subprotocols: Subprotocols,
+				ReadLimit:    settings.ReadLimit,
+				WriteLimit:   settings.WriteLimit,
+				ReadTimeout:  int64(settings.ReadTimeout / time.Millisecond),
+				WriteTimeout: int64(settings.WriteTimeout / time.Millisecond),
+			}, nil
+		}, true
+
+	case "stats":
+		return func(cp *message.CallPayload) (interface{}, error) {
+			stats := make(map[string]int64, len(statsVars))
+			vars, ok := srv.Vars.(interface {
+				Get(string) expvar.Var
+			})
+			if !ok || metrics.IsNil(srv.Vars) {
+				return stats, nil
+			}
+			for _, k := range statsVars {
+				if v := vars.Get(k); v != nil {
+					if iv, ok := v.(*expvar.Int); ok {
+						stats[k] = iv.Value()
+					}
+				}
+			}
+			return stats, nil
+		}, true
+	}
+	if srv.ChannelURIs && srv.Authorizer != nil {
+		if fn, ok := srv.channelCallee(uri); ok {
+			return fn, true
+		}
+	}
+	if srv.AdminURIs && srv.Authorizer != nil {
+		return srv.adminCallee(uri)
+	}
+	return nil, false
+}
+
+// channelCallee returns the in-process callee for the channel uri, or
+// false if uri is not a supported channel URI.
+func (srv *Server) channelCallee(uri string) (callee.Thunk, bool) {
+	switch strings.TrimPrefix(uri, SystemURIPrefix) {
+	case "numsub":
+		return func(cp *message.CallPayload) (interface{}, error) {
+			ib, ok := srv.PubSubBroker.(broker.PubSubInfoBroker)
+			if !ok {
+				return nil, errNoPubSubInfo
+			}
+			var channels []string
+			if err := unmarshalArgs(cp.Args, &channels); err != nil {
+				return nil, err
+			}
+			return ib.NumSub(channels...)
+		}, true
+
+	case "channels":
+		return func(cp *message.CallPayload) (interface{}, error) {
+			ib, ok := srv.PubSubBroker.(broker.PubSubInfoBroker)
+			if !ok {
+				return nil, errNoPubSubInfo
+			}
+			var pattern string
+			if err := unmarshalArgs(cp.Args, &pattern); err != nil {
+				return nil, err
+			}
+			return ib.Channels(pattern)
+		}, true
+	}
+	return nil, false
+}
+
+// adminCallee returns the in-process callee for the admin uri, or
+// false if uri is not a supported admin URI.
+func (srv *Server) adminCallee(uri string) (callee.Thunk, bool) {
+	switch strings.TrimPrefix(uri, SystemURIPrefix) {
+	case "conns.list":
+		return func(cp *message.CallPayload) (interface{}, error) {
+			conns := srv.Conns()
+			infos := make([]ConnInfo, 0, len(conns))
+			for _, c := range conns {
+				infos = append(infos, ConnInfo{
+					UUID:        c.UUID.String(),
+					RemoteAddr:  c.RemoteAddr().String(),
+					Subprotocol: c.Subprotocol(),
+					Tags:        c.Tags(),
+					Rooms:       c.Rooms(),
+					RTT:         int64(c.RTT() / time.Millisecond),
+				})
+			}
+			return infos, nil
+		}, true
+
+	case "conn.kick":
+		return func(cp *message.CallPayload) (interface{}, error) {
+			var id string
+			if err := unmarshalArgs(cp.Args, &id); err != nil {
+				return nil, err
+			}
+			connUUID := uuid.Parse(id)
+			if connUUID == nil {
+				return nil, fmt.Errorf("juggler: invalid connection UUID %q", id)
+			}
+			c, ok := srv.ConnByUUID(connUUID)
+			if ok {
+				c.Close(errKicked)
+			}
+			return ok, nil
+		}, true
+	}
+	return nil, false
+}
+
+// unmarshalArgs unmarshals the call arguments in v. Missing arguments
+// leave v untouched.
+func unmarshalArgs(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	return json.Unmarshal(args, v)
+}
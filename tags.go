@@ -0,0 +1,110 @@
+package juggler
+
+import (
+	"encoding/json"
+
+	"github.com/mna/juggler/message"
+	"github.com/pborman/uuid"
+)
+
+// SetTag attaches the tag key with the specified value to the
+// connection, replacing any existing value. Tags can be used to
+// select connections, e.g. to send messages to all connections of
+// a given user (see Server.SendTagged and Server.PublishTagged).
+func (c *Conn) SetTag(key, value string) {
+	c.tmu.Lock()
+	if c.tags == nil {
+		c.tags = make(map[string]string)
+	}
+	c.tags[key] = value
+	c.tmu.Unlock()
+}
+
+// DeleteTag removes the tag key from the connection.
+func (c *Conn) DeleteTag(key string) {
+	c.tmu.Lock()
+	delete(c.tags, key)
+	c.tmu.Unlock()
+}
+
+// Tag returns the value of the tag key attached to the connection,
+// and false if the tag is not set.
+func (c *Conn) Tag(key string) (string, bool) {
+	c.tmu.Lock()
+	v, ok := c.tags[key]
+	c.tmu.Unlock()
+	return v, ok
+}
+
+// Tags returns a copy of the tags attached to the connection.
+func (c *Conn) Tags() map[string]string {
+	c.tmu.Lock()
+	tags := make(map[string]string, len(c.tags))
+	for k, v := range c.tags {
+		tags[k] = v
+	}
+	c.tmu.Unlock()
+	return tags
+}
+
+// TagSelector selects connections based on their tags. A connection
+// matches if it has all the tags of the selector, with the same
+// values. An empty value matches any value of the tag, as long as
+// the tag is set. An empty selector matches all connections.
+type TagSelector map[string]string
+
+// Matches returns true if the connection c matches the selector.
+func (s TagSelector) Matches(c *Conn) bool {
+	c.tmu.Lock()
+	defer c.tmu.Unlock()
+
+	for k, v := range s {
+		cv, ok := c.tags[k]
+		if !ok || (v != "" && cv != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectConns returns the active connections that match sel.
+func (srv *Server) selectConns(sel TagSelector) []*Conn {
+	conns := srv.conns.Conns()
+	matches := conns[:0]
+	for _, c := range conns {
+		if sel.Matches(c) {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
+
+// SendTagged sends the message m to all connections served by this
+// server that match sel. It returns the number of connections the
+// message was sent to. Only the connections of this server are
+// considered, it does not go through the brokers.
+func (srv *Server) SendTagged(sel TagSelector, m message.Msg) int {
+	conns := srv.selectConns(sel)
+	for _, c := range conns {
+		c.Send(m)
+	}
+	return len(conns)
+}
+
+// PublishTagged sends an event with v as arguments on channel to all
+// connections served by this server that match sel, as if it had been
+// published on that channel, regardless of the connections'
+// subscriptions. It returns the number of connections the event was
+// sent to.
+func (srv *Server) PublishTagged(sel TagSelector, channel string, v interface{}) (int, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	ep := &message.EvntPayload{
+		MsgUUID: uuid.NewRandom(),
+		Channel: channel,
+		Args:    b,
+	}
+	return srv.SendTagged(sel, message.NewEvnt(ep)), nil
+}
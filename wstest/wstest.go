@@ -1,5 +1,9 @@
 // Package wstest provides test helpers for dealing with websocket
-// servers and connections.
+// servers and connections. It is used by the juggler packages' own
+// tests and can be used by custom handlers, clients or transports
+// that need the same test doubles: a server that runs a function on
+// each connection, a server that records the messages it receives,
+// and a Dial helper.
 package wstest
 
 import (
@@ -18,7 +22,7 @@ import (
 // websocket connection for each request it receives. It sends true on the
 // done channel when the connection is terminated. The server should
 // be closed by the caller.
-func StartServer(t *testing.T, done chan<- bool, fn func(*websocket.Conn)) *httptest.Server {
+func StartServer(t testing.TB, done chan<- bool, fn func(*websocket.Conn)) *httptest.Server {
 	upg := &websocket.Upgrader{}
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		wsConn, err := upg.Upgrade(w, r, nil)
@@ -41,7 +45,7 @@ func StartServer(t *testing.T, done chan<- bool, fn func(*websocket.Conn)) *http
 // w. It sends true on the done channel when the connection is
 // terminated. Control messages are ignored. The server should
 // be closed by the caller.
-func StartRecordingServer(t *testing.T, done chan<- bool, w io.Writer) *httptest.Server {
+func StartRecordingServer(t testing.TB, done chan<- bool, w io.Writer) *httptest.Server {
 	srv := StartServer(t, done, func(c *websocket.Conn) {
 		for {
 			_, r, err := c.NextReader()
@@ -60,7 +64,7 @@ func StartRecordingServer(t *testing.T, done chan<- bool, w io.Writer) *httptest
 // Dial starts a new connection to urlStr and returns the created
 // websocket connection. If urlStr uses an http: scheme, it is replaced
 // by ws:. The connection should be closed by the caller.
-func Dial(t *testing.T, urlStr string) *websocket.Conn {
+func Dial(t testing.TB, urlStr string) *websocket.Conn {
 	var d websocket.Dialer
 	c, res, err := d.Dial(strings.Replace(urlStr, "http:", "ws:", 1), nil)
 	require.NoError(t, err, "Dial")